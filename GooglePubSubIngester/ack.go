@@ -0,0 +1,113 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingest/v3/processors"
+)
+
+const (
+	ackInterval    = time.Second
+	ackSyncTimeout = 10 * time.Second
+	maxPendingAcks = 4096
+	ackChanSize    = 2048
+)
+
+type pendingMsg struct {
+	ent *entry.Entry
+	msg *pubsub.Message
+}
+
+// ackProcessor sends entries through the processor set and only acks their messages once the
+// muxer has synced, so a message is never acknowledged before its entry reached the indexers.
+// Messages stay outstanding until then, Pub/Sub keeps extending their ack deadlines and the
+// flow control limits stop delivery while too many are waiting.  If the muxer cannot sync the
+// messages are kept and acked after a later sync.
+type ackProcessor struct {
+	igst    *ingest.IngestMuxer
+	proc    *processors.ProcessorSet
+	c       chan pendingMsg
+	pending []*pubsub.Message
+	done    chan struct{}
+	count   *uint64
+	size    *uint64
+}
+
+func newAckProcessor(igst *ingest.IngestMuxer, proc *processors.ProcessorSet, count, size *uint64) *ackProcessor {
+	ap := &ackProcessor{
+		igst:  igst,
+		proc:  proc,
+		c:     make(chan pendingMsg, ackChanSize),
+		done:  make(chan struct{}),
+		count: count,
+		size:  size,
+	}
+	go ap.run()
+	return ap
+}
+
+// add is called from the receive callbacks
+func (ap *ackProcessor) add(ent *entry.Entry, msg *pubsub.Message) {
+	ap.c <- pendingMsg{ent: ent, msg: msg}
+}
+
+// Close acks the remaining messages and closes the processor set, the receive callbacks must have returned
+func (ap *ackProcessor) Close() {
+	close(ap.c)
+	<-ap.done
+}
+
+func (ap *ackProcessor) run() {
+	defer close(ap.done)
+	tkr := time.NewTicker(ackInterval)
+	defer tkr.Stop()
+	for {
+		select {
+		case pm, ok := <-ap.c:
+			if !ok {
+				ap.ack()
+				if err := ap.proc.Close(); err != nil {
+					lg.Error("Failed to close processor set: %v", err)
+				}
+				return
+			}
+			if err := ap.proc.Process(pm.ent); err != nil {
+				lg.Error("Can't process entry: %v", err)
+				pm.msg.Nack()
+				continue
+			}
+			*ap.count++
+			*ap.size += uint64(len(pm.ent.Data))
+			if ap.pending = append(ap.pending, pm.msg); len(ap.pending) >= maxPendingAcks {
+				ap.ack()
+			}
+		case <-tkr.C:
+			ap.ack()
+		}
+	}
+}
+
+func (ap *ackProcessor) ack() {
+	if len(ap.pending) == 0 {
+		return
+	}
+	if err := ap.igst.Sync(ackSyncTimeout); err != nil {
+		lg.Warn("Delaying %d acks, failed to sync the ingester: %v", len(ap.pending), err)
+		return
+	}
+	for _, msg := range ap.pending {
+		msg.Ack()
+	}
+	ap.pending = ap.pending[:0]
+}
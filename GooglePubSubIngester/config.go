@@ -33,12 +33,15 @@ type global struct {
 }
 
 type pubsubconf struct {
-	Topic_Name            string
-	Tag_Name              string
-	Assume_Local_Timezone bool
-	Timezone_Override     string
-	Parse_Time            bool
-	Preprocessor          []string
+	Topic_Name               string
+	Subscription_Name        string //existing subscription to read, defaults to ingest_<Topic-Name>
+	Tag_Name                 string
+	Max_Outstanding_Messages int //flow control, unacknowledged messages held at once
+	Max_Outstanding_Bytes    int
+	Assume_Local_Timezone    bool
+	Timezone_Override        string
+	Parse_Time               bool
+	Preprocessor             []string
 }
 
 type cfgType struct {
@@ -98,6 +101,13 @@ func verifyConfig(c cfgType) error {
 		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
 			return fmt.Errorf("pubsub stream %s preprocessor invalid: %v", k, err)
 		}
+		if v.Topic_Name == `` && v.Subscription_Name == `` {
+			return fmt.Errorf("pubsub stream %s requires a Topic-Name or Subscription-Name", k)
+		} else if v.Tag_Name == `` {
+			return fmt.Errorf("pubsub stream %s requires a Tag-Name", k)
+		} else if v.Max_Outstanding_Messages < 0 || v.Max_Outstanding_Bytes < 0 {
+			return fmt.Errorf("pubsub stream %s has a negative flow control limit", k)
+		}
 	}
 	return nil
 }
@@ -137,6 +147,14 @@ func (c *cfgType) Tags() ([]string, error) {
 	return tags, nil
 }
 
+// subscription returns the name of the subscription to read
+func (p *pubsubconf) subscription() string {
+	if p.Subscription_Name != `` {
+		return p.Subscription_Name
+	}
+	return fmt.Sprintf("ingest_%s", p.Topic_Name)
+}
+
 func (c *cfgType) VerifyRemote() bool {
 	return c.Global.Verify_Remote_Certificates
 }
@@ -15,6 +15,7 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
 	"syscall"
 	"time"
 
@@ -150,6 +151,17 @@ func main() {
 		return
 	}
 
+	var src net.IP
+	if cfg.Global.Source_Override != `` {
+		// global override
+		src = net.ParseIP(cfg.Global.Source_Override)
+		if src == nil {
+			lg.Fatal("Global Source-Override is invalid")
+		}
+	}
+
+	rctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
 	for _, psv := range cfg.PubSub {
 		tagid, err := igst.GetTag(psv.Tag_Name)
 		if err != nil {
@@ -161,24 +173,26 @@ func main() {
 			lg.Fatal("Preprocessor construction error: %v", err)
 		}
 
-		// get the topic
-		topic := client.Topic(psv.Topic_Name)
-		ok, err := topic.Exists(ctx)
-		if err != nil {
-			lg.Fatal("Error checking topic: %v", err)
-		}
-		if !ok {
-			lg.Fatal("Topic %v doesn't exist", psv.Topic_Name)
-		}
-
-		// Get the subscription, creating if needed
-		subname := fmt.Sprintf("ingest_%s", psv.Topic_Name)
+		// Get the subscription, creating it on the topic if needed
+		subname := psv.subscription()
 		sub := client.Subscription(subname)
 		ok, err = sub.Exists(ctx)
 		if err != nil {
 			lg.Fatal("Error checking subscription existence: %v", err)
 		}
 		if !ok {
+			if psv.Topic_Name == `` {
+				lg.Fatal("Subscription %v doesn't exist and no Topic-Name was given to create it", subname)
+			}
+			// get the topic
+			topic := client.Topic(psv.Topic_Name)
+			ok, err := topic.Exists(ctx)
+			if err != nil {
+				lg.Fatal("Error checking topic: %v", err)
+			}
+			if !ok {
+				lg.Fatal("Topic %v doesn't exist", psv.Topic_Name)
+			}
 			// doesn't exist, try creating it
 			sub, err = client.CreateSubscription(ctx, subname, pubsub.SubscriptionConfig{
 				Topic:       topic,
@@ -188,6 +202,12 @@ func main() {
 				lg.Fatal("Error creating subscription: %v", err)
 			}
 		}
+		if psv.Max_Outstanding_Messages > 0 {
+			sub.ReceiveSettings.MaxOutstandingMessages = psv.Max_Outstanding_Messages
+		}
+		if psv.Max_Outstanding_Bytes > 0 {
+			sub.ReceiveSettings.MaxOutstandingBytes = psv.Max_Outstanding_Bytes
+		}
 
 		var count, size uint64
 		var oldcount, oldsize uint64
@@ -207,19 +227,10 @@ func main() {
 			}()
 		}
 
-		go func(sub *pubsub.Subscription, tagid entry.EntryTag, ps *pubsubconf) {
-			eChan := make(chan *entry.Entry, 2048)
-			go func(c chan *entry.Entry) {
-				for e := range c {
-					if err := procset.Process(e); err != nil {
-						lg.Error("Can't process entry: %v", err)
-					}
-					count++
-				}
-				if err := procset.Close(); err != nil {
-					lg.Error("Failed to close processor set: %v", err)
-				}
-			}(eChan)
+		wg.Add(1)
+		go func(sub *pubsub.Subscription, tagid entry.EntryTag, ps *pubsubconf, ap *ackProcessor) {
+			defer wg.Done()
+			defer ap.Close()
 			tcfg := timegrinder.Config{
 				EnableLeftMostSeed: true,
 			}
@@ -238,49 +249,41 @@ func main() {
 				}
 			}
 
-			var src net.IP
-			if cfg.Global.Source_Override != `` {
-				// global override
-				src = net.ParseIP(cfg.Global.Source_Override)
-				if src == nil {
-					lg.Fatal("Global Source-Override is invalid")
+			callback := func(ctx context.Context, msg *pubsub.Message) {
+				ent := &entry.Entry{
+					Data: msg.Data,
+					Tag:  tagid,
+					SRC:  src,
 				}
-			}
-
-			for {
-				callback := func(ctx context.Context, msg *pubsub.Message) {
-					ent := &entry.Entry{
-						Data: msg.Data,
-						Tag:  tagid,
-						SRC:  src,
-					}
-					size += uint64(len(msg.Data))
-					if ps.Parse_Time == false {
+				if ps.Parse_Time == false {
+					ent.TS = entry.FromStandard(msg.PublishTime)
+				} else {
+					ts, ok, err := tg.Extract(msg.Data)
+					if !ok || err != nil {
+						// failed to extract, use the publishtime
+						ps.Parse_Time = false
 						ent.TS = entry.FromStandard(msg.PublishTime)
 					} else {
-						ts, ok, err := tg.Extract(msg.Data)
-						if !ok || err != nil {
-							// failed to extract, use the publishtime
-							ps.Parse_Time = false
-							ent.TS = entry.FromStandard(msg.PublishTime)
-						} else {
-							ent.TS = entry.FromStandard(ts)
-						}
+						ent.TS = entry.FromStandard(ts)
 					}
-					eChan <- ent
-					msg.Ack()
 				}
-				cctx, cancel := context.WithCancel(ctx)
-				defer cancel()
-				if err := sub.Receive(cctx, callback); err != nil {
-					lg.Error("Receive failed: %v", err)
+				// the message is acked once the entry has been ingested
+				ap.add(ent, msg)
+			}
+			// Receive returns on shutdown after the callbacks return, or on a non-retryable error
+			for rctx.Err() == nil {
+				if err := sub.Receive(rctx, callback); err != nil {
+					lg.Error("Receive failed on %v: %v", sub.ID(), err)
+					time.Sleep(time.Second)
 				}
 			}
-		}(sub, tagid, psv)
+		}(sub, tagid, psv, newAckProcessor(igst, procset, &count, &size))
 	}
 
 	//register quit signals so we can die gracefully
 	utils.WaitForQuit()
+	cancel()
+	wg.Wait()
 }
 
 func debugout(format string, args ...interface{}) {
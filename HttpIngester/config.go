@@ -28,6 +28,9 @@ const (
 	defaultLogLoc        = `/opt/gravwell/log/gravwell_http_ingester.log`
 
 	defaultMethod string = `POST`
+
+	defaultRetryAfter int = 30 //seconds
+	mb                int = 1024 * 1024
 )
 
 type gbl struct {
@@ -53,6 +56,9 @@ type lst struct {
 	Assume_Local_Timezone     bool
 	Timezone_Override         string
 	Timestamp_Format_Override string //override the timestamp format
+	Dead_Letter_Tag           string //optional tag for bodies with no timestamp or that preprocessors fail to parse
+	Backpressure_Threshold    int    //MB this listener accepts while no indexers are connected before we return 503
+	Retry_After               int    //seconds clients are asked to wait when backpressure is applied
 	Preprocessor              []string
 }
 
@@ -141,6 +147,11 @@ func verifyConfig(c *cfgType) error {
 		if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
 			return errors.New("Invalid characters in the \"" + v.Tag_Name + "\"Tag-Name for " + k)
 		}
+		if v.Dead_Letter_Tag != `` {
+			if err := ingest.CheckTag(v.Dead_Letter_Tag); err != nil {
+				return fmt.Errorf("Invalid Dead-Letter-Tag for %s: %v", k, err)
+			}
+		}
 		//normalize the path
 		v.URL = pth
 		if v.Method == `` {
@@ -149,6 +160,11 @@ func verifyConfig(c *cfgType) error {
 		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
 			return fmt.Errorf("HTTP Listener %s preprocessor invalid: %v", k, err)
 		}
+		if v.Backpressure_Threshold < 0 {
+			return fmt.Errorf("HTTP Listener %s Backpressure-Threshold may not be negative", k)
+		} else if v.Retry_After < 0 {
+			return fmt.Errorf("HTTP Listener %s Retry-After may not be negative", k)
+		}
 		c.Listener[k] = v
 	}
 	if len(urls) == 0 {
@@ -161,12 +177,14 @@ func verifyConfig(c *cfgType) error {
 func (c *cfgType) Tags() (tags []string, err error) {
 	tagMp := make(map[string]bool, 1)
 	for _, v := range c.Listener {
-		if len(v.Tag_Name) == 0 {
-			continue
-		}
-		if _, ok := tagMp[v.Tag_Name]; !ok {
-			tags = append(tags, v.Tag_Name)
-			tagMp[v.Tag_Name] = true
+		for _, tag := range []string{v.Tag_Name, v.Dead_Letter_Tag} {
+			if len(tag) == 0 {
+				continue
+			}
+			if _, ok := tagMp[tag]; !ok {
+				tags = append(tags, tag)
+				tagMp[tag] = true
+			}
 		}
 	}
 	if len(tags) == 0 {
@@ -184,6 +202,19 @@ func (c *cfgType) MaxBody() int {
 	return c.Max_Body
 }
 
+// BackpressureThreshold returns the number of bytes the listener will accept while
+// there are no hot indexer connections, zero means backpressure is disabled
+func (l *lst) BackpressureThreshold() int64 {
+	return int64(l.Backpressure_Threshold) * int64(mb)
+}
+
+func (l *lst) RetryAfter() int {
+	if l.Retry_After <= 0 {
+		return defaultRetryAfter
+	}
+	return l.Retry_After
+}
+
 func (g gbl) ValidateTLS() (err error) {
 	if !g.TLSEnabled() {
 		//not enabled
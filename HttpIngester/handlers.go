@@ -9,8 +9,10 @@
 package main
 
 import (
+	"context"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/gravwell/ingest/v3"
@@ -27,13 +29,32 @@ type handlerConfig struct {
 	method   string
 	auth     authHandler
 	pproc    *processors.ProcessorSet
+
+	deadLetter    bool
+	deadLetterTag entry.EntryTag
+
+	bp         *backlog //nil when backpressure is disabled
+	retryAfter string   //seconds value for the Retry-After header
+}
+
+// backlog tracks the bytes a single listener has accepted while the muxer had no hot
+// connections, it drains back to zero as soon as an indexer connection is hot again
+type backlog struct {
+	threshold int64
+	unsent    int64
+}
+
+// muxer is the part of the ingest muxer the handler uses directly
+type muxer interface {
+	WriteEntry(*entry.Entry) error
+	Hot() (int, error)
 }
 
 type handler struct {
 	lgr  *log.Logger
 	mp   map[string]handlerConfig
 	auth map[string]authHandler
-	igst *ingest.IngestMuxer
+	igst muxer
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -64,6 +85,13 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if cfg.bp != nil && cfg.bp.full(h.igst) {
+		h.lgr.Warn("No hot indexer connections, refusing request from %s on %v", getRemoteIP(r), r.URL.Path)
+		w.Header().Set("Retry-After", cfg.retryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	b := make([]byte, maxBody)
 	n, err := readAll(r.Body, b)
 	if err != nil && err != io.EOF {
@@ -89,8 +117,16 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var ok bool
 		if hts, ok, err = cfg.tg.Extract(b); err != nil {
 			h.lgr.Warn("Catastrophic error from timegrinder: %v", err)
+			if cfg.deadLetter {
+				h.sendDeadLetter(cfg, b, r, "timestamp extraction error")
+				return
+			}
 			ts = entry.Now()
 		} else if !ok {
+			if cfg.deadLetter {
+				h.sendDeadLetter(cfg, b, r, "no timestamp found")
+				return
+			}
 			ts = entry.Now()
 		} else {
 			ts = entry.FromStandard(hts)
@@ -102,10 +138,75 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Tag:  cfg.tag,
 		Data: b,
 	}
+	if cfg.bp != nil {
+		cfg.bp.add(h.igst, len(b))
+	}
 	if err = cfg.pproc.Process(&e); err != nil {
-		h.lgr.Error("Failed to send entry: %v", err)
+		if _, failed := err.(writeError); cfg.deadLetter && !failed {
+			h.sendDeadLetter(cfg, b, r, err.Error())
+		} else {
+			h.lgr.Error("Failed to send entry: %v", err)
+		}
 	}
 	if v {
 		h.lgr.Info("Sending entry %s %s", ts.String(), string(b))
 	}
 }
+
+// full checks if the muxer has no hot connections and this listener has already
+// accepted at least threshold bytes since it went cold
+func (bl *backlog) full(igst muxer) bool {
+	if hot, err := igst.Hot(); err == nil && hot > 0 {
+		atomic.StoreInt64(&bl.unsent, 0)
+		return false
+	}
+	return atomic.LoadInt64(&bl.unsent) >= bl.threshold
+}
+
+// add records bytes accepted while there are no hot connections
+func (bl *backlog) add(igst muxer, n int) {
+	if hot, err := igst.Hot(); err == nil && hot > 0 {
+		atomic.StoreInt64(&bl.unsent, 0)
+	} else {
+		atomic.AddInt64(&bl.unsent, int64(n))
+	}
+}
+
+// muxWriter hands the muxer to the preprocessors and marks its write failures so
+// they are not mistaken for bodies the preprocessors could not handle
+type muxWriter struct {
+	*ingest.IngestMuxer
+}
+
+type writeError struct {
+	error
+}
+
+func (mw muxWriter) WriteEntry(e *entry.Entry) error {
+	if err := mw.IngestMuxer.WriteEntry(e); err != nil {
+		return writeError{err}
+	}
+	return nil
+}
+
+func (mw muxWriter) WriteEntryContext(ctx context.Context, e *entry.Entry) error {
+	if err := mw.IngestMuxer.WriteEntryContext(ctx, e); err != nil {
+		return writeError{err}
+	}
+	return nil
+}
+
+// sendDeadLetter writes the raw request body to the dead letter tag, bypassing
+// any preprocessors so that the original data is preserved while parsers are tuned
+func (h *handler) sendDeadLetter(cfg handlerConfig, b []byte, r *http.Request, reason string) {
+	h.lgr.Info("Routing body from %s on %v to dead letter tag: %s", getRemoteIP(r), r.URL.Path, reason)
+	e := entry.Entry{
+		TS:   entry.Now(),
+		SRC:  getRemoteIP(r),
+		Tag:  cfg.deadLetterTag,
+		Data: b,
+	}
+	if err := h.igst.WriteEntry(&e); err != nil {
+		h.lgr.Error("Failed to send dead letter entry: %v", err)
+	}
+}
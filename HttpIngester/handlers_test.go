@@ -0,0 +1,163 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingest/v3/log"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	testURL           = `/data`
+	testTag           = entry.EntryTag(1)
+	testDeadLetterTag = entry.EntryTag(2)
+)
+
+// fakeMuxer collects the entries written to it, writes fail with err when it is set
+type fakeMuxer struct {
+	hot  int
+	err  error
+	ents []*entry.Entry
+}
+
+func (fm *fakeMuxer) Hot() (int, error) { return fm.hot, nil }
+
+func (fm *fakeMuxer) WriteEntry(e *entry.Entry) error {
+	if fm.err != nil {
+		return fm.err
+	}
+	fm.ents = append(fm.ents, e)
+	return nil
+}
+
+func (fm *fakeMuxer) WriteEntryContext(ctx context.Context, e *entry.Entry) error {
+	return fm.WriteEntry(e)
+}
+
+func testHandler(t *testing.T, deadLetter bool) (*handler, *fakeMuxer) {
+	t.Helper()
+	maxBody = 1024
+	tg, err := timegrinder.NewTimeGrinder(timegrinder.Config{EnableLeftMostSeed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &fakeMuxer{hot: 1}
+	h := &handler{
+		lgr:  log.NewDiscardLogger(),
+		mp:   map[string]handlerConfig{},
+		auth: map[string]authHandler{},
+		igst: fm,
+	}
+	h.mp[testURL] = handlerConfig{
+		tag:           testTag,
+		tg:            tg,
+		method:        http.MethodPost,
+		pproc:         processors.NewProcessorSet(fm),
+		deadLetter:    deadLetter,
+		deadLetterTag: testDeadLetterTag,
+		retryAfter:    `30`,
+	}
+	return h, fm
+}
+
+func post(h *handler, url, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, url, strings.NewReader(body)))
+	return w
+}
+
+func TestDeadLetter(t *testing.T) {
+	stamped := `2020-01-02T03:04:05Z user logged in`
+	tests := []struct {
+		name       string
+		deadLetter bool
+		body       string
+		tag        entry.EntryTag
+		stamped    bool
+	}{
+		{name: `timestamp`, deadLetter: true, body: stamped, tag: testTag, stamped: true},
+		{name: `no timestamp`, deadLetter: true, body: `user logged in`, tag: testDeadLetterTag},
+		{name: `no dead letter tag`, body: `user logged in`, tag: testTag},
+	}
+	for _, tt := range tests {
+		h, fm := testHandler(t, tt.deadLetter)
+		if w := post(h, testURL, tt.body); w.Code != http.StatusOK {
+			t.Fatalf("%s returned %d", tt.name, w.Code)
+		} else if len(fm.ents) != 1 {
+			t.Fatalf("%s wrote %d entries", tt.name, len(fm.ents))
+		}
+		e := fm.ents[0]
+		if e.Tag != tt.tag || string(e.Data) != tt.body {
+			t.Fatalf("%s wrote %d %q", tt.name, e.Tag, e.Data)
+		} else if ts := e.TS.StandardTime(); tt.stamped != ts.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+			t.Fatalf("%s has timestamp %v", tt.name, ts)
+		}
+	}
+
+	//ignoring timestamps never dead letters a body
+	h, fm := testHandler(t, true)
+	cfg := h.mp[testURL]
+	cfg.ignoreTs, cfg.tg = true, nil
+	h.mp[testURL] = cfg
+	if post(h, testURL, `user logged in`); len(fm.ents) != 1 || fm.ents[0].Tag != testTag {
+		t.Fatalf("bad entries when ignoring timestamps %+v", fm.ents)
+	}
+
+	//a muxer that cannot take the entry is not a parse failure
+	h, fm = testHandler(t, true)
+	cfg = h.mp[testURL]
+	cfg.pproc = processors.NewProcessorSet(&fakeMuxer{err: writeError{errors.New(`not running`)}})
+	h.mp[testURL] = cfg
+	if post(h, testURL, stamped); len(fm.ents) != 0 {
+		t.Fatalf("write failure was dead lettered %+v", fm.ents)
+	}
+}
+
+func TestHandlerRequests(t *testing.T) {
+	h, fm := testHandler(t, false)
+	if w := post(h, `/other`, `data`); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown URL returned %d", w.Code)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPut, testURL, strings.NewReader(`data`)))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("wrong method returned %d", w.Code)
+	}
+	if w = post(h, testURL, ``); w.Code != http.StatusBadRequest {
+		t.Fatalf("empty body returned %d", w.Code)
+	} else if w = post(h, testURL, strings.Repeat(`x`, maxBody)); w.Code != http.StatusBadRequest {
+		t.Fatalf("oversized body returned %d", w.Code)
+	} else if len(fm.ents) != 0 {
+		t.Fatalf("bad requests wrote %d entries", len(fm.ents))
+	}
+
+	//with no hot connections the listener refuses bodies once its backlog is full
+	cfg := h.mp[testURL]
+	cfg.bp = &backlog{threshold: 8}
+	h.mp[testURL] = cfg
+	fm.hot = 0
+	if w = post(h, testURL, `0123456789`); w.Code != http.StatusOK {
+		t.Fatalf("first body returned %d", w.Code)
+	} else if w = post(h, testURL, `0123456789`); w.Code != http.StatusServiceUnavailable || w.Header().Get(`Retry-After`) != `30` {
+		t.Fatalf("full backlog returned %d %v", w.Code, w.Header())
+	}
+	fm.hot = 1
+	if w = post(h, testURL, `0123456789`); w.Code != http.StatusOK || len(fm.ents) != 2 {
+		t.Fatalf("hot muxer returned %d with %d entries", w.Code, len(fm.ents))
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -169,11 +170,21 @@ func main() {
 				}
 			}
 		}
+		if v.Dead_Letter_Tag != `` {
+			if hcfg.deadLetterTag, err = igst.GetTag(v.Dead_Letter_Tag); err != nil {
+				lg.Fatal("Failed to pull dead letter tag %v: %v", v.Dead_Letter_Tag, err)
+			}
+			hcfg.deadLetter = true
+		}
+		if th := v.BackpressureThreshold(); th > 0 {
+			hcfg.bp = &backlog{threshold: th}
+		}
+		hcfg.retryAfter = strconv.Itoa(v.RetryAfter())
 		if hcfg.method = v.Method; hcfg.method == `` {
 			hcfg.method = defaultMethod
 		}
 
-		hcfg.pproc, err = cfg.Preprocessor.ProcessorSet(igst, v.Preprocessor)
+		hcfg.pproc, err = cfg.Preprocessor.ProcessorSet(muxWriter{igst}, v.Preprocessor)
 		if err != nil {
 			lg.Fatal("Preprocessor construction error: %v", err)
 		}
@@ -0,0 +1,332 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/gravwell/ingesters/v3/utils"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	checkpointInterval    = 15 * time.Second
+	leaseRetryInterval    = 10 * time.Second
+	checkpointSyncTimeout = 10 * time.Second
+	boltOpenTimeout       = time.Second
+)
+
+type shardKey struct {
+	stream, shard string
+}
+
+// checkpointStore persists the sequence number of the last record handled on each shard
+type checkpointStore interface {
+	load(k shardKey) (string, error)
+	store(cps map[shardKey]string) error
+	Close() error
+}
+
+// leaser hands out shard leases so several ingesters can share a stream, only the holder
+// of a lease reads the shard and stores its checkpoints
+type leaser interface {
+	setShardCount(stream string, n int)
+	acquire(k shardKey) bool
+	held(k shardKey) bool
+	release(k shardKey)
+	start()
+	Close() error
+}
+
+// stateman tracks the sequence numbers of handled records and periodically checkpoints them.
+// The ingest muxer is synced before a checkpoint is stored, so a restarted ingester resumes
+// after the last record the indexers acknowledged: records may be read twice after a crash
+// but they are never skipped.
+type stateman struct {
+	sync.Mutex
+	flushMtx sync.Mutex
+	states   map[shardKey]string //sequence numbers that are not stored yet
+	cs       checkpointStore
+	leases   leaser //nil when the shards are not shared with other ingesters
+	sync     func() error
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newStateman opens the configured checkpoint store, owner identifies this ingester in shard leases
+func newStateman(cfg *cfgType, sess *session.Session, owner string) (*stateman, error) {
+	s := &stateman{
+		states: make(map[shardKey]string),
+	}
+	typ, err := cfg.checkpointType()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case checkpointFile:
+		s.cs, err = newFileStore(cfg.Global.State_Store_Location)
+	case checkpointBolt:
+		s.cs, err = newBoltStore(cfg.Global.Checkpoint_File, cfg.Global.State_Store_Location)
+	case checkpointDynamo:
+		var d time.Duration
+		if d, err = cfg.leaseDuration(); err != nil {
+			return nil, err
+		}
+		db := dynamodb.New(sess, aws.NewConfig().WithRegion(cfg.Global.Checkpoint_Region))
+		var dc *dynamoCheckpoints
+		if dc, err = newDynamoCheckpoints(db, cfg.Global.Checkpoint_Table, owner, d); err == nil {
+			s.cs, s.leases = dc, dc
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SetSync sets the function used to make sure handled records have been ingested before they are checkpointed
+func (s *stateman) SetSync(f func() error) {
+	s.Lock()
+	s.sync = f
+	s.Unlock()
+}
+
+func (s *stateman) Start() {
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		tkr := time.NewTicker(checkpointInterval)
+		defer tkr.Stop()
+		for {
+			select {
+			case <-tkr.C:
+				if err := s.Flush(); err != nil {
+					lg.Error("Failed to store checkpoints: %v", err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	if s.leases != nil {
+		s.leases.start()
+	}
+}
+
+func (s *stateman) Close() (err error) {
+	if s.done != nil {
+		close(s.done)
+		s.wg.Wait()
+		s.done = nil
+	}
+	err = s.Flush()
+	if s.leases != nil {
+		if lerr := s.leases.Close(); err == nil {
+			err = lerr
+		}
+	}
+	if lerr := s.cs.Close(); err == nil {
+		err = lerr
+	}
+	return
+}
+
+// Flush stores the pending checkpoints, checkpoints that could not be stored are retried on the next flush
+func (s *stateman) Flush() (err error) {
+	s.flushMtx.Lock()
+	defer s.flushMtx.Unlock()
+	s.Lock()
+	pending, syncFn := s.states, s.sync
+	s.states = make(map[shardKey]string)
+	s.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if syncFn != nil {
+		err = syncFn()
+	}
+	if err == nil {
+		err = s.cs.store(pending)
+	}
+	if err != nil {
+		//put them back unless newer sequence numbers showed up in the meantime
+		s.Lock()
+		for k, v := range pending {
+			if _, ok := s.states[k]; !ok {
+				s.states[k] = v
+			}
+		}
+		s.Unlock()
+	}
+	return
+}
+
+func (s *stateman) UpdateSequenceNum(stream, shard, seq string) {
+	s.Lock()
+	s.states[shardKey{stream: stream, shard: shard}] = seq
+	s.Unlock()
+}
+
+func (s *stateman) GetSequenceNum(stream, shard string) string {
+	k := shardKey{stream: stream, shard: shard}
+	s.Lock()
+	seq, ok := s.states[k]
+	s.Unlock()
+	if ok {
+		return seq
+	}
+	seq, err := s.cs.load(k)
+	if err != nil {
+		lg.Error("Failed to load checkpoint for stream %s shard %s: %v", stream, shard, err)
+	}
+	return seq
+}
+
+// SetShardCount tells the lease manager how many open shards a stream has
+func (s *stateman) SetShardCount(stream string, n int) {
+	if s.leases != nil {
+		s.leases.setShardCount(stream, n)
+	}
+}
+
+// Acquire takes the lease on a shard, it always succeeds when shards are not shared
+func (s *stateman) Acquire(stream, shard string) bool {
+	return s.leases == nil || s.leases.acquire(shardKey{stream: stream, shard: shard})
+}
+
+// Held returns false once the lease on a shard has been lost or given up to balance the shards
+func (s *stateman) Held(stream, shard string) bool {
+	return s.leases == nil || s.leases.held(shardKey{stream: stream, shard: shard})
+}
+
+// Release stores the checkpoints and hands the shard back so another ingester can pick it up
+func (s *stateman) Release(stream, shard string) {
+	if s.leases == nil {
+		return
+	}
+	if err := s.Flush(); err != nil {
+		lg.Error("Failed to store checkpoints: %v", err)
+	}
+	s.leases.release(shardKey{stream: stream, shard: shard})
+}
+
+// fileStore keeps the checkpoints in the State-Store-Location file
+type fileStore struct {
+	sync.Mutex
+	state  *utils.State
+	states map[string]map[string]string // map of stream name to shard name to sequence number
+}
+
+func newFileStore(pth string) (*fileStore, error) {
+	state, err := utils.NewState(pth, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fs := &fileStore{
+		state:  state,
+		states: make(map[string]map[string]string),
+	}
+	if err = state.Read(&fs.states); err != nil && err != utils.ErrNoState {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *fileStore) load(k shardKey) (string, error) {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.states[k.stream][k.shard], nil
+}
+
+func (fs *fileStore) store(cps map[shardKey]string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	for k, v := range cps {
+		if _, ok := fs.states[k.stream]; !ok {
+			fs.states[k.stream] = make(map[string]string)
+		}
+		fs.states[k.stream][k.shard] = v
+	}
+	return fs.state.Write(fs.states)
+}
+
+func (fs *fileStore) Close() error {
+	return nil
+}
+
+// boltStore keeps the checkpoints in a bolt database with a bucket per stream.  The database
+// is locked while it is open, so a second ingester cannot use the same checkpoints.
+type boltStore struct {
+	db *bbolt.DB
+}
+
+// newBoltStore opens the database, a new database starts from the checkpoints in the legacy state file if there is one
+func newBoltStore(pth, legacy string) (*boltStore, error) {
+	db, err := bbolt.Open(pth, 0600, &bbolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+	bs := &boltStore{db: db}
+	var empty bool
+	db.View(func(tx *bbolt.Tx) error {
+		k, _ := tx.Cursor().First()
+		empty = k == nil
+		return nil
+	})
+	if _, err = os.Stat(legacy); empty && err == nil {
+		fs, err := newFileStore(legacy)
+		if err == nil {
+			cps := make(map[shardKey]string)
+			for stream, shards := range fs.states {
+				for shard, seq := range shards {
+					cps[shardKey{stream: stream, shard: shard}] = seq
+				}
+			}
+			err = bs.store(cps)
+		}
+		if err != nil {
+			lg.Warn("Failed to import checkpoints from %s: %v", legacy, err)
+		}
+	}
+	return bs, nil
+}
+
+func (bs *boltStore) load(k shardKey) (seq string, err error) {
+	err = bs.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(k.stream)); b != nil {
+			seq = string(b.Get([]byte(k.shard)))
+		}
+		return nil
+	})
+	return
+}
+
+func (bs *boltStore) store(cps map[shardKey]string) error {
+	return bs.db.Update(func(tx *bbolt.Tx) error {
+		for k, v := range cps {
+			b, err := tx.CreateBucketIfNotExists([]byte(k.stream))
+			if err != nil {
+				return err
+			} else if err = b.Put([]byte(k.shard), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (bs *boltStore) Close() error {
+	return bs.db.Close()
+}
@@ -20,8 +20,23 @@ import (
 )
 
 const (
-	defaultStateStore = `/opt/gravwell/etc/kinesis_ingest.state`
-	defaultLogFile    = `/opt/gravwell/log/kinesis.log`
+	defaultStateStore   = `/opt/gravwell/etc/kinesis_ingest.state`
+	defaultLogFile      = `/opt/gravwell/log/kinesis.log`
+	defaultConsumerName = `gravwell`
+	defaultCheckpointDB = `/opt/gravwell/etc/kinesis_ingest.db`
+	defaultLeaseTime    = 30 * time.Second
+	minLeaseTime        = 5 * time.Second
+
+	checkpointFile   = `file`
+	checkpointBolt   = `bolt`
+	checkpointDynamo = `dynamodb`
+)
+
+var (
+	ErrInvalidCheckpointStore = errors.New("Checkpoint-Store must be file, bolt, or dynamodb")
+	ErrMissingCheckpointTable = errors.New("The dynamodb checkpoint store requires Checkpoint-Table and Checkpoint-Region")
+	ErrInvalidLeaseDuration   = fmt.Errorf("Lease-Duration must be a duration of at least %v", minLeaseTime)
+	ErrLeaseNoDynamo          = errors.New("Lease-Duration requires the dynamodb checkpoint store")
 )
 
 type bindType int
@@ -32,6 +47,11 @@ type global struct {
 	State_Store_Location  string
 	AWS_Access_Key_ID     string
 	AWS_Secret_Access_Key string
+	Checkpoint_Store      string //file, bolt, or dynamodb
+	Checkpoint_File       string //bolt database used by the bolt checkpoint store
+	Checkpoint_Table      string //DynamoDB table used by the dynamodb checkpoint store
+	Checkpoint_Region     string
+	Lease_Duration        string //how long a DynamoDB shard lease lasts without being renewed
 }
 
 type streamDef struct {
@@ -42,6 +62,8 @@ type streamDef struct {
 	Assume_Local_Timezone bool
 	Timezone_Override     string
 	Parse_Time            bool
+	Enhanced_Fan_Out      bool   //read shards with SubscribeToShard instead of GetRecords
+	Consumer_Name         string //name of the registered fan-out consumer
 	Preprocessor          []string
 }
 
@@ -63,6 +85,9 @@ func GetConfig(path string) (*cfgType, error) {
 	if c.Global.Log_File == `` {
 		c.Global.Log_File = defaultLogFile
 	}
+	if c.Global.Checkpoint_File == `` {
+		c.Global.Checkpoint_File = defaultCheckpointDB
+	}
 	if err := verifyConfig(c); err != nil {
 		return nil, err
 	} else if err = c.Global.Verify(); err != nil {
@@ -101,6 +126,11 @@ func verifyConfig(c cfgType) error {
 	if len(c.KinesisStream) == 0 {
 		return errors.New("At least one Kinesis stream required.")
 	}
+	if _, err := c.checkpointType(); err != nil {
+		return err
+	} else if _, err = c.leaseDuration(); err != nil {
+		return err
+	}
 	if err := c.Preprocessor.Validate(); err != nil {
 		return err
 	}
@@ -115,6 +145,13 @@ func verifyConfig(c cfgType) error {
 			// default to LATEST
 			v.Iterator_Type = "LATEST"
 		}
+		if v.Enhanced_Fan_Out {
+			if v.Consumer_Name == `` {
+				v.Consumer_Name = defaultConsumerName
+			}
+		} else if v.Consumer_Name != `` {
+			return fmt.Errorf("Kinesis stream %s: Consumer-Name requires Enhanced-Fan-Out", k)
+		}
 	}
 	return nil
 }
@@ -181,6 +218,34 @@ func (c *cfgType) CacheEnabled() bool {
 	return c.Global.Ingest_Cache_Path != ``
 }
 
+// checkpointType returns the checkpoint store, the default is the State-Store-Location file
+func (c *cfgType) checkpointType() (string, error) {
+	switch t := strings.ToLower(strings.TrimSpace(c.Global.Checkpoint_Store)); t {
+	case ``:
+		return checkpointFile, nil
+	case checkpointFile, checkpointBolt:
+		return t, nil
+	case checkpointDynamo:
+		if c.Global.Checkpoint_Table == `` || c.Global.Checkpoint_Region == `` {
+			return ``, ErrMissingCheckpointTable
+		}
+		return t, nil
+	}
+	return ``, ErrInvalidCheckpointStore
+}
+
+// leaseDuration returns how long DynamoDB shard leases last
+func (c *cfgType) leaseDuration() (d time.Duration, err error) {
+	if c.Global.Lease_Duration == `` {
+		return defaultLeaseTime, nil
+	} else if t, _ := c.checkpointType(); t != checkpointDynamo {
+		return 0, ErrLeaseNoDynamo
+	} else if d, err = time.ParseDuration(c.Global.Lease_Duration); err != nil || d < minLeaseTime {
+		return 0, ErrInvalidLeaseDuration
+	}
+	return
+}
+
 func (c *cfgType) parseTimeout() (time.Duration, error) {
 	tos := strings.TrimSpace(c.Global.Connection_Timeout)
 	if len(tos) == 0 {
@@ -0,0 +1,127 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+)
+
+const (
+	consumerPollInterval  = 5 * time.Second
+	consumerActiveTimeout = 5 * time.Minute
+	subscribeRetryDelay   = 5 * time.Second
+)
+
+// fanOutConsumer returns the ARN of the enhanced fan-out consumer with the given name on a
+// stream, the consumer is registered if it does not exist and the call blocks until it is active.
+// A shard can only have one subscription per consumer, so ingesters reading the same stream
+// need different consumer names unless they share the shards through DynamoDB leases.
+func fanOutConsumer(svc *kinesis.Kinesis, streamARN, name string) (string, error) {
+	dsci := &kinesis.DescribeStreamConsumerInput{}
+	dsci.SetStreamARN(streamARN)
+	dsci.SetConsumerName(name)
+	desc, err := svc.DescribeStreamConsumer(dsci)
+	if err != nil {
+		if !isAWSError(err, kinesis.ErrCodeResourceNotFoundException) {
+			return ``, err
+		}
+		rsci := &kinesis.RegisterStreamConsumerInput{}
+		rsci.SetStreamARN(streamARN)
+		rsci.SetConsumerName(name)
+		//another ingester may register the same consumer first, that's fine
+		if _, err = svc.RegisterStreamConsumer(rsci); err != nil && !isAWSError(err, kinesis.ErrCodeResourceInUseException) {
+			return ``, err
+		}
+		lg.Info("Registered enhanced fan-out consumer %s on %s", name, streamARN)
+	}
+	deadline := time.Now().Add(consumerActiveTimeout)
+	for {
+		if desc != nil && desc.ConsumerDescription != nil &&
+			aws.StringValue(desc.ConsumerDescription.ConsumerStatus) == kinesis.ConsumerStatusActive {
+			return aws.StringValue(desc.ConsumerDescription.ConsumerARN), nil
+		} else if time.Now().After(deadline) {
+			return ``, fmt.Errorf("consumer %s did not become active within %v", name, consumerActiveTimeout)
+		}
+		time.Sleep(consumerPollInterval)
+		if desc, err = svc.DescribeStreamConsumer(dsci); err != nil {
+			return ``, err
+		}
+	}
+}
+
+// fanOutShard reads a shard through an enhanced fan-out subscription, records are pushed to
+// the consumer over a dedicated connection so they don't count against the shared GetRecords
+// throughput of the stream.  Subscriptions expire after five minutes, the shard is resubscribed
+// from the last continuation sequence number until the shard closes or running returns false,
+// true is returned when the shard has been read to the end.
+func fanOutShard(svc *kinesis.Kinesis, sm *stateman, consumerARN string, stream *streamDef, shardID string, running func() bool, handle func([]*kinesis.Record)) bool {
+	for running() {
+		pos := &kinesis.StartingPosition{}
+		if seqnum := sm.GetSequenceNum(stream.Stream_Name, shardID); seqnum == `` {
+			debugout("No previous sequence number for stream %v shard %v, defaulting to %v\n", stream.Stream_Name, shardID, stream.Iterator_Type)
+			pos.SetType(stream.Iterator_Type)
+		} else {
+			pos.SetType(kinesis.ShardIteratorTypeAfterSequenceNumber)
+			pos.SetSequenceNumber(seqnum)
+		}
+		stsi := &kinesis.SubscribeToShardInput{}
+		stsi.SetConsumerARN(consumerARN)
+		stsi.SetShardId(shardID)
+		stsi.SetStartingPosition(pos)
+		out, err := svc.SubscribeToShard(stsi)
+		if err != nil {
+			//ResourceInUse means the previous subscription has not been torn down yet
+			lg.Error("Failed to subscribe to shard %s on stream %s: %v", shardID, stream.Stream_Name, err)
+			time.Sleep(subscribeRetryDelay)
+			continue
+		}
+		closed := readSubscription(out.EventStream, sm, stream.Stream_Name, shardID, running, handle)
+		if err = out.EventStream.Close(); err != nil {
+			lg.Warn("Subscription to shard %s on stream %s ended: %v", shardID, stream.Stream_Name, err)
+			time.Sleep(subscribeRetryDelay)
+		}
+		if closed {
+			lg.Info("Shard %v on stream %s closed", shardID, stream.Stream_Name)
+			return true
+		}
+	}
+	return false
+}
+
+// readSubscription handles the events of a single subscription and returns true when the shard
+// has been closed and read to the end.  Kinesis sends an event at least every five seconds even
+// when there are no records, so running is checked regularly.
+func readSubscription(es *kinesis.SubscribeToShardEventStream, sm *stateman, streamName, shardID string, running func() bool, handle func([]*kinesis.Record)) bool {
+	for ev := range es.Events() {
+		e, ok := ev.(*kinesis.SubscribeToShardEvent)
+		if !ok {
+			continue
+		}
+		handle(e.Records)
+		//a closed shard has no continuation sequence number
+		if e.ContinuationSequenceNumber == nil {
+			return true
+		}
+		sm.UpdateSequenceNum(streamName, shardID, *e.ContinuationSequenceNumber)
+		if !running() {
+			break
+		}
+	}
+	return false
+}
+
+func isAWSError(err error, code string) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == code
+}
@@ -0,0 +1,400 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	attrKey      = `Key`
+	leaseType    = `lease`
+	instanceType = `instance`
+)
+
+// placeholders for the attribute names, most of them are DynamoDB reserved words
+var dynamoNames = map[string]string{
+	`#type`:    `Type`,
+	`#stream`:  `Stream`,
+	`#owner`:   `Owner`,
+	`#expires`: `Expires`,
+	`#seq`:     `Sequence`,
+}
+
+// dynamoCheckpoints stores checkpoints in a DynamoDB table and leases the shards of each stream
+// to the ingesters sharing the table.  Each shard has an item holding its checkpoint, the
+// ingester that owns it, and when the lease expires.  Every ingester also keeps an instance
+// item alive for each stream it reads, the instance items are counted to spread the shards
+// evenly: an ingester holding more than its share gives a lease up so a newly started
+// ingester can take it, and the leases of an ingester that stops renewing them are taken
+// over once they expire.
+type dynamoCheckpoints struct {
+	sync.Mutex
+	db       *dynamodb.DynamoDB
+	table    string
+	owner    string
+	duration time.Duration
+	leases   map[shardKey]time.Time //held leases and when they expire
+	shards   map[string]int         //open shards in each stream
+	fair     map[string]int         //leases this ingester should hold in each stream
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newDynamoCheckpoints creates the table when it does not exist, owner must be unique to each ingester
+func newDynamoCheckpoints(db *dynamodb.DynamoDB, table, owner string, d time.Duration) (*dynamoCheckpoints, error) {
+	dc := &dynamoCheckpoints{
+		db:       db,
+		table:    table,
+		owner:    owner,
+		duration: d,
+		leases:   make(map[shardKey]time.Time),
+		shards:   make(map[string]int),
+		fair:     make(map[string]int),
+	}
+	if err := dc.ensureTable(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (dc *dynamoCheckpoints) ensureTable() error {
+	dti := &dynamodb.DescribeTableInput{TableName: aws.String(dc.table)}
+	_, err := dc.db.DescribeTable(dti)
+	if err == nil || !isAWSError(err, dynamodb.ErrCodeResourceNotFoundException) {
+		return err
+	}
+	_, err = dc.db.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(dc.table),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(attrKey), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(attrKey), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+	})
+	//another ingester may be creating the table as well
+	if err != nil && !isAWSError(err, dynamodb.ErrCodeResourceInUseException) {
+		return err
+	}
+	lg.Info("Created checkpoint table %s", dc.table)
+	return dc.db.WaitUntilTableExists(dti)
+}
+
+func (dc *dynamoCheckpoints) setShardCount(stream string, n int) {
+	dc.Lock()
+	dc.shards[stream] = n
+	dc.Unlock()
+}
+
+func (dc *dynamoCheckpoints) acquire(k shardKey) bool {
+	now := time.Now()
+	dc.Lock()
+	if exp, ok := dc.leases[k]; ok && now.Before(exp) {
+		dc.Unlock()
+		return true
+	} else if dc.heldCount(k.stream) >= dc.fairShare(k.stream) {
+		dc.Unlock()
+		return false
+	}
+	dc.Unlock()
+	ok, err := dc.update(k.item(), `SET #owner = :me, #expires = :exp, #type = :type, #stream = :stream`,
+		`attribute_not_exists(#owner) OR #owner = :me OR #expires < :now`,
+		map[string]*dynamodb.AttributeValue{
+			`:me`:     dynamoString(dc.owner),
+			`:exp`:    dynamoTime(now.Add(dc.duration)),
+			`:now`:    dynamoTime(now),
+			`:type`:   dynamoString(leaseType),
+			`:stream`: dynamoString(k.stream),
+		})
+	if err != nil {
+		lg.Error("Failed to acquire lease on stream %s shard %s: %v", k.stream, k.shard, err)
+		return false
+	} else if !ok {
+		return false
+	}
+	dc.Lock()
+	dc.leases[k] = now.Add(dc.duration)
+	dc.Unlock()
+	lg.Info("Acquired lease on stream %s shard %s", k.stream, k.shard)
+	return true
+}
+
+// held returns false once a lease could not be renewed before it expired
+func (dc *dynamoCheckpoints) held(k shardKey) bool {
+	dc.Lock()
+	defer dc.Unlock()
+	exp, ok := dc.leases[k]
+	return ok && time.Now().Before(exp)
+}
+
+func (dc *dynamoCheckpoints) release(k shardKey) {
+	dc.Lock()
+	delete(dc.leases, k)
+	dc.Unlock()
+	if _, err := dc.update(k.item(), `REMOVE #owner`, `#owner = :me`,
+		map[string]*dynamodb.AttributeValue{`:me`: dynamoString(dc.owner)}); err != nil {
+		lg.Warn("Failed to release lease on stream %s shard %s: %v", k.stream, k.shard, err)
+	}
+}
+
+func (dc *dynamoCheckpoints) load(k shardKey) (string, error) {
+	out, err := dc.db.GetItem(&dynamodb.GetItemInput{
+		TableName:                aws.String(dc.table),
+		Key:                      map[string]*dynamodb.AttributeValue{attrKey: dynamoString(k.item())},
+		ConsistentRead:           aws.Bool(true),
+		ProjectionExpression:     aws.String(`#seq`),
+		ExpressionAttributeNames: expressionNames(`#seq`),
+	})
+	if err != nil {
+		return ``, err
+	} else if v, ok := out.Item[dynamoNames[`#seq`]]; ok {
+		return aws.StringValue(v.S), nil
+	}
+	return ``, nil
+}
+
+// store only writes the checkpoints of shards this ingester still owns
+func (dc *dynamoCheckpoints) store(cps map[shardKey]string) (err error) {
+	for k, seq := range cps {
+		ok, lerr := dc.update(k.item(), `SET #seq = :seq`, `#owner = :me`,
+			map[string]*dynamodb.AttributeValue{
+				`:seq`: dynamoString(seq),
+				`:me`:  dynamoString(dc.owner),
+			})
+		if lerr != nil {
+			if err == nil {
+				err = lerr
+			}
+		} else if !ok {
+			lg.Warn("Lease on stream %s shard %s was lost, checkpoint not stored", k.stream, k.shard)
+			dc.Lock()
+			delete(dc.leases, k)
+			dc.Unlock()
+		}
+	}
+	return
+}
+
+// start renews the leases three times per lease duration
+func (dc *dynamoCheckpoints) start() {
+	dc.done = make(chan struct{})
+	dc.wg.Add(1)
+	go func() {
+		defer dc.wg.Done()
+		tkr := time.NewTicker(dc.duration / 3)
+		defer tkr.Stop()
+		dc.renew()
+		for {
+			select {
+			case <-tkr.C:
+				dc.renew()
+			case <-dc.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close releases the remaining leases and removes the instance items so the other ingesters rebalance right away
+func (dc *dynamoCheckpoints) Close() error {
+	if dc.done != nil {
+		close(dc.done)
+		dc.wg.Wait()
+		dc.done = nil
+	}
+	dc.Lock()
+	var keys []shardKey
+	for k := range dc.leases {
+		keys = append(keys, k)
+	}
+	var streams []string
+	for stream := range dc.shards {
+		streams = append(streams, stream)
+	}
+	dc.Unlock()
+	for _, k := range keys {
+		dc.release(k)
+	}
+	for _, stream := range streams {
+		if _, err := dc.db.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(dc.table),
+			Key:       map[string]*dynamodb.AttributeValue{attrKey: dynamoString(dc.instanceItem(stream))},
+		}); err != nil {
+			lg.Warn("Failed to remove instance from checkpoint table %s: %v", dc.table, err)
+		}
+	}
+	return nil
+}
+
+// renew keeps the instance items and held leases alive, then rebalances the shards
+func (dc *dynamoCheckpoints) renew() {
+	now := time.Now()
+	dc.Lock()
+	var keys []shardKey
+	for k := range dc.leases {
+		keys = append(keys, k)
+	}
+	var streams []string
+	for stream := range dc.shards {
+		streams = append(streams, stream)
+	}
+	dc.Unlock()
+
+	for _, stream := range streams {
+		if _, err := dc.db.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(dc.table),
+			Item: map[string]*dynamodb.AttributeValue{
+				attrKey:   dynamoString(dc.instanceItem(stream)),
+				`Type`:    dynamoString(instanceType),
+				`Stream`:  dynamoString(stream),
+				`Owner`:   dynamoString(dc.owner),
+				`Expires`: dynamoTime(now.Add(dc.duration)),
+			},
+		}); err != nil {
+			lg.Error("Failed to update instance in checkpoint table %s: %v", dc.table, err)
+		}
+	}
+	for _, k := range keys {
+		ok, err := dc.update(k.item(), `SET #expires = :exp`, `#owner = :me`,
+			map[string]*dynamodb.AttributeValue{
+				`:exp`: dynamoTime(now.Add(dc.duration)),
+				`:me`:  dynamoString(dc.owner),
+			})
+		dc.Lock()
+		if err != nil {
+			//the lease runs out unless a later renewal succeeds
+			lg.Error("Failed to renew lease on stream %s shard %s: %v", k.stream, k.shard, err)
+		} else if !ok {
+			lg.Warn("Lost lease on stream %s shard %s", k.stream, k.shard)
+			delete(dc.leases, k)
+		} else if _, ok = dc.leases[k]; ok {
+			dc.leases[k] = now.Add(dc.duration)
+		}
+		dc.Unlock()
+	}
+	dc.balance(now)
+}
+
+// balance counts the live ingesters on each stream and gives up a lease when this ingester
+// holds more than its share, one lease is given up per renewal so the shards move gradually
+func (dc *dynamoCheckpoints) balance(now time.Time) {
+	instances := make(map[string]int)
+	err := dc.db.ScanPages(&dynamodb.ScanInput{
+		TableName:                aws.String(dc.table),
+		ConsistentRead:           aws.Bool(true),
+		FilterExpression:         aws.String(`#type = :type AND #expires > :now`),
+		ProjectionExpression:     aws.String(`#stream`),
+		ExpressionAttributeNames: expressionNames(`#type #expires #stream`),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			`:type`: dynamoString(instanceType),
+			`:now`:  dynamoTime(now),
+		},
+	}, func(out *dynamodb.ScanOutput, last bool) bool {
+		for _, item := range out.Items {
+			if v, ok := item[`Stream`]; ok {
+				instances[aws.StringValue(v.S)]++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		lg.Error("Failed to count ingesters in checkpoint table %s: %v", dc.table, err)
+		return
+	}
+	dc.Lock()
+	defer dc.Unlock()
+	for stream, n := range dc.shards {
+		live := instances[stream]
+		if live == 0 {
+			live = 1
+		}
+		fair := (n + live - 1) / live
+		dc.fair[stream] = fair
+		if dc.heldCount(stream) <= fair {
+			continue
+		}
+		for k := range dc.leases {
+			if k.stream == stream {
+				lg.Info("Giving up lease on stream %s shard %s to balance %d shards across %d ingesters", stream, k.shard, n, live)
+				delete(dc.leases, k)
+				break
+			}
+		}
+	}
+}
+
+// heldCount returns the number of leases held on a stream, caller must hold the lock
+func (dc *dynamoCheckpoints) heldCount(stream string) (n int) {
+	for k := range dc.leases {
+		if k.stream == stream {
+			n++
+		}
+	}
+	return
+}
+
+// fairShare returns the number of leases this ingester may hold on a stream, all of them
+// until the other ingesters have been counted; caller must hold the lock
+func (dc *dynamoCheckpoints) fairShare(stream string) int {
+	if f, ok := dc.fair[stream]; ok {
+		return f
+	}
+	return dc.shards[stream]
+}
+
+// update runs a conditional update, false is returned when the condition did not hold
+func (dc *dynamoCheckpoints) update(key, expr, cond string, vals map[string]*dynamodb.AttributeValue) (bool, error) {
+	_, err := dc.db.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(dc.table),
+		Key:                       map[string]*dynamodb.AttributeValue{attrKey: dynamoString(key)},
+		UpdateExpression:          aws.String(expr),
+		ConditionExpression:       aws.String(cond),
+		ExpressionAttributeNames:  expressionNames(expr + ` ` + cond),
+		ExpressionAttributeValues: vals,
+	})
+	if isAWSError(err, dynamodb.ErrCodeConditionalCheckFailedException) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (dc *dynamoCheckpoints) instanceItem(stream string) string {
+	return stream + `/instance/` + dc.owner
+}
+
+func (k shardKey) item() string {
+	return k.stream + `/` + k.shard
+}
+
+// expressionNames returns the placeholders used in an expression, DynamoDB rejects unused ones
+func expressionNames(expr string) map[string]*string {
+	r := make(map[string]*string)
+	for p, name := range dynamoNames {
+		if strings.Contains(expr, p) {
+			r[p] = aws.String(name)
+		}
+	}
+	return r
+}
+
+func dynamoString(v string) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(v)}
+}
+
+func dynamoTime(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10))}
+}
@@ -98,15 +98,6 @@ func main() {
 		}
 	}
 
-	// Get the state file
-	stateFile, err := utils.NewState(cfg.Global.State_Store_Location, 0600)
-	if err != nil {
-		lg.Fatal("Couldn't open state file: %v", err)
-	}
-	stateMan := NewStateman(stateFile)
-	stateMan.Start()
-	defer stateMan.Close()
-
 	tags, err := cfg.Tags()
 	if err != nil {
 		lg.Fatal("Failed to get tags from configuration: %v", err)
@@ -164,6 +155,15 @@ func main() {
 	// make an aws session
 	sess := session.Must(session.NewSession())
 
+	// Get the checkpoint store, it is closed before the muxer so the last checkpoints are synced
+	stateMan, err := newStateman(cfg, sess, id.String())
+	if err != nil {
+		lg.Fatal("Couldn't open checkpoint store: %v", err)
+	}
+	stateMan.SetSync(func() error { return igst.Sync(checkpointSyncTimeout) })
+	stateMan.Start()
+	defer stateMan.Close()
+
 	for _, stream := range cfg.KinesisStream {
 		tagid, err := igst.GetTag(stream.Tag_Name)
 		if err != nil {
@@ -180,6 +180,7 @@ func main() {
 
 		// Get the list of shards
 		shards := []*kinesis.Shard{}
+		var streamARN string
 		dsi := &kinesis.DescribeStreamInput{}
 		dsi.SetStreamName(stream.Stream_Name)
 		for {
@@ -188,6 +189,7 @@ func main() {
 				lg.Error("Failed to get stream description: %v", err)
 				continue
 			}
+			streamARN = aws.StringValue(streamdesc.StreamDescription.StreamARN)
 			newshards := streamdesc.StreamDescription.Shards
 			shards = append(shards, newshards...)
 			if *streamdesc.StreamDescription.HasMoreShards {
@@ -197,14 +199,28 @@ func main() {
 			}
 		}
 		debugout("Read %d shards from stream %s\n", len(shards), stream.Stream_Name)
+		var open int
+		for _, shard := range shards {
+			if shard.SequenceNumberRange == nil || shard.SequenceNumberRange.EndingSequenceNumber == nil {
+				open++
+			}
+		}
+		stateMan.SetShardCount(stream.Stream_Name, open)
+		var consumerARN string
+		if stream.Enhanced_Fan_Out {
+			if consumerARN, err = fanOutConsumer(svc, streamARN, stream.Consumer_Name); err != nil {
+				lg.Fatal("Failed to get enhanced fan-out consumer %s for stream %s: %v", stream.Consumer_Name, stream.Stream_Name, err)
+			}
+			debugout("Using enhanced fan-out consumer %s\n", consumerARN)
+		}
 		for i, shard := range shards {
 			// Detect and skip closed shards
 			if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
 				lg.Info("Shard %v on stream %s appears to be closed, skipping", *shard.ShardId, stream.Stream_Name)
 				continue
 			}
+			wg.Add(1)
 			go func(stream streamDef, shard kinesis.Shard, tagid entry.EntryTag, shardid int) {
-				wg.Add(1)
 				defer wg.Done()
 
 				// set up timegrinder and other long-lived stuff
@@ -234,108 +250,50 @@ func main() {
 					}
 				}
 
-			reconnectLoop:
-				for {
-					gsii := &kinesis.GetShardIteratorInput{}
-					gsii.SetShardId(*shard.ShardId)
-					gsii.SetStreamName(stream.Stream_Name)
-					seqnum := stateMan.GetSequenceNum(stream.Stream_Name, *shard.ShardId)
-					if seqnum == `` {
-						// we don't have a previous state
-						debugout("No previous sequence number for stream %v shard %v, defaulting to %v\n", stream.Stream_Name, *shard.ShardId, stream.Iterator_Type)
-						gsii.SetShardIteratorType(stream.Iterator_Type)
-					} else {
-						gsii.SetShardIteratorType(`AFTER_SEQUENCE_NUMBER`)
-						gsii.SetStartingSequenceNumber(seqnum)
-					}
-
-					output, err := svc.GetShardIterator(gsii)
-					if err != nil {
-						lg.Error("error on shard #%d (%s): %v", shardid, *shard.ShardId, err)
-						time.Sleep(5 * time.Second)
-						continue
-					}
-					if output.ShardIterator == nil {
-						// this is weird, we are going to bail out
-						lg.Error("Got nil initial shard iterator, sleeping and retrying")
-						time.Sleep(5 * time.Second)
-						continue
-					}
-					iter := *output.ShardIterator
-
-					var lastSeqNum string
-					for running {
-						gri := &kinesis.GetRecordsInput{}
-						gri.SetLimit(5000)
-						gri.SetShardIterator(iter)
-						var res *kinesis.GetRecordsOutput
-						var err error
-						for {
-							res, err = svc.GetRecords(gri)
-							if res != nil {
-								if res.NextShardIterator != nil {
-									iter = *res.NextShardIterator
-								}
-							}
-							if err != nil {
-								if awsErr, ok := err.(awserr.Error); ok {
-									// process SDK error
-									if awsErr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException {
-										lg.Warn("Throughput exceeded, trying again")
-										time.Sleep(500 * time.Millisecond)
-									} else if awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
-										lg.Info("Iterator expired, re-initializing")
-										time.Sleep(100 * time.Millisecond)
-										continue reconnectLoop
-									} else {
-										lg.Error("%s: %s", awsErr.Code(), awsErr.Message())
-										time.Sleep(500 * time.Millisecond)
-									}
-								} else {
-									lg.Error("unknown error: %v", err)
-								}
-							} else {
-								// if we got no records, chill for a sec before we hit it again
-								if len(res.Records) == 0 {
-									time.Sleep(100 * time.Millisecond)
-								}
-								break
-							}
+				handleRecords := func(recs []*kinesis.Record) {
+					for _, r := range recs {
+						ent := &entry.Entry{
+							Tag:  tagid,
+							SRC:  src,
+							Data: r.Data,
 						}
-
-						for _, r := range res.Records {
-							lastSeqNum = *r.SequenceNumber
-							ent := &entry.Entry{
-								Tag:  tagid,
-								SRC:  src,
-								Data: r.Data,
-							}
-							if stream.Parse_Time == false {
+						if stream.Parse_Time == false {
+							ent.TS = entry.FromStandard(*r.ApproximateArrivalTimestamp)
+						} else {
+							ts, ok, err := tg.Extract(ent.Data)
+							if !ok || err != nil {
+								// something went wrong, switch to using kinesis timestamps
+								stream.Parse_Time = false
 								ent.TS = entry.FromStandard(*r.ApproximateArrivalTimestamp)
 							} else {
-								ts, ok, err := tg.Extract(ent.Data)
-								if !ok || err != nil {
-									// something went wrong, switch to using kinesis timestamps
-									stream.Parse_Time = false
-									ent.TS = entry.FromStandard(*r.ApproximateArrivalTimestamp)
-								} else {
-									ent.TS = entry.FromStandard(ts)
-								}
-							}
-							if err = procset.Process(ent); err != nil {
-								lg.Error("Failed to handle entry: %v", err)
+								ent.TS = entry.FromStandard(ts)
 							}
 						}
-						// Now update the most recent sequence number
-						if lastSeqNum != `` {
-							stateMan.UpdateSequenceNum(stream.Stream_Name, *shard.ShardId, lastSeqNum)
+						if err := procset.Process(ent); err != nil {
+							lg.Error("Failed to handle entry: %v", err)
 						}
 					}
-					if err = procset.Close(); err != nil {
-						lg.Error("Failed to close processor set: %v", err)
+				}
+
+				for running {
+					if !stateMan.Acquire(stream.Stream_Name, *shard.ShardId) {
+						time.Sleep(leaseRetryInterval)
+						continue
+					}
+					reading := func() bool { return running && stateMan.Held(stream.Stream_Name, *shard.ShardId) }
+					var closed bool
+					if stream.Enhanced_Fan_Out {
+						closed = fanOutShard(svc, stateMan, consumerARN, &stream, *shard.ShardId, reading, handleRecords)
+					} else {
+						pollShard(svc, stateMan, &stream, *shard.ShardId, shardid, reading, handleRecords)
 					}
-					// if we get to this point, exit the for loop
-					break
+					stateMan.Release(stream.Stream_Name, *shard.ShardId)
+					if closed {
+						break
+					}
+				}
+				if err = procset.Close(); err != nil {
+					lg.Error("Failed to close processor set: %v", err)
 				}
 			}(*stream, *shard, tagid, i)
 		}
@@ -354,59 +312,87 @@ func debugout(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 }
 
-type stateman struct {
-	sync.Mutex
-	states    map[string]map[string]string // map of stream name to shard name to sequence number
-	stateFile *utils.State
-}
+// pollShard reads a shard with GetRecords until reading returns false
+func pollShard(svc *kinesis.Kinesis, sm *stateman, stream *streamDef, shardID string, shardid int, reading func() bool, handleRecords func([]*kinesis.Record)) {
+reconnectLoop:
+	for reading() {
+		gsii := &kinesis.GetShardIteratorInput{}
+		gsii.SetShardId(shardID)
+		gsii.SetStreamName(stream.Stream_Name)
+		seqnum := sm.GetSequenceNum(stream.Stream_Name, shardID)
+		if seqnum == `` {
+			// we don't have a previous state
+			debugout("No previous sequence number for stream %v shard %v, defaulting to %v\n", stream.Stream_Name, shardID, stream.Iterator_Type)
+			gsii.SetShardIteratorType(stream.Iterator_Type)
+		} else {
+			gsii.SetShardIteratorType(`AFTER_SEQUENCE_NUMBER`)
+			gsii.SetStartingSequenceNumber(seqnum)
+		}
 
-func NewStateman(stateFile *utils.State) *stateman {
-	sm := stateman{
-		states:    make(map[string]map[string]string),
-		stateFile: stateFile,
-	}
-	stateFile.Read(&sm.states)
-	return &sm
-}
+		output, err := svc.GetShardIterator(gsii)
+		if err != nil {
+			lg.Error("error on shard #%d (%s): %v", shardid, shardID, err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if output.ShardIterator == nil {
+			// this is weird, we are going to bail out
+			lg.Error("Got nil initial shard iterator, sleeping and retrying")
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		iter := *output.ShardIterator
+
+		var lastSeqNum string
+		for reading() {
+			gri := &kinesis.GetRecordsInput{}
+			gri.SetLimit(5000)
+			gri.SetShardIterator(iter)
+			var res *kinesis.GetRecordsOutput
+			var err error
+			for {
+				res, err = svc.GetRecords(gri)
+				if res != nil {
+					if res.NextShardIterator != nil {
+						iter = *res.NextShardIterator
+					}
+				}
+				if err != nil {
+					if awsErr, ok := err.(awserr.Error); ok {
+						// process SDK error
+						if awsErr.Code() == kinesis.ErrCodeProvisionedThroughputExceededException {
+							lg.Warn("Throughput exceeded, trying again")
+							time.Sleep(500 * time.Millisecond)
+						} else if awsErr.Code() == kinesis.ErrCodeExpiredIteratorException {
+							lg.Info("Iterator expired, re-initializing")
+							time.Sleep(100 * time.Millisecond)
+							continue reconnectLoop
+						} else {
+							lg.Error("%s: %s", awsErr.Code(), awsErr.Message())
+							time.Sleep(500 * time.Millisecond)
+						}
+					} else {
+						lg.Error("unknown error: %v", err)
+					}
+				} else {
+					// if we got no records, chill for a sec before we hit it again
+					if len(res.Records) == 0 {
+						time.Sleep(100 * time.Millisecond)
+					}
+					break
+				}
+			}
 
-func (s *stateman) Start() {
-	go func() {
-		for {
-			select {
-			case <-time.After(15 * time.Second):
-				s.Flush()
+			if n := len(res.Records); n > 0 {
+				lastSeqNum = *res.Records[n-1].SequenceNumber
+				handleRecords(res.Records)
+			}
+			// Now update the most recent sequence number
+			if lastSeqNum != `` {
+				sm.UpdateSequenceNum(stream.Stream_Name, shardID, lastSeqNum)
 			}
 		}
-	}()
-}
-
-func (s *stateman) Close() {
-	s.Flush()
-}
-
-func (s *stateman) Flush() {
-	s.Lock()
-	defer s.Unlock()
-	s.stateFile.Write(s.states)
-}
-
-func (s *stateman) UpdateSequenceNum(stream, shard, seq string) {
-	s.Lock()
-	defer s.Unlock()
-
-	_, ok := s.states[stream]
-	if !ok {
-		// initialize the stream
-		s.states[stream] = make(map[string]string)
-	}
-	s.states[stream][shard] = seq
-}
-
-func (s *stateman) GetSequenceNum(stream, shard string) string {
-	_, ok := s.states[stream]
-	if !ok {
-		// initialize the stream
-		s.states[stream] = make(map[string]string)
+		// if we get to this point, exit the for loop
+		return
 	}
-	return s.states[stream][shard]
 }
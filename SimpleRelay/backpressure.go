@@ -0,0 +1,199 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	blockPolicy backpressurePolicy = iota
+	bufferPolicy
+	dropPolicy
+
+	defaultBufferSize           = 4096
+	dropWriteTimeout            = 100 * time.Millisecond
+	backpressureSummaryInterval = time.Minute
+)
+
+var (
+	ErrInvalidBufferSize   = errors.New("Buffer-Size cannot be negative")
+	ErrBufferSizeNotBuffer = errors.New("Buffer-Size requires Backpressure-Policy buffer")
+)
+
+type backpressurePolicy int
+
+// contextProcessor is satisfied by the preprocessor set
+type contextProcessor interface {
+	entryProcessor
+	ProcessContext(*entry.Entry, context.Context) error
+}
+
+// muxerState is the part of the ingest muxer used to decide when to drop and to log drops
+type muxerState interface {
+	Hot() (int, error)
+	Warn(string, ...interface{}) error
+}
+
+func translateBackpressurePolicy(s string) (backpressurePolicy, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case ``, `block`:
+		return blockPolicy, nil
+	case `buffer`:
+		return bufferPolicy, nil
+	case `drop`:
+		return dropPolicy, nil
+	}
+	return -1, errors.New("invalid Backpressure-Policy, must be block, buffer, or drop")
+}
+
+func (l listener) validateBackpressure() error {
+	bp, err := translateBackpressurePolicy(l.Backpressure_Policy)
+	if err != nil {
+		return err
+	} else if l.Buffer_Size < 0 {
+		return ErrInvalidBufferSize
+	} else if l.Buffer_Size > 0 && bp != bufferPolicy {
+		return ErrBufferSizeNotBuffer
+	}
+	return nil
+}
+
+// backpressureProcessor decides what happens to entries when the muxer cannot take them.
+// The block policy is the default and does not use one, readers simply stop until the
+// muxer catches up and TCP senders feel the backpressure.  The buffer policy queues up to
+// Buffer-Size entries in memory and drops beyond that.  The drop policy writes straight
+// through while the muxer is hot and drops entries that cannot be written promptly while
+// it is not, which happens once the cache is full or when there is no cache.  Entries the
+// drop policy fails to write are dropped too, the client connection is never closed.
+type backpressureProcessor struct {
+	name    string
+	policy  backpressurePolicy
+	proc    contextProcessor
+	ms      muxerState
+	ch      chan *entry.Entry
+	sem     chan struct{} //held while the drop policy writes, waiting for it is bounded
+	dropped uint64
+	stats   *listenerStats
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// newBackpressureProcessor returns nil for the block policy
+func newBackpressureProcessor(name string, l *listener, proc contextProcessor, ms muxerState) (*backpressureProcessor, error) {
+	policy, err := translateBackpressurePolicy(l.Backpressure_Policy)
+	if err != nil || policy == blockPolicy {
+		return nil, err
+	}
+	bp := &backpressureProcessor{
+		name:   name,
+		policy: policy,
+		proc:   proc,
+		ms:     ms,
+		done:   make(chan struct{}),
+	}
+	if policy == bufferPolicy {
+		sz := l.Buffer_Size
+		if sz == 0 {
+			sz = defaultBufferSize
+		}
+		bp.ch = make(chan *entry.Entry, sz)
+		bp.wg.Add(1)
+		go bp.drain()
+	} else {
+		bp.sem = make(chan struct{}, 1)
+	}
+	go runEvery(backpressureSummaryInterval, bp.done, bp.report)
+	return bp, nil
+}
+
+func (bp *backpressureProcessor) Process(ent *entry.Entry) error {
+	if bp.policy == bufferPolicy {
+		select {
+		case <-bp.done:
+			bp.drop()
+		case bp.ch <- ent:
+		default:
+			bp.drop()
+		}
+		return nil
+	}
+	var err error
+	if n, lerr := bp.ms.Hot(); lerr == nil && n > 0 {
+		bp.sem <- struct{}{}
+		err = bp.proc.Process(ent)
+	} else {
+		//the preprocessors take a lock before the context reaches the muxer, so waiting
+		//for another writer is bounded by the same timeout as the write
+		ctx, cf := context.WithTimeout(context.Background(), dropWriteTimeout)
+		defer cf()
+		select {
+		case bp.sem <- struct{}{}:
+		case <-ctx.Done():
+			bp.drop()
+			return nil
+		}
+		err = bp.proc.ProcessContext(ent, ctx)
+	}
+	<-bp.sem
+	if err != nil {
+		bp.drop()
+	}
+	return nil
+}
+
+// drain hands buffered entries to the preprocessors, the buffer is flushed on close
+func (bp *backpressureProcessor) drain() {
+	defer bp.wg.Done()
+	for {
+		select {
+		case ent := <-bp.ch:
+			if err := bp.proc.Process(ent); err != nil {
+				lg.Error("Listener %s failed to write buffered entry: %v\n", bp.name, err)
+			}
+		case <-bp.done:
+			for {
+				select {
+				case ent := <-bp.ch:
+					bp.proc.Process(ent)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (bp *backpressureProcessor) drop() {
+	atomic.AddUint64(&bp.dropped, 1)
+	bp.stats.drop()
+}
+
+func (bp *backpressureProcessor) report() {
+	if n := atomic.SwapUint64(&bp.dropped, 0); n > 0 {
+		lg.Warn("Listener %s dropped %d entries the muxer could not accept\n", bp.name, n)
+		bp.ms.Warn("listener %s dropped %d entries the muxer could not accept", bp.name, n)
+	}
+}
+
+// Close flushes any buffered entries and reports drops since the last summary, it must be
+// called before the preprocessors are closed
+func (bp *backpressureProcessor) Close() error {
+	close(bp.done)
+	bp.wg.Wait()
+	bp.report()
+	return nil
+}
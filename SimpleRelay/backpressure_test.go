@@ -0,0 +1,145 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+// stuckMuxer blocks writes until released, like a muxer with no hot connections and a full cache
+type stuckMuxer struct {
+	sync.Mutex
+	hot     int
+	err     error //returned by every write when set
+	stuck   bool  //writes ignore their context, like a writer waiting on a lock
+	release chan struct{}
+	ents    []*entry.Entry
+}
+
+func (sm *stuckMuxer) Hot() (int, error)                 { return sm.hot, nil }
+func (sm *stuckMuxer) Warn(string, ...interface{}) error { return nil }
+
+func (sm *stuckMuxer) Process(ent *entry.Entry) error {
+	return sm.ProcessContext(ent, context.Background())
+}
+
+func (sm *stuckMuxer) ProcessContext(ent *entry.Entry, ctx context.Context) error {
+	if sm.err != nil {
+		return sm.err
+	} else if sm.stuck {
+		ctx = context.Background()
+	}
+	select {
+	case <-sm.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	sm.Lock()
+	sm.ents = append(sm.ents, ent)
+	sm.Unlock()
+	return nil
+}
+
+func TestDropPolicy(t *testing.T) {
+	sm := &stuckMuxer{release: make(chan struct{})}
+	bp, err := newBackpressureProcessor(`test`, &listener{Backpressure_Policy: `drop`}, sm, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bp.Close()
+	if err = bp.Process(&entry.Entry{}); err != nil {
+		t.Fatal(err)
+	} else if bp.dropped != 1 || len(sm.ents) != 0 {
+		t.Fatal("entry was not dropped while the muxer was stuck", bp.dropped)
+	}
+	close(sm.release)
+	if err = bp.Process(&entry.Entry{}); err != nil {
+		t.Fatal(err)
+	} else if bp.dropped != 1 || len(sm.ents) != 1 {
+		t.Fatal("entry was not written once the muxer accepted it", bp.dropped)
+	}
+}
+
+func TestDropPolicyFailures(t *testing.T) {
+	sm := &stuckMuxer{release: make(chan struct{}), stuck: true}
+	bp, err := newBackpressureProcessor(`test`, &listener{Backpressure_Policy: `drop`}, sm, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the first write never gives up, the next one must not wait for it
+	done := make(chan error)
+	go func() { done <- bp.Process(&entry.Entry{}) }()
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	if err = bp.Process(&entry.Entry{}); err != nil {
+		t.Fatal(err)
+	} else if time.Since(start) > 10*dropWriteTimeout || atomic.LoadUint64(&bp.dropped) != 1 {
+		t.Fatal("entry was not dropped while another write was stuck", atomic.LoadUint64(&bp.dropped))
+	}
+	close(sm.release)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	//write errors are drops rather than errors that close the client, hot or not
+	sm.err = errors.New(`muxer closed`)
+	for _, hot := range []int{0, 1} {
+		sm.hot = hot
+		if err = bp.Process(&entry.Entry{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bp.dropped != 3 || len(sm.ents) != 1 {
+		t.Fatalf("%d entries written and %d dropped", len(sm.ents), bp.dropped)
+	}
+	bp.Close()
+}
+
+func TestBufferPolicy(t *testing.T) {
+	sm := &stuckMuxer{release: make(chan struct{})}
+	l := &listener{Backpressure_Policy: `buffer`, Buffer_Size: 2}
+	bp, err := newBackpressureProcessor(`test`, l, sm, sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//one entry is held by the drain routine, two more fill the buffer, and the rest drop
+	for i := 0; i < 6; i++ {
+		if err = bp.Process(&entry.Entry{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dropped := atomic.LoadUint64(&bp.dropped)
+	close(sm.release)
+	if err = bp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(sm.ents); n < 2 || n > 3 || uint64(n)+dropped != 6 {
+		t.Fatalf("bad buffering: %d written %d dropped", n, dropped)
+	}
+}
+
+func TestBackpressureConfig(t *testing.T) {
+	if bp, err := newBackpressureProcessor(`test`, &listener{}, nil, nil); err != nil || bp != nil {
+		t.Fatal("block policy should not build a processor", err)
+	}
+	for _, l := range []listener{
+		{Backpressure_Policy: `bogus`},
+		{Backpressure_Policy: `drop`, Buffer_Size: 10},
+		{Backpressure_Policy: `buffer`, Buffer_Size: -1},
+	} {
+		if err := l.validateBackpressure(); err == nil {
+			t.Fatalf("accepted invalid backpressure config %+v", l)
+		}
+	}
+}
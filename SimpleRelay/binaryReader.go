@@ -0,0 +1,156 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	maxUDPPacket = 64 * 1024
+)
+
+var (
+	ErrChunkSizeWithoutBinary = errors.New("Chunk-Size requires Reader-Type binary")
+	ErrChunkSizeWithoutTCP    = errors.New("Chunk-Size only applies to TCP and TLS listeners, each datagram is an entry")
+	ErrInvalidChunkSize       = fmt.Errorf("Chunk-Size must be between 1 and %d", maxDataSize)
+	ErrBinaryOptions          = errors.New("Framing and Encoding do not apply to Reader-Type binary")
+)
+
+// validateBinaryReader checks the options that only apply to the binary reader type
+func (l listener) validateBinaryReader() error {
+	lrt, err := translateReaderType(l.Reader_Type)
+	if err != nil {
+		return err
+	}
+	if lrt != binaryReader {
+		if l.Chunk_Size != 0 {
+			return ErrChunkSizeWithoutBinary
+		}
+		return nil
+	}
+	if l.Framing != `` || l.Encoding != `` {
+		return ErrBinaryOptions
+	}
+	if l.Chunk_Size == 0 {
+		return nil
+	} else if l.Chunk_Size < 0 || l.Chunk_Size > maxDataSize {
+		return ErrInvalidChunkSize
+	}
+	if tp, _, err := translateBindType(l.Bind_String); err != nil {
+		return err
+	} else if tp.UDP() {
+		return ErrChunkSizeWithoutTCP
+	}
+	return nil
+}
+
+// readChunks hands fn the stream in chunks of sz bytes, the last chunk may be short.
+// Buffers grow as data arrives so idle connections do not hold a full chunk of memory,
+// and a read timeout from the Idle-Timeout ends the stream like EOF does.
+func readChunks(r io.Reader, sz int, fn func([]byte) error) error {
+	for {
+		var bb bytes.Buffer
+		n, err := bb.ReadFrom(io.LimitReader(r, int64(sz)))
+		if n > 0 {
+			if lerr := fn(bb.Bytes()); lerr != nil {
+				return lerr
+			}
+		}
+		if err != nil && !isTimeout(err) {
+			return err
+		} else if err != nil || n < int64(sz) {
+			return nil
+		}
+	}
+}
+
+// binaryConnHandlerTCP sends the connection as opaque entries of Chunk-Size bytes, without
+// a Chunk-Size the whole connection is one entry unless it exceeds the largest entry size
+func binaryConnHandlerTCP(c net.Conn, cfg handlerConfig) {
+	cfg.wg.Add(1)
+	id := addConn(c)
+	defer cfg.wg.Done()
+	defer delConn(id)
+	defer c.Close()
+	rip := cfg.src
+	if rip == nil {
+		if rip = addrIP(c.RemoteAddr()); rip == nil {
+			fmt.Fprintf(os.Stderr, "Failed to get remote addr from \"%s\"\n", c.RemoteAddr().String())
+			return
+		}
+	}
+	cfg.tag = cfg.sourceTag(c.RemoteAddr())
+	sender := addrIP(c.RemoteAddr())
+
+	sz := cfg.chunkSize
+	if sz <= 0 {
+		sz = maxDataSize
+	}
+	err := readChunks(c, sz, func(b []byte) error {
+		if !cfg.limiter.allow(sender, time.Now()) {
+			return nil
+		}
+		data, ok := cfg.sizer.check(b)
+		if !ok {
+			return nil
+		}
+		return cfg.proc.Process(&entry.Entry{
+			SRC:  rip,
+			TS:   entry.Now(),
+			Tag:  cfg.tag,
+			Data: data,
+		})
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read binary data from %v: %v\n", c.RemoteAddr(), err)
+	}
+}
+
+// binaryConnHandlerUDP treats each datagram as an entry
+func binaryConnHandlerUDP(c *net.UDPConn, cfg handlerConfig) {
+	buff := make([]byte, maxUDPPacket)
+	for {
+		n, raddr, err := c.ReadFromUDP(buff)
+		if err != nil {
+			break
+		}
+		if n == 0 || raddr == nil || n > len(buff) {
+			continue
+		}
+		if !cfg.limiter.allow(raddr.IP, time.Now()) {
+			continue
+		}
+		data, ok := cfg.sizer.check(buff[:n])
+		if !ok {
+			continue
+		}
+		rip := cfg.src
+		if rip == nil {
+			rip = raddr.IP
+		}
+		ent := &entry.Entry{
+			SRC:  rip,
+			TS:   entry.Now(),
+			Tag:  cfg.sourceTag(raddr),
+			Data: append([]byte(nil), data...),
+		}
+		if err = cfg.proc.Process(ent); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestReadChunks(t *testing.T) {
+	tests := map[string][]string{
+		`abcdefghij`: {`abcd`, `efgh`, `ij`},
+		`abcdefgh`:   {`abcd`, `efgh`},
+		``:           nil,
+	}
+	for input, expect := range tests {
+		var got []string
+		err := readChunks(strings.NewReader(input), 4, func(b []byte) error {
+			got = append(got, string(b))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		} else if strings.Join(got, `,`) != strings.Join(expect, `,`) {
+			t.Fatalf("bad chunks for %q: %q", input, got)
+		}
+	}
+}
+
+func TestBinaryConnHandler(t *testing.T) {
+	srv, cli := net.Pipe()
+	cp := &capProcessor{}
+	cfg := handlerConfig{
+		lrt:       binaryReader,
+		chunkSize: 3,
+		wg:        &sync.WaitGroup{},
+		proc:      cp,
+		src:       net.ParseIP(`10.0.0.1`),
+	}
+	go func() {
+		cli.Write([]byte("\x00\x01\x02\x03\n\x05\x06"))
+		cli.Close()
+	}()
+	binaryConnHandlerTCP(srv, cfg)
+	if len(cp.ents) != 3 {
+		t.Fatalf("got %d entries", len(cp.ents))
+	} else if string(cp.ents[1].Data) != "\x03\n\x05" || string(cp.ents[2].Data) != "\x06" {
+		t.Fatalf("bad entries %q %q", cp.ents[1].Data, cp.ents[2].Data)
+	}
+}
+
+func TestBinaryReaderConfig(t *testing.T) {
+	l := listener{
+		base:        base{Bind_String: `tcp://0.0.0.0:7900`},
+		Reader_Type: `binary`,
+		Chunk_Size:  1024,
+	}
+	if err := l.validateBinaryReader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []listener{
+		{base: base{Bind_String: `udp://0.0.0.0:7900`}, Reader_Type: `binary`, Chunk_Size: 1024},
+		{base: base{Bind_String: `tcp://0.0.0.0:7900`}, Reader_Type: `binary`, Chunk_Size: maxDataSize + 1},
+		{base: base{Bind_String: `tcp://0.0.0.0:7900`}, Reader_Type: `binary`, Framing: `newline`},
+		{base: base{Bind_String: `tcp://0.0.0.0:7900`}, Reader_Type: `line`, Chunk_Size: 1024},
+	} {
+		if err := v.validateBinaryReader(); err == nil {
+			t.Fatalf("accepted invalid binary reader %+v", v)
+		}
+	}
+}
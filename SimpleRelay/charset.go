@@ -0,0 +1,71 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// entryProcessor is satisfied by the preprocessor set, handlers hand every entry to one
+type entryProcessor interface {
+	Process(*entry.Entry) error
+}
+
+// translateEncoding looks up an Encoding by its IANA or WHATWG name, a nil Encoding means
+// the input is already UTF-8 and needs no conversion
+func translateEncoding(name string) (enc encoding.Encoding, err error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if name == `` {
+		return
+	}
+	//try the names as given and without dashes so latin-1 finds latin1
+	for _, n := range []string{name, strings.Replace(name, `-`, ``, -1)} {
+		if enc, err = ianaindex.IANA.Encoding(n); err == nil && enc != nil {
+			break
+		} else if enc, err = htmlindex.Get(n); err == nil && enc != nil {
+			break
+		}
+	}
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("Unknown Encoding %q", name)
+	} else if enc == unicode.UTF8 {
+		enc = nil
+	}
+	return
+}
+
+// charsetProcessor converts entry data from a legacy character set to UTF-8 before the
+// entry is counted, deduplicated, routed, or preprocessed, bytes that do not map are
+// replaced with U+FFFD
+type charsetProcessor struct {
+	enc  encoding.Encoding
+	next entryProcessor
+}
+
+func newCharsetProcessor(enc encoding.Encoding, next entryProcessor) entryProcessor {
+	if enc == nil {
+		return next
+	}
+	return &charsetProcessor{enc: enc, next: next}
+}
+
+func (cp *charsetProcessor) Process(ent *entry.Entry) error {
+	//decoders carry state for multi-byte sets, so each entry gets a fresh one
+	if b, err := cp.enc.NewDecoder().Bytes(ent.Data); err == nil {
+		ent.Data = b
+	}
+	return cp.next.Process(ent)
+}
@@ -0,0 +1,68 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+type capProcessor struct {
+	ents []*entry.Entry
+}
+
+func (cp *capProcessor) Process(ent *entry.Entry) error {
+	cp.ents = append(cp.ents, ent)
+	return nil
+}
+
+func TestCharsetConversion(t *testing.T) {
+	tests := map[string]string{
+		`latin-1`:   "caf\xe9",
+		`Shift_JIS`: "\x93\xfa\x96\x7b",
+	}
+	expect := map[string]string{
+		`latin-1`:   "café",
+		`Shift_JIS`: "日本",
+	}
+	for name, input := range tests {
+		enc, err := translateEncoding(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cp := &capProcessor{}
+		if err = newCharsetProcessor(enc, cp).Process(&entry.Entry{Data: []byte(input)}); err != nil {
+			t.Fatal(err)
+		} else if len(cp.ents) != 1 || string(cp.ents[0].Data) != expect[name] {
+			t.Fatalf("bad %s conversion: %q", name, cp.ents[0].Data)
+		}
+	}
+	for _, v := range []string{``, `utf-8`, `UTF8`} {
+		if enc, err := translateEncoding(v); err != nil || enc != nil {
+			t.Fatalf("%q should not convert: %v %v", v, enc, err)
+		}
+	}
+	if _, err := translateEncoding(`klingon`); err == nil {
+		t.Fatal("accepted an unknown Encoding")
+	}
+
+	//routes match the converted data, not the raw bytes
+	enc, err := translateEncoding(`latin-1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &capProcessor{}
+	rr := newRegexRouter([]regexRoute{{re: regexp.MustCompile(`café`), tag: 1}}, cp)
+	if err = newCharsetProcessor(enc, rr).Process(&entry.Entry{Data: []byte("caf\xe9")}); err != nil {
+		t.Fatal(err)
+	} else if len(cp.ents) != 1 || cp.ents[0].Tag != 1 {
+		t.Fatalf("converted entry was not routed: %+v", cp.ents)
+	}
+}
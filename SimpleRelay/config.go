@@ -31,9 +31,24 @@ const (
 
 	lineReader    readerType = iota
 	rfc5424Reader readerType = iota
+	rfc5425Reader readerType = iota //RFC5424 messages in octet counted frames over TLS
+	jsonReader    readerType = iota //JSON documents, top level arrays are split into an entry per element
+	binaryReader  readerType = iota //opaque bytes, each TCP connection or Chunk-Size bytes of it is an entry
+	fluentdReader readerType = iota //fluentd forward protocol, each event record is a JSON entry
+	beatsReader   readerType = iota //Elastic Beats lumberjack v2 protocol, each event is a JSON entry
+	stompReader   readerType = iota //STOMP SEND frames, each frame body is an entry
+
+	defaultDrainTimeout = 5 * time.Second
 )
 
-var ()
+var (
+	ErrRFC5425WithoutTLS = errors.New("Reader-Type rfc5425 requires a tls:// Bind-String")
+	ErrRFC5425Framing    = errors.New("Reader-Type rfc5425 always uses octet-counted framing")
+	ErrWorkersWithoutUDP = errors.New("UDP-Workers only applies to UDP listeners")
+	ErrInvalidUDPWorkers = errors.New("UDP-Workers cannot be negative")
+	ErrNoReusePort       = errors.New("UDP-Workers requires SO_REUSEPORT, which is not supported on this platform")
+	ErrInvalidDrainTime  = errors.New("Drain-Timeout must be a non-negative duration such as 10s")
+)
 
 type bindType int
 type readerType int
@@ -42,10 +57,43 @@ type listener struct {
 	base
 	Tag_Name      string
 	Reader_Type   string
-	Keep_Priority bool // Leave the <nnn> priority value at the start of the log message
+	Keep_Priority bool   // Leave the <nnn> priority value at the start of the log message
+	Framing       string // newline, octet-counted, or auto for TCP listeners, rfc5424 readers default to auto
 	Cert_File     string
 	Key_File      string
+	Source_Tag    []string // CIDR:tag pairs, senders in the network are tagged with tag instead of Tag-Name
+	Priority_Tag  []string // syslog PRI rules such as severity<=warning:alerts, the first matching rule sets the tag
+	Regex_Tag     []string // regex:tag pairs checked in order against the payload, the first match sets the tag
 	Preprocessor  []string
+
+	Multicast_Group     []string // multicast groups joined by UDP listeners
+	Multicast_Interface string   // interface used to join Multicast-Group, the system picks one if empty
+	UDP_Workers         int      // number of SO_REUSEPORT sockets bound to the port, each with its own reader
+
+	Source_Rate_Limit int // maximum entries per second from a single sender, 0 is unlimited
+	Source_Rate_Burst int // entries a sender may burst above the limit, defaults to Source-Rate-Limit
+
+	Timestamp_Field string // dotted path to the timestamp in each document for json readers
+	Quarantine_Tag  string // json readers send invalid documents here unmodified instead of dropping them
+
+	Chunk_Size int // binary readers send an entry every Chunk-Size bytes, each connection is one entry if zero
+
+	Shared_Key        string // fluentd readers require forwarders to authenticate with this key when set
+	Fluentd_Tag_Field string // fluentd readers add the event's fluentd tag to the record under this key
+
+	Destination_Tag []string // destination:tag pairs, stomp readers tag frames sent to the destination with tag instead of Tag-Name
+	Login           string   // stomp readers require clients to connect with this login and the Passcode when set
+	Passcode        string
+
+	Max_Entry_Size  int    // entries larger than this are handled by the Oversize-Policy, at most maxDataSize
+	Oversize_Policy string // drop or truncate, oversized entries are dropped by default
+
+	Encoding string // character set of the incoming data such as latin1 or shift_jis, entries are converted to UTF-8
+
+	Backpressure_Policy string // block, buffer, or drop when the muxer cannot take entries, block is the default
+	Buffer_Size         int    // entries held in memory by the buffer policy
+
+	Dedup_Window string // entries with the same payload as one seen within this duration are dropped
 }
 
 type base struct {
@@ -55,17 +103,30 @@ type base struct {
 	Timezone_Override         string
 	Source_Override           string
 	Timestamp_Format_Override string //override the timestamp format
+	Client_CA_File            string //PEM bundle used to verify client certificates on TLS listeners
+	Require_Client_Cert       bool   //reject TLS clients that do not present a certificate signed by the Client-CA-File
+	Keepalive_Interval        string //TCP keepalive probe interval, the system default is used if empty
+	Disable_Keepalive         bool
+	Idle_Timeout              string   //close connections that have not sent anything for this long
+	Max_Connections           int      //maximum concurrent connections, 0 is unlimited
+	Proxy_Protocol_Source     []string //load balancers that prefix connections with a PROXY protocol header
+}
+
+type global struct {
+	config.IngestConfig
+	Drain_Timeout string // how long established connections may keep sending after the listeners close on shutdown
+	Stats_Listen  string // host:port or unix socket path serving per-listener stats as JSON, disabled if empty
 }
 
 type cfgReadType struct {
-	Global       config.IngestConfig
+	Global       global
 	Listener     map[string]*listener
 	JSONListener map[string]*jsonListener
 	Preprocessor processors.ProcessorConfig
 }
 
 type cfgType struct {
-	config.IngestConfig
+	global
 	Listener     map[string]*listener
 	JSONListener map[string]*jsonListener
 	Preprocessor processors.ProcessorConfig
@@ -78,7 +139,7 @@ func GetConfig(path string) (*cfgType, error) {
 		return nil, err
 	}
 	c := &cfgType{
-		IngestConfig: cr.Global,
+		global:       cr.Global,
 		Listener:     cr.Listener,
 		JSONListener: cr.JSONListener,
 		Preprocessor: cr.Preprocessor,
@@ -122,14 +183,53 @@ func verifyConfig(c *cfgType) error {
 		if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
 			return errors.New("Invalid characters in the Tag-Name for " + k)
 		}
-		if v.Timezone_Override != "" {
-			if v.Assume_Local_Timezone {
-				// cannot do both
-				return fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same listener %v", k)
-			}
-			if _, err := time.LoadLocation(v.Timezone_Override); err != nil {
-				return fmt.Errorf("Invalid timezone override %v in listener %v: %v", v.Timezone_Override, k, err)
-			}
+		if err := v.validateFraming(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if _, err := v.sourceTags(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validatePriorityRules(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if _, err := v.regexTags(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateMulticast(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateUDPWorkers(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateRateLimit(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateJSONReader(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateBinaryReader(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateFluentdReader(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateBeatsReader(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateStompReader(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if _, err := v.dedupWindow(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateEntrySize(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if _, err := translateEncoding(v.Encoding); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
+		}
+		if err := v.validateBackpressure(); err != nil {
+			return fmt.Errorf("Listener %s configuration error: %v", k, err)
 		}
 		if n, ok := bindMp[v.Bind_String]; ok {
 			return errors.New("Bind-String for " + k + " already in use by " + n)
@@ -161,15 +261,6 @@ func verifyConfig(c *cfgType) error {
 				return errors.New("Invalid characters in Tag-Match tag " + t.Tag + " for " + k)
 			}
 		}
-		if v.Timezone_Override != "" {
-			if v.Assume_Local_Timezone {
-				// cannot do both
-				return fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same listener %v", k)
-			}
-			if _, err := time.LoadLocation(v.Timezone_Override); err != nil {
-				return fmt.Errorf("Invalid timezone override %v in listener %v: %v", v.Timezone_Override, k, err)
-			}
-		}
 		if n, ok := bindMp[v.Bind_String]; ok {
 			return errors.New("Bind-String for " + k + " already in use by " + n)
 		}
@@ -184,6 +275,35 @@ func verifyConfig(c *cfgType) error {
 	return nil
 }
 
+func (g *global) Verify() error {
+	if err := g.IngestConfig.Verify(); err != nil {
+		return err
+	}
+	if err := g.validateDrainTimeout(); err != nil {
+		return err
+	}
+	return g.validateStatsListen()
+}
+
+func (g *global) validateDrainTimeout() error {
+	if g.Drain_Timeout != `` {
+		if d, err := time.ParseDuration(g.Drain_Timeout); err != nil || d < 0 {
+			return ErrInvalidDrainTime
+		}
+	}
+	return nil
+}
+
+// DrainTimeout returns how long established connections are given to finish sending on
+// shutdown before they are closed, zero closes them immediately
+func (g *global) DrainTimeout() (d time.Duration) {
+	if g.Drain_Timeout == `` {
+		return defaultDrainTimeout
+	}
+	d, _ = time.ParseDuration(g.Drain_Timeout)
+	return
+}
+
 func (c *cfgType) Tags() ([]string, error) {
 	var tags []string
 	tagMp := make(map[string]bool, 1)
@@ -196,6 +316,50 @@ func (c *cfgType) Tags() ([]string, error) {
 			tags = append(tags, v.Tag_Name)
 			tagMp[v.Tag_Name] = true
 		}
+		sts, err := v.sourceTags()
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range sts {
+			if _, ok := tagMp[st.tag]; !ok {
+				tags = append(tags, st.tag)
+				tagMp[st.tag] = true
+			}
+		}
+		prs, err := v.priorityRules()
+		if err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if _, ok := tagMp[pr.tag]; !ok {
+				tags = append(tags, pr.tag)
+				tagMp[pr.tag] = true
+			}
+		}
+		rts, err := v.regexTags()
+		if err != nil {
+			return nil, err
+		}
+		for _, rt := range rts {
+			if _, ok := tagMp[rt.tag]; !ok {
+				tags = append(tags, rt.tag)
+				tagMp[rt.tag] = true
+			}
+		}
+		dts, err := v.destinationTags()
+		if err != nil {
+			return nil, err
+		}
+		for _, dt := range dts {
+			if _, ok := tagMp[dt.tag]; !ok {
+				tags = append(tags, dt.tag)
+				tagMp[dt.tag] = true
+			}
+		}
+		if v.Quarantine_Tag != `` && !tagMp[v.Quarantine_Tag] {
+			tags = append(tags, v.Quarantine_Tag)
+			tagMp[v.Quarantine_Tag] = true
+		}
 	}
 
 	//iterate over json listeners
@@ -223,6 +387,32 @@ func (l base) Validate() error {
 	if len(l.Bind_String) == 0 {
 		return errors.New("No Bind-String provided")
 	}
+	if err := l.validateTLS(); err != nil {
+		return err
+	}
+	if err := l.validateTimestamps(); err != nil {
+		return err
+	}
+	if err := l.validateConnLimits(); err != nil {
+		return err
+	}
+	return l.validateProxySources()
+}
+
+// validateUDPWorkers checks that multiple workers are only requested on UDP listeners
+func (l listener) validateUDPWorkers() error {
+	if l.UDP_Workers < 0 {
+		return ErrInvalidUDPWorkers
+	} else if l.UDP_Workers <= 1 {
+		return nil
+	}
+	if tp, _, err := translateBindType(l.Bind_String); err != nil {
+		return err
+	} else if !tp.UDP() {
+		return ErrWorkersWithoutUDP
+	} else if !reusePortSupported {
+		return ErrNoReusePort
+	}
 	return nil
 }
 
@@ -290,6 +480,18 @@ func translateReaderType(s string) (readerType, error) {
 		return lineReader, nil
 	case `rfc5424`:
 		return rfc5424Reader, nil
+	case `rfc5425`:
+		return rfc5425Reader, nil
+	case `json`:
+		return jsonReader, nil
+	case `binary`:
+		return binaryReader, nil
+	case `fluentd`, `forward`:
+		return fluentdReader, nil
+	case `beats`, `lumberjack`:
+		return beatsReader, nil
+	case `stomp`:
+		return stompReader, nil
 	case ``:
 		return lineReader, nil
 	}
@@ -302,6 +504,18 @@ func (rt readerType) String() string {
 		return `LINE`
 	case rfc5424Reader:
 		return `RFC5424`
+	case rfc5425Reader:
+		return `RFC5425`
+	case jsonReader:
+		return `JSON`
+	case binaryReader:
+		return `BINARY`
+	case fluentdReader:
+		return `FLUENTD`
+	case beatsReader:
+		return `BEATS`
+	case stompReader:
+		return `STOMP`
 	}
 	return "UNKNOWN"
 }
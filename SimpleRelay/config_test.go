@@ -8,11 +8,18 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
 )
 
 var (
@@ -70,6 +77,360 @@ func TestBasicConfig(t *testing.T) {
 	}
 }
 
+func TestClientCertValidation(t *testing.T) {
+	b := base{
+		Bind_String:         `tls://0.0.0.0:6514`,
+		Require_Client_Cert: true,
+	}
+	if err := b.Validate(); err != ErrClientCertWithoutCA {
+		t.Fatal("missed Require-Client-Cert without a CA", err)
+	}
+	b.Client_CA_File = `/opt/gravwell/etc/ca.pem`
+	if err := b.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b.Bind_String = `tcp://0.0.0.0:601`
+	if err := b.Validate(); err != ErrClientCAWithoutTLS {
+		t.Fatal("missed Client-CA-File on a non-TLS listener", err)
+	}
+	b.Bind_String = `tls://0.0.0.0:6514`
+	b.Client_CA_File = fmt.Sprintf("%s/empty.pem", tmpDir)
+	if err := ioutil.WriteFile(b.Client_CA_File, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.tlsConfig(`cert.pem`, ``); err != ErrMissingCertOrKeyFile {
+		t.Fatal("missed empty Key-File", err)
+	}
+}
+
+func TestSourceTags(t *testing.T) {
+	l := listener{
+		Source_Tag: []string{`10.0.0.0/8:net`, `10.1.0.0/16:fw`, `fd00::/8:v6`, `192.168.1.1:host`},
+	}
+	sts, err := l.sourceTags()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(sts) != 4 || sts[2].tag != `v6` || sts[3].network.String() != `192.168.1.1/32` {
+		t.Fatalf("bad source tags: %+v", sts)
+	}
+	hc := handlerConfig{tag: 0}
+	for i, st := range sts {
+		hc.srcRoutes = append(hc.srcRoutes, sourceRoute{network: st.network, tag: entry.EntryTag(i + 1)})
+	}
+	tests := map[string]entry.EntryTag{
+		`10.2.3.4`:    1,
+		`10.1.3.4`:    2, //most specific wins
+		`fd00::1`:     3,
+		`192.168.1.1`: 4,
+		`172.16.0.1`:  0,
+	}
+	for ip, tag := range tests {
+		if r := hc.sourceTag(&net.UDPAddr{IP: net.ParseIP(ip)}); r != tag {
+			t.Fatalf("%s routed to %d, expected %d", ip, r, tag)
+		}
+	}
+	for _, v := range []string{`10.0.0.0/8`, `10.0.0.0/8:`, `bogus:tag`, `10.0.0.0/8:bad.tag`} {
+		l.Source_Tag = []string{v}
+		if _, err = l.sourceTags(); err == nil {
+			t.Fatalf("accepted invalid Source-Tag %q", v)
+		}
+	}
+}
+
+func TestMulticastGroups(t *testing.T) {
+	l := listener{
+		base:            base{Bind_String: `udp://0.0.0.0:5000`},
+		Multicast_Group: []string{`239.1.2.3`, `ff15::1234`},
+	}
+	if err := l.validateMulticast(); err != nil {
+		t.Fatal(err)
+	}
+	l.Multicast_Group = []string{`10.0.0.1`}
+	if err := l.validateMulticast(); err == nil {
+		t.Fatal("accepted a unicast Multicast-Group")
+	}
+	l.Multicast_Group = []string{`239.1.2.3`}
+	l.Bind_String = `tcp://0.0.0.0:5000`
+	if err := l.validateMulticast(); err != ErrMulticastWithoutUDP {
+		t.Fatal("accepted Multicast-Group on a TCP listener", err)
+	}
+	l.Multicast_Group = nil
+	l.Multicast_Interface = `eth0`
+	if err := l.validateMulticast(); err != ErrMulticastInterfaceNoGroup {
+		t.Fatal("accepted Multicast-Interface without a group", err)
+	}
+}
+
+func TestUDPWorkers(t *testing.T) {
+	l := listener{
+		base:        base{Bind_String: `tcp://127.0.0.1:5000`},
+		UDP_Workers: 2,
+	}
+	if err := l.validateUDPWorkers(); err != ErrWorkersWithoutUDP {
+		t.Fatal("accepted UDP-Workers on a TCP listener", err)
+	}
+	l.UDP_Workers = -1
+	if err := l.validateUDPWorkers(); err != ErrInvalidUDPWorkers {
+		t.Fatal("accepted negative UDP-Workers", err)
+	}
+	if !reusePortSupported {
+		return
+	}
+	first, err := listenUDPReusePort(`udp`, &net.UDPAddr{IP: net.ParseIP(`127.0.0.1`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := listenUDPReusePort(`udp`, first.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal("failed to share the port", err)
+	}
+	second.Close()
+}
+
+func TestSourceRateLimit(t *testing.T) {
+	l := listener{Source_Rate_Limit: 2, Source_Rate_Burst: 4}
+	if err := l.validateRateLimit(); err != nil {
+		t.Fatal(err)
+	}
+	sl := newSourceLimiter(`test`, &l)
+	a, b := net.ParseIP(`10.0.0.1`), net.ParseIP(`10.0.0.2`)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if !sl.allow(a, now) {
+			t.Fatal("dropped an entry within the burst", i)
+		}
+	}
+	if sl.allow(a, now) || sl.allow(a, now) {
+		t.Fatal("allowed an entry beyond the burst")
+	} else if !sl.allow(b, now) {
+		t.Fatal("throttled a quiet sender")
+	}
+	//half a second refills one token
+	if !sl.allow(a, now.Add(500*time.Millisecond)) || sl.allow(a, now.Add(500*time.Millisecond)) {
+		t.Fatal("bad refill")
+	}
+	if drops := sl.summarize(now); len(drops) != 1 || drops[a.String()] != 3 {
+		t.Fatalf("bad drop summary: %v", drops)
+	}
+	//quiet senders are forgotten once their bucket is full
+	if drops := sl.summarize(now.Add(time.Minute)); len(drops) != 0 || len(sl.srcs) != 0 {
+		t.Fatalf("stale senders not pruned: %v %v", drops, sl.srcs)
+	}
+	if newSourceLimiter(`test`, &listener{}).allow(a, now) != true {
+		t.Fatal("nil limiter dropped an entry")
+	}
+	l.Source_Rate_Limit = 0
+	if err := l.validateRateLimit(); err != ErrSourceBurstNoLimit {
+		t.Fatal("accepted Source-Rate-Burst without a limit", err)
+	}
+	l.Source_Rate_Limit = -1
+	if err := l.validateRateLimit(); err != ErrInvalidSourceRate {
+		t.Fatal("accepted a negative Source-Rate-Limit", err)
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	b := base{
+		Bind_String:        `tcp://127.0.0.1:0`,
+		Keepalive_Interval: `30s`,
+		Idle_Timeout:       `100ms`,
+		Max_Connections:    1,
+	}
+	if err := b.validateConnLimits(); err != nil {
+		t.Fatal(err)
+	}
+	cl, err := b.connLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimitListener(tl, cl)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	first, err := net.Dial(`tcp`, tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	time.Sleep(20 * time.Millisecond)
+	//the second connection is over the limit and closed immediately
+	second, err := net.Dial(`tcp`, tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("connection over Max-Connections was not closed", err)
+	}
+	//the first connection is closed once idle
+	first.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = first.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("idle connection was not closed", err)
+	}
+
+	b.Bind_String = `udp://127.0.0.1:0`
+	if err := b.validateConnLimits(); err != ErrConnLimitsWithoutTCP {
+		t.Fatal("accepted connection limits on a UDP listener", err)
+	}
+	b.Bind_String = `tcp://127.0.0.1:0`
+	b.Disable_Keepalive = true
+	if err := b.validateConnLimits(); err != ErrKeepaliveConflict {
+		t.Fatal("accepted Keepalive-Interval and Disable-Keepalive", err)
+	}
+	b.Disable_Keepalive = false
+	b.Idle_Timeout = `-1s`
+	if err := b.validateConnLimits(); err == nil {
+		t.Fatal("accepted a negative Idle-Timeout")
+	}
+}
+
+func TestEntrySizer(t *testing.T) {
+	l := listener{Max_Entry_Size: 4}
+	if err := l.validateEntrySize(); err != nil {
+		t.Fatal(err)
+	}
+	es, err := newEntrySizer(`test`, &l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := es.check([]byte(`abcd`)); !ok || string(b) != `abcd` {
+		t.Fatal("bad pass through", string(b), ok)
+	} else if _, ok = es.check([]byte(`abcde`)); ok || es.dropped != 1 {
+		t.Fatal("oversized entry was not dropped")
+	}
+	l.Oversize_Policy = `truncate`
+	if es, err = newEntrySizer(`test`, &l); err != nil {
+		t.Fatal(err)
+	} else if b, ok := es.check([]byte(`abcdef`)); !ok || string(b) != `abcd` || es.truncated != 1 {
+		t.Fatal("bad truncation", string(b), ok)
+	}
+
+	//oversized lines are handled as they are read, the rest of the line is thrown away
+	for _, policy := range []string{`drop`, `truncate`} {
+		l.Oversize_Policy = policy
+		if es, err = newEntrySizer(`test`, &l); err != nil {
+			t.Fatal(err)
+		}
+		s := bufio.NewScanner(iotest.OneByteReader(strings.NewReader("ab\nabcdefgh\r\ncd\nabcdefg")))
+		s.Buffer(make([]byte, 2), maxDataSize)
+		s.Split(es.split(bufio.ScanLines))
+		var lines []string
+		for s.Scan() {
+			lines = append(lines, s.Text())
+		}
+		exp := `ab,cd`
+		if policy == `truncate` {
+			exp = `ab,abcd,cd,abcd`
+		}
+		if err = s.Err(); err != nil || strings.Join(lines, `,`) != exp {
+			t.Fatalf("%s split into %q: %v", policy, lines, err)
+		} else if es.dropped+es.truncated != 2 {
+			t.Fatalf("%s counted %d drops and %d truncations", policy, es.dropped, es.truncated)
+		}
+	}
+	//a line that fills the read buffer does not fail the reader
+	l.Max_Entry_Size = maxDataSize
+	if es, err = newEntrySizer(`test`, &l); err != nil {
+		t.Fatal(err)
+	}
+	s := bufio.NewScanner(strings.NewReader(strings.Repeat(`x`, maxDataSize+10) + "\nok\n"))
+	s.Buffer(make([]byte, initDataSize), maxDataSize)
+	s.Split(es.split(bufio.ScanLines))
+	var lines []int
+	for s.Scan() {
+		lines = append(lines, len(s.Bytes()))
+	}
+	if err = s.Err(); err != nil || len(lines) != 2 || lines[0] != maxDataSize || lines[1] != 2 {
+		t.Fatalf("read lines of %v bytes: %v", lines, err)
+	}
+
+	if es, err = newEntrySizer(`test`, &listener{}); err != nil || es != nil {
+		t.Fatal("built a sizer without a Max-Entry-Size", err)
+	} else if _, ok := es.check(make([]byte, maxDataSize)); !ok {
+		t.Fatal("nil sizer dropped an entry")
+	}
+	for _, v := range []listener{
+		{Oversize_Policy: `truncate`},
+		{Max_Entry_Size: 4, Oversize_Policy: `bogus`},
+		{Max_Entry_Size: -1},
+		{Max_Entry_Size: maxDataSize + 1},
+	} {
+		if err := v.validateEntrySize(); err == nil {
+			t.Fatalf("accepted invalid entry size %+v", v)
+		}
+	}
+}
+
+func TestTimestampOverrides(t *testing.T) {
+	udp := base{Bind_String: `udp://0.0.0.0:514`, Timezone_Override: `America/Chicago`, Timestamp_Format_Override: `syslog`}
+	js := base{Bind_String: `tcp://0.0.0.0:7777`, Ignore_Timestamps: true}
+	for _, b := range []base{udp, js} {
+		if err := b.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tg, err := udp.timeConfig().newTimeGrinder(); err != nil || tg == nil {
+		t.Fatal("failed to build timegrinder", err)
+	} else if ts, ok, err := tg.Extract([]byte(`Mar  4 05:06:07 host msg`)); err != nil || !ok {
+		t.Fatal("failed to extract timestamp", err)
+	} else if _, off := ts.Zone(); off != -6*3600 && off != -5*3600 {
+		t.Fatal("Timezone-Override was not applied", ts)
+	}
+	if tg, err := js.timeConfig().newTimeGrinder(); err != nil || tg != nil {
+		t.Fatal("built a timegrinder for a listener ignoring timestamps", err)
+	}
+	if err := (base{Bind_String: `:514`, Timezone_Override: `UTC`, Assume_Local_Timezone: true}).Validate(); err != ErrTimezoneConflict {
+		t.Fatal("accepted conflicting timezone options", err)
+	}
+	for _, b := range []base{
+		{Bind_String: `:514`, Timezone_Override: `Nowhere/Special`},
+		{Bind_String: `:514`, Timestamp_Format_Override: `bogus`},
+	} {
+		if err := b.Validate(); err == nil {
+			t.Fatalf("accepted invalid timestamp settings %+v", b)
+		}
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	var g global
+	if err := g.validateDrainTimeout(); err != nil {
+		t.Fatal(err)
+	} else if g.DrainTimeout() != defaultDrainTimeout {
+		t.Fatal("bad default drain timeout", g.DrainTimeout())
+	}
+	g.Drain_Timeout = `0s`
+	if err := g.validateDrainTimeout(); err != nil || g.DrainTimeout() != 0 {
+		t.Fatal("zero drain timeout rejected", err)
+	}
+	g.Drain_Timeout = `30s`
+	if err := g.validateDrainTimeout(); err != nil || g.DrainTimeout() != 30*time.Second {
+		t.Fatal("bad drain timeout", g.DrainTimeout(), err)
+	}
+	for _, v := range []string{`-1s`, `bogus`} {
+		g.Drain_Timeout = v
+		if err := g.validateDrainTimeout(); err != ErrInvalidDrainTime {
+			t.Fatalf("accepted invalid drain timeout %q: %v", v, err)
+		}
+	}
+}
+
 const (
 	baseConfig string = `
 [Global]
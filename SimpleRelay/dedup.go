@@ -0,0 +1,124 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	dedupSummaryInterval = time.Minute
+)
+
+var (
+	ErrInvalidDedupWindow = errors.New("Dedup-Window must be a positive duration such as 5s")
+)
+
+func (l listener) dedupWindow() (d time.Duration, err error) {
+	if l.Dedup_Window == `` {
+		return
+	}
+	if d, err = time.ParseDuration(l.Dedup_Window); err != nil || d <= 0 {
+		err = ErrInvalidDedupWindow
+	}
+	return
+}
+
+// dedupProcessor drops entries whose payload was already seen within the Dedup-Window.
+// Hashes are kept in two generations that rotate every window, so a hash is forgotten
+// at most two windows after it was last seen and memory stays bounded by the rate.
+type dedupProcessor struct {
+	sync.Mutex
+	name    string
+	window  time.Duration
+	cur     map[uint64]time.Time
+	prev    map[uint64]time.Time
+	rotated time.Time
+	dups    uint64
+	stats   *listenerStats
+	next    entryProcessor
+	igst    *ingest.IngestMuxer
+	done    chan struct{}
+}
+
+// newDedupProcessor returns nil if the listener does not set a Dedup-Window
+func newDedupProcessor(name string, l *listener, next entryProcessor) (*dedupProcessor, error) {
+	window, err := l.dedupWindow()
+	if err != nil || window == 0 {
+		return nil, err
+	}
+	return &dedupProcessor{
+		name:    name,
+		window:  window,
+		cur:     map[uint64]time.Time{},
+		prev:    map[uint64]time.Time{},
+		rotated: time.Now(),
+		next:    next,
+	}, nil
+}
+
+// seen records the payload hash and reports whether it was already seen within the window
+func (dp *dedupProcessor) seen(b []byte, now time.Time) bool {
+	h := fnv.New64a()
+	h.Write(b)
+	key := h.Sum64()
+	dp.Lock()
+	defer dp.Unlock()
+	if now.Sub(dp.rotated) >= dp.window {
+		dp.prev, dp.cur, dp.rotated = dp.cur, make(map[uint64]time.Time, len(dp.cur)), now
+	}
+	last, ok := dp.cur[key]
+	if !ok {
+		last, ok = dp.prev[key]
+	}
+	if ok && now.Sub(last) < dp.window {
+		return true
+	}
+	dp.cur[key] = now
+	return false
+}
+
+func (dp *dedupProcessor) Process(ent *entry.Entry) error {
+	if dp.seen(ent.Data, time.Now()) {
+		atomic.AddUint64(&dp.dups, 1)
+		dp.stats.duplicate()
+		return nil
+	}
+	return dp.next.Process(ent)
+}
+
+// start logs the suppressed duplicate counts every dedupSummaryInterval until closed
+func (dp *dedupProcessor) start(igst *ingest.IngestMuxer) {
+	dp.igst = igst
+	dp.done = make(chan struct{})
+	go runEvery(dedupSummaryInterval, dp.done, dp.report)
+}
+
+func (dp *dedupProcessor) report() {
+	if n := atomic.SwapUint64(&dp.dups, 0); n > 0 {
+		lg.Info("Listener %s suppressed %d duplicate entries\n", dp.name, n)
+		dp.igst.Info("listener %s suppressed %d duplicate entries", dp.name, n)
+	}
+}
+
+// Close stops the summary routine and reports duplicates since the last summary
+func (dp *dedupProcessor) Close() error {
+	if dp.done != nil {
+		close(dp.done)
+		dp.report()
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestDedupWindow(t *testing.T) {
+	cp := &capProcessor{}
+	dp, err := newDedupProcessor(`test`, &listener{Dedup_Window: `2s`}, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := dp.rotated
+	if dp.seen([]byte(`a`), now) || dp.seen([]byte(`b`), now) {
+		t.Fatal("first copies reported as duplicates")
+	} else if !dp.seen([]byte(`a`), now.Add(time.Second)) {
+		t.Fatal("missed a duplicate inside the window")
+	}
+	//c is remembered through the rotation in the previous generation
+	if dp.seen([]byte(`c`), now.Add(1500*time.Millisecond)) {
+		t.Fatal("first copy reported as a duplicate")
+	} else if !dp.seen([]byte(`c`), now.Add(2500*time.Millisecond)) {
+		t.Fatal("missed a duplicate after a rotation")
+	} else if dp.seen([]byte(`b`), now.Add(2500*time.Millisecond)) {
+		t.Fatal("b should have aged out of the window")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = dp.Process(&entry.Entry{Data: []byte(`dup`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cp.ents) != 1 || dp.dups != 2 {
+		t.Fatalf("bad dedup results %d entries, %d duplicates", len(cp.ents), dp.dups)
+	}
+	if dp, err = newDedupProcessor(`test`, &listener{}, cp); err != nil || dp != nil {
+		t.Fatal("built a dedup processor without a Dedup-Window", err)
+	}
+	for _, v := range []string{`0s`, `-1s`, `bogus`} {
+		if _, err = (listener{Dedup_Window: v}).dedupWindow(); err != ErrInvalidDedupWindow {
+			t.Fatalf("accepted invalid Dedup-Window %q", v)
+		}
+	}
+}
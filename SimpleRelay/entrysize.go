@@ -0,0 +1,153 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	oversizeSummaryInterval = time.Minute
+)
+
+var (
+	ErrOversizeWithoutMax = errors.New("Oversize-Policy requires a Max-Entry-Size")
+	ErrInvalidMaxEntry    = fmt.Errorf("Max-Entry-Size must be between 1 and %d", maxDataSize)
+)
+
+// entrySizer enforces the Max-Entry-Size on a listener, oversized entries are either
+// truncated or dropped and both are counted and logged periodically
+type entrySizer struct {
+	name      string
+	max       int
+	truncate  bool
+	dropped   uint64
+	truncated uint64
+	stats     *listenerStats
+	igst      *ingest.IngestMuxer
+	done      chan struct{}
+}
+
+func translateOversizePolicy(s string) (truncate bool, err error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case ``, `drop`:
+	case `truncate`:
+		truncate = true
+	default:
+		err = errors.New("invalid Oversize-Policy, must be drop or truncate")
+	}
+	return
+}
+
+// validateEntrySize checks the Max-Entry-Size, entries cannot be larger than the read buffers
+func (l listener) validateEntrySize() error {
+	if _, err := translateOversizePolicy(l.Oversize_Policy); err != nil {
+		return err
+	}
+	if l.Max_Entry_Size == 0 {
+		if l.Oversize_Policy != `` {
+			return ErrOversizeWithoutMax
+		}
+		return nil
+	} else if l.Max_Entry_Size < 0 || l.Max_Entry_Size > maxDataSize {
+		return ErrInvalidMaxEntry
+	}
+	return nil
+}
+
+// newEntrySizer returns nil if the listener does not set a Max-Entry-Size
+func newEntrySizer(name string, l *listener) (*entrySizer, error) {
+	if l.Max_Entry_Size <= 0 {
+		return nil, nil
+	}
+	truncate, err := translateOversizePolicy(l.Oversize_Policy)
+	if err != nil {
+		return nil, err
+	}
+	return &entrySizer{
+		name:     name,
+		max:      l.Max_Entry_Size,
+		truncate: truncate,
+	}, nil
+}
+
+// check returns the entry data to send and false if the entry should be dropped,
+// a nil sizer passes everything through
+func (es *entrySizer) check(b []byte) ([]byte, bool) {
+	if es == nil || len(b) <= es.max {
+		return b, true
+	} else if !es.truncate {
+		atomic.AddUint64(&es.dropped, 1)
+		es.stats.drop()
+		return nil, false
+	}
+	atomic.AddUint64(&es.truncated, 1)
+	return b[:es.max], true
+}
+
+// split wraps a line splitter so lines longer than the Max-Entry-Size are truncated or
+// dropped as they are read, rather than filling the read buffer and failing the connection.
+// The rest of an oversized line is thrown away, a nil sizer returns the native splitter.
+func (es *entrySizer) split(native bufio.SplitFunc) bufio.SplitFunc {
+	if es == nil {
+		return native
+	}
+	var discard bool //in the middle of an oversized line
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = native(data, atEOF)
+		if discard {
+			if advance > 0 || err != nil {
+				discard = false
+				return advance, nil, err
+			}
+			return len(data), nil, nil
+		} else if advance > 0 || token != nil || err != nil {
+			return
+		} else if len(data) <= es.max && len(data) < maxDataSize {
+			return //ask for more data
+		}
+		//the buffer can hold no more than maxDataSize, so a line that fills it is oversized
+		discard = true
+		token, _ = es.check(data)
+		return len(data), token, nil
+	}
+}
+
+// start logs the oversized entry counts every oversizeSummaryInterval until the sizer is closed
+func (es *entrySizer) start(igst *ingest.IngestMuxer) {
+	es.igst = igst
+	es.done = make(chan struct{})
+	go runEvery(oversizeSummaryInterval, es.done, es.report)
+}
+
+func (es *entrySizer) report() {
+	dropped := atomic.SwapUint64(&es.dropped, 0)
+	truncated := atomic.SwapUint64(&es.truncated, 0)
+	if dropped == 0 && truncated == 0 {
+		return
+	}
+	lg.Warn("Listener %s dropped %d and truncated %d entries larger than the Max-Entry-Size of %d\n", es.name, dropped, truncated, es.max)
+	es.igst.Warn("listener %s dropped %d and truncated %d entries larger than the Max-Entry-Size of %d", es.name, dropped, truncated, es.max)
+}
+
+// Close stops the summary routine and reports any oversized entries since the last summary
+func (es *entrySizer) Close() error {
+	if es.done != nil {
+		close(es.done)
+		es.report()
+	}
+	return nil
+}
@@ -0,0 +1,374 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	forwardNonceSize     = 16
+	forwardWriteTimeout  = 10 * time.Second
+	forwardEventTimeType = 0
+)
+
+var (
+	ErrFluentdOptionsWithoutReader = errors.New("Shared-Key and Fluentd-Tag-Field require Reader-Type fluentd")
+	ErrFluentdWithoutTCP           = errors.New("Reader-Type fluentd requires a TCP or TLS listener")
+	ErrFluentdOptions              = errors.New("Framing and Encoding do not apply to Reader-Type fluentd")
+	ErrInvalidForwardMessage       = errors.New("invalid forward protocol message")
+	ErrForwardAuthFailed           = errors.New("forward client failed shared key authentication")
+)
+
+// validateFluentdReader checks the options that only apply to the fluentd reader type
+func (l listener) validateFluentdReader() error {
+	lrt, err := translateReaderType(l.Reader_Type)
+	if err != nil {
+		return err
+	}
+	if lrt != fluentdReader {
+		if l.Shared_Key != `` || l.Fluentd_Tag_Field != `` {
+			return ErrFluentdOptionsWithoutReader
+		}
+		return nil
+	}
+	if l.Framing != `` || l.Encoding != `` {
+		return ErrFluentdOptions
+	}
+	if tp, _, err := translateBindType(l.Bind_String); err != nil {
+		return err
+	} else if tp.UDP() {
+		return ErrFluentdWithoutTCP
+	}
+	return nil
+}
+
+// forwardConnHandlerTCP reads the fluentd forward protocol, each event record becomes a JSON
+// entry with the event time as its timestamp.  Chunks that ask for an ack are acknowledged
+// once their entries have been handed to the processors.
+func forwardConnHandlerTCP(c net.Conn, cfg handlerConfig) {
+	cfg.wg.Add(1)
+	id := addConn(c)
+	defer cfg.wg.Done()
+	defer delConn(id)
+	defer c.Close()
+	rip := cfg.src
+	if rip == nil {
+		if rip = addrIP(c.RemoteAddr()); rip == nil {
+			fmt.Fprintf(os.Stderr, "Failed to get remote addr from \"%s\"\n", c.RemoteAddr().String())
+			return
+		}
+	}
+	fh := forwardHandler{
+		cfg:    cfg,
+		src:    rip,
+		sender: addrIP(c.RemoteAddr()),
+		tag:    cfg.sourceTag(c.RemoteAddr()),
+	}
+	rdr := bufio.NewReader(c)
+	if cfg.sharedKey != `` {
+		if err := forwardHandshake(c, rdr, cfg.sharedKey); err != nil {
+			cfg.stats.parseFailure()
+			fmt.Fprintf(os.Stderr, "Forward handshake with %v failed: %v\n", c.RemoteAddr(), err)
+			return
+		}
+	}
+	dec := newMsgpackDecoder(rdr, maxDataSize)
+	for {
+		v, err := dec.Decode()
+		if err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				cfg.stats.parseFailure()
+				fmt.Fprintf(os.Stderr, "Failed to read forward message from %v: %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+		chunk, err := fh.handleMessage(v)
+		if err != nil {
+			cfg.stats.parseFailure()
+			fmt.Fprintf(os.Stderr, "Bad forward message from %v: %v\n", c.RemoteAddr(), err)
+			return
+		} else if chunk != `` {
+			var e msgpackEncoder
+			e.mapHeader(1)
+			e.str(`ack`)
+			e.str(chunk)
+			c.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+			if _, err = c.Write(e.b); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// forwardHandshake authenticates a client with the shared key, see the forward protocol
+// specification v1.  The server sends HELO with a nonce, the client answers with PING
+// carrying a digest of the key, and the server returns PONG with its own digest so the
+// client can verify the server knows the key too.  User authentication is not used.
+func forwardHandshake(c net.Conn, rdr *bufio.Reader, sharedKey string) error {
+	nonce := make([]byte, forwardNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	var e msgpackEncoder
+	e.arrayHeader(2)
+	e.str(`HELO`)
+	e.mapHeader(3)
+	e.str(`nonce`)
+	e.bin(nonce)
+	e.str(`auth`)
+	e.bin(nil)
+	e.str(`keepalive`)
+	e.bool(true)
+	c.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+	if _, err := c.Write(e.b); err != nil {
+		return err
+	}
+
+	v, err := newMsgpackDecoder(rdr, maxDataSize).Decode()
+	if err != nil {
+		return err
+	}
+	ping, ok := v.([]interface{})
+	if !ok || len(ping) < 4 || msgpackString(ping[0]) != `PING` {
+		return ErrInvalidForwardMessage
+	}
+	hostname := msgpackString(ping[1])
+	salt := msgpackString(ping[2])
+	digest := msgpackString(ping[3])
+	authOK := subtle.ConstantTimeCompare([]byte(digest), []byte(forwardDigest(salt, hostname, nonce, sharedKey))) == 1
+
+	serverName, _ := os.Hostname()
+	e = msgpackEncoder{}
+	e.arrayHeader(5)
+	e.str(`PONG`)
+	e.bool(authOK)
+	if authOK {
+		e.str(``)
+		e.str(serverName)
+		e.str(forwardDigest(salt, serverName, nonce, sharedKey))
+	} else {
+		e.str(`shared_key mismatch`)
+		e.str(``)
+		e.str(``)
+	}
+	c.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+	if _, err = c.Write(e.b); err != nil {
+		return err
+	} else if !authOK {
+		return ErrForwardAuthFailed
+	}
+	return nil
+}
+
+func forwardDigest(salt, hostname string, nonce []byte, sharedKey string) string {
+	h := sha512.New()
+	io.WriteString(h, salt)
+	io.WriteString(h, hostname)
+	h.Write(nonce)
+	io.WriteString(h, sharedKey)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type forwardHandler struct {
+	cfg    handlerConfig
+	src    net.IP
+	sender net.IP
+	tag    entry.EntryTag
+}
+
+// handleMessage handles a message in any of the forward protocol modes and returns the
+// chunk ID to acknowledge, if any.
+//
+//	Message:        [tag, time, record, option]
+//	Forward:        [tag, [[time, record], ...], option]
+//	PackedForward:  [tag, msgpack stream of [time, record], option], gzip compressed if the
+//	                option has compressed set to gzip
+func (fh *forwardHandler) handleMessage(v interface{}) (chunk string, err error) {
+	msg, ok := v.([]interface{})
+	if !ok || len(msg) < 2 {
+		return ``, ErrInvalidForwardMessage
+	}
+	tag := msgpackString(msg[0])
+	var option map[string]interface{}
+	switch ev := msg[1].(type) {
+	case []interface{}:
+		option = forwardOption(msg, 2)
+		for _, e := range ev {
+			pair, ok := e.([]interface{})
+			if !ok || len(pair) < 2 {
+				return ``, ErrInvalidForwardMessage
+			} else if err = fh.handleEvent(tag, pair[0], pair[1]); err != nil {
+				return
+			}
+		}
+	case string, []byte:
+		option = forwardOption(msg, 2)
+		var r io.Reader = bytes.NewReader(msgpackBytes(ev))
+		if msgpackString(option[`compressed`]) == `gzip` {
+			var gz *gzip.Reader
+			if gz, err = gzip.NewReader(r); err != nil {
+				return
+			}
+			defer gz.Close()
+			r = gz
+		}
+		dec := newMsgpackDecoder(r, maxDataSize)
+		for {
+			var e interface{}
+			if e, err = dec.Decode(); err == io.EOF {
+				err = nil
+				break
+			} else if err != nil {
+				return
+			}
+			pair, ok := e.([]interface{})
+			if !ok || len(pair) < 2 {
+				return ``, ErrInvalidForwardMessage
+			} else if err = fh.handleEvent(tag, pair[0], pair[1]); err != nil {
+				return
+			}
+		}
+	default:
+		if len(msg) < 3 {
+			return ``, ErrInvalidForwardMessage
+		}
+		option = forwardOption(msg, 3)
+		if err = fh.handleEvent(tag, msg[1], msg[2]); err != nil {
+			return
+		}
+	}
+	chunk = msgpackString(option[`chunk`])
+	return
+}
+
+// handleEvent sends a single record, records that can't be encoded as JSON are counted as
+// parse failures and dropped
+func (fh *forwardHandler) handleEvent(tag string, tm, rec interface{}) error {
+	record, ok := rec.(map[string]interface{})
+	if !ok {
+		return ErrInvalidForwardMessage
+	}
+	ts, ok := forwardTime(tm)
+	if !ok {
+		return ErrInvalidForwardMessage
+	}
+	if !fh.cfg.limiter.allow(fh.sender, time.Now()) {
+		return nil
+	}
+	if fh.cfg.tagField != `` {
+		record[fh.cfg.tagField] = tag
+	}
+	b, err := json.Marshal(jsonValue(record))
+	if err != nil {
+		fh.cfg.stats.parseFailure()
+		return nil
+	}
+	data, ok := fh.cfg.sizer.check(b)
+	if !ok {
+		return nil
+	}
+	ent := &entry.Entry{
+		SRC:  fh.src,
+		TS:   entry.FromStandard(ts),
+		Tag:  fh.tag,
+		Data: data,
+	}
+	if fh.cfg.ignoreTimestamps {
+		ent.TS = entry.Now()
+	}
+	return fh.cfg.proc.Process(ent)
+}
+
+// forwardTime decodes an event time, either integer seconds or the EventTime extension
+// holding big endian seconds and nanoseconds
+func forwardTime(v interface{}) (t time.Time, ok bool) {
+	switch tv := v.(type) {
+	case int64:
+		return time.Unix(tv, 0), true
+	case uint64:
+		return time.Unix(int64(tv), 0), true
+	case float64:
+		sec := int64(tv)
+		return time.Unix(sec, int64((tv-float64(sec))*1e9)), true
+	case msgpackExt:
+		if tv.typ == forwardEventTimeType && len(tv.data) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint32(tv.data)), int64(binary.BigEndian.Uint32(tv.data[4:]))), true
+		}
+	}
+	return
+}
+
+func forwardOption(msg []interface{}, idx int) map[string]interface{} {
+	if len(msg) > idx {
+		if opt, ok := msg[idx].(map[string]interface{}); ok {
+			return opt
+		}
+	}
+	return nil
+}
+
+// jsonValue converts decoded msgpack to values encoding/json renders naturally, bin values
+// are treated as strings and EventTime values become RFC3339 timestamps
+func jsonValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		for k, val := range tv {
+			tv[k] = jsonValue(val)
+		}
+	case []interface{}:
+		for i, val := range tv {
+			tv[i] = jsonValue(val)
+		}
+	case []byte:
+		return string(tv)
+	case msgpackExt:
+		if t, ok := forwardTime(tv); ok {
+			return t.UTC().Format(time.RFC3339Nano)
+		}
+		return tv.data
+	}
+	return v
+}
+
+func msgpackString(v interface{}) string {
+	switch tv := v.(type) {
+	case string:
+		return tv
+	case []byte:
+		return string(tv)
+	}
+	return ``
+}
+
+func msgpackBytes(v interface{}) []byte {
+	switch tv := v.(type) {
+	case string:
+		return []byte(tv)
+	case []byte:
+		return tv
+	}
+	return nil
+}
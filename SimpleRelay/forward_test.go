@@ -0,0 +1,264 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var forwardTS = time.Date(2020, 6, 1, 12, 30, 0, 500, time.UTC)
+
+// eventTime appends a fluentd EventTime extension
+func eventTime(e *msgpackEncoder, t time.Time) {
+	var buff [8]byte
+	binary.BigEndian.PutUint32(buff[:], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(buff[4:], uint32(t.Nanosecond()))
+	e.b = append(append(e.b, 0xd7, forwardEventTimeType), buff[:]...)
+}
+
+// record appends [time, {"msg": msg}]
+func record(e *msgpackEncoder, msg string) {
+	e.arrayHeader(2)
+	eventTime(e, forwardTS)
+	e.mapHeader(1)
+	e.str(`msg`)
+	e.str(msg)
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	input := []byte{
+		0x93,             //fixarray of 3
+		0x01,             //positive fixint
+		0xff,             //negative fixint
+		0xd1, 0xff, 0x00, //int16 -256
+		0x84,                                          //fixmap of 4
+		0xa1, 'a', 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, //float64 1.5
+		0xa1, 'b', 0xc4, 0x02, 'h', 'i', //bin
+		0xa1, 'c', 0xc0, //nil
+		0x07, 0xc3, //integer key, true
+	}
+	v, err := newMsgpackDecoder(bytes.NewReader(input), 1024).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []interface{}{int64(1), int64(-1), int64(-256)}
+	arr, ok := v.([]interface{})
+	if !ok || !reflect.DeepEqual(arr, expect) {
+		t.Fatalf("bad array %#v", v)
+	}
+	v, err = newMsgpackDecoder(bytes.NewReader(input[6:]), 1024).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, map[string]interface{}{`a`: 1.5, `b`: []byte(`hi`), `c`: nil, `7`: true}) {
+		t.Fatalf("bad map %#v", v)
+	}
+
+	//oversized lengths and truncated objects are errors, not allocations or EOF
+	if _, err = newMsgpackDecoder(bytes.NewReader([]byte{0xdb, 0x7f, 0, 0, 0}), 1024).Decode(); err != ErrMsgpackTooLarge {
+		t.Fatalf("bad oversize error %v", err)
+	} else if _, err = newMsgpackDecoder(bytes.NewReader(input[6:16]), 1024).Decode(); err == nil || err.Error() != `unexpected EOF` {
+		t.Fatalf("bad truncated error %v", err)
+	}
+}
+
+func TestForwardModes(t *testing.T) {
+	var e msgpackEncoder
+	//message mode with an ack request
+	e.arrayHeader(4)
+	e.str(`app.access`)
+	eventTime(&e, forwardTS)
+	e.mapHeader(1)
+	e.str(`msg`)
+	e.str(`message`)
+	e.mapHeader(1)
+	e.str(`chunk`)
+	e.str(`abc123`)
+
+	//forward mode
+	e.arrayHeader(2)
+	e.str(`app.error`)
+	e.arrayHeader(2)
+	record(&e, `forward1`)
+	record(&e, `forward2`)
+
+	//compressed packed forward mode
+	var packed msgpackEncoder
+	record(&packed, `packed1`)
+	record(&packed, `packed2`)
+	var gz bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write(packed.b)
+	gzw.Close()
+	e.arrayHeader(3)
+	e.str(`app.packed`)
+	e.bin(gz.Bytes())
+	e.mapHeader(1)
+	e.str(`compressed`)
+	e.str(`gzip`)
+
+	srv, cli := net.Pipe()
+	cp := &capProcessor{}
+	cfg := handlerConfig{
+		lrt:      fluentdReader,
+		tagField: `fluent_tag`,
+		wg:       &sync.WaitGroup{},
+		proc:     cp,
+		src:      net.ParseIP(`10.0.0.1`),
+	}
+	acks := make(chan interface{}, 1)
+	go func() {
+		cli.Write(e.b)
+		cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+		v, _ := newMsgpackDecoder(cli, 1024).Decode()
+		acks <- v
+		cli.Close()
+	}()
+	forwardConnHandlerTCP(srv, cfg)
+	if ack := <-acks; !reflect.DeepEqual(ack, map[string]interface{}{`ack`: `abc123`}) {
+		t.Fatalf("bad ack %#v", ack)
+	}
+	expect := []string{
+		`{"fluent_tag":"app.access","msg":"message"}`,
+		`{"fluent_tag":"app.error","msg":"forward1"}`,
+		`{"fluent_tag":"app.error","msg":"forward2"}`,
+		`{"fluent_tag":"app.packed","msg":"packed1"}`,
+		`{"fluent_tag":"app.packed","msg":"packed2"}`,
+	}
+	if len(cp.ents) != len(expect) {
+		t.Fatalf("got %d entries", len(cp.ents))
+	}
+	for i, ent := range cp.ents {
+		if string(ent.Data) != expect[i] {
+			t.Fatalf("bad entry %d: %s", i, ent.Data)
+		} else if !ent.TS.StandardTime().Equal(forwardTS) {
+			t.Fatalf("bad timestamp %v", ent.TS.StandardTime())
+		}
+	}
+}
+
+func TestForwardTime(t *testing.T) {
+	if ts, ok := forwardTime(int64(1500000000)); !ok || ts.Unix() != 1500000000 {
+		t.Fatalf("bad integer time %v", ts)
+	} else if ts, ok = forwardTime(uint64(1500000000)); !ok || ts.Unix() != 1500000000 {
+		t.Fatalf("bad unsigned time %v", ts)
+	} else if ts, ok = forwardTime(1500000000.25); !ok || ts.UnixNano() != 1500000000250000000 {
+		t.Fatalf("bad float time %v", ts)
+	} else if _, ok = forwardTime(msgpackExt{typ: 1, data: make([]byte, 8)}); ok {
+		t.Fatal("accepted unknown extension")
+	} else if _, ok = forwardTime(`now`); ok {
+		t.Fatal("accepted string time")
+	}
+}
+
+// forwardClientHandshake runs the client side of the handshake and returns the PONG
+func forwardClientHandshake(t *testing.T, c net.Conn, key string) []interface{} {
+	rdr := bufio.NewReader(c)
+	v, err := newMsgpackDecoder(rdr, 1024).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	helo, ok := v.([]interface{})
+	if !ok || len(helo) != 2 || helo[0] != `HELO` {
+		t.Fatalf("bad HELO %#v", v)
+	}
+	nonce := msgpackBytes(helo[1].(map[string]interface{})[`nonce`])
+	if len(nonce) != forwardNonceSize {
+		t.Fatalf("bad nonce %v", nonce)
+	}
+	var e msgpackEncoder
+	e.arrayHeader(6)
+	e.str(`PING`)
+	e.str(`client`)
+	e.str(`salt`)
+	e.str(forwardDigest(`salt`, `client`, nonce, key))
+	e.str(``)
+	e.str(``)
+	if _, err = c.Write(e.b); err != nil {
+		t.Fatal(err)
+	}
+	if v, err = newMsgpackDecoder(rdr, 1024).Decode(); err != nil {
+		t.Fatal(err)
+	}
+	pong, ok := v.([]interface{})
+	if !ok || len(pong) != 5 || pong[0] != `PONG` {
+		t.Fatalf("bad PONG %#v", v)
+	}
+	if pong[1] == true && pong[4] != forwardDigest(`salt`, msgpackString(pong[3]), nonce, key) {
+		t.Fatalf("bad server digest %#v", pong)
+	}
+	return pong
+}
+
+func TestForwardHandshake(t *testing.T) {
+	for key, ok := range map[string]bool{`secret`: true, `wrong`: false} {
+		srv, cli := net.Pipe()
+		cp := &capProcessor{}
+		cfg := handlerConfig{
+			lrt:       fluentdReader,
+			sharedKey: `secret`,
+			wg:        &sync.WaitGroup{},
+			proc:      cp,
+			src:       net.ParseIP(`10.0.0.1`),
+		}
+		done := make(chan struct{})
+		go func() {
+			forwardConnHandlerTCP(srv, cfg)
+			close(done)
+		}()
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		if pong := forwardClientHandshake(t, cli, key); pong[1] != ok {
+			t.Fatalf("bad auth result for %s: %#v", key, pong)
+		}
+		if ok {
+			var e msgpackEncoder
+			e.arrayHeader(2)
+			e.str(`app`)
+			e.arrayHeader(1)
+			record(&e, `authenticated`)
+			cli.Write(e.b)
+		}
+		cli.Close()
+		<-done
+		if ok && len(cp.ents) != 1 {
+			t.Fatalf("got %d entries after authenticating", len(cp.ents))
+		} else if !ok && len(cp.ents) != 0 {
+			t.Fatal("accepted entries without authenticating")
+		}
+	}
+}
+
+func TestFluentdReaderConfig(t *testing.T) {
+	l := listener{
+		base:              base{Bind_String: `tcp://0.0.0.0:24224`},
+		Reader_Type:       `forward`,
+		Shared_Key:        `secret`,
+		Fluentd_Tag_Field: `tag`,
+	}
+	if err := l.validateFluentdReader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []listener{
+		{base: base{Bind_String: `udp://0.0.0.0:24224`}, Reader_Type: `fluentd`},
+		{base: base{Bind_String: `tcp://0.0.0.0:24224`}, Reader_Type: `fluentd`, Framing: `newline`},
+		{base: base{Bind_String: `tcp://0.0.0.0:24224`}, Reader_Type: `line`, Shared_Key: `secret`},
+		{base: base{Bind_String: `tcp://0.0.0.0:24224`}, Reader_Type: `json`, Fluentd_Tag_Field: `tag`},
+	} {
+		if err := v.validateFluentdReader(); err == nil {
+			t.Fatalf("accepted invalid fluentd reader %+v", v)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultFraming framingType = iota
+	newlineFraming
+	octetFraming
+	autoFraming
+
+	maxFrameDigits int = 8 //enough for maxDataSize
+)
+
+var (
+	ErrInvalidOctetFrame   = errors.New("Invalid octet counted frame")
+	ErrTruncatedOctetFrame = errors.New("Connection closed in the middle of an octet counted frame")
+	ErrFramingWithoutTCP   = errors.New("Framing only applies to TCP and TLS listeners")
+)
+
+type framingType int
+
+func translateFraming(s string) (framingType, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case ``:
+		return defaultFraming, nil
+	case `newline`:
+		return newlineFraming, nil
+	case `octet-counted`:
+		return octetFraming, nil
+	case `auto`:
+		return autoFraming, nil
+	}
+	return -1, errors.New("invalid framing, must be newline, octet-counted, or auto")
+}
+
+// resolve returns the framing used by a reader when none is configured, RFC5424 readers
+// detect octet counting because syslog messages always begin with a '<' and RFC5425
+// requires it
+func (ft framingType) resolve(lrt readerType) framingType {
+	if lrt == rfc5425Reader {
+		return octetFraming
+	} else if ft != defaultFraming {
+		return ft
+	} else if lrt == rfc5424Reader {
+		return autoFraming
+	}
+	return newlineFraming
+}
+
+// validateFraming checks the framing and reader type against the bind type
+func (l listener) validateFraming() error {
+	ft, err := translateFraming(l.Framing)
+	if err != nil {
+		return err
+	}
+	lrt, err := translateReaderType(l.Reader_Type)
+	if err != nil {
+		return err
+	}
+	tp, _, err := translateBindType(l.Bind_String)
+	if err != nil {
+		return err
+	}
+	if lrt == rfc5425Reader {
+		if !tp.TLS() {
+			return ErrRFC5425WithoutTLS
+		} else if ft != defaultFraming && ft != octetFraming {
+			return ErrRFC5425Framing
+		}
+	} else if tp.UDP() && ft != defaultFraming {
+		return ErrFramingWithoutTCP
+	}
+	return nil
+}
+
+// frameFailure counts a reader that stopped on a broken octet counted frame
+func (hc handlerConfig) frameFailure(err error) {
+	if err == ErrInvalidOctetFrame || err == ErrTruncatedOctetFrame {
+		hc.stats.parseFailure()
+	}
+}
+
+func (ft framingType) String() string {
+	switch ft {
+	case defaultFraming:
+		return `default`
+	case newlineFraming:
+		return `newline`
+	case octetFraming:
+		return `octet-counted`
+	case autoFraming:
+		return `auto`
+	}
+	return `unknown`
+}
+
+// framedSplit wraps the native splitter of a reader with RFC 6587 octet counting, where
+// each message is preceded by its length in ASCII digits and a space.  In auto mode each
+// frame that starts with a digit is octet counted and anything else goes to the native
+// splitter.
+func framedSplit(ft framingType, native bufio.SplitFunc) bufio.SplitFunc {
+	if ft != octetFraming && ft != autoFraming {
+		return native
+	}
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		//skip any whitespace senders put between frames
+		start := 0
+		for start < len(data) && isFrameSpace(data[start]) {
+			start++
+		}
+		if start == len(data) {
+			return len(data), nil, nil
+		}
+		if ft == autoFraming && !isDigit(data[start]) {
+			if advance, token, err = native(data[start:], atEOF); advance > 0 {
+				advance += start
+			}
+			return
+		}
+		i := start
+		for i < len(data) && isDigit(data[i]) && i-start <= maxFrameDigits {
+			i++
+		}
+		if i == len(data) {
+			if atEOF {
+				err = ErrTruncatedOctetFrame
+			}
+			return //ask for more data
+		} else if i == start || data[i] != ' ' || i-start > maxFrameDigits {
+			err = ErrInvalidOctetFrame
+			return
+		}
+		n, lerr := strconv.Atoi(string(data[start:i]))
+		if lerr != nil || n > maxDataSize-(i-start)-1 {
+			err = ErrInvalidOctetFrame
+			return
+		}
+		end := i + 1 + n
+		if len(data) < end {
+			if atEOF {
+				err = ErrTruncatedOctetFrame
+			}
+			return //ask for more data
+		}
+		return end, data[i+1 : end], nil
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isFrameSpace(c byte) bool {
+	return c == '\n' || c == '\r' || c == ' ' || c == '\t'
+}
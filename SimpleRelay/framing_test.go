@@ -0,0 +1,85 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func scanFrames(ft framingType, input string) (r []string, err error) {
+	s := bufio.NewScanner(strings.NewReader(input))
+	s.Buffer(make([]byte, 16), maxDataSize)
+	s.Split(framedSplit(ft, bufio.ScanLines))
+	for s.Scan() {
+		r = append(r, s.Text())
+	}
+	err = s.Err()
+	return
+}
+
+func TestOctetCountedFraming(t *testing.T) {
+	input := "10 <1>1 - a\nb12 <2>1 - c d e\n"
+	r, err := scanFrames(octetFraming, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 2 || r[0] != "<1>1 - a\nb" || r[1] != "<2>1 - c d e" {
+		t.Fatalf("bad frames: %q", r)
+	}
+	if _, err = scanFrames(octetFraming, "<1>no count\n"); err != ErrInvalidOctetFrame {
+		t.Fatal("missed an invalid frame", err)
+	}
+	if _, err = scanFrames(octetFraming, "20 <1>short"); err != ErrTruncatedOctetFrame {
+		t.Fatal("missed a truncated frame", err)
+	}
+}
+
+func TestAutoFraming(t *testing.T) {
+	input := "<1>line one\n11 <2>framed\n\n<3>line two"
+	r, err := scanFrames(autoFraming, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r) != 3 || r[0] != "<1>line one" || r[1] != "<2>framed\n\n" || r[2] != "<3>line two" {
+		t.Fatalf("bad frames: %q", r)
+	}
+}
+
+func TestFramingDefaults(t *testing.T) {
+	if ft, err := translateFraming(``); err != nil || ft.resolve(rfc5424Reader) != autoFraming {
+		t.Fatal("rfc5424 readers should detect framing", ft, err)
+	} else if ft.resolve(lineReader) != newlineFraming {
+		t.Fatal("line readers should use newlines by default")
+	}
+	if _, err := translateFraming(`bogus`); err == nil {
+		t.Fatal("accepted invalid framing")
+	}
+}
+
+func TestRFC5425Listener(t *testing.T) {
+	l := listener{
+		base:        base{Bind_String: `tls://0.0.0.0:6514`},
+		Reader_Type: `rfc5425`,
+	}
+	if err := l.validateFraming(); err != nil {
+		t.Fatal(err)
+	} else if defaultFraming.resolve(rfc5425Reader) != octetFraming {
+		t.Fatal("rfc5425 readers must use octet counting")
+	}
+	l.Framing = `newline`
+	if err := l.validateFraming(); err != ErrRFC5425Framing {
+		t.Fatal("accepted newline framing on an rfc5425 listener", err)
+	}
+	l.Framing = ``
+	l.Bind_String = `tcp://0.0.0.0:6514`
+	if err := l.validateFraming(); err != ErrRFC5425WithoutTLS {
+		t.Fatal("accepted rfc5425 without TLS", err)
+	}
+}
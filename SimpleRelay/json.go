@@ -21,27 +21,23 @@ import (
 
 	"github.com/gravwell/ingest/v3"
 	"github.com/gravwell/ingest/v3/entry"
-	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/timegrinder/v3"
 
 	"github.com/buger/jsonparser"
 )
 
 type jsonHandlerConfig struct {
-	defTag           entry.EntryTag
-	tags             map[string]entry.EntryTag
-	ignoreTimestamps bool
-	setLocalTime     bool
-	timezoneOverride string
-	src              net.IP
-	wg               *sync.WaitGroup
-	formatOverride   string
-	flds             []string
-	proc             *processors.ProcessorSet
+	timeConfig
+	defTag entry.EntryTag
+	tags   map[string]entry.EntryTag
+	src    net.IP
+	wg     *sync.WaitGroup
+	flds   []string
+	stats  *listenerStats
+	proc   entryProcessor
 }
 
 func startJSONListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitGroup, f *flusher) error {
-	var err error
 	//short circuit out on empty
 	if len(cfg.JSONListener) == 0 {
 		return nil
@@ -49,17 +45,18 @@ func startJSONListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitGro
 
 	for k, v := range cfg.JSONListener {
 		jhc := jsonHandlerConfig{
-			wg:               wg,
-			tags:             map[string]entry.EntryTag{},
-			ignoreTimestamps: v.Ignore_Timestamps,
-			setLocalTime:     v.Assume_Local_Timezone,
-			timezoneOverride: v.Timezone_Override,
+			wg:         wg,
+			tags:       map[string]entry.EntryTag{},
+			timeConfig: v.timeConfig(),
+			stats:      allStats.get(k),
 		}
-		if jhc.proc, err = cfg.Preprocessor.ProcessorSet(igst, v.Preprocessor); err != nil {
+		proc, err := cfg.Preprocessor.ProcessorSet(igst, v.Preprocessor)
+		if err != nil {
 			lg.Error("Preprocessor failure: %v", err)
 			return err
 		}
-		f.Add(jhc.proc)
+		f.Add(proc)
+		jhc.proc = newStatsProcessor(jhc.stats, proc)
 		if jhc.flds, err = v.GetJsonFields(); err != nil {
 			return err
 		}
@@ -92,14 +89,6 @@ func startJSONListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitGro
 			}
 			jhc.tags[tm.Value] = tg
 		}
-		//check format override
-		if v.Timestamp_Format_Override != `` {
-			if err = timegrinder.ValidateFormatOverride(v.Timestamp_Format_Override); err != nil {
-				return fmt.Errorf("%s Invalid timestamp override \"%s\": %v\n", k, v.Timestamp_Format_Override, err)
-			}
-			jhc.formatOverride = v.Timestamp_Format_Override
-		}
-
 		tp, str, err := translateBindType(v.Bind_String)
 		if err != nil {
 			lg.FatalCode(0, "Invalid bind string \"%s\": %v\n", v.Bind_String, err)
@@ -111,34 +100,38 @@ func startJSONListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitGro
 			if err != nil {
 				return fmt.Errorf("%s Bind-String \"%s\" is invalid: %v\n", k, v.Bind_String, err)
 			}
-			l, err := net.ListenTCP("tcp", addr)
+			tl, err := net.ListenTCP("tcp", addr)
 			if err != nil {
 				return fmt.Errorf("%s Failed to listen on \"%s\": %v\n", k, addr, err)
 			}
-			connID := addConn(l)
+			l, err := v.wrapListener(tl)
+			if err != nil {
+				return fmt.Errorf("%s Invalid connection options: %v\n", k, err)
+			}
+			connID := addListener(l)
 			//start the acceptor
 			wg.Add(1)
 			go jsonAcceptor(l, connID, igst, jhc, tp)
 		} else if tp.TLS() {
-			config := &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			}
-
-			config.Certificates = make([]tls.Certificate, 1)
-			config.Certificates[0], err = tls.LoadX509KeyPair(v.Cert_File, v.Key_File)
+			config, err := v.tlsConfig(v.Cert_File, v.Key_File)
 			if err != nil {
-				lg.Fatal("Certificate load fail: %v", err)
+				lg.Fatal("TLS configuration for %s failed: %v", k, err)
 			}
 			//get the socket
 			addr, err := net.ResolveTCPAddr("tcp", str)
 			if err != nil {
 				lg.FatalCode(0, "Bind-String \"%s\" for %s is invalid: %v\n", v.Bind_String, k, err)
 			}
-			l, err := tls.Listen("tcp", addr.String(), config)
+			tl, err := net.ListenTCP("tcp", addr)
 			if err != nil {
 				lg.FatalCode(0, "Failed to listen on \"%s\" via TLS for %s: %v\n", addr, k, err)
 			}
-			connID := addConn(l)
+			wl, err := v.wrapListener(tl)
+			if err != nil {
+				lg.FatalCode(0, "Invalid connection options for %s: %v\n", k, err)
+			}
+			l := tls.NewListener(wl, config)
+			connID := addListener(l)
 			//start the acceptor
 			wg.Add(1)
 			go jsonAcceptor(l, connID, igst, jhc, tp)
@@ -168,10 +161,13 @@ func jsonAcceptor(lst net.Listener, id int, igst *ingest.IngestMuxer, cfg jsonHa
 			}
 			continue
 		}
-		debugout("Accepted %v connection from %s in json mode\n", tp.String(), conn.RemoteAddr())
-		igst.Info("accepted %v connection from %s in json mode\n", tp.String(), conn.RemoteAddr())
 		failCount = 0
-		go jsonConnHandler(conn, cfg)
+		//RemoteAddr waits for the PROXY header from a trusted load balancer, keep it out of the accept loop
+		go func(c net.Conn) {
+			debugout("Accepted %v connection from %s in json mode\n", tp.String(), c.RemoteAddr())
+			igst.Info("accepted %v connection from %s in json mode\n", tp.String(), c.RemoteAddr())
+			jsonConnHandler(c, cfg)
+		}(cfg.stats.track(conn))
 	}
 	return
 }
@@ -202,27 +198,10 @@ func jsonConnHandler(c net.Conn, cfg jsonHandlerConfig) {
 		rip = cfg.src
 	}
 
-	if !cfg.ignoreTimestamps {
-		var err error
-		tcfg := timegrinder.Config{
-			EnableLeftMostSeed: true,
-			FormatOverride:     cfg.formatOverride,
-		}
-		tg, err = timegrinder.NewTimeGrinder(tcfg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to get a handle on the timegrinder: %v\n", err)
-			return
-		}
-		if cfg.setLocalTime {
-			tg.SetLocalTime()
-		}
-		if cfg.timezoneOverride != `` {
-			err = tg.SetTimezone(cfg.timezoneOverride)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to set timezone to %v: %v\n", cfg.timezoneOverride, err)
-				return
-			}
-		}
+	tg, err := cfg.newTimeGrinder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
 	}
 	bio := bufio.NewReader(c)
 	for {
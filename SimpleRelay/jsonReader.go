@@ -0,0 +1,224 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/buger/jsonparser"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+var (
+	ErrJSONOptionsWithoutReader = errors.New("Timestamp-Field and Quarantine-Tag require Reader-Type json")
+	ErrInvalidJSONDocument      = errors.New("Invalid JSON document")
+)
+
+// validateJSONReader checks the options that only apply to the json reader type
+func (l listener) validateJSONReader() error {
+	lrt, err := translateReaderType(l.Reader_Type)
+	if err != nil {
+		return err
+	}
+	if lrt != jsonReader {
+		if l.Timestamp_Field != `` || l.Quarantine_Tag != `` {
+			return ErrJSONOptionsWithoutReader
+		}
+		return nil
+	}
+	if l.Timestamp_Field != `` {
+		if _, err := getJsonFields(l.Timestamp_Field); err != nil {
+			return fmt.Errorf("Invalid Timestamp-Field %q: %v", l.Timestamp_Field, err)
+		}
+	}
+	if l.Quarantine_Tag != `` {
+		if err := ingest.CheckTag(l.Quarantine_Tag); err != nil {
+			return fmt.Errorf("Invalid Quarantine-Tag %q: %v", l.Quarantine_Tag, err)
+		}
+	}
+	return nil
+}
+
+// splitJSONDocument validates a payload and returns the documents it holds, each element
+// of a top level array is its own document
+func splitJSONDocument(b []byte) (docs [][]byte, err error) {
+	if !json.Valid(b) {
+		return nil, ErrInvalidJSONDocument
+	}
+	if b[0] != '[' {
+		return [][]byte{b}, nil
+	}
+	var arr []json.RawMessage
+	if err = json.Unmarshal(b, &arr); err != nil {
+		return
+	}
+	for _, v := range arr {
+		docs = append(docs, []byte(v))
+	}
+	return
+}
+
+// jsonTimestamp pulls the timestamp out of the Timestamp-Field, strings go through the
+// timegrinder and numbers are treated as seconds since the epoch
+func jsonTimestamp(doc []byte, flds []string, tg *timegrinder.TimeGrinder) (ts entry.Timestamp, ok bool) {
+	val, dt, _, err := jsonparser.Get(doc, flds...)
+	if err != nil {
+		return
+	}
+	switch dt {
+	case jsonparser.String:
+		if t, found, err := tg.Extract(val); err == nil && found {
+			ts, ok = entry.FromStandard(t), true
+		}
+	case jsonparser.Number:
+		if f, err := strconv.ParseFloat(string(val), 64); err == nil {
+			sec, frac := math.Modf(f)
+			ts = entry.FromStandard(time.Unix(int64(sec), int64(frac*1e9)))
+			ok = true
+		}
+	}
+	return
+}
+
+// handleJSONPayload sends each document in a payload as its own entry, payloads that are
+// not valid JSON go to the Quarantine-Tag unmodified or are dropped
+func handleJSONPayload(b []byte, ip net.IP, tag entry.EntryTag, tg *timegrinder.TimeGrinder, cfg handlerConfig) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil
+	}
+	docs, err := splitJSONDocument(b)
+	if err != nil {
+		cfg.stats.parseFailure()
+		if !cfg.hasQuarantine {
+			debugout("Dropping invalid JSON document from %v: %v\n", ip, err)
+			return nil
+		}
+		return cfg.proc.Process(&entry.Entry{
+			SRC:  ip,
+			TS:   entry.Now(),
+			Tag:  cfg.quarantine,
+			Data: b,
+		})
+	}
+	for _, doc := range docs {
+		var ts entry.Timestamp
+		var ok bool
+		if !cfg.ignoreTimestamps {
+			if len(cfg.tsFields) > 0 {
+				ts, ok = jsonTimestamp(doc, cfg.tsFields, tg)
+			} else if t, found, err := tg.Extract(doc); err == nil && found {
+				ts, ok = entry.FromStandard(t), true
+			}
+		}
+		if !ok {
+			ts = entry.Now()
+		}
+		ent := &entry.Entry{
+			SRC:  ip,
+			TS:   ts,
+			Tag:  tag,
+			Data: doc,
+		}
+		if err := cfg.proc.Process(ent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func jsonReaderConnHandlerTCP(c net.Conn, cfg handlerConfig) {
+	cfg.wg.Add(1)
+	id := addConn(c)
+	defer cfg.wg.Done()
+	defer delConn(id)
+	defer c.Close()
+	var rip net.IP
+
+	if cfg.src == nil {
+		if rip = addrIP(c.RemoteAddr()); rip == nil {
+			fmt.Fprintf(os.Stderr, "Failed to get remote addr from \"%s\"\n", c.RemoteAddr().String())
+			return
+		}
+	} else {
+		rip = cfg.src
+	}
+	cfg.tag = cfg.sourceTag(c.RemoteAddr())
+	sender := addrIP(c.RemoteAddr())
+
+	tg, err := cfg.newTimeGrinder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	s := bufio.NewScanner(c)
+	s.Buffer(make([]byte, initDataSize), maxDataSize)
+	s.Split(framedSplit(cfg.framing, cfg.sizer.split(bufio.ScanLines)))
+	for s.Scan() {
+		if !cfg.limiter.allow(sender, time.Now()) {
+			continue
+		}
+		data, ok := cfg.sizer.check(s.Bytes())
+		if !ok {
+			continue
+		}
+		//the scanner reuses its buffer, so the bytes must be copied when handing them in
+		if err := handleJSONPayload(append([]byte(nil), data...), rip, cfg.tag, tg, cfg); err != nil {
+			return
+		}
+	}
+	if err := s.Err(); err != nil && !isTimeout(err) {
+		cfg.frameFailure(err)
+		fmt.Fprintf(os.Stderr, "Failed to read JSON from %v: %v\n", c.RemoteAddr(), err)
+	}
+}
+
+// jsonReaderConnHandlerUDP treats each datagram as a single payload
+func jsonReaderConnHandlerUDP(c *net.UDPConn, cfg handlerConfig) {
+	buff := make([]byte, 16*1024) //local buffer that should be big enough for even the largest UDP packets
+	tg, err := cfg.newTimeGrinder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	for {
+		n, raddr, err := c.ReadFromUDP(buff)
+		if err != nil {
+			break
+		}
+		if n == 0 || raddr == nil || n > len(buff) {
+			continue
+		}
+		if !cfg.limiter.allow(raddr.IP, time.Now()) {
+			continue
+		}
+		data, ok := cfg.sizer.check(buff[:n])
+		if !ok {
+			continue
+		}
+		rip := cfg.src
+		if rip == nil {
+			rip = raddr.IP
+		}
+		if err := handleJSONPayload(append([]byte(nil), data...), rip, cfg.sourceTag(raddr), tg, cfg); err != nil {
+			return
+		}
+	}
+}
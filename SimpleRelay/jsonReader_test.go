@@ -0,0 +1,72 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gravwell/timegrinder/v3"
+)
+
+func TestSplitJSONDocument(t *testing.T) {
+	docs, err := splitJSONDocument([]byte(`[{"a":1}, "b", [2,3]]`))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(docs) != 3 || string(docs[0]) != `{"a":1}` || string(docs[1]) != `"b"` || string(docs[2]) != `[2,3]` {
+		t.Fatalf("bad split: %q", docs)
+	}
+	if docs, err = splitJSONDocument([]byte(`{"a":[1,2]}`)); err != nil || len(docs) != 1 {
+		t.Fatal("objects should not be split", docs, err)
+	}
+	for _, v := range []string{`{"a":1`, `[1,2`, `not json`, `{"a":1} {"b":2}`} {
+		if _, err = splitJSONDocument([]byte(v)); err != ErrInvalidJSONDocument {
+			t.Fatalf("accepted invalid document %q: %v", v, err)
+		}
+	}
+}
+
+func TestJSONTimestamp(t *testing.T) {
+	tg, err := timegrinder.NewTimeGrinder(timegrinder.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	flds := []string{`meta`, `ts`}
+	ts, ok := jsonTimestamp([]byte(`{"meta":{"ts":"2020-03-04T05:06:07Z"}}`), flds, tg)
+	if !ok || !ts.StandardTime().Equal(time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)) {
+		t.Fatal("bad string timestamp", ts, ok)
+	}
+	ts, ok = jsonTimestamp([]byte(`{"meta":{"ts":1583298367.5}}`), flds, tg)
+	if !ok || !ts.StandardTime().Equal(time.Unix(1583298367, 500000000)) {
+		t.Fatal("bad epoch timestamp", ts, ok)
+	}
+	if _, ok = jsonTimestamp([]byte(`{"meta":{"other":1}}`), flds, tg); ok {
+		t.Fatal("found a timestamp in a missing field")
+	}
+}
+
+func TestJSONReaderConfig(t *testing.T) {
+	l := listener{
+		base:            base{Bind_String: `udp://0.0.0.0:7778`},
+		Reader_Type:     `json`,
+		Timestamp_Field: `meta.ts`,
+		Quarantine_Tag:  `badjson`,
+	}
+	if err := l.validateJSONReader(); err != nil {
+		t.Fatal(err)
+	}
+	l.Quarantine_Tag = `bad json`
+	if err := l.validateJSONReader(); err == nil {
+		t.Fatal("accepted an invalid Quarantine-Tag")
+	}
+	l.Quarantine_Tag = ``
+	l.Reader_Type = `line`
+	if err := l.validateJSONReader(); err != ErrJSONOptionsWithoutReader {
+		t.Fatal("accepted Timestamp-Field on a line reader", err)
+	}
+}
@@ -12,9 +12,9 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io"
 	"net"
 	"os"
+	"time"
 
 	"github.com/gravwell/timegrinder/v3"
 )
@@ -40,78 +40,53 @@ func lineConnHandlerTCP(c net.Conn, cfg handlerConfig) {
 	} else {
 		rip = cfg.src
 	}
+	cfg.tag = cfg.sourceTag(c.RemoteAddr())
+	sender := addrIP(c.RemoteAddr())
 
-	var tg *timegrinder.TimeGrinder
-	if !cfg.ignoreTimestamps {
-		var err error
-		tcfg := timegrinder.Config{
-			EnableLeftMostSeed: true,
-			FormatOverride:     cfg.formatOverride,
-		}
-		tg, err = timegrinder.NewTimeGrinder(tcfg)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to get a handle on the timegrinder: %v\n", err)
-			return
-		}
-		if cfg.setLocalTime {
-			tg.SetLocalTime()
-		}
-		if cfg.timezoneOverride != `` {
-			err = tg.SetTimezone(cfg.timezoneOverride)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to set timezone to %v: %v\n", cfg.timezoneOverride, err)
-				return
-			}
-		}
-
+	tg, err := cfg.newTimeGrinder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
 	}
-	bio := bufio.NewReader(c)
-	for {
-		data, err := bio.ReadBytes('\n')
-		data = bytes.Trim(data, "\n\r\t ")
+	lineScannerTCP(c, rip, sender, tg, cfg)
+}
 
-		if len(data) > 0 {
-			if ent, err := handleLog(data, rip, cfg.ignoreTimestamps, cfg.tag, tg); err != nil {
-				return
-			} else if err = cfg.proc.Process(ent); err != nil {
-				return
-			}
+// lineScannerTCP reads newline delimited lines or octet counted frames, each is an entry.
+// Lines are bounded by the read buffer, or by the Max-Entry-Size when one is set.
+func lineScannerTCP(c net.Conn, rip, sender net.IP, tg *timegrinder.TimeGrinder, cfg handlerConfig) {
+	s := bufio.NewScanner(c)
+	s.Buffer(make([]byte, initDataSize), maxDataSize)
+	s.Split(framedSplit(cfg.framing, cfg.sizer.split(bufio.ScanLines)))
+	for s.Scan() {
+		data := bytes.Trim(s.Bytes(), "\n\r\t ")
+		if len(data) == 0 || !cfg.limiter.allow(sender, time.Now()) {
+			continue
 		}
-		if err != nil {
-			if err != io.EOF {
-				lerr, ok := err.(*net.OpError)
-				if !ok || lerr.Temporary() {
-					fmt.Fprintf(os.Stderr, "Failed to read line: %v\n", err)
-				}
-			}
+		data, ok := cfg.sizer.check(data)
+		if !ok {
+			continue
+		}
+		//the scanner reuses its buffer, so the bytes must be copied when handing them in
+		if ent, err := handleLog(append([]byte(nil), data...), rip, cfg.ignoreTimestamps, cfg.tag, tg); err != nil {
+			return
+		} else if err = cfg.proc.Process(ent); err != nil {
 			return
 		}
-
+	}
+	if err := s.Err(); err != nil && !isTimeout(err) {
+		cfg.frameFailure(err)
+		fmt.Fprintf(os.Stderr, "Failed to read frame from %v: %v\n", c.RemoteAddr(), err)
 	}
 }
 
 func lineConnHandlerUDP(c *net.UDPConn, cfg handlerConfig) {
 	sp := []byte("\n")
 	buff := make([]byte, 16*1024) //local buffer that should be big enough for even the largest UDP packets
-	tcfg := timegrinder.Config{
-		EnableLeftMostSeed: true,
-		FormatOverride:     cfg.formatOverride,
-	}
-	tg, err := timegrinder.NewTimeGrinder(tcfg)
+	tg, err := cfg.newTimeGrinder()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get a handle on the timegrinder: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
 	}
-	if cfg.setLocalTime {
-		tg.SetLocalTime()
-	}
-	if cfg.timezoneOverride != `` {
-		err = tg.SetTimezone(cfg.timezoneOverride)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to set timezone to %v: %v\n", cfg.timezoneOverride, err)
-			return
-		}
-	}
 
 	for {
 		var rip net.IP
@@ -134,14 +109,20 @@ func lineConnHandlerUDP(c *net.UDPConn, cfg handlerConfig) {
 			rip = cfg.src
 		}
 
+		tag := cfg.sourceTag(raddr)
+
 		lns := bytes.Split(buff[:n], sp)
 		for _, ln := range lns {
 			ln = bytes.Trim(ln, "\n\r\t ")
-			if len(ln) == 0 {
+			if len(ln) == 0 || !cfg.limiter.allow(raddr.IP, time.Now()) {
+				continue
+			}
+			ln, ok := cfg.sizer.check(ln)
+			if !ok {
 				continue
 			}
 			//because we are using and reusing a local buffer, we have to copy the bytes when handing in
-			if ent, err := handleLog(append([]byte(nil), ln...), rip, cfg.ignoreTimestamps, cfg.tag, tg); err != nil {
+			if ent, err := handleLog(append([]byte(nil), ln...), rip, cfg.ignoreTimestamps, tag, tg); err != nil {
 				return
 			} else if err = cfg.proc.Process(ent); err != nil {
 				return
@@ -0,0 +1,283 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	lumberjackVersion    byte = '2'
+	lumberjackWindow     byte = 'W'
+	lumberjackJSON       byte = 'J'
+	lumberjackData       byte = 'D'
+	lumberjackCompressed byte = 'C'
+	lumberjackAck        byte = 'A'
+
+	lumberjackWriteTimeout = 10 * time.Second
+)
+
+var (
+	ErrBeatsWithoutTCP           = errors.New("Reader-Type beats requires a TCP or TLS listener")
+	ErrBeatsOptions              = errors.New("Framing and Encoding do not apply to Reader-Type beats")
+	ErrInvalidLumberjackVersion  = errors.New("unsupported lumberjack protocol version")
+	ErrInvalidLumberjackFrame    = errors.New("invalid lumberjack frame type")
+	ErrLumberjackFrameTooLarge   = errors.New("lumberjack frame is too large")
+	ErrNestedLumberjackFrame     = errors.New("compressed lumberjack frames cannot be nested")
+	ErrLumberjackWindowExhausted = errors.New("lumberjack client sent more events than its window")
+
+	beatsTimestampField = []string{`@timestamp`}
+)
+
+// validateBeatsReader checks the options that only apply to the beats reader type
+func (l listener) validateBeatsReader() error {
+	lrt, err := translateReaderType(l.Reader_Type)
+	if err != nil {
+		return err
+	} else if lrt != beatsReader {
+		return nil
+	}
+	if l.Framing != `` || l.Encoding != `` {
+		return ErrBeatsOptions
+	}
+	if tp, _, err := translateBindType(l.Bind_String); err != nil {
+		return err
+	} else if tp.UDP() {
+		return ErrBeatsWithoutTCP
+	}
+	return nil
+}
+
+// beatsConnHandlerTCP speaks the lumberjack v2 protocol used by Filebeat, Winlogbeat, and the
+// other Elastic Beats.  Clients send a window size followed by that many events, each event
+// is sent as a JSON entry and the window is acknowledged once its entries have been handed
+// to the processors.  Unacknowledged windows are resent by the client.
+func beatsConnHandlerTCP(c net.Conn, cfg handlerConfig) {
+	cfg.wg.Add(1)
+	id := addConn(c)
+	defer cfg.wg.Done()
+	defer delConn(id)
+	defer c.Close()
+	rip := cfg.src
+	if rip == nil {
+		if rip = addrIP(c.RemoteAddr()); rip == nil {
+			fmt.Fprintf(os.Stderr, "Failed to get remote addr from \"%s\"\n", c.RemoteAddr().String())
+			return
+		}
+	}
+	tg, err := cfg.newTimeGrinder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	lh := lumberjackHandler{
+		cfg:    cfg,
+		c:      c,
+		src:    rip,
+		sender: addrIP(c.RemoteAddr()),
+		tag:    cfg.sourceTag(c.RemoteAddr()),
+		tg:     tg,
+	}
+	rdr := bufio.NewReader(c)
+	for {
+		if err = lh.readFrame(rdr, false); err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				cfg.stats.parseFailure()
+				fmt.Fprintf(os.Stderr, "Failed to read beats data from %v: %v\n", c.RemoteAddr(), err)
+			}
+			return
+		}
+	}
+}
+
+type lumberjackHandler struct {
+	cfg    handlerConfig
+	c      net.Conn
+	src    net.IP
+	sender net.IP
+	tag    entry.EntryTag
+	tg     *timegrinder.TimeGrinder
+	window uint32 //events in the current window
+	count  uint32 //events received in the current window
+	buff   [8]byte
+}
+
+// readFrame handles a single frame, compressed frames hold a stream of further frames.
+// io.EOF is only returned when the stream ends between frames.
+func (lh *lumberjackHandler) readFrame(r io.Reader, nested bool) error {
+	if _, err := io.ReadFull(r, lh.buff[:2]); err != nil {
+		return err
+	}
+	if lh.buff[0] != lumberjackVersion {
+		return ErrInvalidLumberjackVersion
+	}
+	typ := lh.buff[1]
+	switch typ {
+	case lumberjackWindow:
+		sz, err := lh.uint32(r)
+		if err != nil {
+			return err
+		}
+		lh.window, lh.count = sz, 0
+	case lumberjackJSON:
+		seq, err := lh.uint32(r)
+		if err != nil {
+			return err
+		}
+		doc, err := lh.payload(r)
+		if err != nil {
+			return err
+		} else if err = lh.handleEvent(doc); err != nil {
+			return err
+		}
+		return lh.received(seq)
+	case lumberjackData:
+		seq, err := lh.uint32(r)
+		if err != nil {
+			return err
+		}
+		doc, err := lh.dataEvent(r)
+		if err != nil {
+			return err
+		} else if err = lh.handleEvent(doc); err != nil {
+			return err
+		}
+		return lh.received(seq)
+	case lumberjackCompressed:
+		if nested {
+			return ErrNestedLumberjackFrame
+		}
+		payload, err := lh.payload(r)
+		if err != nil {
+			return err
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for {
+			if err = lh.readFrame(zr, true); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	default:
+		return ErrInvalidLumberjackFrame
+	}
+	return nil
+}
+
+// received acknowledges the window once its last event has been processed
+func (lh *lumberjackHandler) received(seq uint32) error {
+	lh.count++
+	if lh.window != 0 && lh.count > lh.window {
+		return ErrLumberjackWindowExhausted
+	} else if lh.count < lh.window {
+		return nil
+	}
+	ack := []byte{lumberjackVersion, lumberjackAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(ack[2:], seq)
+	lh.c.SetWriteDeadline(time.Now().Add(lumberjackWriteTimeout))
+	_, err := lh.c.Write(ack)
+	return err
+}
+
+// handleEvent sends an event document, the @timestamp set by the beat is the entry timestamp
+func (lh *lumberjackHandler) handleEvent(doc []byte) error {
+	if !json.Valid(doc) {
+		lh.cfg.stats.parseFailure()
+		return nil
+	}
+	if !lh.cfg.limiter.allow(lh.sender, time.Now()) {
+		return nil
+	}
+	data, ok := lh.cfg.sizer.check(doc)
+	if !ok {
+		return nil
+	}
+	var ts entry.Timestamp
+	if lh.tg != nil {
+		ts, ok = jsonTimestamp(data, beatsTimestampField, lh.tg)
+	}
+	if !ok {
+		ts = entry.Now()
+	}
+	return lh.cfg.proc.Process(&entry.Entry{
+		SRC:  lh.src,
+		TS:   ts,
+		Tag:  lh.tag,
+		Data: data,
+	})
+}
+
+// dataEvent converts the key value pairs of a data frame to a JSON document
+func (lh *lumberjackHandler) dataEvent(r io.Reader) ([]byte, error) {
+	pairs, err := lh.uint32(r)
+	if err != nil {
+		return nil, err
+	}
+	mp := make(map[string]string, minLen(uint64(pairs)))
+	for i := uint32(0); i < pairs; i++ {
+		k, err := lh.payload(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := lh.payload(r)
+		if err != nil {
+			return nil, err
+		}
+		mp[string(k)] = string(v)
+	}
+	return json.Marshal(mp)
+}
+
+func (lh *lumberjackHandler) uint32(r io.Reader) (uint32, error) {
+	if _, err := io.ReadFull(r, lh.buff[:4]); err != nil {
+		return 0, unexpectedEOF(err)
+	}
+	return binary.BigEndian.Uint32(lh.buff[:4]), nil
+}
+
+// payload reads a length prefixed payload
+func (lh *lumberjackHandler) payload(r io.Reader) ([]byte, error) {
+	l, err := lh.uint32(r)
+	if err != nil {
+		return nil, err
+	} else if l > uint32(maxDataSize) {
+		return nil, ErrLumberjackFrameTooLarge
+	}
+	b := make([]byte, l)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return b, nil
+}
+
+// unexpectedEOF keeps a frame cut short from looking like the end of the stream
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
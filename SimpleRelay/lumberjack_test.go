@@ -0,0 +1,161 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func ljUint32(b []byte, v uint32) []byte {
+	var buff [4]byte
+	binary.BigEndian.PutUint32(buff[:], v)
+	return append(b, buff[:]...)
+}
+
+func ljWindow(sz uint32) []byte {
+	return ljUint32([]byte{lumberjackVersion, lumberjackWindow}, sz)
+}
+
+func ljJSON(seq uint32, doc string) []byte {
+	b := ljUint32([]byte{lumberjackVersion, lumberjackJSON}, seq)
+	b = ljUint32(b, uint32(len(doc)))
+	return append(b, doc...)
+}
+
+func ljCompressed(frames ...[]byte) []byte {
+	var bb bytes.Buffer
+	zw := zlib.NewWriter(&bb)
+	for _, f := range frames {
+		zw.Write(f)
+	}
+	zw.Close()
+	b := ljUint32([]byte{lumberjackVersion, lumberjackCompressed}, uint32(bb.Len()))
+	return append(b, bb.Bytes()...)
+}
+
+func ljData(seq uint32, kv ...string) []byte {
+	b := ljUint32([]byte{lumberjackVersion, lumberjackData}, seq)
+	b = ljUint32(b, uint32(len(kv)/2))
+	for _, s := range kv {
+		b = ljUint32(b, uint32(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// runBeats feeds the frames to a beats handler and returns the acknowledged sequence numbers,
+// the client hangs up after want acks or when the handler closes the connection
+func runBeats(t *testing.T, cp *capProcessor, want int, frames ...[]byte) (acks []uint32) {
+	srv, cli := net.Pipe()
+	cfg := handlerConfig{
+		lrt:  beatsReader,
+		wg:   &sync.WaitGroup{},
+		proc: cp,
+		src:  net.ParseIP(`10.0.0.1`),
+	}
+	done := make(chan struct{})
+	go func() {
+		beatsConnHandlerTCP(srv, cfg)
+		close(done)
+	}()
+	go func() {
+		for _, f := range frames {
+			if _, err := cli.Write(f); err != nil {
+				return
+			}
+		}
+	}()
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack := make([]byte, 6)
+	for len(acks) < want {
+		if _, err := io.ReadFull(cli, ack); err != nil {
+			break
+		} else if ack[0] != lumberjackVersion || ack[1] != lumberjackAck {
+			t.Fatalf("bad ack %v", ack)
+		}
+		acks = append(acks, binary.BigEndian.Uint32(ack[2:]))
+	}
+	cli.Close()
+	<-done
+	return
+}
+
+func TestBeatsWindows(t *testing.T) {
+	cp := &capProcessor{}
+	acks := runBeats(t, cp, 2,
+		ljWindow(2),
+		ljJSON(1, `{"@timestamp":"2020-06-01T12:30:00.000Z","message":"one"}`),
+		ljJSON(2, `{"@timestamp":"2020-06-01T12:30:01.000Z","message":"two"}`),
+		ljWindow(3),
+		ljCompressed(
+			ljJSON(1, `{"@timestamp":"2020-06-01T12:30:02.000Z","message":"three"}`),
+			ljJSON(2, `{"message":"four"}`),
+		),
+		ljData(3, `line`, `five`),
+	)
+	if len(acks) != 2 || acks[0] != 2 || acks[1] != 3 {
+		t.Fatalf("bad acks %v", acks)
+	}
+	if len(cp.ents) != 5 {
+		t.Fatalf("got %d entries", len(cp.ents))
+	}
+	for i := 0; i < 3; i++ {
+		if exp := time.Date(2020, 6, 1, 12, 30, i, 0, time.UTC); !cp.ents[i].TS.StandardTime().Equal(exp) {
+			t.Fatalf("bad timestamp %d %v", i, cp.ents[i].TS.StandardTime())
+		}
+	}
+	if string(cp.ents[3].Data) != `{"message":"four"}` || string(cp.ents[4].Data) != `{"line":"five"}` {
+		t.Fatalf("bad entries %s %s", cp.ents[3].Data, cp.ents[4].Data)
+	}
+}
+
+func TestBeatsBadFrames(t *testing.T) {
+	//the unfinished window is never acknowledged so the client resends it
+	cp := &capProcessor{}
+	if acks := runBeats(t, cp, 1, ljWindow(2), ljJSON(1, `{"message":"one"}`), []byte{'1', lumberjackJSON}); len(acks) != 0 {
+		t.Fatalf("acked a broken window %v", acks)
+	} else if len(cp.ents) != 1 {
+		t.Fatalf("got %d entries", len(cp.ents))
+	}
+	cp = &capProcessor{}
+	if acks := runBeats(t, cp, 2, ljWindow(1), ljJSON(1, `{"message":"one"}`), ljJSON(2, `{"message":"two"}`)); len(acks) != 1 {
+		t.Fatalf("bad acks %v", acks)
+	} else if len(cp.ents) != 2 {
+		t.Fatalf("got %d entries", len(cp.ents))
+	}
+	cp = &capProcessor{}
+	if acks := runBeats(t, cp, 1, ljWindow(1), ljCompressed(ljCompressed(ljJSON(1, `{}`)))); len(acks) != 0 || len(cp.ents) != 0 {
+		t.Fatalf("accepted nested compressed frames %v", acks)
+	}
+}
+
+func TestBeatsReaderConfig(t *testing.T) {
+	l := listener{
+		base:        base{Bind_String: `tls://0.0.0.0:5044`},
+		Reader_Type: `lumberjack`,
+	}
+	if err := l.validateBeatsReader(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []listener{
+		{base: base{Bind_String: `udp://0.0.0.0:5044`}, Reader_Type: `beats`},
+		{base: base{Bind_String: `tcp://0.0.0.0:5044`}, Reader_Type: `beats`, Framing: `newline`},
+		{base: base{Bind_String: `tcp://0.0.0.0:5044`}, Reader_Type: `beats`, Encoding: `latin1`},
+	} {
+		if err := v.validateBeatsReader(); err == nil {
+			t.Fatalf("accepted invalid beats reader %+v", v)
+		}
+	}
+}
@@ -13,9 +13,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gravwell/ingest/v3"
@@ -66,6 +68,7 @@ func init() {
 
 	v = *verbose
 	connClosers = make(map[int]closer, 1)
+	lstClosers = make(map[int]closer, 1)
 }
 func main() {
 	if *cpuprofile != "" {
@@ -174,33 +177,63 @@ func main() {
 		return
 	}
 
+	var ss *statsServer
+	if cfg.Stats_Listen != `` {
+		if ss, err = newStatsServer(cfg.Stats_Listen); err != nil {
+			lg.FatalCode(0, "Failed to start the stats endpoint on %s: %v\n", cfg.Stats_Listen, err)
+			return
+		}
+		debugout("Serving listener stats on %s\n", cfg.Stats_Listen)
+	}
+
 	debugout("Running\n")
 
-	//listen for signals so we can close gracefully
-	utils.WaitForQuit()
-	debugout("Closing %d connections\n", connCount())
-	mtx.Lock()
-	for _, v := range connClosers {
-		v.Close()
+	//listen for signals so we can close gracefully, SIGHUP reloads the TLS certificates
+	qc := utils.GetQuitChannel()
+	for sig := range qc {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		lg.Info("Reloading TLS listener certificates\n")
+		reloadCertificates()
 	}
-	mtx.Unlock() //must unlock so they can delete their connections
+	signal.Stop(qc)
+
+	//stop accepting new connections and give the established ones the drain period to finish
+	drain := cfg.DrainTimeout()
+	debugout("Closing listeners and draining %d connections for up to %v\n", connCount(), drain)
+	closeListeners()
 
 	//wait for everyone to exit with a timeout
 	wch := make(chan bool, 1)
-
 	go func() {
 		wg.Wait()
 		wch <- true
 	}()
 	select {
 	case <-wch:
-	case <-time.After(1 * time.Second):
-		lg.Error("Failed to wait for all connections to close.  %d active\n", connCount())
+	case <-time.After(drain):
+		if n := connCount(); n > 0 {
+			lg.Info("Closing %d connections still open after the %v drain period\n", n, drain)
+		}
+		closeConns()
+		select {
+		case <-wch:
+		case <-time.After(1 * time.Second):
+			lg.Error("Failed to wait for all connections to close.  %d active\n", connCount())
+		}
+	}
+	if ss != nil {
+		ss.Close()
 	}
 	if err := flshr.Close(); err != nil {
 		lg.Error("Failed to close preprocessors: %v", err)
 	}
-	if err := igst.Sync(time.Second); err != nil {
+	syncTimeout := time.Second
+	if drain > syncTimeout {
+		syncTimeout = drain
+	}
+	if err := igst.Sync(syncTimeout); err != nil {
 		lg.Error("Failed to sync: %v\n", err)
 	}
 	if err := igst.Close(); err != nil {
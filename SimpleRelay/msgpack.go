@@ -0,0 +1,300 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	maxMsgpackDepth = 64
+)
+
+var (
+	ErrMsgpackTooLarge = errors.New("msgpack object is too large")
+	ErrMsgpackTooDeep  = errors.New("msgpack object is nested too deeply")
+	ErrMsgpackInvalid  = errors.New("invalid msgpack type")
+)
+
+// msgpackExt is an extension value, fluentd EventTime is extension type 0
+type msgpackExt struct {
+	typ  int8
+	data []byte
+}
+
+// msgpackDecoder reads msgpack objects from a stream.  Maps decode to map[string]interface{}
+// with non-string keys formatted as strings, arrays to []interface{}, str to string, bin to
+// []byte, integers to int64 or uint64, and floats to float64.  limit bounds the size of a
+// single string, binary, or container so a bad length can't exhaust memory.
+type msgpackDecoder struct {
+	r     io.Reader
+	limit int
+	buff  [8]byte
+}
+
+func newMsgpackDecoder(r io.Reader, limit int) *msgpackDecoder {
+	return &msgpackDecoder{r: r, limit: limit}
+}
+
+// Decode reads the next object, io.EOF is only returned between objects
+func (d *msgpackDecoder) Decode() (interface{}, error) {
+	b, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	v, err := d.decode(b, 0)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *msgpackDecoder) byte() (byte, error) {
+	if _, err := io.ReadFull(d.r, d.buff[:1]); err != nil {
+		return 0, err
+	}
+	return d.buff[0], nil
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	if _, err := io.ReadFull(d.r, d.buff[:n]); err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(d.buff[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(d.buff[:])), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(d.buff[:])), nil
+	}
+	return binary.BigEndian.Uint64(d.buff[:]), nil
+}
+
+func (d *msgpackDecoder) bytes(n uint64) ([]byte, error) {
+	if n > uint64(d.limit) {
+		return nil, ErrMsgpackTooLarge
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+// length reads the size of a str, bin, array, map, or ext that is stored in n bytes
+func (d *msgpackDecoder) length(n int) (uint64, error) {
+	l, err := d.uint(n)
+	if err == nil && l > uint64(d.limit) {
+		err = ErrMsgpackTooLarge
+	}
+	return l, err
+}
+
+func (d *msgpackDecoder) decode(b byte, depth int) (v interface{}, err error) {
+	if depth > maxMsgpackDepth {
+		return nil, ErrMsgpackTooDeep
+	}
+	var l uint64
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.decodeMap(uint64(b&0xf), depth)
+	case b >= 0x90 && b <= 0x9f:
+		return d.decodeArray(uint64(b&0xf), depth)
+	case b >= 0xa0 && b <= 0xbf:
+		return d.decodeStr(uint64(b & 0x1f))
+	}
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: //bin 8, 16, 32
+		if l, err = d.length(1 << (b - 0xc4)); err != nil {
+			return
+		}
+		return d.bytes(l)
+	case 0xc7, 0xc8, 0xc9: //ext 8, 16, 32
+		if l, err = d.length(1 << (b - 0xc7)); err != nil {
+			return
+		}
+		return d.decodeExt(l)
+	case 0xca:
+		var u uint64
+		if u, err = d.uint(4); err != nil {
+			return
+		}
+		return float64(math.Float32frombits(uint32(u))), nil
+	case 0xcb:
+		var u uint64
+		if u, err = d.uint(8); err != nil {
+			return
+		}
+		return math.Float64frombits(u), nil
+	case 0xcc, 0xcd, 0xce, 0xcf: //uint 8, 16, 32, 64
+		return d.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3: //int 8, 16, 32, 64
+		n := 1 << (b - 0xd0)
+		var u uint64
+		if u, err = d.uint(n); err != nil {
+			return
+		}
+		//sign extend from the encoded width
+		shift := uint(64 - 8*n)
+		return int64(u<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: //fixext 1, 2, 4, 8, 16
+		return d.decodeExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb: //str 8, 16, 32
+		if l, err = d.length(1 << (b - 0xd9)); err != nil {
+			return
+		}
+		return d.decodeStr(l)
+	case 0xdc, 0xdd: //array 16, 32
+		if l, err = d.length(2 << (b - 0xdc)); err != nil {
+			return
+		}
+		return d.decodeArray(l, depth)
+	case 0xde, 0xdf: //map 16, 32
+		if l, err = d.length(2 << (b - 0xde)); err != nil {
+			return
+		}
+		return d.decodeMap(l, depth)
+	}
+	return nil, ErrMsgpackInvalid
+}
+
+func (d *msgpackDecoder) decodeStr(l uint64) (interface{}, error) {
+	b, err := d.bytes(l)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) decodeExt(l uint64) (interface{}, error) {
+	t, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.bytes(l)
+	return msgpackExt{typ: int8(t), data: b}, err
+}
+
+func (d *msgpackDecoder) decodeArray(l uint64, depth int) (interface{}, error) {
+	arr := make([]interface{}, 0, minLen(l))
+	for i := uint64(0); i < l; i++ {
+		b, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode(b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) decodeMap(l uint64, depth int) (interface{}, error) {
+	mp := make(map[string]interface{}, minLen(l))
+	for i := uint64(0); i < l; i++ {
+		var kv [2]interface{}
+		for j := range kv {
+			b, err := d.byte()
+			if err != nil {
+				return nil, err
+			}
+			if kv[j], err = d.decode(b, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		switch k := kv[0].(type) {
+		case string:
+			mp[k] = kv[1]
+		case []byte:
+			mp[string(k)] = kv[1]
+		default:
+			mp[fmt.Sprint(k)] = kv[1]
+		}
+	}
+	return mp, nil
+}
+
+// minLen caps preallocation, the length has been checked against the limit but the
+// elements have not arrived yet
+func minLen(l uint64) int {
+	if l > 1024 {
+		return 1024
+	}
+	return int(l)
+}
+
+// msgpackEncoder builds the small responses the forward protocol sends
+type msgpackEncoder struct {
+	b []byte
+}
+
+func (e *msgpackEncoder) header(fix, base byte, l int) {
+	switch {
+	case l < 16 && fix != 0:
+		e.b = append(e.b, fix|byte(l))
+	case l <= math.MaxUint16:
+		e.b = append(e.b, base, byte(l>>8), byte(l))
+	default:
+		e.b = append(e.b, base+1, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+}
+
+func (e *msgpackEncoder) arrayHeader(l int) {
+	e.header(0x90, 0xdc, l)
+}
+
+func (e *msgpackEncoder) mapHeader(l int) {
+	e.header(0x80, 0xde, l)
+}
+
+func (e *msgpackEncoder) str(s string) {
+	switch l := len(s); {
+	case l < 32:
+		e.b = append(e.b, 0xa0|byte(l))
+	case l <= math.MaxUint8:
+		e.b = append(e.b, 0xd9, byte(l))
+	case l <= math.MaxUint16:
+		e.b = append(e.b, 0xda, byte(l>>8), byte(l))
+	default:
+		e.b = append(e.b, 0xdb, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	e.b = append(e.b, s...)
+}
+
+func (e *msgpackEncoder) bin(b []byte) {
+	switch l := len(b); {
+	case l <= math.MaxUint8:
+		e.b = append(e.b, 0xc4, byte(l))
+	case l <= math.MaxUint16:
+		e.b = append(e.b, 0xc5, byte(l>>8), byte(l))
+	default:
+		e.b = append(e.b, 0xc6, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	e.b = append(e.b, b...)
+}
+
+func (e *msgpackEncoder) bool(v bool) {
+	if v {
+		e.b = append(e.b, 0xc3)
+	} else {
+		e.b = append(e.b, 0xc2)
+	}
+}
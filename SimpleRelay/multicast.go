@@ -0,0 +1,91 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var (
+	ErrMulticastWithoutUDP       = errors.New("Multicast-Group only applies to UDP listeners")
+	ErrMulticastInterfaceNoGroup = errors.New("Multicast-Interface requires at least one Multicast-Group")
+)
+
+// multicastGroups parses the Multicast-Group addresses
+func (l listener) multicastGroups() (groups []net.IP, err error) {
+	for _, v := range l.Multicast_Group {
+		ip := net.ParseIP(strings.TrimSpace(v))
+		if ip == nil || !ip.IsMulticast() {
+			err = fmt.Errorf("Multicast-Group %q is not a multicast address", v)
+			return
+		}
+		groups = append(groups, ip)
+	}
+	return
+}
+
+func (l listener) validateMulticast() error {
+	groups, err := l.multicastGroups()
+	if err != nil {
+		return err
+	}
+	if len(groups) == 0 {
+		if l.Multicast_Interface != `` {
+			return ErrMulticastInterfaceNoGroup
+		}
+		return nil
+	}
+	if tp, _, err := translateBindType(l.Bind_String); err != nil {
+		return err
+	} else if !tp.UDP() {
+		return ErrMulticastWithoutUDP
+	}
+	return nil
+}
+
+// joinMulticast joins the listener's multicast groups on the UDP socket, the system picks
+// the interface when no Multicast-Interface is specified
+func (l listener) joinMulticast(c *net.UDPConn) error {
+	groups, err := l.multicastGroups()
+	if err != nil || len(groups) == 0 {
+		return err
+	}
+	var ifi *net.Interface
+	if l.Multicast_Interface != `` {
+		if ifi, err = net.InterfaceByName(l.Multicast_Interface); err != nil {
+			return fmt.Errorf("Invalid Multicast-Interface %q: %v", l.Multicast_Interface, err)
+		}
+	}
+	var p4 *ipv4.PacketConn
+	var p6 *ipv6.PacketConn
+	for _, g := range groups {
+		gaddr := &net.UDPAddr{IP: g}
+		if g.To4() != nil {
+			if p4 == nil {
+				p4 = ipv4.NewPacketConn(c)
+			}
+			err = p4.JoinGroup(ifi, gaddr)
+		} else {
+			if p6 == nil {
+				p6 = ipv6.NewPacketConn(c)
+			}
+			err = p6.JoinGroup(ifi, gaddr)
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to join multicast group %v: %v", g, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	maxPRI int = 191 //facility 23, severity 7
+)
+
+var (
+	ErrInvalidPriorityTag    = errors.New("Priority-Tag must be of the form severity<=warning:tag or facility=auth:tag")
+	ErrInvalidPriorityField  = errors.New("Priority-Tag conditions must test severity or facility")
+	ErrInvalidPriorityTagTag = errors.New("Priority-Tag is missing a tag")
+	ErrPriorityTagNotSyslog  = errors.New("Priority-Tag requires Reader-Type rfc5424 or rfc5425")
+
+	priorityOps     = []string{`<=`, `>=`, `!=`, `=`, `<`, `>`} //two character operators are checked first
+	severityNames   = []string{`emerg`, `alert`, `crit`, `err`, `warning`, `notice`, `info`, `debug`}
+	severityAliases = map[string]int{`emergency`: 0, `panic`: 0, `critical`: 2, `error`: 3, `warn`: 4, `informational`: 6}
+	facilityNames   = []string{`kern`, `user`, `mail`, `daemon`, `auth`, `syslog`, `lpr`, `news`, `uucp`, `cron`,
+		`authpriv`, `ftp`, `ntp`, `security`, `console`, `solaris-cron`,
+		`local0`, `local1`, `local2`, `local3`, `local4`, `local5`, `local6`, `local7`}
+)
+
+// priorityRule matches the facility or severity of a syslog PRI
+type priorityRule struct {
+	facility bool //test the facility instead of the severity
+	op       string
+	val      int
+	tag      string
+}
+
+// priorityRoute is a priorityRule with the tag resolved by the muxer
+type priorityRoute struct {
+	priorityRule
+	tag entry.EntryTag
+}
+
+// parsePriorityRule parses a Priority-Tag value such as severity<=warning:alerts, the
+// value may be a name or a number
+func parsePriorityRule(v string) (pr priorityRule, err error) {
+	idx := strings.LastIndex(v, elemSep)
+	if idx <= 0 {
+		err = ErrInvalidPriorityTag
+		return
+	}
+	cond := strings.ToLower(strings.TrimSpace(v[:idx]))
+	if pr.tag = strings.TrimSpace(v[idx+1:]); len(pr.tag) == 0 {
+		err = ErrInvalidPriorityTagTag
+		return
+	} else if err = ingest.CheckTag(pr.tag); err != nil {
+		err = fmt.Errorf("Invalid Priority-Tag tag %q: %v", pr.tag, err)
+		return
+	}
+	var field, val string
+	for _, op := range priorityOps {
+		if i := strings.Index(cond, op); i > 0 {
+			field, pr.op, val = strings.TrimSpace(cond[:i]), op, strings.TrimSpace(cond[i+len(op):])
+			break
+		}
+	}
+	names := severityNames
+	switch field {
+	case `severity`:
+		if n, ok := severityAliases[val]; ok {
+			pr.val = n
+			return
+		}
+	case `facility`:
+		pr.facility = true
+		names = facilityNames
+	case ``:
+		err = ErrInvalidPriorityTag
+		return
+	default:
+		err = ErrInvalidPriorityField
+		return
+	}
+	for i, n := range names {
+		if n == val {
+			pr.val = i
+			return
+		}
+	}
+	if pr.val, err = strconv.Atoi(val); err != nil || pr.val < 0 || pr.val >= len(names) {
+		err = fmt.Errorf("Invalid Priority-Tag %s %q", field, val)
+	}
+	return
+}
+
+func (pr priorityRule) match(facility, severity int) bool {
+	x := severity
+	if pr.facility {
+		x = facility
+	}
+	switch pr.op {
+	case `<=`:
+		return x <= pr.val
+	case `>=`:
+		return x >= pr.val
+	case `<`:
+		return x < pr.val
+	case `>`:
+		return x > pr.val
+	case `!=`:
+		return x != pr.val
+	}
+	return x == pr.val
+}
+
+func (l listener) priorityRules() (prs []priorityRule, err error) {
+	var pr priorityRule
+	for _, v := range l.Priority_Tag {
+		if pr, err = parsePriorityRule(v); err != nil {
+			return
+		}
+		prs = append(prs, pr)
+	}
+	return
+}
+
+// validatePriorityRules checks the Priority-Tag rules against the reader type
+func (l listener) validatePriorityRules() error {
+	prs, err := l.priorityRules()
+	if err != nil || len(prs) == 0 {
+		return err
+	}
+	if lrt, err := translateReaderType(l.Reader_Type); err != nil {
+		return err
+	} else if lrt != rfc5424Reader && lrt != rfc5425Reader {
+		return ErrPriorityTagNotSyslog
+	}
+	return nil
+}
+
+// priorityRoutes resolves the Priority-Tag tags
+func (l listener) priorityRoutes(igst *ingest.IngestMuxer) (prs []priorityRoute, err error) {
+	rules, err := l.priorityRules()
+	if err != nil {
+		return
+	}
+	for _, r := range rules {
+		pr := priorityRoute{priorityRule: r}
+		if pr.tag, err = igst.GetTag(r.tag); err != nil {
+			return
+		}
+		prs = append(prs, pr)
+	}
+	return
+}
+
+// parsePRI pulls the facility and severity out of the <PRI> that starts RFC3164 and
+// RFC5424 messages
+func parsePRI(b []byte) (facility, severity int, ok bool) {
+	if len(b) < 3 || b[0] != '<' {
+		return
+	}
+	var pri, i int
+	for i = 1; i < len(b) && i <= 3 && b[i] >= '0' && b[i] <= '9'; i++ {
+		pri = pri*10 + int(b[i]-'0')
+	}
+	if i == 1 || i >= len(b) || b[i] != '>' || pri > maxPRI {
+		return
+	}
+	return pri >> 3, pri & 7, true
+}
+
+// priorityRouter retags syslog messages using the first matching Priority-Tag rule,
+// messages without a PRI or that match no rule keep their tag
+type priorityRouter struct {
+	routes []priorityRoute
+	next   entryProcessor
+}
+
+func newPriorityRouter(routes []priorityRoute, next entryProcessor) entryProcessor {
+	if len(routes) == 0 {
+		return next
+	}
+	return &priorityRouter{routes: routes, next: next}
+}
+
+func (pr *priorityRouter) Process(ent *entry.Entry) error {
+	if facility, severity, ok := parsePRI(ent.Data); ok {
+		for _, r := range pr.routes {
+			if r.match(facility, severity) {
+				ent.Tag = r.tag
+				break
+			}
+		}
+	}
+	return pr.next.Process(ent)
+}
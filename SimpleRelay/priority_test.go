@@ -0,0 +1,77 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"testing"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestParsePRI(t *testing.T) {
+	tests := map[string][3]int{
+		`<0>1 - kernel panic`:        {0, 0, 1},
+		`<34>Oct 11 22:14:15 mymach`: {4, 2, 1},
+		`<191>1 local7 debug`:        {23, 7, 1},
+		`<192>1 too big`:             {0, 0, 0},
+		`<1234>four digits`:          {0, 0, 0},
+		`<>empty`:                    {0, 0, 0},
+		`no pri`:                     {0, 0, 0},
+		`<13`:                        {0, 0, 0},
+	}
+	for v, exp := range tests {
+		f, s, ok := parsePRI([]byte(v))
+		if ok != (exp[2] == 1) || (ok && (f != exp[0] || s != exp[1])) {
+			t.Fatalf("bad PRI for %q: %d %d %v", v, f, s, ok)
+		}
+	}
+}
+
+func TestPriorityRules(t *testing.T) {
+	l := listener{
+		base:         base{Bind_String: `udp://0.0.0.0:514`},
+		Reader_Type:  `rfc5424`,
+		Priority_Tag: []string{`severity<=warning:alerts`, `facility = authpriv:auth`, `facility>=16:local`},
+	}
+	if err := l.validatePriorityRules(); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := l.priorityRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []priorityRoute
+	for i, r := range rules {
+		routes = append(routes, priorityRoute{priorityRule: r, tag: entry.EntryTag(i + 1)})
+	}
+	cp := &capProcessor{}
+	pr := newPriorityRouter(routes, cp)
+	tests := map[string]entry.EntryTag{
+		`<84>1 authpriv warning`: 1, //first match wins
+		`<86>1 authpriv info`:    2,
+		`<134>1 local0 info`:     3,
+		`<14>1 user info`:        0,
+		`no pri at all`:          0,
+	}
+	for v, tag := range tests {
+		if err := pr.Process(&entry.Entry{Data: []byte(v)}); err != nil {
+			t.Fatal(err)
+		} else if got := cp.ents[len(cp.ents)-1].Tag; got != tag {
+			t.Fatalf("%q routed to %d, expected %d", v, got, tag)
+		}
+	}
+	for _, v := range []string{`severity<=warning`, `severity<=bogus:tag`, `priority=1:tag`, `facility=24:tag`, `severity:tag`, `severity=err:bad.tag`} {
+		if _, err := parsePriorityRule(v); err == nil {
+			t.Fatalf("accepted invalid Priority-Tag %q", v)
+		}
+	}
+	l.Reader_Type = `line`
+	if err := l.validatePriorityRules(); err != ErrPriorityTagNotSyslog {
+		t.Fatal("accepted Priority-Tag on a line reader", err)
+	}
+}
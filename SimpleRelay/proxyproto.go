@@ -0,0 +1,216 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1MaxLen      = 107 //longest v1 header including the CRLF
+)
+
+var (
+	ErrProxyWithoutTCP     = errors.New("Proxy-Protocol-Source requires a tcp:// or tls:// Bind-String")
+	ErrMissingProxyHeader  = errors.New("Connection from a Proxy-Protocol-Source did not send a PROXY header")
+	ErrInvalidProxyHeader  = errors.New("Invalid PROXY protocol header")
+	ErrProxyHeaderTooLong  = errors.New("PROXY protocol v1 header is too long")
+	ErrUnsupportedProxyVer = errors.New("Unsupported PROXY protocol version")
+
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxySources parses the Proxy-Protocol-Source networks
+func (b base) proxySources() (nets []*net.IPNet, err error) {
+	var n *net.IPNet
+	for _, v := range b.Proxy_Protocol_Source {
+		if n, err = parseNetwork(strings.TrimSpace(v)); err != nil {
+			err = fmt.Errorf("Invalid Proxy-Protocol-Source %q: %v", v, err)
+			return
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// validateProxySources checks the Proxy-Protocol-Source networks against the bind type
+func (b base) validateProxySources() error {
+	nets, err := b.proxySources()
+	if err != nil || len(nets) == 0 {
+		return err
+	}
+	if tp, _, err := translateBindType(b.Bind_String); err != nil {
+		return err
+	} else if !tp.TCP() && !tp.TLS() {
+		return ErrProxyWithoutTCP
+	}
+	return nil
+}
+
+// proxyListener expects a PROXY protocol header on connections from the trusted sources,
+// connections from anywhere else are handed back untouched
+type proxyListener struct {
+	net.Listener
+	sources []*net.IPNet
+}
+
+func newProxyListener(l net.Listener, sources []*net.IPNet) net.Listener {
+	if len(sources) == 0 {
+		return l
+	}
+	return &proxyListener{Listener: l, sources: sources}
+}
+
+func (pl *proxyListener) Accept() (net.Conn, error) {
+	c, err := pl.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ip := addrIP(c.RemoteAddr())
+	for _, n := range pl.sources {
+		if ip != nil && n.Contains(ip) {
+			return &proxyConn{Conn: c}, nil
+		}
+	}
+	return c, nil
+}
+
+// proxyConn reads the PROXY header on the first Read or RemoteAddr call so that a slow
+// load balancer does not hold up the accept loop
+type proxyConn struct {
+	net.Conn
+	once  sync.Once
+	br    *bufio.Reader
+	raddr net.Addr
+	err   error
+}
+
+func (pc *proxyConn) readHeader() {
+	pc.once.Do(func() {
+		pc.br = bufio.NewReader(pc.Conn)
+		pc.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		pc.raddr, pc.err = readProxyHeader(pc.br)
+		pc.Conn.SetReadDeadline(time.Time{})
+		if pc.err != nil {
+			debugout("Bad PROXY header from %v: %v\n", pc.Conn.RemoteAddr(), pc.err)
+		}
+		if pc.raddr == nil {
+			pc.raddr = pc.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	if pc.readHeader(); pc.err != nil {
+		return 0, pc.err
+	}
+	return pc.br.Read(b)
+}
+
+// RemoteAddr returns the sender named in the PROXY header
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	pc.readHeader()
+	return pc.raddr
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header, a nil address means the header
+// did not carry a source and the socket address should be used
+func readProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if len(sig) >= 6 && string(sig[:6]) == `PROXY ` {
+		return readProxyV1(br)
+	} else if err != nil {
+		if err == io.EOF || err == bufio.ErrBufferFull {
+			return nil, ErrMissingProxyHeader
+		}
+		return nil, err
+	} else if bytes.Equal(sig, proxyV2Sig) {
+		return readProxyV2(br)
+	}
+	return nil, ErrMissingProxyHeader
+}
+
+// readProxyV1 handles the text header, PROXY TCP4 1.2.3.4 5.6.7.8 1234 80\r\n
+func readProxyV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrProxyHeaderTooLong
+	}
+	flds := strings.Fields(string(line))
+	if len(flds) >= 2 && flds[1] == `UNKNOWN` {
+		return nil, nil
+	} else if len(flds) != 6 || (flds[1] != `TCP4` && flds[1] != `TCP6`) {
+		return nil, ErrInvalidProxyHeader
+	}
+	ip := net.ParseIP(flds[2])
+	port, err := strconv.ParseUint(flds[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 handles the binary header, only the TCP over IPv4 and IPv6 address families
+// carry a usable source
+func readProxyV2(br *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, ErrUnsupportedProxyVer
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, err
+	}
+	//LOCAL connections are health checks from the proxy itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	} else if hdr[12]&0xf != 1 {
+		return nil, ErrInvalidProxyHeader
+	}
+	var alen int
+	switch hdr[13] {
+	case 0x11: //TCP over IPv4
+		alen = net.IPv4len
+	case 0x21: //TCP over IPv6
+		alen = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(body) < 2*alen+4 {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), body[:alen]...)),
+		Port: int(binary.BigEndian.Uint16(body[2*alen:])),
+	}, nil
+}
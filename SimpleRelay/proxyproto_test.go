@@ -0,0 +1,167 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestProxyV1Header(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("PROXY TCP4 10.1.2.3 10.0.0.1 5555 601\r\n<1>hello"))
+	addr, err := readProxyHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	} else if addr.String() != `10.1.2.3:5555` {
+		t.Fatal("bad source", addr)
+	}
+	if rest, _ := ioutil.ReadAll(br); string(rest) != `<1>hello` {
+		t.Fatalf("header was not consumed: %q", rest)
+	}
+	br = bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n"))
+	if addr, err = readProxyHeader(br); err != nil || addr != nil {
+		t.Fatal("UNKNOWN should use the socket address", addr, err)
+	}
+	for _, v := range []string{
+		"<1>no header at all\n",
+		"PROXY TCP4 bogus 10.0.0.1 5555 601\r\n",
+		"PROXY TCP4 10.1.2.3 10.0.0.1 5555\r\n",
+		"PROXY TCP4 10.1.2.3 10.0.0.1 5555 601 " + strings.Repeat("x", 128) + "\r\n",
+	} {
+		if _, err = readProxyHeader(bufio.NewReader(strings.NewReader(v))); err == nil {
+			t.Fatalf("accepted invalid header %q", v)
+		}
+	}
+}
+
+func TestProxyV2Header(t *testing.T) {
+	hdr := append([]byte(nil), proxyV2Sig...)
+	hdr = append(hdr, 0x21, 0x11, 0, 12) //PROXY command, TCP over IPv4
+	hdr = append(hdr, 192, 168, 1, 10, 10, 0, 0, 1, 0x1f, 0x90, 0x02, 0x59)
+	br := bufio.NewReader(strings.NewReader(string(hdr) + "data"))
+	addr, err := readProxyHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	} else if addr.String() != `192.168.1.10:8080` {
+		t.Fatal("bad source", addr)
+	}
+	if rest, _ := ioutil.ReadAll(br); string(rest) != `data` {
+		t.Fatalf("header was not consumed: %q", rest)
+	}
+	//LOCAL commands carry no source
+	local := append(append([]byte(nil), proxyV2Sig...), 0x20, 0x00, 0, 0)
+	if addr, err = readProxyHeader(bufio.NewReader(strings.NewReader(string(local)))); err != nil || addr != nil {
+		t.Fatal("LOCAL should use the socket address", addr, err)
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	b := base{
+		Bind_String:           `tcp://127.0.0.1:0`,
+		Proxy_Protocol_Source: []string{`127.0.0.1`},
+	}
+	if err := b.validateProxySources(); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := b.wrapListener(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := net.Dial(`tcp`, tl.Addr().String())
+		if err != nil {
+			return
+		}
+		c.Write([]byte("PROXY TCP6 fd00::5 ::1 4444 601\r\nline\n"))
+		c.Close()
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ip := addrIP(c.RemoteAddr()); !ip.Equal(net.ParseIP(`fd00::5`)) {
+		t.Fatal("bad remote address", c.RemoteAddr())
+	}
+	if data, err := ioutil.ReadAll(c); err != nil || string(data) != "line\n" {
+		t.Fatalf("bad data %q: %v", data, err)
+	}
+
+	b.Bind_String = `udp://127.0.0.1:0`
+	if err := b.validateProxySources(); err != ErrProxyWithoutTCP {
+		t.Fatal("accepted Proxy-Protocol-Source on a UDP listener", err)
+	}
+	b.Proxy_Protocol_Source = []string{`bogus`}
+	if err := b.validateProxySources(); err == nil {
+		t.Fatal("accepted an invalid Proxy-Protocol-Source")
+	}
+}
+
+func TestProxyListenerSilentSource(t *testing.T) {
+	b := base{
+		Bind_String:           `tcp://127.0.0.1:0`,
+		Proxy_Protocol_Source: []string{`127.0.0.1`},
+	}
+	if err := b.validateProxySources(); err != nil {
+		t.Fatal(err)
+	}
+	tl, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := b.wrapListener(tl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	//a trusted source that never sends its header must not hold up the next connection
+	silent, err := net.Dial(`tcp`, tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	done := make(chan net.Addr, 1)
+	go func() {
+		done <- c.RemoteAddr()
+	}()
+
+	fast, err := net.Dial(`tcp`, tl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	if _, err = fast.Write([]byte("PROXY TCP4 10.1.2.3 10.0.0.1 5555 601\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if ip := addrIP(c2.RemoteAddr()); !ip.Equal(net.ParseIP(`10.1.2.3`)) {
+		t.Fatal("bad remote address", c2.RemoteAddr())
+	}
+	select {
+	case addr := <-done:
+		t.Fatal("silent connection resolved an address", addr)
+	default:
+	}
+}
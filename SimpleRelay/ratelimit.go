@@ -0,0 +1,142 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	sourceRateSummaryInterval = time.Minute
+)
+
+var (
+	ErrInvalidSourceRate  = errors.New("Source-Rate-Limit and Source-Rate-Burst cannot be negative")
+	ErrSourceBurstNoLimit = errors.New("Source-Rate-Burst requires a Source-Rate-Limit")
+)
+
+// sourceLimiter holds a token bucket for each sender on a listener, entries beyond the
+// rate are dropped and counted so that one device stuck in a logging loop cannot flood
+// the relay and indexers
+type sourceLimiter struct {
+	sync.Mutex
+	name  string
+	rate  float64 //entries per second
+	burst float64
+	srcs  map[string]*sourceBucket
+	stats *listenerStats
+	igst  *ingest.IngestMuxer
+	done  chan struct{}
+}
+
+type sourceBucket struct {
+	tokens float64
+	last   time.Time
+	drops  uint64
+}
+
+func (l listener) validateRateLimit() error {
+	if l.Source_Rate_Limit < 0 || l.Source_Rate_Burst < 0 {
+		return ErrInvalidSourceRate
+	} else if l.Source_Rate_Burst > 0 && l.Source_Rate_Limit == 0 {
+		return ErrSourceBurstNoLimit
+	}
+	return nil
+}
+
+// newSourceLimiter returns nil if the listener does not set a Source-Rate-Limit, the burst
+// defaults to one second worth of entries
+func newSourceLimiter(name string, l *listener) *sourceLimiter {
+	if l.Source_Rate_Limit <= 0 {
+		return nil
+	}
+	burst := l.Source_Rate_Burst
+	if burst == 0 {
+		burst = l.Source_Rate_Limit
+	}
+	return &sourceLimiter{
+		name:  name,
+		rate:  float64(l.Source_Rate_Limit),
+		burst: float64(burst),
+		srcs:  map[string]*sourceBucket{},
+	}
+}
+
+// allow takes a token from the sender's bucket, a nil limiter allows everything
+func (sl *sourceLimiter) allow(ip net.IP, now time.Time) bool {
+	if sl == nil {
+		return true
+	}
+	key := ip.String()
+	sl.Lock()
+	defer sl.Unlock()
+	b, ok := sl.srcs[key]
+	if !ok {
+		b = &sourceBucket{tokens: sl.burst, last: now}
+		sl.srcs[key] = b
+	} else if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(sl.burst, b.tokens+elapsed.Seconds()*sl.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		b.drops++
+		sl.stats.drop()
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// summarize returns and resets the drop counters, senders that have been quiet long
+// enough to refill their bucket are forgotten so the map does not grow without bound
+func (sl *sourceLimiter) summarize(now time.Time) (drops map[string]uint64) {
+	sl.Lock()
+	for k, b := range sl.srcs {
+		if b.drops > 0 {
+			if drops == nil {
+				drops = map[string]uint64{}
+			}
+			drops[k] = b.drops
+			b.drops = 0
+		} else if b.tokens+now.Sub(b.last).Seconds()*sl.rate >= sl.burst {
+			delete(sl.srcs, k)
+		}
+	}
+	sl.Unlock()
+	return
+}
+
+// start logs the throttled senders every sourceRateSummaryInterval until the limiter is closed
+func (sl *sourceLimiter) start(igst *ingest.IngestMuxer) {
+	sl.igst = igst
+	sl.done = make(chan struct{})
+	go runEvery(sourceRateSummaryInterval, sl.done, func() { sl.report(time.Now()) })
+}
+
+func (sl *sourceLimiter) report(now time.Time) {
+	for src, n := range sl.summarize(now) {
+		lg.Warn("Listener %s dropped %d entries from %s exceeding the Source-Rate-Limit\n", sl.name, n, src)
+		sl.igst.Warn("listener %s dropped %d entries from %s exceeding the Source-Rate-Limit", sl.name, n, src)
+	}
+}
+
+// Close stops the summary routine and reports any drops since the last summary
+func (sl *sourceLimiter) Close() error {
+	if sl.done != nil {
+		close(sl.done)
+		sl.report(time.Now())
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrInvalidRegexTag = errors.New("Regex-Tag must be of the form regex:tag")
+)
+
+// regexTag maps payloads matching a regular expression to a tag
+type regexTag struct {
+	re  *regexp.Regexp
+	tag string
+}
+
+// regexRoute is a regexTag with the tag resolved by the muxer
+type regexRoute struct {
+	re  *regexp.Regexp
+	tag entry.EntryTag
+}
+
+// parseRegexTag parses a Regex-Tag value such as ^<\d+>\S+ fw01 :firewall, tags cannot
+// contain a colon so the last colon separates the tag from the expression
+func parseRegexTag(v string) (rt regexTag, err error) {
+	idx := strings.LastIndex(v, elemSep)
+	if idx <= 0 {
+		err = ErrInvalidRegexTag
+		return
+	}
+	if rt.tag = strings.TrimSpace(v[idx+1:]); len(rt.tag) == 0 {
+		err = ErrInvalidRegexTag
+		return
+	} else if err = ingest.CheckTag(rt.tag); err != nil {
+		err = fmt.Errorf("Invalid Regex-Tag tag %q: %v", rt.tag, err)
+		return
+	}
+	if rt.re, err = regexp.Compile(v[:idx]); err != nil {
+		err = fmt.Errorf("Invalid Regex-Tag expression %q: %v", v[:idx], err)
+	}
+	return
+}
+
+func (l listener) regexTags() (rts []regexTag, err error) {
+	var rt regexTag
+	for _, v := range l.Regex_Tag {
+		if rt, err = parseRegexTag(v); err != nil {
+			return
+		}
+		rts = append(rts, rt)
+	}
+	return
+}
+
+// regexRoutes resolves the Regex-Tag tags
+func (l listener) regexRoutes(igst *ingest.IngestMuxer) (rrs []regexRoute, err error) {
+	rts, err := l.regexTags()
+	if err != nil {
+		return
+	}
+	for _, rt := range rts {
+		rr := regexRoute{re: rt.re}
+		if rr.tag, err = igst.GetTag(rt.tag); err != nil {
+			return
+		}
+		rrs = append(rrs, rr)
+	}
+	return
+}
+
+// regexRouter retags entries using the first Regex-Tag expression that matches the
+// payload, entries that match nothing keep their tag
+type regexRouter struct {
+	routes []regexRoute
+	next   entryProcessor
+}
+
+func newRegexRouter(routes []regexRoute, next entryProcessor) entryProcessor {
+	if len(routes) == 0 {
+		return next
+	}
+	return &regexRouter{routes: routes, next: next}
+}
+
+func (rr *regexRouter) Process(ent *entry.Entry) error {
+	for _, r := range rr.routes {
+		if r.re.Match(ent.Data) {
+			ent.Tag = r.tag
+			break
+		}
+	}
+	return rr.next.Process(ent)
+}
@@ -0,0 +1,50 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"testing"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestRegexTags(t *testing.T) {
+	l := listener{
+		Regex_Tag: []string{`%ASA-\d-\d+:asa`, `^\S+ (fw|asa)\d+ :firewall`, `(?i)error:errors`},
+	}
+	rts, err := l.regexTags()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rts) != 3 || rts[1].tag != `firewall` || rts[1].re.String() != `^\S+ (fw|asa)\d+ ` {
+		t.Fatalf("bad regex tags: %+v", rts)
+	}
+	var routes []regexRoute
+	for i, rt := range rts {
+		routes = append(routes, regexRoute{re: rt.re, tag: entry.EntryTag(i + 1)})
+	}
+	cp := &capProcessor{}
+	rr := newRegexRouter(routes, cp)
+	tests := map[string]entry.EntryTag{
+		`host asa01 %ASA-4-106023: Deny`: 1, //first match wins
+		`host fw02 denied ERROR`:         2,
+		`something Error happened`:       3,
+		`nothing to see`:                 0,
+	}
+	for v, tag := range tests {
+		if err := rr.Process(&entry.Entry{Data: []byte(v)}); err != nil {
+			t.Fatal(err)
+		} else if got := cp.ents[len(cp.ents)-1].Tag; got != tag {
+			t.Fatalf("%q routed to %d, expected %d", v, got, tag)
+		}
+	}
+	for _, v := range []string{`no tag`, `foo:`, `(unclosed:tag`, `foo:bad.tag`} {
+		if _, err := parseRegexTag(v); err == nil {
+			t.Fatalf("accepted invalid Regex-Tag %q", v)
+		}
+	}
+}
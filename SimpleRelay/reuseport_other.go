@@ -0,0 +1,22 @@
+// +build !linux
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+const reusePortSupported = false
+
+func listenUDPReusePort(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -15,9 +15,9 @@ import (
 	"net"
 	"os"
 	"regexp"
+	"time"
 
 	"github.com/gravwell/ingest/v3/entry"
-	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/timegrinder/v3"
 )
 
@@ -43,28 +43,15 @@ func rfc5424ConnHandlerTCP(c net.Conn, cfg handlerConfig) {
 	} else {
 		rip = cfg.src
 	}
+	cfg.tag = cfg.sourceTag(c.RemoteAddr())
+	sender := addrIP(c.RemoteAddr())
 
-	tcfg := timegrinder.Config{
-		EnableLeftMostSeed: true,
-		FormatOverride:     cfg.formatOverride,
-	}
-	tg, err := timegrinder.NewTimeGrinder(tcfg)
+	tg, err := cfg.newTimeGrinder()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get a handle on the timegrinder: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
 	}
 
-	if cfg.setLocalTime {
-		tg.SetLocalTime()
-	}
-	if cfg.timezoneOverride != `` {
-		err = tg.SetTimezone(cfg.timezoneOverride)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to set timezone to %v: %v\n", cfg.timezoneOverride, err)
-			return
-		}
-	}
-
 	re := regexp.MustCompile(`\n<\d{1,3}>`)
 
 	s := bufio.NewScanner(c)
@@ -98,44 +85,38 @@ func rfc5424ConnHandlerTCP(c net.Conn, cfg handlerConfig) {
 		token = data[:advance]
 		return
 	}
-	s.Split(splitter)
+	s.Split(framedSplit(cfg.framing, splitter))
 	for s.Scan() {
 		data := bytes.Trim(s.Bytes(), "\n\r\t ")
 		debugout("Scanning TCP input %s\n", string(data))
-		if len(data) == 0 {
+		if len(data) == 0 || !cfg.limiter.allow(sender, time.Now()) {
+			continue
+		}
+		data, ok := cfg.sizer.check(data)
+		if !ok {
 			continue
 		}
-		if ent, err := handleLog(data, rip, cfg.ignoreTimestamps, cfg.tag, tg); err != nil {
+		//the scanner reuses its buffer, so the bytes must be copied when handing them in
+		if ent, err := handleLog(append([]byte(nil), data...), rip, cfg.ignoreTimestamps, cfg.tag, tg); err != nil {
 			return
 		} else if err = cfg.proc.Process(ent); err != nil {
 			return
 		}
 	}
+	if err := s.Err(); err != nil && !isTimeout(err) {
+		cfg.frameFailure(err)
+		fmt.Fprintf(os.Stderr, "Failed to read syslog from %v: %v\n", c.RemoteAddr(), err)
+	}
 }
 
 func rfc5424ConnHandlerUDP(c *net.UDPConn, cfg handlerConfig) {
 	buff := make([]byte, 16*1024) //local buffer that should be big enough for even the largest UDP packets
-	tcfg := timegrinder.Config{
-		EnableLeftMostSeed: true,
-		FormatOverride:     cfg.formatOverride,
-	}
-	tg, err := timegrinder.NewTimeGrinder(tcfg)
+	tg, err := cfg.newTimeGrinder()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to get a handle on the timegrinder: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
 	}
 
-	if cfg.setLocalTime {
-		tg.SetLocalTime()
-	}
-	if cfg.timezoneOverride != `` {
-		err = tg.SetTimezone(cfg.timezoneOverride)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to set timezone to %v: %v\n", cfg.timezoneOverride, err)
-			return
-		}
-	}
-
 	var rip net.IP
 	for {
 		n, raddr, err := c.ReadFromUDP(buff)
@@ -149,19 +130,27 @@ func rfc5424ConnHandlerUDP(c *net.UDPConn, cfg handlerConfig) {
 			if n > len(buff) {
 				continue
 			}
+			//syslog senders put a single message in each datagram, so limit by packet
+			if !cfg.limiter.allow(raddr.IP, time.Now()) {
+				continue
+			}
+			pkt, ok := cfg.sizer.check(buff[:n])
+			if !ok {
+				continue
+			}
 			if cfg.src == nil {
 				rip = raddr.IP
 			} else {
 				rip = cfg.src
 			}
-			handleRFC5424Packet(append([]byte(nil), buff[:n]...), rip, cfg.ignoreTimestamps, cfg.tag, tg, cfg.proc)
+			handleRFC5424Packet(append([]byte(nil), pkt...), rip, cfg.ignoreTimestamps, cfg.sourceTag(raddr), tg, cfg.proc)
 		}
 	}
 
 }
 
 //we can be very very fast on this one by just manually scanning the buffer
-func handleRFC5424Packet(buff []byte, ip net.IP, ignoreTS bool, tag entry.EntryTag, tg *timegrinder.TimeGrinder, proc *processors.ProcessorSet) {
+func handleRFC5424Packet(buff []byte, ip net.IP, ignoreTS bool, tag entry.EntryTag, tg *timegrinder.TimeGrinder, proc entryProcessor) {
 	var idx []int
 	var idx2 []int
 	re := regexp.MustCompile(`^<\d{1,3}>`)
@@ -19,12 +19,12 @@ import (
 
 	"github.com/gravwell/ingest/v3"
 	"github.com/gravwell/ingest/v3/entry"
-	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/timegrinder/v3"
 )
 
 var (
 	connClosers map[int]closer
+	lstClosers  map[int]closer //listening sockets, closed first on shutdown so established connections can drain
 	connId      int
 	mtx         sync.Mutex
 )
@@ -34,15 +34,26 @@ type closer interface {
 }
 
 type handlerConfig struct {
-	tag              entry.EntryTag
-	lrt              readerType
-	ignoreTimestamps bool
-	setLocalTime     bool
-	timezoneOverride string
-	src              net.IP
-	wg               *sync.WaitGroup
-	formatOverride   string
-	proc             *processors.ProcessorSet
+	timeConfig
+	tag           entry.EntryTag
+	srcRoutes     []sourceRoute
+	limiter       *sourceLimiter
+	stats         *listenerStats
+	sizer         *entrySizer
+	tsFields      []string       //json reader timestamp field
+	quarantine    entry.EntryTag //json reader tag for invalid documents
+	hasQuarantine bool
+	chunkSize     int                       //binary reader chunk size
+	sharedKey     string                    //fluentd reader handshake key
+	tagField      string                    //fluentd reader record key for the fluentd tag
+	destRoutes    map[string]entry.EntryTag //stomp reader destination tags
+	login         string                    //stomp reader credentials
+	passcode      string
+	lrt           readerType
+	framing       framingType
+	src           net.IP
+	wg            *sync.WaitGroup
+	proc          entryProcessor
 }
 
 func startSimpleListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitGroup, f *flusher) error {
@@ -78,57 +89,132 @@ func startSimpleListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitG
 		if err != nil {
 			lg.FatalCode(0, "Invalid reader type \"%s\": %v\n", v.Reader_Type, err)
 		}
+		framing, err := translateFraming(v.Framing)
+		if err != nil {
+			lg.FatalCode(0, "Invalid framing \"%s\": %v\n", v.Framing, err)
+		}
 		hcfg := handlerConfig{
-			tag:              tag,
-			lrt:              lrt,
-			ignoreTimestamps: v.Ignore_Timestamps,
-			setLocalTime:     v.Assume_Local_Timezone,
-			timezoneOverride: v.Timezone_Override,
-			src:              src,
-			wg:               wg,
-			formatOverride:   v.Timestamp_Format_Override,
-		}
-		if hcfg.proc, err = cfg.Preprocessor.ProcessorSet(igst, v.Preprocessor); err != nil {
+			tag:        tag,
+			lrt:        lrt,
+			framing:    framing.resolve(lrt),
+			timeConfig: v.timeConfig(),
+			chunkSize:  v.Chunk_Size,
+			sharedKey:  v.Shared_Key,
+			tagField:   v.Fluentd_Tag_Field,
+			login:      v.Login,
+			passcode:   v.Passcode,
+			stats:      allStats.get(k),
+			src:        src,
+			wg:         wg,
+		}
+		if hcfg.srcRoutes, err = v.sourceRoutes(igst); err != nil {
+			lg.Fatal("Failed to resolve Source-Tag tags for %s: %v\n", k, err)
+		}
+		if hcfg.destRoutes, err = v.destinationRoutes(igst); err != nil {
+			lg.Fatal("Failed to resolve Destination-Tag tags for %s: %v\n", k, err)
+		}
+		if v.Timestamp_Field != `` {
+			if hcfg.tsFields, err = getJsonFields(v.Timestamp_Field); err != nil {
+				lg.FatalCode(0, "Invalid Timestamp-Field for %s: %v\n", k, err)
+			}
+		}
+		if v.Quarantine_Tag != `` {
+			if hcfg.quarantine, err = igst.GetTag(v.Quarantine_Tag); err != nil {
+				lg.Fatal("Failed to resolve tag \"%s\" for %s: %v\n", v.Quarantine_Tag, k, err)
+			}
+			hcfg.hasQuarantine = true
+		}
+		proc, err := cfg.Preprocessor.ProcessorSet(igst, v.Preprocessor)
+		if err != nil {
 			lg.Fatal("Preprocessor failure: %v", err)
 		}
+		var next entryProcessor = proc
+		if bp, err := newBackpressureProcessor(k, v, proc, igst); err != nil {
+			lg.FatalCode(0, "Listener %s: %v\n", k, err)
+		} else if bp != nil {
+			bp.stats = hcfg.stats
+			//added ahead of the preprocessors so buffered entries are flushed before they close
+			f.Add(bp)
+			next = bp
+		}
+		f.Add(proc)
+		rrs, err := v.regexRoutes(igst)
+		if err != nil {
+			lg.Fatal("Failed to resolve Regex-Tag tags for %s: %v\n", k, err)
+		}
+		hcfg.proc = newRegexRouter(rrs, next)
+		//priority routes run first so a matching Regex-Tag has the final say
+		prs, err := v.priorityRoutes(igst)
+		if err != nil {
+			lg.Fatal("Failed to resolve Priority-Tag tags for %s: %v\n", k, err)
+		}
+		hcfg.proc = newPriorityRouter(prs, hcfg.proc)
+		//duplicates are dropped before routing and counted after the stats see them
+		if dp, err := newDedupProcessor(k, v, hcfg.proc); err != nil {
+			lg.FatalCode(0, "Listener %s: %v\n", k, err)
+		} else if dp != nil {
+			dp.stats = hcfg.stats
+			dp.start(igst)
+			f.Add(dp)
+			hcfg.proc = dp
+		}
+		hcfg.proc = newStatsProcessor(hcfg.stats, hcfg.proc)
+		//data is converted to UTF-8 first so everything after it sees what gets ingested
+		enc, err := translateEncoding(v.Encoding)
 		if err != nil {
-			lg.Fatal("Preprocessor construction error: %v", err)
+			lg.FatalCode(0, "Listener %s: %v\n", k, err)
+		}
+		hcfg.proc = newCharsetProcessor(enc, hcfg.proc)
+		if hcfg.limiter = newSourceLimiter(k, v); hcfg.limiter != nil {
+			hcfg.limiter.stats = hcfg.stats
+			hcfg.limiter.start(igst)
+			f.Add(hcfg.limiter)
+		}
+		if hcfg.sizer, err = newEntrySizer(k, v); err != nil {
+			lg.FatalCode(0, "Invalid Oversize-Policy for %s: %v\n", k, err)
+		} else if hcfg.sizer != nil {
+			hcfg.sizer.stats = hcfg.stats
+			hcfg.sizer.start(igst)
+			f.Add(hcfg.sizer)
 		}
-		f.Add(hcfg.proc)
 		if tp.TCP() {
 			//get the socket
 			addr, err := net.ResolveTCPAddr(tp.String(), str)
 			if err != nil {
 				lg.FatalCode(0, "Bind-String \"%s\" for %s is invalid: %v\n", v.Bind_String, k, err)
 			}
-			l, err := net.ListenTCP(tp.String(), addr)
+			tl, err := net.ListenTCP(tp.String(), addr)
 			if err != nil {
 				lg.FatalCode(0, "Failed to listen on \"%s\" via %s for %s: %v\n", addr, tp.String(), k, err)
 			}
-			connID := addConn(l)
+			l, err := v.wrapListener(tl)
+			if err != nil {
+				lg.FatalCode(0, "Invalid connection options for %s: %v\n", k, err)
+			}
+			connID := addListener(l)
 			//start the acceptor
 			wg.Add(1)
 			go acceptor(l, connID, igst, hcfg, tp)
 		} else if tp.TLS() {
-			config := &tls.Config{
-				MinVersion: tls.VersionTLS12,
-			}
-
-			config.Certificates = make([]tls.Certificate, 1)
-			config.Certificates[0], err = tls.LoadX509KeyPair(v.Cert_File, v.Key_File)
+			config, err := v.tlsConfig(v.Cert_File, v.Key_File)
 			if err != nil {
-				lg.Fatal("Certificate load fail: %v", err)
+				lg.Fatal("TLS configuration for %s failed: %v", k, err)
 			}
 			//get the socket
 			addr, err := net.ResolveTCPAddr("tcp", str)
 			if err != nil {
 				lg.FatalCode(0, "Bind-String \"%s\" for %s is invalid: %v\n", v.Bind_String, k, err)
 			}
-			l, err := tls.Listen("tcp", addr.String(), config)
+			tl, err := net.ListenTCP("tcp", addr)
 			if err != nil {
 				lg.FatalCode(0, "Failed to listen on \"%s\" via TLS for %s: %v\n", addr, k, err)
 			}
-			connID := addConn(l)
+			wl, err := v.wrapListener(tl)
+			if err != nil {
+				lg.FatalCode(0, "Invalid connection options for %s: %v\n", k, err)
+			}
+			l := tls.NewListener(wl, config)
+			connID := addListener(l)
 			//start the acceptor
 			wg.Add(1)
 			go acceptor(l, connID, igst, hcfg, tp)
@@ -137,13 +223,22 @@ func startSimpleListeners(cfg *cfgType, igst *ingest.IngestMuxer, wg *sync.WaitG
 			if err != nil {
 				lg.FatalCode(0, "Bind-String \"%s\" for %s is invalid: %v\n", v.Bind_String, k, err)
 			}
-			l, err := net.ListenUDP(tp.String(), addr)
-			if err != nil {
-				lg.FatalCode(0, "Failed to listen on \"%s\" via %s for %s: %v\n", addr, tp.String(), k, err)
+			if v.UDP_Workers <= 1 {
+				l, err := net.ListenUDP(tp.String(), addr)
+				if err != nil {
+					lg.FatalCode(0, "Failed to listen on \"%s\" via %s for %s: %v\n", addr, tp.String(), k, err)
+				}
+				startUDPWorker(l, k, v, hcfg)
+				continue
+			}
+			//each worker gets its own socket on the port and the kernel balances packets across them
+			for i := 0; i < v.UDP_Workers; i++ {
+				l, err := listenUDPReusePort(tp.String(), addr)
+				if err != nil {
+					lg.FatalCode(0, "Failed to listen on \"%s\" via %s for %s: %v\n", addr, tp.String(), k, err)
+				}
+				startUDPWorker(l, k, v, hcfg)
 			}
-			connID := addConn(l)
-			wg.Add(1)
-			go acceptorUDP(l, connID, hcfg)
 		}
 	}
 	debugout("Started %d listeners\n", len(cfg.Listener))
@@ -169,21 +264,46 @@ func acceptor(lst net.Listener, id int, igst *ingest.IngestMuxer, cfg handlerCon
 			}
 			continue
 		}
-		debugout("Accepted %v connection from %s in %v mode\n", conn.RemoteAddr(), cfg.lrt, tp.String())
-		igst.Info("accepted %v connection from %s in %v mode\n", conn.RemoteAddr(), cfg.lrt, tp.String())
 		failCount = 0
-		switch cfg.lrt {
-		case lineReader:
-			go lineConnHandlerTCP(conn, cfg)
-		case rfc5424Reader:
-			go rfc5424ConnHandlerTCP(conn, cfg)
-		default:
-			fmt.Fprintf(os.Stderr, "Invalid reader type on connection\n")
-			return
-		}
+		go tcpConnHandler(cfg.stats.track(conn), igst, cfg, tp)
 	}
 }
 
+// tcpConnHandler logs an accepted connection and hands it to the reader.  It runs on its own
+// goroutine because RemoteAddr waits for the PROXY header from a trusted load balancer.
+func tcpConnHandler(conn net.Conn, igst *ingest.IngestMuxer, cfg handlerConfig, tp bindType) {
+	debugout("Accepted %v connection from %s in %v mode\n", conn.RemoteAddr(), cfg.lrt, tp.String())
+	igst.Info("accepted %v connection from %s in %v mode\n", conn.RemoteAddr(), cfg.lrt, tp.String())
+	switch cfg.lrt {
+	case lineReader:
+		lineConnHandlerTCP(conn, cfg)
+	case rfc5424Reader, rfc5425Reader:
+		rfc5424ConnHandlerTCP(conn, cfg)
+	case jsonReader:
+		jsonReaderConnHandlerTCP(conn, cfg)
+	case binaryReader:
+		binaryConnHandlerTCP(conn, cfg)
+	case fluentdReader:
+		forwardConnHandlerTCP(conn, cfg)
+	case beatsReader:
+		beatsConnHandlerTCP(conn, cfg)
+	case stompReader:
+		stompConnHandlerTCP(conn, cfg)
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid reader type on connection\n")
+		conn.Close()
+	}
+}
+
+func startUDPWorker(l *net.UDPConn, name string, v *listener, hcfg handlerConfig) {
+	if err := v.joinMulticast(l); err != nil {
+		lg.FatalCode(0, "Listener %s: %v\n", name, err)
+	}
+	connID := addListener(l)
+	hcfg.wg.Add(1)
+	go acceptorUDP(l, connID, hcfg)
+}
+
 func acceptorUDP(conn *net.UDPConn, id int, cfg handlerConfig) {
 	defer cfg.wg.Done()
 	defer delConn(id)
@@ -194,6 +314,10 @@ func acceptorUDP(conn *net.UDPConn, id int, cfg handlerConfig) {
 		lineConnHandlerUDP(conn, cfg)
 	case rfc5424Reader:
 		rfc5424ConnHandlerUDP(conn, cfg)
+	case jsonReader:
+		jsonReaderConnHandlerUDP(conn, cfg)
+	case binaryReader:
+		binaryConnHandlerUDP(conn, cfg)
 	default:
 		fmt.Fprintf(os.Stderr, "Invalid reader type on connection\n")
 		return
@@ -228,6 +352,20 @@ func handleLog(b []byte, ip net.IP, ignoreTS bool, tag entry.EntryTag, tg *timeg
 	return
 }
 
+// runEvery calls fn on every tick of the interval until done is closed
+func runEvery(d time.Duration, done chan struct{}, fn func()) {
+	tkr := time.NewTicker(d)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-tkr.C:
+			fn()
+		case <-done:
+			return
+		}
+	}
+}
+
 func addConn(c closer) int {
 	mtx.Lock()
 	connId++
@@ -237,9 +375,39 @@ func addConn(c closer) int {
 	return id
 }
 
+// addListener registers a listening socket, listeners are closed before connections on shutdown
+func addListener(c closer) int {
+	mtx.Lock()
+	connId++
+	id := connId
+	lstClosers[connId] = c
+	mtx.Unlock()
+	return id
+}
+
+// delConn removes a connection or listener
 func delConn(id int) {
 	mtx.Lock()
 	delete(connClosers, id)
+	delete(lstClosers, id)
+	mtx.Unlock()
+}
+
+// closeListeners stops accepting new connections and UDP packets
+func closeListeners() {
+	mtx.Lock()
+	for _, v := range lstClosers {
+		v.Close()
+	}
+	mtx.Unlock()
+}
+
+// closeConns closes established connections, handlers finish with whatever they have read
+func closeConns() {
+	mtx.Lock()
+	for _, v := range connClosers {
+		v.Close()
+	}
 	mtx.Unlock()
 }
 
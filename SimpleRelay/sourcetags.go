@@ -0,0 +1,132 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrInvalidSourceTag = errors.New("Source-Tag must be of the form CIDR:tag")
+)
+
+// sourceTag maps a block of sender addresses to a tag
+type sourceTag struct {
+	network *net.IPNet
+	tag     string
+}
+
+// sourceRoute is a sourceTag with the tag resolved by the muxer
+type sourceRoute struct {
+	network *net.IPNet
+	tag     entry.EntryTag
+}
+
+// parseSourceTag parses a Source-Tag value of the form 10.0.0.0/8:fw, tags cannot contain
+// a colon so the last colon separates the tag from an IPv6 CIDR
+func parseSourceTag(v string) (st sourceTag, err error) {
+	idx := strings.LastIndex(v, elemSep)
+	if idx <= 0 {
+		err = ErrInvalidSourceTag
+		return
+	}
+	cidr := strings.TrimSpace(v[:idx])
+	st.tag = strings.TrimSpace(v[idx+1:])
+	if st.network, err = parseNetwork(cidr); err != nil {
+		err = fmt.Errorf("Invalid Source-Tag network %q: %v", cidr, err)
+		return
+	}
+	if len(st.tag) == 0 {
+		err = ErrInvalidSourceTag
+	} else if err = ingest.CheckTag(st.tag); err != nil {
+		err = fmt.Errorf("Invalid Source-Tag tag %q: %v", st.tag, err)
+	}
+	return
+}
+
+// parseNetwork parses a CIDR, a bare address is a single host
+func parseNetwork(cidr string) (network *net.IPNet, err error) {
+	if !strings.Contains(cidr, `/`) {
+		if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+			cidr += `/32`
+		} else {
+			cidr += `/128`
+		}
+	}
+	_, network, err = net.ParseCIDR(cidr)
+	return
+}
+
+func (l listener) sourceTags() (sts []sourceTag, err error) {
+	var st sourceTag
+	for _, v := range l.Source_Tag {
+		if st, err = parseSourceTag(v); err != nil {
+			return
+		}
+		sts = append(sts, st)
+	}
+	return
+}
+
+// sourceRoutes resolves the Source-Tag tags so they can be checked on each connection or packet
+func (l listener) sourceRoutes(igst *ingest.IngestMuxer) (srs []sourceRoute, err error) {
+	sts, err := l.sourceTags()
+	if err != nil {
+		return
+	}
+	for _, st := range sts {
+		sr := sourceRoute{network: st.network}
+		if sr.tag, err = igst.GetTag(st.tag); err != nil {
+			return
+		}
+		srs = append(srs, sr)
+	}
+	return
+}
+
+// sourceTag returns the tag for a sender, the most specific matching network wins and
+// senders outside every network use the listener tag
+func (hc handlerConfig) sourceTag(addr net.Addr) entry.EntryTag {
+	if len(hc.srcRoutes) == 0 {
+		return hc.tag
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return hc.tag
+	}
+	tag := hc.tag
+	best := -1
+	for _, sr := range hc.srcRoutes {
+		if !sr.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := sr.network.Mask.Size(); ones > best {
+			best = ones
+			tag = sr.tag
+		}
+	}
+	return tag
+}
+
+// addrIP returns the IP of a TCP or UDP address, the sender of a connection or packet
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	statsSampleInterval             = 5 * time.Second
+	statsSocketPerm     os.FileMode = 0660
+)
+
+var (
+	//stats are registered by name as listeners start and served by the stats endpoint
+	allStats = &statsRegistry{
+		stats: map[string]*listenerStats{},
+	}
+
+	ErrInvalidStatsListen = errors.New("Stats-Listen must be a host:port pair or an absolute path to a unix socket")
+)
+
+// listenerStats are the counters for a single listener, the counters are updated atomically
+// and the rates are updated by the stats endpoint under the registry lock
+type listenerStats struct {
+	active    int64 //open TCP connections
+	conns     int64 //TCP connections accepted
+	entries   int64 //entries read, before routing and preprocessing
+	bytes     int64 //bytes of entry data read
+	parseFail int64 //invalid JSON documents and broken frames
+	drops     int64 //entries dropped by the rate limit, size limit, or backpressure policy
+	dups      int64 //entries suppressed by the Dedup-Window
+
+	lastEntries int64
+	lastBytes   int64
+	lastSample  time.Time
+	entryRate   float64
+	byteRate    float64
+}
+
+type listenerStatsSnapshot struct {
+	ActiveConnections int64
+	Connections       int64
+	Entries           int64
+	Bytes             int64
+	EntriesPerSecond  float64
+	BytesPerSecond    float64
+	ParseFailures     int64
+	Drops             int64
+	Duplicates        int64
+}
+
+// drop, duplicate, and parseFailure are safe to call on nil stats
+func (st *listenerStats) drop() {
+	if st != nil {
+		atomic.AddInt64(&st.drops, 1)
+	}
+}
+
+func (st *listenerStats) duplicate() {
+	if st != nil {
+		atomic.AddInt64(&st.dups, 1)
+	}
+}
+
+func (st *listenerStats) parseFailure() {
+	if st != nil {
+		atomic.AddInt64(&st.parseFail, 1)
+	}
+}
+
+// track counts an accepted connection, it stops counting as active when it is closed
+func (st *listenerStats) track(c net.Conn) net.Conn {
+	if st == nil {
+		return c
+	}
+	atomic.AddInt64(&st.conns, 1)
+	atomic.AddInt64(&st.active, 1)
+	return &statsConn{Conn: c, st: st}
+}
+
+type statsConn struct {
+	net.Conn
+	st   *listenerStats
+	once sync.Once
+}
+
+func (sc *statsConn) Close() error {
+	sc.once.Do(func() { atomic.AddInt64(&sc.st.active, -1) })
+	return sc.Conn.Close()
+}
+
+type statsRegistry struct {
+	sync.Mutex
+	stats map[string]*listenerStats
+}
+
+// get returns the stats for a listener, creating them if needed
+func (sr *statsRegistry) get(name string) *listenerStats {
+	sr.Lock()
+	defer sr.Unlock()
+	st, ok := sr.stats[name]
+	if !ok {
+		st = &listenerStats{lastSample: time.Now()}
+		sr.stats[name] = st
+	}
+	return st
+}
+
+// sample updates the per second rates of every listener
+func (sr *statsRegistry) sample(now time.Time) {
+	sr.Lock()
+	defer sr.Unlock()
+	for _, st := range sr.stats {
+		entries, bytes := atomic.LoadInt64(&st.entries), atomic.LoadInt64(&st.bytes)
+		if secs := now.Sub(st.lastSample).Seconds(); secs > 0 {
+			st.entryRate = float64(entries-st.lastEntries) / secs
+			st.byteRate = float64(bytes-st.lastBytes) / secs
+		}
+		st.lastEntries, st.lastBytes, st.lastSample = entries, bytes, now
+	}
+}
+
+func (sr *statsRegistry) snapshot() map[string]listenerStatsSnapshot {
+	sr.Lock()
+	defer sr.Unlock()
+	r := make(map[string]listenerStatsSnapshot, len(sr.stats))
+	for name, st := range sr.stats {
+		r[name] = listenerStatsSnapshot{
+			ActiveConnections: atomic.LoadInt64(&st.active),
+			Connections:       atomic.LoadInt64(&st.conns),
+			Entries:           atomic.LoadInt64(&st.entries),
+			Bytes:             atomic.LoadInt64(&st.bytes),
+			EntriesPerSecond:  st.entryRate,
+			BytesPerSecond:    st.byteRate,
+			ParseFailures:     atomic.LoadInt64(&st.parseFail),
+			Drops:             atomic.LoadInt64(&st.drops),
+			Duplicates:        atomic.LoadInt64(&st.dups),
+		}
+	}
+	return r
+}
+
+// statsProcessor sits in front of the processing chain and counts everything a listener reads
+type statsProcessor struct {
+	st   *listenerStats
+	next entryProcessor
+}
+
+func newStatsProcessor(st *listenerStats, next entryProcessor) entryProcessor {
+	return &statsProcessor{st: st, next: next}
+}
+
+func (sp *statsProcessor) Process(ent *entry.Entry) error {
+	atomic.AddInt64(&sp.st.entries, 1)
+	atomic.AddInt64(&sp.st.bytes, int64(len(ent.Data)))
+	return sp.next.Process(ent)
+}
+
+func (g *global) validateStatsListen() error {
+	if g.Stats_Listen == `` || strings.HasPrefix(g.Stats_Listen, `/`) {
+		return nil
+	} else if _, _, err := net.SplitHostPort(g.Stats_Listen); err != nil {
+		return ErrInvalidStatsListen
+	}
+	return nil
+}
+
+// statsServer answers HTTP requests with the stats of every listener as JSON, it listens
+// on a unix socket when given a path and on TCP otherwise
+type statsServer struct {
+	srv  *http.Server
+	done chan struct{}
+}
+
+func newStatsServer(addr string) (ss *statsServer, err error) {
+	var l net.Listener
+	if strings.HasPrefix(addr, `/`) {
+		//remove a stale socket left behind by a relay that did not shut down cleanly
+		if fi, lerr := os.Lstat(addr); lerr == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err = os.Remove(addr); err != nil {
+				return
+			}
+		}
+		if l, err = net.Listen(`unix`, addr); err != nil {
+			return
+		}
+		if err = os.Chmod(addr, statsSocketPerm); err != nil {
+			l.Close()
+			return
+		}
+	} else if l, err = net.Listen(`tcp`, addr); err != nil {
+		return
+	}
+	ss = &statsServer{
+		srv:  &http.Server{Handler: http.HandlerFunc(serveStats)},
+		done: make(chan struct{}),
+	}
+	go ss.srv.Serve(l)
+	go runEvery(statsSampleInterval, ss.done, func() { allStats.sample(time.Now()) })
+	return
+}
+
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent(``, "\t")
+	enc.Encode(allStats.snapshot())
+}
+
+func (ss *statsServer) Close() error {
+	close(ss.done)
+	return ss.srv.Close()
+}
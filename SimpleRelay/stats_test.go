@@ -0,0 +1,90 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func TestListenerStats(t *testing.T) {
+	st := allStats.get(`stats test`)
+	cp := &capProcessor{}
+	proc := newStatsProcessor(st, cp)
+	for _, v := range []string{`abc`, `defgh`} {
+		if err := proc.Process(&entry.Entry{Data: []byte(v)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st.parseFailure()
+	sl := newSourceLimiter(`stats test`, &listener{Source_Rate_Limit: 1})
+	sl.stats = st
+	ip := net.ParseIP(`10.0.0.1`)
+	now := time.Now()
+	sl.allow(ip, now)
+	sl.allow(ip, now)
+
+	srv, cli := net.Pipe()
+	c := st.track(srv)
+	start := time.Now()
+	allStats.sample(start.Add(2 * time.Second))
+
+	sock := filepath.Join(tmpDir, `stats.sock`)
+	ss, err := newStatsServer(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Close()
+	hc := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial(`unix`, sock)
+		},
+	}}
+	get := func() (s listenerStatsSnapshot) {
+		resp, err := hc.Get(`http://relay/`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var mp map[string]listenerStatsSnapshot
+		if err = json.NewDecoder(resp.Body).Decode(&mp); err != nil {
+			t.Fatal(err)
+		}
+		return mp[`stats test`]
+	}
+	s := get()
+	if s.Entries != 2 || s.Bytes != 8 || s.ParseFailures != 1 || s.Drops != 1 {
+		t.Fatalf("bad counters %+v", s)
+	} else if s.ActiveConnections != 1 || s.Connections != 1 {
+		t.Fatalf("bad connection counts %+v", s)
+	} else if s.EntriesPerSecond <= 0 || s.BytesPerSecond <= 0 {
+		t.Fatalf("bad rates %+v", s)
+	}
+	c.Close()
+	c.Close()
+	cli.Close()
+	if s = get(); s.ActiveConnections != 0 || s.Connections != 1 {
+		t.Fatalf("bad connection counts after close %+v", s)
+	}
+
+	g := global{Stats_Listen: `127.0.0.1:9050`}
+	if err := g.validateStatsListen(); err != nil {
+		t.Fatal(err)
+	}
+	g.Stats_Listen = `relay.sock`
+	if err := g.validateStatsListen(); err != ErrInvalidStatsListen {
+		t.Fatal("accepted a relative socket path", err)
+	}
+}
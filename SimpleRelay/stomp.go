@@ -0,0 +1,521 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	maxStompHeaders      = 128
+	maxStompHeaderLine   = 64 * 1024
+	maxStompTransactions = 16
+	stompWriteTimeout    = 10 * time.Second
+)
+
+var (
+	ErrStompOptionsWithoutReader = errors.New("Destination-Tag, Login, and Passcode require Reader-Type stomp")
+	ErrStompWithoutTCP           = errors.New("Reader-Type stomp requires a TCP or TLS listener")
+	ErrStompOptions              = errors.New("Framing does not apply to Reader-Type stomp")
+	ErrPasscodeWithoutLogin      = errors.New("Passcode requires a Login")
+	ErrInvalidDestinationTag     = errors.New("Destination-Tag must be of the form destination:tag")
+	ErrInvalidStompFrame         = errors.New("invalid STOMP frame")
+	ErrStompFrameTooLarge        = errors.New("STOMP frame is too large")
+	ErrStompTransactionTooLarge  = fmt.Errorf("open STOMP transactions may not hold more than %d bytes", maxDataSize)
+
+	stompVersions = []string{`1.2`, `1.1`} //preferred first
+)
+
+// destinationTag maps a STOMP destination to a tag
+type destinationTag struct {
+	dest string
+	tag  string
+}
+
+// parseDestinationTag parses a Destination-Tag value such as /queue/firewall:firewall, tags
+// cannot contain a colon so the last colon separates the tag from the destination
+func parseDestinationTag(v string) (dt destinationTag, err error) {
+	idx := strings.LastIndex(v, elemSep)
+	if idx <= 0 {
+		err = ErrInvalidDestinationTag
+		return
+	}
+	dt.dest = strings.TrimSpace(v[:idx])
+	if dt.tag = strings.TrimSpace(v[idx+1:]); len(dt.dest) == 0 || len(dt.tag) == 0 {
+		err = ErrInvalidDestinationTag
+	} else if err = ingest.CheckTag(dt.tag); err != nil {
+		err = fmt.Errorf("Invalid Destination-Tag tag %q: %v", dt.tag, err)
+	}
+	return
+}
+
+func (l listener) destinationTags() (dts []destinationTag, err error) {
+	var dt destinationTag
+	for _, v := range l.Destination_Tag {
+		if dt, err = parseDestinationTag(v); err != nil {
+			return
+		}
+		dts = append(dts, dt)
+	}
+	return
+}
+
+// destinationRoutes resolves the Destination-Tag tags
+func (l listener) destinationRoutes(igst *ingest.IngestMuxer) (mp map[string]entry.EntryTag, err error) {
+	dts, err := l.destinationTags()
+	if err != nil || len(dts) == 0 {
+		return
+	}
+	mp = make(map[string]entry.EntryTag, len(dts))
+	for _, dt := range dts {
+		if mp[dt.dest], err = igst.GetTag(dt.tag); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// validateStompReader checks the options that only apply to the stomp reader type
+func (l listener) validateStompReader() error {
+	lrt, err := translateReaderType(l.Reader_Type)
+	if err != nil {
+		return err
+	}
+	if lrt != stompReader {
+		if len(l.Destination_Tag) > 0 || l.Login != `` || l.Passcode != `` {
+			return ErrStompOptionsWithoutReader
+		}
+		return nil
+	}
+	if l.Framing != `` {
+		return ErrStompOptions
+	} else if l.Passcode != `` && l.Login == `` {
+		return ErrPasscodeWithoutLogin
+	}
+	if _, err = l.destinationTags(); err != nil {
+		return err
+	}
+	if tp, _, err := translateBindType(l.Bind_String); err != nil {
+		return err
+	} else if tp.UDP() {
+		return ErrStompWithoutTCP
+	}
+	return nil
+}
+
+type stompFrame struct {
+	command string
+	headers [][2]string
+	body    []byte
+}
+
+// header returns the first value of a header, repeated headers are ignored as in STOMP 1.2
+func (f stompFrame) header(k string) (string, bool) {
+	for _, h := range f.headers {
+		if h[0] == k {
+			return h[1], true
+		}
+	}
+	return ``, false
+}
+
+func (f stompFrame) encode(version string) []byte {
+	var bb bytes.Buffer
+	bb.WriteString(f.command)
+	bb.WriteByte('\n')
+	for _, h := range f.headers {
+		bb.WriteString(stompEscape(h[0], version))
+		bb.WriteByte(':')
+		bb.WriteString(stompEscape(h[1], version))
+		bb.WriteByte('\n')
+	}
+	if len(f.body) > 0 {
+		fmt.Fprintf(&bb, "content-length:%d\n", len(f.body))
+	}
+	bb.WriteByte('\n')
+	bb.Write(f.body)
+	bb.WriteByte(0)
+	return bb.Bytes()
+}
+
+// stompEscape applies header escaping, which STOMP 1.0 and the CONNECTED frame do not use
+func stompEscape(s, version string) string {
+	switch version {
+	case `1.2`:
+		return strings.NewReplacer("\\", `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`).Replace(s)
+	case `1.1`:
+		return strings.NewReplacer("\\", `\\`, "\n", `\n`, ":", `\c`).Replace(s)
+	}
+	return s
+}
+
+func stompUnescape(s, version string) (string, error) {
+	if version == `` || strings.IndexByte(s, '\\') == -1 {
+		return s, nil
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			sb.WriteByte(s[i])
+			continue
+		} else if i++; i == len(s) {
+			return ``, ErrInvalidStompFrame
+		}
+		switch s[i] {
+		case '\\':
+			sb.WriteByte('\\')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'c':
+			sb.WriteByte(':')
+		case 'r':
+			if version != `1.2` {
+				return ``, ErrInvalidStompFrame
+			}
+			sb.WriteByte('\r')
+		default:
+			return ``, ErrInvalidStompFrame
+		}
+	}
+	return sb.String(), nil
+}
+
+// stompFrameReader reads frames, version is empty until the CONNECT frame has been handled
+type stompFrameReader struct {
+	rdr     *bufio.Reader
+	version string
+}
+
+// line reads a line, dropping the optional carriage return
+func (sr *stompFrameReader) line() (string, error) {
+	var ln []byte
+	for {
+		b, isPrefix, err := sr.rdr.ReadLine()
+		if err != nil {
+			return ``, err
+		}
+		if ln = append(ln, b...); len(ln) > maxStompHeaderLine {
+			return ``, ErrStompFrameTooLarge
+		} else if !isPrefix {
+			return string(ln), nil
+		}
+	}
+}
+
+// readFrame returns the next frame, io.EOF is only returned between frames
+func (sr *stompFrameReader) readFrame() (f stompFrame, err error) {
+	//blank lines between frames are heart-beats
+	for f.command == `` {
+		if f.command, err = sr.line(); err != nil {
+			return
+		}
+	}
+	for {
+		var ln string
+		if ln, err = sr.line(); err != nil {
+			err = unexpectedEOF(err)
+			return
+		} else if ln == `` {
+			break
+		}
+		idx := strings.IndexByte(ln, ':')
+		if idx <= 0 {
+			err = ErrInvalidStompFrame
+			return
+		} else if len(f.headers) >= maxStompHeaders {
+			err = ErrStompFrameTooLarge
+			return
+		}
+		var h [2]string
+		if h[0], err = stompUnescape(ln[:idx], sr.version); err != nil {
+			return
+		} else if h[1], err = stompUnescape(ln[idx+1:], sr.version); err != nil {
+			return
+		}
+		f.headers = append(f.headers, h)
+	}
+	if cl, ok := f.header(`content-length`); ok {
+		var l int
+		if l, err = strconv.Atoi(cl); err != nil || l < 0 {
+			err = ErrInvalidStompFrame
+			return
+		} else if l > maxDataSize {
+			err = ErrStompFrameTooLarge
+			return
+		}
+		f.body = make([]byte, l+1)
+		if _, err = io.ReadFull(sr.rdr, f.body); err != nil {
+			err = unexpectedEOF(err)
+			return
+		} else if f.body[l] != 0 {
+			err = ErrInvalidStompFrame
+			return
+		}
+		f.body = f.body[:l]
+		return
+	}
+	for {
+		var b []byte
+		if b, err = sr.rdr.ReadSlice(0); err == nil {
+			f.body = append(f.body, b[:len(b)-1]...)
+			break
+		} else if err != bufio.ErrBufferFull {
+			err = unexpectedEOF(err)
+			return
+		}
+		f.body = append(f.body, b...)
+		if len(f.body) > maxDataSize {
+			err = ErrStompFrameTooLarge
+			return
+		}
+	}
+	return
+}
+
+// stompConnHandlerTCP accepts STOMP 1.1 and 1.2 clients publishing with SEND frames, each
+// frame body is an entry tagged by its destination.  Transactions are held until COMMIT,
+// and receipts are sent once the entries have been handed to the processors.  Listeners
+// only accept events so SUBSCRIBE and the acknowledgement frames are errors.
+func stompConnHandlerTCP(c net.Conn, cfg handlerConfig) {
+	cfg.wg.Add(1)
+	id := addConn(c)
+	defer cfg.wg.Done()
+	defer delConn(id)
+	defer c.Close()
+	rip := cfg.src
+	if rip == nil {
+		if rip = addrIP(c.RemoteAddr()); rip == nil {
+			fmt.Fprintf(os.Stderr, "Failed to get remote addr from \"%s\"\n", c.RemoteAddr().String())
+			return
+		}
+	}
+	tg, err := cfg.newTimeGrinder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	sh := stompHandler{
+		cfg:    cfg,
+		c:      c,
+		sr:     stompFrameReader{rdr: bufio.NewReaderSize(c, initDataSize)},
+		src:    rip,
+		sender: addrIP(c.RemoteAddr()),
+		tag:    cfg.sourceTag(c.RemoteAddr()),
+		tg:     tg,
+		txns:   map[string][]*entry.Entry{},
+	}
+	if err = sh.run(); err != nil && err != io.EOF && !isTimeout(err) {
+		cfg.stats.parseFailure()
+		fmt.Fprintf(os.Stderr, "STOMP session with %v failed: %v\n", c.RemoteAddr(), err)
+	}
+}
+
+type stompHandler struct {
+	cfg    handlerConfig
+	c      net.Conn
+	sr     stompFrameReader
+	src    net.IP
+	sender net.IP
+	tag    entry.EntryTag
+	tg     *timegrinder.TimeGrinder
+	txns   map[string][]*entry.Entry
+	txnSz  int //bytes held by all open transactions
+}
+
+// run handles frames until the client disconnects or breaks the protocol, protocol errors
+// are reported to the client with an ERROR frame before the connection closes
+func (sh *stompHandler) run() error {
+	f, err := sh.sr.readFrame()
+	if err != nil {
+		return err
+	} else if err = sh.connect(f); err != nil {
+		return sh.fail(f, err)
+	}
+	for {
+		if f, err = sh.sr.readFrame(); err != nil {
+			if err != io.EOF && !isTimeout(err) {
+				sh.fail(f, err)
+			}
+			return err
+		}
+		var done bool
+		if done, err = sh.handleFrame(f); err != nil {
+			return sh.fail(f, err)
+		} else if done {
+			return nil
+		}
+	}
+}
+
+// connect negotiates the version and checks the Login and Passcode
+func (sh *stompHandler) connect(f stompFrame) error {
+	if f.command != `CONNECT` && f.command != `STOMP` {
+		return fmt.Errorf("expected CONNECT, got %q", f.command)
+	}
+	accepted, _ := f.header(`accept-version`)
+	for _, v := range stompVersions {
+		for _, av := range strings.Split(accepted, `,`) {
+			if strings.TrimSpace(av) == v {
+				sh.sr.version = v
+				break
+			}
+		}
+		if sh.sr.version != `` {
+			break
+		}
+	}
+	if sh.sr.version == `` {
+		return fmt.Errorf("supported protocol versions are %s", strings.Join(stompVersions, `,`))
+	}
+	if sh.cfg.login != `` {
+		login, _ := f.header(`login`)
+		passcode, _ := f.header(`passcode`)
+		if subtle.ConstantTimeCompare([]byte(login), []byte(sh.cfg.login)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(passcode), []byte(sh.cfg.passcode)) != 1 {
+			return errors.New("authentication failed")
+		}
+	}
+	//heart-beats are not sent, the Idle-Timeout closes clients that go quiet
+	return sh.write(stompFrame{
+		command: `CONNECTED`,
+		headers: [][2]string{{`version`, sh.sr.version}, {`heart-beat`, `0,0`}, {`server`, `gravwell-simplerelay`}},
+	})
+}
+
+func (sh *stompHandler) handleFrame(f stompFrame) (done bool, err error) {
+	switch f.command {
+	case `SEND`:
+		err = sh.send(f)
+	case `BEGIN`, `COMMIT`, `ABORT`:
+		err = sh.transaction(f)
+	case `DISCONNECT`:
+		done = true
+	case `SUBSCRIBE`, `UNSUBSCRIBE`, `ACK`, `NACK`:
+		err = fmt.Errorf("%s is not supported, this server only accepts events", f.command)
+	default:
+		err = fmt.Errorf("unknown command %q", f.command)
+	}
+	if err == nil {
+		err = sh.receipt(f)
+	}
+	return
+}
+
+// send turns the frame into an entry, sent now or held until its transaction commits
+func (sh *stompHandler) send(f stompFrame) error {
+	dest, ok := f.header(`destination`)
+	if !ok {
+		return errors.New("SEND frame has no destination")
+	}
+	txn, inTxn := f.header(`transaction`)
+	if _, ok = sh.txns[txn]; inTxn && !ok {
+		return fmt.Errorf("unknown transaction %q", txn)
+	}
+	if !sh.cfg.limiter.allow(sh.sender, time.Now()) {
+		return nil
+	}
+	data, ok := sh.cfg.sizer.check(f.body)
+	if !ok {
+		return nil
+	}
+	tag, ok := sh.cfg.destRoutes[dest]
+	if !ok {
+		tag = sh.tag
+	}
+	ent, err := handleLog(data, sh.src, sh.cfg.ignoreTimestamps, tag, sh.tg)
+	if err != nil || ent == nil {
+		return err
+	}
+	if inTxn {
+		//held entries are bounded like a single frame so a client cannot exhaust memory
+		if sh.txnSz+len(ent.Data) > maxDataSize {
+			return ErrStompTransactionTooLarge
+		}
+		sh.txnSz += len(ent.Data)
+		sh.txns[txn] = append(sh.txns[txn], ent)
+		return nil
+	}
+	return sh.cfg.proc.Process(ent)
+}
+
+func (sh *stompHandler) transaction(f stompFrame) error {
+	txn, ok := f.header(`transaction`)
+	if !ok {
+		return fmt.Errorf("%s frame has no transaction", f.command)
+	}
+	ents, ok := sh.txns[txn]
+	if f.command == `BEGIN` {
+		if ok {
+			return fmt.Errorf("transaction %q already started", txn)
+		} else if len(sh.txns) >= maxStompTransactions {
+			return errors.New("too many open transactions")
+		}
+		sh.txns[txn] = nil
+		return nil
+	} else if !ok {
+		return fmt.Errorf("unknown transaction %q", txn)
+	}
+	delete(sh.txns, txn)
+	for _, ent := range ents {
+		sh.txnSz -= len(ent.Data)
+	}
+	if f.command == `COMMIT` {
+		for _, ent := range ents {
+			if err := sh.cfg.proc.Process(ent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (sh *stompHandler) receipt(f stompFrame) error {
+	if id, ok := f.header(`receipt`); ok {
+		return sh.write(stompFrame{command: `RECEIPT`, headers: [][2]string{{`receipt-id`, id}}})
+	}
+	return nil
+}
+
+// fail sends an ERROR frame describing err and returns err
+func (sh *stompHandler) fail(f stompFrame, err error) error {
+	ef := stompFrame{
+		command: `ERROR`,
+		headers: [][2]string{{`message`, err.Error()}, {`content-type`, `text/plain`}},
+		body:    []byte(err.Error()),
+	}
+	if id, ok := f.header(`receipt`); ok {
+		ef.headers = append(ef.headers, [2]string{`receipt-id`, id})
+	}
+	sh.write(ef)
+	return err
+}
+
+func (sh *stompHandler) write(f stompFrame) error {
+	version := sh.sr.version
+	if f.command == `CONNECTED` {
+		version = ``
+	}
+	sh.c.SetWriteDeadline(time.Now().Add(stompWriteTimeout))
+	_, err := sh.c.Write(f.encode(version))
+	return err
+}
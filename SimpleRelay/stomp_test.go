@@ -0,0 +1,209 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+// stompClient drives a stomp handler over a pipe
+type stompClient struct {
+	t    *testing.T
+	conn net.Conn
+	sr   stompFrameReader
+	cp   *capProcessor
+	done chan struct{}
+}
+
+func newStompClient(t *testing.T, cfg handlerConfig) *stompClient {
+	srv, cli := net.Pipe()
+	sc := &stompClient{
+		t:    t,
+		conn: cli,
+		sr:   stompFrameReader{rdr: bufio.NewReader(cli), version: `1.2`},
+		cp:   &capProcessor{},
+		done: make(chan struct{}),
+	}
+	cfg.lrt = stompReader
+	cfg.wg = &sync.WaitGroup{}
+	cfg.proc = sc.cp
+	cfg.src = net.ParseIP(`10.0.0.1`)
+	cfg.ignoreTimestamps = true
+	go func() {
+		stompConnHandlerTCP(srv, cfg)
+		close(sc.done)
+	}()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	return sc
+}
+
+func (sc *stompClient) send(raw string) {
+	if _, err := sc.conn.Write([]byte(raw)); err != nil {
+		sc.t.Fatal(err)
+	}
+}
+
+func (sc *stompClient) expect(command string) stompFrame {
+	f, err := sc.sr.readFrame()
+	if err != nil {
+		sc.t.Fatal(err)
+	} else if f.command != command {
+		sc.t.Fatalf("expected %s, got %s %v %q", command, f.command, f.headers, f.body)
+	}
+	return f
+}
+
+func (sc *stompClient) close() {
+	sc.conn.Close()
+	<-sc.done
+}
+
+func TestStompSession(t *testing.T) {
+	sc := newStompClient(t, handlerConfig{
+		tag:        1,
+		destRoutes: map[string]entry.EntryTag{`/queue/fw`: 2},
+		login:      `user`,
+		passcode:   `pass`,
+	})
+	sc.send("CONNECT\naccept-version:1.0,1.1,1.2\nhost:gravwell\nlogin:user\npasscode:pass\n\n\x00")
+	if v, _ := sc.expect(`CONNECTED`).header(`version`); v != `1.2` {
+		t.Fatalf("bad version %q", v)
+	}
+	//heart-beats between frames are ignored, bodies may contain newlines without a content-length
+	sc.send("\n\r\nSEND\ndestination:/queue/app\nreceipt:r1\n\nline one\nline two\x00\n")
+	if id, _ := sc.expect(`RECEIPT`).header(`receipt-id`); id != `r1` {
+		t.Fatalf("bad receipt %q", id)
+	}
+	sc.send("SEND\ndestination:/queue/fw\ncontent-length:5\n\nnul\x00b\x00")
+	sc.send("BEGIN\ntransaction:t1\n\n\x00SEND\ndestination:/queue/app\ntransaction:t1\n\ntxn\x00")
+	sc.send("BEGIN\ntransaction:t2\n\n\x00SEND\ndestination:/queue/app\ntransaction:t2\n\naborted\x00ABORT\ntransaction:t2\n\n\x00")
+	sc.send("COMMIT\ntransaction:t1\nreceipt:r2\n\n\x00")
+	sc.expect(`RECEIPT`)
+	expect := []struct {
+		tag  entry.EntryTag
+		data string
+	}{
+		{1, "line one\nline two"},
+		{2, "nul\x00b"},
+		{1, `txn`},
+	}
+	if len(sc.cp.ents) != len(expect) {
+		t.Fatalf("got %d entries", len(sc.cp.ents))
+	}
+	for i, e := range expect {
+		if ent := sc.cp.ents[i]; ent.Tag != e.tag || string(ent.Data) != e.data {
+			t.Fatalf("bad entry %d: %d %q", i, ent.Tag, ent.Data)
+		}
+	}
+
+	//subscribing is an error that ends the session
+	sc.send("SUBSCRIBE\nid:0\ndestination:/queue/app\n\n\x00")
+	if msg, _ := sc.expect(`ERROR`).header(`message`); !strings.Contains(msg, `SUBSCRIBE`) {
+		t.Fatalf("bad error %q", msg)
+	}
+	sc.close()
+}
+
+func TestStompTransactionLimit(t *testing.T) {
+	sc := newStompClient(t, handlerConfig{tag: 1})
+	sc.send("CONNECT\naccept-version:1.2\n\n\x00")
+	sc.expect(`CONNECTED`)
+	half := strings.Repeat(`x`, maxDataSize/2)
+	sc.send("BEGIN\ntransaction:t1\n\n\x00BEGIN\ntransaction:t2\n\n\x00")
+	//committed and aborted transactions no longer count against the limit
+	for _, end := range []string{`COMMIT`, `ABORT`} {
+		sc.send("BEGIN\ntransaction:t3\n\n\x00SEND\ndestination:/queue/app\ntransaction:t3\n\n" + half + "\x00")
+		sc.send("SEND\ndestination:/queue/app\ntransaction:t3\n\n" + half + "\x00")
+		sc.send(end + "\ntransaction:t3\nreceipt:r1\n\n\x00")
+		sc.expect(`RECEIPT`)
+	}
+	if len(sc.cp.ents) != 2 {
+		t.Fatalf("got %d entries", len(sc.cp.ents))
+	}
+	//the limit covers every open transaction together
+	sc.send("SEND\ndestination:/queue/app\ntransaction:t1\n\n" + half + "\x00")
+	sc.send("SEND\ndestination:/queue/app\ntransaction:t2\n\n" + half + "x\x00")
+	if msg, _ := sc.expect(`ERROR`).header(`message`); msg != ErrStompTransactionTooLarge.Error() {
+		t.Fatalf("bad error %q", msg)
+	}
+	sc.close()
+	if len(sc.cp.ents) != 2 {
+		t.Fatalf("got %d entries after the limit", len(sc.cp.ents))
+	}
+}
+
+func TestStompConnectFailures(t *testing.T) {
+	for _, connect := range []string{
+		"CONNECT\naccept-version:1.2\nlogin:user\npasscode:wrong\n\n\x00",
+		"CONNECT\naccept-version:1.0\nlogin:user\npasscode:pass\n\n\x00",
+		"SEND\ndestination:/queue/app\n\nhello\x00",
+	} {
+		sc := newStompClient(t, handlerConfig{login: `user`, passcode: `pass`})
+		sc.send(connect)
+		sc.expect(`ERROR`)
+		sc.close()
+		if len(sc.cp.ents) != 0 {
+			t.Fatalf("accepted entries after %q", connect)
+		}
+	}
+}
+
+func TestStompEscapes(t *testing.T) {
+	orig := "a:b\\c\nd\re"
+	for _, v := range []string{`1.1`, `1.2`} {
+		s := orig
+		if v == `1.1` {
+			s = strings.Replace(orig, "\r", ``, -1)
+		}
+		if r, err := stompUnescape(stompEscape(s, v), v); err != nil || r != s {
+			t.Fatalf("bad %s round trip %q %v", v, r, err)
+		}
+	}
+	if _, err := stompUnescape(`bad\t`, `1.2`); err == nil {
+		t.Fatal("accepted an undefined escape")
+	} else if _, err = stompUnescape(`a\r`, `1.1`); err == nil {
+		t.Fatal("accepted a carriage return escape in 1.1")
+	}
+}
+
+func TestStompReaderConfig(t *testing.T) {
+	l := listener{
+		base:            base{Bind_String: `tcp://0.0.0.0:61613`},
+		Reader_Type:     `stomp`,
+		Destination_Tag: []string{`/queue/firewall:firewall`, `jms.topic.audit:audit`},
+		Login:           `user`,
+		Passcode:        `pass`,
+	}
+	if err := l.validateStompReader(); err != nil {
+		t.Fatal(err)
+	}
+	if dts, err := l.destinationTags(); err != nil {
+		t.Fatal(err)
+	} else if len(dts) != 2 || dts[0].dest != `/queue/firewall` || dts[1].tag != `audit` {
+		t.Fatalf("bad destination tags %+v", dts)
+	}
+	for _, v := range []listener{
+		{base: base{Bind_String: `udp://0.0.0.0:61613`}, Reader_Type: `stomp`},
+		{base: base{Bind_String: `tcp://0.0.0.0:61613`}, Reader_Type: `stomp`, Framing: `newline`},
+		{base: base{Bind_String: `tcp://0.0.0.0:61613`}, Reader_Type: `stomp`, Passcode: `pass`},
+		{base: base{Bind_String: `tcp://0.0.0.0:61613`}, Reader_Type: `stomp`, Destination_Tag: []string{`/queue/fw`}},
+		{base: base{Bind_String: `tcp://0.0.0.0:61613`}, Reader_Type: `stomp`, Destination_Tag: []string{`/queue/fw:bad tag`}},
+		{base: base{Bind_String: `tcp://0.0.0.0:61613`}, Reader_Type: `line`, Login: `user`},
+	} {
+		if err := v.validateStompReader(); err == nil {
+			t.Fatalf("accepted invalid stomp reader %+v", v)
+		}
+	}
+}
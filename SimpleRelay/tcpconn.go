@@ -0,0 +1,176 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConnLimitsWithoutTCP = errors.New("Keepalive-Interval, Disable-Keepalive, Idle-Timeout, and Max-Connections require a tcp:// or tls:// Bind-String")
+	ErrKeepaliveConflict    = errors.New("Cannot specify Keepalive-Interval and Disable-Keepalive")
+	ErrInvalidMaxConns      = errors.New("Max-Connections cannot be negative")
+)
+
+// connLimits controls the lifetime of the connections accepted by a TCP or TLS listener
+type connLimits struct {
+	keepalive        time.Duration //zero leaves the system default
+	disableKeepalive bool
+	idleTimeout      time.Duration
+	maxConns         int
+}
+
+func (b base) connLimits() (cl connLimits, err error) {
+	if b.Keepalive_Interval != `` {
+		if cl.keepalive, err = time.ParseDuration(b.Keepalive_Interval); err == nil && cl.keepalive <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			err = fmt.Errorf("Invalid Keepalive-Interval %q: %v", b.Keepalive_Interval, err)
+			return
+		} else if b.Disable_Keepalive {
+			err = ErrKeepaliveConflict
+			return
+		}
+	}
+	if b.Idle_Timeout != `` {
+		if cl.idleTimeout, err = time.ParseDuration(b.Idle_Timeout); err == nil && cl.idleTimeout <= 0 {
+			err = errors.New("must be positive")
+		}
+		if err != nil {
+			err = fmt.Errorf("Invalid Idle-Timeout %q: %v", b.Idle_Timeout, err)
+			return
+		}
+	}
+	if b.Max_Connections < 0 {
+		err = ErrInvalidMaxConns
+		return
+	}
+	cl.disableKeepalive = b.Disable_Keepalive
+	cl.maxConns = b.Max_Connections
+	return
+}
+
+// validateConnLimits checks the connection controls against the bind type
+func (b base) validateConnLimits() error {
+	cl, err := b.connLimits()
+	if err != nil || cl == (connLimits{}) {
+		return err
+	}
+	if tp, _, err := translateBindType(b.Bind_String); err != nil {
+		return err
+	} else if !tp.TCP() && !tp.TLS() {
+		return ErrConnLimitsWithoutTCP
+	}
+	return nil
+}
+
+// wrapListener applies the connection limits and PROXY protocol handling to a TCP
+// listener, TLS listeners must wrap the result
+func (b base) wrapListener(l net.Listener) (net.Listener, error) {
+	cl, err := b.connLimits()
+	if err != nil {
+		return nil, err
+	}
+	sources, err := b.proxySources()
+	if err != nil {
+		return nil, err
+	}
+	//the limits sit beneath the PROXY handling so they never wait on a header in the accept loop
+	return newProxyListener(newLimitListener(l, cl), sources), nil
+}
+
+// limitListener applies connLimits to each accepted connection, connections over
+// Max-Connections are closed as soon as they are accepted
+type limitListener struct {
+	net.Listener
+	connLimits
+	active chan struct{}
+}
+
+// newLimitListener wraps a TCP listener, TLS listeners must wrap the result so that the
+// limits apply to the underlying TCP connections
+func newLimitListener(l net.Listener, cl connLimits) net.Listener {
+	if cl == (connLimits{}) {
+		return l
+	}
+	ll := &limitListener{
+		Listener:   l,
+		connLimits: cl,
+	}
+	if cl.maxConns > 0 {
+		ll.active = make(chan struct{}, cl.maxConns)
+	}
+	return ll
+}
+
+func (ll *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := ll.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if ll.active != nil {
+			select {
+			case ll.active <- struct{}{}:
+			default:
+				debugout("Rejected connection from %v, Max-Connections of %d reached\n", c.RemoteAddr(), ll.maxConns)
+				c.Close()
+				continue
+			}
+		}
+		if tc, ok := c.(*net.TCPConn); ok {
+			if ll.disableKeepalive {
+				tc.SetKeepAlive(false)
+			} else if ll.keepalive > 0 {
+				tc.SetKeepAlive(true)
+				tc.SetKeepAlivePeriod(ll.keepalive)
+			}
+		}
+		return &limitConn{Conn: c, idleTimeout: ll.idleTimeout, active: ll.active}, nil
+	}
+}
+
+// limitConn pushes the read deadline out on every read so idle senders are dropped and
+// releases its Max-Connections slot when closed
+type limitConn struct {
+	net.Conn
+	idleTimeout time.Duration
+	active      chan struct{}
+	once        sync.Once
+}
+
+func (lc *limitConn) Read(b []byte) (int, error) {
+	if lc.idleTimeout > 0 {
+		if err := lc.Conn.SetReadDeadline(time.Now().Add(lc.idleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return lc.Conn.Read(b)
+}
+
+func (lc *limitConn) Close() error {
+	lc.once.Do(func() {
+		if lc.active != nil {
+			<-lc.active
+		}
+	})
+	return lc.Conn.Close()
+}
+
+// isTimeout returns true if the error is a read deadline expiring, which is how idle
+// connections are closed and should not be reported as a failure
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
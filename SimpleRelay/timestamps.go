@@ -0,0 +1,81 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gravwell/timegrinder/v3"
+)
+
+var (
+	ErrTimezoneConflict = errors.New("Cannot specify Assume-Local-Timezone and Timezone-Override in the same listener")
+)
+
+// timeConfig is the timestamp handling for a single listener, every connection or UDP
+// reader gets its own timegrinder built from it so that listeners never share settings
+type timeConfig struct {
+	ignoreTimestamps bool
+	setLocalTime     bool
+	timezoneOverride string
+	formatOverride   string
+}
+
+func (b base) timeConfig() timeConfig {
+	return timeConfig{
+		ignoreTimestamps: b.Ignore_Timestamps,
+		setLocalTime:     b.Assume_Local_Timezone,
+		timezoneOverride: b.Timezone_Override,
+		formatOverride:   b.Timestamp_Format_Override,
+	}
+}
+
+// validateTimestamps checks the timezone and format overrides so that a bad value stops
+// the relay at startup instead of failing every connection
+func (b base) validateTimestamps() error {
+	if b.Timezone_Override != `` {
+		if b.Assume_Local_Timezone {
+			return ErrTimezoneConflict
+		}
+		if _, err := time.LoadLocation(b.Timezone_Override); err != nil {
+			return fmt.Errorf("Invalid Timezone-Override %q: %v", b.Timezone_Override, err)
+		}
+	}
+	if b.Timestamp_Format_Override != `` {
+		if err := timegrinder.ValidateFormatOverride(b.Timestamp_Format_Override); err != nil {
+			return fmt.Errorf("Invalid Timestamp-Format-Override %q: %v", b.Timestamp_Format_Override, err)
+		}
+	}
+	return nil
+}
+
+// newTimeGrinder returns nil when the listener ignores timestamps
+func (tc timeConfig) newTimeGrinder() (tg *timegrinder.TimeGrinder, err error) {
+	if tc.ignoreTimestamps {
+		return
+	}
+	tcfg := timegrinder.Config{
+		EnableLeftMostSeed: true,
+		FormatOverride:     tc.formatOverride,
+	}
+	if tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+		return nil, fmt.Errorf("Failed to get a handle on the timegrinder: %v", err)
+	}
+	if tc.setLocalTime {
+		tg.SetLocalTime()
+	}
+	if tc.timezoneOverride != `` {
+		if err = tg.SetTimezone(tc.timezoneOverride); err != nil {
+			return nil, fmt.Errorf("Failed to set timezone to %v: %v", tc.timezoneOverride, err)
+		}
+	}
+	return
+}
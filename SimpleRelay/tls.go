@@ -0,0 +1,138 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrClientCertWithoutCA  = errors.New("Require-Client-Cert requires a Client-CA-File")
+	ErrClientCAWithoutTLS   = errors.New("Client-CA-File and Require-Client-Cert require a tls:// Bind-String")
+	ErrNoClientCACerts      = errors.New("No PEM certificates found in Client-CA-File")
+	ErrMissingCertOrKeyFile = errors.New("TLS listeners require a Cert-File and Key-File")
+
+	certReloaders   []*certReloader
+	certReloaderMtx sync.Mutex
+)
+
+// certReloader hands out the current certificate for a TLS listener.  The listener keeps
+// a single tls.Config for its lifetime, so swapping the certificate does not disturb
+// established connections or invalidate session tickets issued before the reload.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value //*tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (cr *certReloader, err error) {
+	cr = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err = cr.reload(); err != nil {
+		cr = nil
+	}
+	return
+}
+
+// reload loads the certificate and key from disk, the current certificate stays in use if they cannot be loaded
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Certificate load fail: %v", err)
+	}
+	cr.cert.Store(&cert)
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load().(*tls.Certificate), nil
+}
+
+// reloadCertificates reloads the certificates of every TLS listener, typically on SIGHUP
+func reloadCertificates() {
+	certReloaderMtx.Lock()
+	defer certReloaderMtx.Unlock()
+	for _, cr := range certReloaders {
+		if err := cr.reload(); err != nil {
+			lg.Error("Failed to reload %s, continuing with the previous certificate: %v\n", cr.certFile, err)
+		} else {
+			lg.Info("Reloaded certificate %s\n", cr.certFile)
+		}
+	}
+}
+
+// validateTLS checks the client certificate options against the bind type
+func (b base) validateTLS() error {
+	if b.Require_Client_Cert && b.Client_CA_File == `` {
+		return ErrClientCertWithoutCA
+	}
+	if b.Client_CA_File == `` {
+		return nil
+	}
+	if tp, _, err := translateBindType(b.Bind_String); err != nil {
+		return err
+	} else if !tp.TLS() {
+		return ErrClientCAWithoutTLS
+	}
+	return nil
+}
+
+// tlsConfig builds the server configuration for a TLS listener.  When a Client-CA-File is
+// given, client certificates are verified against it and Require-Client-Cert refuses
+// clients that do not present one.  Session tickets are left enabled so that senders
+// which reconnect often can resume instead of performing a full handshake, and the
+// certificate is registered for reloading by reloadCertificates.
+func (b base) tlsConfig(certFile, keyFile string) (config *tls.Config, err error) {
+	if certFile == `` || keyFile == `` {
+		return nil, ErrMissingCertOrKeyFile
+	}
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.getCertificate,
+	}
+	if b.Client_CA_File != `` {
+		if err = b.clientCAs(config); err != nil {
+			return nil, err
+		}
+	}
+	certReloaderMtx.Lock()
+	certReloaders = append(certReloaders, cr)
+	certReloaderMtx.Unlock()
+	return
+}
+
+// clientCAs loads the Client-CA-File into the config, it is not reloaded
+func (b base) clientCAs(config *tls.Config) (err error) {
+	var bb []byte
+	if bb, err = ioutil.ReadFile(b.Client_CA_File); err != nil {
+		return fmt.Errorf("Failed to read Client-CA-File: %v", err)
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(bb) {
+		return ErrNoClientCACerts
+	}
+	if b.Require_Client_Cert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return
+}
@@ -0,0 +1,107 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, cn, certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: `EC PRIVATE KEY`, Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	certFile, keyFile := filepath.Join(tmpDir, `reload.pem`), filepath.Join(tmpDir, `reload.key`)
+	writeTestCert(t, `one`, certFile, keyFile)
+	b := base{Bind_String: `tls://127.0.0.1:0`}
+	config, err := b.tlsConfig(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen(`tcp`, `127.0.0.1:0`, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(`ok`))
+			c.Close()
+		}
+	}()
+	cache := tls.NewLRUClientSessionCache(4)
+	dial := func(cache tls.ClientSessionCache) tls.ConnectionState {
+		c, err := tls.Dial(`tcp`, l.Addr().String(), &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		ioutil.ReadAll(c) //picks up the session ticket
+		return c.ConnectionState()
+	}
+	if cs := dial(cache); cs.PeerCertificates[0].Subject.CommonName != `one` {
+		t.Fatal("bad certificate", cs.PeerCertificates[0].Subject)
+	}
+
+	writeTestCert(t, `two`, certFile, keyFile)
+	reloadCertificates()
+	if cs := dial(cache); !cs.DidResume {
+		t.Fatal("session was not resumed across a certificate reload")
+	}
+	if cs := dial(nil); cs.PeerCertificates[0].Subject.CommonName != `two` {
+		t.Fatal("certificate was not reloaded", cs.PeerCertificates[0].Subject)
+	}
+
+	//a bad certificate leaves the current one in place
+	if err = ioutil.WriteFile(certFile, []byte(`garbage`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reloadCertificates()
+	if cs := dial(nil); cs.PeerCertificates[0].Subject.CommonName != `two` {
+		t.Fatal("lost certificate after a failed reload", cs.PeerCertificates[0].Subject)
+	}
+}
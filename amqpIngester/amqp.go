@@ -0,0 +1,429 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// AMQP 0-9-1 frame types, classes, and the methods the consumer uses
+const (
+	frameMethod    byte = 1
+	frameHeader    byte = 2
+	frameBody      byte = 3
+	frameHeartbeat byte = 8
+	frameEnd       byte = 0xce
+
+	classConnection uint16 = 10
+	classChannel    uint16 = 20
+	classBasic      uint16 = 60
+
+	methodStart     uint16 = 10
+	methodStartOk   uint16 = 11
+	methodTune      uint16 = 30
+	methodTuneOk    uint16 = 31
+	methodOpen      uint16 = 40
+	methodOpenOk    uint16 = 41
+	methodClose     uint16 = 50
+	methodCloseOk   uint16 = 51
+	methodChOpen    uint16 = 10
+	methodChOpenOk  uint16 = 11
+	methodChClose   uint16 = 40
+	methodChCloseOk uint16 = 41
+	methodQos       uint16 = 10
+	methodQosOk     uint16 = 11
+	methodConsume   uint16 = 20
+	methodConsumeOk uint16 = 21
+	methodCancel    uint16 = 30
+	methodDeliver   uint16 = 60
+	methodAck       uint16 = 80
+
+	clientFrameMax uint32 = 128 * 1024
+	minFrameMax    uint32 = 4096
+	replySuccess   uint16 = 200
+)
+
+var (
+	protocolHeader = []byte{'A', 'M', 'Q', 'P', 0, 0, 9, 1}
+
+	ErrMalformedFrame = errors.New("malformed AMQP frame")
+	ErrFrameTooLarge  = errors.New("AMQP frame is larger than the negotiated frame size")
+)
+
+type frame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+func readFrame(rdr *bufio.Reader, max uint32) (f frame, err error) {
+	var hdr [7]byte
+	if _, err = io.ReadFull(rdr, hdr[:]); err != nil {
+		return
+	}
+	f.typ = hdr[0]
+	f.channel = binary.BigEndian.Uint16(hdr[1:])
+	sz := binary.BigEndian.Uint32(hdr[3:])
+	if sz > max {
+		err = ErrFrameTooLarge
+		return
+	}
+	buff := make([]byte, sz+1)
+	if _, err = io.ReadFull(rdr, buff); err != nil {
+		return
+	} else if buff[sz] != frameEnd {
+		err = ErrMalformedFrame
+		return
+	}
+	f.payload = buff[:sz]
+	return
+}
+
+func (f frame) encode() []byte {
+	b := make([]byte, 7, 8+len(f.payload))
+	b[0] = f.typ
+	binary.BigEndian.PutUint16(b[1:], f.channel)
+	binary.BigEndian.PutUint32(b[3:], uint32(len(f.payload)))
+	b = append(b, f.payload...)
+	return append(b, frameEnd)
+}
+
+// method is a decoded method frame, args holds the arguments that follow the class and method IDs
+type method struct {
+	channel uint16
+	class   uint16
+	id      uint16
+	args    decoder
+}
+
+func (m method) is(class, id uint16) bool {
+	return m.class == class && m.id == id
+}
+
+func (m method) String() string {
+	return fmt.Sprintf("method %d.%d", m.class, m.id)
+}
+
+func parseMethod(f frame) (m method, err error) {
+	d := decoder{b: f.payload}
+	m.channel = f.channel
+	m.class = d.uint16()
+	m.id = d.uint16()
+	m.args = d
+	err = d.err
+	return
+}
+
+func methodFrame(channel, class, id uint16, args *encoder) frame {
+	e := &encoder{}
+	e.uint16(class)
+	e.uint16(id)
+	if args != nil {
+		e.b = append(e.b, args.b...)
+	}
+	return frame{typ: frameMethod, channel: channel, payload: e.b}
+}
+
+// closeReason reads the reply code and text of Connection.Close and Channel.Close
+func closeReason(m method) error {
+	what := `channel`
+	if m.class == classConnection {
+		what = `connection`
+	}
+	code := m.args.uint16()
+	text := m.args.shortstr()
+	return fmt.Errorf("broker closed the %s: %d %s", what, code, text)
+}
+
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) uint8(v byte) {
+	e.b = append(e.b, v)
+}
+
+func (e *encoder) uint16(v uint16) {
+	e.b = append(e.b, byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.b = append(e.b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) uint64(v uint64) {
+	e.uint32(uint32(v >> 32))
+	e.uint32(uint32(v))
+}
+
+func (e *encoder) shortstr(s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	e.uint8(byte(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *encoder) longstr(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// table encodes a field table, only the string, bool, and nested table values the client
+// sends are supported
+func (e *encoder) table(fields []field) {
+	te := &encoder{}
+	for _, f := range fields {
+		te.shortstr(f.name)
+		switch v := f.value.(type) {
+		case string:
+			te.uint8('S')
+			te.longstr(v)
+		case bool:
+			te.uint8('t')
+			if v {
+				te.uint8(1)
+			} else {
+				te.uint8(0)
+			}
+		case []field:
+			te.uint8('F')
+			te.table(v)
+		}
+	}
+	e.uint32(uint32(len(te.b)))
+	e.b = append(e.b, te.b...)
+}
+
+type field struct {
+	name  string
+	value interface{}
+}
+
+// decoder walks the payload of a frame, the first error sticks
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) bytes(n int) (v []byte) {
+	if d.err == nil && (n < 0 || len(d.b) < n) {
+		d.err = ErrMalformedFrame
+	}
+	if d.err != nil {
+		return
+	}
+	v, d.b = d.b[:n], d.b[n:]
+	return
+}
+
+func (d *decoder) uint8() byte {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) shortstr() string {
+	return string(d.bytes(int(d.uint8())))
+}
+
+func (d *decoder) longstr() string {
+	return string(d.bytes(int(d.uint32())))
+}
+
+// skipTable skips a field table, tables are length prefixed so the fields are not parsed
+func (d *decoder) skipTable() {
+	d.bytes(int(d.uint32()))
+}
+
+func startOkArgs(user, pass string) *encoder {
+	e := &encoder{}
+	e.table([]field{
+		{name: `product`, value: `gravwell`},
+		{name: `capabilities`, value: []field{
+			{name: `consumer_cancel_notify`, value: true},
+		}},
+	})
+	e.shortstr(`PLAIN`)
+	e.longstr("\x00" + user + "\x00" + pass)
+	e.shortstr(`en_US`)
+	return e
+}
+
+type tuning struct {
+	channelMax uint16
+	frameMax   uint32
+	heartbeat  uint16 //seconds
+}
+
+// negotiate picks the lower of the broker and client limits, a frame size of zero means no
+// limit and a heartbeat of zero disables heartbeats
+func negotiate(m method, heartbeat time.Duration) (t tuning, err error) {
+	t.channelMax = m.args.uint16()
+	t.frameMax = m.args.uint32()
+	hb := m.args.uint16()
+	if err = m.args.err; err != nil {
+		return
+	}
+	if t.frameMax == 0 || t.frameMax > clientFrameMax {
+		t.frameMax = clientFrameMax
+	} else if t.frameMax < minFrameMax {
+		t.frameMax = minFrameMax
+	}
+	if t.heartbeat = uint16(heartbeat / time.Second); hb != 0 && hb < t.heartbeat {
+		t.heartbeat = hb
+	}
+	return
+}
+
+func tuneOkArgs(t tuning) *encoder {
+	e := &encoder{}
+	e.uint16(t.channelMax)
+	e.uint32(t.frameMax)
+	e.uint16(t.heartbeat)
+	return e
+}
+
+func openArgs(vhost string) *encoder {
+	e := &encoder{}
+	e.shortstr(vhost)
+	e.shortstr(``) //reserved
+	e.uint8(0)     //reserved
+	return e
+}
+
+func openChannelArgs() *encoder {
+	e := &encoder{}
+	e.shortstr(``) //reserved
+	return e
+}
+
+func closeArgs() *encoder {
+	e := &encoder{}
+	e.uint16(replySuccess)
+	e.shortstr(`closing`)
+	e.uint16(0)
+	e.uint16(0)
+	return e
+}
+
+func qosArgs(prefetch uint16) *encoder {
+	e := &encoder{}
+	e.uint32(0) //no prefetch size limit
+	e.uint16(prefetch)
+	e.uint8(0) //per consumer
+	return e
+}
+
+func consumeArgs(queue, consumerTag string) *encoder {
+	e := &encoder{}
+	e.uint16(0) //reserved
+	e.shortstr(queue)
+	e.shortstr(consumerTag)
+	e.uint8(0) //local, manual acks, not exclusive, wait for Consume-Ok
+	e.table(nil)
+	return e
+}
+
+func ackArgs(tag uint64, multiple bool) *encoder {
+	e := &encoder{}
+	e.uint64(tag)
+	if multiple {
+		e.uint8(1)
+	} else {
+		e.uint8(0)
+	}
+	return e
+}
+
+// delivery is a message pushed to a consumer
+type delivery struct {
+	consumerTag string
+	tag         uint64
+	redelivered bool
+	exchange    string
+	routingKey  string
+	timestamp   time.Time //zero when the publisher did not set one
+	body        []byte
+}
+
+func parseDeliver(m method) (d delivery, err error) {
+	d.consumerTag = m.args.shortstr()
+	d.tag = m.args.uint64()
+	d.redelivered = m.args.uint8()&0x1 != 0
+	d.exchange = m.args.shortstr()
+	d.routingKey = m.args.shortstr()
+	err = m.args.err
+	return
+}
+
+// parseContentHeader returns the body size and timestamp of a message, the properties before
+// the timestamp are decoded to find it
+func parseContentHeader(f frame) (size uint64, ts time.Time, err error) {
+	d := decoder{b: f.payload}
+	d.uint16() //class
+	d.uint16() //weight
+	size = d.uint64()
+	flags := d.uint16()
+	if flags&0x8000 != 0 { //content-type
+		d.shortstr()
+	}
+	if flags&0x4000 != 0 { //content-encoding
+		d.shortstr()
+	}
+	if flags&0x2000 != 0 { //headers
+		d.skipTable()
+	}
+	if flags&0x1000 != 0 { //delivery-mode
+		d.uint8()
+	}
+	if flags&0x0800 != 0 { //priority
+		d.uint8()
+	}
+	//correlation-id, reply-to, expiration, and message-id
+	for _, bit := range []uint16{0x0400, 0x0200, 0x0100, 0x0080} {
+		if flags&bit != 0 {
+			d.shortstr()
+		}
+	}
+	if flags&0x0040 != 0 {
+		if sec := d.uint64(); sec != 0 {
+			ts = time.Unix(int64(sec), 0)
+		}
+	}
+	err = d.err
+	return
+}
@@ -0,0 +1,300 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestContentHeader(t *testing.T) {
+	ts := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	f := contentHeader(11, ts, true)
+	size, rts, err := parseContentHeader(f)
+	if err != nil {
+		t.Fatal(err)
+	} else if size != 11 || !rts.Equal(ts) {
+		t.Fatalf("bad content header %d %v", size, rts)
+	}
+	if _, rts, err = parseContentHeader(contentHeader(0, time.Time{}, false)); err != nil {
+		t.Fatal(err)
+	} else if !rts.IsZero() {
+		t.Fatalf("unexpected timestamp %v", rts)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tune := func(frameMax uint32, hb uint16) method {
+		e := &encoder{}
+		e.uint16(2047)
+		e.uint32(frameMax)
+		e.uint16(hb)
+		m, _ := parseMethod(methodFrame(0, classConnection, methodTune, e))
+		return m
+	}
+	if tn, err := negotiate(tune(0, 60), 30*time.Second); err != nil {
+		t.Fatal(err)
+	} else if tn.frameMax != clientFrameMax || tn.heartbeat != 30 || tn.channelMax != 2047 {
+		t.Fatalf("bad tuning %+v", tn)
+	}
+	if tn, err := negotiate(tune(8192, 10), 30*time.Second); err != nil {
+		t.Fatal(err)
+	} else if tn.frameMax != 8192 || tn.heartbeat != 10 {
+		t.Fatalf("bad tuning %+v", tn)
+	}
+	if tn, err := negotiate(tune(8192, 10), 0); err != nil {
+		t.Fatal(err)
+	} else if tn.heartbeat != 0 {
+		t.Fatalf("heartbeats not disabled %+v", tn)
+	}
+}
+
+// contentHeader builds a header frame with delivery-mode, message-id, and optionally timestamp properties
+func contentHeader(size uint64, ts time.Time, withTS bool) frame {
+	e := &encoder{}
+	e.uint16(classBasic)
+	e.uint16(0)
+	e.uint64(size)
+	flags := uint16(0x1000 | 0x2000 | 0x0080)
+	if withTS {
+		flags |= 0x0040
+	}
+	e.uint16(flags)
+	e.table([]field{{name: `h`, value: `v`}})
+	e.uint8(2)
+	e.shortstr(`id`)
+	if withTS {
+		e.uint64(uint64(ts.Unix()))
+	}
+	return frame{typ: frameHeader, channel: consumerChannel, payload: e.b}
+}
+
+// fakeBroker accepts a single connection and drives it frame by frame
+type fakeBroker struct {
+	t    *testing.T
+	lst  net.Listener
+	conn net.Conn
+	rdr  *bufio.Reader
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	lst, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeBroker{t: t, lst: lst}
+}
+
+func (fb *fakeBroker) close() {
+	if fb.conn != nil {
+		fb.conn.Close()
+	}
+	fb.lst.Close()
+}
+
+func (fb *fakeBroker) send(f frame) {
+	if _, err := fb.conn.Write(f.encode()); err != nil {
+		fb.t.Fatal(err)
+	}
+}
+
+func (fb *fakeBroker) sendMethod(channel, class, id uint16, args *encoder) {
+	fb.send(methodFrame(channel, class, id, args))
+}
+
+func (fb *fakeBroker) expect(class, id uint16) method {
+	m, err := expect(fb.rdr, class, id)
+	if err != nil {
+		fb.t.Fatal(err)
+	}
+	return m
+}
+
+// handshake accepts the client and walks it through the connection and channel setup
+func (fb *fakeBroker) handshake() {
+	var err error
+	if fb.conn, err = fb.lst.Accept(); err != nil {
+		fb.t.Fatal(err)
+	}
+	fb.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fb.rdr = bufio.NewReader(fb.conn)
+	hdr := make([]byte, len(protocolHeader))
+	if _, err = io.ReadFull(fb.rdr, hdr); err != nil {
+		fb.t.Fatal(err)
+	} else if !bytes.Equal(hdr, protocolHeader) {
+		fb.t.Fatalf("bad protocol header %v", hdr)
+	}
+
+	start := &encoder{}
+	start.uint8(0)
+	start.uint8(9)
+	start.table([]field{{name: `product`, value: `RabbitMQ`}})
+	start.longstr(`AMQPLAIN PLAIN`)
+	start.longstr(`en_US`)
+	fb.sendMethod(0, classConnection, methodStart, start)
+	m := fb.expect(classConnection, methodStartOk)
+	m.args.skipTable()
+	if mech := m.args.shortstr(); mech != `PLAIN` {
+		fb.t.Fatalf("bad mechanism %q", mech)
+	} else if resp := m.args.longstr(); resp != "\x00user\x00pass" {
+		fb.t.Fatalf("bad PLAIN response %q", resp)
+	}
+
+	tune := &encoder{}
+	tune.uint16(2047)
+	tune.uint32(131072)
+	tune.uint16(60)
+	fb.sendMethod(0, classConnection, methodTune, tune)
+	fb.expect(classConnection, methodTuneOk)
+	if m = fb.expect(classConnection, methodOpen); m.args.shortstr() != `/logs` {
+		fb.t.Fatal("bad vhost")
+	}
+	fb.sendMethod(0, classConnection, methodOpenOk, openChannelArgs())
+	fb.expect(classChannel, methodChOpen)
+	fb.sendMethod(consumerChannel, classChannel, methodChOpenOk, &encoder{b: []byte{0, 0, 0, 0}})
+	m = fb.expect(classBasic, methodQos)
+	if m.args.uint32(); m.args.uint16() != 4 {
+		fb.t.Fatal("bad prefetch count")
+	}
+	fb.sendMethod(consumerChannel, classBasic, methodQosOk, nil)
+}
+
+// deliver sends a message split over two body frames
+func (fb *fakeBroker) deliver(ctag string, tag uint64, body string) {
+	e := &encoder{}
+	e.shortstr(ctag)
+	e.uint64(tag)
+	e.uint8(0)
+	e.shortstr(`logs`)
+	e.shortstr(`app.info`)
+	fb.sendMethod(consumerChannel, classBasic, methodDeliver, e)
+	fb.send(contentHeader(uint64(len(body)), time.Unix(1500000000, 0), true))
+	half := len(body) / 2
+	fb.send(frame{typ: frameBody, channel: consumerChannel, payload: []byte(body[:half])})
+	fb.send(frame{typ: frameBody, channel: consumerChannel, payload: []byte(body[half:])})
+}
+
+func TestConsumerSession(t *testing.T) {
+	fb := newFakeBroker(t)
+	defer fb.close()
+	cfg := &consumerCfg{
+		addr:      fb.lst.Addr().String(),
+		vhost:     `/logs`,
+		username:  `user`,
+		password:  `pass`,
+		queues:    []string{`app`, `audit`},
+		prefetch:  4,
+		heartbeat: time.Minute,
+	}
+	type msg struct {
+		queue string
+		d     delivery
+	}
+	got := make(chan msg, 8)
+	var syncs int32
+	c := newAMQPConsumer(`test`, cfg, func(q string, d delivery) error {
+		got <- msg{queue: q, d: d}
+		return nil
+	}, func(time.Duration) error {
+		atomic.AddInt32(&syncs, 1)
+		return nil
+	})
+	c.Start()
+	defer c.Close()
+
+	fb.handshake()
+	ctags := map[string]string{}
+	for i := 0; i < 2; i++ {
+		m := fb.expect(classBasic, methodConsume)
+		m.args.uint16()
+		q := m.args.shortstr()
+		ctags[q] = m.args.shortstr()
+		ok := &encoder{}
+		ok.shortstr(ctags[q])
+		fb.sendMethod(consumerChannel, classBasic, methodConsumeOk, ok)
+	}
+
+	//half the prefetch count triggers an ack of both deliveries once the muxer synced
+	fb.deliver(ctags[`app`], 1, `hello world`)
+	fb.deliver(ctags[`audit`], 2, `user logged in`)
+	for _, exp := range []msg{
+		{queue: `app`, d: delivery{tag: 1, body: []byte(`hello world`)}},
+		{queue: `audit`, d: delivery{tag: 2, body: []byte(`user logged in`)}},
+	} {
+		r := <-got
+		if r.queue != exp.queue || r.d.tag != exp.d.tag || !bytes.Equal(r.d.body, exp.d.body) {
+			t.Fatalf("bad delivery %+v", r)
+		} else if r.d.routingKey != `app.info` || r.d.timestamp.Unix() != 1500000000 {
+			t.Fatalf("bad delivery properties %+v", r.d)
+		}
+	}
+	m := fb.expect(classBasic, methodAck)
+	if tag := m.args.uint64(); tag != 2 {
+		t.Fatalf("bad ack tag %d", tag)
+	} else if multiple := m.args.uint8(); multiple != 1 {
+		t.Fatal("ack is not multiple")
+	} else if atomic.LoadInt32(&syncs) == 0 {
+		t.Fatal("acked without syncing")
+	}
+
+	//closing acks the outstanding delivery before closing the connection
+	fb.deliver(ctags[`app`], 3, `last`)
+	<-got
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	if m = fb.expect(classBasic, methodAck); m.args.uint64() != 3 {
+		t.Fatal("outstanding delivery not acked")
+	}
+	fb.expect(classConnection, methodClose)
+	fb.sendMethod(0, classConnection, methodCloseOk, nil)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConsumerRefused(t *testing.T) {
+	fb := newFakeBroker(t)
+	defer fb.close()
+	c := newAMQPConsumer(`test`, &consumerCfg{
+		addr:     fb.lst.Addr().String(),
+		username: `user`,
+		password: `bad`,
+		queues:   []string{`app`},
+	}, nil, nil)
+	go func() {
+		conn, err := fb.lst.Accept()
+		if err != nil {
+			return
+		}
+		fb.conn, fb.rdr = conn, bufio.NewReader(conn)
+		io.ReadFull(fb.rdr, make([]byte, len(protocolHeader)))
+		start := &encoder{}
+		start.uint16(9)
+		start.table(nil)
+		start.longstr(`PLAIN`)
+		start.longstr(`en_US`)
+		fb.sendMethod(0, classConnection, methodStart, start)
+		expect(fb.rdr, classConnection, methodStartOk)
+		cl := &encoder{}
+		cl.uint16(403)
+		cl.shortstr(`ACCESS_REFUSED`)
+		cl.uint16(0)
+		cl.uint16(0)
+		fb.sendMethod(0, classConnection, methodClose, cl)
+	}()
+	if connected, err := c.session(); connected || err == nil {
+		t.Fatalf("refused connection not reported: %v %v", connected, err)
+	}
+}
@@ -0,0 +1,343 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/config"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	MAX_CONFIG_SIZE  int64  = (1024 * 1024 * 2) //2MB, even this is crazy large
+	defaultPort      uint16 = 5672
+	defaultTLSPort   uint16 = 5671
+	defaultVhost            = `/`
+	defaultUser             = `guest`
+	defaultPrefetch  int    = 512
+	maxPrefetch      int    = 65535
+	defaultHeartbeat        = 60 * time.Second
+	maxHeartbeat            = 65535 * time.Second
+)
+
+var (
+	ErrMissingBroker      = errors.New("Broker is required")
+	ErrMissingQueue       = errors.New("at least one Queue is required")
+	ErrInvalidPrefetch    = fmt.Errorf("Prefetch must be between 1 and %d", maxPrefetch)
+	ErrInvalidHeartbeat   = errors.New("Heartbeat must be a duration of whole seconds, 0 disables heartbeats")
+	ErrInvalidQueueTag    = errors.New("Queue-Tag must be of the form queue:tag")
+	ErrQueueTagNoQueue    = errors.New("Queue-Tag names a queue the consumer does not read")
+	ErrPasswordNoUsername = errors.New("Password requires a Username")
+	ErrTLSOptionsNoTLS    = errors.New("TLS options require Use-TLS=true")
+	ErrTLSCertKeyMissing  = errors.New("TLS-Cert-File and TLS-Key-File must be given together")
+)
+
+type ConfigConsumer struct {
+	Tag_Name        string
+	Broker          string //host:port, the port defaults to 5672 or 5671 with TLS
+	Vhost           string //defaults to /
+	Username        string //defaults to guest
+	Password        string
+	Queue           []string //may be given multiple times
+	Queue_Tag       []string //queue:tag, messages from the queue go to the tag instead of Tag-Name
+	Prefetch        int      //unacknowledged messages the broker sends each queue consumer, defaults to 512
+	Heartbeat       string   //heartbeat interval requested from the broker, defaults to 60s
+	Source_Override string
+
+	Use_TLS                  bool
+	Insecure_Skip_TLS_Verify bool
+	TLS_CA_File              string //CA bundle used to verify the broker, the system pool is used if empty
+	TLS_Cert_File            string //client certificate for brokers that require TLS client authentication
+	TLS_Key_File             string
+
+	Ignore_Timestamps         bool //apply the current time instead of the message timestamp
+	Extract_Timestamps        bool //ignore the message timestamp, use timegrinder
+	Assume_Local_Timezone     bool
+	Timezone_Override         string
+	Timestamp_Format_Override string //override the timestamp format
+	Preprocessor              []string
+}
+
+type consumerCfg struct {
+	tag          string
+	addr         string
+	vhost        string
+	username     string
+	password     string
+	queues       []string
+	queueTags    map[string]string
+	prefetch     uint16
+	heartbeat    time.Duration
+	srcOverride  net.IP
+	tls          *tls.Config
+	ignoreTS     bool
+	tg           *timegrinder.TimeGrinder
+	preprocessor []string
+}
+
+type cfgReadType struct {
+	Global       config.IngestConfig
+	Consumer     map[string]*ConfigConsumer
+	Preprocessor processors.ProcessorConfig
+}
+
+type cfgType struct {
+	config.IngestConfig
+	Consumers    map[string]*consumerCfg
+	Preprocessor processors.ProcessorConfig
+}
+
+func GetConfig(path string) (*cfgType, error) {
+	var cr cfgReadType
+	if err := config.LoadConfigFile(&cr, path); err != nil {
+		return nil, err
+	}
+	//validate the global params
+	if err := cr.Global.Verify(); err != nil {
+		return nil, err
+	} else if len(cr.Consumer) == 0 {
+		return nil, errors.New("no consumers defined")
+	} else if err := cr.Preprocessor.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &cfgType{
+		IngestConfig: cr.Global,
+		Consumers:    make(map[string]*consumerCfg, len(cr.Consumer)),
+		Preprocessor: cr.Preprocessor,
+	}
+	for k, v := range cr.Consumer {
+		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
+			return nil, fmt.Errorf("Consumer %s preprocessor invalid: %v", k, err)
+		}
+		cc, err := v.validateAndProcess()
+		if err != nil {
+			return nil, fmt.Errorf("Consumer %s: %v", k, err)
+		}
+		c.Consumers[k] = &cc
+	}
+	return c, nil
+}
+
+func (c *cfgType) Tags() (tags []string, err error) {
+	tagMp := make(map[string]bool, len(c.Consumers))
+	add := func(tag string) {
+		if _, ok := tagMp[tag]; !ok {
+			tags = append(tags, tag)
+			tagMp[tag] = true
+		}
+	}
+	for _, v := range c.Consumers {
+		add(v.tag)
+		for _, tag := range v.queueTags {
+			add(tag)
+		}
+	}
+	if len(tags) == 0 {
+		err = errors.New("No tags specified")
+	} else {
+		sort.Strings(tags)
+	}
+	return
+}
+
+func (cc ConfigConsumer) validateAndProcess() (c consumerCfg, err error) {
+	if len(cc.Tag_Name) == 0 {
+		err = errors.New("missing tag name")
+		return
+	} else if err = ingest.CheckTag(cc.Tag_Name); err != nil {
+		return
+	}
+	c.tag = cc.Tag_Name
+
+	if cc.Broker = strings.TrimSpace(cc.Broker); cc.Broker == `` {
+		err = ErrMissingBroker
+		return
+	}
+	port := defaultPort
+	if cc.Use_TLS {
+		port = defaultTLSPort
+	}
+	c.addr = config.AppendDefaultPort(cc.Broker, port)
+	if _, _, err = net.SplitHostPort(c.addr); err != nil {
+		return
+	}
+	if c.vhost = cc.Vhost; c.vhost == `` {
+		c.vhost = defaultVhost
+	}
+	if cc.Username == `` {
+		if cc.Password != `` {
+			err = ErrPasswordNoUsername
+			return
+		}
+		c.username, c.password = defaultUser, defaultUser
+	} else {
+		c.username, c.password = cc.Username, cc.Password
+	}
+
+	for _, q := range cc.Queue {
+		if q = strings.TrimSpace(q); len(q) > 0 {
+			c.queues = append(c.queues, q)
+		}
+	}
+	if len(c.queues) == 0 {
+		err = ErrMissingQueue
+		return
+	}
+	if c.queueTags, err = cc.parseQueueTags(c.queues); err != nil {
+		return
+	}
+
+	if cc.Prefetch == 0 {
+		c.prefetch = uint16(defaultPrefetch)
+	} else if cc.Prefetch < 0 || cc.Prefetch > maxPrefetch {
+		err = ErrInvalidPrefetch
+		return
+	} else {
+		c.prefetch = uint16(cc.Prefetch)
+	}
+	if cc.Heartbeat == `` {
+		c.heartbeat = defaultHeartbeat
+	} else if c.heartbeat, err = time.ParseDuration(cc.Heartbeat); err != nil || c.heartbeat < 0 || c.heartbeat > maxHeartbeat || c.heartbeat%time.Second != 0 {
+		err = ErrInvalidHeartbeat
+		return
+	}
+
+	if c.tls, err = cc.tlsConfig(c.addr); err != nil {
+		return
+	}
+
+	if len(cc.Source_Override) > 0 {
+		if c.srcOverride = net.ParseIP(cc.Source_Override); c.srcOverride == nil {
+			err = fmt.Errorf("Invalid source override %s", cc.Source_Override)
+			return
+		}
+	}
+
+	if cc.Timezone_Override != "" {
+		if cc.Assume_Local_Timezone {
+			err = fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same consumer")
+			return
+		}
+		if _, err = time.LoadLocation(cc.Timezone_Override); err != nil {
+			err = fmt.Errorf("Invalid timezone override %v: %v", cc.Timezone_Override, err)
+			return
+		}
+	}
+	if cc.Ignore_Timestamps {
+		c.ignoreTS = true
+	} else if cc.Extract_Timestamps {
+		tcfg := timegrinder.Config{
+			EnableLeftMostSeed: true,
+			FormatOverride:     cc.Timestamp_Format_Override,
+		}
+		if c.tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+			err = fmt.Errorf("Failed to generate new timegrinder: %v", err)
+			return
+		}
+		if cc.Assume_Local_Timezone {
+			c.tg.SetLocalTime()
+		}
+		if cc.Timezone_Override != `` {
+			if err = c.tg.SetTimezone(cc.Timezone_Override); err != nil {
+				err = fmt.Errorf("Failed to override timezone: %v", err)
+				return
+			}
+		}
+	}
+	c.preprocessor = cc.Preprocessor
+	return
+}
+
+// parseQueueTags checks the queue:tag overrides, tags cannot contain a colon so the last one
+// separates the queue
+func (cc ConfigConsumer) parseQueueTags(queues []string) (mp map[string]string, err error) {
+	for _, v := range cc.Queue_Tag {
+		idx := strings.LastIndex(v, ":")
+		if idx <= 0 {
+			return nil, ErrInvalidQueueTag
+		}
+		queue, tag := strings.TrimSpace(v[:idx]), strings.TrimSpace(v[idx+1:])
+		if queue == `` || tag == `` {
+			return nil, ErrInvalidQueueTag
+		} else if err = ingest.CheckTag(tag); err != nil {
+			return nil, fmt.Errorf("Invalid Queue-Tag tag %q: %v", tag, err)
+		}
+		var found bool
+		for _, q := range queues {
+			if q == queue {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%v: %s", ErrQueueTagNoQueue, queue)
+		}
+		if mp == nil {
+			mp = map[string]string{}
+		}
+		mp[queue] = tag
+	}
+	return
+}
+
+// tlsConfig builds the TLS configuration for the broker connection, nil when TLS is not enabled
+func (cc ConfigConsumer) tlsConfig(addr string) (tc *tls.Config, err error) {
+	if !cc.Use_TLS {
+		if cc.Insecure_Skip_TLS_Verify || cc.TLS_CA_File != `` || cc.TLS_Cert_File != `` || cc.TLS_Key_File != `` {
+			err = ErrTLSOptionsNoTLS
+		}
+		return
+	}
+	tc = &tls.Config{
+		InsecureSkipVerify: cc.Insecure_Skip_TLS_Verify,
+	}
+	if host, _, lerr := net.SplitHostPort(addr); lerr == nil {
+		tc.ServerName = host
+	}
+	if cc.TLS_CA_File != `` {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(cc.TLS_CA_File); err != nil {
+			return nil, fmt.Errorf("Failed to read TLS-CA-File: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in TLS-CA-File %s", cc.TLS_CA_File)
+		}
+	}
+	if (cc.TLS_Cert_File == ``) != (cc.TLS_Key_File == ``) {
+		return nil, ErrTLSCertKeyMissing
+	} else if cc.TLS_Cert_File != `` {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cc.TLS_Cert_File, cc.TLS_Key_File); err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// tagFor returns the tag for messages consumed from a queue
+func (c *consumerCfg) tagFor(queue string) string {
+	if tag, ok := c.queueTags[queue]; ok {
+		return tag
+	}
+	return c.tag
+}
@@ -0,0 +1,138 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/log"
+)
+
+var (
+	tmpDir string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if tmpDir, err = ioutil.TempDir(os.TempDir(), `amqp`); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create tempdir %v\n", err)
+		os.Exit(-1)
+	}
+	lg = log.NewDiscardLogger()
+	r := m.Run()
+	os.RemoveAll(tmpDir)
+	os.Exit(r)
+}
+
+func writeConfig(t *testing.T, s string) string {
+	fout, err := ioutil.TempFile(tmpDir, `cfg`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	if _, err = fout.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	return fout.Name()
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := GetConfig(writeConfig(t, baseConfig))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cfg.Consumers) != 2 {
+		t.Fatalf("invalid consumer count %d", len(cfg.Consumers))
+	}
+	if tags, err := cfg.Tags(); err != nil {
+		t.Fatal(err)
+	} else if len(tags) != 3 {
+		t.Fatalf("invalid tags %v", tags)
+	}
+
+	cc := cfg.Consumers[`logs`]
+	if cc.addr != `rabbit.example.com:5671` || cc.vhost != `/logs` || cc.tls == nil {
+		t.Fatalf("bad consumer config %+v", cc)
+	} else if cc.prefetch != 100 || cc.heartbeat != 30*time.Second || cc.tg == nil {
+		t.Fatalf("bad consumer config %+v", cc)
+	} else if cc.tagFor(`audit`) != `audit` || cc.tagFor(`app`) != `rabbit` {
+		t.Fatal("bad queue tags")
+	}
+
+	cc = cfg.Consumers[`local`]
+	if cc.addr != `127.0.0.1:5672` || cc.vhost != defaultVhost || cc.username != defaultUser || cc.tls != nil {
+		t.Fatalf("bad defaults %+v", cc)
+	} else if cc.prefetch != uint16(defaultPrefetch) || cc.heartbeat != defaultHeartbeat || !cc.ignoreTS {
+		t.Fatalf("bad defaults %+v", cc)
+	}
+}
+
+func TestBadConfigs(t *testing.T) {
+	for _, b := range []string{
+		`Queue=a`,
+		`Broker=127.0.0.1`,
+		`Broker=127.0.0.1
+		Queue=a
+		Prefetch=70000`,
+		`Broker=127.0.0.1
+		Queue=a
+		Heartbeat=1500ms`,
+		`Broker=127.0.0.1
+		Queue=a
+		Queue-Tag=b:tag`,
+		`Broker=127.0.0.1
+		Queue=a
+		Password=pass`,
+		`Broker=127.0.0.1
+		Queue=a
+		TLS-CA-File=/tmp/ca.pem`,
+	} {
+		if _, err := GetConfig(writeConfig(t, badBase+b)); err == nil {
+			t.Errorf("bad config accepted: %s", b)
+		}
+	}
+}
+
+const baseConfig = `
+[Global]
+Ingest-Secret = IngestSecrets
+Connection-Timeout = 0
+Cleartext-Backend-Target=127.0.0.1:4023
+
+[Consumer "logs"]
+	Broker=rabbit.example.com
+	Vhost=/logs
+	Username=gravwell
+	Password=secret
+	Tag-Name=rabbit
+	Queue=app
+	Queue=audit
+	Queue-Tag=audit:audit
+	Prefetch=100
+	Heartbeat=30s
+	Use-TLS=true
+	Extract-Timestamps=true
+
+[Consumer "local"]
+	Broker=127.0.0.1
+	Tag-Name=local
+	Queue=logs
+	Ignore-Timestamps=true
+`
+
+const badBase = `
+[Global]
+Ingest-Secret = IngestSecrets
+Cleartext-Backend-Target=127.0.0.1:4023
+
+[Consumer "bad"]
+	Tag-Name=rabbit
+	`
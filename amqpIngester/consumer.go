@@ -0,0 +1,446 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout              = 10 * time.Second
+	handshakeTimeout         = 30 * time.Second
+	closeTimeout             = 5 * time.Second
+	minReconnectDelay        = time.Second
+	maxReconnectDelay        = time.Minute
+	ackInterval              = time.Second
+	ackSyncTimeout           = 10 * time.Second
+	eventChanSize            = 256
+	maxBodyPrealloc          = 1024 * 1024
+	consumerChannel   uint16 = 1
+)
+
+var (
+	ErrConsumerClosed = errors.New("consumer closed")
+)
+
+// event is a method or a complete delivery read from the broker, or the error that ended the
+// connection
+type event struct {
+	m   method
+	d   *delivery
+	err error
+}
+
+// amqpConsumer consumes the queues of a consumer config over a single channel, it reconnects
+// with a backoff whenever the connection or channel fails.  Deliveries are acknowledged only
+// after the ingest muxer has synced them, unacknowledged deliveries are requeued by the broker
+// when the connection drops and the prefetch count bounds how many are outstanding.
+type amqpConsumer struct {
+	name    string
+	cfg     *consumerCfg
+	process func(queue string, d delivery) error
+	sync    func(time.Duration) error
+
+	wmtx sync.Mutex //serializes writes between the consumer and the heartbeats
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newAMQPConsumer(name string, cfg *consumerCfg, process func(string, delivery) error, syncFn func(time.Duration) error) *amqpConsumer {
+	return &amqpConsumer{
+		name:    name,
+		cfg:     cfg,
+		process: process,
+		sync:    syncFn,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *amqpConsumer) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Close acknowledges the synced deliveries, closes the connection, and waits for the consumer to exit
+func (c *amqpConsumer) Close() error {
+	if c.closed() {
+		return ErrConsumerClosed
+	}
+	close(c.done)
+	c.wg.Wait()
+	return nil
+}
+
+func (c *amqpConsumer) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	return false
+}
+
+func (c *amqpConsumer) run() {
+	defer c.wg.Done()
+	delay := minReconnectDelay
+	for {
+		connected, err := c.session()
+		if c.closed() {
+			return
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		lg.Error("Connection to AMQP broker %s (%s) failed, reconnecting in %v: %v", c.name, c.cfg.addr, delay, err)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (c *amqpConsumer) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if c.cfg.tls != nil {
+		return tls.DialWithDialer(d, `tcp`, c.cfg.addr, c.cfg.tls)
+	}
+	return d.Dial(`tcp`, c.cfg.addr)
+}
+
+func (c *amqpConsumer) write(conn net.Conn, f frame) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	_, err := conn.Write(f.encode())
+	return err
+}
+
+// consumerTag names the consumer of the queue at idx, deliveries carry it to identify the queue
+func consumerTag(idx int) string {
+	return fmt.Sprintf("gravwell-%d", idx)
+}
+
+// session connects, opens the channel, starts consuming every queue, and handles deliveries
+// until the connection fails or the consumer is closed, connected is true if the handshake
+// succeeded
+func (c *amqpConsumer) session() (connected bool, err error) {
+	conn, err := c.dial()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	rdr := bufio.NewReader(conn)
+
+	//a close during the handshake drops the connection instead of waiting out the timeouts
+	hsDone := make(chan struct{})
+	go func() {
+		select {
+		case <-c.done:
+			conn.Close()
+		case <-hsDone:
+		}
+	}()
+	t, err := c.handshake(conn, rdr)
+	close(hsDone)
+	if err != nil {
+		return
+	}
+	connected = true
+	lg.Info("Connected to AMQP broker %s (%s)", c.name, c.cfg.addr)
+
+	queues := make(map[string]string, len(c.cfg.queues))
+	for i, q := range c.cfg.queues {
+		queues[consumerTag(i)] = q
+		if err = c.write(conn, methodFrame(consumerChannel, classBasic, methodConsume, consumeArgs(q, consumerTag(i)))); err != nil {
+			return
+		}
+	}
+
+	events := make(chan event, eventChanSize)
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.read(conn, rdr, t, events, stop)
+	if t.heartbeat > 0 {
+		go c.heartbeats(conn, time.Duration(t.heartbeat)*time.Second/2, stop)
+	}
+	err = c.consume(conn, queues, events)
+	return
+}
+
+// handshake opens the connection and the consumer channel and sets the prefetch count
+func (c *amqpConsumer) handshake(conn net.Conn, rdr *bufio.Reader) (t tuning, err error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if _, err = conn.Write(protocolHeader); err != nil {
+		return
+	}
+	var m method
+	if m, err = expect(rdr, classConnection, methodStart); err != nil {
+		return
+	}
+	m.args.uint8() //version major
+	m.args.uint8() //version minor
+	m.args.skipTable()
+	if mechs := m.args.longstr(); m.args.err != nil {
+		err = m.args.err
+		return
+	} else if !strings.Contains(` `+mechs+` `, ` PLAIN `) {
+		err = fmt.Errorf("broker does not support PLAIN authentication, it offers %q", mechs)
+		return
+	}
+	if err = c.write(conn, methodFrame(0, classConnection, methodStartOk, startOkArgs(c.cfg.username, c.cfg.password))); err != nil {
+		return
+	}
+	//a broker that rejects the credentials closes the connection here
+	if m, err = expect(rdr, classConnection, methodTune); err != nil {
+		return
+	} else if t, err = negotiate(m, c.cfg.heartbeat); err != nil {
+		return
+	}
+	steps := []struct {
+		channel   uint16
+		class, id uint16
+		args      *encoder
+		okID      uint16
+	}{
+		{0, classConnection, methodOpen, openArgs(c.cfg.vhost), methodOpenOk},
+		{consumerChannel, classChannel, methodChOpen, openChannelArgs(), methodChOpenOk},
+		{consumerChannel, classBasic, methodQos, qosArgs(c.cfg.prefetch), methodQosOk},
+	}
+	if err = c.write(conn, methodFrame(0, classConnection, methodTuneOk, tuneOkArgs(t))); err != nil {
+		return
+	}
+	for _, s := range steps {
+		if err = c.write(conn, methodFrame(s.channel, s.class, s.id, s.args)); err != nil {
+			return
+		} else if _, err = expect(rdr, s.class, s.okID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// expect reads the next method during the handshake, a Close from the broker is returned as
+// an error with the reason
+func expect(rdr *bufio.Reader, class, id uint16) (m method, err error) {
+	for {
+		var f frame
+		if f, err = readFrame(rdr, clientFrameMax); err != nil {
+			return
+		} else if f.typ == frameHeartbeat {
+			continue
+		} else if f.typ != frameMethod {
+			err = fmt.Errorf("expected a method frame, got frame type %d", f.typ)
+			return
+		}
+		if m, err = parseMethod(f); err != nil || m.is(class, id) {
+			return
+		} else if m.is(classConnection, methodClose) || m.is(classChannel, methodChClose) {
+			err = closeReason(m)
+		} else {
+			err = fmt.Errorf("expected method %d.%d, got %v", class, id, m)
+		}
+		return
+	}
+}
+
+// read assembles deliveries from their method, header, and body frames and sends them and
+// every other method to the consumer
+func (c *amqpConsumer) read(conn net.Conn, rdr *bufio.Reader, t tuning, events chan event, stop chan struct{}) {
+	emit := func(ev event) bool {
+		select {
+		case events <- ev:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	var cur *delivery
+	var remaining uint64
+	for {
+		//the broker sends heartbeats, losing two in a row means the connection is gone
+		if t.heartbeat > 0 {
+			conn.SetReadDeadline(time.Now().Add(2 * time.Duration(t.heartbeat) * time.Second))
+		}
+		f, err := readFrame(rdr, t.frameMax)
+		if err != nil {
+			emit(event{err: err})
+			return
+		}
+		switch f.typ {
+		case frameHeartbeat:
+			continue
+		case frameMethod:
+			var m method
+			if m, err = parseMethod(f); err == nil {
+				if !m.is(classBasic, methodDeliver) {
+					if !emit(event{m: m}) {
+						return
+					}
+					continue
+				}
+				var d delivery
+				if d, err = parseDeliver(m); err == nil {
+					cur = &d
+					continue
+				}
+			}
+		case frameHeader:
+			if cur == nil {
+				err = ErrMalformedFrame
+				break
+			}
+			if remaining, cur.timestamp, err = parseContentHeader(f); err != nil {
+				break
+			}
+			prealloc := remaining
+			if prealloc > maxBodyPrealloc {
+				prealloc = maxBodyPrealloc
+			}
+			cur.body = make([]byte, 0, prealloc)
+		case frameBody:
+			if cur == nil || uint64(len(f.payload)) > remaining {
+				err = ErrMalformedFrame
+				break
+			}
+			cur.body = append(cur.body, f.payload...)
+			remaining -= uint64(len(f.payload))
+		default:
+			err = fmt.Errorf("unexpected frame type %d", f.typ)
+		}
+		if err != nil {
+			emit(event{err: err})
+			return
+		}
+		if cur != nil && cur.body != nil && remaining == 0 {
+			if !emit(event{d: cur}) {
+				return
+			}
+			cur = nil
+		}
+	}
+}
+
+// consume handles deliveries and acknowledges them in batches once the muxer synced them, half
+// the prefetch count or the ack interval triggers a batch
+func (c *amqpConsumer) consume(conn net.Conn, queues map[string]string, events chan event) error {
+	var lastTag uint64
+	var pending int
+	ackAt := int(c.cfg.prefetch) / 2
+	if ackAt < 1 {
+		ackAt = 1
+	}
+	ack := func() error {
+		if pending == 0 {
+			return nil
+		} else if err := c.sync(ackSyncTimeout); err != nil {
+			lg.Warn("Delaying %d acks, failed to sync the ingester: %v", pending, err)
+			return nil
+		} else if err = c.write(conn, methodFrame(consumerChannel, classBasic, methodAck, ackArgs(lastTag, true))); err != nil {
+			return err
+		}
+		pending = 0
+		return nil
+	}
+
+	tkr := time.NewTicker(ackInterval)
+	defer tkr.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if ev.err != nil {
+				return ev.err
+			} else if ev.d != nil {
+				//a delivery that can't be processed is left unacknowledged and redelivered after reconnecting
+				if err := c.process(queues[ev.d.consumerTag], *ev.d); err != nil {
+					ack()
+					return err
+				}
+				lastTag = ev.d.tag
+				if pending++; pending >= ackAt {
+					if err := ack(); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			m := ev.m
+			switch {
+			case m.is(classBasic, methodConsumeOk):
+				debugout("Consuming %s on %s\n", queues[m.args.shortstr()], c.name)
+			case m.is(classBasic, methodCancel):
+				return fmt.Errorf("broker cancelled the consumer of queue %s", queues[m.args.shortstr()])
+			case m.is(classChannel, methodChClose):
+				c.write(conn, methodFrame(consumerChannel, classChannel, methodChCloseOk, nil))
+				return closeReason(m)
+			case m.is(classConnection, methodClose):
+				c.write(conn, methodFrame(0, classConnection, methodCloseOk, nil))
+				return closeReason(m)
+			default:
+				debugout("Ignoring %v from %s\n", m, c.name)
+			}
+		case <-tkr.C:
+			if err := ack(); err != nil {
+				return err
+			}
+		case <-c.done:
+			return c.shutdown(conn, events, ack())
+		}
+	}
+}
+
+// shutdown closes the connection, deliveries that arrive while closing are not acknowledged
+// and the broker requeues them
+func (c *amqpConsumer) shutdown(conn net.Conn, events chan event, err error) error {
+	if err != nil {
+		return err
+	} else if err = c.write(conn, methodFrame(0, classConnection, methodClose, closeArgs())); err != nil {
+		return err
+	}
+	tmr := time.NewTimer(closeTimeout)
+	defer tmr.Stop()
+	for {
+		select {
+		case ev := <-events:
+			if ev.err != nil || ev.m.is(classConnection, methodCloseOk) {
+				return ev.err
+			}
+		case <-tmr.C:
+			return errors.New("timed out waiting for the broker to close the connection")
+		}
+	}
+}
+
+// heartbeats sends a heartbeat at half the negotiated interval, a failed write surfaces as a read error
+func (c *amqpConsumer) heartbeats(conn net.Conn, interval time.Duration, stop chan struct{}) {
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tkr.C:
+			if err := c.write(conn, frame{typ: frameHeartbeat}); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	backfillSyncTimeout = time.Minute
+)
+
+// runBackfill ingests the existing contents of every file the followers match using the
+// same handlers as the live followers, waits for the muxer to sync, and returns.  Offsets
+// are recorded in the state file so a live follower, or another backfill, resumes where
+// this one stopped.  The live follower must not be running against the same state file.
+func runBackfill(cfg *cfgType, igst *ingest.IngestMuxer, src net.IP, lgr handlerLogger, dbg func(string, ...interface{})) error {
+	fs, err := newFollowerSet(cfg, igst, src, lgr, dbg)
+	if err != nil {
+		return err
+	}
+	states, err := fs.backfill(cfg.StatePath())
+	fs.reportStats(igst, dbg)
+	//the watcher writes the states it loaded when it closes, so close before writing ours
+	if lerr := fs.Close(); lerr != nil && err == nil {
+		err = lerr
+	}
+	if states != nil {
+		if lerr := writeStates(cfg.StatePath(), states); lerr != nil && err == nil {
+			err = fmt.Errorf("Failed to write state file: %v", lerr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = igst.Sync(backfillSyncTimeout); err != nil {
+		err = fmt.Errorf("Failed to sync the ingest muxer: %v", err)
+	}
+	return err
+}
+
+func (fs *followerSet) backfill(statePath string) (states map[filewatch.FileName]*int64, err error) {
+	if states, err = loadStates(statePath); err != nil {
+		err = fmt.Errorf("Failed to read state file %s: %v", statePath, err)
+		return
+	}
+	for _, cf := range fs.bfill {
+		walkFiles(cf.base, cf.recursive, func(p string, fi os.FileInfo) error {
+			if !cf.match(fi.Name()) {
+				return nil
+			}
+			key := filewatch.FileName{BaseName: cf.name, FilePath: p}
+			var off int64
+			if v := states[key]; v != nil {
+				off = *v
+			}
+			if off > fi.Size() {
+				off = 0 //file was truncated since the offset was recorded
+			} else if off == fi.Size() {
+				return nil
+			}
+			//a failed file keeps its old offset, the scanner reads ahead so we cannot tell how far we got
+			if n, lerr := cf.tail(p, off, fi.ModTime()); lerr != nil {
+				fs.igst.Error("file_follower failed to backfill %s: %v", p, lerr)
+			} else {
+				fs.igst.Info("file_follower backfilled %s from offset %d to %d", p, off, n)
+				states[key] = &n
+			}
+			return nil
+		})
+	}
+	//compressed, binary, and CSV files are tracked by their own managers, one pass picks them all up
+	fs.cmpr.scan()
+	fs.bins.scan()
+	fs.csvs.scan()
+	return
+}
+
+// tail processes a file from the offset to its current end and returns the new offset
+func (cf compressedFollower) tail(p string, off int64, mtime time.Time) (n int64, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	if _, err = fin.Seek(off, io.SeekStart); err != nil {
+		return
+	}
+	cr := &countingReader{r: fin}
+	err = cf.process(cr, mtime)
+	n = off + cr.n
+	return
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(b []byte) (n int, err error) {
+	n, err = cr.r.Read(b)
+	cr.n += int64(n)
+	return
+}
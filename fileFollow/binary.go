@@ -0,0 +1,362 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingesters/v3/utils"
+)
+
+const (
+	binaryStateSuffix          = `.binary`
+	binaryScanInterval         = time.Second
+	defaultBinaryMaxRecord int = 1024 * 1024
+	binaryReadBuffer       int = 64 * 1024
+	binaryMaxRecordLimit   int = 64 * 1024 * 1024
+)
+
+var (
+	ErrBinaryManagerStarted = errors.New("Binary file manager already started")
+	ErrInvalidBinaryRecord  = errors.New("Binary record length is invalid or exceeds Binary-Max-Record-Size")
+)
+
+// binaryLayout describes how records are delimited in a binary file, records are
+// either a fixed size or begin with a header holding the length of the record
+type binaryLayout struct {
+	size       int //fixed record size, zero when records are length prefixed
+	lenBytes   int
+	lenOffset  int
+	hdrSize    int
+	bigEndian  bool
+	inclHeader bool //the length covers the header as well as the body
+	max        int
+}
+
+// BinaryLayout returns the binary record layout of the follower, ok is false for text followers
+func (f follower) BinaryLayout() (bl binaryLayout, ok bool, err error) {
+	if f.Binary_Record_Size == 0 && f.Binary_Length_Bytes == 0 {
+		return
+	}
+	bl = binaryLayout{
+		size:       f.Binary_Record_Size,
+		lenBytes:   f.Binary_Length_Bytes,
+		lenOffset:  f.Binary_Length_Offset,
+		hdrSize:    f.Binary_Header_Size,
+		bigEndian:  f.Binary_Big_Endian,
+		inclHeader: f.Binary_Length_Inclusive,
+		max:        f.Binary_Max_Record_Size,
+	}
+	if bl.max == 0 {
+		bl.max = defaultBinaryMaxRecord
+	} else if bl.max < 0 || bl.max > binaryMaxRecordLimit {
+		err = fmt.Errorf("Binary-Max-Record-Size must be between 1 and %d", binaryMaxRecordLimit)
+		return
+	}
+	if bl.size != 0 {
+		if bl.lenBytes != 0 {
+			err = errors.New("Binary-Record-Size and Binary-Length-Bytes are mutually exclusive")
+		} else if bl.size < 0 || bl.size > bl.max {
+			err = errors.New("Binary-Record-Size must be positive and no larger than Binary-Max-Record-Size")
+		}
+		ok = err == nil
+		return
+	}
+	switch bl.lenBytes {
+	case 1, 2, 4, 8:
+	default:
+		err = errors.New("Binary-Length-Bytes must be 1, 2, 4, or 8")
+		return
+	}
+	if bl.lenOffset < 0 {
+		err = errors.New("Binary-Length-Offset may not be negative")
+		return
+	}
+	if bl.hdrSize == 0 {
+		bl.hdrSize = bl.lenOffset + bl.lenBytes
+	} else if bl.hdrSize < bl.lenOffset+bl.lenBytes {
+		err = errors.New("Binary-Header-Size must include the length field")
+		return
+	}
+	ok = true
+	return
+}
+
+// recordSize returns the size of the record at the start of b, zero means that b does
+// not hold a complete header yet
+func (bl binaryLayout) recordSize(b []byte) (n int, err error) {
+	if bl.size > 0 {
+		return bl.size, nil
+	} else if len(b) < bl.hdrSize {
+		return
+	}
+	var v uint64
+	fld := b[bl.lenOffset : bl.lenOffset+bl.lenBytes]
+	var order binary.ByteOrder = binary.LittleEndian
+	if bl.bigEndian {
+		order = binary.BigEndian
+	}
+	switch bl.lenBytes {
+	case 1:
+		v = uint64(fld[0])
+	case 2:
+		v = uint64(order.Uint16(fld))
+	case 4:
+		v = uint64(order.Uint32(fld))
+	case 8:
+		v = order.Uint64(fld)
+	}
+	if !bl.inclHeader {
+		v += uint64(bl.hdrSize)
+	}
+	if v > uint64(bl.max) || v < uint64(bl.hdrSize) {
+		err = ErrInvalidBinaryRecord
+		return
+	}
+	n = int(v)
+	return
+}
+
+// split is a bufio.SplitFunc which only hands out complete records, a partial record at
+// the end of the file is left for the next scan
+func (bl binaryLayout) split(data []byte, atEOF bool) (advance int, tok []byte, err error) {
+	var n int
+	if n, err = bl.recordSize(data); err != nil || n == 0 || len(data) < n {
+		return
+	}
+	return n, data[:n], nil
+}
+
+type binaryFollower struct {
+	compressedFollower
+	layout binaryLayout
+}
+
+// binaryManager polls files that hold binary records, the filewatch engines only split
+// on newlines and regular expressions.  Offsets are kept in a state file beside the
+// follower state file and only ever advance past complete records.  Offsets are written
+// at most once per checkpoint interval, and when the manager is closed.  Offsets of files
+// that go missing are kept for the state retention period.
+type binaryManager struct {
+	sync.Mutex
+	st         *utils.State
+	offsets    map[string]int64
+	flwrs      []binaryFollower
+	lgr        ingest.IngestLogger
+	checkpoint time.Duration
+	lastWrite  time.Time
+	dirty      bool                 //offsets changed since they were last written
+	retention  time.Duration        //how long offsets of missing files are kept, zero is forever
+	missing    map[string]time.Time //when files were first found missing
+	quit       chan bool
+	wg         sync.WaitGroup
+}
+
+func newBinaryManager(statePath string, checkpoint, retention time.Duration, lgr ingest.IngestLogger) (bm *binaryManager, err error) {
+	var st *utils.State
+	if st, err = utils.NewState(statePath+binaryStateSuffix, 0660); err != nil {
+		return
+	}
+	offsets := map[string]int64{}
+	if err = st.Read(&offsets); err == utils.ErrNoState {
+		err = nil
+	} else if err != nil {
+		return
+	}
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	bm = &binaryManager{
+		st:         st,
+		offsets:    offsets,
+		lgr:        lgr,
+		checkpoint: checkpoint,
+		retention:  retention,
+		missing:    map[string]time.Time{},
+	}
+	return
+}
+
+// Add registers a follower with the binary file manager
+func (bm *binaryManager) Add(bf binaryFollower) {
+	bm.Lock()
+	bm.flwrs = append(bm.flwrs, bf)
+	bm.Unlock()
+}
+
+// Count returns the number of followers with binary records
+func (bm *binaryManager) Count() int {
+	bm.Lock()
+	defer bm.Unlock()
+	return len(bm.flwrs)
+}
+
+func (bm *binaryManager) followers() (r []compressedFollower) {
+	bm.Lock()
+	defer bm.Unlock()
+	for _, bf := range bm.flwrs {
+		r = append(r, bf.compressedFollower)
+	}
+	return
+}
+
+func (bm *binaryManager) Start() error {
+	bm.Lock()
+	defer bm.Unlock()
+	if bm.quit != nil {
+		return ErrBinaryManagerStarted
+	}
+	bm.quit = make(chan bool)
+	bm.wg.Add(1)
+	go bm.routine()
+	return nil
+}
+
+func (bm *binaryManager) Close() error {
+	bm.Lock()
+	if bm.quit != nil {
+		close(bm.quit)
+	}
+	bm.Unlock()
+	bm.wg.Wait()
+	bm.Lock()
+	defer bm.Unlock()
+	bm.quit = nil
+	return bm.st.Write(bm.offsets)
+}
+
+func (bm *binaryManager) routine() {
+	defer bm.wg.Done()
+	tckr := time.NewTicker(binaryScanInterval)
+	defer tckr.Stop()
+	for {
+		bm.scan()
+		select {
+		case <-tckr.C:
+		case <-bm.quit:
+			return
+		}
+	}
+}
+
+func (bm *binaryManager) quitting() bool {
+	select {
+	case <-bm.quit:
+		return true
+	default:
+	}
+	return false
+}
+
+// scan reads new records from every matching file, files that are gone are dropped from the
+// states once they have been missing for the retention period
+func (bm *binaryManager) scan() {
+	bm.Lock()
+	flwrs := bm.flwrs
+	bm.Unlock()
+	seen := map[string]bool{}
+	var dirty bool
+	for _, bf := range flwrs {
+		walkFiles(bf.base, bf.recursive, func(p string, fi os.FileInfo) error {
+			if bm.quitting() {
+				return errScanAbort
+			} else if !bf.match(fi.Name()) {
+				return nil
+			}
+			key := compressedKey(bf.name, p)
+			seen[key] = true
+			bm.Lock()
+			off, ok := bm.offsets[key]
+			bm.Unlock()
+			if fi.Size() < off {
+				bm.lgr.Info("file_follower binary file %s was truncated, starting over", p)
+				off = 0
+			} else if ok && fi.Size() == off {
+				return nil
+			} else if !ok && bf.skip(fi, time.Now()) {
+				bm.lgr.Info("file_follower skipping binary file %s, it is too old or too large", p)
+				bm.Lock()
+				bm.offsets[key] = fi.Size()
+				bm.Unlock()
+				dirty = true
+				return nil
+			}
+			n, err := bf.tail(p, off)
+			if err != nil {
+				bm.lgr.Error("file_follower failed to read binary file %s at offset %d: %v", p, n, err)
+				if err == ErrInvalidBinaryRecord {
+					//there is no way to find the next record, skip what is in the file now
+					n = fi.Size()
+				}
+			}
+			bm.Lock()
+			bm.offsets[key] = n
+			bm.Unlock()
+			dirty = dirty || n != off || !ok
+			return nil
+		})
+	}
+	if bm.quitting() {
+		return
+	}
+	bm.Lock()
+	defer bm.Unlock()
+	now := time.Now()
+	for k := range bm.offsets {
+		if seen[k] {
+			delete(bm.missing, k)
+		} else if expireState(k, bm.missing, bm.retention, now, bm.lgr) {
+			delete(bm.offsets, k)
+			dirty = true
+		}
+	}
+	bm.dirty = bm.dirty || dirty
+	if bm.dirty && time.Since(bm.lastWrite) >= bm.checkpoint {
+		if err := bm.st.Write(bm.offsets); err != nil {
+			bm.lgr.Error("file_follower failed to write binary file states: %v", err)
+		} else {
+			bm.dirty = false
+			bm.lastWrite = time.Now()
+		}
+	}
+}
+
+// tail hands every complete record after the offset to the handler and returns the
+// offset just past the last complete record
+func (bf binaryFollower) tail(p string, off int64) (n int64, err error) {
+	n = off
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	if _, err = fin.Seek(off, io.SeekStart); err != nil {
+		return
+	}
+	s := bufio.NewScanner(fin)
+	s.Buffer(make([]byte, binaryReadBuffer), bf.layout.max)
+	s.Split(bf.layout.split)
+	for s.Scan() {
+		//the scanner reuses its buffer, so hand out a copy
+		if err = bf.hnd.HandleLog(append([]byte(nil), s.Bytes()...), time.Now()); err != nil {
+			return
+		}
+		n += int64(len(s.Bytes()))
+	}
+	err = s.Err()
+	return
+}
@@ -0,0 +1,118 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestBinaryLayout(t *testing.T) {
+	tests := []struct {
+		f    follower
+		in   []byte
+		recs [][]byte //complete records, anything after them is left for the next scan
+	}{
+		{
+			f:    follower{Binary_Record_Size: 3},
+			in:   []byte{1, 2, 3, 4, 5, 6, 7},
+			recs: [][]byte{{1, 2, 3}, {4, 5, 6}},
+		},
+		{
+			//big endian length not counting the header
+			f:    follower{Binary_Length_Bytes: 2, Binary_Big_Endian: true},
+			in:   []byte{0, 2, 'a', 'b', 0, 0, 0, 3, 'c'},
+			recs: [][]byte{{0, 2, 'a', 'b'}, {0, 0}},
+		},
+		{
+			//length field inside a larger header, counting the header
+			f:    follower{Binary_Length_Bytes: 1, Binary_Length_Offset: 1, Binary_Header_Size: 3, Binary_Length_Inclusive: true},
+			in:   []byte{0xff, 4, 0xff, 'a', 0xff, 3, 0xff, 0xff},
+			recs: [][]byte{{0xff, 4, 0xff, 'a'}, {0xff, 3, 0xff}},
+		},
+		{
+			f:    follower{Binary_Length_Bytes: 4},
+			in:   []byte{1, 0, 0, 0, 'a', 2, 0},
+			recs: [][]byte{{1, 0, 0, 0, 'a'}},
+		},
+		{
+			f:    follower{Binary_Length_Bytes: 8, Binary_Big_Endian: true},
+			in:   []byte{0, 0, 0, 0, 0, 0, 0, 1, 'z'},
+			recs: [][]byte{{0, 0, 0, 0, 0, 0, 0, 1, 'z'}},
+		},
+	}
+	for i, tt := range tests {
+		bl, ok, err := tt.f.BinaryLayout()
+		if err != nil || !ok {
+			t.Fatalf("%d bad layout %v %v", i, ok, err)
+		}
+		s := bufio.NewScanner(bytes.NewReader(tt.in))
+		s.Split(bl.split)
+		var recs [][]byte
+		for s.Scan() {
+			recs = append(recs, append([]byte(nil), s.Bytes()...))
+		}
+		if err = s.Err(); err != nil {
+			t.Fatalf("%d %v", i, err)
+		} else if len(recs) != len(tt.recs) {
+			t.Fatalf("%d split into %v, expected %v", i, recs, tt.recs)
+		}
+		for j := range recs {
+			if !bytes.Equal(recs[j], tt.recs[j]) {
+				t.Fatalf("%d record %d is %v, expected %v", i, j, recs[j], tt.recs[j])
+			}
+		}
+	}
+}
+
+func TestBinaryInvalidRecords(t *testing.T) {
+	tests := []struct {
+		f  follower
+		in []byte
+	}{
+		{f: follower{Binary_Length_Bytes: 2, Binary_Max_Record_Size: 16}, in: []byte{15, 0}},
+		{f: follower{Binary_Length_Bytes: 1, Binary_Length_Inclusive: true}, in: []byte{0}},
+		{f: follower{Binary_Length_Bytes: 1, Binary_Header_Size: 4, Binary_Length_Inclusive: true}, in: []byte{3, 0, 0, 0}},
+		{f: follower{Binary_Length_Bytes: 8}, in: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for i, tt := range tests {
+		bl, ok, err := tt.f.BinaryLayout()
+		if err != nil || !ok {
+			t.Fatalf("%d bad layout %v %v", i, ok, err)
+		}
+		if _, err = bl.recordSize(tt.in); err != ErrInvalidBinaryRecord {
+			t.Fatalf("%d accepted %v: %v", i, tt.in, err)
+		}
+	}
+	//an incomplete header waits for more data
+	bl, _, _ := follower{Binary_Length_Bytes: 4}.BinaryLayout()
+	if n, err := bl.recordSize([]byte{1, 0}); n != 0 || err != nil {
+		t.Fatalf("bad partial header %d %v", n, err)
+	}
+}
+
+func TestBinaryLayoutConfig(t *testing.T) {
+	if _, ok, err := (follower{}).BinaryLayout(); ok || err != nil {
+		t.Fatalf("text follower has a binary layout %v %v", ok, err)
+	}
+	bad := []follower{
+		{Binary_Record_Size: 4, Binary_Length_Bytes: 2},
+		{Binary_Record_Size: -1},
+		{Binary_Record_Size: 32, Binary_Max_Record_Size: 16},
+		{Binary_Length_Bytes: 3},
+		{Binary_Length_Bytes: 2, Binary_Length_Offset: -1},
+		{Binary_Length_Bytes: 4, Binary_Length_Offset: 2, Binary_Header_Size: 4},
+		{Binary_Length_Bytes: 4, Binary_Max_Record_Size: binaryMaxRecordLimit + 1},
+	}
+	for _, f := range bad {
+		if _, _, err := f.BinaryLayout(); err == nil {
+			t.Fatalf("Failed to catch bad binary layout %+v", f)
+		}
+	}
+}
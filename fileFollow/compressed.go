@@ -0,0 +1,411 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingesters/v3/utils"
+	ft "github.com/h2non/filetype"
+)
+
+const (
+	compressedStateSuffix        = `.compressed`
+	compressedScanInterval       = 10 * time.Second
+	compressedExpireInterval     = time.Hour
+	compressedMaxRecord      int = 16 * 1024 * 1024
+)
+
+var (
+	ErrCompressedManagerStarted = errors.New("Compressed file manager already started")
+)
+
+// compressedFollower describes a set of compressed files that are decompressed
+// and ingested once, instead of being followed as they grow
+type compressedFollower struct {
+	name      string
+	base      string
+	filters   []string
+	recursive bool
+	hnd       logHandler
+	rx        *regexp.Regexp //nil means line delimited
+	skip      func(os.FileInfo, time.Time) bool
+}
+
+type compressedState struct {
+	Size    int64
+	ModTime time.Time
+	Missing time.Time //when the file was first seen missing, zero while it exists
+}
+
+// compressedManager periodically scans for compressed files and records which
+// have been ingested in a state file that lives beside the follower state file.
+// A file is only ingested once it is no longer being written, its size and modification
+// time must be unchanged since the previous scan or it must not have been modified for
+// a full scan interval.  Entries for files that have been missing longer than the
+// retention are dropped.
+type compressedManager struct {
+	sync.Mutex
+	st         *utils.State
+	done       map[string]compressedState
+	pending    map[string]compressedState //files seen by the last scan that may still be written
+	retention  time.Duration              //zero keeps entries forever
+	lastExpire time.Time
+	flwrs      []compressedFollower
+	lgr        ingest.IngestLogger
+	quit       chan bool
+	wg         sync.WaitGroup
+}
+
+func newCompressedManager(statePath string, retention time.Duration, lgr ingest.IngestLogger) (cm *compressedManager, err error) {
+	var st *utils.State
+	if st, err = utils.NewState(statePath+compressedStateSuffix, 0660); err != nil {
+		return
+	}
+	done := map[string]compressedState{}
+	if err = st.Read(&done); err == utils.ErrNoState {
+		err = nil
+	} else if err != nil {
+		return
+	}
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	cm = &compressedManager{
+		st:        st,
+		done:      done,
+		pending:   map[string]compressedState{},
+		retention: retention,
+		lgr:       lgr,
+	}
+	//expire at startup as well, the manager is only started when there are compressed followers
+	if cm.expire(time.Now()) {
+		err = cm.st.Write(cm.done)
+	}
+	return
+}
+
+func (cm *compressedManager) SetLogger(lgr ingest.IngestLogger) {
+	cm.Lock()
+	defer cm.Unlock()
+	if lgr == nil {
+		cm.lgr = ingest.NoLogger()
+	} else {
+		cm.lgr = lgr
+	}
+}
+
+// Add registers a follower with the compressed file manager
+func (cm *compressedManager) Add(name string, f follower, hnd logHandler, ecfg filewatch.FollowerEngineConfig) (err error) {
+	var cf compressedFollower
+	if cf, err = newCompressedFollower(name, f, f.Compressed_File_Filter, hnd, ecfg); err != nil {
+		return
+	}
+	cm.Lock()
+	cm.flwrs = append(cm.flwrs, cf)
+	cm.Unlock()
+	return
+}
+
+func newCompressedFollower(name string, f follower, filter string, hnd logHandler, ecfg filewatch.FollowerEngineConfig) (cf compressedFollower, err error) {
+	cf = compressedFollower{
+		name:      name,
+		base:      f.Base_Directory,
+		filters:   splitFilters(filter),
+		recursive: f.Recursive,
+		hnd:       hnd,
+		skip:      f.SkipFile,
+	}
+	if ecfg.Engine == filewatch.RegexEngine {
+		cf.rx, err = regexp.Compile(ecfg.EngineArgs)
+	}
+	return
+}
+
+// Count returns the number of followers with compressed file filters
+func (cm *compressedManager) Count() int {
+	cm.Lock()
+	defer cm.Unlock()
+	return len(cm.flwrs)
+}
+
+func (cm *compressedManager) Start() error {
+	cm.Lock()
+	defer cm.Unlock()
+	if cm.quit != nil {
+		return ErrCompressedManagerStarted
+	}
+	cm.quit = make(chan bool)
+	cm.wg.Add(1)
+	go cm.routine()
+	return nil
+}
+
+func (cm *compressedManager) Close() error {
+	cm.Lock()
+	if cm.quit != nil {
+		close(cm.quit)
+	}
+	cm.Unlock()
+	cm.wg.Wait()
+	cm.Lock()
+	defer cm.Unlock()
+	cm.quit = nil
+	return cm.st.Write(cm.done)
+}
+
+func (cm *compressedManager) routine() {
+	defer cm.wg.Done()
+	tckr := time.NewTicker(compressedScanInterval)
+	defer tckr.Stop()
+	for {
+		cm.scan()
+		select {
+		case <-tckr.C:
+		case <-cm.quit:
+			return
+		}
+	}
+}
+
+func (cm *compressedManager) quitting() bool {
+	select {
+	case <-cm.quit:
+		return true
+	default:
+	}
+	return false
+}
+
+func (cm *compressedManager) scan() {
+	cm.Lock()
+	flwrs := cm.flwrs
+	cm.Unlock()
+	var dirty bool
+	pending := map[string]compressedState{}
+	for _, cf := range flwrs {
+		walkFiles(cf.base, cf.recursive, func(p string, fi os.FileInfo) error {
+			if cm.quitting() {
+				return errScanAbort
+			} else if !cf.match(fi.Name()) || cm.ingested(cf.name, p, fi) {
+				return nil
+			}
+			key := compressedKey(cf.name, p)
+			cs := compressedState{Size: fi.Size(), ModTime: fi.ModTime()}
+			if now := time.Now(); cf.skip(fi, now) {
+				cm.lgr.Info("file_follower skipping compressed file %s, it is too old or too large", p)
+			} else if !cm.settled(key, cs, now) {
+				//check again on the next scan, it may still be written
+				pending[key] = cs
+				return nil
+			} else if err := cf.ingest(p, fi.ModTime()); err != nil {
+				//the file stopped changing, reading it again would only repeat the entries that
+				//were ingested before the error.  It is retried if it changes.
+				cm.lgr.Error("file_follower failed to ingest compressed file %s, it will not be retried until it changes: %v", p, err)
+			} else {
+				cm.lgr.Info("file_follower ingested compressed file %s", p)
+			}
+			cm.Lock()
+			cm.done[key] = cs
+			cm.Unlock()
+			dirty = true
+			return nil
+		})
+	}
+	if !cm.quitting() {
+		cm.Lock()
+		cm.pending = pending
+		cm.Unlock()
+	}
+	if cm.expire(time.Now()) {
+		dirty = true
+	}
+	if dirty {
+		cm.Lock()
+		if err := cm.st.Write(cm.done); err != nil {
+			cm.lgr.Error("file_follower failed to write compressed file states: %v", err)
+		}
+		cm.Unlock()
+	}
+}
+
+// ingested returns true if the compressed file has already been ingested by the named follower
+func (cm *compressedManager) ingested(name, p string, fi os.FileInfo) bool {
+	cm.Lock()
+	prev, ok := cm.done[compressedKey(name, p)]
+	cm.Unlock()
+	return ok && prev.Size == fi.Size() && prev.ModTime.Equal(fi.ModTime())
+}
+
+// settled returns true if a compressed file is no longer being written, either the last
+// scan saw the same size and modification time or it has not been modified for a scan interval
+func (cm *compressedManager) settled(key string, cs compressedState, now time.Time) bool {
+	cm.Lock()
+	prev, ok := cm.pending[key]
+	cm.Unlock()
+	if ok && prev.Size == cs.Size && prev.ModTime.Equal(cs.ModTime) {
+		return true
+	}
+	return now.Sub(cs.ModTime) >= compressedScanInterval
+}
+
+// expire drops entries for files that have been missing for the retention period, files
+// are checked at most once per compressedExpireInterval
+func (cm *compressedManager) expire(now time.Time) (dirty bool) {
+	cm.Lock()
+	defer cm.Unlock()
+	if cm.retention <= 0 || now.Sub(cm.lastExpire) < compressedExpireInterval {
+		return
+	}
+	cm.lastExpire = now
+	for k, v := range cm.done {
+		_, p := splitCompressedKey(k)
+		if _, err := os.Stat(p); err == nil {
+			if !v.Missing.IsZero() {
+				v.Missing = time.Time{}
+				cm.done[k] = v
+				dirty = true
+			}
+			continue
+		} else if !os.IsNotExist(err) {
+			continue //an unavailable share is not a missing file
+		}
+		if v.Missing.IsZero() {
+			v.Missing = now
+			cm.done[k] = v
+		} else if now.Sub(v.Missing) >= cm.retention {
+			delete(cm.done, k)
+			cm.lgr.Info("file_follower dropped state for %s, missing since %v", p, v.Missing)
+		}
+		dirty = true
+	}
+	return
+}
+
+// expireState returns true if the state of a file that a scan did not see should be
+// dropped.  A file that still exists no longer matches its follower and is dropped right
+// away, a missing file is dropped once it has been gone for the retention period.  The
+// missing map holds when each file was first found missing, an unavailable share is not
+// a missing file.
+func expireState(k string, missing map[string]time.Time, retention time.Duration, now time.Time, lgr ingest.IngestLogger) bool {
+	_, p := splitCompressedKey(k)
+	if _, err := os.Stat(p); err == nil {
+		delete(missing, k)
+		return true
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+	since, ok := missing[k]
+	if !ok {
+		missing[k] = now
+		return false
+	} else if retention <= 0 || now.Sub(since) < retention {
+		return false
+	}
+	delete(missing, k)
+	lgr.Info("file_follower dropped state for %s, missing since %v", p, since)
+	return true
+}
+
+func compressedKey(name, p string) string {
+	return name + `:` + p
+}
+
+func splitCompressedKey(k string) (name, p string) {
+	if idx := strings.Index(k, `:`); idx >= 0 {
+		return k[:idx], k[idx+1:]
+	}
+	return ``, k
+}
+
+func (cf compressedFollower) match(name string) bool {
+	return matchFilters(cf.filters, name)
+}
+
+// ingest decompresses a single file, entries without a timestamp get the modification time of the file
+func (cf compressedFollower) ingest(p string, mtime time.Time) (err error) {
+	var tp, _ = ft.MatchFile(p)
+	if tp.MIME.Subtype == `zip` {
+		var zr *zip.ReadCloser
+		if zr, err = zip.OpenReader(p); err != nil {
+			return
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			var rdr io.ReadCloser
+			if rdr, err = zf.Open(); err != nil {
+				return
+			}
+			err = cf.process(rdr, zf.Modified)
+			rdr.Close()
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	var rdr utils.ReadResetCloser
+	if rdr, err = utils.OpenFileReader(p); err != nil {
+		return
+	}
+	defer rdr.Close()
+	return cf.process(rdr, mtime)
+}
+
+func (cf compressedFollower) process(rdr io.Reader, ts time.Time) error {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	s := bufio.NewScanner(rdr)
+	s.Buffer(make([]byte, 64*1024), compressedMaxRecord)
+	if cf.rx != nil {
+		s.Split(regexSplitter(cf.rx))
+	}
+	for s.Scan() {
+		//the scanner reuses its buffer, so hand out a copy
+		if err := cf.hnd.HandleLog(append([]byte(nil), s.Bytes()...), ts); err != nil {
+			return err
+		}
+	}
+	return s.Err()
+}
+
+// regexSplitter splits records at each match of rx, the same way the filewatch regex engine does
+func regexSplitter(rx *regexp.Regexp) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+		if idxs := rx.FindIndex(data); len(idxs) == 2 {
+			if idxs[0] > 0 {
+				return idxs[0], data[:idxs[0]], nil
+			} else if idxs2 := rx.FindIndex(data[idxs[1]:]); len(idxs2) == 2 {
+				idx := idxs[1] + idxs2[0]
+				return idx, data[:idx], nil
+			}
+		}
+		if atEOF {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
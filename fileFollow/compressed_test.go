@@ -0,0 +1,94 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+)
+
+func TestCompressedWaitsForWriter(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `compressed`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, `logs`)
+	if err = os.Mkdir(logs, 0770); err != nil {
+		t.Fatal(err)
+	}
+	var c captureHandler
+	f := follower{
+		Base_Directory:         logs,
+		Compressed_File_Filter: `*.gz`,
+	}
+	cm, err := newCompressedManager(filepath.Join(dir, `state`), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cm.Add(`test`, f, &c, filewatch.FollowerEngineConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	bb := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(bb)
+	gz.Write([]byte("one\ntwo\n"))
+	gz.Close()
+	full := bb.Bytes()
+	p := filepath.Join(logs, `a.gz`)
+
+	//a file that is still being written is left alone until it stops changing
+	if err = ioutil.WriteFile(p, full[:len(full)/2], 0660); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	if err = ioutil.WriteFile(p, full, 0660); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Second)
+	if err = os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	if len(c.lines) != 0 {
+		t.Fatalf("ingested a file that was still changing: %q", c.lines)
+	}
+	cm.scan()
+	if len(c.lines) != 2 || c.lines[0] != `one` || c.lines[1] != `two` {
+		t.Fatalf("bad lines %q", c.lines)
+	}
+	cm.scan()
+	if len(c.lines) != 2 {
+		t.Fatalf("ingested a file twice: %q", c.lines)
+	}
+	c.reset()
+
+	//files that have not been modified for a scan interval are picked up right away
+	p = filepath.Join(logs, `b.gz`)
+	if err = ioutil.WriteFile(p, full, 0660); err != nil {
+		t.Fatal(err)
+	}
+	mtime = time.Now().Add(-compressedScanInterval)
+	if err = os.Chtimes(p, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	if len(c.lines) != 2 {
+		t.Fatalf("bad lines %q", c.lines)
+	}
+	if err = cm.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
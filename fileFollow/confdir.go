@@ -0,0 +1,174 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/config"
+)
+
+const (
+	configDirExt      = `.conf`
+	configDirInterval = 30 * time.Second
+)
+
+var (
+	ErrDuplicateFollower = errors.New("Duplicate follower")
+)
+
+// cfgDirReadType is the content of a file in the Follower-Config-Dir, only follower
+// definitions are allowed
+type cfgDirReadType struct {
+	Follower map[string]*follower
+}
+
+// configDirFiles returns the config files in a Follower-Config-Dir in name order.  Only
+// regular files ending in .conf are read and hidden files are ignored, so provisioning
+// tools can write a temporary file and rename it into place.
+func configDirFiles(dir string) (files []string, sig string, err error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var sb strings.Builder
+	for _, fi := range fis {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || strings.HasPrefix(name, `.`) || filepath.Ext(name) != configDirExt {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+		fmt.Fprintf(&sb, "%s:%d:%d\n", name, fi.Size(), fi.ModTime().UnixNano())
+	}
+	sig = sb.String()
+	return
+}
+
+// loadConfigDir adds the followers defined in the Follower-Config-Dir to the configuration,
+// a follower name may only be defined once across all files
+func loadConfigDir(dir string, c *cfgType) error {
+	files, _, err := configDirFiles(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read Follower-Config-Dir %s: %v", dir, err)
+	}
+	if c.Follower == nil {
+		c.Follower = map[string]*follower{}
+	}
+	for _, p := range files {
+		var cr cfgDirReadType
+		if err := config.LoadConfigFile(&cr, p); err != nil {
+			return fmt.Errorf("Failed to load %s: %v", p, err)
+		}
+		for k, v := range cr.Follower {
+			if _, ok := c.Follower[k]; ok {
+				return fmt.Errorf("%v %q in %s", ErrDuplicateFollower, k, p)
+			}
+			c.Follower[k] = v
+		}
+	}
+	return nil
+}
+
+// configDirMonitor periodically checks the Follower-Config-Dir and signals on its channel
+// when a file is added, removed, or changed so the configuration can be reloaded
+type configDirMonitor struct {
+	mtx  sync.Mutex
+	dir  string
+	sig  string
+	lgr  ingest.IngestLogger
+	ch   chan bool
+	quit chan bool
+	wg   sync.WaitGroup
+}
+
+func newConfigDirMonitor(dir string, lgr ingest.IngestLogger) *configDirMonitor {
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	cdm := &configDirMonitor{
+		dir: dir,
+		lgr: lgr,
+		ch:  make(chan bool, 1),
+	}
+	if dir != `` {
+		_, cdm.sig, _ = configDirFiles(dir)
+	}
+	return cdm
+}
+
+// C returns a channel that is notified when the configuration directory changes
+func (cdm *configDirMonitor) C() <-chan bool {
+	return cdm.ch
+}
+
+func (cdm *configDirMonitor) Start() {
+	cdm.mtx.Lock()
+	defer cdm.mtx.Unlock()
+	if cdm.quit != nil || cdm.dir == `` {
+		return
+	}
+	cdm.quit = make(chan bool)
+	cdm.wg.Add(1)
+	go cdm.routine()
+}
+
+func (cdm *configDirMonitor) Close() {
+	cdm.mtx.Lock()
+	if cdm.quit != nil {
+		close(cdm.quit)
+	}
+	cdm.mtx.Unlock()
+	cdm.wg.Wait()
+	cdm.mtx.Lock()
+	cdm.quit = nil
+	cdm.mtx.Unlock()
+}
+
+func (cdm *configDirMonitor) routine() {
+	defer cdm.wg.Done()
+	tckr := time.NewTicker(configDirInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+			if cdm.check() {
+				select {
+				case cdm.ch <- true:
+				default: //a reload is already pending
+				}
+			}
+		case <-cdm.quit:
+			return
+		}
+	}
+}
+
+// check returns true if the directory listing changed since the last check
+func (cdm *configDirMonitor) check() bool {
+	_, sig, err := configDirFiles(cdm.dir)
+	if err != nil {
+		cdm.lgr.Warn("file_follower failed to read Follower-Config-Dir %s: %v", cdm.dir, err)
+		return false
+	}
+	cdm.mtx.Lock()
+	defer cdm.mtx.Unlock()
+	if sig == cdm.sig {
+		return false
+	}
+	cdm.sig = sig
+	cdm.lgr.Info("file_follower Follower-Config-Dir %s changed", cdm.dir)
+	return true
+}
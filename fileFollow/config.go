@@ -11,6 +11,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
@@ -18,6 +20,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gravwell/filewatch/v3"
 	"github.com/gravwell/ingest/v3"
 	"github.com/gravwell/ingest/v3/config"
 	"github.com/gravwell/ingest/v3/processors"
@@ -31,7 +34,21 @@ const (
 
 var (
 	ErrInvalidStateStoreLocation         = errors.New("Empty state storage location")
-	ErrTimestampDelimiterMissingOverride = errors.New("Timestamp delimiting requires a defined timestamp override")
+	ErrTimestampDelimiterMissingOverride = errors.New("Timestamp delimiting requires a defined timestamp override or format")
+	ErrTimestampFormatAndOverride        = errors.New("Timestamp-Format and Timestamp-Format-Override are mutually exclusive")
+	ErrBinaryTextOptions                 = errors.New("Binary records cannot be combined with CSV-Handler, Record-Start-Regex, Timestamp-Delimited, Compressed-File-Filter, Post-Ingest-Action, Follow-Symlinks, or Mask-Regex")
+	ErrNoLayoutFields                    = errors.New("Timestamp-Format must be a timegrinder format name or a Go time layout such as 2006-01-02 15:04:05.000")
+	ErrRecordStartAndTimestampDelimited  = errors.New("Record-Start-Regex and Timestamp-Delimited are mutually exclusive")
+	ErrInvalidPostAction                 = errors.New("Invalid Post-Ingest-Action, must be delete or move")
+	ErrMissingArchiveDirectory           = errors.New("Post-Ingest-Action move requires an Archive-Directory")
+	ErrUTF16RecordOptions                = errors.New("UTF-16 encodings cannot be combined with Record-Start-Regex or Timestamp-Delimited")
+	ErrCSVColumnsWithoutHandler          = errors.New("CSV-Timestamp-Column requires CSV-Handler")
+	ErrCSVOptions                        = errors.New("CSV-Handler cannot be combined with Record-Start-Regex, Timestamp-Delimited, Compressed-File-Filter, Post-Ingest-Action, Follow-Symlinks, or Filename-Tag-Regex")
+	ErrInvalidSourceOverride             = errors.New("Source-Override must be an IP address or UUID")
+	ErrInvalidStatsInterval              = errors.New("Stats-Interval must be a positive duration such as 5m")
+	ErrInvalidStartupDuration            = errors.New("Startup-Delay and Startup-Retry-Window must be non-negative durations such as 30s")
+	ErrInvalidStateRetention             = errors.New("State-Retention-Days may not be negative")
+	ErrInvalidCheckpointInterval         = errors.New("Checkpoint-Interval must be a duration such as 10s")
 )
 
 type bindType int
@@ -50,10 +67,42 @@ type follower struct {
 	Ignore_Timestamps         bool //Just apply the current timestamp to lines as we get them
 	Assume_Local_Timezone     bool
 	Recursive                 bool // Should we descend into child directories?
+	Follow_Symlinks           bool // follow symlinks to matching files and, when recursive, to directories
 	Ignore_Line_Prefix        []string
-	Timestamp_Format_Override string //override the timestamp format
+	Ignore_Line_Regex         []string // lines matching any of these are dropped
+	Require_Line_Regex        []string // if set, only lines matching at least one of these are ingested
+	Timestamp_Format_Override string   //override the timestamp format
+	Timestamp_Format          string   // explicit timegrinder format name or Go time layout, disables auto-detection
 	Timestamp_Delimited       bool
 	Timezone_Override         string
+	Record_Start_Regex        string   // regex matching the beginning of a multi-line record
+	Max_Record_Lines          int      // maximum lines in a multi-line record before it is split
+	Max_Record_Bytes          int      // maximum bytes in a multi-line record before it is split
+	Encoding                  string   // character encoding of followed files, lines are transcoded to UTF-8, use utf-16le or utf-16be for UTF-16 text beyond ASCII
+	Network_Share             bool     // base directory is on a network share that may disappear, UNC paths are always treated as shares
+	Source_Override           string   // IP or UUID applied as the source of entries from this follower
+	JSON_Tag_Field            string   // JSON field used to select the tag for each entry
+	JSON_Tag_Match            []string // value:tag pairs for the JSON-Tag-Field
+	Filename_Tag_Regex        string   // regex applied to file names, its captures are expanded into Filename-Tag
+	Filename_Tag              string   // tag template such as svc_${svc}, files that do not match use Tag-Name
+	Quarantine_Tag            string   // records without a timestamp, malformed CSV rows, and lines matching no Require-Line-Regex go here unmodified
+	Mask_Regex                []string // matches are masked before records leave the host, quarantined records included
+	Mask_Replacement          string   // replacement for Mask-Regex matches, may reference captures such as ${1}, defaults to ****
+	CSV_Handler               bool     // treat the first row of each file as its CSV header
+	CSV_Timestamp_Column      string   // column the timestamp is extracted from
+	Binary_Record_Size        int      // files hold fixed size binary records of this many bytes
+	Binary_Length_Bytes       int      // files hold binary records prefixed with a length field of 1, 2, 4, or 8 bytes
+	Binary_Length_Offset      int      // offset of the length field in the record header
+	Binary_Header_Size        int      // record header size, defaults to the end of the length field
+	Binary_Big_Endian         bool     // the length field is big endian, the default is little endian
+	Binary_Length_Inclusive   bool     // the length field counts the header as well as the body
+	Binary_Max_Record_Size    int      // records longer than this are treated as corrupt
+	Compressed_File_Filter    string   // globs for gzip, bzip2, and zip files that are decompressed and ingested once
+	Ignore_Older_Than_Days    int      // files not modified in this many days are skipped when first discovered
+	Ignore_Larger_Than_Bytes  int64    // files larger than this are skipped when first discovered
+	Post_Ingest_Action        string   // delete or move files once they are completely ingested and idle
+	Post_Ingest_Idle_Time     string   // how long a completely ingested file must be untouched before the action is taken
+	Archive_Directory         string   // destination directory for the move action
 	Preprocessor              []string
 }
 
@@ -61,6 +110,14 @@ type global struct {
 	config.IngestConfig
 	Max_Files_Watched    int
 	State_Store_Location string
+	Stats_Interval       string // how often per-follower stats are logged, stats are not logged if empty
+	Control_Socket       string // unix socket, or named pipe on Windows, accepting pause and resume commands
+	Follower_Config_Dir  string // directory of .conf files holding more Follower definitions, checked for changes periodically
+	State_Retention_Days int    // compressed, binary, and CSV file states are dropped once the file has been missing this many days, 0 keeps them forever
+	Checkpoint_Interval  string // how often follower offsets are written, by default every minute for followed files and every second for binary and CSV files while changing
+	Disable_State_Fsync  bool   // write state files without syncing them to disk, a crash may repeat recently ingested records
+	Startup_Delay        string // Windows service only, how long to wait before connecting to the indexers
+	Startup_Retry_Window string // Windows service only, how long to keep retrying indexers that cannot be resolved or reached
 }
 
 type cfgType struct {
@@ -80,6 +137,11 @@ func GetConfig(path string) (*cfgType, error) {
 		Follower:     cr.Follower,
 		Preprocessor: cr.Preprocessor,
 	}
+	if c.Follower_Config_Dir != `` {
+		if err := loadConfigDir(c.Follower_Config_Dir, c); err != nil {
+			return nil, err
+		}
+	}
 	if err := verifyConfig(c); err != nil {
 		return nil, err
 	}
@@ -114,13 +176,97 @@ func verifyConfig(c *cfgType) error {
 		if len(v.Tag_Name) == 0 {
 			v.Tag_Name = `default`
 		}
-		if v.Timestamp_Delimited && v.Timestamp_Format_Override == `` {
+		if v.Timestamp_Delimited && v.Timestamp_Format_Override == `` && v.Timestamp_Format == `` {
 			return ErrTimestampDelimiterMissingOverride
 		}
+		if v.Timestamp_Format != `` {
+			if v.Timestamp_Format_Override != `` {
+				return fmt.Errorf("%v in follower %v", ErrTimestampFormatAndOverride, k)
+			} else if _, err := v.timestampProcessor(); err != nil {
+				return fmt.Errorf("Invalid Timestamp-Format %q in follower %v: %v", v.Timestamp_Format, k, err)
+			}
+		}
 		if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
 			return errors.New("Invalid characters in the Tag-Name for " + k)
 		}
-		v.Base_Directory = filepath.Clean(v.Base_Directory)
+		if v.Record_Start_Regex != `` {
+			if v.Timestamp_Delimited {
+				return ErrRecordStartAndTimestampDelimited
+			}
+			if _, _, err := v.RecordDelimited(); err != nil {
+				return fmt.Errorf("Invalid Record-Start-Regex in follower %v: %v", k, err)
+			}
+		}
+		for _, f := range splitFilters(v.Compressed_File_Filter) {
+			if _, err := filepath.Match(f, `test`); err != nil {
+				return fmt.Errorf("Invalid Compressed-File-Filter %q in follower %v: %v", f, k, err)
+			}
+		}
+		if _, err := newFilterHandler(v.Ignore_Line_Prefix, v.Ignore_Line_Regex, v.Require_Line_Regex, nil, nil); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		}
+		if _, err := newMaskHandler(v.Mask_Regex, v.Mask_Replacement, nil); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		}
+		if _, err := v.SourceOverride(); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		}
+		if _, _, err := v.TagMatchers(); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		}
+		if ft, err := v.FilenameTagger(); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		} else if _, bin, _ := v.BinaryLayout(); ft != nil && (bin || v.Follow_Symlinks) {
+			return fmt.Errorf("%v in follower %v", ErrFilenameTagOptions, k)
+		}
+		if !v.CSV_Handler && v.CSV_Timestamp_Column != `` {
+			return fmt.Errorf("%v in follower %v", ErrCSVColumnsWithoutHandler, k)
+		} else if v.CSV_Handler {
+			if _, err := v.newCSVHandler(nil, nil, nil); err != nil {
+				return fmt.Errorf("Invalid CSV timestamp settings in follower %v: %v", k, err)
+			}
+			//CSV files are read a row at a time by the CSV file manager
+			if v.Record_Start_Regex != `` || v.Timestamp_Delimited || v.Compressed_File_Filter != `` ||
+				v.Post_Ingest_Action != `` || v.Follow_Symlinks || v.Filename_Tag_Regex != `` {
+				return fmt.Errorf("%v in follower %v", ErrCSVOptions, k)
+			}
+		}
+		if _, err := newEncodingHandler(v.Encoding, nil); err != nil {
+			return fmt.Errorf("Invalid Encoding in follower %v: %v", k, err)
+		} else if utf16Encoding(v.Encoding) != noUTF16 && (v.Record_Start_Regex != `` || v.Timestamp_Delimited) {
+			//the record regexes would run against the raw UTF-16 bytes
+			return fmt.Errorf("%v in follower %v", ErrUTF16RecordOptions, k)
+		}
+		if v.Max_Record_Lines < 0 || v.Max_Record_Bytes < 0 {
+			return fmt.Errorf("Max-Record-Lines and Max-Record-Bytes may not be negative in follower %v", k)
+		}
+		if _, ok, err := v.BinaryLayout(); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		} else if ok && (v.CSV_Handler || v.Record_Start_Regex != `` || v.Timestamp_Delimited ||
+			v.Compressed_File_Filter != `` || v.Post_Ingest_Action != `` || v.Follow_Symlinks || len(v.Mask_Regex) > 0) {
+			return fmt.Errorf("%v in follower %v", ErrBinaryTextOptions, k)
+		}
+		if v.Ignore_Older_Than_Days < 0 || v.Ignore_Larger_Than_Bytes < 0 {
+			return fmt.Errorf("Ignore-Older-Than-Days and Ignore-Larger-Than-Bytes may not be negative in follower %v", k)
+		}
+		if pa, err := parsePostAction(v.Post_Ingest_Action); err != nil {
+			return fmt.Errorf("%v in follower %v", err, k)
+		} else if pa == postActionMove {
+			if v.Archive_Directory == `` {
+				return fmt.Errorf("%v in follower %v", ErrMissingArchiveDirectory, k)
+			}
+			v.Archive_Directory = longPath(filepath.Clean(v.Archive_Directory))
+			//files moved back into the watched tree would just be ingested again
+			if rel, err := filepath.Rel(longPath(filepath.Clean(v.Base_Directory)), v.Archive_Directory); err == nil &&
+				(rel == `.` || (v.Recursive && !strings.HasPrefix(rel, `..`))) {
+				return fmt.Errorf("Archive-Directory may not be inside the Base-Directory in follower %v", k)
+			}
+		}
+		if _, err := v.PostIngestIdle(); err != nil {
+			return fmt.Errorf("Invalid Post-Ingest-Idle-Time in follower %v: %v", k, err)
+		}
+		//extended-length paths on Windows so deep trees past MAX_PATH can be followed
+		v.Base_Directory = longPath(filepath.Clean(v.Base_Directory))
 		if v.Timezone_Override != "" {
 			if v.Assume_Local_Timezone {
 				// cannot do both
@@ -148,6 +294,17 @@ func (c *cfgType) Tags() ([]string, error) {
 			tags = append(tags, v.Tag_Name)
 			tagMp[v.Tag_Name] = true
 		}
+		_, matches, _ := v.TagMatchers()
+		for _, tag := range matches {
+			if _, ok := tagMp[tag]; !ok {
+				tags = append(tags, tag)
+				tagMp[tag] = true
+			}
+		}
+		if v.Quarantine_Tag != `` && !tagMp[v.Quarantine_Tag] {
+			tags = append(tags, v.Quarantine_Tag)
+			tagMp[v.Quarantine_Tag] = true
+		}
 	}
 	if len(tags) == 0 {
 		return nil, errors.New("No tags specified")
@@ -174,21 +331,26 @@ func (f follower) TimestampDelimited() (rex string, ok bool, err error) {
 	if !f.Timestamp_Delimited {
 		return
 	}
-	if f.Timestamp_Format_Override == `` {
-		err = ErrTimestampDelimiterMissingOverride
-		return
-	}
-	//fir eup a timegrinder, set the override, and extract the regex in use
-	cfg := timegrinder.Config{
-		FormatOverride: f.Timestamp_Format_Override,
-	}
 	var tg *timegrinder.TimeGrinder
 	var proc timegrinder.Processor
-	if tg, err = timegrinder.New(cfg); err != nil {
-		return
-	}
-	if proc, err = tg.OverrideProcessor(); err != nil {
+	if f.Timestamp_Format != `` {
+		if proc, err = f.timestampProcessor(); err != nil {
+			return
+		}
+	} else if f.Timestamp_Format_Override == `` {
+		err = ErrTimestampDelimiterMissingOverride
 		return
+	} else {
+		//fir eup a timegrinder, set the override, and extract the regex in use
+		cfg := timegrinder.Config{
+			FormatOverride: f.Timestamp_Format_Override,
+		}
+		if tg, err = timegrinder.New(cfg); err != nil {
+			return
+		}
+		if proc, err = tg.OverrideProcessor(); err != nil {
+			return
+		}
 	}
 	if rex = proc.ExtractionRegex(); rex == `` {
 		err = errors.New("Missing timestamp processor extraction string")
@@ -210,6 +372,110 @@ func (f follower) TimestampDelimited() (rex string, ok bool, err error) {
 	return
 }
 
+// RecordDelimited returns the regular expression used to split multi-line records
+// the start-of-record regex is anchored to line breaks the same way a timestamp delimiter is
+func (f follower) RecordDelimited() (rex string, ok bool, err error) {
+	if rex = strings.TrimSpace(f.Record_Start_Regex); rex == `` {
+		return
+	}
+	//group the regex so every branch of an alternation is anchored to the line break
+	rex = `\n(?:` + strings.TrimPrefix(strings.TrimPrefix(rex, `\A`), `^`) + `)`
+	if _, err = regexp.Compile(rex); err != nil {
+		return
+	}
+	ok = true
+	return
+}
+
+// Engine returns the filewatch reader engine and arguments needed by the follower
+func (f follower) Engine() (cfg filewatch.FollowerEngineConfig, err error) {
+	var rex string
+	var ok bool
+	if rex, ok, err = f.TimestampDelimited(); err != nil {
+		return
+	} else if !ok {
+		if rex, ok, err = f.RecordDelimited(); err != nil {
+			return
+		}
+	}
+	if !ok {
+		//UTF-16 characters may contain a 0x0A byte, split on the newline code unit instead
+		switch utf16Encoding(f.Encoding) {
+		case utf16LE:
+			rex, ok = utf16LENewline, true
+		case utf16BE:
+			rex, ok = utf16BENewline, true
+		}
+	}
+	if ok {
+		cfg.Engine = filewatch.RegexEngine
+		cfg.EngineArgs = rex
+	} else {
+		cfg.Engine = filewatch.LineEngine
+	}
+	return
+}
+
+// PostIngestIdle returns how long a file must be idle before the post ingest action is applied
+func (f follower) PostIngestIdle() (d time.Duration, err error) {
+	if f.Post_Ingest_Idle_Time == `` {
+		d = defaultPostActionIdle
+	} else if d, err = time.ParseDuration(f.Post_Ingest_Idle_Time); err == nil && d < 0 {
+		err = errors.New("Negative duration")
+	}
+	return
+}
+
+// SourceOverride returns the source for entries from this follower, a nil IP means
+// the global source should be used.  UUIDs are stored in the 16 byte source field.
+func (f follower) SourceOverride() (ip net.IP, err error) {
+	v := strings.TrimSpace(f.Source_Override)
+	if len(v) == 0 {
+		return
+	}
+	if ip = net.ParseIP(v); ip != nil {
+		return
+	}
+	if id, lerr := uuid.Parse(v); lerr == nil {
+		ip = net.IP(id[:])
+	} else {
+		err = ErrInvalidSourceOverride
+	}
+	return
+}
+
+// NetworkShare returns true if the base directory may be unavailable for periods of time
+// SkipFile returns true if a newly discovered file is too old or too large to ingest
+func (f follower) SkipFile(fi os.FileInfo, now time.Time) bool {
+	if f.Ignore_Larger_Than_Bytes > 0 && fi.Size() > f.Ignore_Larger_Than_Bytes {
+		return true
+	}
+	return f.Ignore_Older_Than_Days > 0 && now.Sub(fi.ModTime()) > time.Duration(f.Ignore_Older_Than_Days)*24*time.Hour
+}
+
+// SkipRules returns true if the follower skips old or large files
+func (f follower) SkipRules() bool {
+	return f.Ignore_Older_Than_Days > 0 || f.Ignore_Larger_Than_Bytes > 0
+}
+
+func (f follower) NetworkShare() bool {
+	return f.Network_Share || isUNCPath(f.Base_Directory)
+}
+
+// isUNCPath returns true for \\server\share and \\?\UNC\server\share paths
+func isUNCPath(p string) bool {
+	if strings.HasPrefix(p, `\\?\`) {
+		return strings.HasPrefix(strings.ToUpper(p), `\\?\UNC\`)
+	}
+	return strings.HasPrefix(p, `\\`)
+}
+
+// IgnoreTimestamps returns true if the log handler should not extract timestamps from the line,
+// CSV followers with a timestamp column extract the timestamp themselves
+func (f follower) IgnoreTimestamps() bool {
+	return f.Ignore_Timestamps || (f.CSV_Handler && f.CSV_Timestamp_Column != ``)
+}
+
 func (f follower) TimezoneOverride() string {
 	return f.Timezone_Override
 }
@@ -226,10 +492,65 @@ func (g *global) Verify() (err error) {
 	}
 	if g.State_Store_Location == `` {
 		err = ErrInvalidStateStoreLocation
+	} else if g.Stats_Interval != `` {
+		if d, lerr := time.ParseDuration(g.Stats_Interval); lerr != nil || d <= 0 {
+			err = ErrInvalidStatsInterval
+		}
 	}
+	if err == nil && g.State_Retention_Days < 0 {
+		err = ErrInvalidStateRetention
+	}
+	if d, lerr := parseOptionalDuration(g.Checkpoint_Interval); err == nil && (lerr != nil || d < 0) {
+		err = ErrInvalidCheckpointInterval
+	}
+	for _, v := range []string{g.Startup_Delay, g.Startup_Retry_Window} {
+		if d, lerr := parseOptionalDuration(v); err == nil && (lerr != nil || d < 0) {
+			err = ErrInvalidStartupDuration
+		}
+	}
+	return
+}
+
+func parseOptionalDuration(v string) (time.Duration, error) {
+	if v = strings.TrimSpace(v); v == `` {
+		return 0, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// StartupDelay returns how long the service waits before connecting to the indexers
+func (g *global) StartupDelay() (d time.Duration) {
+	d, _ = parseOptionalDuration(g.Startup_Delay)
+	return
+}
+
+// StartupRetryWindow returns how long the service keeps retrying the indexers at startup,
+// zero means the service gives up after a single Connection-Timeout
+func (g *global) StartupRetryWindow() (d time.Duration) {
+	d, _ = parseOptionalDuration(g.Startup_Retry_Window)
+	return
+}
+
+// StateRetention returns how long state is kept for missing files, zero means forever
+func (g *global) StateRetention() time.Duration {
+	return time.Duration(g.State_Retention_Days) * 24 * time.Hour
+}
+
+// CheckpointInterval returns the minimum time between writes of follower offsets, zero
+// writes followed file offsets every minute and binary and CSV offsets as often as they change
+func (g *global) CheckpointInterval() (d time.Duration) {
+	d, _ = parseOptionalDuration(g.Checkpoint_Interval)
 	return
 }
 
 func (g *global) StatePath() string {
 	return g.State_Store_Location
 }
+
+// StatsInterval returns how often follower stats are logged, zero means never
+func (g *global) StatsInterval() (d time.Duration) {
+	if g.Stats_Interval != `` {
+		d, _ = time.ParseDuration(g.Stats_Interval)
+	}
+	return
+}
@@ -0,0 +1,293 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	controlPause         = `pause`
+	controlResume        = `resume`
+	controlStatus        = `status`
+	controlTimeout       = 5 * time.Second
+	controlMaxLine int64 = 4096
+)
+
+var (
+	//gates live outside of the follower set so a paused follower stays paused across reloads
+	allGates = &gateRegistry{
+		gates: map[string]*followerGate{},
+	}
+
+	ErrUnknownFollower        = errors.New("Unknown follower")
+	ErrInvalidControlCommand  = errors.New("Invalid command, expected pause, resume, or status")
+	ErrControlListenerClosed  = errors.New("Control listener closed")
+	ErrControlCommandRejected = errors.New("Control command failed")
+)
+
+// followerGate pauses a follower by holding its records until it is resumed.  The
+// follower does not read while its handler is held, so nothing is dropped and the file
+// offset does not advance past what was ingested.
+type followerGate struct {
+	sync.Mutex
+	paused chan bool //closed when the follower is resumed, nil while running
+}
+
+func (g *followerGate) pause() {
+	g.Lock()
+	if g.paused == nil {
+		g.paused = make(chan bool)
+	}
+	g.Unlock()
+}
+
+func (g *followerGate) resume() {
+	g.Lock()
+	if g.paused != nil {
+		close(g.paused)
+		g.paused = nil
+	}
+	g.Unlock()
+}
+
+func (g *followerGate) Paused() bool {
+	g.Lock()
+	defer g.Unlock()
+	return g.paused != nil
+}
+
+// wait blocks while the follower is paused, closing done releases it so the follower set
+// can shut down
+func (g *followerGate) wait(done chan bool) {
+	g.Lock()
+	c := g.paused
+	g.Unlock()
+	if c == nil {
+		return
+	}
+	select {
+	case <-c:
+	case <-done:
+	}
+}
+
+type gateRegistry struct {
+	sync.Mutex
+	gates map[string]*followerGate
+}
+
+// get returns the gate for a follower, creating it if needed
+func (gr *gateRegistry) get(name string) *followerGate {
+	gr.Lock()
+	defer gr.Unlock()
+	g, ok := gr.gates[name]
+	if !ok {
+		g = &followerGate{}
+		gr.gates[name] = g
+	}
+	return g
+}
+
+func (gr *gateRegistry) lookup(name string) (g *followerGate, ok bool) {
+	gr.Lock()
+	g, ok = gr.gates[name]
+	gr.Unlock()
+	return
+}
+
+func (gr *gateRegistry) names() (r []string) {
+	gr.Lock()
+	for k := range gr.gates {
+		r = append(r, k)
+	}
+	gr.Unlock()
+	sort.Strings(r)
+	return
+}
+
+// pauseHandler sits in front of the handler chain and holds records while the follower is paused
+type pauseHandler struct {
+	lh   logHandler
+	g    *followerGate
+	done chan bool
+}
+
+func (ph *pauseHandler) HandleLog(b []byte, catchts time.Time) error {
+	ph.g.wait(ph.done)
+	return ph.lh.HandleLog(b, catchts)
+}
+
+// controlListener accepts connections on a unix socket or a Windows named pipe
+type controlListener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+}
+
+// controlServer accepts a single command per connection and replies with the result,
+// commands are "pause [follower...]", "resume [follower...]", and "status".  Pause
+// and resume apply to every follower when no names are given.
+type controlServer struct {
+	sync.Mutex
+	l     controlListener
+	lgr   ingest.IngestLogger
+	conns map[io.ReadWriteCloser]bool
+	wg    sync.WaitGroup
+}
+
+func newControlServer(p string, lgr ingest.IngestLogger) (cs *controlServer, err error) {
+	var l controlListener
+	if l, err = listenControl(p); err != nil {
+		return
+	}
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	cs = &controlServer{
+		l:     l,
+		lgr:   lgr,
+		conns: map[io.ReadWriteCloser]bool{},
+	}
+	return
+}
+
+func (cs *controlServer) Start() {
+	cs.wg.Add(1)
+	go cs.routine()
+}
+
+func (cs *controlServer) Close() (err error) {
+	err = cs.l.Close()
+	cs.Lock()
+	for c := range cs.conns {
+		c.Close()
+	}
+	cs.Unlock()
+	cs.wg.Wait()
+	return
+}
+
+func (cs *controlServer) routine() {
+	defer cs.wg.Done()
+	for {
+		c, err := cs.l.Accept()
+		if err != nil {
+			if err != ErrControlListenerClosed {
+				cs.lgr.Error("file_follower control listener failed: %v", err)
+			}
+			return
+		}
+		cs.Lock()
+		cs.conns[c] = true
+		cs.Unlock()
+		cs.wg.Add(1)
+		go cs.handle(c)
+	}
+}
+
+func (cs *controlServer) handle(c io.ReadWriteCloser) {
+	defer cs.wg.Done()
+	defer func() {
+		cs.Lock()
+		delete(cs.conns, c)
+		cs.Unlock()
+		c.Close()
+	}()
+	line, err := bufio.NewReader(io.LimitReader(c, controlMaxLine)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return
+	}
+	resp, err := cs.command(line)
+	if err != nil {
+		resp = fmt.Sprintf("ERROR %v\n", err)
+	}
+	io.WriteString(c, resp)
+}
+
+func (cs *controlServer) command(line string) (resp string, err error) {
+	flds := strings.Fields(line)
+	if len(flds) == 0 {
+		return ``, ErrInvalidControlCommand
+	}
+	cmd, names := strings.ToLower(flds[0]), flds[1:]
+	var sb strings.Builder
+	switch cmd {
+	case controlStatus:
+		for _, name := range allGates.names() {
+			g, _ := allGates.lookup(name)
+			state := `running`
+			if g.Paused() {
+				state = `paused`
+			}
+			fmt.Fprintf(&sb, "%s %s\n", name, state)
+		}
+		return sb.String(), nil
+	case controlPause, controlResume:
+	default:
+		return ``, ErrInvalidControlCommand
+	}
+	if len(names) == 0 {
+		names = allGates.names()
+	}
+	//check every name before changing anything
+	gates := make([]*followerGate, 0, len(names))
+	for _, name := range names {
+		g, ok := allGates.lookup(name)
+		if !ok {
+			return ``, fmt.Errorf("%v %q", ErrUnknownFollower, name)
+		}
+		gates = append(gates, g)
+	}
+	for i, g := range gates {
+		if cmd == controlPause {
+			g.pause()
+			cs.lgr.Info("file_follower paused %s", names[i])
+			fmt.Fprintf(&sb, "OK paused %s\n", names[i])
+		} else {
+			g.resume()
+			cs.lgr.Info("file_follower resumed %s", names[i])
+			fmt.Fprintf(&sb, "OK resumed %s\n", names[i])
+		}
+	}
+	return sb.String(), nil
+}
+
+// sendControl sends a command to a running ingester and writes the reply to out
+func sendControl(p, cmd string, out io.Writer) error {
+	if p == `` {
+		return errors.New("Control-Socket is not set in the configuration")
+	}
+	c, err := dialControl(p)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to %s: %v", p, err)
+	}
+	defer c.Close()
+	if _, err = io.WriteString(c, strings.TrimSpace(cmd)+"\n"); err != nil {
+		return err
+	}
+	resp, err := ioutil.ReadAll(c)
+	if err != nil {
+		return err
+	}
+	out.Write(resp)
+	if strings.HasPrefix(string(resp), `ERROR`) {
+		return ErrControlCommandRejected
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	controlSocketPerm os.FileMode = 0660
+)
+
+type unixListener struct {
+	l      net.Listener
+	closed int32
+}
+
+// listenControl creates the control socket, a stale socket left behind by an ingester
+// that did not shut down cleanly is removed first
+func listenControl(p string) (controlListener, error) {
+	if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(p); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen(`unix`, p)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(p, controlSocketPerm); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unixListener{l: l}, nil
+}
+
+func (ul *unixListener) Accept() (io.ReadWriteCloser, error) {
+	c, err := ul.l.Accept()
+	if err != nil {
+		if atomic.LoadInt32(&ul.closed) != 0 {
+			err = ErrControlListenerClosed
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops the listener, which also removes the socket file
+func (ul *unixListener) Close() error {
+	atomic.StoreInt32(&ul.closed, 1)
+	return ul.l.Close()
+}
+
+func dialControl(p string) (io.ReadWriteCloser, error) {
+	return net.DialTimeout(`unix`, p, controlTimeout)
+}
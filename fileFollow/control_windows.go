@@ -0,0 +1,128 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	pipePrefix              = `\\.\pipe\`
+	pipeAccessDuplex        = 0x3
+	pipeRejectRemoteClients = 0x8
+	pipeUnlimitedInstances  = 255
+	pipeBufferSize          = 4096
+	pipeRetryInterval       = 100 * time.Millisecond
+
+	errorPipeBusy      syscall.Errno = 231
+	errorPipeConnected syscall.Errno = 535
+)
+
+var (
+	ErrInvalidPipeName = errors.New(`Control-Socket must be a named pipe such as \\.\pipe\gravwell_file_follow`)
+
+	modkernel32             = windows.NewLazySystemDLL("kernel32.dll")
+	procCreateNamedPipeW    = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe    = modkernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe = modkernel32.NewProc("DisconnectNamedPipe")
+)
+
+// pipeListener hands out one named pipe instance per connection.  The default security
+// descriptor only lets administrators and the service account write to the pipe, remote
+// clients are always rejected.
+type pipeListener struct {
+	sync.Mutex
+	name   *uint16
+	path   string
+	closed bool
+}
+
+type pipeConn struct {
+	*os.File
+	h windows.Handle
+}
+
+func listenControl(p string) (controlListener, error) {
+	if !strings.HasPrefix(strings.ToLower(p), pipePrefix) {
+		return nil, ErrInvalidPipeName
+	}
+	name, err := windows.UTF16PtrFromString(p)
+	if err != nil {
+		return nil, err
+	}
+	return &pipeListener{name: name, path: p}, nil
+}
+
+func (pl *pipeListener) Accept() (io.ReadWriteCloser, error) {
+	if pl.isClosed() {
+		return nil, ErrControlListenerClosed
+	}
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(pl.name)), pipeAccessDuplex,
+		pipeRejectRemoteClients, pipeUnlimitedInstances, pipeBufferSize, pipeBufferSize, 0, 0)
+	h := windows.Handle(r)
+	if h == windows.InvalidHandle {
+		return nil, err
+	}
+	//blocks until a client connects, Close connects to the pipe to release it
+	if r, _, err = procConnectNamedPipe.Call(uintptr(h), 0); r == 0 && err != errorPipeConnected {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	if pl.isClosed() {
+		windows.CloseHandle(h)
+		return nil, ErrControlListenerClosed
+	}
+	return &pipeConn{File: os.NewFile(uintptr(h), pl.path), h: h}, nil
+}
+
+func (pl *pipeListener) isClosed() bool {
+	pl.Lock()
+	defer pl.Unlock()
+	return pl.closed
+}
+
+func (pl *pipeListener) Close() error {
+	pl.Lock()
+	pl.closed = true
+	pl.Unlock()
+	if c, err := os.OpenFile(pl.path, os.O_RDWR, 0); err == nil {
+		c.Close()
+	}
+	return nil
+}
+
+// Close makes sure the client has read everything before the pipe instance goes away
+func (pc *pipeConn) Close() error {
+	windows.FlushFileBuffers(pc.h)
+	procDisconnectNamedPipe.Call(uintptr(pc.h))
+	return pc.File.Close()
+}
+
+// dialControl retries while every pipe instance is busy
+func dialControl(p string) (io.ReadWriteCloser, error) {
+	deadline := time.Now().Add(controlTimeout)
+	for {
+		c, err := os.OpenFile(p, os.O_RDWR, 0)
+		if err == nil {
+			return c, nil
+		} else if pe, ok := err.(*os.PathError); !ok || pe.Err != errorPipeBusy || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(pipeRetryInterval)
+	}
+}
@@ -0,0 +1,481 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingesters/v3/utils"
+)
+
+const (
+	csvStateSuffix  = `.csv`
+	csvScanInterval = time.Second
+	csvReadBuffer   = 64 * 1024
+)
+
+var (
+	ErrCSVManagerStarted = errors.New("CSV file manager already started")
+)
+
+// csvHandler uses the header row of a CSV file to pull the timestamp column out of the
+// rows that follow it, rows are always handed on unmodified.  Every file has its own
+// header, so the handler is driven by the csvManager which points it at the header of
+// a file before handing it the rows of that file.
+type csvHandler struct {
+	lh        logHandler
+	qh        logHandler //nil unless the follower has a Quarantine-Tag
+	header    string
+	hasHeader bool
+	hdrErr    error //set when the header row read from the file could not be parsed
+	cols      map[string]int
+	tsCol     string
+	tg        timestampExtractor
+	st        *followerStats
+}
+
+func (f follower) newCSVHandler(lh, qh logHandler, st *followerStats) (ch *csvHandler, err error) {
+	ch = &csvHandler{
+		lh: lh,
+		qh: qh,
+		st: st,
+	}
+	if f.CSV_Timestamp_Column == `` || f.Ignore_Timestamps {
+		return
+	}
+	ch.tsCol = f.CSV_Timestamp_Column
+	ch.tg, err = f.timestampExtractor()
+	return
+}
+
+// setHeader points the handler at a file, an empty header means that the next row the
+// handler sees is the header of the file
+func (ch *csvHandler) setHeader(hdr string) {
+	ch.header, ch.hasHeader, ch.hdrErr, ch.cols = hdr, hdr != ``, nil, nil
+	if ch.hasHeader {
+		//a header that does not parse was reported when it was read from the file
+		ch.cols, _ = csvColumns(hdr)
+	}
+}
+
+func (ch *csvHandler) HandleLog(b []byte, catchts time.Time) error {
+	if b = bytes.TrimRight(b, "\r\n"); len(b) == 0 {
+		return nil
+	}
+	if !ch.hasHeader {
+		ch.header, ch.hasHeader = string(bytes.TrimPrefix(b, utf8BOM)), true
+		ch.cols, ch.hdrErr = csvColumns(ch.header)
+		return nil
+	}
+	row, err := parseCSVRow(b)
+	if err == nil {
+		if ch.tsCol == `` {
+			return ch.lh.HandleLog(b, catchts)
+		}
+		if idx, ok := ch.cols[ch.tsCol]; ok && idx < len(row) {
+			var ts time.Time
+			if ts, ok, err = ch.tg.Extract([]byte(row[idx])); err == nil && ok {
+				return ch.lh.HandleLog(b, ts)
+			}
+		}
+	}
+	//hand malformed rows and rows without a timestamp through untouched rather than dropping them
+	ch.st.parseFailure()
+	if ch.qh != nil {
+		return ch.qh.HandleLog(b, catchts)
+	}
+	return ch.lh.HandleLog(b, catchts)
+}
+
+// csvColumns maps the column names in a header row to their index, the first of any
+// duplicated names wins
+func csvColumns(hdr string) (cols map[string]int, err error) {
+	var row []string
+	if row, err = parseCSVRow([]byte(hdr)); err != nil {
+		return
+	}
+	cols = make(map[string]int, len(row))
+	for i, name := range row {
+		if _, ok := cols[name]; !ok {
+			cols[name] = i
+		}
+	}
+	return
+}
+
+func parseCSVRow(b []byte) ([]string, error) {
+	rdr := csv.NewReader(bytes.NewReader(b))
+	rdr.FieldsPerRecord = -1
+	rdr.LazyQuotes = true
+	rdr.TrimLeadingSpace = true
+	return rdr.Read()
+}
+
+// csvDelimiter returns the row delimiter and code unit size of the follower encoding,
+// UTF-16 text with a known byte order is split on the whole newline code unit
+func (f follower) csvDelimiter() ([]byte, int) {
+	switch utf16Encoding(f.Encoding) {
+	case utf16LE:
+		return []byte{'\n', 0}, 2
+	case utf16BE:
+		return []byte{0, '\n'}, 2
+	}
+	return []byte{'\n'}, 1
+}
+
+// csvRowSplitter is a bufio.SplitFunc which only hands out whole rows ending in the
+// delimiter, a delimiter inside a quoted field does not end the row.  The row after the
+// last delimiter may still be growing so it is left for the next scan.  Delimiters and
+// quotes only match on code unit boundaries.
+func csvRowSplitter(delim []byte, unit int) bufio.SplitFunc {
+	bigEndian := unit == 2 && delim[0] == 0
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if n := csvRowEnd(data, unit, bigEndian); n > 0 {
+			return n, data[:n], nil
+		}
+		return 0, nil, nil
+	}
+}
+
+// csvRowEnd returns the length of the first complete row in data, zero if there is none.
+// Fields are quoted the way parseCSVRow reads them, a quote after leading spaces opens a
+// quoted field and a quote that is not doubled or followed by a comma or the end of the
+// line is a stray quote that stays in the field.
+func csvRowEnd(data []byte, unit int, bigEndian bool) int {
+	start, quoted := true, false
+	for i := 0; i+unit <= len(data); i += unit {
+		c := csvUnit(data[i:], unit, bigEndian)
+		switch {
+		case quoted:
+			if c != '"' {
+				continue
+			} else if i+2*unit > len(data) {
+				return 0 //the next code unit decides what the quote means
+			}
+			switch csvUnit(data[i+unit:], unit, bigEndian) {
+			case '"':
+				i += unit
+			case ',', '\r', '\n':
+				quoted = false
+			}
+		case c == '\n':
+			return i + unit
+		case start && (c == ' ' || c == '\t'):
+		case start && c == '"':
+			start, quoted = false, true
+		default:
+			start = c == ','
+		}
+	}
+	return 0
+}
+
+// csvUnit returns the ASCII character in the code unit at the start of b, zero for any
+// other UTF-16 code unit
+func csvUnit(b []byte, unit int, bigEndian bool) byte {
+	if unit == 1 {
+		return b[0]
+	} else if bigEndian {
+		b = []byte{b[1], b[0]}
+	}
+	if b[1] != 0 || b[0] >= utf8.RuneSelf {
+		return 0
+	}
+	return b[0]
+}
+
+type csvFollower struct {
+	compressedFollower
+	ch    *csvHandler //the CSV handler within the handler chain of the follower
+	hdr   logHandler  //hands the header row straight to the CSV handler
+	delim []byte
+	unit  int
+}
+
+// newCSVFollower only decodes the header row on its way to the CSV handler, the first
+// row of a file is always its header so the filters must not drop or quarantine it
+func (f follower) newCSVFollower(cf compressedFollower, ch *csvHandler) (csvf csvFollower, err error) {
+	csvf = csvFollower{compressedFollower: cf, ch: ch, hdr: ch}
+	csvf.delim, csvf.unit = f.csvDelimiter()
+	if f.Encoding != `` {
+		var eh *encodingHandler
+		if eh, err = newEncodingHandler(f.Encoding, ch); err == nil && eh != nil {
+			csvf.hdr = eh
+		}
+	}
+	return
+}
+
+// csvFileState is the offset just past the last complete row and the header row of a file
+type csvFileState struct {
+	Offset int64
+	Header string //empty until the header row has been read
+}
+
+// csvManager polls the files of CSV followers, the filewatch handlers are shared by every
+// file of a follower so they cannot tell which header a row belongs to.  Offsets and header
+// rows are kept in a state file beside the follower state file, so a follower restarted in
+// the middle of a file still knows its header.  States are written at most once per
+// checkpoint interval, and when the manager is closed.  States of files that go missing are
+// kept for the state retention period.
+type csvManager struct {
+	sync.Mutex
+	st         *utils.State
+	states     map[string]csvFileState
+	flwrs      []csvFollower
+	lgr        ingest.IngestLogger
+	checkpoint time.Duration
+	lastWrite  time.Time
+	dirty      bool                 //states changed since they were last written
+	retention  time.Duration        //how long states of missing files are kept, zero is forever
+	missing    map[string]time.Time //when files were first found missing
+	quit       chan bool
+	wg         sync.WaitGroup
+}
+
+func newCSVManager(statePath string, checkpoint, retention time.Duration, lgr ingest.IngestLogger) (cm *csvManager, err error) {
+	var st *utils.State
+	if st, err = utils.NewState(statePath+csvStateSuffix, 0660); err != nil {
+		return
+	}
+	states := map[string]csvFileState{}
+	if err = st.Read(&states); err == utils.ErrNoState {
+		err = nil
+	} else if err != nil {
+		return
+	}
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	cm = &csvManager{
+		st:         st,
+		states:     states,
+		lgr:        lgr,
+		checkpoint: checkpoint,
+		retention:  retention,
+		missing:    map[string]time.Time{},
+	}
+	return
+}
+
+// Add registers a follower with the CSV file manager
+func (cm *csvManager) Add(cf csvFollower) {
+	cm.Lock()
+	cm.flwrs = append(cm.flwrs, cf)
+	cm.Unlock()
+}
+
+// Count returns the number of CSV followers
+func (cm *csvManager) Count() int {
+	cm.Lock()
+	defer cm.Unlock()
+	return len(cm.flwrs)
+}
+
+func (cm *csvManager) followers() (r []compressedFollower) {
+	cm.Lock()
+	defer cm.Unlock()
+	for _, cf := range cm.flwrs {
+		r = append(r, cf.compressedFollower)
+	}
+	return
+}
+
+func (cm *csvManager) Start() error {
+	cm.Lock()
+	defer cm.Unlock()
+	if cm.quit != nil {
+		return ErrCSVManagerStarted
+	}
+	cm.quit = make(chan bool)
+	cm.wg.Add(1)
+	go cm.routine()
+	return nil
+}
+
+func (cm *csvManager) Close() error {
+	cm.Lock()
+	if cm.quit != nil {
+		close(cm.quit)
+	}
+	cm.Unlock()
+	cm.wg.Wait()
+	cm.Lock()
+	defer cm.Unlock()
+	cm.quit = nil
+	return cm.st.Write(cm.states)
+}
+
+func (cm *csvManager) routine() {
+	defer cm.wg.Done()
+	tckr := time.NewTicker(csvScanInterval)
+	defer tckr.Stop()
+	for {
+		cm.scan()
+		select {
+		case <-tckr.C:
+		case <-cm.quit:
+			return
+		}
+	}
+}
+
+func (cm *csvManager) quitting() bool {
+	select {
+	case <-cm.quit:
+		return true
+	default:
+	}
+	return false
+}
+
+// scan reads new rows from every matching file, files that are gone are dropped from the
+// states once they have been missing for the retention period
+func (cm *csvManager) scan() {
+	cm.Lock()
+	flwrs := cm.flwrs
+	cm.Unlock()
+	seen := map[string]bool{}
+	var dirty bool
+	for _, cf := range flwrs {
+		walkFiles(cf.base, cf.recursive, func(p string, fi os.FileInfo) error {
+			if cm.quitting() {
+				return errScanAbort
+			} else if !cf.match(fi.Name()) {
+				return nil
+			}
+			key := compressedKey(cf.name, p)
+			seen[key] = true
+			cm.Lock()
+			fst, ok := cm.states[key]
+			cm.Unlock()
+			if fi.Size() < fst.Offset {
+				cm.lgr.Info("file_follower CSV file %s was truncated, starting over", p)
+				fst = csvFileState{}
+			} else if ok && fi.Size() == fst.Offset {
+				return nil
+			} else if !ok && cf.skip(fi, time.Now()) {
+				//the header is read if the file ever grows
+				cm.lgr.Info("file_follower skipping CSV file %s, it is too old or too large", p)
+				fst.Offset = fi.Size()
+				cm.Lock()
+				cm.states[key] = fst
+				cm.Unlock()
+				dirty = true
+				return nil
+			}
+			prev := fst
+			if err := cm.tail(cf, p, &fst); err != nil {
+				cm.lgr.Error("file_follower failed to read CSV file %s at offset %d: %v", p, fst.Offset, err)
+				if err == bufio.ErrTooLong {
+					//there is no way to find the next row, skip what is in the file now
+					fst.Offset = fi.Size()
+				}
+			}
+			cm.Lock()
+			cm.states[key] = fst
+			cm.Unlock()
+			dirty = dirty || fst != prev || !ok
+			return nil
+		})
+	}
+	if cm.quitting() {
+		return
+	}
+	cm.Lock()
+	defer cm.Unlock()
+	now := time.Now()
+	for k := range cm.states {
+		if seen[k] {
+			delete(cm.missing, k)
+		} else if expireState(k, cm.missing, cm.retention, now, cm.lgr) {
+			delete(cm.states, k)
+			dirty = true
+		}
+	}
+	cm.dirty = cm.dirty || dirty
+	if cm.dirty && time.Since(cm.lastWrite) >= cm.checkpoint {
+		if err := cm.st.Write(cm.states); err != nil {
+			cm.lgr.Error("file_follower failed to write CSV file states: %v", err)
+		} else {
+			cm.dirty = false
+			cm.lastWrite = time.Now()
+		}
+	}
+}
+
+// tail hands every complete row after the offset to the follower and advances the state,
+// the header row is read from the start of the file when the state does not hold it
+func (cm *csvManager) tail(cf csvFollower, p string, fst *csvFileState) (err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	cf.ch.setHeader(fst.Header)
+	if !cf.ch.hasHeader && fst.Offset > 0 {
+		//the rows before the offset were skipped, only read them far enough to find the header
+		if _, err = cf.read(io.LimitReader(fin, fst.Offset), true); err != nil {
+			return
+		}
+		cm.learnHeader(cf, p, fst)
+	}
+	if _, err = fin.Seek(fst.Offset, io.SeekStart); err != nil {
+		return
+	}
+	var n int64
+	n, err = cf.read(fin, false)
+	fst.Offset += n
+	cm.learnHeader(cf, p, fst)
+	return
+}
+
+// learnHeader records a header row the handler read from the file
+func (cm *csvManager) learnHeader(cf csvFollower, p string, fst *csvFileState) {
+	if fst.Header != `` || !cf.ch.hasHeader {
+		return
+	}
+	fst.Header = cf.ch.header
+	if cf.ch.hdrErr != nil {
+		cm.lgr.Warn("file_follower failed to parse the CSV header of %s, rows are ingested without column timestamps: %v", p, cf.ch.hdrErr)
+	}
+}
+
+// read hands complete rows to the handler chain and returns the number of bytes they
+// covered, with hdrOnly set it stops as soon as the handler has the header row
+func (cf csvFollower) read(r io.Reader, hdrOnly bool) (n int64, err error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, csvReadBuffer), compressedMaxRecord)
+	s.Split(csvRowSplitter(cf.delim, cf.unit))
+	for s.Scan() {
+		if hdrOnly && cf.ch.hasHeader {
+			return
+		}
+		lh := cf.hnd
+		if !cf.ch.hasHeader {
+			lh = cf.hdr
+		}
+		//the scanner reuses its buffer, so hand out a copy
+		if err = lh.HandleLog(append([]byte(nil), s.Bytes()...), time.Now()); err != nil {
+			return
+		}
+		n += int64(len(s.Bytes()))
+	}
+	err = s.Err()
+	return
+}
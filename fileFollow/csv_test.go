@@ -0,0 +1,321 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+)
+
+// captureHandler keeps everything handed to it
+type captureHandler struct {
+	lines []string
+	ts    []time.Time
+}
+
+func (c *captureHandler) HandleLog(b []byte, ts time.Time) error {
+	c.lines = append(c.lines, string(b))
+	c.ts = append(c.ts, ts)
+	return nil
+}
+
+func (c *captureHandler) reset() {
+	c.lines, c.ts = nil, nil
+}
+
+func newTestCSVManager(t *testing.T, dir string, f follower, c *captureHandler) *csvManager {
+	hnd, ch, err := f.handler(c, nil, &followerStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := newCompressedFollower(`test`, f, f.File_Filter, hnd, filewatch.FollowerEngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm, err := newCSVManager(filepath.Join(dir, `state`), 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvf, err := f.newCSVFollower(cf, ch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Add(csvf)
+	return cm
+}
+
+func appendFile(t *testing.T, p, s string) {
+	fout, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fout.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	if err = fout.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRows(t *testing.T, c *captureHandler, rows []string, ts []string) {
+	t.Helper()
+	if len(c.lines) != len(rows) {
+		t.Fatalf("got rows %q, expected %q", c.lines, rows)
+	}
+	for i := range rows {
+		if c.lines[i] != rows[i] {
+			t.Fatalf("row %d is %q, expected %q", i, c.lines[i], rows[i])
+		} else if exp, _ := time.Parse(time.RFC3339, ts[i]); !c.ts[i].Equal(exp) {
+			t.Fatalf("row %d timestamp is %v, expected %v", i, c.ts[i], exp)
+		}
+	}
+	c.reset()
+}
+
+func TestCSVHeadersPerFile(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `csv`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, `logs`)
+	if err = os.Mkdir(logs, 0770); err != nil {
+		t.Fatal(err)
+	}
+	f := follower{
+		Base_Directory:       logs,
+		File_Filter:          `*.csv`,
+		CSV_Handler:          true,
+		CSV_Timestamp_Column: `ts`,
+	}
+	a, b := filepath.Join(logs, `a.csv`), filepath.Join(logs, `b.csv`)
+	appendFile(t, a, "ts,user\n2020-01-02T03:04:05Z,bob\n")
+	appendFile(t, b, "user,\"ts\"\r\nalice,2021-01-02T03:04:05Z\r\n")
+
+	var c captureHandler
+	cm := newTestCSVManager(t, dir, f, &c)
+	cm.scan()
+	//walks are in lexical order
+	checkRows(t, &c, []string{`2020-01-02T03:04:05Z,bob`, `alice,2021-01-02T03:04:05Z`},
+		[]string{`2020-01-02T03:04:05Z`, `2021-01-02T03:04:05Z`})
+
+	//partial rows wait for their delimiter
+	appendFile(t, a, `2020-02-02T03:04:05Z,ca`)
+	cm.scan()
+	checkRows(t, &c, nil, nil)
+	appendFile(t, a, "rol\n")
+	cm.scan()
+	checkRows(t, &c, []string{`2020-02-02T03:04:05Z,carol`}, []string{`2020-02-02T03:04:05Z`})
+	if err = cm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restarted follower resumes mid file with the header it read before
+	appendFile(t, b, "dave,2021-02-02T03:04:05Z\r\n")
+	cm = newTestCSVManager(t, dir, f, &c)
+	cm.scan()
+	checkRows(t, &c, []string{`dave,2021-02-02T03:04:05Z`}, []string{`2021-02-02T03:04:05Z`})
+
+	//a truncated file starts over and reads its new header
+	if err = ioutil.WriteFile(a, []byte("user,ts\nerin,2022-01-02T03:04:05Z\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	checkRows(t, &c, []string{`erin,2022-01-02T03:04:05Z`}, []string{`2022-01-02T03:04:05Z`})
+	if err = cm.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCSVSkippedFileHeader(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `csv`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := follower{
+		Base_Directory:       dir,
+		File_Filter:          `*.csv`,
+		CSV_Handler:          true,
+		CSV_Timestamp_Column: `ts`,
+	}
+	p := filepath.Join(dir, `a.csv`)
+	existing := "\nuser,ts\nbob,2020-01-02T03:04:05Z\n"
+	appendFile(t, p, existing)
+	var c captureHandler
+	cm := newTestCSVManager(t, dir, f, &c)
+	//the file was skipped, so only the offset is known
+	cm.states[compressedKey(`test`, p)] = csvFileState{Offset: int64(len(existing))}
+
+	appendFile(t, p, "carol,2020-02-02T03:04:05Z\n")
+	cm.scan()
+	checkRows(t, &c, []string{`carol,2020-02-02T03:04:05Z`}, []string{`2020-02-02T03:04:05Z`})
+	if st := cm.states[compressedKey(`test`, p)]; st.Header != `user,ts` {
+		t.Fatalf("header was not recorded: %+v", st)
+	}
+}
+
+func TestCSVHeaderAndQuotedRows(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `csv`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//the header row does not match the filter but is still the header
+	f := follower{
+		Base_Directory:       dir,
+		File_Filter:          `*.csv`,
+		CSV_Handler:          true,
+		CSV_Timestamp_Column: `ts`,
+		Require_Line_Regex:   []string{`bob|carol`},
+		Encoding:             `utf-16le`,
+	}
+	rows := "user,ts\r\ndave,2020-01-02T03:04:05Z\r\n\"bob\r\nsmith\",\"2020-02-02T03:04:05Z\"\r\ncarol,2020-03-02T03:04:05Z\r\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, `a.csv`), utf16Bytes("\ufeff"+rows, false), 0660); err != nil {
+		t.Fatal(err)
+	}
+	var c captureHandler
+	cm := newTestCSVManager(t, dir, f, &c)
+	cm.scan()
+	checkRows(t, &c, []string{"\"bob\r\nsmith\",\"2020-02-02T03:04:05Z\"", `carol,2020-03-02T03:04:05Z`},
+		[]string{`2020-02-02T03:04:05Z`, `2020-03-02T03:04:05Z`})
+}
+
+func TestCSVMissingFileState(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `csv`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, `logs`)
+	if err = os.Mkdir(logs, 0770); err != nil {
+		t.Fatal(err)
+	}
+	f := follower{
+		Base_Directory:       logs,
+		File_Filter:          `*.csv`,
+		CSV_Handler:          true,
+		CSV_Timestamp_Column: `ts`,
+	}
+	p, moved := filepath.Join(logs, `a.csv`), filepath.Join(dir, `a.csv`)
+	appendFile(t, p, "ts,user\n2020-01-02T03:04:05Z,bob\n")
+	var c captureHandler
+	cm := newTestCSVManager(t, dir, f, &c)
+	cm.retention = time.Hour
+	key := compressedKey(`test`, p)
+	cm.scan()
+	checkRows(t, &c, []string{`2020-01-02T03:04:05Z,bob`}, []string{`2020-01-02T03:04:05Z`})
+
+	//a file that goes away for a while is not ingested again when it comes back
+	if err = os.Rename(p, moved); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	if _, ok := cm.states[key]; !ok {
+		t.Fatal("dropped the state of a file missing from one scan")
+	} else if _, ok = cm.missing[key]; !ok {
+		t.Fatal("missing file was not recorded")
+	}
+	if err = os.Rename(moved, p); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	checkRows(t, &c, nil, nil)
+	if _, ok := cm.missing[key]; ok {
+		t.Fatal("file that came back is still missing")
+	}
+
+	//once the retention period passes the state is dropped
+	if err = os.Rename(p, moved); err != nil {
+		t.Fatal(err)
+	}
+	cm.scan()
+	cm.missing[key] = time.Now().Add(-time.Hour)
+	cm.scan()
+	if _, ok := cm.states[key]; ok {
+		t.Fatal("kept the state of a file missing for the retention period")
+	} else if len(cm.missing) != 0 {
+		t.Fatalf("missing files were not cleaned up %v", cm.missing)
+	}
+}
+
+func TestCSVUTF16(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `csv`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f := follower{
+		Base_Directory:       dir,
+		File_Filter:          `*.csv`,
+		CSV_Handler:          true,
+		CSV_Timestamp_Column: `ts`,
+		Encoding:             `utf-16le`,
+	}
+	//U+4E0A has a 0x0A byte which must not split the row
+	rows := "\ufeffts,user\r\n2020-01-02T03:04:05Z,\u4e0a\r\n"
+	var b []byte
+	for _, r := range rows {
+		b = append(b, byte(r), byte(r>>8))
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, `a.csv`), b, 0660); err != nil {
+		t.Fatal(err)
+	}
+	var c captureHandler
+	cm := newTestCSVManager(t, dir, f, &c)
+	cm.scan()
+	checkRows(t, &c, []string{"2020-01-02T03:04:05Z,\u4e0a"}, []string{`2020-01-02T03:04:05Z`})
+}
+
+func TestCSVHandlerRows(t *testing.T) {
+	f := follower{
+		CSV_Handler:          true,
+		CSV_Timestamp_Column: `ts`,
+		Timestamp_Format:     `2006-01-02 15:04:05`,
+	}
+	var c, q captureHandler
+	ch, err := f.newCSVHandler(&c, &q, &followerStats{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	catch := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		row    string
+		ts     string //empty when the row is quarantined
+	}{
+		{header: `ts,user`, row: `2020-01-02 03:04:05,bob`, ts: `2020-01-02T03:04:05Z`},
+		{header: `user, ts, ts`, row: `bob, "2020-01-02 03:04:05", nope`, ts: `2020-01-02T03:04:05Z`},
+		{header: "\ufeffts,user", row: `2020-01-02 03:04:05,bob`, ts: `2020-01-02T03:04:05Z`},
+		{header: `user,ts`, row: `bob`},
+		{header: `user,ts`, row: `bob,yesterday`},
+		{header: `user,when`, row: `bob,2020-01-02 03:04:05`},
+	}
+	for _, tt := range tests {
+		ch.setHeader(``)
+		for _, b := range []string{``, tt.header, tt.row} {
+			if err = ch.HandleLog([]byte(b), catch); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tt.ts == `` {
+			if len(c.lines) != 0 || len(q.lines) != 1 || q.lines[0] != tt.row || !q.ts[0].Equal(catch) {
+				t.Fatalf("%q with header %q was not quarantined: %q %q", tt.row, tt.header, c.lines, q.lines)
+			}
+		} else {
+			checkRows(t, &c, []string{tt.row}, []string{tt.ts})
+		}
+		c.reset()
+		q.reset()
+	}
+}
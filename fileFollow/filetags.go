@@ -0,0 +1,159 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	filenameTagCheckInterval = 10 * time.Second
+)
+
+var (
+	ErrFilenameTagMissing      = errors.New("Filename-Tag-Regex requires a Filename-Tag")
+	ErrFilenameTagRegexMissing = errors.New("Filename-Tag requires a Filename-Tag-Regex")
+	ErrFilenameTagOptions      = errors.New("Filename-Tag-Regex cannot be combined with Follow-Symlinks or binary records")
+)
+
+// filenameTagger expands the captures of a regular expression applied to file names into
+// a tag name, such as (?P<svc>\w+)\.log with svc_${svc}
+type filenameTagger struct {
+	rx   *regexp.Regexp
+	tmpl string
+}
+
+// FilenameTagger returns the filename tagger of the follower, nil if there is none
+func (f follower) FilenameTagger() (ft *filenameTagger, err error) {
+	if f.Filename_Tag_Regex == `` && f.Filename_Tag == `` {
+		return
+	} else if f.Filename_Tag == `` {
+		err = ErrFilenameTagMissing
+		return
+	} else if f.Filename_Tag_Regex == `` {
+		err = ErrFilenameTagRegexMissing
+		return
+	}
+	ft = &filenameTagger{tmpl: f.Filename_Tag}
+	if ft.rx, err = regexp.Compile(f.Filename_Tag_Regex); err != nil {
+		err = fmt.Errorf("Invalid Filename-Tag-Regex: %v", err)
+	}
+	return
+}
+
+// tag returns the tag for a file name, ok is false if the name does not match
+func (ft *filenameTagger) tag(name string) (tag string, ok bool, err error) {
+	m := ft.rx.FindStringSubmatchIndex(name)
+	if m == nil {
+		return
+	}
+	tag = string(ft.rx.ExpandString(nil, ft.tmpl, name, m))
+	if err = ingest.CheckTag(tag); err != nil {
+		err = fmt.Errorf("file %s produced invalid tag %q: %v", name, tag, err)
+		return
+	}
+	ok = true
+	return
+}
+
+type taggedFollower struct {
+	val  follower
+	seen map[string]bool
+}
+
+// tagGroup is a set of file names that share a tag
+type tagGroup struct {
+	tag   string
+	names []string
+}
+
+// filter returns a File-Filter that matches exactly the names in the group
+func (tg tagGroup) filter() string {
+	return `{` + strings.Join(tg.names, `,`) + `}`
+}
+
+// filenameTagGroups groups every file the follower currently matches by the tag derived
+// from its name, files that do not match the regex are grouped under Tag-Name.  The
+// watcher cannot tag files individually, so each group becomes its own watch with a filter
+// listing the names.  The returned set holds every name seen, including names that cannot
+// be listed in a filter, so that new files can be spotted.
+func (f follower) filenameTagGroups(ft *filenameTagger, lgr handlerLogger) (groups []tagGroup, seen map[string]bool) {
+	seen = map[string]bool{}
+	byTag := map[string][]string{}
+	filters := splitFilters(f.File_Filter)
+	walkFiles(f.Base_Directory, f.Recursive, func(p string, fi os.FileInfo) error {
+		name := fi.Name()
+		if seen[name] || !matchFilters(filters, name) {
+			return nil
+		}
+		seen[name] = true
+		if strings.ContainsAny(name, globMetaChars) {
+			lgr.Warn("file_follower cannot follow %s with Filename-Tag-Regex, the name contains glob characters", p)
+			return nil
+		}
+		tag, ok, err := ft.tag(name)
+		if err != nil {
+			lgr.Warn("file_follower %v, using tag %s", err, f.Tag_Name)
+		} else if !ok {
+			tag = f.Tag_Name
+		}
+		byTag[tag] = append(byTag[tag], name)
+		return nil
+	})
+	for tag, names := range byTag {
+		sort.Strings(names)
+		groups = append(groups, tagGroup{tag: tag, names: names})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].tag < groups[j].tag })
+	return
+}
+
+// newFilenames returns true if the follower matches a file name that was not seen when
+// the groups were built
+func (f follower) newFilenames(seen map[string]bool) (found bool) {
+	filters := splitFilters(f.File_Filter)
+	walkFiles(f.Base_Directory, f.Recursive, func(p string, fi os.FileInfo) error {
+		if name := fi.Name(); !seen[name] && matchFilters(filters, name) {
+			found = true
+			return errScanAbort
+		}
+		return nil
+	})
+	return
+}
+
+// filenameTagRoutine periodically looks for files the tagged followers do not cover yet and
+// signals that the follower set must be rebuilt to pick them up
+func (fs *followerSet) filenameTagRoutine() {
+	defer fs.wg.Done()
+	tckr := time.NewTicker(filenameTagCheckInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+			for k, tf := range fs.tagged {
+				if tf.val.newFilenames(tf.seen) {
+					fs.igst.Info("file_follower new files for %s", k)
+					fs.notifyChanged()
+					return
+				}
+			}
+		case <-fs.quit:
+			return
+		}
+	}
+}
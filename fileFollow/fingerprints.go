@@ -0,0 +1,240 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingesters/v3/utils"
+)
+
+const (
+	fingerprintStateSuffix     = `.fingerprints`
+	fingerprintInterval        = time.Minute
+	fingerprintSize        int = 1024
+)
+
+// fingerprint identifies a file by the hash of its first bytes.  Paths and inodes are
+// reused by log rotation, the content at the start of a file is not.
+type fingerprint struct {
+	Size int64 //number of bytes hashed, files shorter than fingerprintSize hash everything
+	Sum  uint64
+}
+
+// fileFingerprint hashes the start of a file, max limits how many bytes are read
+func fileFingerprint(p string, max int64) (fp fingerprint, err error) {
+	var fin *os.File
+	if fin, err = os.Open(p); err != nil {
+		return
+	}
+	defer fin.Close()
+	h := fnv.New64a()
+	if fp.Size, err = io.Copy(h, io.LimitReader(fin, max)); err != nil {
+		return
+	}
+	fp.Sum = h.Sum64()
+	return
+}
+
+// matches returns true if the file at p begins with the fingerprinted bytes, a file that
+// was appended to still matches
+func (fp fingerprint) matches(p string) bool {
+	cur, err := fileFingerprint(p, fp.Size)
+	return err == nil && cur == fp
+}
+
+func loadFingerprints(statePath string) (st *utils.State, fps map[filewatch.FileName]fingerprint, err error) {
+	if st, err = utils.NewState(statePath+fingerprintStateSuffix, 0660); err != nil {
+		return
+	}
+	fps = map[filewatch.FileName]fingerprint{}
+	if err = st.Read(&fps); err == utils.ErrNoState {
+		err = nil
+	}
+	return
+}
+
+// reconcileFingerprints compares the files in the state file against the fingerprints
+// taken while they were being followed.  A file that no longer begins with the same bytes
+// was truncated in place, copied and truncated, or replaced by a new file that reused the
+// path or inode, so its offset is reset to the start.  If the old file is found beside it
+// under a name the follower also matches, such as after a rename rotation, the old offset
+// moves with it so the old file is not ingested again.  It must be called before the
+// watcher loads the state file.
+func reconcileFingerprints(cfg *cfgType, lgr handlerLogger) error {
+	p := cfg.StatePath()
+	_, fps, err := loadFingerprints(p)
+	if err != nil {
+		return fmt.Errorf("Failed to read fingerprint file %s: %v", p+fingerprintStateSuffix, err)
+	} else if len(fps) == 0 {
+		return nil
+	}
+	states, err := loadStates(p)
+	if err != nil {
+		return fmt.Errorf("Failed to read state file %s: %v", p, err)
+	}
+	type moved struct {
+		filewatch.FileName
+		fp     fingerprint
+		offset int64
+	}
+	var changed []moved
+	for k, v := range states {
+		fp, ok := fps[k]
+		if !ok || fp.Size == 0 || v == nil || *v == 0 {
+			continue
+		} else if _, err := os.Stat(k.FilePath); err != nil {
+			continue //missing files are pruned by the watcher
+		} else if fp.matches(k.FilePath) {
+			continue
+		}
+		changed = append(changed, moved{FileName: k, fp: fp, offset: *v})
+		*v = 0
+		lgr.Info("file_follower %s content of %s changed, ingesting it from the start", k.BaseName, k.FilePath)
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	//files that were reset may be the new home of another file's content
+	claimed := map[filewatch.FileName]bool{}
+	for _, m := range changed {
+		claimed[m.FileName] = false
+	}
+	for _, m := range changed {
+		f, ok := cfg.Follower[m.BaseName]
+		if !ok {
+			continue
+		}
+		filters := splitFilters(f.File_Filter)
+		dir := filepath.Dir(m.FilePath)
+		walkFiles(dir, false, func(fp string, fi os.FileInfo) error {
+			key := filewatch.FileName{BaseName: m.BaseName, FilePath: fp}
+			if c, ok := claimed[key]; (ok && c) || (!ok && states[key] != nil) {
+				return nil
+			} else if !matchFilters(filters, fi.Name()) || fi.Size() < m.offset || !m.fp.matches(fp) {
+				return nil
+			}
+			offset := m.offset
+			states[key] = &offset
+			claimed[key] = true
+			lgr.Info("file_follower %s found %s at %s, resuming at offset %d", m.BaseName, m.FilePath, fp, offset)
+			return errScanAbort
+		})
+	}
+	if err = writeStates(p, states); err != nil {
+		return fmt.Errorf("Failed to write state file %s: %v", p, err)
+	}
+	return nil
+}
+
+// fingerprintManager periodically fingerprints every file the followers match so that
+// rotations which happen while the ingester is stopped can be detected at startup
+type fingerprintManager struct {
+	sync.Mutex
+	st    *utils.State
+	flwrs []compressedFollower
+	lgr   ingest.IngestLogger
+	quit  chan bool
+	wg    sync.WaitGroup
+}
+
+func newFingerprintManager(statePath string, lgr ingest.IngestLogger) (fm *fingerprintManager, err error) {
+	var st *utils.State
+	if st, _, err = loadFingerprints(statePath); err != nil {
+		return
+	}
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	fm = &fingerprintManager{
+		st:  st,
+		lgr: lgr,
+	}
+	return
+}
+
+// Add registers the files matched by a follower for fingerprinting
+func (fm *fingerprintManager) Add(cf compressedFollower) {
+	fm.Lock()
+	fm.flwrs = append(fm.flwrs, cf)
+	fm.Unlock()
+}
+
+func (fm *fingerprintManager) Start() {
+	fm.Lock()
+	defer fm.Unlock()
+	if fm.quit != nil {
+		return
+	}
+	fm.quit = make(chan bool)
+	fm.wg.Add(1)
+	go fm.routine()
+}
+
+// Close stops the routine and takes a final set of fingerprints, it should be called
+// after the watcher has written its final states
+func (fm *fingerprintManager) Close() error {
+	fm.Lock()
+	if fm.quit != nil {
+		close(fm.quit)
+	}
+	fm.Unlock()
+	fm.wg.Wait()
+	fm.Lock()
+	fm.quit = nil
+	fm.Unlock()
+	return fm.record()
+}
+
+func (fm *fingerprintManager) routine() {
+	defer fm.wg.Done()
+	tckr := time.NewTicker(fingerprintInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+			if err := fm.record(); err != nil {
+				fm.lgr.Error("file_follower failed to write file fingerprints: %v", err)
+			}
+		case <-fm.quit:
+			return
+		}
+	}
+}
+
+// record fingerprints every matching file, files that no longer exist are dropped
+func (fm *fingerprintManager) record() error {
+	fm.Lock()
+	flwrs := fm.flwrs
+	fm.Unlock()
+	if len(flwrs) == 0 {
+		return nil
+	}
+	fps := map[filewatch.FileName]fingerprint{}
+	for _, cf := range flwrs {
+		walkFiles(cf.base, cf.recursive, func(p string, fi os.FileInfo) error {
+			if fi.Size() == 0 || !cf.match(fi.Name()) {
+				return nil
+			}
+			if fp, err := fileFingerprint(p, int64(fingerprintSize)); err == nil {
+				fps[filewatch.FileName{BaseName: cf.name, FilePath: p}] = fp
+			}
+			return nil
+		})
+	}
+	return fm.st.Write(fps)
+}
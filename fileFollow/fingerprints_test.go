@@ -0,0 +1,142 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gravwell/filewatch/v3"
+)
+
+type testLogger struct{}
+
+func (testLogger) Debug(string, ...interface{}) error    { return nil }
+func (testLogger) Info(string, ...interface{}) error     { return nil }
+func (testLogger) Warn(string, ...interface{}) error     { return nil }
+func (testLogger) Error(string, ...interface{}) error    { return nil }
+func (testLogger) Critical(string, ...interface{}) error { return nil }
+
+func TestFingerprintMatches(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `fingerprint`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, `a.log`)
+	if err = ioutil.WriteFile(p, []byte("first line\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	fp, err := fileFingerprint(p, int64(fingerprintSize))
+	if err != nil {
+		t.Fatal(err)
+	} else if fp.Size != 11 {
+		t.Fatalf("hashed %d bytes", fp.Size)
+	}
+	tests := []struct {
+		content string
+		match   bool
+	}{
+		{content: "first line\n", match: true},
+		{content: "first line\nsecond line\n", match: true},
+		{content: "first", match: false},
+		{content: "First line\n", match: false},
+		{content: ``, match: false},
+	}
+	for _, tt := range tests {
+		if err = ioutil.WriteFile(p, []byte(tt.content), 0660); err != nil {
+			t.Fatal(err)
+		} else if fp.matches(p) != tt.match {
+			t.Fatalf("%q match should be %v", tt.content, tt.match)
+		}
+	}
+	if fp.matches(filepath.Join(dir, `missing.log`)) {
+		t.Fatal("missing file matched")
+	}
+}
+
+func TestReconcileFingerprints(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `fingerprint`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, `logs`)
+	if err = os.Mkdir(logs, 0770); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &cfgType{
+		global: global{State_Store_Location: filepath.Join(dir, `state`)},
+		Follower: map[string]*follower{
+			`test`: {Base_Directory: logs, File_Filter: `*.log,*.log.1`},
+		},
+	}
+	files := map[string]string{
+		`rotated.log`:   "rotated file content\n",
+		`truncated.log`: "truncated file content\n",
+		`appended.log`:  "appended file content\n",
+	}
+	states := map[filewatch.FileName]*int64{}
+	for name, content := range files {
+		p := filepath.Join(logs, name)
+		if err = ioutil.WriteFile(p, []byte(content), 0660); err != nil {
+			t.Fatal(err)
+		}
+		off := int64(len(content))
+		states[filewatch.FileName{BaseName: `test`, FilePath: p}] = &off
+	}
+	if err = writeStates(cfg.StatePath(), states); err != nil {
+		t.Fatal(err)
+	}
+	fm, err := newFingerprintManager(cfg.StatePath(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := newCompressedFollower(`test`, *cfg.Follower[`test`], cfg.Follower[`test`].File_Filter, nil, filewatch.FollowerEngineConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm.Add(cf)
+	if err = fm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//changes while the ingester is stopped
+	if err = os.Rename(filepath.Join(logs, `rotated.log`), filepath.Join(logs, `rotated.log.1`)); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		`rotated.log`:   "new file\n",
+		`truncated.log`: "short\n",
+		`appended.log`:  files[`appended.log`] + "more\n",
+	} {
+		if err = ioutil.WriteFile(filepath.Join(logs, name), []byte(content), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = reconcileFingerprints(cfg, testLogger{}); err != nil {
+		t.Fatal(err)
+	}
+	if states, err = loadStates(cfg.StatePath()); err != nil {
+		t.Fatal(err)
+	}
+	exp := map[string]int64{
+		`rotated.log`:   0,
+		`rotated.log.1`: int64(len(files[`rotated.log`])),
+		`truncated.log`: 0,
+		`appended.log`:  int64(len(files[`appended.log`])),
+	}
+	for name, off := range exp {
+		v := states[filewatch.FileName{BaseName: `test`, FilePath: filepath.Join(logs, name)}]
+		if v == nil || *v != off {
+			t.Fatalf("%s offset is %v, expected %d", name, v, off)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/ingesters/v3/utils"
+)
+
+// handlerLogger is the logger interface the filewatch log handlers expect
+type handlerLogger interface {
+	Debug(string, ...interface{}) error
+	Info(string, ...interface{}) error
+	Warn(string, ...interface{}) error
+	Error(string, ...interface{}) error
+	Critical(string, ...interface{}) error
+}
+
+// followerSet is everything built out of the follower configuration.  A set can be
+// closed and rebuilt against the same muxer so that the configuration can be reloaded
+// without dropping entries that are already in flight.
+type followerSet struct {
+	igst  *ingest.IngestMuxer
+	wtchr *watchManager
+	cmpr  *compressedManager
+	bins  *binaryManager
+	csvs  *csvManager
+	fprts *fingerprintManager
+	pacts *postActionManager
+	procs []*processors.ProcessorSet
+	bfill []compressedFollower //used to read existing files in backfill mode and count files for stats
+	rptr  *statsReporter
+	added int
+	done  chan bool //closed to release paused followers when the set is closed
+
+	//followers with Follow-Symlinks and the links they resolved when the set was built
+	slinks  map[string]follower
+	links   map[string]map[string]string
+	tagged  map[string]taggedFollower //followers with Filename-Tag-Regex and the file names they cover
+	changed chan bool
+	quit    chan bool
+	wg      sync.WaitGroup
+}
+
+func newFollowerSet(cfg *cfgType, igst *ingest.IngestMuxer, src net.IP, lgr handlerLogger, dbg func(string, ...interface{})) (fs *followerSet, err error) {
+	//rotated and skipped files must be in the state file before the watcher loads it
+	if err = migrateStatePaths(cfg, lgr); err != nil {
+		return
+	} else if err = reconcileFingerprints(cfg, lgr); err != nil {
+		return
+	} else if err = skipFiles(cfg, lgr); err != nil {
+		return
+	}
+	fs = &followerSet{
+		igst:    igst,
+		slinks:  map[string]follower{},
+		links:   map[string]map[string]string{},
+		tagged:  map[string]taggedFollower{},
+		changed: make(chan bool, 1),
+		done:    make(chan bool),
+	}
+	if fs.wtchr, err = newWatchManager(cfg.StatePath(), cfg.CheckpointInterval(), !cfg.Disable_State_Fsync); err != nil {
+		err = fmt.Errorf("Failed to create notification watcher: %v", err)
+		return
+	}
+	//pass in the ingest muxer to the file watcher so it can throw info and errors down the muxer chan
+	fs.wtchr.SetLogger(igst)
+	fs.wtchr.SetMaxFilesWatched(cfg.Max_Files_Watched)
+
+	if fs.cmpr, err = newCompressedManager(cfg.StatePath(), cfg.StateRetention(), igst); err != nil {
+		fs.wtchr.Close()
+		err = fmt.Errorf("Failed to load compressed file states: %v", err)
+		return
+	}
+	if fs.bins, err = newBinaryManager(cfg.StatePath(), cfg.CheckpointInterval(), cfg.StateRetention(), igst); err != nil {
+		fs.wtchr.Close()
+		fs.cmpr.Close()
+		err = fmt.Errorf("Failed to load binary file states: %v", err)
+		return
+	}
+	if fs.csvs, err = newCSVManager(cfg.StatePath(), cfg.CheckpointInterval(), cfg.StateRetention(), igst); err != nil {
+		fs.wtchr.Close()
+		fs.cmpr.Close()
+		fs.bins.Close()
+		err = fmt.Errorf("Failed to load CSV file states: %v", err)
+		return
+	}
+	if fs.fprts, err = newFingerprintManager(cfg.StatePath(), igst); err != nil {
+		fs.wtchr.Close()
+		fs.cmpr.Close()
+		fs.bins.Close()
+		fs.csvs.Close()
+		err = fmt.Errorf("Failed to load file fingerprints: %v", err)
+		return
+	}
+	//syncing every state write is the safe default, disabling it trades a window of repeated
+	//records after a crash for less disk I/O
+	if cfg.Disable_State_Fsync {
+		for _, st := range []*utils.State{fs.cmpr.st, fs.bins.st, fs.csvs.st, fs.fprts.st} {
+			st.SetSync(false)
+		}
+	}
+	fs.pacts = newPostActionManager(cfg.StatePath(), fs.cmpr, igst)
+	fs.rptr = newStatsReporter(fs, cfg.StatsInterval(), igst, dbg)
+
+	//build a list of base directories and globs
+	for k, val := range cfg.Follower {
+		//followers on unavailable network shares are picked up when the share monitor sees them return
+		if val.NetworkShare() && !shareAvailable(val.Base_Directory) {
+			igst.Warn("file_follower skipping %s, network share %s is unavailable", k, val.Base_Directory)
+			continue
+		}
+		if err = fs.add(k, *val, cfg.Preprocessor, src, lgr, dbg); err != nil {
+			fs.Close()
+			return
+		}
+	}
+	return
+}
+
+func (fs *followerSet) add(k string, val follower, pp processors.ProcessorConfig, src net.IP, lgr handlerLogger, dbg func(string, ...interface{})) error {
+	pproc, err := pp.ProcessorSet(fs.igst, val.Preprocessor)
+	if err != nil {
+		return fmt.Errorf("Preprocessor construction error: %v", err)
+	}
+	fs.procs = append(fs.procs, pproc)
+	//get the tag for this listener
+	tag, err := fs.tag(val.Tag_Name)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve tag \"%s\" for %s: %v", val.Tag_Name, k, err)
+	}
+	fsrc := src
+	if ip, err := val.SourceOverride(); err != nil {
+		return fmt.Errorf("Invalid Source-Override for %s: %v", k, err)
+	} else if ip != nil {
+		fsrc = ip
+	}
+
+	st := allStats.get(k)
+	gate := allGates.get(k)
+	pause := func(h logHandler) logHandler {
+		return &pauseHandler{lh: h, g: gate, done: fs.done}
+	}
+
+	//create our handler for this watcher, timestamps and prefixes are handled in our handler chain.
+	//The watcher reads every file on its own goroutine and the handlers write straight into the
+	//muxer, which batches for the indexers, so files are ingested in parallel and each file stays
+	//in order.  Handlers must not buffer, the file offset advances as soon as HandleLog returns.
+	wr, err := val.Router(pproc, fs.tag)
+	if err != nil {
+		return fmt.Errorf("Failed to generate tag router for %s: %v", k, err)
+	}
+	newLogHandler := func(tag entry.EntryTag, w entryWriter) (logHandler, error) {
+		cfg := filewatch.LogHandlerConfig{
+			Tag:      tag,
+			Src:      fsrc,
+			IgnoreTS: true,
+			Logger:   lgr,
+		}
+		if dbg != nil {
+			cfg.Debugger = dbg
+		}
+		lh, err := filewatch.NewLogHandler(cfg, &statsWriter{w: w, st: st})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to generate handler: %v", err)
+		}
+		return lh, nil
+	}
+	lh, err := newLogHandler(tag, wr)
+	if err != nil {
+		return err
+	}
+	//quarantined records skip the tag router so they always land in the quarantine tag
+	var qh logHandler
+	if val.Quarantine_Tag != `` {
+		qtag, err := fs.tag(val.Quarantine_Tag)
+		if err != nil {
+			return fmt.Errorf("Failed to resolve tag \"%s\" for %s: %v", val.Quarantine_Tag, k, err)
+		}
+		qlh, err := newLogHandler(qtag, pproc)
+		if err != nil {
+			return err
+		}
+		qh = &quarantineHandler{lh: qlh, st: st}
+	}
+	if layout, ok, err := val.BinaryLayout(); err != nil {
+		return fmt.Errorf("Invalid binary record layout for %s: %v", k, err)
+	} else if ok {
+		//binary records bypass the text handlers, each record is a single entry
+		bf, err := newCompressedFollower(k, val, val.File_Filter, pause(&statsHandler{lh: lh, st: st}), filewatch.FollowerEngineConfig{})
+		if err != nil {
+			return fmt.Errorf("Failed to create binary follower for %s: %v", k, err)
+		}
+		fs.bins.Add(binaryFollower{compressedFollower: bf, layout: layout})
+		return nil
+	}
+	if val.CSV_Handler {
+		//every CSV file has its own header, which the shared filewatch handlers cannot tell apart
+		hnd, ch, err := val.handler(lh, qh, st)
+		if err != nil {
+			return fmt.Errorf("Failed to generate handler for %s: %v", k, err)
+		}
+		cf, err := newCompressedFollower(k, val, val.File_Filter, pause(hnd), filewatch.FollowerEngineConfig{})
+		if err != nil {
+			return fmt.Errorf("Failed to create CSV follower for %s: %v", k, err)
+		}
+		csvf, err := val.newCSVFollower(cf, ch)
+		if err != nil {
+			return fmt.Errorf("Failed to create CSV follower for %s: %v", k, err)
+		}
+		fs.csvs.Add(csvf)
+		return nil
+	}
+	hnd, err := val.Handler(lh, qh, st)
+	if err != nil {
+		return fmt.Errorf("Failed to generate handler for %s: %v", k, err)
+	}
+	hnd = pause(hnd)
+	c := filewatch.WatchConfig{
+		ConfigName: k,
+		BaseDir:    val.Base_Directory,
+		FileFilter: val.File_Filter,
+		Hnd:        hnd,
+		Recursive:  val.Recursive,
+	}
+	if c.FollowerEngineConfig, err = val.Engine(); err != nil {
+		return fmt.Errorf("Invalid record delimiter: %v", err)
+	}
+	if ft, err := val.FilenameTagger(); err != nil {
+		return fmt.Errorf("Invalid filename tags for %s: %v", k, err)
+	} else if ft != nil {
+		groups, seen := val.filenameTagGroups(ft, lgr)
+		fs.tagged[k] = taggedFollower{val: val, seen: seen}
+		for _, g := range groups {
+			gc := c
+			gc.FileFilter = g.filter()
+			if g.tag != val.Tag_Name {
+				gtag, err := fs.tag(g.tag)
+				if err != nil {
+					return fmt.Errorf("Failed to resolve tag \"%s\" for %s: %v", g.tag, k, err)
+				}
+				glh, err := newLogHandler(gtag, wr)
+				if err != nil {
+					return err
+				}
+				ghnd, err := val.Handler(glh, qh, st)
+				if err != nil {
+					return fmt.Errorf("Failed to generate handler for %s: %v", k, err)
+				}
+				gc.Hnd = pause(ghnd)
+			}
+			if err := fs.addWatch(k, val, gc); err != nil {
+				return err
+			}
+		}
+	} else if err := fs.addWatch(k, val, c); err != nil {
+		return err
+	} else if val.Follow_Symlinks {
+		if err := fs.addSymlinks(k, val, c); err != nil {
+			return err
+		}
+	}
+	if val.Compressed_File_Filter != `` {
+		if err := fs.cmpr.Add(k, val, hnd, c.FollowerEngineConfig); err != nil {
+			return fmt.Errorf("Failed to add compressed file filter for %s: %v", k, err)
+		}
+	}
+	if err := fs.pacts.Add(k, val); err != nil {
+		return fmt.Errorf("Failed to add post ingest action for %s: %v", k, err)
+	}
+	return nil
+}
+
+// addWatch adds a location to the watcher and keeps it for backfills, stats, and fingerprints
+func (fs *followerSet) addWatch(k string, val follower, c filewatch.WatchConfig) error {
+	if err := fs.wtchr.Add(c); err != nil {
+		return fmt.Errorf("Failed to add watch directory for %s (%s): %v",
+			c.BaseDir, c.FileFilter, err)
+	}
+	bf, err := newCompressedFollower(k, val, c.FileFilter, c.Hnd, c.FollowerEngineConfig)
+	if err != nil {
+		return fmt.Errorf("Invalid record delimiter: %v", err)
+	}
+	fs.bfill = append(fs.bfill, bf)
+	fs.fprts.Add(bf)
+	fs.added++
+	return nil
+}
+
+// addSymlinks points the watcher directly at the targets of symlinks under the follower
+func (fs *followerSet) addSymlinks(k string, val follower, c filewatch.WatchConfig) error {
+	tgts, links := val.symlinkTargets()
+	fs.slinks[k] = val
+	fs.links[k] = links
+	for _, t := range tgts {
+		c.BaseDir, c.FileFilter, c.Recursive = t.dir, t.filter, t.recursive
+		if err := fs.wtchr.Add(c); err != nil {
+			fs.igst.Warn("file_follower failed to add symlink target %s (%s) for %s: %v", t.dir, t.filter, k, err)
+			continue
+		}
+		sval := val
+		sval.Base_Directory, sval.Recursive = t.dir, t.recursive
+		bf, err := newCompressedFollower(k, sval, t.filter, c.Hnd, c.FollowerEngineConfig)
+		if err != nil {
+			return fmt.Errorf("Invalid record delimiter: %v", err)
+		}
+		fs.bfill = append(fs.bfill, bf)
+		fs.fprts.Add(bf)
+	}
+	return nil
+}
+
+// Changed is notified when symlinks or files under a follower changed and the set must be rebuilt
+func (fs *followerSet) Changed() <-chan bool {
+	if fs == nil {
+		return nil
+	}
+	return fs.changed
+}
+
+// notifyChanged never blocks, a single pending notification rebuilds the set
+func (fs *followerSet) notifyChanged() {
+	select {
+	case fs.changed <- true:
+	default:
+	}
+}
+
+// tag resolves a tag name, tags that were not part of the initial muxer configuration
+// (such as those added by a configuration reload) are negotiated with the indexers
+func (fs *followerSet) tag(name string) (tg entry.EntryTag, err error) {
+	if tg, err = fs.igst.GetTag(name); err == ingest.ErrTagNotFound {
+		tg, err = fs.igst.NegotiateTag(name)
+	}
+	return
+}
+
+func (fs *followerSet) Start() error {
+	//with every follower on an unavailable network share there is nothing to watch yet
+	if fs.added > 0 {
+		if err := fs.wtchr.Start(); err != nil {
+			return fmt.Errorf("Failed to start file watcher: %v", err)
+		}
+		fs.fprts.Start()
+	}
+	if fs.bins.Count() > 0 {
+		if err := fs.bins.Start(); err != nil {
+			fs.igst.Error("Failed to start binary file manager: %v", err)
+		}
+	}
+	if fs.csvs.Count() > 0 {
+		if err := fs.csvs.Start(); err != nil {
+			fs.igst.Error("Failed to start CSV file manager: %v", err)
+		}
+	}
+	if fs.cmpr.Count() > 0 {
+		if err := fs.cmpr.Start(); err != nil {
+			fs.igst.Error("Failed to start compressed file manager: %v", err)
+		}
+	}
+	if fs.pacts.Count() > 0 {
+		fs.pacts.Start()
+	}
+	if fs.rptr != nil {
+		fs.rptr.Start()
+	}
+	if len(fs.slinks) > 0 || len(fs.tagged) > 0 {
+		fs.quit = make(chan bool)
+	}
+	if len(fs.slinks) > 0 {
+		fs.wg.Add(1)
+		go fs.symlinkRoutine()
+	}
+	if len(fs.tagged) > 0 {
+		fs.wg.Add(1)
+		go fs.filenameTagRoutine()
+	}
+	return nil
+}
+
+// Close stops the watchers and preprocessors, the muxer is left open
+func (fs *followerSet) Close() (err error) {
+	if fs.done != nil {
+		close(fs.done)
+		fs.done = nil
+	}
+	if fs.rptr != nil {
+		fs.rptr.Close()
+		fs.rptr = nil
+	}
+	if fs.quit != nil {
+		close(fs.quit)
+		fs.wg.Wait()
+		fs.quit = nil
+	}
+	fs.pacts.Close()
+	if err = fs.wtchr.Close(); err != nil {
+		err = fmt.Errorf("Failed to close file follower: %v", err)
+	}
+	//fingerprints are taken after the watcher wrote its final states so the two agree
+	if lerr := fs.fprts.Close(); lerr != nil {
+		fs.igst.Error("Failed to write file fingerprints: %v", lerr)
+	}
+	if lerr := fs.cmpr.Close(); lerr != nil {
+		fs.igst.Error("Failed to close compressed file manager: %v", lerr)
+	}
+	if lerr := fs.bins.Close(); lerr != nil {
+		fs.igst.Error("Failed to close binary file manager: %v", lerr)
+	}
+	if lerr := fs.csvs.Close(); lerr != nil {
+		fs.igst.Error("Failed to close CSV file manager: %v", lerr)
+	}
+	//close down all the preprocessors
+	for _, v := range fs.procs {
+		if v != nil {
+			if lerr := v.Close(); lerr != nil {
+				fs.igst.Error("Failed to close preprocessor: %v", lerr)
+			}
+		}
+	}
+	fs.procs = nil
+	return
+}
+
+// reloadConfig re-reads the configuration file and verifies that only follower and
+// preprocessor settings changed, global settings require a restart
+func reloadConfig(p string, old *cfgType) (cfg *cfgType, err error) {
+	if cfg, err = GetConfig(p); err != nil {
+		return
+	}
+	if cfg.StatePath() != old.StatePath() {
+		err = fmt.Errorf("State-Store-Location cannot be changed without a restart")
+	} else if cfg.Follower_Config_Dir != old.Follower_Config_Dir {
+		err = fmt.Errorf("Follower-Config-Dir cannot be changed without a restart")
+	}
+	return
+}
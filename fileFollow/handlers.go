@@ -0,0 +1,437 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingesters/v3/utils"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const (
+	encodingAuto           = `auto`
+	encodingUTF16          = `utf-16`
+	defaultMaskReplacement = `****`
+
+	//filewatch regex engine arguments that split UTF-16 text on the whole newline code unit
+	utf16LENewline = `\n\x00`
+	utf16BENewline = `\x00\n`
+)
+
+const (
+	noUTF16 utf16Order = iota
+	utf16BOM
+	utf16LE
+	utf16BE
+)
+
+var (
+	utf8BOM    = []byte{0xef, 0xbb, 0xbf}
+	utf16LEBOM = []byte{0xff, 0xfe}
+	utf16BEBOM = []byte{0xfe, 0xff}
+)
+
+type utf16Order int
+
+// logHandler is the interface the filewatch library expects from a handler
+type logHandler interface {
+	HandleLog([]byte, time.Time) error
+}
+
+// Handler wraps the base log handler with any additional processing the follower requires,
+// the base handler must be configured to ignore timestamps as they are extracted here.
+// Records that fail parsing or the line requirements go to the quarantine handler if it
+// is not nil.
+func (f follower) Handler(lh, qh logHandler, st *followerStats) (logHandler, error) {
+	hnd, _, err := f.handler(lh, qh, st)
+	return hnd, err
+}
+
+// handler builds the handler chain and also returns the CSV handler within the chain, which
+// is nil unless the follower has CSV-Handler set
+func (f follower) handler(lh, qh logHandler, st *followerStats) (hnd logHandler, ch *csvHandler, err error) {
+	//masking is closest to the base handlers so nothing unmasked reaches an entry
+	if len(f.Mask_Regex) > 0 {
+		mh, err := newMaskHandler(f.Mask_Regex, f.Mask_Replacement, lh)
+		if err != nil {
+			return nil, nil, err
+		}
+		lh = mh
+		if qh != nil {
+			qmh := *mh
+			qmh.lh = qh
+			qh = &qmh
+		}
+	}
+	if !f.IgnoreTimestamps() {
+		th, err := f.newTimestampHandler(lh, qh, st)
+		if err != nil {
+			return nil, nil, err
+		}
+		lh = th
+	}
+	if f.CSV_Handler {
+		if ch, err = f.newCSVHandler(lh, qh, st); err != nil {
+			return nil, nil, err
+		}
+		lh = ch
+	}
+	//filters are closest to the base handler so they see decoded and assembled records
+	if len(f.Ignore_Line_Prefix) > 0 || len(f.Ignore_Line_Regex) > 0 || len(f.Require_Line_Regex) > 0 {
+		fh, err := newFilterHandler(f.Ignore_Line_Prefix, f.Ignore_Line_Regex, f.Require_Line_Regex, lh, qh)
+		if err != nil {
+			return nil, nil, err
+		}
+		lh = fh
+	}
+	if f.Encoding != `` {
+		eh, err := newEncodingHandler(f.Encoding, lh)
+		if err != nil {
+			return nil, nil, err
+		}
+		if eh != nil {
+			lh = eh
+		}
+	}
+	if f.Record_Start_Regex != `` {
+		lh = &recordHandler{
+			lh:       lh,
+			maxLines: f.Max_Record_Lines,
+			maxBytes: f.Max_Record_Bytes,
+		}
+	}
+	return &statsHandler{lh: lh, st: st}, ch, nil
+}
+
+// timestampHandler extracts timestamps ahead of the base handler so that records without
+// a timestamp can be counted, those records get the time they were read or are quarantined
+type timestampHandler struct {
+	sync.Mutex
+	lh logHandler
+	qh logHandler
+	tg timestampExtractor
+	st *followerStats
+}
+
+func (f follower) newTimestampHandler(lh, qh logHandler, st *followerStats) (th *timestampHandler, err error) {
+	th = &timestampHandler{
+		lh: lh,
+		qh: qh,
+		st: st,
+	}
+	th.tg, err = f.timestampExtractor()
+	return
+}
+
+func (th *timestampHandler) HandleLog(b []byte, catchts time.Time) error {
+	if len(b) == 0 {
+		return nil
+	}
+	th.Lock()
+	ts, ok, err := th.tg.Extract(b)
+	th.Unlock()
+	if err != nil {
+		return fmt.Errorf("Catastrophic timegrinder failure: %v", err)
+	} else if ok {
+		catchts = ts
+	} else {
+		th.st.parseFailure()
+		if th.qh != nil {
+			return th.qh.HandleLog(b, catchts)
+		}
+	}
+	return th.lh.HandleLog(b, catchts)
+}
+
+// quarantineHandler counts the records sent to the quarantine tag, they are handed to the
+// base handler untouched so the original record can be inspected, apart from Mask-Regex
+type quarantineHandler struct {
+	lh logHandler
+	st *followerStats
+}
+
+func (qh *quarantineHandler) HandleLog(b []byte, catchts time.Time) error {
+	atomic.AddInt64(&qh.st.quarantined, 1)
+	return qh.lh.HandleLog(b, catchts)
+}
+
+// filterHandler drops lines with an ignored prefix or matching any ignore regex and,
+// if require regexes are specified, lines which match none of them unless there is a
+// quarantine handler to hand them to
+type filterHandler struct {
+	lh       logHandler
+	qh       logHandler
+	prefixes [][]byte
+	ignore   []*regexp.Regexp
+	require  []*regexp.Regexp
+}
+
+func newFilterHandler(prefixes, ignore, require []string, lh, qh logHandler) (fh *filterHandler, err error) {
+	fh = &filterHandler{
+		lh: lh,
+		qh: qh,
+	}
+	for _, prefix := range prefixes {
+		if prefix != `` {
+			fh.prefixes = append(fh.prefixes, []byte(prefix))
+		}
+	}
+	if fh.ignore, err = compileRegexes(ignore); err != nil {
+		err = fmt.Errorf("Invalid Ignore-Line-Regex: %v", err)
+	} else if fh.require, err = compileRegexes(require); err != nil {
+		err = fmt.Errorf("Invalid Require-Line-Regex: %v", err)
+	}
+	return
+}
+
+func compileRegexes(v []string) (r []*regexp.Regexp, err error) {
+	for _, s := range v {
+		if s == `` {
+			continue
+		}
+		var rx *regexp.Regexp
+		if rx, err = regexp.Compile(s); err != nil {
+			return
+		}
+		r = append(r, rx)
+	}
+	return
+}
+
+func (fh *filterHandler) HandleLog(b []byte, catchts time.Time) error {
+	for _, prefix := range fh.prefixes {
+		if bytes.HasPrefix(b, prefix) {
+			return nil
+		}
+	}
+	for _, rx := range fh.ignore {
+		if rx.Match(b) {
+			return nil
+		}
+	}
+	if len(fh.require) > 0 && !matchAny(fh.require, b) {
+		if fh.qh != nil {
+			return fh.qh.HandleLog(b, catchts)
+		}
+		return nil
+	}
+	return fh.lh.HandleLog(b, catchts)
+}
+
+// maskHandler replaces everything matching the mask regexes so sensitive values are
+// scrubbed before records leave the host, the replacement may reference captures like ${1}
+type maskHandler struct {
+	lh   logHandler
+	rxs  []*regexp.Regexp
+	repl []byte
+}
+
+func newMaskHandler(masks []string, repl string, lh logHandler) (mh *maskHandler, err error) {
+	if repl == `` {
+		repl = defaultMaskReplacement
+	}
+	mh = &maskHandler{
+		lh:   lh,
+		repl: []byte(repl),
+	}
+	if mh.rxs, err = compileRegexes(masks); err != nil {
+		err = fmt.Errorf("Invalid Mask-Regex: %v", err)
+	}
+	return
+}
+
+func (mh *maskHandler) HandleLog(b []byte, catchts time.Time) error {
+	for _, rx := range mh.rxs {
+		b = rx.ReplaceAll(b, mh.repl)
+	}
+	return mh.lh.HandleLog(b, catchts)
+}
+
+func matchAny(rxs []*regexp.Regexp, b []byte) bool {
+	for _, rx := range rxs {
+		if rx.Match(b) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordHandler cleans up multi-line records handed out by the regex engine
+// and splits records that exceed the configured line and byte limits
+type recordHandler struct {
+	lh       logHandler
+	maxLines int
+	maxBytes int
+}
+
+func (rh *recordHandler) HandleLog(b []byte, catchts time.Time) error {
+	if b = bytes.Trim(b, "\r\n"); len(b) == 0 {
+		return nil
+	}
+	for len(b) > 0 {
+		var rec []byte
+		rec, b = rh.next(b)
+		if err := rh.lh.HandleLog(rec, catchts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next returns the next record that fits within the limits and the remainder
+func (rh *recordHandler) next(b []byte) (rec, rem []byte) {
+	end := len(b)
+	if rh.maxLines > 0 {
+		var lines int
+		for i := 0; i < len(b); i++ {
+			if b[i] != '\n' {
+				continue
+			}
+			if lines++; lines == rh.maxLines {
+				end = i
+				break
+			}
+		}
+	}
+	if rh.maxBytes > 0 && end > rh.maxBytes {
+		end = rh.maxBytes
+		//attempt to break on a line boundary
+		if idx := bytes.LastIndexByte(b[:end], '\n'); idx > 0 {
+			end = idx
+		}
+	}
+	rec = bytes.TrimRight(b[:end], "\r\n")
+	rem = bytes.TrimLeft(b[end:], "\r\n")
+	return
+}
+
+// encodingHandler transcodes lines to UTF-8 before handing them to the log handler
+// UTF-16 is handled directly, utf-16le and utf-16be followers split on the whole newline
+// code unit but utf-16 and auto followers use the line engine which splits on the 0x0A byte
+// and leaves the other half of the newline code unit on one side of the split
+type encodingHandler struct {
+	lh    logHandler
+	enc   encoding.Encoding
+	order utf16Order
+	auto  bool
+}
+
+// newEncodingHandler returns a nil handler if the encoding requires no conversion
+func newEncodingHandler(name string, lh logHandler) (eh *encodingHandler, err error) {
+	eh = &encodingHandler{
+		lh: lh,
+	}
+	if eh.order = utf16Encoding(name); eh.order != noUTF16 {
+		return
+	}
+	switch name = strings.ToLower(strings.TrimSpace(name)); name {
+	case encodingAuto:
+		eh.auto = true
+	default:
+		if eh.enc, err = utils.GetEncoding(name); err != nil {
+			eh = nil
+		} else if eh.enc == nil {
+			eh = nil //utf-8, nothing to do
+		}
+	}
+	return
+}
+
+// utf16Encoding returns the byte order of a UTF-16 encoding name, noUTF16 for any other encoding
+func utf16Encoding(name string) utf16Order {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case encodingUTF16:
+		return utf16BOM
+	case `utf-16le`, `utf16le`:
+		return utf16LE
+	case `utf-16be`, `utf16be`:
+		return utf16BE
+	}
+	return noUTF16
+}
+
+func (eh *encodingHandler) HandleLog(b []byte, catchts time.Time) error {
+	b, err := eh.decode(b)
+	if err != nil {
+		return fmt.Errorf("Failed to decode line: %v", err)
+	}
+	if b = bytes.Trim(bytes.TrimPrefix(b, utf8BOM), "\r\n"); len(b) == 0 {
+		return nil
+	}
+	return eh.lh.HandleLog(b, catchts)
+}
+
+func (eh *encodingHandler) decode(b []byte) ([]byte, error) {
+	order := eh.order
+	if eh.auto || order == utf16BOM {
+		if bytes.HasPrefix(b, utf8BOM) {
+			return b[len(utf8BOM):], nil
+		} else if bytes.HasPrefix(b, utf16LEBOM) {
+			order = utf16LE
+			b = b[len(utf16LEBOM):]
+		} else if bytes.HasPrefix(b, utf16BEBOM) {
+			order = utf16BE
+			b = b[len(utf16BEBOM):]
+		} else if eh.auto && bytes.IndexByte(b, 0) == -1 {
+			return b, nil //no BOM and no NULs, treat as UTF-8
+		} else {
+			order = guessUTF16Order(b)
+		}
+	}
+	switch order {
+	case utf16LE:
+		//a leading NUL is the high byte of the previous newline
+		if len(b)%2 == 1 && b[0] == 0 {
+			b = b[1:]
+		}
+		return decodeUTF16(unicode.LittleEndian, b)
+	case utf16BE:
+		//a trailing NUL is the high byte of the newline we split on
+		return decodeUTF16(unicode.BigEndian, b)
+	}
+	return utils.Transcode(eh.enc, b)
+}
+
+func decodeUTF16(e unicode.Endianness, b []byte) ([]byte, error) {
+	if len(b)%2 == 1 {
+		b = b[:len(b)-1]
+	}
+	return unicode.UTF16(e, unicode.IgnoreBOM).NewDecoder().Bytes(b)
+}
+
+// guessUTF16Order looks at where the NUL bytes land, mostly-ASCII little endian
+// text has them in the odd positions and big endian text in the even positions
+func guessUTF16Order(b []byte) utf16Order {
+	if len(b)%2 == 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	var even, odd int
+	for i := range b {
+		if b[i] != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			even++
+		} else {
+			odd++
+		}
+	}
+	if even > odd {
+		return utf16BE
+	}
+	return utf16LE
+}
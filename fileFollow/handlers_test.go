@@ -0,0 +1,258 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+)
+
+// utf16Bytes encodes a string as UTF-16 code units in the given byte order
+func utf16Bytes(s string, bigEndian bool) (b []byte) {
+	for _, r := range s {
+		if bigEndian {
+			b = append(b, byte(r>>8), byte(r))
+		} else {
+			b = append(b, byte(r), byte(r>>8))
+		}
+	}
+	return
+}
+
+// splitRecords runs data through the same splitter the compressed follower uses for the engine
+func splitRecords(t *testing.T, ecfg filewatch.FollowerEngineConfig, data []byte, lh logHandler) {
+	t.Helper()
+	s := bufio.NewScanner(bytes.NewReader(data))
+	if ecfg.Engine == filewatch.RegexEngine {
+		s.Split(regexSplitter(regexp.MustCompile(ecfg.EngineArgs)))
+	}
+	for s.Scan() {
+		if err := lh.HandleLog(append([]byte(nil), s.Bytes()...), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordStartRegex(t *testing.T) {
+	tests := []struct {
+		rex  string
+		in   string
+		recs []string
+	}{
+		{
+			rex:  `^\d{4}-\d{2}-\d{2} `,
+			in:   "2020-01-02 panic\n\tat main.go:10\n\tat main.go:20\n2020-01-02 ok\n",
+			recs: []string{"2020-01-02 panic\n\tat main.go:10\n\tat main.go:20", `2020-01-02 ok`},
+		},
+		{
+			rex:  `\AINFO|WARN`,
+			in:   "INFO start\n  detail WARN\nWARN next\n  more\nINFO last",
+			recs: []string{"INFO start\n  detail WARN", "WARN next\n  more", `INFO last`},
+		},
+		{
+			rex:  `\[`,
+			in:   "[a]\n[b]\n",
+			recs: []string{`[a]`, `[b]`},
+		},
+	}
+	for _, tt := range tests {
+		f := follower{Record_Start_Regex: tt.rex}
+		ecfg, err := f.Engine()
+		if err != nil {
+			t.Fatal(err)
+		} else if ecfg.Engine != filewatch.RegexEngine {
+			t.Fatalf("%s did not select the regex engine", tt.rex)
+		}
+		var c captureHandler
+		splitRecords(t, ecfg, []byte(tt.in), &recordHandler{lh: &c})
+		if len(c.lines) != len(tt.recs) {
+			t.Fatalf("%s split into %q, expected %q", tt.rex, c.lines, tt.recs)
+		}
+		for i := range tt.recs {
+			if c.lines[i] != tt.recs[i] {
+				t.Fatalf("%s record %d is %q, expected %q", tt.rex, i, c.lines[i], tt.recs[i])
+			}
+		}
+	}
+	if _, _, err := (follower{Record_Start_Regex: `(`}).RecordDelimited(); err == nil {
+		t.Fatal("accepted an invalid regex")
+	}
+}
+
+func TestRecordLimits(t *testing.T) {
+	tests := []struct {
+		maxLines int
+		maxBytes int
+		in       string
+		recs     []string
+	}{
+		{in: "a\nb\nc", recs: []string{"a\nb\nc"}},
+		{maxLines: 2, in: "a\nb\nc\nd\ne", recs: []string{"a\nb", "c\nd", `e`}},
+		{maxBytes: 6, in: "abc\ndefgh", recs: []string{`abc`, `defgh`}},
+		{maxBytes: 4, in: `abcdefghij`, recs: []string{`abcd`, `efgh`, `ij`}},
+		{maxLines: 3, maxBytes: 4, in: "a\nb\nc\nd", recs: []string{"a\nb", "c\nd"}},
+		{maxLines: 1, in: "\r\na\r\n\r\nb\r\n", recs: []string{`a`, `b`}},
+	}
+	for _, tt := range tests {
+		var c captureHandler
+		rh := &recordHandler{lh: &c, maxLines: tt.maxLines, maxBytes: tt.maxBytes}
+		if err := rh.HandleLog([]byte(tt.in), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.lines) != len(tt.recs) {
+			t.Fatalf("%q with %d lines and %d bytes split into %q, expected %q", tt.in, tt.maxLines, tt.maxBytes, c.lines, tt.recs)
+		}
+		for i := range tt.recs {
+			if c.lines[i] != tt.recs[i] {
+				t.Fatalf("%q record %d is %q, expected %q", tt.in, i, c.lines[i], tt.recs[i])
+			}
+		}
+	}
+}
+
+func TestEncodingHandler(t *testing.T) {
+	tests := []struct {
+		enc string
+		in  []byte
+		out string
+	}{
+		{enc: `utf-16le`, in: utf16Bytes("A\u4e0a\r\n", false), out: "A\u4e0a"},
+		{enc: `UTF16BE`, in: utf16Bytes("A\u4e0a\n", true), out: "A\u4e0a"},
+		{enc: `utf-16`, in: utf16Bytes("\ufeffbom", false), out: `bom`},
+		{enc: `utf-16`, in: utf16Bytes("\ufeffbom", true), out: `bom`},
+		{enc: `utf-16`, in: utf16Bytes(`guess`, true), out: `guess`},
+		{enc: `auto`, in: []byte("héllo"), out: "héllo"},
+		{enc: `auto`, in: []byte("\ufeffhéllo"), out: "héllo"},
+		{enc: `auto`, in: utf16Bytes(`little`, false), out: `little`},
+		{enc: `auto`, in: utf16Bytes(`big`, true), out: `big`},
+		{enc: `cp1252`, in: []byte("caf\xe9 \x80"), out: "café €"},
+		{enc: `latin1`, in: []byte("\xe9t\xe9"), out: "été"},
+		//the line engine leaves the high byte of the previous newline at the start
+		{enc: `utf-16le`, in: append([]byte{0}, utf16Bytes(`line`, false)...), out: `line`},
+		//and the high byte of this one at the end
+		{enc: `utf-16be`, in: append(utf16Bytes(`line`, true), 0), out: `line`},
+	}
+	for _, tt := range tests {
+		var c captureHandler
+		eh, err := newEncodingHandler(tt.enc, &c)
+		if err != nil {
+			t.Fatal(err)
+		} else if err = eh.HandleLog(tt.in, time.Now()); err != nil {
+			t.Fatal(err)
+		} else if len(c.lines) != 1 || c.lines[0] != tt.out {
+			t.Fatalf("%s decoded %x into %q, expected %q", tt.enc, tt.in, c.lines, tt.out)
+		}
+	}
+	for _, enc := range []string{``, `utf8`, `UTF-8`} {
+		if eh, err := newEncodingHandler(enc, nil); err != nil || eh != nil {
+			t.Fatalf("%q needs no handler: %v %v", enc, eh, err)
+		}
+	}
+	if _, err := newEncodingHandler(`klingon`, nil); err == nil {
+		t.Fatal("accepted an unknown encoding")
+	}
+}
+
+func TestUTF16Lines(t *testing.T) {
+	//U+4E0A and U+0A4E both hold a 0x0A byte, neither may split a line
+	lines := []string{"\u4e0a\u0a4e", "abc", "\u4e0b"}
+	for _, be := range []bool{false, true} {
+		enc := `utf-16le`
+		if be {
+			enc = `utf-16be`
+		}
+		var in string
+		for _, l := range lines {
+			in += l + "\r\n"
+		}
+		f := follower{Encoding: enc}
+		ecfg, err := f.Engine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c captureHandler
+		hnd, err := f.Handler(&c, nil, &followerStats{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		splitRecords(t, ecfg, utf16Bytes("\ufeff"+in, be), hnd)
+		if len(c.lines) != len(lines) {
+			t.Fatalf("%s split into %q, expected %q", enc, c.lines, lines)
+		}
+		for i := range lines {
+			if c.lines[i] != lines[i] {
+				t.Fatalf("%s line %d is %q, expected %q", enc, i, c.lines[i], lines[i])
+			}
+		}
+	}
+}
+
+func TestCSVRowSplitter(t *testing.T) {
+	tests := []struct {
+		enc  string
+		in   []byte
+		rows []string //raw rows including the delimiter, the partial row is never handed out
+	}{
+		{in: []byte("a,b\nc,d\r\npartial"), rows: []string{"a,b\n", "c,d\r\n"}},
+		{in: []byte("\n\nx"), rows: []string{"\n", "\n"}},
+		{enc: `utf-16le`, in: utf16Bytes("\u0a4e\u4e00\nx", false), rows: []string{string(utf16Bytes("\u0a4e\u4e00\n", false))}},
+		{enc: `utf-16be`, in: utf16Bytes("\n\u4e00\u0a4e\n", true), rows: []string{string(utf16Bytes("\n", true)), string(utf16Bytes("\u4e00\u0a4e\n", true))}},
+		//newlines in quoted fields stay in the row
+		{in: []byte("\"a\nb\",c\r\nd\n"), rows: []string{"\"a\nb\",c\r\n", "d\n"}},
+		{in: []byte("a, \"x\"\"\n\"\nb\n"), rows: []string{"a, \"x\"\"\n\"\n", "b\n"}},
+		{in: []byte("a,\"open\nrow\n"), rows: nil},
+		{in: []byte("a,\"b\"\n"), rows: []string{"a,\"b\"\n"}},
+		//quotes that do not open a field and stray quotes do not end it
+		{in: []byte("a\"b\nc\n"), rows: []string{"a\"b\n", "c\n"}},
+		{in: []byte("\"a\"b\nc\"\nd\n"), rows: []string{"\"a\"b\nc\"\n", "d\n"}},
+		{enc: `utf-16le`, in: utf16Bytes("\"\u0a22\n\",\u220a\nx", false), rows: []string{string(utf16Bytes("\"\u0a22\n\",\u220a\n", false))}},
+		{enc: `utf-16be`, in: utf16Bytes("\"a\n\"\n\"", true), rows: []string{string(utf16Bytes("\"a\n\"\n", true))}},
+	}
+	for _, tt := range tests {
+		s := bufio.NewScanner(bytes.NewReader(tt.in))
+		s.Split(csvRowSplitter(follower{Encoding: tt.enc}.csvDelimiter()))
+		var rows []string
+		for s.Scan() {
+			rows = append(rows, s.Text())
+		}
+		if len(rows) != len(tt.rows) {
+			t.Fatalf("%s split %x into %q, expected %q", tt.enc, tt.in, rows, tt.rows)
+		}
+		for i := range rows {
+			if rows[i] != tt.rows[i] {
+				t.Fatalf("%s row %d is %x, expected %x", tt.enc, i, rows[i], tt.rows[i])
+			}
+		}
+	}
+}
+
+func TestFilterHandler(t *testing.T) {
+	var c, q captureHandler
+	fh, err := newFilterHandler([]string{`#`}, []string{`^DEBUG`}, []string{`user=`}, &c, &q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range []string{`# comment`, `DEBUG user=bob`, `INFO user=bob`, `INFO system`} {
+		if err = fh.HandleLog([]byte(l), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.lines) != 1 || c.lines[0] != `INFO user=bob` {
+		t.Fatalf("bad lines %q", c.lines)
+	} else if len(q.lines) != 1 || q.lines[0] != `INFO system` {
+		t.Fatalf("bad quarantined lines %q", q.lines)
+	}
+}
@@ -0,0 +1,18 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+// longPath is only needed on Windows
+func longPath(p string) string {
+	return p
+}
+
+func migrateStatePaths(cfg *cfgType, lgr handlerLogger) error {
+	return nil
+}
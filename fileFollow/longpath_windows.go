@@ -0,0 +1,74 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gravwell/filewatch/v3"
+)
+
+const (
+	extendedPathPrefix = `\\?\`
+	extendedUNCPrefix  = `\\?\UNC\`
+)
+
+// longPath converts an absolute path to the extended-length form so paths longer than
+// MAX_PATH can be watched and opened, the watcher opens files with CreateFile directly
+// and does not get the conversion the os package applies.  Extended-length paths are
+// not normalized by Windows, so the path must already be clean.
+func longPath(p string) string {
+	if strings.HasPrefix(p, extendedPathPrefix) || !filepath.IsAbs(p) {
+		return p
+	} else if strings.HasPrefix(p, `\\`) {
+		return extendedUNCPrefix + p[2:]
+	}
+	return extendedPathPrefix + p
+}
+
+// migrateStatePaths rewrites state and fingerprint entries recorded before base directories
+// were converted to extended-length paths, otherwise every file would be ingested again
+func migrateStatePaths(cfg *cfgType, lgr handlerLogger) error {
+	p := cfg.StatePath()
+	states, err := loadStates(p)
+	if err != nil {
+		return fmt.Errorf("Failed to read state file %s: %v", p, err)
+	}
+	var moved int
+	for k, v := range states {
+		nk := filewatch.FileName{BaseName: k.BaseName, FilePath: longPath(k.FilePath)}
+		if nk == k {
+			continue
+		}
+		if _, ok := states[nk]; !ok {
+			states[nk] = v
+		}
+		delete(states, k)
+		moved++
+	}
+	if moved == 0 {
+		return nil
+	}
+	if err = writeStates(p, states); err != nil {
+		return fmt.Errorf("Failed to write state file %s: %v", p, err)
+	}
+	lgr.Info("file_follower converted %d state file entries to extended-length paths", moved)
+
+	st, fps, err := loadFingerprints(p)
+	if err != nil {
+		return fmt.Errorf("Failed to read fingerprint file %s: %v", p+fingerprintStateSuffix, err)
+	}
+	nfps := make(map[filewatch.FileName]fingerprint, len(fps))
+	for k, v := range fps {
+		nfps[filewatch.FileName{BaseName: k.BaseName, FilePath: longPath(k.FilePath)}] = v
+	}
+	return st.Write(nfps)
+}
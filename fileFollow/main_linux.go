@@ -14,14 +14,13 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
 	"path"
 	"syscall"
 	"time"
 
-	"github.com/gravwell/filewatch/v3"
 	"github.com/gravwell/ingest/v3"
 	"github.com/gravwell/ingest/v3/log"
-	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/ingesters/v3/utils"
 	"github.com/gravwell/ingesters/v3/version"
 )
@@ -35,6 +34,11 @@ var (
 	verbose        = flag.Bool("v", false, "Display verbose status updates to stdout")
 	ver            = flag.Bool("version", false, "Print the version information and exit")
 	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
+	stateDump      = flag.Bool("state-dump", false, "Print the files and offsets tracked in the state file and exit")
+	stateRepair    = flag.Bool("state-repair", false, "Prune and repair entries in the state file and exit, the ingester must not be running")
+	stateReset     = flag.String("state-reset", "", "Reset offsets for tracked files matching the glob during -state-repair")
+	backfillMode   = flag.Bool("backfill", false, "Ingest the existing contents of all followed files and exit, the follower service must not be running")
+	controlCmd     = flag.String("control", "", "Send \"pause [follower...]\", \"resume [follower...]\", or \"status\" to the running ingester over the Control-Socket and exit")
 
 	v  bool
 	lg *log.Logger
@@ -78,6 +82,22 @@ func main() {
 	if err != nil {
 		lg.FatalCode(0, "Failed to get configuration: %v\n", err)
 	}
+	if *stateDump {
+		if err := dumpStates(cfg, os.Stdout); err != nil {
+			lg.FatalCode(0, "%v\n", err)
+		}
+		return
+	} else if *stateRepair {
+		if err := repairStates(cfg, *stateReset, os.Stdout); err != nil {
+			lg.FatalCode(0, "%v\n", err)
+		}
+		return
+	} else if *controlCmd != `` {
+		if err := sendControl(cfg.Control_Socket, *controlCmd, os.Stdout); err != nil {
+			lg.FatalCode(0, "%v\n", err)
+		}
+		return
+	}
 
 	if len(cfg.Log_File) > 0 {
 		fout, err := os.OpenFile(cfg.Log_File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
@@ -153,107 +173,110 @@ func main() {
 		lg.Fatal("Failed to resolve source IP from muxer: %v", err)
 	}
 
-	wtcher, err := filewatch.NewWatcher(cfg.StatePath())
-	if err != nil {
-		lg.Fatal("Failed to create notification watcher: %v\n", err)
+	var dbg func(string, ...interface{})
+	if v {
+		dbg = debugout
 	}
-
-	//pass in the ingest muxer to the file watcher so it can throw info and errors down the muxer chan
-	wtcher.SetLogger(igst)
-	wtcher.SetMaxFilesWatched(cfg.Max_Files_Watched)
-
-	var procs []*processors.ProcessorSet
-
-	//build a list of base directories and globs
-	for k, val := range cfg.Follower {
-		pproc, err := cfg.Preprocessor.ProcessorSet(igst, val.Preprocessor)
-		if err != nil {
-			lg.FatalCode(0, "Preprocessor construction error: %v", err)
+	if *backfillMode {
+		debugout("Backfilling %d locations\n", len(cfg.Follower))
+		if err := runBackfill(cfg, igst, src, lg, dbg); err != nil {
+			lg.Error("Backfill failed: %v\n", err)
+			igst.Close()
+			os.Exit(-1)
 		}
-		procs = append(procs, pproc)
-		//get the tag for this listener
-		tag, err := igst.GetTag(val.Tag_Name)
-		if err != nil {
-			lg.Fatal("Failed to resolve tag \"%s\" for %s: %v\n", val.Tag_Name, k, err)
-		}
-		var ignore [][]byte
-		for _, prefix := range val.Ignore_Line_Prefix {
-			if prefix != "" {
-				ignore = append(ignore, []byte(prefix))
-			}
-		}
-		tsFmtOverride, err := val.TimestampOverride()
-		if err != nil {
-			lg.FatalCode(0, "Invalid timestamp override \"%s\": %v\n", val.Timestamp_Format_Override, err)
-		}
-
-		//create our handler for this watcher
-		cfg := filewatch.LogHandlerConfig{
-			Tag:                     tag,
-			Src:                     src,
-			IgnoreTS:                val.Ignore_Timestamps,
-			AssumeLocalTZ:           val.Assume_Local_Timezone,
-			IgnorePrefixes:          ignore,
-			TimestampFormatOverride: tsFmtOverride,
-			Logger:                  lg,
-			TimezoneOverride:        val.Timezone_Override,
-		}
-		if v {
-			cfg.Debugger = debugout
-		}
-		lh, err := filewatch.NewLogHandler(cfg, pproc)
-		if err != nil {
-			lg.Fatal("Failed to generate handler: %v", err)
-		}
-		c := filewatch.WatchConfig{
-			ConfigName: k,
-			BaseDir:    val.Base_Directory,
-			FileFilter: val.File_Filter,
-			Hnd:        lh,
-			Recursive:  val.Recursive,
-		}
-		if rex, ok, err := val.TimestampDelimited(); err != nil {
-			lg.FatalCode(0, "Invalid timestamp delimiter: %v\n", err)
-		} else if ok {
-			c.Engine = filewatch.RegexEngine
-			c.EngineArgs = rex
-		} else {
-			c.Engine = filewatch.LineEngine
-		}
-		if err := wtcher.Add(c); err != nil {
-			wtcher.Close()
-			lg.Fatal("Failed to add watch directory for %s (%s): %v\n",
-				val.Base_Directory, val.File_Filter, err)
+		debugout("Backfill complete\n")
+		if err = igst.Close(); err != nil {
+			lg.Error("Failed to close ingest muxer: %v", err)
 		}
+		return
 	}
 
-	if err := wtcher.Start(); err != nil {
-		lg.Error("Failed to start file watcher: %v\n", err)
-		wtcher.Close()
+	//the share monitor is created first so a share that returns while the followers start is not missed
+	sm := newShareMonitor(cfg, igst)
+	fs, err := startFollowerSet(cfg, igst, src, dbg)
+	if err != nil {
+		lg.Error("%v\n", err)
 		igst.Close()
 		os.Exit(-1)
 	}
+	sm.Start()
+	var cs *controlServer
+	if cfg.Control_Socket != `` {
+		if cs, err = newControlServer(cfg.Control_Socket, igst); err != nil {
+			lg.Error("Failed to create control socket %s: %v\n", cfg.Control_Socket, err)
+		} else {
+			cs.Start()
+		}
+	}
 
 	debugout("Started following %d locations\n", len(cfg.Follower))
+	cdm := newConfigDirMonitor(cfg.Follower_Config_Dir, igst)
+	cdm.Start()
 
 	debugout("Running\n")
 
-	//listen for signals so we can close gracefully
-	utils.WaitForQuit()
-	debugout("Attempting to close the watcher... ")
-	if err := wtcher.Close(); err != nil {
-		lg.Error("Failed to close file follower: %v\n", err)
+	//reload rebuilds the followers from the configuration file and the Follower-Config-Dir
+	reload := func() {
+		ncfg, err := reloadConfig(*confLoc, cfg)
+		if err != nil {
+			lg.Error("Failed to reload configuration, continuing with the existing followers: %v\n", err)
+			return
+		}
+		sm.Close()
+		sm = newShareMonitor(ncfg, igst)
+		//stop the existing followers so the state file is flushed before the new watcher loads it
+		if err := fs.Close(); err != nil {
+			lg.Error("%v\n", err)
+		}
+		if fs, err = startFollowerSet(ncfg, igst, src, dbg); err != nil {
+			lg.Error("Failed to start reloaded followers, restoring previous configuration: %v\n", err)
+			sm = newShareMonitor(cfg, igst)
+			if fs, err = startFollowerSet(cfg, igst, src, dbg); err != nil {
+				lg.Fatal("Failed to restore followers: %v\n", err)
+			}
+		} else {
+			cfg = ncfg
+			lg.Info("Reloaded configuration, following %d locations\n", len(cfg.Follower))
+		}
+		sm.Start()
 	}
-	debugout("Done\n")
 
-	//close down all the preprocessors
-	for _, v := range procs {
-		if v != nil {
-			if err := v.Close(); err != nil {
-				lg.Error("Failed to close processors: %v\n", err)
+	//listen for signals so we can close gracefully, SIGHUP reloads the followers
+	qc := utils.GetQuitChannel()
+mainLoop:
+	for {
+		select {
+		case sig := <-qc:
+			if sig != syscall.SIGHUP {
+				break mainLoop
 			}
+			lg.Info("Reloading follower configuration from %s\n", *confLoc)
+			reload()
+		case <-cdm.C():
+			lg.Info("Reloading follower configuration after changes in %s\n", cfg.Follower_Config_Dir)
+			reload()
+		case <-sm.C():
+			//a network share came back, restart the followers so they resume at their saved offsets
+			lg.Info("Restarting followers after network share recovery\n")
+			fs = restartFollowerSet(fs, cfg, igst, src, dbg)
+		case <-fs.Changed():
+			lg.Info("Restarting followers after symlink changes\n")
+			fs = restartFollowerSet(fs, cfg, igst, src, dbg)
+		}
+	}
+	cdm.Close()
+	sm.Close()
+	signal.Stop(qc)
+	if cs != nil {
+		if err := cs.Close(); err != nil {
+			lg.Error("Failed to close control socket: %v\n", err)
 		}
 	}
+	debugout("Attempting to close the watcher... ")
+	if err := fs.Close(); err != nil {
+		lg.Error("%v\n", err)
+	}
+	debugout("Done\n")
 
 	//wait for our ingest relay to exit
 	if err := igst.Sync(time.Second); err != nil {
@@ -264,6 +287,29 @@ func main() {
 	}
 }
 
+func startFollowerSet(cfg *cfgType, igst *ingest.IngestMuxer, src net.IP, dbg func(string, ...interface{})) (fs *followerSet, err error) {
+	if fs, err = newFollowerSet(cfg, igst, src, lg, dbg); err != nil {
+		return
+	}
+	if err = fs.Start(); err != nil {
+		fs.Close()
+		fs = nil
+	}
+	return
+}
+
+// restartFollowerSet closes the followers and starts a new set, failing to restart is fatal
+func restartFollowerSet(fs *followerSet, cfg *cfgType, igst *ingest.IngestMuxer, src net.IP, dbg func(string, ...interface{})) *followerSet {
+	if err := fs.Close(); err != nil {
+		lg.Error("%v\n", err)
+	}
+	fs, err := startFollowerSet(cfg, igst, src, dbg)
+	if err != nil {
+		lg.Fatal("Failed to restart followers: %v\n", err)
+	}
+	return fs
+}
+
 func debugout(format string, args ...interface{}) {
 	if !v {
 		return
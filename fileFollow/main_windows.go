@@ -32,6 +32,11 @@ var (
 	configOverride = flag.String("config-file-override", "", "Override location for configuration file")
 	verboseF       = flag.Bool("v", false, "Verbose mode, do not run as a service and output status to stdout")
 	ver            = flag.Bool("version", false, "Print the version information and exit")
+	stateDump      = flag.Bool("state-dump", false, "Print the files and offsets tracked in the state file and exit")
+	stateRepair    = flag.Bool("state-repair", false, "Prune and repair entries in the state file and exit, the service must be stopped")
+	stateReset     = flag.String("state-reset", "", "Reset offsets for tracked files matching the glob during -state-repair")
+	backfillMode   = flag.Bool("backfill", false, "Ingest the existing contents of all followed files and exit, the service must be stopped")
+	controlCmd     = flag.String("control", "", "Send \"pause [follower...]\", \"resume [follower...]\", or \"status\" to the running service over the Control-Socket and exit")
 
 	confLoc string
 	verbose bool
@@ -85,6 +90,22 @@ func main() {
 		errorout("Failed to get configuration: %v", err)
 		return
 	}
+	if *stateDump {
+		if err := dumpStates(cfg, os.Stdout); err != nil {
+			errorout("%v", err)
+		}
+		return
+	} else if *stateRepair {
+		if err := repairStates(cfg, *stateReset, os.Stdout); err != nil {
+			errorout("%v", err)
+		}
+		return
+	} else if *controlCmd != `` {
+		if err := sendControl(cfg.Control_Socket, *controlCmd, os.Stdout); err != nil {
+			errorout("%v", err)
+		}
+		return
+	}
 
 	s, err := NewService(cfg)
 	if err != nil {
@@ -92,7 +113,11 @@ func main() {
 		return
 	}
 
-	if inter {
+	if *backfillMode {
+		if err := s.Backfill(); err != nil {
+			errorout("Backfill failed: %v", err)
+		}
+	} else if inter {
 		runInteractive(s)
 	} else {
 		runService(s)
@@ -0,0 +1,254 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	postActionNone postAction = iota
+	postActionDelete
+	postActionMove
+
+	defaultPostActionIdle = 5 * time.Minute
+	postActionInterval    = 30 * time.Second
+)
+
+type postAction int
+
+func parsePostAction(v string) (pa postAction, err error) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case ``:
+		pa = postActionNone
+	case `delete`:
+		pa = postActionDelete
+	case `move`:
+		pa = postActionMove
+	default:
+		err = ErrInvalidPostAction
+	}
+	return
+}
+
+func (pa postAction) String() string {
+	switch pa {
+	case postActionDelete:
+		return `delete`
+	case postActionMove:
+		return `move`
+	}
+	return `none`
+}
+
+type postActionFollower struct {
+	name      string
+	base      string
+	filters   []string
+	recursive bool
+	action    postAction
+	archive   string
+	idle      time.Duration
+}
+
+// postActionManager deletes or moves files that have been completely ingested
+// and idle for a period of time.  Ingest completion is determined using the
+// offsets in the follower state file and the compressed file state.
+type postActionManager struct {
+	sync.Mutex
+	statePath string
+	cmpr      *compressedManager
+	flwrs     []postActionFollower
+	lgr       ingest.IngestLogger
+	quit      chan bool
+	wg        sync.WaitGroup
+}
+
+func newPostActionManager(statePath string, cmpr *compressedManager, lgr ingest.IngestLogger) *postActionManager {
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	return &postActionManager{
+		statePath: statePath,
+		cmpr:      cmpr,
+		lgr:       lgr,
+	}
+}
+
+func (pm *postActionManager) SetLogger(lgr ingest.IngestLogger) {
+	pm.Lock()
+	defer pm.Unlock()
+	if lgr == nil {
+		pm.lgr = ingest.NoLogger()
+	} else {
+		pm.lgr = lgr
+	}
+}
+
+// Add registers a follower, followers without a post ingest action are ignored
+func (pm *postActionManager) Add(name string, f follower) (err error) {
+	paf := postActionFollower{
+		name:      name,
+		base:      f.Base_Directory,
+		filters:   append(splitFilters(f.File_Filter), splitFilters(f.Compressed_File_Filter)...),
+		recursive: f.Recursive,
+		archive:   f.Archive_Directory,
+	}
+	if paf.action, err = parsePostAction(f.Post_Ingest_Action); err != nil || paf.action == postActionNone {
+		return
+	}
+	if paf.idle, err = f.PostIngestIdle(); err != nil {
+		return
+	}
+	pm.Lock()
+	pm.flwrs = append(pm.flwrs, paf)
+	pm.Unlock()
+	return
+}
+
+func (pm *postActionManager) Count() int {
+	pm.Lock()
+	defer pm.Unlock()
+	return len(pm.flwrs)
+}
+
+func (pm *postActionManager) Start() {
+	pm.Lock()
+	defer pm.Unlock()
+	if pm.quit != nil {
+		return
+	}
+	pm.quit = make(chan bool)
+	pm.wg.Add(1)
+	go pm.routine()
+}
+
+func (pm *postActionManager) Close() {
+	pm.Lock()
+	if pm.quit != nil {
+		close(pm.quit)
+	}
+	pm.Unlock()
+	pm.wg.Wait()
+	pm.Lock()
+	pm.quit = nil
+	pm.Unlock()
+}
+
+func (pm *postActionManager) routine() {
+	defer pm.wg.Done()
+	tckr := time.NewTicker(postActionInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+			pm.scan()
+		case <-pm.quit:
+			return
+		}
+	}
+}
+
+func (pm *postActionManager) scan() {
+	//states are flushed by the watcher periodically, a failed read just means we try again later
+	states, err := filewatch.ReadStateFile(pm.statePath)
+	if err != nil {
+		pm.lgr.Warn("file_follower failed to read states for post ingest actions: %v", err)
+		return
+	}
+	pm.Lock()
+	flwrs := pm.flwrs
+	pm.Unlock()
+	for _, paf := range flwrs {
+		walkFiles(paf.base, paf.recursive, func(p string, fi os.FileInfo) error {
+			select {
+			case <-pm.quit:
+				return errScanAbort
+			default:
+			}
+			if !matchFilters(paf.filters, fi.Name()) || time.Since(fi.ModTime()) < paf.idle {
+				return nil
+			} else if !pm.complete(states, paf.name, p, fi) {
+				return nil
+			}
+			if err := paf.apply(p); err != nil {
+				pm.lgr.Error("file_follower failed to %s %s: %v", paf.action, p, err)
+			} else {
+				pm.lgr.Info("file_follower completed post ingest %s on %s", paf.action, p)
+			}
+			return nil
+		})
+	}
+}
+
+// complete returns true if the follower has read the entire file or ingested it as a compressed file
+func (pm *postActionManager) complete(states map[string]int64, name, p string, fi os.FileInfo) bool {
+	//the state file keys are the file path joined with the follower name
+	if off, ok := states[filepath.Join(p, name)]; ok && off >= fi.Size() {
+		return true
+	}
+	return pm.cmpr != nil && pm.cmpr.ingested(name, p, fi)
+}
+
+func (paf postActionFollower) apply(p string) error {
+	switch paf.action {
+	case postActionDelete:
+		return os.Remove(p)
+	case postActionMove:
+		return moveFile(p, archivePath(paf.archive, p))
+	}
+	return nil
+}
+
+// archivePath picks a name in the archive directory that does not collide with an existing file
+func archivePath(dir, p string) (r string) {
+	base := filepath.Base(p)
+	r = filepath.Join(dir, base)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(r); os.IsNotExist(err) {
+			return
+		}
+		r = filepath.Join(dir, fmt.Sprintf("%s.%d", base, i))
+	}
+}
+
+// moveFile renames a file, falling back to a copy and delete when crossing filesystems
+func moveFile(src, dst string) (err error) {
+	if err = os.Rename(src, dst); err == nil {
+		return
+	}
+	var fin, fout *os.File
+	if fin, err = os.Open(src); err != nil {
+		return
+	}
+	defer fin.Close()
+	if fout, err = os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640); err != nil {
+		return
+	}
+	if _, err = io.Copy(fout, fin); err != nil {
+		fout.Close()
+		os.Remove(dst)
+		return
+	}
+	if err = fout.Close(); err != nil {
+		os.Remove(dst)
+		return
+	}
+	fin.Close()
+	return os.Remove(src)
+}
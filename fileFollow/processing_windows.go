@@ -13,19 +13,20 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"strings"
 	"time"
 
 	"golang.org/x/sys/windows/svc"
 
-	"github.com/gravwell/filewatch/v3"
 	"github.com/gravwell/ingest/v3"
-	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/ingesters/v3/version"
 	"github.com/gravwell/timegrinder/v3"
 )
 
 const (
 	defaultEntryChannelSize int = 1024
+	startupMinBackoff           = time.Second
+	startupMaxBackoff           = time.Minute
 )
 
 var (
@@ -35,14 +36,18 @@ var (
 type mainService struct {
 	secret      string
 	timeout     time.Duration
+	delay       time.Duration //Startup-Delay
+	retryWindow time.Duration //Startup-Retry-Window
 	tags        []string
 	conns       []string
-	flocs       map[string]follower
+	cfg         *cfgType
 	igst        *ingest.IngestMuxer
 	tg          *timegrinder.TimeGrinder
-	wtchr       *filewatch.WatchManager
-	pp          processors.ProcessorConfig
-	procs       []*processors.ProcessorSet
+	fs          *followerSet
+	sm          *shareMonitor
+	cs          *controlServer
+	cdm         *configDirMonitor
+	src         net.IP
 	srcOverride string
 	cachePath   string
 	logLevel    string
@@ -61,13 +66,6 @@ func NewService(cfg *cfgType) (*mainService, error) {
 		return nil, fmt.Errorf("Failed to get backend targets from configuration: %v", err)
 	}
 	debugout("Acquired tags and targets\n")
-	//fire up the watch manager
-	wtchr, err := filewatch.NewWatcher(cfg.StatePath())
-	if err != nil {
-		return nil, err
-	}
-	//pass in the ingest muxer to the file watcher so it can throw info and errors down the muxer chan
-	wtchr.SetMaxFilesWatched(cfg.Max_Files_Watched)
 
 	id, ok := cfg.IngesterUUID()
 	if !ok {
@@ -77,12 +75,12 @@ func NewService(cfg *cfgType) (*mainService, error) {
 	debugout("Watching %d Directories\n", len(cfg.Follower))
 	return &mainService{
 		timeout:     cfg.Timeout(),
+		delay:       cfg.StartupDelay(),
+		retryWindow: cfg.StartupRetryWindow(),
 		secret:      cfg.Secret(),
 		tags:        tags,
 		conns:       conns,
-		flocs:       cfg.Followers(), //this copies the map
-		wtchr:       wtchr,
-		pp:          cfg.Preprocessor,
+		cfg:         cfg,
 		logLevel:    cfg.LogLevel(),
 		uuid:        id.String(),
 		srcOverride: cfg.Source_Override,
@@ -98,18 +96,25 @@ func (m *mainService) Close() (err error) {
 
 func (m *mainService) shutdown() error {
 	var rerr error
-	if err := m.wtchr.Close(); err != nil {
-		return err
+	if m.cdm != nil {
+		m.cdm.Close()
 	}
-	if m.igst != nil {
-		for _, v := range m.procs {
-			if v != nil {
-				if err := v.Close(); err != nil {
-					err = fmt.Errorf("Failed to close preprocessor: %v", err)
-					errorout("%s", err)
-				}
-			}
+	if m.sm != nil {
+		m.sm.Close()
+	}
+	if m.cs != nil {
+		if err := m.cs.Close(); err != nil {
+			errorout("Failed to close control pipe: %v", err)
+		}
+		m.cs = nil
+	}
+	if m.fs != nil {
+		if err := m.fs.Close(); err != nil {
+			return err
 		}
+		m.fs = nil
+	}
+	if m.igst != nil {
 		if err := m.igst.Sync(time.Second); err != nil {
 			rerr = fmt.Errorf("Failed to sync the ingest muxer: %v", err)
 			errorout("%s", rerr)
@@ -126,34 +131,96 @@ func (m *mainService) shutdown() error {
 }
 
 func (m *mainService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
-	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
 	changes <- svc.Status{State: svc.StartPending}
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
 	var cancel context.CancelFunc
 	m.ctx, cancel = context.WithCancel(context.Background())
 
-	if err := m.init(); err != nil {
-		ssec = true
-		errno = 1000
-		errorout("Failed to initialize the service: %v", err)
-		return
+	//initialization may wait a long time for the network, so keep answering the service manager
+	initDone := make(chan error, 1)
+	go func() {
+		initDone <- m.init()
+	}()
+initLoop:
+	for {
+		select {
+		case err := <-initDone:
+			if err != nil {
+				cancel()
+				ssec = true
+				errno = 1000
+				errorout("Failed to initialize the service: %v", err)
+				return
+			}
+			break initLoop
+		case c, ok := <-r:
+			if !ok {
+				cancel()
+				<-initDone
+				return
+			}
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				infoout("%s stopping before initialization completed", serviceName)
+				cancel()
+				<-initDone
+				changes <- svc.Status{State: svc.StopPending}
+				return
+			case svc.ParamChange:
+				//the configuration is read again once initialization completes
+				changes <- c.CurrentStatus
+			default:
+				errorout("Got invalid control request #%d", c)
+			}
+		}
 	}
 
 loop:
-	for c := range r {
-		switch c.Cmd {
-		case svc.Interrogate:
-			//not sure why this is sent twice, but ok
-			//its in the example from official golang libs
-			changes <- c.CurrentStatus
-			changes <- c.CurrentStatus
-		case svc.Stop, svc.Shutdown:
-			//shutdown the watchers to get the consumer routine to exit
-			cancel()
-			break loop
-		default:
-			errorout("Got invalid control request #%d", c)
-			break loop
+	for {
+		select {
+		case c, ok := <-r:
+			if !ok {
+				break loop
+			}
+			switch c.Cmd {
+			case svc.Interrogate:
+				//not sure why this is sent twice, but ok
+				//its in the example from official golang libs
+				changes <- c.CurrentStatus
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				//shutdown the watchers to get the consumer routine to exit
+				cancel()
+				break loop
+			case svc.ParamChange:
+				if err := m.reload(); err != nil {
+					errorout("Failed to reload configuration: %v", err)
+				}
+				changes <- c.CurrentStatus
+			default:
+				errorout("Got invalid control request #%d", c)
+				break loop
+			}
+		case <-m.cdm.C():
+			infoout("Reloading follower configuration after changes in %s", m.cfg.Follower_Config_Dir)
+			if err := m.reload(); err != nil {
+				errorout("Failed to reload configuration: %v", err)
+			}
+		case <-m.sm.C():
+			//a network share came back, restart the followers so they resume at their saved offsets
+			infoout("Restarting followers after network share recovery")
+			if err := m.restartFollowers(m.cfg); err != nil {
+				errorout("Failed to restart followers: %v", err)
+			}
+		case <-m.fs.Changed():
+			infoout("Restarting followers after symlink changes")
+			if err := m.restartFollowers(m.cfg); err != nil {
+				errorout("Failed to restart followers: %v", err)
+			}
 		}
 	}
 	infoout("%s stopping", serviceName)
@@ -161,12 +228,51 @@ loop:
 	return
 }
 
-func (m *mainService) init() error {
+func (m *mainService) init() (err error) {
+	if m.delay > 0 {
+		infoout("Delaying start by %v", m.delay)
+		select {
+		case <-time.After(m.delay):
+		case <-m.ctx.Done():
+			return m.ctx.Err()
+		}
+	}
+	if err = m.startMuxer(); err != nil {
+		return
+	}
+	//the share monitor is created first so a share that returns while the followers start is not missed
+	m.sm = newShareMonitor(m.cfg, m.igst)
+	if m.fs, err = m.startFollowers(m.cfg); err != nil {
+		errorout("%v", err)
+		return err
+	}
+	m.sm.Start()
+	m.cdm = newConfigDirMonitor(m.cfg.Follower_Config_Dir, m.igst)
+	m.cdm.Start()
+	if m.cfg.Control_Socket != `` {
+		if m.cs, err = newControlServer(m.cfg.Control_Socket, m.igst); err != nil {
+			errorout("Failed to create control pipe %s: %v", m.cfg.Control_Socket, err)
+			err = nil
+		} else {
+			m.cs.Start()
+		}
+	}
+	debugout("File watcher started\n")
+	return nil
+}
+
+// startMuxer connects to the indexers and resolves the source for entries
+func (m *mainService) startMuxer() error {
 	//check that there is something to load up and watch
-	if len(m.flocs) == 0 {
+	if len(m.cfg.Follower) == 0 {
 		return errors.New("No watch locations specified")
 	}
 
+	deadline := time.Now().Add(m.retryWindow)
+	if err := m.waitForResolution(deadline); err != nil {
+		return err
+	}
+
 	//fire up the ingesters
 	ingestConfig := ingest.UniformMuxerConfig{
 		Destinations:    m.conns,
@@ -188,7 +294,8 @@ func (m *mainService) init() error {
 	}
 
 	debugout("Started ingester stream\n")
-	if err := igst.WaitForHotContext(m.ctx, m.timeout); err != nil {
+	if err := m.waitForIndexers(igst, deadline); err != nil {
+		igst.Close()
 		return err
 	}
 	m.igst = igst
@@ -197,7 +304,6 @@ func (m *mainService) init() error {
 		return err
 	}
 	infoout("Ingester established %d connections\n", hot)
-	m.wtchr.SetLogger(igst)
 
 	var src net.IP
 	if m.srcOverride != "" {
@@ -210,80 +316,118 @@ func (m *mainService) init() error {
 		errorout("Failed to resolve source IP from muxer: %v", err)
 		return err
 	}
+	m.src = src
+	return nil
+}
 
-	//build up the handlers
-	for k, val := range m.flocs {
-		pproc, err := m.pp.ProcessorSet(igst, val.Preprocessor)
-		if err != nil {
-			errorout("Preprocessor construction error: %v", err)
-			return err
-		}
-		m.procs = append(m.procs, pproc)
-		//get the tag for this listener
-		tag, err := igst.GetTag(val.Tag_Name)
-		if err != nil {
-			errorout("Failed to resolve tag \"%s\" for %s: %v\n", val.Tag_Name, k, err)
-			return err
+// waitForResolution waits for the indexer host names to resolve, a service started at boot
+// may run before the network and DNS are up.  Resolving is only retried within the
+// Startup-Retry-Window.
+func (m *mainService) waitForResolution(deadline time.Time) error {
+	var hosts []string
+	for _, c := range m.conns {
+		if idx := strings.Index(c, `://`); idx < 0 || c[:idx] == `pipe` {
+			continue
+		} else if host, _, err := net.SplitHostPort(c[idx+3:]); err == nil && net.ParseIP(host) == nil {
+			hosts = append(hosts, host)
 		}
-		var ignore [][]byte
-		for _, prefix := range val.Ignore_Line_Prefix {
-			if prefix != "" {
-				ignore = append(ignore, []byte(prefix))
+	}
+	if m.retryWindow == 0 || len(hosts) == 0 {
+		return nil
+	}
+	delay := startupMinBackoff
+	for {
+		var err error
+		for _, h := range hosts {
+			if _, err = net.LookupHost(h); err == nil {
+				return nil //the resolver works, the muxer handles any hosts that are still missing
 			}
 		}
-		tsFmtOverride, err := val.TimestampOverride()
-		if err != nil {
-			errorout("Invalid timestamp override \"%s\": %v\n", val.Timestamp_Format_Override, err)
-			return err
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Failed to resolve indexers within %v: %v", m.retryWindow, err)
 		}
-
-		//create our handler for this watcher
-		cfg := filewatch.LogHandlerConfig{
-			Tag:                     tag,
-			Src:                     src,
-			IgnoreTS:                val.Ignore_Timestamps,
-			AssumeLocalTZ:           val.Assume_Local_Timezone,
-			IgnorePrefixes:          ignore,
-			TimestampFormatOverride: tsFmtOverride,
-			Logger:                  dbgLogger,
-			TimezoneOverride:        val.Timezone_Override,
+		infoout("Indexers cannot be resolved yet, retrying in %v: %v", delay, err)
+		select {
+		case <-time.After(delay):
+		case <-m.ctx.Done():
+			return m.ctx.Err()
 		}
+		if delay *= 2; delay > startupMaxBackoff {
+			delay = startupMaxBackoff
+		}
+	}
+}
 
-		lh, err := filewatch.NewLogHandler(cfg, pproc)
-		if err != nil {
-			errorout("Failed to generate handler: %v", err)
+// waitForIndexers waits for a hot connection, the muxer keeps dialing in the background
+// so failed waits are repeated until the Startup-Retry-Window closes
+func (m *mainService) waitForIndexers(igst *ingest.IngestMuxer, deadline time.Time) error {
+	for {
+		err := igst.WaitForHotContext(m.ctx, m.timeout)
+		if err == nil || m.retryWindow == 0 || m.ctx.Err() != nil {
 			return err
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("No indexer connections within %v: %v", m.retryWindow, err)
 		}
-		c := filewatch.WatchConfig{
-			ConfigName: k,
-			BaseDir:    val.Base_Directory,
-			FileFilter: val.File_Filter,
-			Hnd:        lh,
-			Recursive:  val.Recursive,
-		}
-		if rex, ok, err := val.TimestampDelimited(); err != nil {
-			errorout("Invalid timestamp delimiter: %v\n", err)
-		} else if ok {
-			c.Engine = filewatch.RegexEngine
-			c.EngineArgs = rex
-		} else {
-			c.Engine = filewatch.LineEngine
+		infoout("No indexer connections after %v, still retrying: %v", m.timeout, err)
+	}
+}
+
+// Backfill ingests the existing contents of all followed files and returns, it is used in
+// place of running the service
+func (m *mainService) Backfill() error {
+	m.ctx = context.Background()
+	if err := m.startMuxer(); err != nil {
+		return err
+	}
+	return runBackfill(m.cfg, m.igst, m.src, dbgLogger, nil)
+}
+
+func (m *mainService) startFollowers(cfg *cfgType) (fs *followerSet, err error) {
+	if fs, err = newFollowerSet(cfg, m.igst, m.src, dbgLogger, nil); err != nil {
+		return
+	}
+	if err = fs.Start(); err != nil {
+		fs.Close()
+		fs = nil
+	}
+	return
+}
+
+// reload re-reads the configuration file and rebuilds the followers, the muxer and
+// any entries it is holding are left untouched
+func (m *mainService) reload() error {
+	infoout("Reloading follower configuration from %s", confLoc)
+	cfg, err := reloadConfig(confLoc, m.cfg)
+	if err != nil {
+		return err
+	}
+	if err = m.restartFollowers(cfg); err != nil {
+		errorout("Failed to start reloaded followers, restoring previous configuration: %v", err)
+		if rerr := m.restartFollowers(m.cfg); rerr != nil {
+			errorout("Failed to restore followers: %v", rerr)
 		}
+		return err
+	}
+	m.cfg = cfg
+	infoout("Reloaded configuration, following %d locations", len(cfg.Follower))
+	return nil
+}
 
-		if err := m.wtchr.Add(c); err != nil {
-			errorout("Failed to add watch directory for %s (%s): %v\n",
-				val.Base_Directory, val.File_Filter, err)
-			m.wtchr.Close()
-			return err
+// restartFollowers tears down the current followers and starts a new set from the configuration
+func (m *mainService) restartFollowers(cfg *cfgType) (err error) {
+	m.sm.Close()
+	m.sm = newShareMonitor(cfg, m.igst)
+	//stop the existing followers so the state file is flushed before the new watcher loads it
+	if m.fs != nil {
+		if err = m.fs.Close(); err != nil {
+			errorout("%v", err)
 		}
+		m.fs = nil
 	}
-	m.wtchr.SetLogger(m.igst)
-	if err = m.wtchr.Start(); err == nil {
-		debugout("File watcher started\n")
-	} else {
-		errorout("Failed to start file watcher: %v\n", err)
+	if m.fs, err = m.startFollowers(cfg); err == nil {
+		m.sm.Start()
 	}
-	return err
+	return
 }
 
 func debugPrint(f string, args ...interface{}) {
@@ -0,0 +1,99 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrJSONTagFieldMissing = errors.New("JSON-Tag-Match requires a JSON-Tag-Field")
+	ErrJSONTagMatchMissing = errors.New("JSON-Tag-Field requires at least one JSON-Tag-Match")
+)
+
+// entryWriter is the interface the filewatch log handler writes entries into
+type entryWriter interface {
+	Process(*entry.Entry) error
+}
+
+// tagRouter sets the tag on JSON entries based on the value of a field,
+// entries without the field or without a matching value keep the follower tag
+type tagRouter struct {
+	w    entryWriter
+	flds []string
+	tags map[string]entry.EntryTag
+}
+
+func (tr *tagRouter) Process(ent *entry.Entry) error {
+	if s, err := jsonparser.GetString(ent.Data, tr.flds...); err == nil {
+		if tag, ok := tr.tags[s]; ok {
+			ent.Tag = tag
+		}
+	}
+	return tr.w.Process(ent)
+}
+
+// Router wraps the entry writer with a tagRouter if the follower routes on a JSON field
+func (f follower) Router(w entryWriter, getTag func(string) (entry.EntryTag, error)) (entryWriter, error) {
+	flds, matches, err := f.TagMatchers()
+	if err != nil || len(flds) == 0 {
+		return w, err
+	}
+	tr := &tagRouter{
+		w:    w,
+		flds: flds,
+		tags: make(map[string]entry.EntryTag, len(matches)),
+	}
+	for val, name := range matches {
+		if tr.tags[val], err = getTag(name); err != nil {
+			return nil, fmt.Errorf("Failed to resolve tag %q: %v", name, err)
+		}
+	}
+	return tr, nil
+}
+
+// TagMatchers returns the JSON field path and a map of field values to tag names
+func (f follower) TagMatchers() (flds []string, matches map[string]string, err error) {
+	for _, v := range strings.Split(f.JSON_Tag_Field, ".") {
+		if v = strings.TrimSpace(v); v != `` {
+			flds = append(flds, v)
+		}
+	}
+	if len(flds) == 0 {
+		if len(f.JSON_Tag_Match) > 0 {
+			err = ErrJSONTagFieldMissing
+		}
+		return
+	} else if len(f.JSON_Tag_Match) == 0 {
+		err = ErrJSONTagMatchMissing
+		return
+	}
+	matches = make(map[string]string, len(f.JSON_Tag_Match))
+	for _, v := range f.JSON_Tag_Match {
+		//tags cannot contain a colon, so the last one separates the value from the tag
+		idx := strings.LastIndex(v, ":")
+		if idx == -1 {
+			err = fmt.Errorf("Invalid JSON-Tag-Match %q, missing value and tag", v)
+			return
+		}
+		tag := strings.TrimSpace(v[idx+1:])
+		if err = ingest.CheckTag(tag); err != nil {
+			err = fmt.Errorf("Invalid JSON-Tag-Match %q: %v", v, err)
+			return
+		}
+		matches[v[:idx]] = tag
+	}
+	return
+}
@@ -0,0 +1,65 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	errScanAbort = errors.New("directory scan aborted")
+)
+
+// walkFiles calls fn for every regular file under base, descending into
+// child directories only when recursive is set.  Returning errScanAbort from fn stops the walk.
+func walkFiles(base string, recursive bool, fn func(string, os.FileInfo) error) error {
+	err := filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil //file vanished out from under us, keep going
+		}
+		if fi.IsDir() {
+			if !recursive && p != base {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		return fn(p, fi)
+	})
+	if err == errScanAbort {
+		err = nil
+	}
+	return err
+}
+
+// splitFilters breaks a File-Filter style list of globs apart
+func splitFilters(ff string) (r []string) {
+	ff = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(ff), "{"), "}")
+	for _, f := range strings.Split(ff, ",") {
+		if f = strings.TrimSpace(f); f != `` {
+			r = append(r, f)
+		}
+	}
+	return
+}
+
+// matchFilters returns true if the file name matches any of the globs
+func matchFilters(filters []string, name string) bool {
+	for _, f := range filters {
+		if ok, err := filepath.Match(f, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	shareTick          = time.Second
+	shareCheckInterval = 10 * time.Second
+	shareMinBackoff    = time.Second
+	shareMaxBackoff    = 5 * time.Minute
+)
+
+type shareState struct {
+	up    bool
+	delay time.Duration
+	next  time.Time
+}
+
+// shareMonitor periodically checks the base directories of followers on network shares.
+// When a share that was unavailable comes back the monitor signals on its channel so the
+// follower set can be rebuilt, which resumes each file at the offset in the state file.
+// Unavailable shares are retried with an exponential backoff.
+type shareMonitor struct {
+	mtx  sync.Mutex
+	dirs map[string]*shareState
+	lgr  ingest.IngestLogger
+	ch   chan bool
+	quit chan bool
+	wg   sync.WaitGroup
+}
+
+func newShareMonitor(cfg *cfgType, lgr ingest.IngestLogger) *shareMonitor {
+	if lgr == nil {
+		lgr = ingest.NoLogger()
+	}
+	sm := &shareMonitor{
+		dirs: map[string]*shareState{},
+		lgr:  lgr,
+		ch:   make(chan bool, 1),
+	}
+	now := time.Now()
+	for _, v := range cfg.Follower {
+		if !v.NetworkShare() {
+			continue
+		}
+		st := &shareState{
+			up:    shareAvailable(v.Base_Directory),
+			delay: shareMinBackoff,
+		}
+		if st.up {
+			st.next = now.Add(shareCheckInterval)
+		} else {
+			st.next = now.Add(st.delay)
+		}
+		sm.dirs[v.Base_Directory] = st
+	}
+	return sm
+}
+
+// C returns a channel that is notified when a network share becomes available again
+func (sm *shareMonitor) C() <-chan bool {
+	return sm.ch
+}
+
+func (sm *shareMonitor) Start() {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	if sm.quit != nil || len(sm.dirs) == 0 {
+		return
+	}
+	sm.quit = make(chan bool)
+	sm.wg.Add(1)
+	go sm.routine()
+}
+
+func (sm *shareMonitor) Close() {
+	sm.mtx.Lock()
+	if sm.quit != nil {
+		close(sm.quit)
+	}
+	sm.mtx.Unlock()
+	sm.wg.Wait()
+	sm.mtx.Lock()
+	sm.quit = nil
+	sm.mtx.Unlock()
+}
+
+func (sm *shareMonitor) routine() {
+	defer sm.wg.Done()
+	tckr := time.NewTicker(shareTick)
+	defer tckr.Stop()
+	for {
+		select {
+		case now := <-tckr.C:
+			if sm.check(now) {
+				select {
+				case sm.ch <- true:
+				default: //a restart is already pending
+				}
+			}
+		case <-sm.quit:
+			return
+		}
+	}
+}
+
+// check tests every share that is due and returns true if any share came back
+func (sm *shareMonitor) check(now time.Time) (restored bool) {
+	sm.mtx.Lock()
+	defer sm.mtx.Unlock()
+	for dir, st := range sm.dirs {
+		if now.Before(st.next) {
+			continue
+		}
+		up := shareAvailable(dir)
+		switch {
+		case up && st.up:
+			st.next = now.Add(shareCheckInterval)
+		case up && !st.up:
+			sm.lgr.Info("file_follower network share %s is available again", dir)
+			st.up = true
+			st.delay = shareMinBackoff
+			st.next = now.Add(shareCheckInterval)
+			restored = true
+		case !up && st.up:
+			sm.lgr.Warn("file_follower network share %s is unavailable, retrying in %v", dir, shareMinBackoff)
+			st.up = false
+			st.delay = shareMinBackoff
+			st.next = now.Add(st.delay)
+		default:
+			if st.delay *= 2; st.delay > shareMaxBackoff {
+				st.delay = shareMaxBackoff
+			}
+			st.next = now.Add(st.delay)
+		}
+	}
+	return
+}
+
+func shareAvailable(dir string) bool {
+	fi, err := os.Stat(dir)
+	return err == nil && fi.IsDir()
+}
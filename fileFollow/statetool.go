@@ -0,0 +1,238 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingesters/v3/utils"
+)
+
+const (
+	corruptStateSuffix = `.corrupt`
+)
+
+// The state tools operate directly on the state file, the ingester must not be running
+
+type stateEntry struct {
+	filewatch.FileName
+	offset int64
+}
+
+func loadStates(p string) (states map[filewatch.FileName]*int64, err error) {
+	var st *utils.State
+	var fi os.FileInfo
+	states = map[filewatch.FileName]*int64{}
+	if fi, err = os.Stat(p); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	} else if fi.Size() == 0 {
+		return
+	}
+	if st, err = utils.NewState(p, 0660); err == nil {
+		err = st.Read(&states)
+	}
+	return
+}
+
+func writeStates(p string, states map[filewatch.FileName]*int64) error {
+	st, err := utils.NewState(p, 0660)
+	if err != nil {
+		return err
+	}
+	return st.Write(states)
+}
+
+func sortedStates(states map[filewatch.FileName]*int64) (r []stateEntry) {
+	for k, v := range states {
+		se := stateEntry{FileName: k}
+		if v != nil {
+			se.offset = *v
+		}
+		r = append(r, se)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		if r[i].BaseName != r[j].BaseName {
+			return r[i].BaseName < r[j].BaseName
+		}
+		return r[i].FilePath < r[j].FilePath
+	})
+	return
+}
+
+// stateStatus describes how a tracked offset relates to the file currently on disk
+func stateStatus(p string, offset int64) (size int64, status string) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -1, `missing`
+		}
+		return -1, err.Error()
+	}
+	size = fi.Size()
+	if offset > size {
+		status = `truncated`
+	} else if offset == size {
+		status = `complete`
+	} else {
+		status = `partial`
+	}
+	return
+}
+
+// dumpStates prints every file tracked in the follower and compressed file state files
+func dumpStates(cfg *cfgType, out io.Writer) error {
+	states, err := loadStates(cfg.StatePath())
+	if err != nil {
+		return fmt.Errorf("Failed to read state file %s: %v", cfg.StatePath(), err)
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "FOLLOWER\tOFFSET\tSIZE\tSTATUS\tFILE\n")
+	for _, se := range sortedStates(states) {
+		size, status := stateStatus(se.FilePath, se.offset)
+		if _, ok := cfg.Follower[se.BaseName]; !ok {
+			status += ` (unconfigured)`
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", se.BaseName, se.offset, size, status, se.FilePath)
+	}
+	if err = tw.Flush(); err != nil {
+		return err
+	}
+	cmpr, err := newCompressedManager(cfg.StatePath(), 0, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to read compressed file states: %v", err)
+	} else if len(cmpr.done) == 0 {
+		return nil
+	}
+	var keys []string
+	for k := range cmpr.done {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fmt.Fprintf(tw, "\nCOMPRESSED FILE\tSIZE\tMODIFIED\n")
+	for _, k := range keys {
+		cs := cmpr.done[k]
+		fmt.Fprintf(tw, "%s\t%d\t%v\n", k, cs.Size, cs.ModTime)
+	}
+	return tw.Flush()
+}
+
+// repairStates removes entries for missing files and followers that are no longer
+// configured and resets offsets that are beyond the end of a truncated file.  Files
+// matching resetFilter have their offsets reset so they are ingested again.  A state
+// file that cannot be decoded is moved aside and rebuilt by marking every file the
+// followers currently match as completely ingested, which avoids a full re-ingest.
+func repairStates(cfg *cfgType, resetFilter string, out io.Writer) (err error) {
+	p := cfg.StatePath()
+	states, err := loadStates(p)
+	if err != nil {
+		fmt.Fprintf(out, "State file %s is corrupt: %v\n", p, err)
+		if err = os.Rename(p, p+corruptStateSuffix); err != nil {
+			return fmt.Errorf("Failed to move corrupt state file aside: %v", err)
+		}
+		fmt.Fprintf(out, "Moved corrupt state file to %s\n", p+corruptStateSuffix)
+		states = rebuildStates(cfg, out)
+	}
+	for _, se := range sortedStates(states) {
+		_, status := stateStatus(se.FilePath, se.offset)
+		if _, ok := cfg.Follower[se.BaseName]; !ok {
+			status = `unconfigured`
+		}
+		switch status {
+		case `missing`, `unconfigured`:
+			delete(states, se.FileName)
+			fmt.Fprintf(out, "pruned %s %s (%s)\n", se.BaseName, se.FilePath, status)
+			continue
+		case `truncated`:
+			*states[se.FileName] = 0
+			fmt.Fprintf(out, "reset %s %s (%s)\n", se.BaseName, se.FilePath, status)
+			continue
+		}
+		if resetFilter != `` {
+			if ok, merr := filepath.Match(resetFilter, se.FilePath); merr != nil {
+				return fmt.Errorf("Invalid reset filter %q: %v", resetFilter, merr)
+			} else if ok {
+				*states[se.FileName] = 0
+				fmt.Fprintf(out, "reset %s %s\n", se.BaseName, se.FilePath)
+			}
+		}
+	}
+	if err = writeStates(p, states); err == nil {
+		fmt.Fprintf(out, "Wrote %d states to %s\n", len(states), p)
+	}
+	return
+}
+
+// skipFiles marks files that the followers have never seen and that are too old or too
+// large as completely ingested, so only data appended after discovery is ingested.  It
+// must be called before the watcher loads the state file.
+func skipFiles(cfg *cfgType, lgr handlerLogger) error {
+	p := cfg.StatePath()
+	states, err := loadStates(p)
+	if err != nil {
+		return fmt.Errorf("Failed to read state file %s: %v", p, err)
+	}
+	now := time.Now()
+	var skipped int
+	for k, v := range cfg.Follower {
+		if !v.SkipRules() {
+			continue
+		}
+		locs := []symlinkTarget{{dir: v.Base_Directory, filter: v.File_Filter, recursive: v.Recursive}}
+		if v.Follow_Symlinks {
+			tgts, _ := v.symlinkTargets()
+			locs = append(locs, tgts...)
+		}
+		for _, loc := range locs {
+			filters := splitFilters(loc.filter)
+			walkFiles(loc.dir, loc.recursive, func(fp string, fi os.FileInfo) error {
+				key := filewatch.FileName{BaseName: k, FilePath: fp}
+				if _, ok := states[key]; ok || !matchFilters(filters, fi.Name()) || !v.SkipFile(fi, now) {
+					return nil
+				}
+				offset := fi.Size()
+				states[key] = &offset
+				lgr.Info("file_follower %s skipping existing contents of %s, it is too old or too large", k, fp)
+				skipped++
+				return nil
+			})
+		}
+	}
+	if skipped == 0 {
+		return nil
+	} else if err = writeStates(p, states); err != nil {
+		return fmt.Errorf("Failed to write state file %s: %v", p, err)
+	}
+	return nil
+}
+
+func rebuildStates(cfg *cfgType, out io.Writer) map[filewatch.FileName]*int64 {
+	states := map[filewatch.FileName]*int64{}
+	for k, v := range cfg.Follower {
+		filters := splitFilters(v.File_Filter)
+		walkFiles(v.Base_Directory, v.Recursive, func(p string, fi os.FileInfo) error {
+			if matchFilters(filters, fi.Name()) {
+				offset := fi.Size()
+				states[filewatch.FileName{BaseName: k, FilePath: p}] = &offset
+				fmt.Fprintf(out, "marked %s %s as ingested at %d\n", k, p, offset)
+			}
+			return nil
+		})
+	}
+	return states
+}
@@ -0,0 +1,202 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	defaultDebugStatsInterval = time.Minute
+)
+
+var (
+	//stats live outside of the follower set so counters survive configuration reloads
+	allStats = &statsRegistry{
+		stats: map[string]*followerStats{},
+	}
+)
+
+// followerStats are the counters for a single follower, all fields are updated atomically
+type followerStats struct {
+	bytes       int64 //bytes of line data read from files
+	records     int64 //lines or records read from files
+	entries     int64 //entries handed to the muxer
+	parseFail   int64 //records with no extractable timestamp or malformed CSV rows
+	errors      int64 //records the handlers failed to process
+	quarantined int64 //records sent to the quarantine tag
+	last        int64 //unix nanoseconds of the last entry
+}
+
+type followerStatsSnapshot struct {
+	Bytes       int64
+	Records     int64
+	Entries     int64
+	ParseFailed int64
+	Errors      int64
+	Quarantined int64
+	LastEntry   time.Time
+}
+
+func (st *followerStats) parseFailure() {
+	atomic.AddInt64(&st.parseFail, 1)
+}
+
+func (st *followerStats) snapshot() (s followerStatsSnapshot) {
+	s = followerStatsSnapshot{
+		Bytes:       atomic.LoadInt64(&st.bytes),
+		Records:     atomic.LoadInt64(&st.records),
+		Entries:     atomic.LoadInt64(&st.entries),
+		ParseFailed: atomic.LoadInt64(&st.parseFail),
+		Errors:      atomic.LoadInt64(&st.errors),
+		Quarantined: atomic.LoadInt64(&st.quarantined),
+	}
+	if last := atomic.LoadInt64(&st.last); last > 0 {
+		s.LastEntry = time.Unix(0, last)
+	}
+	return
+}
+
+type statsRegistry struct {
+	sync.Mutex
+	stats map[string]*followerStats
+}
+
+// get returns the stats for a follower, creating them if needed
+func (sr *statsRegistry) get(name string) *followerStats {
+	sr.Lock()
+	defer sr.Unlock()
+	st, ok := sr.stats[name]
+	if !ok {
+		st = &followerStats{}
+		sr.stats[name] = st
+	}
+	return st
+}
+
+// statsHandler sits in front of the handler chain and counts everything read from files
+type statsHandler struct {
+	lh logHandler
+	st *followerStats
+}
+
+func (sh *statsHandler) HandleLog(b []byte, catchts time.Time) error {
+	atomic.AddInt64(&sh.st.bytes, int64(len(b)))
+	atomic.AddInt64(&sh.st.records, 1)
+	err := sh.lh.HandleLog(b, catchts)
+	if err != nil {
+		atomic.AddInt64(&sh.st.errors, 1)
+	}
+	return err
+}
+
+// statsWriter counts the entries handed to the muxer
+type statsWriter struct {
+	w  entryWriter
+	st *followerStats
+}
+
+func (sw *statsWriter) Process(ent *entry.Entry) (err error) {
+	if err = sw.w.Process(ent); err == nil {
+		atomic.AddInt64(&sw.st.entries, 1)
+		atomic.StoreInt64(&sw.st.last, time.Now().UnixNano())
+	}
+	return
+}
+
+// statsReporter periodically logs the stats of every follower in a follower set
+type statsReporter struct {
+	fs       *followerSet
+	interval time.Duration
+	lgr      ingest.IngestLogger //nil when stats are only printed as debug output
+	dbg      func(string, ...interface{})
+	quit     chan bool
+	wg       sync.WaitGroup
+}
+
+func newStatsReporter(fs *followerSet, interval time.Duration, lgr ingest.IngestLogger, dbg func(string, ...interface{})) *statsReporter {
+	if interval <= 0 {
+		if dbg == nil {
+			return nil
+		}
+		interval = defaultDebugStatsInterval
+		lgr = nil
+	}
+	return &statsReporter{
+		fs:       fs,
+		interval: interval,
+		lgr:      lgr,
+		dbg:      dbg,
+		quit:     make(chan bool),
+	}
+}
+
+func (sr *statsReporter) Start() {
+	sr.wg.Add(1)
+	go sr.routine()
+}
+
+func (sr *statsReporter) Close() {
+	close(sr.quit)
+	sr.wg.Wait()
+}
+
+func (sr *statsReporter) routine() {
+	defer sr.wg.Done()
+	tckr := time.NewTicker(sr.interval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+			sr.fs.reportStats(sr.lgr, sr.dbg)
+		case <-sr.quit:
+			return
+		}
+	}
+}
+
+// reportStats logs the stats for every follower in the set, files are counted by scanning
+// the base directories so the count reflects what is on disk right now
+func (fs *followerSet) reportStats(lgr ingest.IngestLogger, dbg func(string, ...interface{})) {
+	//a follower may watch several locations when it follows symlinks
+	var names []string
+	files := map[string]int{}
+	for _, cf := range append(append(fs.bfill, fs.bins.followers()...), fs.csvs.followers()...) {
+		if _, ok := files[cf.name]; !ok {
+			names = append(names, cf.name)
+		}
+		walkFiles(cf.base, cf.recursive, func(p string, fi os.FileInfo) error {
+			if cf.match(fi.Name()) {
+				files[cf.name]++
+			}
+			return nil
+		})
+	}
+	for _, name := range names {
+		s := allStats.get(name).snapshot()
+		last := `never`
+		if !s.LastEntry.IsZero() {
+			last = s.LastEntry.Format(time.RFC3339)
+		}
+		if lgr != nil {
+			lgr.Info("file_follower stats for %s: files=%d bytes=%d records=%d entries=%d parse_failures=%d quarantined=%d errors=%d last_entry=%s",
+				name, files[name], s.Bytes, s.Records, s.Entries, s.ParseFailed, s.Quarantined, s.Errors, last)
+		}
+		if dbg != nil {
+			dbg("%s: files=%d bytes=%s records=%d entries=%d parse_failures=%d quarantined=%d errors=%d last_entry=%s\n",
+				name, files[name], ingest.HumanSize(uint64(s.Bytes)), s.Records, s.Entries, s.ParseFailed, s.Quarantined, s.Errors, last)
+		}
+	}
+}
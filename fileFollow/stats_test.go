@@ -0,0 +1,52 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFollowerStats(t *testing.T) {
+	st := &followerStats{}
+	var c, q captureHandler
+	f := follower{
+		Require_Line_Regex: []string{`user=`},
+		Timestamp_Format:   `2006-01-02 15:04:05`,
+		Quarantine_Tag:     `quarantine`,
+	}
+	hnd, err := f.Handler(&c, &quarantineHandler{lh: &q, st: st}, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		`2020-01-02 03:04:05 user=bob`,
+		`2020-01-02 03:04:06 user=alice`,
+		`no timestamp user=carol`,
+		`2020-01-02 03:04:07 system`,
+	}
+	var size int64
+	for _, l := range lines {
+		size += int64(len(l))
+		if err = hnd.HandleLog([]byte(l), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := st.snapshot()
+	if s.Bytes != size || s.Records != 4 || s.ParseFailed != 1 || s.Quarantined != 2 || s.Errors != 0 {
+		t.Fatalf("bad stats %+v", s)
+	} else if len(c.lines) != 2 || len(q.lines) != 2 {
+		t.Fatalf("bad lines %q %q", c.lines, q.lines)
+	}
+	if !s.LastEntry.IsZero() {
+		t.Fatalf("entries counted without a writer: %v", s.LastEntry)
+	}
+	if allStats.get(`stats`) != allStats.get(`stats`) || allStats.get(`stats`) == allStats.get(`other`) {
+		t.Fatal("stats are not kept per follower")
+	}
+}
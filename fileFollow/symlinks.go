@@ -0,0 +1,143 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	symlinkCheckInterval = 10 * time.Second
+	globMetaChars        = `*?[]{},\`
+)
+
+// symlinkTarget is a location reached through a symlink, the watcher does not follow
+// symlinks so it is pointed at the real location directly
+type symlinkTarget struct {
+	dir       string
+	filter    string
+	recursive bool
+}
+
+// symlinkTargets walks the follower's directories looking for symlinks to matching files
+// and, for recursive followers, to directories.  The watcher only sees regular files and
+// directories, so each target outside of what the follower already covers is returned as
+// a separate location to watch.  Loops are broken by never descending into a directory
+// that is already covered and by dropping links that cannot be resolved.  The links map
+// holds every resolved link and its target so changes can be detected.
+func (f follower) symlinkTargets() (tgts []symlinkTarget, links map[string]string) {
+	links = map[string]string{}
+	root, err := filepath.EvalSymlinks(f.Base_Directory)
+	if err != nil {
+		return
+	}
+	filters := splitFilters(f.File_Filter)
+	roots := []string{root}
+	covered := func(dir string) bool {
+		for _, r := range roots {
+			if dir == r {
+				return true
+			} else if rel, err := filepath.Rel(r, dir); f.Recursive && err == nil && !strings.HasPrefix(rel, `..`) {
+				return true
+			}
+		}
+		return false
+	}
+	added := map[string]bool{}
+	queue := []string{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range fis {
+			p := filepath.Join(dir, fi.Name())
+			if fi.IsDir() {
+				if f.Recursive {
+					queue = append(queue, p)
+				}
+				continue
+			} else if fi.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			//resolving fails on dangling links and links that loop back on each other
+			real, err := filepath.EvalSymlinks(p)
+			if err != nil {
+				continue
+			}
+			rfi, err := os.Stat(real)
+			if err != nil {
+				continue
+			}
+			if rfi.IsDir() {
+				if !f.Recursive {
+					continue
+				}
+				links[p] = real
+				if covered(real) {
+					continue //a link back into the tree we are already walking
+				}
+				roots = append(roots, real)
+				queue = append(queue, real)
+				tgts = append(tgts, symlinkTarget{dir: real, filter: f.File_Filter, recursive: true})
+			} else if rfi.Mode().IsRegular() && matchFilters(filters, fi.Name()) {
+				links[p] = real
+				name := filepath.Base(real)
+				if added[real] || (covered(filepath.Dir(real)) && matchFilters(filters, name)) {
+					continue //already followed directly or through another link
+				} else if strings.ContainsAny(name, globMetaChars) {
+					continue //no way to build a filter that matches only this file
+				}
+				added[real] = true
+				tgts = append(tgts, symlinkTarget{dir: filepath.Dir(real), filter: name})
+			}
+		}
+	}
+	return
+}
+
+// symlinkRoutine periodically re-resolves symlinks and signals when any link was added,
+// removed, or retargeted so the follower set can be rebuilt against the new targets
+func (fs *followerSet) symlinkRoutine() {
+	defer fs.wg.Done()
+	tckr := time.NewTicker(symlinkCheckInterval)
+	defer tckr.Stop()
+	for {
+		select {
+		case <-tckr.C:
+			for k, f := range fs.slinks {
+				if _, links := f.symlinkTargets(); !sameLinks(links, fs.links[k]) {
+					fs.igst.Info("file_follower symlinks changed for %s", k)
+					fs.notifyChanged()
+					return
+				}
+			}
+		case <-fs.quit:
+			return
+		}
+	}
+}
+
+func sameLinks(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,192 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	explicitProcessorName = `explicit`
+)
+
+// timestampExtractor is satisfied by timegrinder and by the explicit format extractor
+type timestampExtractor interface {
+	Extract([]byte) (time.Time, bool, error)
+}
+
+// explicitExtractor uses a single timestamp processor, there is no auto-detection
+// so lines that do not match the format never pick up some other timestamp
+type explicitExtractor struct {
+	proc timegrinder.Processor
+	loc  *time.Location
+}
+
+func (ee explicitExtractor) Extract(b []byte) (ts time.Time, ok bool, err error) {
+	if ts, ok, _ = ee.proc.Extract(b, ee.loc); ok && ts.Year() == 0 {
+		//layouts without a year, such as syslog, get the current year
+		ts = ts.AddDate(time.Now().In(ee.loc).Year(), 0, 0)
+	}
+	return
+}
+
+// timestampExtractor builds an extractor from the timestamp settings of the follower
+func (f follower) timestampExtractor() (te timestampExtractor, err error) {
+	if f.Timestamp_Format != `` {
+		return f.explicitExtractor()
+	}
+	tcfg := timegrinder.Config{
+		EnableLeftMostSeed: true,
+	}
+	if tcfg.FormatOverride, err = f.TimestampOverride(); err != nil {
+		return
+	}
+	var tg *timegrinder.TimeGrinder
+	if tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+		return
+	}
+	if f.Assume_Local_Timezone {
+		tg.SetLocalTime()
+	}
+	if f.Timezone_Override != `` {
+		if err = tg.SetTimezone(f.Timezone_Override); err != nil {
+			return
+		}
+	}
+	te = tg
+	return
+}
+
+func (f follower) explicitExtractor() (ee explicitExtractor, err error) {
+	ee.loc = time.UTC
+	if f.Assume_Local_Timezone {
+		ee.loc = time.Local
+	} else if f.Timezone_Override != `` {
+		if ee.loc, err = time.LoadLocation(f.Timezone_Override); err != nil {
+			return
+		}
+	}
+	ee.proc, err = f.timestampProcessor()
+	return
+}
+
+// timestampProcessor returns the processor for an explicit Timestamp-Format, which is
+// either the name of a timegrinder format or a Go time layout
+func (f follower) timestampProcessor() (timegrinder.Processor, error) {
+	name := strings.TrimSpace(f.Timestamp_Format)
+	tg, err := timegrinder.New(timegrinder.Config{FormatOverride: name})
+	if err != nil {
+		return nil, err
+	}
+	if proc, err := tg.OverrideProcessor(); err == nil {
+		return proc, nil
+	}
+	rx, fields := layoutRegex(f.Timestamp_Format)
+	if fields == 0 {
+		return nil, ErrNoLayoutFields
+	}
+	return timegrinder.NewUserProcessor(explicitProcessorName, rx, f.Timestamp_Format)
+}
+
+type layoutChunk struct {
+	std string
+	rx  string
+}
+
+// layoutChunks are the elements of a Go time layout, where more than one begins with the
+// same characters the longest is listed first
+var layoutChunks = []layoutChunk{
+	{`January`, `[A-Za-z]+`},
+	{`Jan`, `[A-Za-z]{3}`},
+	{`Monday`, `[A-Za-z]+`},
+	{`Mon`, `[A-Za-z]{3}`},
+	{`MST`, `[A-Z]{3,5}`},
+	{`2006`, `\d{4}`},
+	{`002`, `\d{3}`},
+	{`01`, `\d{2}`},
+	{`02`, `\d{2}`},
+	{`03`, `\d{2}`},
+	{`04`, `\d{2}`},
+	{`05`, `\d{2}`},
+	{`06`, `\d{2}`},
+	{`__2`, `[ \d]{2}\d`},
+	{`_2`, `[ \d]?\d`},
+	{`15`, `\d{1,2}`},
+	{`1`, `\d{1,2}`},
+	{`2`, `\d{1,2}`},
+	{`3`, `\d{1,2}`},
+	{`4`, `\d{1,2}`},
+	{`5`, `\d{1,2}`},
+	{`PM`, `[AaPp][Mm]`},
+	{`pm`, `[AaPp][Mm]`},
+	{`-070000`, `[+-]\d{6}`},
+	{`-07:00:00`, `[+-]\d{2}:\d{2}:\d{2}`},
+	{`-0700`, `[+-]\d{4}`},
+	{`-07:00`, `[+-]\d{2}:\d{2}`},
+	{`-07`, `[+-]\d{2}`},
+	{`Z070000`, `(?:Z|[+-]\d{6})`},
+	{`Z07:00:00`, `(?:Z|[+-]\d{2}:\d{2}:\d{2})`},
+	{`Z0700`, `(?:Z|[+-]\d{4})`},
+	{`Z07:00`, `(?:Z|[+-]\d{2}:\d{2})`},
+	{`Z07`, `(?:Z|[+-]\d{2})`},
+}
+
+// layoutRegex builds a regular expression that matches timestamps in the Go time layout
+// and returns the number of layout fields found, everything else is matched literally
+func layoutRegex(layout string) (rx string, fields int) {
+	var sb strings.Builder
+	for i := 0; i < len(layout); {
+		if n, frx := fracSeconds(layout[i:]); n > 0 {
+			sb.WriteString(frx)
+			i += n
+			fields++
+			continue
+		}
+		var hit bool
+		for _, c := range layoutChunks {
+			if strings.HasPrefix(layout[i:], c.std) {
+				sb.WriteString(c.rx)
+				i += len(c.std)
+				fields++
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			sb.WriteString(regexp.QuoteMeta(layout[i : i+1]))
+			i++
+		}
+	}
+	rx = sb.String()
+	return
+}
+
+// fracSeconds matches the .000 and .999 fractional second elements, the 9 form is optional
+func fracSeconds(s string) (n int, rx string) {
+	if len(s) < 2 || (s[0] != '.' && s[0] != ',') || (s[1] != '0' && s[1] != '9') {
+		return
+	}
+	ch := s[1]
+	j := 1
+	for j < len(s) && s[j] == ch {
+		j++
+	}
+	if j < len(s) && s[j] >= '0' && s[j] <= '9' {
+		return //a literal number, not a fractional second
+	}
+	if ch == '0' {
+		return j, `[.,]\d{` + strconv.Itoa(j-1) + `}`
+	}
+	return j, `(?:[.,]\d+)?`
+}
@@ -0,0 +1,52 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExplicitTimestampFormat(t *testing.T) {
+	year := time.Now().UTC().Year()
+	tests := []struct {
+		format string
+		tz     string
+		line   string
+		ts     time.Time //zero when no timestamp should be found
+	}{
+		{format: `2006-01-02 15:04:05`, line: `x 2020-01-02 03:04:05 y`, ts: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{format: `02/01/2006 15:04:05.000`, line: `03/02/2021 10:11:12.345 z`, ts: time.Date(2021, 2, 3, 10, 11, 12, 345000000, time.UTC)},
+		{format: `Jan _2 15:04:05`, line: `Feb  3 10:11:12 host sshd`, ts: time.Date(year, 2, 3, 10, 11, 12, 0, time.UTC)},
+		{format: `RFC3339`, line: `at 2020-01-02T03:04:05Z`, ts: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{format: `2006-01-02 15:04:05`, tz: `America/Denver`, line: `2020-01-02 03:04:05`, ts: time.Date(2020, 1, 2, 10, 4, 5, 0, time.UTC)},
+		//no fallback to auto-detection
+		{format: `2006-01-02 15:04:05`, line: `2020-01-02T03:04:05Z`},
+		{format: `15:04:05`, line: `no time here`},
+	}
+	for _, tt := range tests {
+		f := follower{Timestamp_Format: tt.format, Timezone_Override: tt.tz}
+		te, err := f.timestampExtractor()
+		if err != nil {
+			t.Fatalf("%s %v", tt.format, err)
+		}
+		ts, ok, err := te.Extract([]byte(tt.line))
+		if err != nil {
+			t.Fatal(err)
+		} else if ok != !tt.ts.IsZero() {
+			t.Fatalf("%s found a timestamp in %q: %v", tt.format, tt.line, ok)
+		} else if ok && !ts.Equal(tt.ts) {
+			t.Fatalf("%s extracted %v from %q, expected %v", tt.format, ts, tt.line, tt.ts)
+		}
+	}
+	for _, v := range []string{`hello`, `not a layout`} {
+		if _, err := (follower{Timestamp_Format: v}).timestampExtractor(); err == nil {
+			t.Fatalf("accepted Timestamp-Format %q", v)
+		}
+	}
+}
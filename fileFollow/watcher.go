@@ -0,0 +1,353 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gravwell/filewatch/v3"
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	defaultStateCheckpoint = time.Minute
+)
+
+var (
+	ErrWatcherNotReady    = errors.New("fsnotify watcher is not ready")
+	ErrWatchNotDir        = errors.New("Watched Location is not a directory")
+	ErrNoWatchDirs        = errors.New("No locations have been added to the watch list")
+	ErrWatcherStarted     = errors.New("file watcher already started")
+	ErrWatcherNoStateFile = errors.New("file watcher state file is not open")
+)
+
+// watchManager follows files the same way as filewatch.WatchManager, which writes the
+// followed file offsets on a fixed one minute timer and never syncs them.  Here the
+// offsets are written every checkpoint interval and the state file is synced after
+// each write unless syncing is disabled.
+type watchManager struct {
+	mtx        sync.Mutex
+	fman       *filewatch.FilterManager
+	watcher    *fsnotify.Watcher
+	watched    map[string][]filewatch.WatchConfig
+	routineRet chan error
+	logger     ingest.IngestLogger
+	statePath  string
+	checkpoint time.Duration
+	sync       bool
+}
+
+// newWatchManager opens the state file, a zero checkpoint writes it every minute
+func newWatchManager(statePath string, checkpoint time.Duration, sync bool) (*watchManager, error) {
+	fman, err := filewatch.NewFilterManager(statePath)
+	if err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		fman.Close()
+		return nil, err
+	}
+	if checkpoint <= 0 {
+		checkpoint = defaultStateCheckpoint
+	}
+	return &watchManager{
+		fman:       fman,
+		watcher:    w,
+		watched:    map[string][]filewatch.WatchConfig{},
+		logger:     ingest.NoLogger(),
+		statePath:  statePath,
+		checkpoint: checkpoint,
+		sync:       sync,
+	}, nil
+}
+
+func (wm *watchManager) SetMaxFilesWatched(max int) {
+	wm.fman.SetMaxFilesWatched(max)
+}
+
+func (wm *watchManager) SetLogger(lgr ingest.IngestLogger) {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	if lgr == nil {
+		wm.logger = ingest.NoLogger()
+	} else {
+		wm.logger = lgr
+	}
+	wm.fman.SetLogger(wm.logger)
+}
+
+// Close stops the watcher and writes the final states
+func (wm *watchManager) Close() error {
+	var retCh chan error
+	wm.mtx.Lock()
+	if wm.watcher != nil {
+		if err := wm.watcher.Close(); err != nil {
+			wm.mtx.Unlock()
+			return err
+		}
+		retCh = wm.routineRet
+	}
+	wm.mtx.Unlock() //the routine must be able to finish what it is doing
+	var err error
+	if retCh != nil {
+		err = <-retCh
+		close(retCh)
+	}
+
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	if wm.fman != nil {
+		if lerr := wm.fman.Close(); lerr != nil {
+			return lerr
+		} else if lerr = wm.syncStates(); lerr != nil {
+			return lerr
+		}
+	}
+	wm.watcher = nil
+	wm.fman = nil
+	return err
+}
+
+// Add watches a directory, and all of its subdirectories if the config is recursive
+func (wm *watchManager) Add(c filewatch.WatchConfig) error {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	return wm.addNoLock(c)
+}
+
+func (wm *watchManager) addNoLock(c filewatch.WatchConfig) error {
+	if wm.watcher == nil || wm.watched == nil {
+		return ErrWatcherNotReady
+	}
+	if fi, err := os.Stat(c.BaseDir); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return ErrWatchNotDir
+	}
+	fltrs, err := watchFilters(c.FileFilter)
+	if err != nil {
+		return err
+	}
+
+	//directories are only added to the notification watcher once per config
+	doAdd := true
+	for _, e := range wm.watched[c.BaseDir] {
+		if e == c {
+			doAdd = false
+			break
+		}
+	}
+	if doAdd {
+		if err := wm.watcher.Add(c.BaseDir); err != nil {
+			return err
+		}
+		wm.watched[c.BaseDir] = append(wm.watched[c.BaseDir], c)
+	}
+	if err := wm.fman.AddFilter(c.ConfigName, c.BaseDir, fltrs, c.Hnd, c.FollowerEngineConfig); err != nil {
+		return err
+	}
+	if c.Recursive {
+		fis, err := ioutil.ReadDir(c.BaseDir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				nc := c
+				nc.BaseDir = filepath.Join(c.BaseDir, fi.Name())
+				wm.addNoLock(nc)
+			}
+		}
+	}
+	return nil
+}
+
+// watchFilters splits a file filter such as {*.log,*.txt} into its patterns
+func watchFilters(ff string) ([]string, error) {
+	if strings.HasPrefix(ff, "{") && strings.HasSuffix(ff, "}") {
+		ff = strings.TrimPrefix(strings.TrimSuffix(ff, "}"), "{")
+	}
+	flds := strings.Split(ff, ",")
+	for _, f := range flds {
+		if _, err := filepath.Match(f, "asdf"); err != nil {
+			return nil, err
+		}
+	}
+	return flds, nil
+}
+
+// Start loads the files that already exist and begins watching for changes
+func (wm *watchManager) Start() error {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	if wm.fman == nil || wm.watcher == nil {
+		return ErrWatcherNotReady
+	} else if len(wm.watched) == 0 {
+		return ErrNoWatchDirs
+	} else if wm.routineRet != nil {
+		return ErrWatcherStarted
+	}
+	for k := range wm.watched {
+		fis, err := ioutil.ReadDir(k)
+		if err != nil {
+			return fmt.Errorf("Failed to initialize %v: %v", k, err)
+		}
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() {
+				continue
+			}
+			if _, err := wm.fman.LoadFile(filepath.Join(k, fi.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	wm.routineRet = make(chan error, 1)
+	go wm.routine(wm.watcher, wm.routineRet)
+	return nil
+}
+
+// Checkpoint writes the current offsets to the state file
+func (wm *watchManager) Checkpoint() error {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	if wm.fman == nil {
+		return ErrWatcherNoStateFile
+	}
+	if err := wm.fman.FlushStates(); err != nil {
+		return err
+	}
+	return wm.syncStates()
+}
+
+// syncStates forces the state file to disk, the filter manager does not expose its
+// handle so the file is opened again, caller must hold the lock
+func (wm *watchManager) syncStates() error {
+	if !wm.sync {
+		return nil
+	}
+	fout, err := os.OpenFile(wm.statePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if err = fout.Sync(); err != nil {
+		fout.Close()
+		return err
+	}
+	return fout.Close()
+}
+
+func (wm *watchManager) routine(w *fsnotify.Watcher, errch chan error) {
+	var err error
+	tckr := time.NewTicker(wm.checkpoint)
+	defer tckr.Stop()
+
+watchRoutine:
+	for {
+		select {
+		case lerr, ok := <-w.Errors:
+			if !ok {
+				break watchRoutine
+			}
+			err = lerr
+			wm.logger.Error("file_follower filesystem notification error %v", lerr)
+		case evt, ok := <-w.Events:
+			if !ok {
+				break watchRoutine
+			}
+			wm.handleEvent(evt)
+		case <-tckr.C:
+			if lerr := wm.Checkpoint(); lerr != nil {
+				wm.logger.Error("file_follower failed to flush states: %v", lerr)
+			}
+		}
+	}
+	errch <- err
+}
+
+func (wm *watchManager) handleEvent(evt fsnotify.Event) {
+	switch evt.Op {
+	case fsnotify.Create:
+		fi, err := os.Stat(evt.Name)
+		if err != nil {
+			return
+		}
+		if !fi.IsDir() {
+			if ok, err := wm.newFile(evt.Name); err != nil {
+				wm.logger.Error("file_follower failed to watch new file %s due to %v", evt.Name, err)
+			} else if ok {
+				wm.logger.Info("file_follower now watching %s", evt.Name)
+			}
+			return
+		}
+		wm.mtx.Lock()
+		parents, ok := wm.watched[filepath.Dir(evt.Name)]
+		wm.mtx.Unlock()
+		if !ok {
+			wm.logger.Error("file_follower failed to find parent directory for %s", evt.Name)
+			return
+		}
+		for _, parent := range parents {
+			if !parent.Recursive {
+				wm.logger.Info("file_follower not adding watcher for subdirectory %v: parent not recursive", evt.Name)
+				continue
+			}
+			parent.BaseDir = evt.Name
+			wm.logger.Info("file_follower adding watcher for subdirectory %v, patterns = %v", evt.Name, parent.FileFilter)
+			if err := wm.Add(parent); err != nil {
+				wm.logger.Error("file_follower failed to add watcher for new directory %v: %v", evt.Name, err)
+			}
+		}
+	case fsnotify.Remove:
+		if ok, err := wm.removeFile(evt.Name); err != nil {
+			wm.logger.Error("file_follower failed to stop watching %s due to %v", evt.Name, err)
+		} else if ok {
+			wm.logger.Info("file_follower stopped watching %s", evt.Name)
+		}
+	case fsnotify.Rename:
+		if err := wm.renameFile(evt.Name); err != nil {
+			wm.logger.Error("file_follower failed to track renamed file %s due to %v", evt.Name, err)
+		}
+	case fsnotify.Write:
+		//writes to files that are not followed yet, such as ones expunged by Max-Files-Watched
+		if !wm.fman.IsWatched(evt.Name) {
+			if ok, err := wm.fman.LoadFile(evt.Name); err != nil {
+				wm.logger.Error("file_follower failed to watch file %s due to %v", evt.Name, err)
+			} else if ok {
+				wm.logger.Info("file_follower now watching %s", evt.Name)
+			}
+		}
+	}
+}
+
+func (wm *watchManager) newFile(fpath string) (bool, error) {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	return wm.fman.NewFollower(fpath)
+}
+
+func (wm *watchManager) removeFile(fpath string) (bool, error) {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	return wm.fman.RemoveFollower(fpath)
+}
+
+func (wm *watchManager) renameFile(fpath string) error {
+	wm.mtx.Lock()
+	defer wm.mtx.Unlock()
+	return wm.fman.RenameFollower(fpath)
+}
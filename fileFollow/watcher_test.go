@@ -0,0 +1,80 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gravwell/filewatch/v3"
+)
+
+func TestWatchManagerCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `watcher`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logs := filepath.Join(dir, `logs`)
+	if err = os.Mkdir(logs, 0770); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(logs, `a.log`)
+	if err = ioutil.WriteFile(p, []byte("one\ntwo\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, `state`)
+	wm, err := newWatchManager(state, 50*time.Millisecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wm.Add(filewatch.WatchConfig{
+		ConfigName:           `test`,
+		BaseDir:              logs,
+		FileFilter:           `*.log`,
+		Hnd:                  &captureHandler{},
+		FollowerEngineConfig: filewatch.FollowerEngineConfig{Engine: filewatch.LineEngine},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = wm.Start(); err != nil {
+		t.Fatal(err)
+	} else if err = wm.Start(); err != ErrWatcherStarted {
+		t.Fatal("started twice", err)
+	}
+
+	//the offsets reach the state file long before the library's one minute flush
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if sts, err := filewatch.ReadStateFile(state); err == nil && sts[filepath.Join(p, `test`)] == 8 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("offsets were not checkpointed %v %v", sts, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = wm.Close(); err != nil {
+		t.Fatal(err)
+	} else if err = wm.Checkpoint(); err != ErrWatcherNoStateFile {
+		t.Fatal("checkpointed a closed watcher", err)
+	}
+
+	//the default checkpoint matches the library
+	if wm, err = newWatchManager(state, 0, false); err != nil {
+		t.Fatal(err)
+	} else if wm.checkpoint != defaultStateCheckpoint {
+		t.Fatal("bad default checkpoint", wm.checkpoint)
+	} else if err = wm.Start(); err != ErrNoWatchDirs {
+		t.Fatal("started without any locations", err)
+	} else if err = wm.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
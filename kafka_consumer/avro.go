@@ -0,0 +1,616 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	avroMagic           byte = 0
+	avroHeaderLen            = 5    //magic byte and a big endian schema id
+	avroMaxDepth             = 128  //nesting of records, arrays, and maps
+	avroZeroWidthBudget      = 4096 //array and map items that may not consume any bytes, such as nulls
+
+	registryTimeout       = 10 * time.Second
+	registryRetryInterval = 30 * time.Second //how long a failed schema lookup is remembered before trying again
+	registryMaxResponse   = 8 * mb
+	registryContentType   = `application/vnd.schemaregistry.v1+json`
+)
+
+var (
+	ErrSchemaRegistryURL     = errors.New("Schema-Registry-URL must be an http or https URL")
+	ErrSchemaRegistryOptions = errors.New("Schema-Registry options require a Schema-Registry-URL")
+	ErrSchemaRegistryNoUser  = errors.New("Schema-Registry-Password requires a Schema-Registry-User")
+
+	errAvroTruncated = errors.New("truncated Avro value")
+	errAvroTrailing  = errors.New("trailing bytes after the Avro value")
+	errAvroVarint    = errors.New("invalid Avro varint")
+	errAvroBoolean   = errors.New("invalid Avro boolean")
+	errAvroLength    = errors.New("invalid Avro length")
+	errAvroTooLarge  = errors.New("Avro array or map is larger than the value")
+	errAvroTooDeep   = errors.New("Avro value is nested too deeply")
+)
+
+// schemaRegistry fetches Avro schemas from a Confluent Schema Registry by id.  Schemas
+// are immutable once registered so they are cached for the life of the consumer, failed
+// lookups are remembered for a short time so an unreachable registry does not stall
+// every message.
+type schemaRegistry struct {
+	url      string
+	user     string
+	password string
+	clnt     *http.Client
+
+	mtx      sync.Mutex
+	schemas  map[uint32]*avroSchema
+	failures map[uint32]registryFailure
+}
+
+type registryFailure struct {
+	err   error
+	until time.Time
+}
+
+// schemaRegistry checks the Schema Registry options, nil is returned when Avro decoding is not enabled
+func (cc ConfigConsumer) schemaRegistry() (sr *schemaRegistry, err error) {
+	if cc.Schema_Registry_URL == `` {
+		if cc.Schema_Registry_User != `` || cc.Schema_Registry_Password != `` {
+			err = ErrSchemaRegistryOptions
+		}
+		return
+	}
+	u, err := url.Parse(cc.Schema_Registry_URL)
+	if err != nil || (u.Scheme != `http` && u.Scheme != `https`) || u.Host == `` {
+		return nil, ErrSchemaRegistryURL
+	} else if cc.Schema_Registry_Password != `` && cc.Schema_Registry_User == `` {
+		return nil, ErrSchemaRegistryNoUser
+	}
+	sr = &schemaRegistry{
+		url:      strings.TrimSuffix(u.String(), `/`),
+		user:     cc.Schema_Registry_User,
+		password: cc.Schema_Registry_Password,
+		clnt:     &http.Client{Timeout: registryTimeout},
+	}
+	return
+}
+
+// decode converts a Confluent wire format Avro value to JSON, values without the wire
+// format header are returned unmodified with ok set to false
+func (sr *schemaRegistry) decode(ctx context.Context, v []byte) (out []byte, ok bool, err error) {
+	if len(v) < avroHeaderLen || v[0] != avroMagic {
+		return v, false, nil
+	}
+	id := binary.BigEndian.Uint32(v[1:avroHeaderLen])
+	var s *avroSchema
+	if s, err = sr.schema(ctx, id); err != nil {
+		return
+	}
+	if out, err = decodeAvro(s, v[avroHeaderLen:]); err != nil {
+		err = fmt.Errorf("schema %d: %v", id, err)
+		return
+	}
+	ok = true
+	return
+}
+
+func (sr *schemaRegistry) schema(ctx context.Context, id uint32) (s *avroSchema, err error) {
+	sr.mtx.Lock()
+	s = sr.schemas[id]
+	f, failed := sr.failures[id]
+	sr.mtx.Unlock()
+	if s != nil {
+		return
+	} else if failed && time.Now().Before(f.until) {
+		return nil, f.err
+	}
+
+	s, err = sr.fetch(ctx, id)
+	sr.mtx.Lock()
+	if err != nil {
+		if sr.failures == nil {
+			sr.failures = map[uint32]registryFailure{}
+		}
+		sr.failures[id] = registryFailure{err: err, until: time.Now().Add(registryRetryInterval)}
+	} else {
+		if sr.schemas == nil {
+			sr.schemas = map[uint32]*avroSchema{}
+		}
+		sr.schemas[id] = s
+		delete(sr.failures, id)
+	}
+	sr.mtx.Unlock()
+	return
+}
+
+func (sr *schemaRegistry) fetch(ctx context.Context, id uint32) (*avroSchema, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/schemas/ids/%d", sr.url, id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(`Accept`, registryContentType)
+	if sr.user != `` {
+		req.SetBasicAuth(sr.user, sr.password)
+	}
+	resp, err := sr.clnt.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch schema %d: %v", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Schema Registry returned %s for schema %d", resp.Status, id)
+	}
+	var sresp struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err = json.NewDecoder(io.LimitReader(resp.Body, registryMaxResponse)).Decode(&sresp); err != nil {
+		return nil, fmt.Errorf("Invalid Schema Registry response for schema %d: %v", id, err)
+	} else if sresp.SchemaType != `` && sresp.SchemaType != `AVRO` {
+		return nil, fmt.Errorf("schema %d is a %s schema, only Avro is supported", id, sresp.SchemaType)
+	}
+	s, err := parseAvroSchema(sresp.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("schema %d: %v", id, err)
+	}
+	return s, nil
+}
+
+type avroType int
+
+const (
+	avroNull avroType = iota
+	avroBoolean
+	avroInt
+	avroLong
+	avroFloat
+	avroDouble
+	avroBytes
+	avroString
+	avroRecord
+	avroEnum
+	avroArray
+	avroMap
+	avroUnion
+	avroFixed
+)
+
+var avroPrimitives = map[string]avroType{
+	`null`:    avroNull,
+	`boolean`: avroBoolean,
+	`int`:     avroInt,
+	`long`:    avroLong,
+	`float`:   avroFloat,
+	`double`:  avroDouble,
+	`bytes`:   avroBytes,
+	`string`:  avroString,
+}
+
+// avroSchema is a parsed Avro schema, named types are shared so recursive records point at themselves
+type avroSchema struct {
+	typ      avroType
+	name     string        //full name of records, enums, and fixed types
+	fields   []avroField   //record fields in order
+	symbols  [][]byte      //enum symbols as JSON strings
+	items    *avroSchema   //array items and map values
+	branches []*avroSchema //union branches
+	size     int           //fixed size
+}
+
+type avroField struct {
+	key    []byte //JSON encoded field name and colon
+	schema *avroSchema
+}
+
+// parseAvroSchema parses a schema in the Avro JSON schema format.  Logical types are
+// decoded as their underlying type and schema references are not supported.
+func parseAvroSchema(s string) (*avroSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("invalid Avro schema: %v", err)
+	}
+	p := avroParser{named: map[string]*avroSchema{}}
+	return p.parse(v, ``)
+}
+
+type avroParser struct {
+	named map[string]*avroSchema
+}
+
+func (p *avroParser) parse(v interface{}, ns string) (*avroSchema, error) {
+	switch t := v.(type) {
+	case string:
+		return p.lookup(t, ns)
+	case []interface{}:
+		s := &avroSchema{typ: avroUnion}
+		for _, b := range t {
+			bs, err := p.parse(b, ns)
+			if err != nil {
+				return nil, err
+			}
+			s.branches = append(s.branches, bs)
+		}
+		if len(s.branches) == 0 {
+			return nil, errors.New("empty Avro union")
+		}
+		return s, nil
+	case map[string]interface{}:
+		return p.parseComplex(t, ns)
+	}
+	return nil, fmt.Errorf("invalid Avro schema %v", v)
+}
+
+// lookup resolves primitive type names and references to named types defined earlier in the schema
+func (p *avroParser) lookup(name, ns string) (*avroSchema, error) {
+	if typ, ok := avroPrimitives[name]; ok {
+		return &avroSchema{typ: typ}, nil
+	} else if s, ok := p.named[avroFullName(name, ns)]; ok {
+		return s, nil
+	} else if s, ok := p.named[name]; ok {
+		return s, nil
+	}
+	return nil, fmt.Errorf("unknown Avro type %q", name)
+}
+
+func (p *avroParser) parseComplex(m map[string]interface{}, ns string) (*avroSchema, error) {
+	typ, ok := m[`type`].(string)
+	if !ok {
+		//the type attribute holds a full schema
+		return p.parse(m[`type`], ns)
+	}
+	switch typ {
+	case `record`, `error`, `enum`, `fixed`:
+		return p.parseNamed(typ, m, ns)
+	case `array`:
+		items, err := p.parse(m[`items`], ns)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: avroArray, items: items}, nil
+	case `map`:
+		values, err := p.parse(m[`values`], ns)
+		if err != nil {
+			return nil, err
+		}
+		return &avroSchema{typ: avroMap, items: values}, nil
+	}
+	//primitives with attributes such as a logicalType
+	return p.lookup(typ, ns)
+}
+
+func (p *avroParser) parseNamed(typ string, m map[string]interface{}, ns string) (*avroSchema, error) {
+	name, _ := m[`name`].(string)
+	if name == `` {
+		return nil, fmt.Errorf("Avro %s is missing a name", typ)
+	}
+	if n, ok := m[`namespace`].(string); ok {
+		ns = n
+	}
+	full := avroFullName(name, ns)
+	if idx := strings.LastIndex(full, `.`); idx >= 0 {
+		ns = full[:idx]
+	} else {
+		ns = ``
+	}
+	if _, ok := p.named[full]; ok {
+		return nil, fmt.Errorf("Avro type %s is defined more than once", full)
+	}
+	s := &avroSchema{name: full}
+	p.named[full] = s //registered before the fields so records may refer to themselves
+
+	switch typ {
+	case `enum`:
+		s.typ = avroEnum
+		syms, _ := m[`symbols`].([]interface{})
+		for _, v := range syms {
+			sym, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("Avro enum %s has an invalid symbol %v", full, v)
+			}
+			s.symbols = append(s.symbols, appendJSONString(nil, []byte(sym)))
+		}
+		if len(s.symbols) == 0 {
+			return nil, fmt.Errorf("Avro enum %s has no symbols", full)
+		}
+	case `fixed`:
+		s.typ = avroFixed
+		sz, ok := m[`size`].(float64)
+		if !ok || sz < 0 || sz != math.Trunc(sz) || sz > math.MaxInt32 {
+			return nil, fmt.Errorf("Avro fixed %s has an invalid size", full)
+		}
+		s.size = int(sz)
+	default:
+		s.typ = avroRecord
+		fields, ok := m[`fields`].([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Avro record %s is missing its fields", full)
+		}
+		for _, v := range fields {
+			fm, _ := v.(map[string]interface{})
+			fname, _ := fm[`name`].(string)
+			if fname == `` {
+				return nil, fmt.Errorf("Avro record %s has a field without a name", full)
+			}
+			fs, err := p.parse(fm[`type`], ns)
+			if err != nil {
+				return nil, err
+			}
+			s.fields = append(s.fields, avroField{
+				key:    append(appendJSONString(nil, []byte(fname)), ':'),
+				schema: fs,
+			})
+		}
+	}
+	return s, nil
+}
+
+func avroFullName(name, ns string) string {
+	if ns == `` || strings.Contains(name, `.`) {
+		return name
+	}
+	return ns + `.` + name
+}
+
+// decodeAvro decodes an Avro binary value to JSON.  Record fields keep their schema
+// order, unions are written as the value of the selected branch rather than the
+// {"type": value} form of the Avro JSON encoding, enums are written as their symbol,
+// bytes and fixed values are base64 encoded, and NaN or infinite floats are null.
+func decodeAvro(s *avroSchema, b []byte) ([]byte, error) {
+	d := avroDecoder{
+		b:      b,
+		out:    make([]byte, 0, 2*len(b)),
+		budget: int64(len(b)) + avroZeroWidthBudget,
+	}
+	if err := d.value(s); err != nil {
+		return nil, err
+	} else if len(d.b) != 0 {
+		return nil, errAvroTrailing
+	}
+	return d.out, nil
+}
+
+type avroDecoder struct {
+	b      []byte
+	out    []byte
+	depth  int
+	budget int64 //remaining array and map items, so a huge count cannot spin on an empty value
+}
+
+func (d *avroDecoder) value(s *avroSchema) (err error) {
+	switch s.typ {
+	case avroNull:
+		d.out = append(d.out, `null`...)
+	case avroBoolean:
+		if len(d.b) == 0 {
+			return errAvroTruncated
+		} else if d.b[0] > 1 {
+			return errAvroBoolean
+		}
+		d.out = strconv.AppendBool(d.out, d.b[0] == 1)
+		d.b = d.b[1:]
+	case avroInt, avroLong:
+		var v int64
+		if v, err = d.long(); err == nil {
+			d.out = strconv.AppendInt(d.out, v, 10)
+		}
+	case avroFloat:
+		if len(d.b) < 4 {
+			return errAvroTruncated
+		}
+		d.float(float64(math.Float32frombits(binary.LittleEndian.Uint32(d.b))), 32)
+		d.b = d.b[4:]
+	case avroDouble:
+		if len(d.b) < 8 {
+			return errAvroTruncated
+		}
+		d.float(math.Float64frombits(binary.LittleEndian.Uint64(d.b)), 64)
+		d.b = d.b[8:]
+	case avroBytes:
+		var b []byte
+		if b, err = d.bytes(); err == nil {
+			d.base64(b)
+		}
+	case avroString:
+		var b []byte
+		if b, err = d.bytes(); err == nil {
+			d.out = appendJSONString(d.out, b)
+		}
+	case avroFixed:
+		if len(d.b) < s.size {
+			return errAvroTruncated
+		}
+		d.base64(d.b[:s.size])
+		d.b = d.b[s.size:]
+	case avroEnum:
+		var idx int64
+		if idx, err = d.long(); err != nil {
+			return
+		} else if idx < 0 || idx >= int64(len(s.symbols)) {
+			return fmt.Errorf("invalid index %d for Avro enum %s", idx, s.name)
+		}
+		d.out = append(d.out, s.symbols[idx]...)
+	case avroUnion:
+		var idx int64
+		if idx, err = d.long(); err != nil {
+			return
+		} else if idx < 0 || idx >= int64(len(s.branches)) {
+			return fmt.Errorf("invalid Avro union index %d", idx)
+		}
+		err = d.value(s.branches[idx])
+	case avroRecord:
+		err = d.record(s)
+	case avroArray, avroMap:
+		err = d.collection(s)
+	default:
+		err = fmt.Errorf("unknown Avro type %d", s.typ)
+	}
+	return
+}
+
+func (d *avroDecoder) record(s *avroSchema) error {
+	if d.depth++; d.depth > avroMaxDepth {
+		return errAvroTooDeep
+	}
+	d.out = append(d.out, '{')
+	for i, f := range s.fields {
+		if i > 0 {
+			d.out = append(d.out, ',')
+		}
+		d.out = append(d.out, f.key...)
+		if err := d.value(f.schema); err != nil {
+			return err
+		}
+	}
+	d.out = append(d.out, '}')
+	d.depth--
+	return nil
+}
+
+// collection decodes the blocks of an array or map, a negative block count is followed
+// by the size of the block in bytes
+func (d *avroDecoder) collection(s *avroSchema) error {
+	if d.depth++; d.depth > avroMaxDepth {
+		return errAvroTooDeep
+	}
+	open, end := byte('['), byte(']')
+	if s.typ == avroMap {
+		open, end = '{', '}'
+	}
+	d.out = append(d.out, open)
+	first := true
+	for {
+		n, err := d.long()
+		if err != nil {
+			return err
+		} else if n == 0 {
+			break
+		} else if n < 0 {
+			if n = -n; n < 0 {
+				return errAvroTooLarge
+			} else if _, err = d.long(); err != nil {
+				return err
+			}
+		}
+		if n > d.budget {
+			return errAvroTooLarge
+		}
+		d.budget -= n
+		for ; n > 0; n-- {
+			if !first {
+				d.out = append(d.out, ',')
+			}
+			first = false
+			if s.typ == avroMap {
+				key, err := d.bytes()
+				if err != nil {
+					return err
+				}
+				d.out = append(appendJSONString(d.out, key), ':')
+			}
+			if err = d.value(s.items); err != nil {
+				return err
+			}
+		}
+	}
+	d.out = append(d.out, end)
+	d.depth--
+	return nil
+}
+
+// long reads a zigzag encoded varint, which is the signed varint encoding of encoding/binary
+func (d *avroDecoder) long() (int64, error) {
+	v, n := binary.Varint(d.b)
+	if n == 0 {
+		return 0, errAvroTruncated
+	} else if n < 0 {
+		return 0, errAvroVarint
+	}
+	d.b = d.b[n:]
+	return v, nil
+}
+
+func (d *avroDecoder) bytes() ([]byte, error) {
+	n, err := d.long()
+	if err != nil {
+		return nil, err
+	} else if n < 0 {
+		return nil, errAvroLength
+	} else if n > int64(len(d.b)) {
+		return nil, errAvroTruncated
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+func (d *avroDecoder) float(f float64, bits int) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		d.out = append(d.out, `null`...)
+	} else {
+		d.out = strconv.AppendFloat(d.out, f, 'g', -1, bits)
+	}
+}
+
+func (d *avroDecoder) base64(b []byte) {
+	d.out = append(d.out, '"')
+	n := len(d.out)
+	d.out = append(d.out, make([]byte, base64.StdEncoding.EncodedLen(len(b)))...)
+	base64.StdEncoding.Encode(d.out[n:], b)
+	d.out = append(d.out, '"')
+}
+
+const hexDigits = `0123456789abcdef`
+
+// appendJSONString appends s as a quoted JSON string, invalid UTF-8 is replaced with U+FFFD
+func appendJSONString(dst, s []byte) []byte {
+	dst = append(dst, '"')
+	for len(s) > 0 {
+		c := s[0]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < 0x20:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			s = s[1:]
+			continue
+		}
+		r, sz := utf8.DecodeRune(s)
+		if r == utf8.RuneError && sz == 1 {
+			dst = append(dst, `\ufffd`...)
+		} else {
+			dst = append(dst, s[:sz]...)
+		}
+		s = s[sz:]
+	}
+	return append(dst, '"')
+}
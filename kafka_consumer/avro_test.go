@@ -0,0 +1,262 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const testAvroSchema = `{
+	"type": "record", "name": "Event", "namespace": "com.example",
+	"fields": [
+		{"name": "id", "type": "long"},
+		{"name": "count", "type": {"type": "int", "logicalType": "date"}},
+		{"name": "msg", "type": "string"},
+		{"name": "ok", "type": "boolean"},
+		{"name": "ratio", "type": "float"},
+		{"name": "score", "type": "double"},
+		{"name": "raw", "type": "bytes"},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["DEBUG", "INFO", "WARN"]}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "attrs", "type": {"type": "map", "values": "long"}},
+		{"name": "user", "type": ["null", "string"]},
+		{"name": "hash", "type": {"type": "fixed", "name": "MD4", "size": 2}},
+		{"name": "next", "type": ["null", "Event"]},
+		{"name": "other", "type": ["null", "com.example.Level"]}
+	]
+}`
+
+// avroEncoder builds Avro binary values for the tests
+type avroEncoder struct {
+	b []byte
+}
+
+func (e *avroEncoder) long(v int64) *avroEncoder {
+	var buff [binary.MaxVarintLen64]byte
+	e.b = append(e.b, buff[:binary.PutVarint(buff[:], v)]...)
+	return e
+}
+
+func (e *avroEncoder) str(v string) *avroEncoder {
+	e.long(int64(len(v)))
+	e.b = append(e.b, v...)
+	return e
+}
+
+func (e *avroEncoder) raw(v ...byte) *avroEncoder {
+	e.b = append(e.b, v...)
+	return e
+}
+
+func (e *avroEncoder) float(v float32) *avroEncoder {
+	var buff [4]byte
+	binary.LittleEndian.PutUint32(buff[:], math.Float32bits(v))
+	return e.raw(buff[:]...)
+}
+
+func (e *avroEncoder) double(v float64) *avroEncoder {
+	var buff [8]byte
+	binary.LittleEndian.PutUint64(buff[:], math.Float64bits(v))
+	return e.raw(buff[:]...)
+}
+
+// event appends an Event record, next is encoded as a nested Event when nested is set
+func (e *avroEncoder) event(id int64, nested bool) *avroEncoder {
+	e.long(id).long(18000).str("say \"hi\"\n").raw(1).float(1.5).double(math.NaN()).str("\x00\xff")
+	e.long(1)                                                      //INFO
+	e.long(-2).long(6).str(`a`).str(`bc`).long(1).str(`d`).long(0) //array as a sized block and a plain block
+	e.long(1).str(`port`).long(443).long(0)
+	e.long(1).str(`bob`)
+	e.raw(0xde, 0xad)
+	if nested {
+		e.long(1)
+		e.event(id+1, false)
+	} else {
+		e.long(0)
+	}
+	return e.long(1).long(2)
+}
+
+const testAvroEventJSON = `{"id":%d,"count":18000,"msg":"say \"hi\"\n","ok":true,"ratio":1.5,"score":null,"raw":"AP8=",` +
+	`"level":"INFO","tags":["a","bc","d"],"attrs":{"port":443},"user":"bob","hash":"3q0=","next":%s,"other":"WARN"}`
+
+func TestAvroDecode(t *testing.T) {
+	s, err := parseAvroSchema(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e avroEncoder
+	out, err := decodeAvro(s, e.event(-7, true).b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := fmt.Sprintf(testAvroEventJSON, -6, `null`)
+	if exp := fmt.Sprintf(testAvroEventJSON, -7, inner); string(out) != exp {
+		t.Fatalf("bad JSON\n%s\n%s", out, exp)
+	} else if !json.Valid(out) {
+		t.Fatal("invalid JSON")
+	}
+
+	//invalid UTF-8 and control characters are escaped
+	if out, err = decodeAvro(&avroSchema{typ: avroString}, (&avroEncoder{}).str("a\x01\xffé").b); err != nil {
+		t.Fatal(err)
+	} else if string(out) != `"a\u0001\ufffdé"` {
+		t.Fatalf("bad string %s", out)
+	}
+}
+
+func TestAvroDecodeErrors(t *testing.T) {
+	s, err := parseAvroSchema(testAvroSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e avroEncoder
+	good := e.event(1, false).b
+	if _, err = decodeAvro(s, good[:len(good)-1]); err != errAvroTruncated {
+		t.Fatalf("bad truncated error %v", err)
+	} else if _, err = decodeAvro(s, append(good, 0)); err != errAvroTrailing {
+		t.Fatalf("bad trailing error %v", err)
+	}
+	bad := map[string][]byte{
+		`{"type":"enum","name":"e","symbols":["a"]}`: (&avroEncoder{}).long(1).b,
+		`["null","int"]`:                  (&avroEncoder{}).long(-1).b,
+		`"boolean"`:                       {2},
+		`"string"`:                        (&avroEncoder{}).long(-1).b,
+		`{"type":"array","items":"null"}`: (&avroEncoder{}).long(math.MaxInt64 >> 1).b,
+		`{"type":"map","values":"null"}`:  (&avroEncoder{}).long(math.MinInt64).long(0).b,
+		`"long"`:                          {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+	}
+	for schema, v := range bad {
+		s, err := parseAvroSchema(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = decodeAvro(s, v); err == nil {
+			t.Fatalf("decoded invalid %s value %v", schema, v)
+		}
+	}
+
+	//deeply nested values are rejected rather than exhausting the stack
+	if s, err = parseAvroSchema(`{"type":"record","name":"n","fields":[{"name":"n","type":["null","n"]}]}`); err != nil {
+		t.Fatal(err)
+	}
+	deep := make([]byte, avroMaxDepth+1)
+	for i := range deep {
+		deep[i] = 2 //union branch 1
+	}
+	if _, err = decodeAvro(s, deep); err != errAvroTooDeep {
+		t.Fatalf("bad nesting error %v", err)
+	}
+}
+
+func TestAvroSchemaErrors(t *testing.T) {
+	for _, v := range []string{
+		`not json`,
+		`"Missing"`,
+		`[]`,
+		`{"type":"record","name":"r"}`,
+		`{"type":"record","fields":[]}`,
+		`{"type":"record","name":"r","fields":[{"name":"a","type":"r2"}]}`,
+		`{"type":"enum","name":"e","symbols":[]}`,
+		`{"type":"fixed","name":"f","size":-1}`,
+		`["null",{"type":"fixed","name":"f","size":1},{"type":"fixed","name":"f","size":2}]`,
+	} {
+		if _, err := parseAvroSchema(v); err == nil {
+			t.Fatalf("accepted invalid schema %s", v)
+		}
+	}
+}
+
+func TestSchemaRegistry(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if user, pass, ok := r.BasicAuth(); !ok || user != `key` || pass != `secret` {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case `/registry/schemas/ids/1`:
+			json.NewEncoder(w).Encode(map[string]string{`schema`: testAvroSchema})
+		case `/registry/schemas/ids/2`:
+			json.NewEncoder(w).Encode(map[string]string{`schema`: `syntax = "proto3";`, `schemaType`: `PROTOBUF`})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	sr, err := ConfigConsumer{
+		Schema_Registry_URL:      srv.URL + `/registry/`,
+		Schema_Registry_User:     `key`,
+		Schema_Registry_Password: `secret`,
+	}.schemaRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	//schemas are fetched once
+	val := (&avroEncoder{}).raw(avroMagic, 0, 0, 0, 1).event(1, false).b
+	for i := 0; i < 2; i++ {
+		if out, ok, err := sr.decode(ctx, val); err != nil || !ok {
+			t.Fatalf("failed to decode %v %v", ok, err)
+		} else if exp := fmt.Sprintf(testAvroEventJSON, 1, `null`); string(out) != exp {
+			t.Fatalf("bad JSON\n%s\n%s", out, exp)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("schema fetched %d times", n)
+	}
+
+	//values that are not in the wire format are passed through
+	if out, ok, err := sr.decode(ctx, []byte(`plain text`)); err != nil || ok || string(out) != `plain text` {
+		t.Fatalf("bad passthrough %q %v %v", out, ok, err)
+	}
+
+	//failed lookups are not retried right away
+	for _, id := range []byte{2, 3} {
+		for i := 0; i < 2; i++ {
+			if _, _, err = sr.decode(ctx, []byte{avroMagic, 0, 0, 0, id, 0}); err == nil {
+				t.Fatalf("decoded a value with schema %d", id)
+			}
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("made %d requests", n)
+	}
+}
+
+func TestSchemaRegistryConfig(t *testing.T) {
+	if sr, err := (ConfigConsumer{}).schemaRegistry(); err != nil || sr != nil {
+		t.Fatalf("Avro decoding enabled without a registry: %v %v", sr, err)
+	}
+	if sr, err := (ConfigConsumer{Schema_Registry_URL: `https://registry.example.com:8081/`}).schemaRegistry(); err != nil {
+		t.Fatal(err)
+	} else if sr.url != `https://registry.example.com:8081` {
+		t.Fatalf("bad url %s", sr.url)
+	}
+	bad := []ConfigConsumer{
+		{Schema_Registry_URL: `registry.example.com:8081`},
+		{Schema_Registry_URL: `ftp://registry.example.com`},
+		{Schema_Registry_URL: `https://registry.example.com`, Schema_Registry_Password: `secret`},
+		{Schema_Registry_User: `key`, Schema_Registry_Password: `secret`},
+	}
+	for _, v := range bad {
+		if _, err := v.schemaRegistry(); err == nil {
+			t.Fatalf("Failed to catch bad Schema Registry config %+v", v)
+		}
+	}
+}
@@ -9,8 +9,11 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"sort"
 	"strings"
@@ -34,19 +37,49 @@ const (
 	defaultConsumerGroup string = `gravwell`
 )
 
+var (
+	ErrInvalidTopicTag   = errors.New("Topic-Tag must be of the form topic:tag")
+	ErrTopicTagNoTopic   = errors.New("Topic-Tag names a topic the consumer does not read")
+	ErrInvalidHeaderTag  = errors.New("Header-Tag must be of the form value:tag")
+	ErrHeaderTagNoHeader = errors.New("Header-Tag requires a Tag-Header")
+	ErrTLSOptionsNoTLS   = errors.New("TLS options require Use-TLS=true")
+	ErrTLSCertKeyMissing = errors.New("TLS-Cert-File and TLS-Key-File must be given together")
+)
+
 type ConfigConsumer struct {
 	Tag_Name           string
 	Leader             string
-	Topic              string
+	Topic              []string //may be given multiple times
+	Topic_Tag          []string //topic:tag, entries from the topic go to the tag instead of Tag-Name
+	Tag_Header         string   //header holding the tag name for each message, overrides Topic-Tag
+	Header_Tag         []string //value:tag, maps Tag-Header values to tags instead of using the value as the tag name
 	Consumer_Group     string
 	Source_Override    string
 	Rebalance_Strategy string
 	Key_As_Source      bool
 	Header_As_Source   string
-	Synchronous        bool
+	Synchronous        bool //deprecated, offsets are always committed once the entries are acknowledged
 	Batch_Size         int
 	Source_As_Text     bool
 
+	Use_TLS                  bool
+	Insecure_Skip_TLS_Verify bool
+	TLS_CA_File              string //CA bundle used to verify the brokers, the system pool is used if empty
+	TLS_Cert_File            string //client certificate for brokers that require TLS client authentication
+	TLS_Key_File             string
+
+	SASL_Mechanism           string //plain, scram-sha-256, scram-sha-512, or oauthbearer
+	SASL_User                string //user for plain and SCRAM authentication
+	SASL_Password            string
+	SASL_OAuth_Token_URL     string //OAuth token endpoint used to get oauthbearer tokens with the client credentials flow
+	SASL_OAuth_Client_ID     string
+	SASL_OAuth_Client_Secret string
+	SASL_OAuth_Scope         []string //may be given multiple times
+
+	Schema_Registry_URL      string //Confluent Schema Registry used to decode Avro values to JSON
+	Schema_Registry_User     string //basic authentication user, the API key for Confluent Cloud
+	Schema_Registry_Password string
+
 	Ignore_Timestamps         bool //Just apply the current timestamp to lines as we get them
 	Extract_Timestamps        bool // Ignore the kafka timestamp, use timegrinder
 	Assume_Local_Timezone     bool
@@ -56,21 +89,26 @@ type ConfigConsumer struct {
 }
 
 type consumerCfg struct {
-	tag            string
-	leader         string
-	topic          string
-	group          string
-	strat          sarama.BalanceStrategy
-	sync           bool
-	batchSize      int
-	keyAsSrc       bool
-	headerKeyAsSrc []byte
-	srcAsText      bool
-	srcOverride    net.IP
-	ignoreTS       bool
-	extractTS      bool
-	tg             *timegrinder.TimeGrinder
-	preprocessor   []string
+	tag             string
+	leader          string
+	topics          []string
+	topicTags       map[string]string
+	tagHeader       []byte
+	headerValueTags map[string]string
+	group           string
+	strat           sarama.BalanceStrategy
+	batchSize       int
+	keyAsSrc        bool
+	headerKeyAsSrc  []byte
+	srcAsText       bool
+	srcOverride     net.IP
+	ignoreTS        bool
+	extractTS       bool
+	tg              *timegrinder.TimeGrinder
+	preprocessor    []string
+	tls             *tls.Config
+	sasl            *saslConfig
+	registry        *schemaRegistry
 }
 
 type cfgReadType struct {
@@ -133,6 +171,14 @@ func (c *cfgType) Tags() (tags []string, err error) {
 			tags = append(tags, v.tag)
 			tagMp[v.tag] = true
 		}
+		for _, mp := range []map[string]string{v.topicTags, v.headerValueTags} {
+			for _, tag := range mp {
+				if _, ok := tagMp[tag]; !ok {
+					tags = append(tags, tag)
+					tagMp[tag] = true
+				}
+			}
+		}
 	}
 
 	if len(tags) == 0 {
@@ -163,15 +209,34 @@ func (cc ConfigConsumer) validateAndProcess() (c consumerCfg, err error) {
 		return
 	}
 
-	//check the topic
-	if len(cc.Topic) == 0 {
+	//check the topics
+	for _, t := range cc.Topic {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			c.topics = append(c.topics, t)
+		}
+	}
+	if len(c.topics) == 0 {
 		err = errors.New("Missing topic name")
 		return
 	}
-	c.topic = cc.Topic
-
-	//just set the sync
-	c.sync = cc.Synchronous
+	if c.topicTags, err = cc.parseTopicTags(c.topics); err != nil {
+		return
+	}
+	if cc.Tag_Header != `` {
+		c.tagHeader = []byte(cc.Tag_Header)
+	}
+	if c.headerValueTags, err = cc.parseHeaderTags(); err != nil {
+		return
+	}
+	if c.tls, err = cc.tlsConfig(); err != nil {
+		return
+	}
+	if c.sasl, err = cc.saslConfig(); err != nil {
+		return
+	}
+	if c.registry, err = cc.schemaRegistry(); err != nil {
+		return
+	}
 
 	// check that the source override is valid
 	if len(cc.Source_Override) > 0 {
@@ -250,3 +315,97 @@ func (cc ConfigConsumer) balanceStrat() (st sarama.BalanceStrategy, err error) {
 	}
 	return
 }
+
+// splitTagPair splits a value:tag override, tags cannot contain a colon so the last one separates the value
+func splitTagPair(v string) (val, tag string, ok bool) {
+	idx := strings.LastIndex(v, ":")
+	if idx <= 0 {
+		return
+	}
+	val, tag = strings.TrimSpace(v[:idx]), strings.TrimSpace(v[idx+1:])
+	ok = val != `` && tag != ``
+	return
+}
+
+// parseTopicTags checks the topic:tag overrides
+func (cc ConfigConsumer) parseTopicTags(topics []string) (mp map[string]string, err error) {
+	for _, v := range cc.Topic_Tag {
+		topic, tag, ok := splitTagPair(v)
+		if !ok {
+			return nil, ErrInvalidTopicTag
+		} else if err = ingest.CheckTag(tag); err != nil {
+			return nil, fmt.Errorf("Invalid Topic-Tag tag %q: %v", tag, err)
+		}
+		var found bool
+		for _, t := range topics {
+			if t == topic {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%v: %s", ErrTopicTagNoTopic, topic)
+		}
+		if mp == nil {
+			mp = map[string]string{}
+		}
+		mp[topic] = tag
+	}
+	return
+}
+
+// parseHeaderTags checks the value:tag overrides for the values of the Tag-Header
+func (cc ConfigConsumer) parseHeaderTags() (mp map[string]string, err error) {
+	if len(cc.Header_Tag) > 0 && cc.Tag_Header == `` {
+		return nil, ErrHeaderTagNoHeader
+	}
+	for _, v := range cc.Header_Tag {
+		val, tag, ok := splitTagPair(v)
+		if !ok {
+			return nil, ErrInvalidHeaderTag
+		} else if err = ingest.CheckTag(tag); err != nil {
+			return nil, fmt.Errorf("Invalid Header-Tag tag %q: %v", tag, err)
+		}
+		if mp == nil {
+			mp = map[string]string{}
+		}
+		mp[val] = tag
+	}
+	return
+}
+
+// tlsConfig builds the TLS configuration for the broker connections, nil when TLS is not enabled
+func (cc ConfigConsumer) tlsConfig() (tc *tls.Config, err error) {
+	if !cc.Use_TLS {
+		if cc.Insecure_Skip_TLS_Verify || cc.TLS_CA_File != `` || cc.TLS_Cert_File != `` || cc.TLS_Key_File != `` {
+			err = ErrTLSOptionsNoTLS
+		}
+		return
+	}
+	tc = &tls.Config{
+		InsecureSkipVerify: cc.Insecure_Skip_TLS_Verify,
+	}
+	if host, _, lerr := net.SplitHostPort(config.AppendDefaultPort(cc.Leader, defaultPort)); lerr == nil {
+		tc.ServerName = host
+	}
+	if cc.TLS_CA_File != `` {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(cc.TLS_CA_File); err != nil {
+			return nil, fmt.Errorf("Failed to read TLS-CA-File: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in TLS-CA-File %s", cc.TLS_CA_File)
+		}
+	}
+	if (cc.TLS_Cert_File == ``) != (cc.TLS_Key_File == ``) {
+		return nil, ErrTLSCertKeyMissing
+	} else if cc.TLS_Cert_File != `` {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cc.TLS_Cert_File, cc.TLS_Key_File); err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
@@ -70,6 +70,70 @@ func TestBasicConfig(t *testing.T) {
 	}
 }
 
+func TestTopicTagConfig(t *testing.T) {
+	cfg, err := GetConfig(writeConfig(t, topicConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := cfg.Consumers["multi"]
+	if !ok {
+		t.Fatal("missing consumer")
+	}
+	if len(c.topics) != 3 || c.topics[0] != `foo` || c.topics[2] != `baz` {
+		t.Fatalf("invalid topics: %v", c.topics)
+	}
+	if len(c.topicTags) != 2 || c.topicTags[`bar`] != `bartag` || c.topicTags[`baz`] != `baztag` {
+		t.Fatalf("invalid topic tags: %v", c.topicTags)
+	}
+	if string(c.tagHeader) != `tag` {
+		t.Fatalf("invalid tag header: %s", c.tagHeader)
+	}
+	if len(c.headerValueTags) != 1 || c.headerValueTags[`fw:asa`] != `firewall` {
+		t.Fatalf("invalid header tags: %v", c.headerValueTags)
+	}
+	if c.tls == nil || !c.tls.InsecureSkipVerify || c.tls.ServerName != `kafka.example.com` {
+		t.Fatalf("invalid TLS config: %+v", c.tls)
+	}
+	tags, err := cfg.Tags()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(tags) != 4 || tags[0] != `bartag` || tags[1] != `baztag` || tags[2] != `firewall` || tags[3] != `foo` {
+		t.Fatalf("invalid tags: %v", tags)
+	}
+}
+
+func TestBadTopicTagConfig(t *testing.T) {
+	bad := []string{
+		"\tTopic=foo\n\tTopic-Tag=foo\n",          //missing tag
+		"\tTopic=foo\n\tTopic-Tag=bar:bartag\n",   //not a consumed topic
+		"\tTopic=foo\n\tTopic-Tag=foo:bad tag\n",  //invalid tag
+		"\tTopic=foo\n\tHeader-Tag=fw:firewall\n", //no Tag-Header
+		"\tTopic=foo\n\tTag-Header=tag\n\tHeader-Tag=fw\n",
+		"\tTopic=foo\n\tTLS-CA-File=/tmp/ca.pem\n", //TLS options without TLS
+		"\tTopic=foo\n\tUse-TLS=true\n\tTLS-Cert-File=/tmp/cert.pem\n",
+		"\tTopic=foo\n\tSchema-Registry-User=key\n", //registry options without a registry
+		"\tTopic=foo\n\tSchema-Registry-URL=registry.example.com:8081\n",
+	}
+	for _, v := range bad {
+		cfg := badTopicConfigBase + v
+		if _, err := GetConfig(writeConfig(t, cfg)); err == nil {
+			t.Fatalf("Failed to catch bad config:\n%s", v)
+		}
+	}
+}
+
+func writeConfig(t *testing.T, cfg string) string {
+	fout, err := ioutil.TempFile(tmpDir, `cfg`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	if _, err := io.WriteString(fout, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return fout.Name()
+}
+
 const (
 	baseConfig string = `
 [Global]
@@ -103,4 +167,33 @@ Log-File=/opt/gravwell/log/kafka.log
 	Header-As-Source=TS
 	Source-As-Text=true
 `
+
+	topicConfig string = `
+[Global]
+Ingest-Secret = IngestSecrets
+Cleartext-Backend-target=127.0.0.1:4023
+
+[Consumer "multi"]
+	Leader="kafka.example.com:9093"
+	Topic=foo
+	Topic=bar
+	Topic=baz
+	Topic-Tag=bar:bartag
+	Topic-Tag="baz:baztag"
+	Tag-Header=tag
+	Header-Tag="fw:asa:firewall"
+	Tag-Name=foo
+	Use-TLS=true
+	Insecure-Skip-TLS-Verify=true
+`
+
+	badTopicConfigBase string = `
+[Global]
+Ingest-Secret = IngestSecrets
+Cleartext-Backend-target=127.0.0.1:4023
+
+[Consumer "bad"]
+	Leader="127.0.0.1"
+	Tag-Name=foo
+`
 )
@@ -29,6 +29,9 @@ const (
 	ipv6Len = 16
 
 	currKafkaVersion = `2.1.1`
+
+	ackTimeout    = 10 * time.Second //how long a batch waits to be acknowledged before the claim is given up
+	maxHeaderTags = 256              //distinct tags that may be named by the Tag-Header
 )
 
 type closer interface {
@@ -87,6 +90,12 @@ type kafkaConsumer struct {
 	size     uint
 	memberId string
 	src      net.IP
+
+	topicTags  map[string]entry.EntryTag
+	valueTags  map[string]entry.EntryTag //Header-Tag overrides
+	tagMtx     sync.Mutex
+	headerTags map[string]entry.EntryTag //tags negotiated for Tag-Header values
+	tagsFull   bool
 }
 
 type kafkaConsumerConfig struct {
@@ -107,6 +116,29 @@ func newKafkaConsumer(cfg kafkaConsumerConfig) (kc *kafkaConsumer, err error) {
 		}
 		if kc.tag, err = cfg.igst.GetTag(cfg.tag); err != nil {
 			kc = nil
+			return
+		}
+		for topic, name := range cfg.topicTags {
+			var tag entry.EntryTag
+			if tag, err = cfg.igst.GetTag(name); err != nil {
+				kc = nil
+				return
+			}
+			if kc.topicTags == nil {
+				kc.topicTags = map[string]entry.EntryTag{}
+			}
+			kc.topicTags[topic] = tag
+		}
+		for val, name := range cfg.headerValueTags {
+			var tag entry.EntryTag
+			if tag, err = cfg.igst.GetTag(name); err != nil {
+				kc = nil
+				return
+			}
+			if kc.valueTags == nil {
+				kc.valueTags = map[string]entry.EntryTag{}
+			}
+			kc.valueTags[val] = tag
 		}
 		kc.ctx, kc.cf = context.WithCancel(context.Background())
 	}
@@ -126,6 +158,11 @@ func (kc *kafkaConsumer) Start(wg *sync.WaitGroup) (err error) {
 		}
 		cfg.Consumer.Group.Rebalance.Strategy = kc.strat
 		cfg.Consumer.Offsets.Initial = sarama.OffsetOldest
+		if kc.tls != nil {
+			cfg.Net.TLS.Enable = true
+			cfg.Net.TLS.Config = kc.tls
+		}
+		kc.sasl.apply(cfg)
 		var clnt sarama.ConsumerGroup
 		if clnt, err = sarama.NewConsumerGroup([]string{kc.leader}, kc.group, cfg); err != nil {
 			return
@@ -161,7 +198,7 @@ func (kc *kafkaConsumer) routine(client sarama.ConsumerGroup, wg *sync.WaitGroup
 	for {
 		i++
 		kc.lg.Info("Consumer start attempt %d\n", i)
-		if err := client.Consume(kc.ctx, []string{kc.topic}, kc); err != nil {
+		if err := client.Consume(kc.ctx, kc.topics, kc); err != nil {
 			kc.lg.Error("Consumer error: %v", err)
 			break
 		}
@@ -216,7 +253,7 @@ func (kc *kafkaConsumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim
 	//README the ConsumeClaim function is running in a go routine
 	//it is entirely possible for multiple of these routines to be running at a time
 
-	if claim.Topic() != kc.topic {
+	if !kc.hasTopic(claim.Topic()) {
 		return errors.New("Claim routine got the wrong topic")
 	}
 
@@ -279,11 +316,19 @@ func (kc *kafkaConsumer) flush(session sarama.ConsumerGroupSession, msgs []*sara
 	var cnt uint
 	for _, m := range msgs {
 		ent := &entry.Entry{
-			Tag:  kc.tag,
+			Tag:  kc.msgTag(m),
 			TS:   entry.FromStandard(m.Timestamp),
 			Data: m.Value,
 			SRC:  kc.extractSource(m),
 		}
+		if kc.registry != nil {
+			//values that cannot be decoded are ingested as they are rather than dropped
+			if data, ok, err := kc.registry.decode(kc.ctx, m.Value); err != nil {
+				kc.lg.Warn("Failed to decode Avro value from topic %s partition %d offset %d: %v", m.Topic, m.Partition, m.Offset, err)
+			} else if ok {
+				ent.Data = data
+			}
+		}
 		if kc.ignoreTS {
 			ent.TS = entry.Now()
 		} else if kc.extractTS && kc.tg != nil {
@@ -302,10 +347,10 @@ func (kc *kafkaConsumer) flush(session sarama.ConsumerGroupSession, msgs []*sara
 		sz += uint(ent.Size())
 		cnt++
 	}
-	if kc.sync {
-		if err = kc.igst.SyncContext(kc.ctx, time.Second); err != nil {
-			return
-		}
+	//offsets are only committed once the muxer has handed the entries off, messages
+	//that were never acknowledged are consumed again by whoever picks up the partition
+	if err = kc.igst.SyncContext(kc.ctx, ackTimeout); err != nil {
+		return
 	}
 	//commit the messages
 	for i := range msgs {
@@ -348,3 +393,68 @@ func (kc *kafkaConsumer) extractSrc(v []byte) (ip net.IP) {
 	}
 	return
 }
+
+func (kc *kafkaConsumer) hasTopic(topic string) bool {
+	for _, t := range kc.topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// msgTag picks the tag for a message, the Tag-Header wins over the Topic-Tag of the
+// message topic which wins over the consumer Tag-Name.  When Header-Tag overrides are
+// given only the listed header values are routed, otherwise the header value is the
+// tag name.
+func (kc *kafkaConsumer) msgTag(m *sarama.ConsumerMessage) entry.EntryTag {
+	if kc.tagHeader != nil {
+		for _, rh := range m.Headers {
+			if bytes.Equal(kc.tagHeader, rh.Key) {
+				if kc.valueTags != nil {
+					if tag, ok := kc.valueTags[string(rh.Value)]; ok {
+						return tag
+					}
+				} else if tag, ok := kc.headerTag(string(rh.Value)); ok {
+					return tag
+				}
+				break
+			}
+		}
+	}
+	if tag, ok := kc.topicTags[m.Topic]; ok {
+		return tag
+	}
+	return kc.tag
+}
+
+// headerTag resolves a tag named in a message header, the number of distinct tags is
+// capped so a misbehaving producer cannot create an unbounded number of tags
+func (kc *kafkaConsumer) headerTag(name string) (tag entry.EntryTag, ok bool) {
+	if ingest.CheckTag(name) != nil {
+		return
+	}
+	kc.tagMtx.Lock()
+	defer kc.tagMtx.Unlock()
+	if tag, ok = kc.headerTags[name]; ok {
+		return
+	}
+	if len(kc.headerTags) >= maxHeaderTags {
+		if !kc.tagsFull {
+			kc.tagsFull = true
+			kc.lg.Warn("Consumer %s group %s reached %d header tags, new header tags use the default tag", kc.memberId, kc.group, maxHeaderTags)
+		}
+		return
+	}
+	var err error
+	if tag, err = kc.igst.NegotiateTag(name); err != nil {
+		kc.lg.Warn("Failed to negotiate header tag %q: %v", name, err)
+		return
+	}
+	if kc.headerTags == nil {
+		kc.headerTags = map[string]entry.EntryTag{}
+	}
+	kc.headerTags[name] = tag
+	ok = true
+	return
+}
@@ -0,0 +1,260 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	saslPlain       = `plain`
+	saslScramSHA256 = `scram-sha-256`
+	saslScramSHA512 = `scram-sha-512`
+	saslOAuthBearer = `oauthbearer`
+
+	oauthTimeout  = 10 * time.Second
+	scramNonceLen = 24
+)
+
+var (
+	ErrInvalidSASLMechanism = errors.New("SASL-Mechanism must be plain, scram-sha-256, scram-sha-512, or oauthbearer")
+	ErrSASLOptionsNoSASL    = errors.New("SASL options require a SASL-Mechanism")
+	ErrSASLMissingUser      = errors.New("SASL-User and SASL-Password are required for plain and SCRAM authentication")
+	ErrSASLMissingOAuth     = errors.New("oauthbearer authentication requires SASL-OAuth-Token-URL, SASL-OAuth-Client-ID, and SASL-OAuth-Client-Secret")
+
+	errScramServerNonce     = errors.New("SCRAM server nonce does not extend the client nonce")
+	errScramServerSignature = errors.New("SCRAM server signature is invalid")
+)
+
+// saslConfig holds the SASL authentication settings of a consumer
+type saslConfig struct {
+	mechanism sarama.SASLMechanism
+	user      string
+	password  string
+	oauth     *clientcredentials.Config
+}
+
+// saslConfig checks the SASL options, nil is returned when SASL is not enabled
+func (cc ConfigConsumer) saslConfig() (sc *saslConfig, err error) {
+	mech := strings.ToLower(strings.TrimSpace(cc.SASL_Mechanism))
+	if mech == `` {
+		if cc.SASL_User != `` || cc.SASL_Password != `` || cc.SASL_OAuth_Token_URL != `` ||
+			cc.SASL_OAuth_Client_ID != `` || cc.SASL_OAuth_Client_Secret != `` || len(cc.SASL_OAuth_Scope) > 0 {
+			err = ErrSASLOptionsNoSASL
+		}
+		return
+	}
+	sc = &saslConfig{
+		user:     cc.SASL_User,
+		password: cc.SASL_Password,
+	}
+	switch mech {
+	case saslPlain:
+		sc.mechanism = sarama.SASLTypePlaintext
+	case saslScramSHA256:
+		sc.mechanism = sarama.SASLTypeSCRAMSHA256
+	case saslScramSHA512:
+		sc.mechanism = sarama.SASLTypeSCRAMSHA512
+	case saslOAuthBearer:
+		sc.mechanism = sarama.SASLTypeOAuth
+		if cc.SASL_OAuth_Token_URL == `` || cc.SASL_OAuth_Client_ID == `` || cc.SASL_OAuth_Client_Secret == `` {
+			return nil, ErrSASLMissingOAuth
+		}
+		sc.oauth = &clientcredentials.Config{
+			ClientID:     cc.SASL_OAuth_Client_ID,
+			ClientSecret: cc.SASL_OAuth_Client_Secret,
+			TokenURL:     cc.SASL_OAuth_Token_URL,
+			Scopes:       cc.SASL_OAuth_Scope,
+		}
+		return
+	default:
+		return nil, ErrInvalidSASLMechanism
+	}
+	if sc.user == `` || sc.password == `` {
+		return nil, ErrSASLMissingUser
+	}
+	return
+}
+
+// apply enables SASL on a sarama configuration
+func (sc *saslConfig) apply(cfg *sarama.Config) {
+	if sc == nil {
+		return
+	}
+	cfg.Net.SASL.Enable = true
+	cfg.Net.SASL.Handshake = true
+	cfg.Net.SASL.Version = sarama.SASLHandshakeV1
+	cfg.Net.SASL.Mechanism = sc.mechanism
+	cfg.Net.SASL.User = sc.user
+	cfg.Net.SASL.Password = sc.password
+	switch sc.mechanism {
+	case sarama.SASLTypeSCRAMSHA256:
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: sha256.New} }
+	case sarama.SASLTypeSCRAMSHA512:
+		cfg.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient { return &scramClient{hash: sha512.New} }
+	case sarama.SASLTypeOAuth:
+		cfg.Net.SASL.TokenProvider = newOAuthTokenProvider(sc.oauth)
+	}
+}
+
+// oauthTokenProvider fetches OAUTHBEARER tokens with the OAuth client credentials flow.
+// Tokens are reused until they are about to expire and then fetched again, so every
+// broker connection is authenticated with an unexpired token.
+type oauthTokenProvider struct {
+	ts oauth2.TokenSource
+}
+
+func newOAuthTokenProvider(cfg *clientcredentials.Config) *oauthTokenProvider {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Timeout: oauthTimeout})
+	return &oauthTokenProvider{ts: cfg.TokenSource(ctx)}
+}
+
+func (p *oauthTokenProvider) Token() (*sarama.AccessToken, error) {
+	tok, err := p.ts.Token()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get OAuth token: %v", err)
+	}
+	return &sarama.AccessToken{Token: tok.AccessToken}, nil
+}
+
+// scramClient implements the client side of a SCRAM exchange as described in RFC 5802,
+// channel binding is not supported
+type scramClient struct {
+	hash            func() hash.Hash
+	user, password  string
+	authzID         string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	step            int
+	done            bool
+}
+
+func (sc *scramClient) Begin(user, password, authzID string) error {
+	sc.user, sc.password, sc.authzID = user, password, authzID
+	sc.step, sc.done = 0, false
+	if sc.nonce == `` {
+		b := make([]byte, scramNonceLen)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		sc.nonce = base64.RawStdEncoding.EncodeToString(b)
+	}
+	return nil
+}
+
+func (sc *scramClient) Step(challenge string) (resp string, err error) {
+	switch sc.step {
+	case 0:
+		sc.clientFirstBare = `n=` + scramName(sc.user) + `,r=` + sc.nonce
+		resp = sc.gs2Header() + sc.clientFirstBare
+	case 1:
+		resp, err = sc.clientFinal(challenge)
+	case 2:
+		err = sc.verifyServer(challenge)
+		sc.done = err == nil
+	default:
+		err = errors.New("SCRAM exchange already completed")
+	}
+	sc.step++
+	return
+}
+
+func (sc *scramClient) Done() bool {
+	return sc.done
+}
+
+func (sc *scramClient) gs2Header() string {
+	if sc.authzID == `` {
+		return `n,,`
+	}
+	return `n,a=` + scramName(sc.authzID) + `,`
+}
+
+// clientFinal computes the proof from the server first message
+func (sc *scramClient) clientFinal(serverFirst string) (string, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce, salt64, iters := attrs['r'], attrs['s'], attrs['i']
+	if !strings.HasPrefix(nonce, sc.nonce) || len(nonce) == len(sc.nonce) {
+		return ``, errScramServerNonce
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return ``, fmt.Errorf("invalid SCRAM salt: %v", err)
+	}
+	iter, err := strconv.Atoi(iters)
+	if err != nil || iter <= 0 {
+		return ``, fmt.Errorf("invalid SCRAM iteration count %q", iters)
+	}
+	finalNoProof := `c=` + base64.StdEncoding.EncodeToString([]byte(sc.gs2Header())) + `,r=` + nonce
+	authMsg := []byte(sc.clientFirstBare + `,` + serverFirst + `,` + finalNoProof)
+
+	salted := pbkdf2.Key([]byte(sc.password), salt, iter, sc.hash().Size(), sc.hash)
+	clientKey := sc.hmac(salted, []byte(`Client Key`))
+	h := sc.hash()
+	h.Write(clientKey)
+	clientSig := sc.hmac(h.Sum(nil), authMsg)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSig[i]
+	}
+	sc.serverSignature = sc.hmac(sc.hmac(salted, []byte(`Server Key`)), authMsg)
+	return finalNoProof + `,p=` + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+func (sc *scramClient) verifyServer(serverFinal string) error {
+	attrs := scramAttributes(serverFinal)
+	if e, ok := attrs['e']; ok {
+		return fmt.Errorf("SCRAM authentication failed: %s", e)
+	}
+	sig, err := base64.StdEncoding.DecodeString(attrs['v'])
+	if err != nil || !hmac.Equal(sig, sc.serverSignature) {
+		return errScramServerSignature
+	}
+	return nil
+}
+
+func (sc *scramClient) hmac(key, msg []byte) []byte {
+	m := hmac.New(sc.hash, key)
+	m.Write(msg)
+	return m.Sum(nil)
+}
+
+// scramAttributes splits a SCRAM message into its single letter attributes
+func scramAttributes(msg string) map[byte]string {
+	attrs := map[byte]string{}
+	for _, v := range strings.Split(msg, ",") {
+		if len(v) >= 2 && v[1] == '=' {
+			attrs[v[0]] = v[2:]
+		}
+	}
+	return attrs
+}
+
+// scramName escapes the comma and equals characters of a user name
+func scramName(v string) string {
+	return strings.NewReplacer(`=`, `=3D`, `,`, `=2C`).Replace(v)
+}
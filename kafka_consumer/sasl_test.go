@@ -0,0 +1,106 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/Shopify/sarama"
+)
+
+// TestScramSHA256 runs the example exchange from RFC 7677 section 3
+func TestScramSHA256(t *testing.T) {
+	sc := &scramClient{hash: sha256.New, nonce: `rOprNGfwEbeRWgbNEkqO`}
+	if err := sc.Begin(`user`, `pencil`, ``); err != nil {
+		t.Fatal(err)
+	}
+	steps := []struct {
+		challenge, resp string
+	}{
+		{``, `n,,n=user,r=rOprNGfwEbeRWgbNEkqO`},
+		{`r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096`,
+			`c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=`},
+		{`v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=`, ``},
+	}
+	for i, s := range steps {
+		if sc.Done() {
+			t.Fatalf("exchange done early at step %d", i)
+		}
+		resp, err := sc.Step(s.challenge)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		} else if resp != s.resp {
+			t.Fatalf("step %d: bad response\n%s\n%s", i, resp, s.resp)
+		}
+	}
+	if !sc.Done() {
+		t.Fatal("exchange not done")
+	}
+}
+
+func TestScramBadServer(t *testing.T) {
+	sc := &scramClient{hash: sha256.New, nonce: `rOprNGfwEbeRWgbNEkqO`}
+	sc.Begin(`user`, `pencil`, ``)
+	sc.Step(``)
+	if _, err := sc.Step(`r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096`); err != errScramServerNonce {
+		t.Fatalf("bad nonce not caught: %v", err)
+	}
+	sc = &scramClient{hash: sha256.New, nonce: `rOprNGfwEbeRWgbNEkqO`}
+	sc.Begin(`user`, `pencil`, ``)
+	sc.Step(``)
+	sc.Step(`r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096`)
+	if _, err := sc.Step(`v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=`); err != errScramServerSignature {
+		t.Fatalf("bad server signature not caught: %v", err)
+	} else if sc.Done() {
+		t.Fatal("exchange done after a bad server signature")
+	}
+}
+
+func TestSASLConfig(t *testing.T) {
+	sc, err := ConfigConsumer{SASL_Mechanism: `SCRAM-SHA-512`, SASL_User: `user`, SASL_Password: `pass`}.saslConfig()
+	if err != nil {
+		t.Fatal(err)
+	} else if sc.mechanism != sarama.SASLTypeSCRAMSHA512 {
+		t.Fatalf("bad mechanism %v", sc.mechanism)
+	}
+	cfg := sarama.NewConfig()
+	sc.apply(cfg)
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	sc, err = ConfigConsumer{
+		SASL_Mechanism:           `oauthbearer`,
+		SASL_OAuth_Token_URL:     `https://auth.example.com/token`,
+		SASL_OAuth_Client_ID:     `id`,
+		SASL_OAuth_Client_Secret: `secret`,
+	}.saslConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = sarama.NewConfig()
+	sc.apply(cfg)
+	if err = cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if sc, err = (ConfigConsumer{}).saslConfig(); err != nil || sc != nil {
+		t.Fatalf("SASL enabled without a mechanism: %v %v", sc, err)
+	}
+
+	bad := []ConfigConsumer{
+		{SASL_Mechanism: `gssapi`, SASL_User: `user`, SASL_Password: `pass`},
+		{SASL_Mechanism: `plain`, SASL_User: `user`},
+		{SASL_Mechanism: `oauthbearer`, SASL_OAuth_Client_ID: `id`},
+		{SASL_User: `user`, SASL_Password: `pass`},
+	}
+	for _, v := range bad {
+		if _, err := v.saslConfig(); err == nil {
+			t.Fatalf("Failed to catch bad SASL config %+v", v)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout       = 10 * time.Second
+	handshakeTimeout  = 30 * time.Second
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+	subscribeID       = 1
+)
+
+var (
+	ErrClientClosed = errors.New("client closed")
+)
+
+// mqttClient keeps a connection to a broker with the topic filters subscribed, it reconnects
+// with a backoff whenever the connection fails.  QoS 1 and 2 messages are acknowledged once
+// handle has returned, a message handle fails on is not acknowledged and the connection is
+// dropped so the broker delivers it again.
+type mqttClient struct {
+	name   string
+	cfg    *brokerCfg
+	handle func(publish) error
+
+	mtx  sync.Mutex
+	conn net.Conn
+	wmtx sync.Mutex //serializes writes between the read loop and the pinger
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newMQTTClient(name string, cfg *brokerCfg, handle func(publish) error) *mqttClient {
+	return &mqttClient{
+		name:   name,
+		cfg:    cfg,
+		handle: handle,
+		done:   make(chan struct{}),
+	}
+}
+
+func (c *mqttClient) Start() {
+	c.wg.Add(1)
+	go c.run()
+}
+
+// Close sends a DISCONNECT, closes the connection, and waits for the client to exit
+func (c *mqttClient) Close() error {
+	c.mtx.Lock()
+	select {
+	case <-c.done:
+		c.mtx.Unlock()
+		return ErrClientClosed
+	default:
+	}
+	close(c.done)
+	if c.conn != nil {
+		c.write(c.conn, packet{typ: pktDisconnect})
+		c.conn.Close()
+	}
+	c.mtx.Unlock()
+	c.wg.Wait()
+	return nil
+}
+
+func (c *mqttClient) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+	}
+	return false
+}
+
+func (c *mqttClient) run() {
+	defer c.wg.Done()
+	delay := minReconnectDelay
+	for {
+		connected, err := c.session()
+		if c.closed() {
+			return
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		lg.Error("Connection to MQTT broker %s (%s) failed, reconnecting in %v: %v", c.name, c.cfg.addr, delay, err)
+		select {
+		case <-c.done:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (c *mqttClient) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: dialTimeout}
+	if c.cfg.tls != nil {
+		return tls.DialWithDialer(d, `tcp`, c.cfg.addr, c.cfg.tls)
+	}
+	return d.Dial(`tcp`, c.cfg.addr)
+}
+
+// setConn publishes the connection so Close can interrupt it, false means the client was
+// closed while dialing
+func (c *mqttClient) setConn(conn net.Conn) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed() {
+		return false
+	}
+	c.conn = conn
+	return true
+}
+
+func (c *mqttClient) clearConn() {
+	c.mtx.Lock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	c.mtx.Unlock()
+}
+
+func (c *mqttClient) write(conn net.Conn, p packet) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(handshakeTimeout))
+	_, err := conn.Write(p.encode())
+	return err
+}
+
+// session connects, subscribes, and reads from the broker until the connection fails, connected
+// is true if the broker accepted the connection
+func (c *mqttClient) session() (connected bool, err error) {
+	conn, err := c.dial()
+	if err != nil {
+		return
+	} else if !c.setConn(conn) {
+		conn.Close()
+		return false, ErrClientClosed
+	}
+	defer c.clearConn()
+
+	rdr := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	co := connectOptions{
+		version:      c.cfg.version,
+		clientID:     c.cfg.clientID,
+		username:     c.cfg.username,
+		password:     c.cfg.password,
+		cleanSession: c.cfg.cleanSession,
+		keepAlive:    uint16(c.cfg.keepAlive / time.Second),
+	}
+	if !co.cleanSession {
+		co.sessionExpiry = defaultSessionExpiry
+	}
+	if err = c.write(conn, connectPacket(co)); err != nil {
+		return
+	}
+	var p packet
+	if p, err = readPacket(rdr); err != nil {
+		return
+	}
+	var present bool
+	if present, err = parseConnack(p, c.cfg.version); err != nil {
+		return
+	}
+	connected = true
+	lg.Info("Connected to MQTT broker %s (%s), session present: %v", c.name, c.cfg.addr, present)
+
+	//the broker may deliver messages held for a persistent session before the SUBACK
+	if err = c.write(conn, subscribePacket(subscribeID, c.cfg.subs, c.cfg.version)); err != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.pinger(conn, stop)
+
+	qos2 := map[uint16]bool{} //QoS 2 messages handled but not yet released by the broker
+	for {
+		//the pinger keeps the broker talking, a silent broker is gone
+		conn.SetReadDeadline(time.Now().Add(c.cfg.keepAlive * 3 / 2))
+		if p, err = readPacket(rdr); err != nil {
+			return
+		}
+		switch p.typ {
+		case pktPublish:
+			err = c.handlePublish(conn, p, qos2)
+		case pktPubrel:
+			var id uint16
+			if id, err = packetID(p); err == nil {
+				delete(qos2, id)
+				err = c.write(conn, ackPacket(pktPubcomp, id))
+			}
+		case pktSuback:
+			err = c.checkSuback(p)
+		case pktPingresp:
+		case pktDisconnect:
+			err = errors.New("broker sent DISCONNECT")
+			if len(p.body) > 0 {
+				err = fmt.Errorf("broker sent DISCONNECT with reason code 0x%x", p.body[0])
+			}
+		default:
+			err = fmt.Errorf("unexpected packet type %d", p.typ)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *mqttClient) handlePublish(conn net.Conn, p packet, qos2 map[uint16]bool) error {
+	pub, err := parsePublish(p, c.cfg.version)
+	if err != nil {
+		return err
+	}
+	switch pub.qos {
+	case 0:
+		return c.handle(pub)
+	case 1:
+		if err = c.handle(pub); err != nil {
+			return err
+		}
+		return c.write(conn, ackPacket(pktPuback, pub.id))
+	}
+	//QoS 2 messages are redelivered until the PUBREC arrives, only handle them once
+	if !qos2[pub.id] {
+		if err = c.handle(pub); err != nil {
+			return err
+		}
+		qos2[pub.id] = true
+	}
+	return c.write(conn, ackPacket(pktPubrec, pub.id))
+}
+
+func (c *mqttClient) checkSuback(p packet) error {
+	id, codes, err := parseSuback(p, c.cfg.version)
+	if err != nil {
+		return err
+	} else if id != subscribeID || len(codes) != len(c.cfg.subs) {
+		return ErrMalformedPacket
+	}
+	for i, code := range codes {
+		s := c.cfg.subs[i]
+		if code >= 0x80 {
+			return fmt.Errorf("broker refused the subscription to %q with code 0x%x", s.filter, code)
+		} else if code < s.qos {
+			lg.Warn("MQTT broker %s granted QoS %d instead of %d for %q", c.name, code, s.qos, s.filter)
+		}
+	}
+	debugout("Subscribed to %d topic filters on %s\n", len(codes), c.name)
+	return nil
+}
+
+// pinger sends a PINGREQ at half the keepalive interval, a failed write surfaces as a read error
+func (c *mqttClient) pinger(conn net.Conn, stop chan struct{}) {
+	tkr := time.NewTicker(c.cfg.keepAlive / 2)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tkr.C:
+			if err := c.write(conn, packet{typ: pktPingreq}); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
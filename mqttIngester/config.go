@@ -0,0 +1,367 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/config"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	MAX_CONFIG_SIZE  int64  = (1024 * 1024 * 2) //2MB, even this is crazy large
+	defaultPort      uint16 = 1883
+	defaultTLSPort   uint16 = 8883
+	defaultKeepAlive        = 30 * time.Second
+	minKeepAlive            = 5 * time.Second
+	maxKeepAlive            = 65535 * time.Second
+	//how long a v5 broker keeps the session of a disconnected client that is not using clean sessions
+	defaultSessionExpiry uint32 = 24 * 60 * 60
+)
+
+var (
+	ErrMissingBroker      = errors.New("Broker is required")
+	ErrMissingTopic       = errors.New("at least one Topic is required")
+	ErrInvalidTopic       = errors.New("invalid topic filter")
+	ErrInvalidQoS         = errors.New("QoS must be 0, 1, or 2")
+	ErrInvalidVersion     = errors.New("Protocol-Version must be 3.1.1 or 5")
+	ErrInvalidKeepAlive   = fmt.Errorf("Keep-Alive must be a duration between %v and %v", minKeepAlive, maxKeepAlive)
+	ErrInvalidTopicTag    = errors.New("Topic-Tag must be of the form filter:tag")
+	ErrPasswordNoUsername = errors.New("Password requires a Username")
+	ErrTLSOptionsNoTLS    = errors.New("TLS options require Use-TLS=true")
+	ErrTLSCertKeyMissing  = errors.New("TLS-Cert-File and TLS-Key-File must be given together")
+)
+
+type ConfigBroker struct {
+	Tag_Name           string
+	Broker             string //host:port, the port defaults to 1883 or 8883 with TLS
+	Protocol_Version   string //3.1.1 or 5
+	Client_ID          string //defaults to gravwell-<hostname>-<broker name>
+	Username           string
+	Password           string
+	Persistent_Session bool     //the broker keeps QoS 1 and 2 messages while the ingester is disconnected
+	Keep_Alive         string   //interval of keepalive pings, defaults to 30s
+	Topic              []string //topic filter, may contain + and # wildcards and be given multiple times
+	QoS                int      //QoS requested for every Topic, 0 (the default), 1, or 2
+	Topic_Tag          []string //filter:tag, messages on topics matching the filter go to the tag instead of Tag-Name
+	Source_Override    string
+
+	Use_TLS                  bool
+	Insecure_Skip_TLS_Verify bool
+	TLS_CA_File              string //CA bundle used to verify the broker, the system pool is used if empty
+	TLS_Cert_File            string //client certificate for brokers that require TLS client authentication
+	TLS_Key_File             string
+
+	Extract_Timestamps        bool //MQTT messages carry no timestamp, use timegrinder instead of the receive time
+	Assume_Local_Timezone     bool
+	Timezone_Override         string
+	Timestamp_Format_Override string //override the timestamp format
+	Preprocessor              []string
+}
+
+type topicTag struct {
+	filter string
+	tag    string
+}
+
+type brokerCfg struct {
+	tag          string
+	addr         string
+	version      byte
+	clientID     string
+	username     string
+	password     string
+	cleanSession bool
+	keepAlive    time.Duration
+	subs         []subscription
+	topicTags    []topicTag //in configuration order, the first matching filter wins
+	srcOverride  net.IP
+	tls          *tls.Config
+	tg           *timegrinder.TimeGrinder
+	preprocessor []string
+}
+
+type cfgReadType struct {
+	Global       config.IngestConfig
+	Broker       map[string]*ConfigBroker
+	Preprocessor processors.ProcessorConfig
+}
+
+type cfgType struct {
+	config.IngestConfig
+	Brokers      map[string]*brokerCfg
+	Preprocessor processors.ProcessorConfig
+}
+
+func GetConfig(path string) (*cfgType, error) {
+	var cr cfgReadType
+	if err := config.LoadConfigFile(&cr, path); err != nil {
+		return nil, err
+	}
+	//validate the global params
+	if err := cr.Global.Verify(); err != nil {
+		return nil, err
+	} else if len(cr.Broker) == 0 {
+		return nil, errors.New("no brokers defined")
+	} else if err := cr.Preprocessor.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &cfgType{
+		IngestConfig: cr.Global,
+		Brokers:      make(map[string]*brokerCfg, len(cr.Broker)),
+		Preprocessor: cr.Preprocessor,
+	}
+	for k, v := range cr.Broker {
+		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
+			return nil, fmt.Errorf("Broker %s preprocessor invalid: %v", k, err)
+		}
+		bc, err := v.validateAndProcess(k)
+		if err != nil {
+			return nil, fmt.Errorf("Broker %s: %v", k, err)
+		}
+		c.Brokers[k] = &bc
+	}
+	return c, nil
+}
+
+func (c *cfgType) Tags() (tags []string, err error) {
+	tagMp := make(map[string]bool, len(c.Brokers))
+	add := func(tag string) {
+		if _, ok := tagMp[tag]; !ok {
+			tags = append(tags, tag)
+			tagMp[tag] = true
+		}
+	}
+	for _, v := range c.Brokers {
+		add(v.tag)
+		for _, tt := range v.topicTags {
+			add(tt.tag)
+		}
+	}
+	if len(tags) == 0 {
+		err = errors.New("No tags specified")
+	} else {
+		sort.Strings(tags)
+	}
+	return
+}
+
+func (cb ConfigBroker) validateAndProcess(name string) (c brokerCfg, err error) {
+	if len(cb.Tag_Name) == 0 {
+		err = errors.New("missing tag name")
+		return
+	} else if err = ingest.CheckTag(cb.Tag_Name); err != nil {
+		return
+	}
+	c.tag = cb.Tag_Name
+
+	if cb.Broker = strings.TrimSpace(cb.Broker); cb.Broker == `` {
+		err = ErrMissingBroker
+		return
+	}
+	port := defaultPort
+	if cb.Use_TLS {
+		port = defaultTLSPort
+	}
+	c.addr = config.AppendDefaultPort(cb.Broker, port)
+	if _, _, err = net.SplitHostPort(c.addr); err != nil {
+		return
+	}
+
+	switch strings.TrimSpace(cb.Protocol_Version) {
+	case ``, `3.1.1`, `4`:
+		c.version = protocolV311
+	case `5`, `5.0`:
+		c.version = protocolV5
+	default:
+		err = ErrInvalidVersion
+		return
+	}
+
+	if cb.Password != `` && cb.Username == `` {
+		err = ErrPasswordNoUsername
+		return
+	}
+	c.username, c.password = cb.Username, cb.Password
+
+	c.cleanSession = !cb.Persistent_Session
+	if c.clientID = strings.TrimSpace(cb.Client_ID); c.clientID == `` {
+		c.clientID = defaultClientID(name)
+	}
+
+	if c.keepAlive, err = cb.keepAlive(); err != nil {
+		return
+	}
+
+	if cb.QoS < 0 || cb.QoS > 2 {
+		err = ErrInvalidQoS
+		return
+	}
+	for _, t := range cb.Topic {
+		if t = strings.TrimSpace(t); t == `` {
+			continue
+		} else if !validFilter(t) {
+			err = fmt.Errorf("%v %q", ErrInvalidTopic, t)
+			return
+		}
+		c.subs = append(c.subs, subscription{filter: t, qos: byte(cb.QoS)})
+	}
+	if len(c.subs) == 0 {
+		err = ErrMissingTopic
+		return
+	}
+	if c.topicTags, err = cb.parseTopicTags(); err != nil {
+		return
+	}
+	if c.tls, err = cb.tlsConfig(c.addr); err != nil {
+		return
+	}
+
+	if len(cb.Source_Override) > 0 {
+		if c.srcOverride = net.ParseIP(cb.Source_Override); c.srcOverride == nil {
+			err = fmt.Errorf("Invalid source override %s", cb.Source_Override)
+			return
+		}
+	}
+
+	if cb.Timezone_Override != "" {
+		if cb.Assume_Local_Timezone {
+			err = fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same broker")
+			return
+		}
+		if _, err = time.LoadLocation(cb.Timezone_Override); err != nil {
+			err = fmt.Errorf("Invalid timezone override %v: %v", cb.Timezone_Override, err)
+			return
+		}
+	}
+	if cb.Extract_Timestamps {
+		tcfg := timegrinder.Config{
+			EnableLeftMostSeed: true,
+			FormatOverride:     cb.Timestamp_Format_Override,
+		}
+		if c.tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+			err = fmt.Errorf("Failed to generate new timegrinder: %v", err)
+			return
+		}
+		if cb.Assume_Local_Timezone {
+			c.tg.SetLocalTime()
+		}
+		if cb.Timezone_Override != `` {
+			if err = c.tg.SetTimezone(cb.Timezone_Override); err != nil {
+				err = fmt.Errorf("Failed to override timezone: %v", err)
+				return
+			}
+		}
+	}
+	c.preprocessor = cb.Preprocessor
+	return
+}
+
+func (cb ConfigBroker) keepAlive() (d time.Duration, err error) {
+	if cb.Keep_Alive == `` {
+		return defaultKeepAlive, nil
+	} else if d, err = time.ParseDuration(cb.Keep_Alive); err != nil || d < minKeepAlive || d > maxKeepAlive {
+		return 0, ErrInvalidKeepAlive
+	}
+	return
+}
+
+// defaultClientID builds a client ID that is unique per host and broker section, brokers
+// disconnect the older client when two connect with the same ID.  The ID is stable across
+// restarts so a persistent session is picked up again.
+func defaultClientID(name string) string {
+	host, err := os.Hostname()
+	if err != nil || host == `` {
+		host = `ingester`
+	}
+	return fmt.Sprintf("gravwell-%s-%s", host, name)
+}
+
+// parseTopicTags checks the filter:tag overrides, tags cannot contain a colon so the last one
+// separates the filter
+func (cb ConfigBroker) parseTopicTags() (tts []topicTag, err error) {
+	for _, v := range cb.Topic_Tag {
+		idx := strings.LastIndex(v, ":")
+		if idx <= 0 {
+			return nil, ErrInvalidTopicTag
+		}
+		tt := topicTag{
+			filter: strings.TrimSpace(v[:idx]),
+			tag:    strings.TrimSpace(v[idx+1:]),
+		}
+		if tt.filter == `` || tt.tag == `` {
+			return nil, ErrInvalidTopicTag
+		} else if !validFilter(tt.filter) {
+			return nil, fmt.Errorf("%v %q in Topic-Tag", ErrInvalidTopic, tt.filter)
+		} else if err = ingest.CheckTag(tt.tag); err != nil {
+			return nil, fmt.Errorf("Invalid Topic-Tag tag %q: %v", tt.tag, err)
+		}
+		tts = append(tts, tt)
+	}
+	return
+}
+
+// tlsConfig builds the TLS configuration for the broker connection, nil when TLS is not enabled
+func (cb ConfigBroker) tlsConfig(addr string) (tc *tls.Config, err error) {
+	if !cb.Use_TLS {
+		if cb.Insecure_Skip_TLS_Verify || cb.TLS_CA_File != `` || cb.TLS_Cert_File != `` || cb.TLS_Key_File != `` {
+			err = ErrTLSOptionsNoTLS
+		}
+		return
+	}
+	tc = &tls.Config{
+		InsecureSkipVerify: cb.Insecure_Skip_TLS_Verify,
+	}
+	if host, _, lerr := net.SplitHostPort(addr); lerr == nil {
+		tc.ServerName = host
+	}
+	if cb.TLS_CA_File != `` {
+		var pem []byte
+		if pem, err = ioutil.ReadFile(cb.TLS_CA_File); err != nil {
+			return nil, fmt.Errorf("Failed to read TLS-CA-File: %v", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in TLS-CA-File %s", cb.TLS_CA_File)
+		}
+	}
+	if (cb.TLS_Cert_File == ``) != (cb.TLS_Key_File == ``) {
+		return nil, ErrTLSCertKeyMissing
+	} else if cb.TLS_Cert_File != `` {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(cb.TLS_Cert_File, cb.TLS_Key_File); err != nil {
+			return nil, fmt.Errorf("Failed to load TLS client certificate: %v", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return
+}
+
+// tagFor returns the tag for messages published on a topic
+func (c *brokerCfg) tagFor(topic string) string {
+	for _, tt := range c.topicTags {
+		if topicMatch(tt.filter, topic) {
+			return tt.tag
+		}
+	}
+	return c.tag
+}
@@ -0,0 +1,153 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gravwell/ingest/v3/log"
+)
+
+var (
+	tmpDir string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if tmpDir, err = ioutil.TempDir(os.TempDir(), `mqtt`); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create tempdir %v\n", err)
+		os.Exit(-1)
+	}
+	lg = log.NewDiscardLogger()
+	r := m.Run()
+	os.RemoveAll(tmpDir)
+	os.Exit(r)
+}
+
+func writeConfig(t *testing.T, s string) string {
+	fout, err := ioutil.TempFile(tmpDir, `cfg`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	if _, err = fout.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	return fout.Name()
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := GetConfig(writeConfig(t, baseConfig))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cfg.Brokers) != 2 {
+		t.Fatalf("invalid broker count %d", len(cfg.Brokers))
+	}
+	if tags, err := cfg.Tags(); err != nil {
+		t.Fatal(err)
+	} else if len(tags) != 4 {
+		t.Fatalf("invalid tags %v", tags)
+	}
+
+	bc := cfg.Brokers[`iot`]
+	if bc.addr != `broker.example.com:8883` || bc.version != protocolV5 || bc.tls == nil {
+		t.Fatalf("bad broker config %+v", bc)
+	} else if bc.cleanSession || bc.clientID != `gravwell-iot` || bc.tg == nil {
+		t.Fatalf("bad session config %+v", bc)
+	} else if len(bc.subs) != 2 || bc.subs[1].filter != `factory/+/power` || bc.subs[1].qos != 1 {
+		t.Fatalf("bad subscriptions %+v", bc.subs)
+	}
+	for topic, tag := range map[string]string{
+		`sensors/temp/1`:   `temperature`,
+		`sensors/hum/1`:    `sensors`,
+		`factory/a/power`:  `power`,
+		`factory/a/status`: `iot`,
+	} {
+		if r := bc.tagFor(topic); r != tag {
+			t.Errorf("topic %s went to %s instead of %s", topic, r, tag)
+		}
+	}
+
+	bc = cfg.Brokers[`local`]
+	if bc.addr != `127.0.0.1:1883` || bc.version != protocolV311 || bc.tls != nil || !bc.cleanSession {
+		t.Fatalf("bad broker config %+v", bc)
+	} else if bc.keepAlive != defaultKeepAlive || bc.clientID == `` {
+		t.Fatalf("bad defaults %+v", bc)
+	}
+}
+
+func TestBadConfigs(t *testing.T) {
+	for _, b := range []string{
+		`Topic=a`,
+		`Broker=127.0.0.1
+		Topic=a
+		QoS=3`,
+		`Broker=127.0.0.1
+		Topic="a/#/b"`,
+		`Broker=127.0.0.1
+		Topic=a
+		Protocol-Version=3.1`,
+		`Broker=127.0.0.1
+		Topic=a
+		Keep-Alive=1s`,
+		`Broker=127.0.0.1
+		Topic=a
+		Topic-Tag=a`,
+		`Broker=127.0.0.1
+		Topic=a
+		Password=pass`,
+		`Broker=127.0.0.1
+		Topic=a
+		TLS-CA-File=/tmp/ca.pem`,
+	} {
+		if _, err := GetConfig(writeConfig(t, badBase+b)); err == nil {
+			t.Errorf("bad config accepted: %s", b)
+		}
+	}
+}
+
+const baseConfig = `
+[Global]
+Ingest-Secret = IngestSecrets
+Connection-Timeout = 0
+Cleartext-Backend-Target=127.0.0.1:4023
+
+[Broker "iot"]
+	Broker=broker.example.com
+	Protocol-Version=5
+	Client-ID=gravwell-iot
+	Username=gravwell
+	Password=secret
+	Persistent-Session=true
+	Tag-Name=iot
+	Topic="sensors/#"
+	Topic=factory/+/power
+	QoS=1
+	Topic-Tag="sensors/temp/#:temperature"
+	Topic-Tag="sensors/#:sensors"
+	Topic-Tag=factory/+/power:power
+	Use-TLS=true
+	Extract-Timestamps=true
+
+[Broker "local"]
+	Broker=127.0.0.1
+	Tag-Name=iot
+	Topic="#"
+`
+
+const badBase = `
+[Global]
+Ingest-Secret = IngestSecrets
+Cleartext-Backend-Target=127.0.0.1:4023
+
+[Broker "bad"]
+	Tag-Name=iot
+	`
@@ -0,0 +1,417 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MQTT control packet types
+const (
+	pktConnect    byte = 1
+	pktConnack    byte = 2
+	pktPublish    byte = 3
+	pktPuback     byte = 4
+	pktPubrec     byte = 5
+	pktPubrel     byte = 6
+	pktPubcomp    byte = 7
+	pktSubscribe  byte = 8
+	pktSuback     byte = 9
+	pktPingreq    byte = 12
+	pktPingresp   byte = 13
+	pktDisconnect byte = 14
+	protocolV311  byte = 4
+	protocolV5    byte = 5
+	maxPacketSize      = 16 * 1024 * 1024
+
+	//MQTT v5 properties used by the client
+	propSessionExpiry byte = 0x11
+	propMaxPacketSize byte = 0x27
+)
+
+var (
+	ErrMalformedPacket = errors.New("malformed MQTT packet")
+	ErrPacketTooLarge  = fmt.Errorf("MQTT packet is larger than %d bytes", maxPacketSize)
+)
+
+// packet is a raw MQTT control packet, body holds everything after the fixed header
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(rdr *bufio.Reader) (p packet, err error) {
+	var b byte
+	if b, err = rdr.ReadByte(); err != nil {
+		return
+	}
+	p.typ, p.flags = b>>4, b&0xf
+	var l int
+	if l, err = readVarint(rdr); err != nil {
+		return
+	} else if l > maxPacketSize {
+		err = ErrPacketTooLarge
+		return
+	}
+	p.body = make([]byte, l)
+	_, err = io.ReadFull(rdr, p.body)
+	return
+}
+
+func (p packet) encode() []byte {
+	b := []byte{p.typ<<4 | p.flags}
+	b = appendVarint(b, len(p.body))
+	return append(b, p.body...)
+}
+
+func readVarint(rdr io.ByteReader) (v int, err error) {
+	var mult uint
+	for i := 0; i < 4; i++ {
+		var b byte
+		if b, err = rdr.ReadByte(); err != nil {
+			return
+		}
+		v |= int(b&0x7f) << mult
+		if b&0x80 == 0 {
+			return
+		}
+		mult += 7
+	}
+	err = ErrMalformedPacket
+	return
+}
+
+func appendVarint(b []byte, v int) []byte {
+	for {
+		d := byte(v & 0x7f)
+		if v >>= 7; v > 0 {
+			d |= 0x80
+		}
+		if b = append(b, d); v == 0 {
+			return b
+		}
+	}
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// decoder walks the body of a packet, the first error sticks
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) uint8() (v byte) {
+	if d.err == nil && len(d.b) < 1 {
+		d.err = ErrMalformedPacket
+	}
+	if d.err != nil {
+		return
+	}
+	v, d.b = d.b[0], d.b[1:]
+	return
+}
+
+func (d *decoder) uint16() (v uint16) {
+	if d.err == nil && len(d.b) < 2 {
+		d.err = ErrMalformedPacket
+	}
+	if d.err != nil {
+		return
+	}
+	v, d.b = binary.BigEndian.Uint16(d.b), d.b[2:]
+	return
+}
+
+func (d *decoder) bytes(n int) (v []byte) {
+	if d.err == nil && (n < 0 || len(d.b) < n) {
+		d.err = ErrMalformedPacket
+	}
+	if d.err != nil {
+		return
+	}
+	v, d.b = d.b[:n], d.b[n:]
+	return
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(int(d.uint16())))
+}
+
+func (d *decoder) varint() (v int) {
+	if d.err != nil {
+		return
+	}
+	var mult uint
+	for i := 0; i < 4; i++ {
+		b := d.uint8()
+		if d.err != nil {
+			return
+		}
+		v |= int(b&0x7f) << mult
+		if b&0x80 == 0 {
+			return
+		}
+		mult += 7
+	}
+	d.err = ErrMalformedPacket
+	return
+}
+
+// skipProperties skips the properties of an MQTT v5 packet, the client does not use any of
+// the properties the broker sends
+func (d *decoder) skipProperties(version byte) {
+	if version >= protocolV5 {
+		d.bytes(d.varint())
+	}
+}
+
+type connectOptions struct {
+	version      byte
+	clientID     string
+	username     string
+	password     string
+	cleanSession bool
+	keepAlive    uint16 //seconds
+	//sessionExpiry is how long an MQTT v5 broker keeps a session that is not clean, MQTT 3.1.1
+	//brokers keep them until a clean session connects
+	sessionExpiry uint32
+}
+
+func connectPacket(o connectOptions) packet {
+	b := appendString(nil, `MQTT`)
+	b = append(b, o.version)
+	var flags byte
+	if o.username != `` {
+		flags |= 0x80
+	}
+	if o.password != `` {
+		flags |= 0x40
+	}
+	if o.cleanSession {
+		flags |= 0x02
+	}
+	b = append(b, flags)
+	b = appendUint16(b, o.keepAlive)
+	if o.version >= protocolV5 {
+		var props []byte
+		if !o.cleanSession && o.sessionExpiry > 0 {
+			props = appendUint32(append(props, propSessionExpiry), o.sessionExpiry)
+		}
+		props = appendUint32(append(props, propMaxPacketSize), maxPacketSize)
+		b = appendVarint(b, len(props))
+		b = append(b, props...)
+	}
+	b = appendString(b, o.clientID)
+	if o.username != `` {
+		b = appendString(b, o.username)
+	}
+	if o.password != `` {
+		b = appendString(b, o.password)
+	}
+	return packet{typ: pktConnect, body: b}
+}
+
+// parseConnack returns an error when the broker refused the connection
+func parseConnack(p packet, version byte) (sessionPresent bool, err error) {
+	if p.typ != pktConnack {
+		return false, fmt.Errorf("expected CONNACK, got packet type %d", p.typ)
+	}
+	d := decoder{b: p.body}
+	flags := d.uint8()
+	code := d.uint8()
+	d.skipProperties(version)
+	if d.err != nil {
+		return false, d.err
+	} else if code != 0 {
+		return false, fmt.Errorf("broker refused the connection: %s", connackReason(code, version))
+	}
+	return flags&0x01 != 0, nil
+}
+
+func connackReason(code, version byte) string {
+	if version < protocolV5 {
+		switch code {
+		case 1:
+			return `unacceptable protocol version`
+		case 2:
+			return `client identifier rejected`
+		case 3:
+			return `server unavailable`
+		case 4:
+			return `bad user name or password`
+		case 5:
+			return `not authorized`
+		}
+	} else {
+		switch code {
+		case 0x84:
+			return `unsupported protocol version`
+		case 0x85:
+			return `client identifier not valid`
+		case 0x86:
+			return `bad user name or password`
+		case 0x87:
+			return `not authorized`
+		case 0x88:
+			return `server unavailable`
+		case 0x89:
+			return `server busy`
+		case 0x8a:
+			return `banned`
+		}
+	}
+	return fmt.Sprintf("reason code 0x%x", code)
+}
+
+type subscription struct {
+	filter string
+	qos    byte
+}
+
+func subscribePacket(id uint16, subs []subscription, version byte) packet {
+	b := appendUint16(nil, id)
+	if version >= protocolV5 {
+		b = append(b, 0) //no properties
+	}
+	for _, s := range subs {
+		b = appendString(b, s.filter)
+		b = append(b, s.qos)
+	}
+	return packet{typ: pktSubscribe, flags: 0x2, body: b}
+}
+
+// parseSuback returns the granted QoS of each subscription, codes of 0x80 and above are refusals
+func parseSuback(p packet, version byte) (id uint16, codes []byte, err error) {
+	if p.typ != pktSuback {
+		err = fmt.Errorf("expected SUBACK, got packet type %d", p.typ)
+		return
+	}
+	d := decoder{b: p.body}
+	id = d.uint16()
+	d.skipProperties(version)
+	codes = d.b
+	err = d.err
+	return
+}
+
+type publish struct {
+	topic   string
+	qos     byte
+	dup     bool
+	retain  bool
+	id      uint16
+	payload []byte
+}
+
+func parsePublish(p packet, version byte) (pub publish, err error) {
+	pub.dup = p.flags&0x8 != 0
+	pub.qos = (p.flags >> 1) & 0x3
+	pub.retain = p.flags&0x1 != 0
+	if pub.qos > 2 {
+		err = ErrMalformedPacket
+		return
+	}
+	d := decoder{b: p.body}
+	pub.topic = d.string()
+	if pub.qos > 0 {
+		pub.id = d.uint16()
+	}
+	d.skipProperties(version)
+	pub.payload = d.b
+	err = d.err
+	return
+}
+
+func publishPacket(pub publish, version byte) packet {
+	flags := pub.qos << 1
+	if pub.dup {
+		flags |= 0x8
+	}
+	if pub.retain {
+		flags |= 0x1
+	}
+	b := appendString(nil, pub.topic)
+	if pub.qos > 0 {
+		b = appendUint16(b, pub.id)
+	}
+	if version >= protocolV5 {
+		b = append(b, 0)
+	}
+	return packet{typ: pktPublish, flags: flags, body: append(b, pub.payload...)}
+}
+
+// ackPacket builds PUBACK, PUBREC, PUBREL, and PUBCOMP packets, a v5 packet without a reason
+// code or properties means success
+func ackPacket(typ byte, id uint16) packet {
+	p := packet{typ: typ, body: appendUint16(nil, id)}
+	if typ == pktPubrel {
+		p.flags = 0x2
+	}
+	return p
+}
+
+func packetID(p packet) (uint16, error) {
+	d := decoder{b: p.body}
+	id := d.uint16()
+	return id, d.err
+}
+
+// topicMatch reports whether a topic matches a subscription filter with + and # wildcards.
+// Topics starting with $ are only matched by filters that start with the same level.
+func topicMatch(filter, topic string) bool {
+	if strings.HasPrefix(topic, `$`) && (strings.HasPrefix(filter, `+`) || strings.HasPrefix(filter, `#`)) {
+		return false
+	}
+	fl := strings.Split(filter, `/`)
+	tl := strings.Split(topic, `/`)
+	for i, f := range fl {
+		if f == `#` {
+			return i == len(fl)-1
+		} else if i >= len(tl) {
+			return false
+		} else if f != `+` && f != tl[i] {
+			return false
+		}
+	}
+	return len(fl) == len(tl)
+}
+
+// validFilter checks the wildcards of a subscription filter
+func validFilter(filter string) bool {
+	if filter == `` || len(filter) > 65535 {
+		return false
+	}
+	levels := strings.Split(filter, `/`)
+	for i, l := range levels {
+		if strings.Contains(l, `#`) && (l != `#` || i != len(levels)-1) {
+			return false
+		} else if strings.Contains(l, `+`) && l != `+` {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,231 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVarint(t *testing.T) {
+	for _, v := range []int{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		b := appendVarint(nil, v)
+		if r, err := readVarint(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		} else if r != v {
+			t.Fatalf("varint mismatch: %d != %d", r, v)
+		}
+	}
+	if _, err := readVarint(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x01})); err != ErrMalformedPacket {
+		t.Fatalf("five byte varint not rejected: %v", err)
+	}
+}
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{`sensors/temp`, `sensors/temp`, true},
+		{`sensors/temp`, `sensors/humidity`, false},
+		{`sensors/+`, `sensors/temp`, true},
+		{`sensors/+`, `sensors/temp/1`, false},
+		{`sensors/+/1`, `sensors/temp/1`, true},
+		{`sensors/#`, `sensors`, true},
+		{`sensors/#`, `sensors/temp/1`, true},
+		{`#`, `sensors/temp`, true},
+		{`+/+`, `/temp`, true},
+		{`#`, `$SYS/broker/uptime`, false},
+		{`+/broker/uptime`, `$SYS/broker/uptime`, false},
+		{`$SYS/#`, `$SYS/broker/uptime`, true},
+	}
+	for _, tt := range tests {
+		if topicMatch(tt.filter, tt.topic) != tt.match {
+			t.Errorf("%q matching %q != %v", tt.filter, tt.topic, tt.match)
+		}
+	}
+	for _, f := range []string{`a/#/b`, `a/b#`, `a+/b`, ``} {
+		if validFilter(f) {
+			t.Errorf("invalid filter %q accepted", f)
+		}
+	}
+}
+
+func TestPublishRoundTrip(t *testing.T) {
+	for _, ver := range []byte{protocolV311, protocolV5} {
+		pub := publish{topic: `a/b`, qos: 2, dup: true, id: 77, payload: []byte(`payload`)}
+		p, err := readPacket(bufio.NewReader(bytes.NewReader(publishPacket(pub, ver).encode())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := parsePublish(p, ver)
+		if err != nil {
+			t.Fatal(err)
+		} else if r.topic != pub.topic || r.qos != pub.qos || !r.dup || r.retain || r.id != pub.id || !bytes.Equal(r.payload, pub.payload) {
+			t.Fatalf("bad publish round trip: %+v", r)
+		}
+	}
+}
+
+// fakeBroker accepts a single client and hands the test the packets it reads
+type fakeBroker struct {
+	t    *testing.T
+	lst  net.Listener
+	conn net.Conn
+	rdr  *bufio.Reader
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	lst, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeBroker{t: t, lst: lst}
+}
+
+func (fb *fakeBroker) accept() {
+	var err error
+	if fb.conn, err = fb.lst.Accept(); err != nil {
+		fb.t.Fatal(err)
+	}
+	fb.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fb.rdr = bufio.NewReader(fb.conn)
+}
+
+func (fb *fakeBroker) read(typ byte) packet {
+	for {
+		p, err := readPacket(fb.rdr)
+		if err != nil {
+			fb.t.Fatal(err)
+		} else if p.typ == pktPingreq {
+			fb.send(packet{typ: pktPingresp})
+			continue
+		} else if p.typ != typ {
+			fb.t.Fatalf("expected packet type %d, got %d", typ, p.typ)
+		}
+		return p
+	}
+}
+
+func (fb *fakeBroker) send(p packet) {
+	if _, err := fb.conn.Write(p.encode()); err != nil {
+		fb.t.Fatal(err)
+	}
+}
+
+func (fb *fakeBroker) close() {
+	if fb.conn != nil {
+		fb.conn.Close()
+	}
+	fb.lst.Close()
+}
+
+func TestClientSession(t *testing.T) {
+	for _, ver := range []byte{protocolV311, protocolV5} {
+		testClientSession(t, ver)
+	}
+}
+
+func testClientSession(t *testing.T, ver byte) {
+	fb := newFakeBroker(t)
+	defer fb.close()
+	cfg := &brokerCfg{
+		addr:         fb.lst.Addr().String(),
+		version:      ver,
+		clientID:     `test`,
+		username:     `user`,
+		password:     `pass`,
+		cleanSession: true,
+		keepAlive:    time.Minute,
+		subs:         []subscription{{filter: `sensors/#`, qos: 2}},
+	}
+	got := make(chan publish, 8)
+	c := newMQTTClient(`test`, cfg, func(pub publish) error {
+		got <- pub
+		return nil
+	})
+	c.Start()
+	defer c.Close()
+	fb.accept()
+
+	p := fb.read(pktConnect)
+	d := decoder{b: p.body}
+	if name := d.string(); name != `MQTT` {
+		t.Fatalf("bad protocol name %q", name)
+	} else if level := d.uint8(); level != ver {
+		t.Fatalf("bad protocol level %d", level)
+	} else if flags := d.uint8(); flags != 0xc2 {
+		t.Fatalf("bad connect flags 0x%x", flags)
+	}
+	connack := []byte{0, 0}
+	if ver >= protocolV5 {
+		connack = append(connack, 0)
+	}
+	fb.send(packet{typ: pktConnack, body: connack})
+
+	p = fb.read(pktSubscribe)
+	if id, _ := packetID(p); id != subscribeID {
+		t.Fatalf("bad subscribe packet ID %d", id)
+	}
+	suback := appendUint16(nil, subscribeID)
+	if ver >= protocolV5 {
+		suback = append(suback, 0)
+	}
+	fb.send(packet{typ: pktSuback, body: append(suback, 2)})
+
+	//QoS 1 is acknowledged once handled
+	fb.send(publishPacket(publish{topic: `sensors/temp`, qos: 1, id: 10, payload: []byte(`21.5`)}, ver))
+	if pub := <-got; pub.topic != `sensors/temp` || string(pub.payload) != `21.5` {
+		t.Fatalf("bad message %+v", pub)
+	}
+	if id, _ := packetID(fb.read(pktPuback)); id != 10 {
+		t.Fatalf("bad PUBACK ID %d", id)
+	}
+
+	//a redelivered QoS 2 message is only handled once
+	pub := publish{topic: `sensors/hum`, qos: 2, id: 11, payload: []byte(`40`)}
+	fb.send(publishPacket(pub, ver))
+	fb.read(pktPubrec)
+	pub.dup = true
+	fb.send(publishPacket(pub, ver))
+	fb.read(pktPubrec)
+	fb.send(ackPacket(pktPubrel, 11))
+	if id, _ := packetID(fb.read(pktPubcomp)); id != 11 {
+		t.Fatalf("bad PUBCOMP ID %d", id)
+	}
+	if <-got; len(got) != 0 {
+		t.Fatalf("QoS 2 message handled %d times", len(got)+1)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fb.read(pktDisconnect)
+}
+
+func TestClientRefused(t *testing.T) {
+	fb := newFakeBroker(t)
+	defer fb.close()
+	c := newMQTTClient(`test`, &brokerCfg{
+		addr:      fb.lst.Addr().String(),
+		version:   protocolV311,
+		clientID:  `test`,
+		keepAlive: time.Minute,
+	}, nil)
+	go func() {
+		fb.accept()
+		fb.read(pktConnect)
+		fb.send(packet{typ: pktConnack, body: []byte{0, 5}})
+	}()
+	if connected, err := c.session(); connected || err == nil {
+		t.Fatalf("refused connection not reported: %v %v", connected, err)
+	}
+}
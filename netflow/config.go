@@ -10,6 +10,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"sort"
 	"strings"
@@ -30,7 +31,9 @@ const (
 	ipfixName string = `ipfix`
 )
 
-var ()
+var (
+	ErrTCPFlowType = errors.New("TCP Bind-Strings are only supported for the ipfix Flow-Type")
+)
 
 type flowType int
 
@@ -41,16 +44,24 @@ type collector struct {
 	Ignore_Timestamps     bool
 	Flow_Type             string
 	Session_Dump_Enabled  bool
+	Template_Cache        string   //file that IPFIX and Netflow v9 templates are saved to
+	Allowed_Exporter      []string //exporter IPs or CIDRs accepted by the collector, all are accepted if empty
+	Output_Format         string   //native or json, json renders each flow record as a normalized JSON entry
+	Bidirectional_Flows   bool     //merge the two directions of a conversation into one record
+	Bidirectional_Timeout string   //how long a record waits for its reverse direction
+	Dedup_Window          string   //drop records of a flow already exported by another router within this window
 }
 
 type cfgReadType struct {
 	Global    config.IngestConfig
 	Collector map[string]*collector
+	Exporter  map[string]*exporter
 }
 
 type cfgType struct {
 	config.IngestConfig
 	Collector map[string]*collector
+	Exporter  map[string]*exporter
 }
 
 func GetConfig(path string) (*cfgType, error) {
@@ -83,6 +94,7 @@ func GetConfig(path string) (*cfgType, error) {
 	c := &cfgType{
 		IngestConfig: cr.Global,
 		Collector:    cr.Collector,
+		Exporter:     cr.Exporter,
 	}
 
 	if err := verifyConfig(c); err != nil {
@@ -120,10 +132,36 @@ func verifyConfig(c *cfgType) error {
 		if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
 			return errors.New("Invalid characters in the Tag-Name for " + k)
 		}
+		tcp, _, err := translateBindString(v.Bind_String)
+		if err != nil {
+			return fmt.Errorf("Invalid Bind-String for %s: %v", k, err)
+		}
+		if ft, err := translateFlowType(v.Flow_Type); err != nil {
+			return fmt.Errorf("Invalid Flow-Type for %s: %v", k, err)
+		} else if tcp && ft != ipfixType {
+			return fmt.Errorf("%s: %v", k, ErrTCPFlowType)
+		}
+		if _, err := translateOutputFormat(v.Output_Format); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
+		if _, err := v.stitchOptions(); err != nil {
+			return fmt.Errorf("%s: %v", k, err)
+		}
 		if n, ok := bindMp[v.Bind_String]; ok {
 			return errors.New("Bind-String for " + k + " already in use by " + n)
 		}
 		bindMp[v.Bind_String] = k
+		if _, err := parseNets(v.Allowed_Exporter); err != nil {
+			return fmt.Errorf("Invalid Allowed-Exporter for %s: %v", k, err)
+		}
+	}
+	for k, v := range c.Exporter {
+		if v == nil {
+			return errors.New("Invalid exporter named " + k)
+		}
+		if err := v.verify(c.Collector); err != nil {
+			return fmt.Errorf("Exporter %s: %v", k, err)
+		}
 	}
 	return nil
 }
@@ -140,6 +178,15 @@ func (c *cfgType) Tags() ([]string, error) {
 			tagMp[v.Tag_Name] = true
 		}
 	}
+	for _, v := range c.Exporter {
+		if len(v.Tag_Name) == 0 {
+			continue
+		}
+		if _, ok := tagMp[v.Tag_Name]; !ok {
+			tags = append(tags, v.Tag_Name)
+			tagMp[v.Tag_Name] = true
+		}
+	}
 	if len(tags) == 0 {
 		return nil, errors.New("No tags specified")
 	}
@@ -171,3 +218,19 @@ func translateFlowType(s string) (flowType, error) {
 	}
 	return -1, errors.New("invalid reader type")
 }
+
+// translateBindString splits an optional udp:// or tcp:// protocol off of the Bind-String,
+// flows are received over UDP unless TCP is requested
+func translateBindString(s string) (tcp bool, addr string, err error) {
+	bits := strings.SplitN(s, "://", 2)
+	if len(bits) != 2 {
+		return false, s, nil
+	}
+	switch strings.ToLower(bits[0]) {
+	case `udp`:
+		return false, bits[1], nil
+	case `tcp`:
+		return true, bits[1], nil
+	}
+	return false, ``, errors.New("invalid bind protocol specifier of " + bits[0])
+}
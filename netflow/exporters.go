@@ -0,0 +1,179 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingesters/v3/utils"
+)
+
+const (
+	maxRejectedExporters = 1024
+)
+
+var (
+	ErrNoExporterAddress = errors.New("Exporter sections require at least one Address")
+	ErrNoExporterOptions = errors.New("Exporter sections require a Tag-Name or Source-Override")
+)
+
+// exporter maps one or more exporter addresses to a dedicated tag and source,
+// an empty Collector applies the exporter to every collector
+type exporter struct {
+	Address         []string //exporter IP or CIDR, may be given multiple times
+	Collector       string   //collector the exporter sends to, all collectors if empty
+	Tag_Name        string   //tag for flows from the exporter, defaults to the collector tag
+	Source_Override string   //source for flows from the exporter, defaults to the Source-Override or the exporter IP
+}
+
+// parseNets parses a list of IP addresses and CIDR networks, bare addresses match only themselves
+func parseNets(vals []string) (nets []*net.IPNet, err error) {
+	for _, v := range vals {
+		v = strings.TrimSpace(v)
+		if strings.Contains(v, "/") {
+			var n *net.IPNet
+			if _, n, err = net.ParseCIDR(v); err != nil {
+				return nil, fmt.Errorf("Invalid network %q", v)
+			}
+			nets = append(nets, n)
+			continue
+		}
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid address %q", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return
+}
+
+func (e *exporter) verify(collectors map[string]*collector) error {
+	if len(e.Address) == 0 {
+		return ErrNoExporterAddress
+	} else if _, err := parseNets(e.Address); err != nil {
+		return err
+	}
+	if e.Collector != `` {
+		if _, ok := collectors[e.Collector]; !ok {
+			return fmt.Errorf("Collector %q does not exist", e.Collector)
+		}
+	}
+	if e.Tag_Name == `` && e.Source_Override == `` {
+		return ErrNoExporterOptions
+	}
+	if strings.ContainsAny(e.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
+		return errors.New("Invalid characters in the Tag-Name")
+	}
+	if e.Source_Override != `` && net.ParseIP(e.Source_Override) == nil {
+		return errors.New("Invalid Source-Override")
+	}
+	return nil
+}
+
+// exporterRoute is a resolved exporter section
+type exporterRoute struct {
+	nets []*net.IPNet
+	tag  entry.EntryTag
+	src  net.IP
+}
+
+// exporterRoutes picks the tag and source for each exporter of a collector and drops
+// exporters that are not on the allowlist.  Routes are checked from the most specific
+// network to the least so a single router can be split out of a site wide network.
+type exporterRoutes struct {
+	allowed []*net.IPNet //empty allows every exporter
+	routes  []exporterRoute
+	tag     entry.EntryTag //collector tag
+	src     net.IP         //global Source-Override, nil uses the exporter IP
+
+	mtx      sync.Mutex
+	rejected map[string]bool //exporters that have been logged as rejected
+}
+
+// newExporterRoutes builds the routes for a collector from the exporter sections that apply to it
+func newExporterRoutes(name string, c *collector, exps map[string]*exporter, tag entry.EntryTag, src net.IP, getTag func(string) (entry.EntryTag, error)) (*exporterRoutes, error) {
+	er := &exporterRoutes{
+		tag: tag,
+		src: src,
+	}
+	var err error
+	if er.allowed, err = parseNets(c.Allowed_Exporter); err != nil {
+		return nil, err
+	}
+	for k, e := range exps {
+		if e.Collector != `` && e.Collector != name {
+			continue
+		}
+		rt := exporterRoute{tag: tag, src: src}
+		if rt.nets, err = parseNets(e.Address); err != nil {
+			return nil, fmt.Errorf("Exporter %s: %v", k, err)
+		}
+		if e.Tag_Name != `` {
+			if rt.tag, err = getTag(e.Tag_Name); err != nil {
+				return nil, fmt.Errorf("Failed to resolve tag %q for exporter %s: %v", e.Tag_Name, k, err)
+			}
+		}
+		if e.Source_Override != `` {
+			rt.src = utils.NormalizeSource(net.ParseIP(e.Source_Override))
+		}
+		er.routes = append(er.routes, rt)
+	}
+	return er, nil
+}
+
+// allow reports whether flows from the exporter are accepted, rejected exporters are logged once
+func (er *exporterRoutes) allow(ip net.IP) bool {
+	if len(er.allowed) == 0 {
+		return true
+	}
+	for _, n := range er.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	er.mtx.Lock()
+	if er.rejected == nil {
+		er.rejected = map[string]bool{}
+	}
+	if s := ip.String(); !er.rejected[s] && len(er.rejected) < maxRejectedExporters {
+		er.rejected[s] = true
+		lg.Warn("Dropping flows from %s, the exporter is not in Allowed-Exporter\n", s)
+	}
+	er.mtx.Unlock()
+	return false
+}
+
+// route returns the tag and source for flows from an exporter
+func (er *exporterRoutes) route(ip net.IP) (tag entry.EntryTag, src net.IP) {
+	tag, src = er.tag, er.src
+	best := -1
+	for _, rt := range er.routes {
+		for _, n := range rt.nets {
+			if ones, _ := n.Mask.Size(); ones > best && n.Contains(ip) {
+				best = ones
+				tag, src = rt.tag, rt.src
+			}
+		}
+	}
+	if src == nil {
+		//IPv4 exporters show up as IPv4-mapped addresses on dual stack sockets
+		src = utils.NormalizeSource(ip)
+	}
+	return
+}
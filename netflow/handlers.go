@@ -9,9 +9,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"time"
@@ -22,6 +24,11 @@ import (
 	"github.com/gravwell/netflow/v3"
 )
 
+const (
+	ipfixVersion   = 10
+	ipfixHeaderLen = 16
+)
+
 var (
 	ErrAlreadyListening = errors.New("Already listening")
 	ErrAlreadyClosed    = errors.New("Already closed")
@@ -57,6 +64,9 @@ func (n *NetflowV5Handler) Listen(s string) (err error) {
 		err = ErrAlreadyListening
 		return
 	}
+	if _, s, err = translateBindString(s); err != nil {
+		return
+	}
 	var a *net.UDPAddr
 	if a, err = net.ResolveUDPAddr("udp", s); err != nil {
 		return
@@ -74,6 +84,7 @@ func (n *NetflowV5Handler) Close() error {
 		return ErrAlreadyClosed
 	}
 	n.ready = false
+	n.stitcher.Close()
 	return n.c.Close()
 }
 
@@ -87,6 +98,7 @@ func (n *NetflowV5Handler) Start(id int) error {
 	if id < 0 {
 		return errors.New("invalid id")
 	}
+	n.stitcher.start()
 	go n.routine(id)
 	return nil
 }
@@ -104,6 +116,9 @@ func (n *NetflowV5Handler) routine(id int) {
 		if l, addr, err = n.c.ReadFromUDP(tbuff); err != nil {
 			return
 		}
+		if !n.exporters.allow(addr.IP) {
+			continue
+		}
 		if l, err = nf.ValidateSize(tbuff); err != nil {
 			continue //there isn't much we can do about bad packets...
 		}
@@ -114,9 +129,21 @@ func (n *NetflowV5Handler) routine(id int) {
 		} else {
 			ts = entry.UnixTime(int64(binary.BigEndian.Uint32(lbuff[8:12])), int64(binary.BigEndian.Uint32(lbuff[12:16])))
 		}
+		tag, src := n.exporters.route(addr.IP)
+		if n.jsonOutput {
+			if err = nf.Decode(lbuff); err != nil {
+				continue
+			}
+			for _, fr := range nfv5Records(&nf, addr.IP) {
+				for _, e := range n.stitcher.add(fr, tag, src, ts) {
+					n.ch <- e
+				}
+			}
+			continue
+		}
 		e := &entry.Entry{
-			Tag:  n.tag,
-			SRC:  addr.IP,
+			Tag:  tag,
+			SRC:  src,
 			TS:   ts,
 			Data: lbuff,
 		}
@@ -128,19 +155,28 @@ type IpfixHandler struct {
 	bindConfig
 	mtx   *sync.Mutex
 	c     *net.UDPConn
+	l     net.Listener //IPFIX over TCP
+	conns map[net.Conn]bool
 	ready bool
 	igst  *ingest.IngestMuxer
+	tmpls *templateStore
 }
 
 func NewIpfixHandler(c bindConfig, mux *ingest.IngestMuxer) (*IpfixHandler, error) {
 	if err := c.Validate(); err != nil {
 		return nil, err
 	}
+	tmpls, err := newTemplateStore(c.templateCache)
+	if err != nil {
+		return nil, err
+	}
 
 	return &IpfixHandler{
 		bindConfig: c,
 		mtx:        &sync.Mutex{},
+		conns:      map[net.Conn]bool{},
 		igst:       mux,
+		tmpls:      tmpls,
 	}, nil
 }
 
@@ -151,10 +187,20 @@ func (i *IpfixHandler) String() string {
 func (i *IpfixHandler) Listen(s string) (err error) {
 	i.mtx.Lock()
 	defer i.mtx.Unlock()
-	if i.c != nil {
+	if i.c != nil || i.l != nil {
 		err = ErrAlreadyListening
 		return
 	}
+	var tcp bool
+	if tcp, s, err = translateBindString(s); err != nil {
+		return
+	}
+	if tcp {
+		if i.l, err = net.Listen("tcp", s); err == nil {
+			i.ready = true
+		}
+		return
+	}
 	var a *net.UDPAddr
 	if a, err = net.ResolveUDPAddr("udp", s); err != nil {
 		return
@@ -172,20 +218,36 @@ func (i *IpfixHandler) Close() error {
 		return ErrAlreadyClosed
 	}
 	i.ready = false
+	i.stitcher.Close()
+	if err := i.tmpls.Close(); err != nil {
+		lg.Error("Failed to write template cache %s: %v\n", i.templateCache, err)
+	}
+	if i.l != nil {
+		for c := range i.conns {
+			c.Close()
+		}
+		return i.l.Close()
+	}
 	return i.c.Close()
 }
 
 func (i *IpfixHandler) Start(id int) error {
 	i.mtx.Lock()
 	defer i.mtx.Unlock()
-	if !i.ready || i.c == nil {
+	if !i.ready || (i.c == nil && i.l == nil) {
 		fmt.Println(i.ready, i.c)
 		return ErrNotReady
 	}
 	if id < 0 {
 		return errors.New("invalid id")
 	}
-	go i.routine(id)
+	i.tmpls.start()
+	i.stitcher.start()
+	if i.l != nil {
+		go i.acceptRoutine(id)
+	} else {
+		go i.routine(id)
+	}
 	return nil
 }
 
@@ -207,10 +269,26 @@ func getSessionKey(domain uint32, v net.IP) (k sessionKey) {
 }
 
 func (s *sessionKey) String() string {
-	if r := net.IP(s.ip[0:4]).To4(); r != nil {
-		return fmt.Sprintf("%v:%d", r, s.domain)
+	//IPv4 exporters are stored in the first 4 bytes with the rest zeroed
+	var zero [12]byte
+	if bytes.Equal(s.ip[4:], zero[:]) {
+		return fmt.Sprintf("%v:%d", net.IP(s.ip[0:4]), s.domain)
+	}
+	return fmt.Sprintf("[%v]:%d", net.IP(s.ip[:]), s.domain)
+}
+
+// ipfixSessions holds the template sessions for a listener, or for a single
+// connection when IPFIX is carried over TCP
+type ipfixSessions struct {
+	sessions map[sessionKey]*ipfix.Session
+	lastDump time.Time
+}
+
+func (i *IpfixHandler) newSessions() *ipfixSessions {
+	return &ipfixSessions{
+		sessions: make(map[sessionKey]*ipfix.Session),
+		lastDump: i.lastInfoDump,
 	}
-	return fmt.Sprintf("%v:%d", net.IP(s.ip[:]), s.domain)
 }
 
 func (i *IpfixHandler) routine(id int) {
@@ -218,15 +296,10 @@ func (i *IpfixHandler) routine(id int) {
 	defer delConn(id)
 
 	var l int
-	var ok bool
-	var s *ipfix.Session
 	var addr *net.UDPAddr
 	var err error
-	var ts entry.Timestamp
-	var version uint16
-	var domainID uint32
 
-	sessionMap := make(map[sessionKey]*ipfix.Session)
+	ss := i.newSessions()
 	tbuff := make([]byte, 65507) // just go with max UDP packet size
 	for {
 		if l, addr, err = i.c.ReadFromUDP(tbuff); err != nil {
@@ -234,88 +307,219 @@ func (i *IpfixHandler) routine(id int) {
 			return
 		}
 		debugout("%v got packet of length %v from %v\n", time.Now(), l, addr.IP)
+		if !i.exporters.allow(addr.IP) {
+			continue
+		}
+		for _, e := range i.handleMessage(ss, tbuff[:l], addr.IP) {
+			i.ch <- e
+		}
+	}
+}
 
-		// For each message received, we want to parse it, extract and attach
-		// any relevant but missing templates, then re-marshal it and ingest
-
-		// First, to figure out the appropriate Session, we extract the domain ID
-		// We do this manually for speed
-		// Grab the version so we know where to look
-		if l < 2 {
-			debugout("Message too short for IPFIX or Netflow v9, skipping\n")
+// acceptRoutine accepts IPFIX exporters over TCP, each connection is its own
+// transport session with its own templates as described in RFC 7011 section 10.4
+func (i *IpfixHandler) acceptRoutine(id int) {
+	defer i.wg.Done()
+	defer delConn(id)
+	var cwg sync.WaitGroup
+	defer cwg.Wait()
+	for {
+		c, err := i.l.Accept()
+		if err != nil {
+			debugout("Error in Accept: %v\n", err)
+			return
+		}
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && !i.exporters.allow(addr.IP) {
+			c.Close()
 			continue
 		}
-		version = binary.BigEndian.Uint16(tbuff[0:])
-		switch version {
-		case 9:
-			// netflow v9
-			// Make sure it's long enough, a netflow v9 message header is 20 bytes long
-			if l < 20 {
-				debugout("Message too short for Netflow v9, skipping\n")
-				continue
-			}
-			domainID = binary.BigEndian.Uint32(tbuff[16:])
-		case 10:
-			// ipfix
-			// Make sure it's long enough, a ipfix message header is 16 bytes long
-			if l < 16 {
-				debugout("Message too short for IPFIX, skipping\n")
-				continue
+		i.mtx.Lock()
+		if !i.ready {
+			i.mtx.Unlock()
+			c.Close()
+			return
+		}
+		i.conns[c] = true
+		i.mtx.Unlock()
+		cwg.Add(1)
+		go i.connRoutine(c, &cwg)
+	}
+}
+
+func (i *IpfixHandler) connRoutine(c net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer func() {
+		i.mtx.Lock()
+		delete(i.conns, c)
+		i.mtx.Unlock()
+		c.Close()
+	}()
+	var ip net.IP
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	debugout("Accepted IPFIX connection from %v\n", c.RemoteAddr())
+	ss := i.newSessions()
+	tbuff := make([]byte, 65535) // the IPFIX message length is 16 bits
+	for {
+		l, err := readIpfixMessage(c, tbuff)
+		if err != nil {
+			if err != io.EOF {
+				debugout("IPFIX connection from %v closed: %v\n", c.RemoteAddr(), err)
 			}
-			domainID = binary.BigEndian.Uint32(tbuff[12:])
+			return
+		}
+		for _, e := range i.handleMessage(ss, tbuff[:l], ip) {
+			i.ch <- e
 		}
+	}
+}
 
-		key := getSessionKey(domainID, addr.IP)
-		if s, ok = sessionMap[key]; !ok {
-			// if it's not in the map yet, we need to create a session
-			debugout("Creating new session for %v\n", key.String())
-			i.igst.Info("Creating new session for %v, domain ID %d", addr.IP, domainID)
-			s = ipfix.NewSession()
-			sessionMap[key] = s
+// readIpfixMessage reads a single message from an IPFIX stream using the length in the message header
+func readIpfixMessage(r io.Reader, buff []byte) (l int, err error) {
+	if _, err = io.ReadFull(r, buff[:ipfixHeaderLen]); err != nil {
+		return
+	}
+	if v := binary.BigEndian.Uint16(buff[0:]); v != ipfixVersion {
+		err = fmt.Errorf("invalid IPFIX version %d", v)
+		return
+	}
+	if l = int(binary.BigEndian.Uint16(buff[2:])); l < ipfixHeaderLen {
+		err = fmt.Errorf("invalid IPFIX message length %d", l)
+		return
+	}
+	_, err = io.ReadFull(r, buff[ipfixHeaderLen:l])
+	return
+}
+
+// handleMessage parses an IPFIX or Netflow v9 message, attaches any templates the message
+// needs so that each entry can be decoded on its own, and returns the entry.  When the
+// collector outputs JSON an entry is returned for each flow record instead.
+func (i *IpfixHandler) handleMessage(ss *ipfixSessions, buff []byte, ip net.IP) []*entry.Entry {
+	var s *ipfix.Session
+	var ok bool
+	var version uint16
+	var domainID uint32
+	l := len(buff)
+
+	// For each message received, we want to parse it, extract and attach
+	// any relevant but missing templates, then re-marshal it and ingest
+
+	// First, to figure out the appropriate Session, we extract the domain ID
+	// We do this manually for speed
+	// Grab the version so we know where to look
+	if l < 2 {
+		debugout("Message too short for IPFIX or Netflow v9, skipping\n")
+		return nil
+	}
+	version = binary.BigEndian.Uint16(buff[0:])
+	switch version {
+	case 9:
+		// netflow v9
+		// Make sure it's long enough, a netflow v9 message header is 20 bytes long
+		if l < 20 {
+			debugout("Message too short for Netflow v9, skipping\n")
+			return nil
 		}
+		domainID = binary.BigEndian.Uint32(buff[16:])
+	case ipfixVersion:
+		// ipfix
+		// Make sure it's long enough, a ipfix message header is 16 bytes long
+		if l < ipfixHeaderLen {
+			debugout("Message too short for IPFIX, skipping\n")
+			return nil
+		}
+		domainID = binary.BigEndian.Uint32(buff[12:])
+	}
 
-		if i.sessionDumpEnabled && time.Now().Sub(i.lastInfoDump) > 1*time.Hour {
-			for k, _ := range sessionMap {
-				i.igst.Info("IPFIX/Netflow v9 session dump: %v", k.String())
-			}
-			i.lastInfoDump = time.Now()
+	key := getSessionKey(domainID, ip)
+	if s, ok = ss.sessions[key]; !ok {
+		// if it's not in the map yet, we need to create a session
+		debugout("Creating new session for %v\n", key.String())
+		i.igst.Info("Creating new session for %v, domain ID %d", ip, domainID)
+		s = ipfix.NewSession()
+		ss.sessions[key] = s
+		if n := i.tmpls.restore(key, s); n > 0 {
+			debugout("Restored %d templates for %v\n", n, key.String())
 		}
+	}
 
-		msg, err := s.ParseBuffer(tbuff[:l])
-		if err != nil {
-			debugout("Rejecting packet: %v\n", err)
-			// must have been a bad packet
-			continue
+	if i.sessionDumpEnabled && time.Now().Sub(ss.lastDump) > 1*time.Hour {
+		for k, _ := range ss.sessions {
+			i.igst.Info("IPFIX/Netflow v9 session dump: %v", k.String())
 		}
+		ss.lastDump = time.Now()
+	}
 
-		// LookupTemplateRecords will fail if we haven't seen an appropriate
-		// template packet for this message yet. In that case, just pass along
-		// the original message, it's all we can do
-		var lbuff []byte
-		templates, err := s.LookupTemplateRecords(msg)
-		if err != nil || (len(msg.DataRecords) == 0 && len(msg.TemplateRecords) == 0) {
-			debugout("Failed to lookup template records for message, passing original (this is not necessarily an error)\n")
-			lbuff = make([]byte, l)
-			copy(lbuff, tbuff[0:l])
-		} else {
-			debugout("Attaching %d templates\n", len(templates))
-			msg.TemplateRecords = templates
-			lbuff, err = s.Marshal(msg)
-			if err != nil {
-				// if we fail to marshal, I guess just send along the original
-				debugout("Failed to marshal message, passing original\n")
-				lbuff = make([]byte, l)
-				copy(lbuff, tbuff[0:l])
-			}
+	// options templates must be registered before the message is parsed so the
+	// options data records in the same message can be decoded
+	opts := optionTemplates(buff)
+	if reg := definedTemplates(opts); len(reg) > 0 {
+		if err := registerTemplates(s, version, domainID, reg); err != nil {
+			debugout("Failed to register options templates: %v\n", err)
 		}
+	}
 
-		ts = entry.Now()
-		e := &entry.Entry{
-			Tag:  i.tag,
-			SRC:  addr.IP,
-			TS:   ts,
-			Data: lbuff,
+	msg, err := s.ParseBuffer(buff)
+	if err != nil {
+		debugout("Rejecting packet: %v\n", err)
+		// must have been a bad packet
+		return nil
+	}
+	if len(msg.TemplateRecords) > 0 || len(opts) > 0 {
+		i.tmpls.update(key, version, append(opts, msg.TemplateRecords...))
+	}
+
+	ts := entry.Now()
+	tag, src := i.exporters.route(ip)
+	if i.jsonOutput {
+		var ents []*entry.Entry
+		for _, fr := range ipfixRecords(s, &msg, ip) {
+			ents = append(ents, i.stitcher.add(fr, tag, src, ts)...)
+		}
+		return ents
+	}
+
+	// LookupTemplateRecords will fail if we haven't seen an appropriate
+	// template packet for this message yet. In that case, just pass along
+	// the original message, it's all we can do
+	var lbuff []byte
+	templates, err := s.LookupTemplateRecords(msg)
+	if err != nil || (len(msg.DataRecords) == 0 && len(msg.TemplateRecords) == 0) {
+		debugout("Failed to lookup template records for message, passing original (this is not necessarily an error)\n")
+	} else {
+		debugout("Attaching %d templates\n", len(templates))
+		msg.TemplateRecords = templates
+		// the marshaller returns an empty buffer rather than an error on some failures
+		if lbuff, err = s.Marshal(msg); err != nil || len(lbuff) == 0 {
+			// if we fail to marshal, I guess just send along the original
+			debugout("Failed to marshal message, passing original\n")
+			lbuff = nil
 		}
-		i.ch <- e
+	}
+	if lbuff == nil {
+		lbuff = make([]byte, l)
+		copy(lbuff, buff)
+	}
+	return []*entry.Entry{{
+		Tag:  tag,
+		SRC:  src,
+		TS:   ts,
+		Data: lbuff,
+	}}
+}
+
+// jsonEntry encodes a normalized flow record into an entry
+func jsonEntry(fr flowRecord, tag entry.EntryTag, src net.IP, ts entry.Timestamp) *entry.Entry {
+	b, err := fr.encode()
+	if err != nil {
+		debugout("Failed to encode flow record: %v\n", err)
+		return nil
+	}
+	return &entry.Entry{
+		Tag:  tag,
+		SRC:  src,
+		TS:   ts,
+		Data: b,
 	}
 }
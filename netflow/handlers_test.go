@@ -0,0 +1,274 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/floren/ipfix"
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingest/v3/log"
+)
+
+const (
+	testTemplateID = 256
+	testEnterprise = 9
+	testExportTime = 1577934245 //2020-01-02T03:04:05Z
+)
+
+func u16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func join(bs ...[]byte) (r []byte) {
+	for _, b := range bs {
+		r = append(r, b...)
+	}
+	return
+}
+
+// ipfixMessage builds an IPFIX message from its sets
+func ipfixMessage(domain, seq uint32, sets ...[]byte) []byte {
+	body := join(sets...)
+	return join(u16(ipfixVersion), u16(uint16(ipfixHeaderLen+len(body))), u32(testExportTime), u32(seq), u32(domain), body)
+}
+
+func ipfixSet(id uint16, recs ...[]byte) []byte {
+	body := join(recs...)
+	return join(u16(id), u16(uint16(4+len(body))), body)
+}
+
+// nfv9Message builds a Netflow v9 packet from its flowsets
+func nfv9Message(uptime, seq, source uint32, sets ...[]byte) []byte {
+	return join(u16(9), u16(uint16(len(sets))), u32(uptime), u32(testExportTime), u32(seq), u32(source), join(sets...))
+}
+
+func decodeRecord(t *testing.T, data []byte) (fr flowRecord) {
+	t.Helper()
+	if err := json.Unmarshal(data, &fr); err != nil {
+		t.Fatalf("bad JSON %s: %v", data, err)
+	}
+	return
+}
+
+// testTemplate describes a flow with a variable length enterprise element at the end
+func testTemplate() []byte {
+	return ipfixSet(2, join(
+		u16(testTemplateID), u16(10),
+		u16(8), u16(4), //sourceIPv4Address
+		u16(12), u16(4), //destinationIPv4Address
+		u16(7), u16(2), //sourceTransportPort
+		u16(11), u16(2), //destinationTransportPort
+		u16(4), u16(1), //protocolIdentifier
+		u16(1), u16(8), //octetDeltaCount
+		u16(2), u16(8), //packetDeltaCount
+		u16(152), u16(8), //flowStartMilliseconds
+		u16(153), u16(8), //flowEndMilliseconds
+		u16(0x8000|100), u16(0xffff), u32(testEnterprise),
+	))
+}
+
+// testFlow is a data record for testTemplate
+func testFlow(src, dst string, sport, dport uint16, octets, packets uint64, start time.Time, ent []byte) []byte {
+	ms := uint64(start.UnixNano() / int64(time.Millisecond))
+	return join(
+		net.ParseIP(src).To4(), net.ParseIP(dst).To4(),
+		u16(sport), u16(dport), []byte{6},
+		u64(octets), u64(packets), u64(ms), u64(ms+1500),
+		[]byte{byte(len(ent))}, ent,
+	)
+}
+
+// testHandler returns an IPFIX handler that is not listening, the muxer is never started
+func testHandler(t *testing.T, jsonOutput bool, cache string) *IpfixHandler {
+	t.Helper()
+	if lg == nil {
+		lg = log.NewDiscardLogger()
+	}
+	er, err := newExporterRoutes(`test`, &collector{}, nil, 1, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewIpfixHandler(bindConfig{
+		tag:           1,
+		exporters:     er,
+		ch:            make(chan *entry.Entry, 16),
+		wg:            &sync.WaitGroup{},
+		igst:          &ingest.IngestMuxer{},
+		templateCache: cache,
+		jsonOutput:    jsonOutput,
+	}, &ingest.IngestMuxer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestReadIpfixMessage(t *testing.T) {
+	start := time.Unix(testExportTime, 0)
+	first := ipfixMessage(1, 0, testTemplate())
+	second := ipfixMessage(1, 1, ipfixSet(testTemplateID, testFlow(`10.0.0.1`, `10.0.0.2`, 1234, 80, 100, 2, start, nil)))
+	r := bytes.NewReader(join(first, second))
+	buff := make([]byte, 65535)
+	for _, exp := range [][]byte{first, second} {
+		l, err := readIpfixMessage(r, buff)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(buff[:l], exp) {
+			t.Fatalf("read %x, expected %x", buff[:l], exp)
+		}
+	}
+	if _, err := readIpfixMessage(r, buff); err != io.EOF {
+		t.Fatal("expected EOF at the end of the stream", err)
+	}
+
+	bad := map[string][]byte{
+		`netflow v9`:    join(u16(9), first[2:]),
+		`short length`:  join(first[:2], u16(ipfixHeaderLen-1), first[4:]),
+		`truncated`:     first[:len(first)-1],
+		`short header`:  first[:ipfixHeaderLen-1],
+		`empty message`: nil,
+	}
+	for name, b := range bad {
+		if _, err := readIpfixMessage(bytes.NewReader(b), buff); err == nil {
+			t.Fatalf("%s was read", name)
+		}
+	}
+	//a bare header is a valid, if empty, message
+	if l, err := readIpfixMessage(bytes.NewReader(ipfixMessage(1, 0)), buff); err != nil || l != ipfixHeaderLen {
+		t.Fatalf("bad empty message %d %v", l, err)
+	}
+}
+
+func TestIpfixTCP(t *testing.T) {
+	h := testHandler(t, true, ``)
+	if err := h.Listen(`tcp://127.0.0.1:0`); err != nil {
+		t.Fatal(err)
+	}
+	h.wg.Add(1)
+	if err := h.Start(0); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(testExportTime-10, 0).UTC()
+	flows := ipfixSet(testTemplateID,
+		testFlow(`10.0.0.1`, `10.0.0.2`, 1234, 80, 100, 2, start, []byte(`abc`)),
+		testFlow(`10.0.0.3`, `10.0.0.4`, 5678, 443, 200, 3, start, nil),
+	)
+	c, err := net.Dial(`tcp`, h.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the template and the records arrive in separate messages split across writes
+	stream := join(ipfixMessage(5, 0, testTemplate()), ipfixMessage(5, 1, flows))
+	for len(stream) > 0 {
+		n := 7
+		if n > len(stream) {
+			n = len(stream)
+		}
+		if _, err = c.Write(stream[:n]); err != nil {
+			t.Fatal(err)
+		}
+		stream = stream[n:]
+	}
+	for i, exp := range []string{`10.0.0.1`, `10.0.0.3`} {
+		select {
+		case e := <-h.ch:
+			if time.Since(e.TS.StandardTime()) > time.Minute || e.Tag != 1 || !e.SRC.Equal(net.ParseIP(`127.0.0.1`)) {
+				t.Fatalf("bad entry %d %v %v %v", i, e.TS, e.Tag, e.SRC)
+			} else if !bytes.Contains(e.Data, []byte(`"Src":"`+exp+`"`)) {
+				t.Fatalf("bad record %d %s", i, e.Data)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for record %d", i)
+		}
+	}
+
+	//templates belong to the TCP connection, a new connection starts without them
+	c2, err := net.Dial(`tcp`, h.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c2.Write(ipfixMessage(5, 2, flows)); err != nil {
+		t.Fatal(err)
+	}
+	c2.Close()
+	c.Close()
+	select {
+	case e := <-h.ch:
+		t.Fatalf("decoded %s without a template", e.Data)
+	case <-time.After(250 * time.Millisecond):
+	}
+	if err = h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h.wg.Wait()
+}
+
+func TestIpfixNativeOutput(t *testing.T) {
+	h := testHandler(t, false, ``)
+	ss := h.newSessions()
+	exp := net.ParseIP(`192.168.1.1`)
+	start := time.Unix(testExportTime, 0)
+	flows := ipfixMessage(5, 1, ipfixSet(testTemplateID, testFlow(`10.0.0.1`, `10.0.0.2`, 1234, 80, 100, 2, start, nil)))
+
+	//records that arrive before their template are passed along untouched
+	ents := h.handleMessage(ss, flows, exp)
+	if len(ents) != 1 || !bytes.Equal(ents[0].Data, flows) {
+		t.Fatalf("bad entries before the template %v", ents)
+	}
+	if ents = h.handleMessage(ss, ipfixMessage(5, 0, testTemplate()), exp); len(ents) != 1 {
+		t.Fatalf("template message produced %d entries", len(ents))
+	}
+	//afterwards the template is attached so each entry can be decoded by itself
+	ents = h.handleMessage(ss, flows, exp)
+	if len(ents) != 1 {
+		t.Fatalf("produced %d entries", len(ents))
+	} else if e := ents[0]; len(e.Data) <= len(flows) || !e.SRC.Equal(exp) {
+		t.Fatalf("template was not attached %x", e.Data)
+	}
+	msg, err := ipfix.NewSession().ParseBuffer(ents[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(msg.TemplateRecords) != 1 || len(msg.DataRecords) != 1 {
+		t.Fatalf("bad attached message %+v", msg)
+	}
+	//the same domain from another exporter is another session
+	if ents = h.handleMessage(ss, flows, net.ParseIP(`192.168.1.2`)); len(ents) != 1 || !bytes.Equal(ents[0].Data, flows) {
+		t.Fatal("templates were shared between exporters")
+	}
+
+	//truncated and garbage messages are dropped without a panic
+	for i := 0; i < len(flows); i++ {
+		h.handleMessage(h.newSessions(), flows[:i], exp)
+		h.handleMessage(ss, flows[:i], exp)
+	}
+	//entries are stamped when they are received, not with the exporter clock
+	if ents = h.handleMessage(ss, flows, exp); len(ents) != 1 || time.Since(ents[0].TS.StandardTime()) > time.Minute {
+		t.Fatal("entry was not stamped with the receipt time")
+	}
+}
@@ -0,0 +1,300 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/floren/ipfix"
+	"github.com/gravwell/netflow/v3"
+)
+
+const (
+	nativeFormatName string = `native`
+	jsonFormatName   string = `json`
+)
+
+var (
+	ErrInvalidOutputFormat = errors.New("Output-Format must be native or json")
+)
+
+// flowRecord is the normalized form of a single Netflow v5, Netflow v9, or IPFIX flow record.
+// The same field names are used for every version so queries do not need to care which
+// version an exporter speaks, information elements without a normalized field are kept
+// in Fields under their IPFIX or Netflow v9 name.
+type flowRecord struct {
+	Type             string
+	Exporter         net.IP
+	Domain           uint32 `json:",omitempty"`
+	Sequence         uint32
+	Src              net.IP                 `json:",omitempty"`
+	Dst              net.IP                 `json:",omitempty"`
+	SrcPort          uint16                 `json:",omitempty"`
+	DstPort          uint16                 `json:",omitempty"`
+	Protocol         uint8                  `json:",omitempty"`
+	Packets          uint64                 `json:",omitempty"`
+	Bytes            uint64                 `json:",omitempty"`
+	Start            *time.Time             `json:",omitempty"`
+	End              *time.Time             `json:",omitempty"`
+	TCPFlags         uint16                 `json:",omitempty"`
+	ToS              uint8                  `json:",omitempty"`
+	InputIf          uint32                 `json:",omitempty"`
+	OutputIf         uint32                 `json:",omitempty"`
+	NextHop          net.IP                 `json:",omitempty"`
+	SrcAS            uint32                 `json:",omitempty"`
+	DstAS            uint32                 `json:",omitempty"`
+	SrcMask          uint8                  `json:",omitempty"`
+	DstMask          uint8                  `json:",omitempty"`
+	SamplingInterval uint32                 `json:",omitempty"`
+	ReversePackets   uint64                 `json:",omitempty"` //reverse direction of a bidirectional record
+	ReverseBytes     uint64                 `json:",omitempty"`
+	ReverseTCPFlags  uint16                 `json:",omitempty"`
+	Fields           map[string]interface{} `json:",omitempty"`
+}
+
+// translateOutputFormat returns true when flow records should be rendered as JSON
+func translateOutputFormat(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case ``:
+		fallthrough //default is the native format
+	case nativeFormatName:
+		return false, nil
+	case jsonFormatName:
+		return true, nil
+	}
+	return false, ErrInvalidOutputFormat
+}
+
+// nfv5Records normalizes the records of a decoded Netflow v5 packet.  Record times are
+// relative to the exporter uptime, they are converted using the export time in the header.
+func nfv5Records(nf *netflow.NFv5, exporter net.IP) (r []flowRecord) {
+	boot := time.Unix(int64(nf.Sec), int64(nf.Nsec)).Add(-time.Duration(nf.Uptime) * time.Millisecond).UTC()
+	for i := 0; i < int(nf.Count) && i < len(nf.Recs); i++ {
+		rec := &nf.Recs[i]
+		start := boot.Add(time.Duration(rec.UptimeFirst) * time.Millisecond)
+		end := boot.Add(time.Duration(rec.UptimeLast) * time.Millisecond)
+		fr := flowRecord{
+			Type:     nfv5Name,
+			Exporter: exporter,
+			Sequence: nf.Sequence + uint32(i),
+			Src:      copyIP(rec.Src),
+			Dst:      copyIP(rec.Dst),
+			SrcPort:  rec.SrcPort,
+			DstPort:  rec.DstPort,
+			Protocol: rec.Protocol,
+			Packets:  uint64(rec.Pkts),
+			Bytes:    uint64(rec.Bytes),
+			Start:    &start,
+			End:      &end,
+			TCPFlags: uint16(rec.Flags),
+			ToS:      rec.ToS,
+			InputIf:  uint32(rec.Input),
+			OutputIf: uint32(rec.Output),
+			SrcAS:    uint32(rec.SrcAs),
+			DstAS:    uint32(rec.DstAs),
+			SrcMask:  rec.SrcMask,
+			DstMask:  rec.DstMask,
+		}
+		if !rec.Next.IsUnspecified() {
+			fr.NextHop = copyIP(rec.Next)
+		}
+		//the top two bits of the sampling field hold the sampling mode
+		if si := uint32(nf.SampleInterval & 0x3fff); si > 1 {
+			fr.SamplingInterval = si
+		}
+		r = append(r, fr)
+	}
+	return
+}
+
+// ipfixRecords normalizes the data records of a parsed Netflow v9 or IPFIX message.  Both
+// versions share the field IDs of the normalized fields, so the records are normalized on
+// the field IDs and the names are only used for the remaining fields.  Records whose
+// template has not been seen yet cannot be decoded and are skipped.
+func ipfixRecords(s *ipfix.Session, msg *ipfix.Message, exporter net.IP) (r []flowRecord) {
+	typ := ipfixName
+	if msg.Header.Version == 9 {
+		typ = `netflowv9`
+	}
+	interp, err := ipfix.NewInterpreterVersion(s, msg.Header.Version)
+	if err != nil {
+		return
+	}
+	export := time.Unix(int64(msg.Header.ExportTime), 0).UTC()
+	var fields []ipfix.InterpretedField
+	for _, dr := range msg.DataRecords {
+		if fields = interp.InterpretInto(dr, fields); len(fields) == 0 {
+			continue
+		}
+		fr := flowRecord{
+			Type:     typ,
+			Exporter: exporter,
+			Domain:   msg.Header.DomainID,
+			Sequence: msg.Header.SequenceNumber,
+		}
+		var uptimeStart, uptimeEnd, initTime uint64
+		var haveStart, haveEnd, haveInit bool
+		for _, f := range fields {
+			if f.EnterpriseID != 0 || f.Value == nil {
+				fr.addField(f)
+				continue
+			}
+			switch f.FieldID {
+			case 1, 85: //octetDeltaCount, octetTotalCount
+				fr.Bytes, _ = fieldUint(f.Value)
+			case 2, 86: //packetDeltaCount, packetTotalCount
+				fr.Packets, _ = fieldUint(f.Value)
+			case 4:
+				fr.Protocol = uint8(fieldUintOr(f.Value))
+			case 5:
+				fr.ToS = uint8(fieldUintOr(f.Value))
+			case 6:
+				fr.TCPFlags = uint16(fieldUintOr(f.Value))
+			case 7:
+				fr.SrcPort = uint16(fieldUintOr(f.Value))
+			case 11:
+				fr.DstPort = uint16(fieldUintOr(f.Value))
+			case 8, 27: //source IPv4 and IPv6 address
+				fr.Src = fieldIP(f.Value)
+			case 12, 28: //destination IPv4 and IPv6 address
+				fr.Dst = fieldIP(f.Value)
+			case 15, 62: //next hop IPv4 and IPv6 address
+				fr.NextHop = fieldIP(f.Value)
+			case 9, 29:
+				fr.SrcMask = uint8(fieldUintOr(f.Value))
+			case 13, 30:
+				fr.DstMask = uint8(fieldUintOr(f.Value))
+			case 10:
+				fr.InputIf = uint32(fieldUintOr(f.Value))
+			case 14:
+				fr.OutputIf = uint32(fieldUintOr(f.Value))
+			case 16:
+				fr.SrcAS = uint32(fieldUintOr(f.Value))
+			case 17:
+				fr.DstAS = uint32(fieldUintOr(f.Value))
+			case 34:
+				fr.SamplingInterval = uint32(fieldUintOr(f.Value))
+			case 22: //flowStartSysUpTime
+				uptimeStart, haveStart = fieldUint(f.Value)
+			case 21: //flowEndSysUpTime
+				uptimeEnd, haveEnd = fieldUint(f.Value)
+			case 160: //systemInitTimeMilliseconds
+				if t, ok := f.Value.(time.Time); ok {
+					initTime, haveInit = uint64(t.UnixNano()/int64(time.Millisecond)), true
+				}
+			case 150, 152, 154, 156: //flowStart seconds through nanoseconds
+				if t, ok := f.Value.(time.Time); ok {
+					t = t.UTC()
+					fr.Start = &t
+				}
+			case 151, 153, 155, 157: //flowEnd seconds through nanoseconds
+				if t, ok := f.Value.(time.Time); ok {
+					t = t.UTC()
+					fr.End = &t
+				}
+			default:
+				fr.addField(f)
+			}
+		}
+		//uptime based times are relative to the exporter boot time, Netflow v9 carries the uptime
+		//in the header while IPFIX exporters have to send the boot time as a field
+		var boot time.Time
+		if haveInit {
+			boot = time.Unix(0, int64(initTime)*int64(time.Millisecond)).UTC()
+		} else if msg.Header.Version == 9 {
+			boot = export.Add(-time.Duration(msg.Header.SysUptime) * time.Millisecond)
+		}
+		if !boot.IsZero() {
+			if haveStart && fr.Start == nil {
+				t := boot.Add(time.Duration(uptimeStart) * time.Millisecond)
+				fr.Start = &t
+			}
+			if haveEnd && fr.End == nil {
+				t := boot.Add(time.Duration(uptimeEnd) * time.Millisecond)
+				fr.End = &t
+			}
+		}
+		r = append(r, fr)
+	}
+	return
+}
+
+// addField keeps an information element that has no normalized field, unknown elements
+// are named by their enterprise and field IDs and carry their raw bytes as hex
+func (fr *flowRecord) addField(f ipfix.InterpretedField) {
+	if fr.Fields == nil {
+		fr.Fields = map[string]interface{}{}
+	}
+	name := f.Name
+	if name == `` {
+		name = strconv.FormatUint(uint64(f.EnterpriseID), 10) + `.` + strconv.FormatUint(uint64(f.FieldID), 10)
+	}
+	switch v := f.Value.(type) {
+	case nil:
+		fr.Fields[name] = hex.EncodeToString(f.RawValue)
+	case []byte:
+		fr.Fields[name] = hex.EncodeToString(v)
+	case *net.IP:
+		fr.Fields[name] = copyIP(*v)
+	case time.Time:
+		fr.Fields[name] = v.UTC()
+	default:
+		fr.Fields[name] = v
+	}
+}
+
+func (fr *flowRecord) encode() ([]byte, error) {
+	return json.Marshal(fr)
+}
+
+// fieldUint converts the unsigned integer types produced by the interpreter
+func fieldUint(v interface{}) (uint64, bool) {
+	switch x := v.(type) {
+	case uint8:
+		return uint64(x), true
+	case uint16:
+		return uint64(x), true
+	case uint32:
+		return uint64(x), true
+	case uint64:
+		return x, true
+	}
+	return 0, false
+}
+
+func fieldUintOr(v interface{}) (r uint64) {
+	r, _ = fieldUint(v)
+	return
+}
+
+func fieldIP(v interface{}) net.IP {
+	if ip, ok := v.(*net.IP); ok && ip != nil {
+		return copyIP(*ip)
+	}
+	return nil
+}
+
+// copyIP copies an address out of a packet buffer that will be reused
+func copyIP(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	r := make(net.IP, len(ip))
+	copy(r, ip)
+	return r
+}
@@ -0,0 +1,148 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravwell/netflow/v3"
+)
+
+func TestTranslateOutputFormat(t *testing.T) {
+	for v, exp := range map[string]bool{``: false, `native`: false, ` JSON `: true} {
+		if js, err := translateOutputFormat(v); err != nil || js != exp {
+			t.Fatalf("%q translated to %v %v", v, js, err)
+		}
+	}
+	if _, err := translateOutputFormat(`xml`); err != ErrInvalidOutputFormat {
+		t.Fatal("accepted an invalid format", err)
+	}
+}
+
+func TestIpfixJSONRecords(t *testing.T) {
+	h := testHandler(t, true, ``)
+	ss := h.newSessions()
+	exp := net.ParseIP(`192.168.1.1`)
+	start := time.Unix(testExportTime-10, 0).UTC()
+	if ents := h.handleMessage(ss, ipfixMessage(5, 0, testTemplate()), exp); len(ents) != 0 {
+		t.Fatalf("template message produced %d entries", len(ents))
+	}
+	ents := h.handleMessage(ss, ipfixMessage(5, 7, ipfixSet(testTemplateID,
+		testFlow(`10.0.0.1`, `10.0.0.2`, 1234, 80, 1000, 10, start, []byte(`abc`)),
+		testFlow(`10.0.0.3`, `10.0.0.4`, 5678, 443, 2000, 20, start, nil),
+	)), exp)
+	if len(ents) != 2 {
+		t.Fatalf("produced %d entries", len(ents))
+	}
+	fr := decodeRecord(t, ents[0].Data)
+	if fr.Type != ipfixName || !fr.Exporter.Equal(exp) || fr.Domain != 5 || fr.Sequence != 7 {
+		t.Fatalf("bad header fields %s", ents[0].Data)
+	} else if !fr.Src.Equal(net.ParseIP(`10.0.0.1`)) || !fr.Dst.Equal(net.ParseIP(`10.0.0.2`)) || fr.SrcPort != 1234 || fr.DstPort != 80 || fr.Protocol != 6 {
+		t.Fatalf("bad flow key %s", ents[0].Data)
+	} else if fr.Bytes != 1000 || fr.Packets != 10 {
+		t.Fatalf("bad counters %s", ents[0].Data)
+	} else if fr.Start == nil || !fr.Start.Equal(start) || fr.End == nil || !fr.End.Equal(start.Add(1500*time.Millisecond)) {
+		t.Fatalf("bad times %s", ents[0].Data)
+	}
+	//the enterprise element has no name, its raw value is kept under the enterprise and field IDs
+	if v, ok := fr.Fields[`9.100`]; !ok || v != `616263` {
+		t.Fatalf("bad enterprise field %s", ents[0].Data)
+	}
+	if fr = decodeRecord(t, ents[1].Data); !fr.Src.Equal(net.ParseIP(`10.0.0.3`)) || fr.Bytes != 2000 {
+		t.Fatalf("bad second record %s", ents[1].Data)
+	}
+	//records without a template cannot be normalized
+	if ents = h.handleMessage(ss, ipfixMessage(6, 8, ipfixSet(testTemplateID, testFlow(`10.0.0.1`, `10.0.0.2`, 1, 2, 3, 4, start, nil))), exp); len(ents) != 0 {
+		t.Fatalf("normalized records without a template %v", ents)
+	}
+}
+
+func TestNetflowV9JSONRecords(t *testing.T) {
+	h := testHandler(t, true, ``)
+	ss := h.newSessions()
+	exp := net.ParseIP(`192.168.1.1`)
+	tmpl := ipfixSet(0, join(
+		u16(300), u16(7),
+		u16(27), u16(16), //IPV6_SRC_ADDR
+		u16(28), u16(16), //IPV6_DST_ADDR
+		u16(1), u16(4), //IN_BYTES
+		u16(2), u16(4), //IN_PKTS
+		u16(22), u16(4), //FIRST_SWITCHED
+		u16(21), u16(4), //LAST_SWITCHED
+		u16(10), u16(2), //INPUT_SNMP
+	))
+	//the exporter booted 100 seconds before the export, the flow ran from 40 to 45 seconds after boot
+	data := ipfixSet(300, join(
+		net.ParseIP(`fd00::1`), net.ParseIP(`fd00::2`),
+		u32(512), u32(4), u32(40000), u32(45000), u16(3),
+	))
+	ents := h.handleMessage(ss, nfv9Message(100000, 9, 11, tmpl, data), exp)
+	if len(ents) != 1 {
+		t.Fatalf("produced %d entries", len(ents))
+	}
+	fr := decodeRecord(t, ents[0].Data)
+	boot := time.Unix(testExportTime-100, 0)
+	if fr.Type != `netflowv9` || fr.Domain != 11 || fr.Sequence != 9 {
+		t.Fatalf("bad header fields %s", ents[0].Data)
+	} else if !fr.Src.Equal(net.ParseIP(`fd00::1`)) || !fr.Dst.Equal(net.ParseIP(`fd00::2`)) || fr.Bytes != 512 || fr.Packets != 4 || fr.InputIf != 3 {
+		t.Fatalf("bad fields %s", ents[0].Data)
+	} else if fr.Start == nil || !fr.Start.Equal(boot.Add(40*time.Second)) || fr.End == nil || !fr.End.Equal(boot.Add(45*time.Second)) {
+		t.Fatalf("bad times %s", ents[0].Data)
+	}
+}
+
+func TestNetflowV5Records(t *testing.T) {
+	var nf netflow.NFv5
+	nf.Count = 2
+	nf.Uptime = 60000
+	nf.Sec = testExportTime
+	nf.Sequence = 100
+	nf.SampleInterval = 0x4000 | 10 //mode bits are ignored
+	nf.Recs[0] = netflow.NFv5Record{
+		Src: net.ParseIP(`10.0.0.1`).To4(), Dst: net.ParseIP(`10.0.0.2`).To4(), Next: net.IPv4zero.To4(),
+		SrcPort: 1234, DstPort: 53, Protocol: 17, Pkts: 1, Bytes: 70, UptimeFirst: 30000, UptimeLast: 31000,
+	}
+	nf.Recs[1] = netflow.NFv5Record{
+		Src: net.ParseIP(`10.0.0.3`).To4(), Dst: net.ParseIP(`10.0.0.4`).To4(), Next: net.ParseIP(`10.0.0.254`).To4(),
+		Protocol: 6, Flags: 0x12, SrcAs: 64512,
+	}
+	nf.Recs[2].Src = net.ParseIP(`10.0.0.5`).To4() //past the count
+	recs := nfv5Records(&nf, net.ParseIP(`192.168.1.1`))
+	if len(recs) != 2 {
+		t.Fatalf("normalized %d records", len(recs))
+	}
+	boot := time.Unix(testExportTime-60, 0)
+	if r := recs[0]; r.Type != nfv5Name || r.Sequence != 100 || r.SamplingInterval != 10 || r.NextHop != nil {
+		t.Fatalf("bad record %+v", r)
+	} else if !r.Start.Equal(boot.Add(30*time.Second)) || !r.End.Equal(boot.Add(31*time.Second)) {
+		t.Fatalf("bad times %v %v", r.Start, r.End)
+	}
+	if r := recs[1]; r.Sequence != 101 || !r.NextHop.Equal(net.ParseIP(`10.0.0.254`)) || r.TCPFlags != 0x12 || r.SrcAS != 64512 {
+		t.Fatalf("bad record %+v", r)
+	}
+	//the normalized names are shared with the other versions
+	b, err := recs[0].encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{`Type`, `Exporter`, `Src`, `Dst`, `SrcPort`, `DstPort`, `Protocol`, `Packets`, `Bytes`, `Start`, `End`} {
+		if _, ok := m[k]; !ok {
+			t.Fatalf("%s is missing from %s", k, b)
+		}
+	}
+	if _, ok := m[`NextHop`]; ok {
+		t.Fatalf("empty next hop was rendered %s", b)
+	}
+}
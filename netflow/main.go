@@ -165,7 +165,7 @@ func main() {
 	var src net.IP
 	if cfg.Source_Override != `` {
 		// global override
-		src = net.ParseIP(cfg.Source_Override)
+		src = utils.NormalizeSource(net.ParseIP(cfg.Source_Override))
 		if src == nil {
 			lg.FatalCode(0, "Global Source-Override is invalid")
 		}
@@ -183,9 +183,21 @@ func main() {
 			lg.FatalCode(0, "Invalid flow type \"%s\": %v\n", v.Flow_Type, err)
 		}
 		bc.tag = tag
+		if bc.exporters, err = newExporterRoutes(k, v, cfg.Exporter, tag, src, igst.GetTag); err != nil {
+			lg.FatalCode(0, "Invalid exporters for %s: %v\n", k, err)
+		}
 		bc.ignoreTS = v.Ignore_Timestamps
 		bc.localTZ = v.Assume_Local_Timezone
 		bc.sessionDumpEnabled = v.Session_Dump_Enabled
+		bc.templateCache = v.Template_Cache
+		if bc.jsonOutput, err = translateOutputFormat(v.Output_Format); err != nil {
+			lg.FatalCode(0, "Invalid Output-Format for %s: %v\n", k, err)
+		}
+		sc, err := v.stitchOptions()
+		if err != nil {
+			lg.FatalCode(0, "Invalid flow stitching options for %s: %v\n", k, err)
+		}
+		bc.stitcher = newFlowStitcher(sc, ch, &wg)
 		bc.lastInfoDump = time.Now()
 		var bh BindHandler
 		switch ft {
@@ -215,7 +227,7 @@ func main() {
 	debugout("Started %d handlers\n", len(cfg.Collector))
 	//fire off our relay
 	doneChan := make(chan bool)
-	go relay(ch, doneChan, src, igst)
+	go relay(ch, doneChan, igst)
 
 	debugout("Running\n")
 
@@ -252,7 +264,7 @@ func main() {
 	}
 }
 
-func relay(ch chan *entry.Entry, done chan bool, srcOverride net.IP, igst *ingest.IngestMuxer) {
+func relay(ch chan *entry.Entry, done chan bool, igst *ingest.IngestMuxer) {
 	var ents []*entry.Entry
 
 	tckr := time.NewTicker(time.Second)
@@ -273,9 +285,6 @@ mainLoop:
 				break mainLoop
 			}
 			if e != nil {
-				if srcOverride != nil {
-					e.SRC = srcOverride
-				}
 				ents = append(ents, e)
 			}
 			if len(ents) >= batchSize {
@@ -0,0 +1,282 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+const (
+	defaultBidirectionalTimeout = 10 * time.Second
+	maxStitchEntries            = 262144
+	stitchFlushInterval         = time.Second
+)
+
+var (
+	ErrStitchRequiresJSON          = errors.New("Bidirectional-Flows and Dedup-Window require Output-Format=json")
+	ErrInvalidBidirectionalTimeout = errors.New("Bidirectional-Timeout must be a positive duration")
+	ErrInvalidDedupWindow          = errors.New("Dedup-Window must be a positive duration")
+	ErrTimeoutNoBidirectional      = errors.New("Bidirectional-Timeout requires Bidirectional-Flows")
+)
+
+// stitchConfig holds the parsed Bidirectional-Flows and Dedup-Window options of a collector
+type stitchConfig struct {
+	bidir   bool
+	timeout time.Duration
+	dedup   time.Duration
+}
+
+func (sc stitchConfig) enabled() bool {
+	return sc.bidir || sc.dedup > 0
+}
+
+// stitchOptions parses and checks the stitching options of a collector
+func (c *collector) stitchOptions() (sc stitchConfig, err error) {
+	sc.bidir = c.Bidirectional_Flows
+	if c.Bidirectional_Timeout != `` {
+		if !sc.bidir {
+			err = ErrTimeoutNoBidirectional
+			return
+		} else if sc.timeout, err = time.ParseDuration(c.Bidirectional_Timeout); err != nil || sc.timeout <= 0 {
+			err = ErrInvalidBidirectionalTimeout
+			return
+		}
+	} else if sc.bidir {
+		sc.timeout = defaultBidirectionalTimeout
+	}
+	if c.Dedup_Window != `` {
+		if sc.dedup, err = time.ParseDuration(c.Dedup_Window); err != nil || sc.dedup <= 0 {
+			err = ErrInvalidDedupWindow
+			return
+		}
+	}
+	if sc.enabled() {
+		var js bool
+		if js, err = translateOutputFormat(c.Output_Format); err == nil && !js {
+			err = ErrStitchRequiresJSON
+		}
+	}
+	return
+}
+
+// stitchKey is the 5-tuple of a unidirectional flow record
+type stitchKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+	proto        uint8
+}
+
+// dedupKey identifies the same flow seen by several routers on its path, every router
+// counts the same packets and bytes while the timestamps depend on each router's clock
+type dedupKey struct {
+	stitchKey
+	packets, bytes uint64
+}
+
+type dedupState struct {
+	exporter [16]byte
+	expires  time.Time
+}
+
+type pendingFlow struct {
+	fr       flowRecord
+	tag      entry.EntryTag
+	src      net.IP
+	ts       entry.Timestamp
+	deadline time.Time
+}
+
+// flowStitcher drops records of a flow that were already exported by another router and
+// merges the two directions of a conversation into a single record.  Records wait up to
+// the bidirectional timeout for their reverse direction, records that are never matched
+// are sent on by themselves.  Records without addresses, such as options records, are
+// passed through untouched.
+type flowStitcher struct {
+	stitchConfig
+	mtx     sync.Mutex
+	pending map[stitchKey]*pendingFlow
+	seen    map[dedupKey]dedupState
+	ch      chan *entry.Entry
+	wg      *sync.WaitGroup
+	done    chan struct{}
+	closed  bool
+}
+
+// newFlowStitcher returns nil when neither option is enabled
+func newFlowStitcher(sc stitchConfig, ch chan *entry.Entry, wg *sync.WaitGroup) *flowStitcher {
+	if !sc.enabled() {
+		return nil
+	}
+	return &flowStitcher{
+		stitchConfig: sc,
+		pending:      map[stitchKey]*pendingFlow{},
+		seen:         map[dedupKey]dedupState{},
+		ch:           ch,
+		wg:           wg,
+	}
+}
+
+// start sends on the records whose reverse direction did not show up in time
+func (fs *flowStitcher) start() {
+	if fs == nil || fs.done != nil {
+		return
+	}
+	fs.done = make(chan struct{})
+	fs.wg.Add(1)
+	go func() {
+		defer fs.wg.Done()
+		tkr := time.NewTicker(stitchFlushInterval)
+		defer tkr.Stop()
+		for {
+			select {
+			case now := <-tkr.C:
+				for _, e := range fs.expire(now, false) {
+					fs.ch <- e
+				}
+			case <-fs.done:
+				for _, e := range fs.expire(time.Now(), true) {
+					fs.ch <- e
+				}
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the stitcher and sends on every waiting record, records added afterwards pass straight through
+func (fs *flowStitcher) Close() {
+	if fs == nil {
+		return
+	}
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if !fs.closed {
+		fs.closed = true
+		if fs.done != nil {
+			close(fs.done)
+		}
+	}
+}
+
+// add hands a normalized record to the stitcher and returns the entries that are ready to be
+// ingested, it is safe to call on a nil stitcher
+func (fs *flowStitcher) add(fr flowRecord, tag entry.EntryTag, src net.IP, ts entry.Timestamp) (ents []*entry.Entry) {
+	k, ok := recordKey(&fr)
+	if fs == nil || !ok {
+		return appendEntry(ents, fr, tag, src, ts)
+	}
+	now := time.Now()
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	if fs.dedup > 0 && fs.duplicate(k, &fr, now) {
+		return
+	}
+	if !fs.bidir || fs.closed {
+		return appendEntry(ents, fr, tag, src, ts)
+	}
+	if pf, ok := fs.pending[k.reverse()]; ok {
+		delete(fs.pending, k.reverse())
+		pf.fr.merge(&fr)
+		return appendEntry(ents, pf.fr, pf.tag, pf.src, pf.ts)
+	}
+	if pf, ok := fs.pending[k]; ok {
+		//another record for the same direction, such as an active timeout export
+		ents = appendEntry(ents, pf.fr, pf.tag, pf.src, pf.ts)
+		delete(fs.pending, k)
+	}
+	if len(fs.pending) >= maxStitchEntries {
+		return appendEntry(ents, fr, tag, src, ts)
+	}
+	fs.pending[k] = &pendingFlow{
+		fr:       fr,
+		tag:      tag,
+		src:      src,
+		ts:       ts,
+		deadline: now.Add(fs.timeout),
+	}
+	return
+}
+
+// duplicate reports whether another exporter already sent the record within the dedup
+// window, the caller holds the lock
+func (fs *flowStitcher) duplicate(k stitchKey, fr *flowRecord, now time.Time) bool {
+	dk := dedupKey{stitchKey: k, packets: fr.Packets, bytes: fr.Bytes}
+	var exp [16]byte
+	copy(exp[:], fr.Exporter.To16())
+	if ds, ok := fs.seen[dk]; ok && now.Before(ds.expires) {
+		return ds.exporter != exp
+	}
+	if len(fs.seen) < maxStitchEntries {
+		fs.seen[dk] = dedupState{exporter: exp, expires: now.Add(fs.dedup)}
+	}
+	return false
+}
+
+// expire returns the entries of records that waited too long for their reverse direction
+// and forgets the expired dedup state, all waiting records are returned when all is set
+func (fs *flowStitcher) expire(now time.Time, all bool) (ents []*entry.Entry) {
+	fs.mtx.Lock()
+	defer fs.mtx.Unlock()
+	for k, pf := range fs.pending {
+		if all || !now.Before(pf.deadline) {
+			ents = appendEntry(ents, pf.fr, pf.tag, pf.src, pf.ts)
+			delete(fs.pending, k)
+		}
+	}
+	for k, ds := range fs.seen {
+		if !now.Before(ds.expires) {
+			delete(fs.seen, k)
+		}
+	}
+	return
+}
+
+func recordKey(fr *flowRecord) (k stitchKey, ok bool) {
+	if fr.Src == nil || fr.Dst == nil {
+		return
+	}
+	copy(k.src[:], fr.Src.To16())
+	copy(k.dst[:], fr.Dst.To16())
+	k.sport, k.dport, k.proto = fr.SrcPort, fr.DstPort, fr.Protocol
+	ok = true
+	return
+}
+
+func (k stitchKey) reverse() stitchKey {
+	return stitchKey{src: k.dst, dst: k.src, sport: k.dport, dport: k.sport, proto: k.proto}
+}
+
+// merge folds the reverse direction of a conversation into the record, the direction that
+// started first is kept as the forward direction
+func (fr *flowRecord) merge(rev *flowRecord) {
+	if rev.Start != nil && fr.Start != nil && rev.Start.Before(*fr.Start) {
+		*fr, *rev = *rev, *fr
+	}
+	fr.ReversePackets = rev.Packets
+	fr.ReverseBytes = rev.Bytes
+	fr.ReverseTCPFlags = rev.TCPFlags
+	if rev.Start != nil && (fr.Start == nil || rev.Start.Before(*fr.Start)) {
+		fr.Start = rev.Start
+	}
+	if rev.End != nil && (fr.End == nil || rev.End.After(*fr.End)) {
+		fr.End = rev.End
+	}
+}
+
+func appendEntry(ents []*entry.Entry, fr flowRecord, tag entry.EntryTag, src net.IP, ts entry.Timestamp) []*entry.Entry {
+	if e := jsonEntry(fr, tag, src, ts); e != nil {
+		ents = append(ents, e)
+	}
+	return ents
+}
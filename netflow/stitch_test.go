@@ -0,0 +1,152 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+func testRecord(exporter, src, dst string, sport, dport uint16, packets, bytes uint64, start time.Time) flowRecord {
+	end := start.Add(time.Second)
+	return flowRecord{
+		Type:     ipfixName,
+		Exporter: net.ParseIP(exporter),
+		Src:      net.ParseIP(src),
+		Dst:      net.ParseIP(dst),
+		SrcPort:  sport,
+		DstPort:  dport,
+		Protocol: 6,
+		Packets:  packets,
+		Bytes:    bytes,
+		Start:    &start,
+		End:      &end,
+	}
+}
+
+func TestStitchOptions(t *testing.T) {
+	tests := []struct {
+		c   collector
+		sc  stitchConfig
+		err error
+	}{
+		{c: collector{}},
+		{c: collector{Bidirectional_Flows: true, Output_Format: `json`}, sc: stitchConfig{bidir: true, timeout: defaultBidirectionalTimeout}},
+		{c: collector{Bidirectional_Flows: true, Bidirectional_Timeout: `30s`, Output_Format: `json`}, sc: stitchConfig{bidir: true, timeout: 30 * time.Second}},
+		{c: collector{Dedup_Window: `2s`, Output_Format: `json`}, sc: stitchConfig{dedup: 2 * time.Second}},
+		{c: collector{Bidirectional_Flows: true}, err: ErrStitchRequiresJSON},
+		{c: collector{Dedup_Window: `2s`, Output_Format: `native`}, err: ErrStitchRequiresJSON},
+		{c: collector{Bidirectional_Timeout: `30s`, Output_Format: `json`}, err: ErrTimeoutNoBidirectional},
+		{c: collector{Bidirectional_Flows: true, Bidirectional_Timeout: `-1s`, Output_Format: `json`}, err: ErrInvalidBidirectionalTimeout},
+		{c: collector{Dedup_Window: `soon`, Output_Format: `json`}, err: ErrInvalidDedupWindow},
+	}
+	for i, tt := range tests {
+		sc, err := tt.c.stitchOptions()
+		if err != tt.err {
+			t.Fatalf("%d returned %v, expected %v", i, err, tt.err)
+		} else if err == nil && sc != tt.sc {
+			t.Fatalf("%d parsed to %+v, expected %+v", i, sc, tt.sc)
+		}
+	}
+}
+
+func TestBidirectionalFlows(t *testing.T) {
+	fs := newFlowStitcher(stitchConfig{bidir: true, timeout: time.Minute}, make(chan *entry.Entry), &sync.WaitGroup{})
+	start := time.Unix(testExportTime, 0).UTC()
+	ts := entry.Now()
+
+	//the response arrives first but started later, the request stays the forward direction
+	resp := testRecord(`192.168.1.1`, `10.0.0.2`, `10.0.0.1`, 80, 1234, 5, 5000, start.Add(time.Millisecond))
+	if ents := fs.add(resp, 1, nil, ts); len(ents) != 0 {
+		t.Fatal("sent a record before its reverse direction showed up")
+	}
+	req := testRecord(`192.168.1.1`, `10.0.0.1`, `10.0.0.2`, 1234, 80, 4, 400, start)
+	req.TCPFlags = 0x02
+	ents := fs.add(req, 1, nil, ts)
+	if len(ents) != 1 {
+		t.Fatalf("merged into %d entries", len(ents))
+	}
+	fr := decodeRecord(t, ents[0].Data)
+	if !fr.Src.Equal(net.ParseIP(`10.0.0.1`)) || fr.SrcPort != 1234 || fr.Packets != 4 || fr.Bytes != 400 || fr.TCPFlags != 0x02 {
+		t.Fatalf("bad forward direction %s", ents[0].Data)
+	} else if fr.ReversePackets != 5 || fr.ReverseBytes != 5000 {
+		t.Fatalf("bad reverse direction %s", ents[0].Data)
+	} else if !fr.Start.Equal(start) || !fr.End.Equal(start.Add(time.Second+time.Millisecond)) {
+		t.Fatalf("bad times %s", ents[0].Data)
+	}
+
+	//records that never see their reverse direction are sent on once the timeout passes
+	fs.add(testRecord(`192.168.1.1`, `10.0.0.5`, `10.0.0.6`, 1, 2, 1, 60, start), 1, nil, ts)
+	if ents = fs.expire(time.Now(), false); len(ents) != 0 {
+		t.Fatal("expired a record early")
+	} else if ents = fs.expire(time.Now().Add(time.Minute), false); len(ents) != 1 {
+		t.Fatalf("expired %d records", len(ents))
+	}
+	//a second record for the same direction sends the first on
+	fs.add(testRecord(`192.168.1.1`, `10.0.0.5`, `10.0.0.6`, 1, 2, 1, 60, start), 1, nil, ts)
+	if ents = fs.add(testRecord(`192.168.1.1`, `10.0.0.5`, `10.0.0.6`, 1, 2, 2, 120, start), 1, nil, ts); len(ents) != 1 {
+		t.Fatalf("repeated direction sent %d records", len(ents))
+	} else if fr = decodeRecord(t, ents[0].Data); fr.Packets != 1 {
+		t.Fatalf("sent the wrong record %s", ents[0].Data)
+	}
+	//records without addresses, such as options records, pass straight through
+	if ents = fs.add(flowRecord{Type: ipfixName, SamplingInterval: 100}, 1, nil, ts); len(ents) != 1 {
+		t.Fatal("held an options record")
+	}
+	//closing sends everything that is still waiting
+	fs.Close()
+	if ents = fs.expire(time.Now(), true); len(ents) != 1 {
+		t.Fatalf("flushed %d records", len(ents))
+	} else if ents = fs.add(req, 1, nil, ts); len(ents) != 1 {
+		t.Fatal("held a record after the stitcher was closed")
+	}
+}
+
+func TestFlowDedup(t *testing.T) {
+	fs := newFlowStitcher(stitchConfig{dedup: time.Minute}, make(chan *entry.Entry), &sync.WaitGroup{})
+	start := time.Unix(testExportTime, 0).UTC()
+	ts := entry.Now()
+	first := testRecord(`192.168.1.1`, `10.0.0.1`, `10.0.0.2`, 1234, 80, 4, 400, start)
+	//the next router on the path has a different clock but counts the same packets
+	second := testRecord(`192.168.1.2`, `10.0.0.1`, `10.0.0.2`, 1234, 80, 4, 400, start.Add(3*time.Millisecond))
+	other := testRecord(`192.168.1.2`, `10.0.0.1`, `10.0.0.2`, 1234, 80, 5, 500, start)
+	tests := []struct {
+		fr   flowRecord
+		sent bool
+	}{
+		{fr: first, sent: true},
+		{fr: second, sent: false},
+		{fr: other, sent: true},
+		{fr: first, sent: true}, //the same exporter sending the flow again is not a duplicate
+	}
+	for i, tt := range tests {
+		if ents := fs.add(tt.fr, 1, nil, ts); (len(ents) == 1) != tt.sent {
+			t.Fatalf("%d sent %d entries", i, len(ents))
+		}
+	}
+	//the dedup state is forgotten once the window passes
+	fs.expire(time.Now().Add(time.Minute), false)
+	if ents := fs.add(second, 1, nil, ts); len(ents) != 1 {
+		t.Fatal("dropped a record after the dedup window")
+	}
+
+	//a nil stitcher passes records through
+	var nfs *flowStitcher
+	if ents := nfs.add(first, 1, nil, ts); len(ents) != 1 {
+		t.Fatal("nil stitcher dropped a record")
+	}
+	nfs.start()
+	nfs.Close()
+	if newFlowStitcher(stitchConfig{}, nil, nil) != nil {
+		t.Fatal("created a stitcher without any options")
+	}
+}
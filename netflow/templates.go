@@ -0,0 +1,328 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/floren/ipfix"
+)
+
+const (
+	templateFlushInterval = 10 * time.Second
+	templateFilePerm      = 0640
+
+	nfv9OptionsTemplateSet  = 1
+	ipfixOptionsTemplateSet = 3
+)
+
+// templateStore saves the templates received from each exporter so that a collector
+// restart can decode flow records right away instead of dropping them until the
+// exporter resends its templates, which can take several minutes.
+type templateStore struct {
+	sync.Mutex
+	path     string
+	sessions map[sessionKey]*savedSession
+	dirty    bool
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+type savedSession struct {
+	version   uint16
+	templates map[uint16]ipfix.TemplateRecord
+}
+
+// persistedSession is the on disk form of a savedSession
+type persistedSession struct {
+	IP        [16]byte
+	Domain    uint32
+	Version   uint16
+	Templates []ipfix.TemplateRecord
+}
+
+// newTemplateStore loads the templates saved at path, no store is used when the path is empty.
+// A template file that cannot be decoded is ignored and overwritten.
+func newTemplateStore(path string) (*templateStore, error) {
+	if path == `` {
+		return nil, nil
+	}
+	ts := &templateStore{
+		path:     path,
+		sessions: map[sessionKey]*savedSession{},
+	}
+	fin, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ts, nil
+		}
+		return nil, err
+	}
+	defer fin.Close()
+	var saved []persistedSession
+	if err := gob.NewDecoder(fin).Decode(&saved); err != nil {
+		lg.Warn("Ignoring unreadable template cache %s: %v\n", path, err)
+		return ts, nil
+	}
+	for _, ps := range saved {
+		ss := &savedSession{
+			version:   ps.Version,
+			templates: make(map[uint16]ipfix.TemplateRecord, len(ps.Templates)),
+		}
+		for _, tr := range ps.Templates {
+			ss.templates[tr.TemplateID] = tr
+		}
+		ts.sessions[sessionKey{ip: ps.IP, domain: ps.Domain}] = ss
+	}
+	return ts, nil
+}
+
+// start writes the templates out every templateFlushInterval when they have changed
+func (ts *templateStore) start() {
+	if ts == nil {
+		return
+	}
+	ts.done = make(chan struct{})
+	ts.wg.Add(1)
+	go func() {
+		defer ts.wg.Done()
+		tkr := time.NewTicker(templateFlushInterval)
+		defer tkr.Stop()
+		for {
+			select {
+			case <-tkr.C:
+				if err := ts.flush(); err != nil {
+					lg.Error("Failed to write template cache %s: %v\n", ts.path, err)
+				}
+			case <-ts.done:
+				return
+			}
+		}
+	}()
+}
+
+func (ts *templateStore) Close() error {
+	if ts == nil {
+		return nil
+	}
+	if ts.done != nil {
+		close(ts.done)
+		ts.wg.Wait()
+		ts.done = nil
+	}
+	return ts.flush()
+}
+
+// update records templates received from an exporter
+func (ts *templateStore) update(key sessionKey, version uint16, trs []ipfix.TemplateRecord) {
+	if ts == nil || len(trs) == 0 {
+		return
+	}
+	ts.Lock()
+	defer ts.Unlock()
+	ss, ok := ts.sessions[key]
+	if !ok || ss.version != version {
+		ss = &savedSession{version: version, templates: map[uint16]ipfix.TemplateRecord{}}
+		ts.sessions[key] = ss
+	}
+	for _, tr := range trs {
+		if len(tr.FieldSpecifiers) == 0 {
+			delete(ss.templates, tr.TemplateID) //template withdrawal
+		} else {
+			ss.templates[tr.TemplateID] = tr
+		}
+	}
+	ts.dirty = true
+}
+
+// restore loads the saved templates for an exporter into a new session
+func (ts *templateStore) restore(key sessionKey, s *ipfix.Session) (n int) {
+	if ts == nil {
+		return
+	}
+	ts.Lock()
+	ss, ok := ts.sessions[key]
+	var trs []ipfix.TemplateRecord
+	var version uint16
+	if ok {
+		version = ss.version
+		for _, tr := range ss.templates {
+			trs = append(trs, tr)
+		}
+	}
+	ts.Unlock()
+	if trs = definedTemplates(trs); len(trs) == 0 {
+		return
+	}
+	if err := registerTemplates(s, version, key.domain, trs); err != nil {
+		lg.Warn("Failed to restore templates for %v: %v\n", key.String(), err)
+		return
+	}
+	return len(trs)
+}
+
+func (ts *templateStore) flush() error {
+	ts.Lock()
+	defer ts.Unlock()
+	if !ts.dirty {
+		return nil
+	}
+	saved := make([]persistedSession, 0, len(ts.sessions))
+	for k, ss := range ts.sessions {
+		ps := persistedSession{IP: k.ip, Domain: k.domain, Version: ss.version}
+		for _, tr := range ss.templates {
+			ps.Templates = append(ps.Templates, tr)
+		}
+		saved = append(saved, ps)
+	}
+	tmp := ts.path + `.tmp`
+	fout, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, templateFilePerm)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(fout).Encode(saved); err != nil {
+		fout.Close()
+		return err
+	} else if err = fout.Close(); err != nil {
+		return err
+	} else if err = os.Rename(tmp, ts.path); err != nil {
+		return err
+	}
+	ts.dirty = false
+	return nil
+}
+
+// registerTemplates loads templates into a session by handing it a message that only holds the templates
+func registerTemplates(s *ipfix.Session, version uint16, domain uint32, trs []ipfix.TemplateRecord) error {
+	msg := ipfix.Message{
+		Header: ipfix.MessageHeader{
+			Version:    version,
+			ExportTime: uint32(time.Now().Unix()),
+			DomainID:   domain,
+		},
+		TemplateRecords: trs,
+	}
+	buff, err := s.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.ParseBuffer(buff)
+	return err
+}
+
+// optionTemplates decodes the options template sets in a Netflow v9 or IPFIX message.
+// The ipfix package skips options templates, which leaves the options data records (such
+// as sampling rates and interface names) undecodable and stops parsing at the first one.
+// The options templates are returned as plain templates with the scope fields first so
+// they can be registered with the session and attached to the entries like any other.
+func optionTemplates(buff []byte) (trs []ipfix.TemplateRecord) {
+	var off int
+	var optSet uint16
+	switch v := binary.BigEndian.Uint16(buff); v {
+	case 9:
+		off, optSet = 20, nfv9OptionsTemplateSet
+	case ipfixVersion:
+		off, optSet = ipfixHeaderLen, ipfixOptionsTemplateSet
+	default:
+		return
+	}
+	for off+4 <= len(buff) {
+		id := binary.BigEndian.Uint16(buff[off:])
+		l := int(binary.BigEndian.Uint16(buff[off+2:]))
+		if l < 4 || off+l > len(buff) {
+			return
+		}
+		if id == optSet {
+			if optSet == nfv9OptionsTemplateSet {
+				trs = append(trs, nfv9OptionTemplates(buff[off+4:off+l])...)
+			} else {
+				trs = append(trs, ipfixOptionTemplates(buff[off+4:off+l])...)
+			}
+		}
+		off += l
+	}
+	return
+}
+
+// nfv9OptionTemplates decodes the records of a Netflow v9 options template set, see RFC 3954 section 6.1
+func nfv9OptionTemplates(set []byte) (trs []ipfix.TemplateRecord) {
+	for len(set) >= 6 {
+		tr := ipfix.TemplateRecord{TemplateID: binary.BigEndian.Uint16(set)}
+		scopeLen := int(binary.BigEndian.Uint16(set[2:]))
+		optLen := int(binary.BigEndian.Uint16(set[4:]))
+		set = set[6:]
+		if tr.TemplateID < 256 || scopeLen+optLen > len(set) || (scopeLen+optLen)%4 != 0 {
+			return //the rest is padding
+		}
+		for fs := set[:scopeLen+optLen]; len(fs) >= 4; fs = fs[4:] {
+			tr.FieldSpecifiers = append(tr.FieldSpecifiers, ipfix.TemplateFieldSpecifier{
+				FieldID: binary.BigEndian.Uint16(fs),
+				Length:  binary.BigEndian.Uint16(fs[2:]),
+			})
+		}
+		set = set[scopeLen+optLen:]
+		trs = append(trs, tr)
+	}
+	return
+}
+
+// ipfixOptionTemplates decodes the records of an IPFIX options template set, see RFC 7011 section 3.4.2.2
+func ipfixOptionTemplates(set []byte) (trs []ipfix.TemplateRecord) {
+	for len(set) >= 4 {
+		tr := ipfix.TemplateRecord{TemplateID: binary.BigEndian.Uint16(set)}
+		cnt := int(binary.BigEndian.Uint16(set[2:]))
+		if tr.TemplateID < 256 {
+			return //the rest is padding
+		}
+		if cnt == 0 {
+			//withdrawal records have no scope field count
+			trs = append(trs, tr)
+			set = set[4:]
+			continue
+		} else if len(set) < 6 {
+			return
+		}
+		set = set[6:]
+		for i := 0; i < cnt; i++ {
+			if len(set) < 4 {
+				return
+			}
+			f := ipfix.TemplateFieldSpecifier{
+				FieldID: binary.BigEndian.Uint16(set),
+				Length:  binary.BigEndian.Uint16(set[2:]),
+			}
+			set = set[4:]
+			if f.FieldID >= 0x8000 {
+				if len(set) < 4 {
+					return
+				}
+				f.FieldID -= 0x8000
+				f.EnterpriseID = binary.BigEndian.Uint32(set)
+				set = set[4:]
+			}
+			tr.FieldSpecifiers = append(tr.FieldSpecifiers, f)
+		}
+		trs = append(trs, tr)
+	}
+	return
+}
+
+// definedTemplates returns the templates that are not withdrawals
+func definedTemplates(trs []ipfix.TemplateRecord) (r []ipfix.TemplateRecord) {
+	for _, tr := range trs {
+		if len(tr.FieldSpecifiers) > 0 {
+			r = append(r, tr)
+		}
+	}
+	return
+}
@@ -0,0 +1,165 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/floren/ipfix"
+)
+
+func TestTemplateCache(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `templates`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, `templates.cache`)
+	exp := net.ParseIP(`192.168.1.1`)
+	start := time.Unix(testExportTime, 0)
+	flows := ipfixMessage(5, 1, ipfixSet(testTemplateID, testFlow(`10.0.0.1`, `10.0.0.2`, 1234, 80, 100, 2, start, nil)))
+
+	h := testHandler(t, true, cache)
+	h.handleMessage(h.newSessions(), ipfixMessage(5, 0, testTemplate()), exp)
+	if err = h.tmpls.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	//a restarted collector decodes records before the exporter resends its templates
+	h = testHandler(t, true, cache)
+	if ents := h.handleMessage(h.newSessions(), flows, exp); len(ents) != 1 {
+		t.Fatalf("restored collector produced %d entries", len(ents))
+	} else if fr := decodeRecord(t, ents[0].Data); !fr.Src.Equal(net.ParseIP(`10.0.0.1`)) || fr.Bytes != 100 {
+		t.Fatalf("bad restored record %s", ents[0].Data)
+	}
+	//templates are kept per exporter and observation domain
+	for _, s := range []struct {
+		ip     string
+		domain uint32
+	}{{`192.168.1.2`, 5}, {`192.168.1.1`, 6}} {
+		msg := ipfixMessage(s.domain, 1, ipfixSet(testTemplateID, testFlow(`10.0.0.1`, `10.0.0.2`, 1234, 80, 100, 2, start, nil)))
+		if ents := h.handleMessage(h.newSessions(), msg, net.ParseIP(s.ip)); len(ents) != 0 {
+			t.Fatalf("%s domain %d used another exporter's templates", s.ip, s.domain)
+		}
+	}
+
+	//a withdrawn template is forgotten
+	h.handleMessage(h.newSessions(), ipfixMessage(5, 2, ipfixSet(2, join(u16(testTemplateID), u16(0)))), exp)
+	if err = h.tmpls.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := newTemplateStore(cache)
+	if err != nil {
+		t.Fatal(err)
+	} else if n := ts.restore(getSessionKey(5, exp), ipfix.NewSession()); n != 0 {
+		t.Fatalf("restored %d withdrawn templates", n)
+	}
+}
+
+func TestTemplateStoreVersions(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `templates`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, `templates.cache`)
+	ts, err := newTemplateStore(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := getSessionKey(1, net.ParseIP(`10.1.1.1`))
+	tr := ipfix.TemplateRecord{TemplateID: 300, FieldSpecifiers: []ipfix.TemplateFieldSpecifier{{FieldID: 8, Length: 4}}}
+	ts.update(key, ipfixVersion, []ipfix.TemplateRecord{tr})
+	tr.TemplateID = 301
+	ts.update(key, ipfixVersion, []ipfix.TemplateRecord{tr})
+	if n := len(ts.sessions[key].templates); n != 2 {
+		t.Fatalf("stored %d templates", n)
+	}
+	//an exporter that switches protocol versions starts over
+	ts.update(key, 9, []ipfix.TemplateRecord{tr})
+	if ss := ts.sessions[key]; ss.version != 9 || len(ss.templates) != 1 {
+		t.Fatalf("bad session after a version change %+v", ss)
+	}
+	if err = ts.Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err = os.Stat(cache + `.tmp`); !os.IsNotExist(err) {
+		t.Fatal("temporary cache file was left behind", err)
+	}
+
+	//an unreadable cache is ignored rather than blocking startup
+	if err = ioutil.WriteFile(cache, []byte(`garbage`), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if ts, err = newTemplateStore(cache); err != nil || ts == nil || len(ts.sessions) != 0 {
+		t.Fatalf("bad store from a corrupt cache %v %v", ts, err)
+	}
+	//no cache path means no store, which is safe to use
+	if ts, err = newTemplateStore(``); err != nil || ts != nil {
+		t.Fatalf("created a store without a path %v %v", ts, err)
+	}
+	ts.update(key, 9, []ipfix.TemplateRecord{tr})
+	ts.start()
+	if n := ts.restore(key, ipfix.NewSession()); n != 0 {
+		t.Fatal("nil store restored templates")
+	} else if err = ts.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOptionTemplates(t *testing.T) {
+	//IPFIX: scope of the exporting process ID with a sampling interval and an enterprise field
+	ipfixOpts := ipfixSet(ipfixOptionsTemplateSet, join(
+		u16(400), u16(3), u16(1),
+		u16(144), u16(4), //exportingProcessId
+		u16(34), u16(4), //samplingInterval
+		u16(0x8000|7), u16(2), u32(testEnterprise),
+	), join(u16(401), u16(0))) //withdrawal
+	trs := optionTemplates(ipfixMessage(5, 0, ipfixOpts))
+	if len(trs) != 2 || trs[0].TemplateID != 400 || len(trs[0].FieldSpecifiers) != 3 || trs[1].TemplateID != 401 || len(trs[1].FieldSpecifiers) != 0 {
+		t.Fatalf("bad IPFIX options templates %+v", trs)
+	} else if f := trs[0].FieldSpecifiers[2]; f.FieldID != 7 || f.EnterpriseID != testEnterprise || f.Length != 2 {
+		t.Fatalf("bad enterprise field %+v", f)
+	}
+
+	//Netflow v9: system scope with a sampling interval, padded to 32 bits
+	nfOpts := ipfixSet(nfv9OptionsTemplateSet, join(
+		u16(500), u16(4), u16(4),
+		u16(1), u16(4), //system scope
+		u16(34), u16(4), //SAMPLING_INTERVAL
+		u16(0),
+	))
+	if trs = optionTemplates(nfv9Message(0, 0, 1, nfOpts)); len(trs) != 1 || trs[0].TemplateID != 500 || len(trs[0].FieldSpecifiers) != 2 {
+		t.Fatalf("bad Netflow v9 options templates %+v", trs)
+	}
+
+	//the options data records in the same message can be decoded
+	h := testHandler(t, true, ``)
+	data := ipfixSet(400, join(u32(1), u32(100), u16(0xbeef)))
+	ents := h.handleMessage(h.newSessions(), ipfixMessage(5, 0, ipfixOpts, data), net.ParseIP(`192.168.1.1`))
+	if len(ents) != 1 {
+		t.Fatalf("options message produced %d entries", len(ents))
+	} else if fr := decodeRecord(t, ents[0].Data); fr.SamplingInterval != 100 || fr.Src != nil {
+		t.Fatalf("bad options record %s", ents[0].Data)
+	}
+
+	//sets that overrun the message are ignored without a panic
+	msg := ipfixMessage(5, 0, ipfixOpts)
+	for i := 2; i < len(msg); i++ {
+		optionTemplates(msg[:i])
+	}
+	for i := ipfixHeaderLen; i < len(msg); i++ {
+		b := append([]byte(nil), msg...)
+		b[i] = 0xff
+		optionTemplates(b)
+	}
+}
@@ -50,6 +50,7 @@ func connCount() int {
 
 type bindConfig struct {
 	tag                entry.EntryTag
+	exporters          *exporterRoutes
 	ch                 chan *entry.Entry
 	wg                 *sync.WaitGroup
 	ignoreTS           bool
@@ -57,6 +58,9 @@ type bindConfig struct {
 	igst               *ingest.IngestMuxer
 	lastInfoDump       time.Time
 	sessionDumpEnabled bool
+	templateCache      string
+	jsonOutput         bool
+	stitcher           *flowStitcher
 }
 
 type BindHandler interface {
@@ -76,5 +80,8 @@ func (bc bindConfig) Validate() error {
 	if bc.igst == nil {
 		return errors.New("Nil ingest muxer")
 	}
+	if bc.exporters == nil {
+		return errors.New("nil exporter routes")
+	}
 	return nil
 }
@@ -0,0 +1,313 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	dhcpTimeout      = 30 * time.Second
+	maxARPEntries    = 64 * 1024
+	maxDHCPPending   = 16 * 1024
+	arpOpRequest     = 1
+	arpOpReply       = 2
+	arpEventNew      = `NEW`
+	arpEventChanged  = `CHANGED`
+	assetTypeARP     = `ARP`
+	assetTypeDHCP    = `DHCP`
+	ipv4AddrLen      = 4
+	ethernetAddrLen  = 6
+	dhcpMinHeaderLen = 240
+	arpHeaderLen     = 8
+	dhcpMaxHWLen     = 16 //size of the chaddr field
+)
+
+var (
+	ErrInvalidAssetRecords  = errors.New("Asset-Records must be only or alongside")
+	ErrAssetOptionsNoAssets = errors.New("Asset-Tag requires Asset-Records")
+	ErrAssetOnlyWithFlows   = errors.New("Asset-Records=only cannot be combined with Flow-Records, use Asset-Records=alongside")
+)
+
+// arpEvent is the JSON form of an IP address showing up with a new hardware address
+type arpEvent struct {
+	Type        string
+	Event       string
+	IP          net.IP
+	MAC         string
+	PreviousMAC string `json:",omitempty"`
+	Operation   string
+	Gratuitous  bool `json:",omitempty"`
+}
+
+// dhcpEvent is the JSON form of a DHCP lease transaction, ACK and NAK responses are joined
+// with the client details from the request they answer
+type dhcpEvent struct {
+	Type        string
+	Event       string
+	XID         uint32
+	MAC         string
+	IP          net.IP   `json:",omitempty"`
+	RequestedIP net.IP   `json:",omitempty"`
+	Hostname    string   `json:",omitempty"`
+	VendorClass string   `json:",omitempty"`
+	Server      net.IP   `json:",omitempty"`
+	LeaseTime   uint32   `json:",omitempty"` //seconds
+	SubnetMask  net.IP   `json:",omitempty"`
+	Routers     []net.IP `json:",omitempty"`
+	DNSServers  []net.IP `json:",omitempty"`
+	Domain      string   `json:",omitempty"`
+}
+
+type dhcpKey struct {
+	xid uint32
+	mac [ethernetAddrLen]byte
+}
+
+type dhcpPending struct {
+	ev   dhcpEvent
+	seen time.Time
+}
+
+// assetTracker watches ARP and DHCP traffic for address assignments.  ARP bindings are
+// reported when an address is first seen or moves to a different hardware address, DHCP
+// requests are held until the server answers and are dropped if it never does.
+type assetTracker struct {
+	arp     map[[ipv4AddrLen]byte][ethernetAddrLen]byte
+	pending map[dhcpKey]*dhcpPending
+}
+
+func newAssetTracker() *assetTracker {
+	return &assetTracker{
+		arp:     map[[ipv4AddrLen]byte][ethernetAddrLen]byte{},
+		pending: map[dhcpKey]*dhcpPending{},
+	}
+}
+
+// add parses a captured packet and returns any events it produces
+func (at *assetTracker) add(data []byte, lt layers.LinkType, now time.Time) (evs []interface{}) {
+	po := decodeOffsets(data, lt)
+	if po.et == layers.EthernetTypeARP && po.netOff > 0 && po.netOff < len(data) {
+		if ev, ok := at.addARP(data[po.netOff:]); ok {
+			evs = append(evs, ev)
+		}
+		return
+	}
+	if !po.hasTrans || po.proto != layers.IPProtocolUDP || len(data) < po.transEnd+dhcpMinHeaderLen {
+		return
+	}
+	sport := binary.BigEndian.Uint16(data[po.transOff:])
+	dport := binary.BigEndian.Uint16(data[po.transOff+2:])
+	if (sport != dhcpServerPort && sport != dhcpClientPort) || (dport != dhcpServerPort && dport != dhcpClientPort) {
+		return
+	}
+	if ev, ok := at.addDHCP(data[po.transEnd:], now); ok {
+		evs = append(evs, ev)
+	}
+	return
+}
+
+func (at *assetTracker) addARP(data []byte) (ev arpEvent, ok bool) {
+	//the gopacket decoder trusts the address sizes in the header and sums them in a byte,
+	//only Ethernet and IPv4 addresses are tracked so anything else is rejected up front
+	if len(data) < arpHeaderLen+2*ethernetAddrLen+2*ipv4AddrLen || data[4] != ethernetAddrLen || data[5] != ipv4AddrLen {
+		return
+	}
+	var arp layers.ARP
+	if err := arp.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return
+	} else if arp.Protocol != layers.EthernetTypeIPv4 {
+		return
+	}
+	var ip [ipv4AddrLen]byte
+	var mac [ethernetAddrLen]byte
+	copy(ip[:], arp.SourceProtAddress)
+	copy(mac[:], arp.SourceHwAddress)
+	if ip == ([ipv4AddrLen]byte{}) {
+		return //address probes do not claim an address yet
+	}
+	prev, seen := at.arp[ip]
+	if seen && prev == mac {
+		return
+	}
+	if !seen && len(at.arp) >= maxARPEntries {
+		//start over rather than grow without bound, known bindings are reported again as new
+		at.arp = map[[ipv4AddrLen]byte][ethernetAddrLen]byte{}
+	}
+	at.arp[ip] = mac
+	ev = arpEvent{
+		Type:       assetTypeARP,
+		Event:      arpEventNew,
+		IP:         net.IP(append([]byte(nil), ip[:]...)),
+		MAC:        net.HardwareAddr(mac[:]).String(),
+		Operation:  `request`,
+		Gratuitous: net.IP(arp.SourceProtAddress).Equal(net.IP(arp.DstProtAddress)),
+	}
+	if arp.Operation == arpOpReply {
+		ev.Operation = `reply`
+	}
+	if seen {
+		ev.Event = arpEventChanged
+		ev.PreviousMAC = net.HardwareAddr(prev[:]).String()
+	}
+	ok = true
+	return
+}
+
+func (at *assetTracker) addDHCP(data []byte, now time.Time) (ev dhcpEvent, ok bool) {
+	//the gopacket decoder trusts the hardware address length
+	if len(data) < dhcpMinHeaderLen || data[2] > dhcpMaxHWLen {
+		return
+	}
+	var dhcp layers.DHCPv4
+	if err := dhcp.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return
+	} else if len(dhcp.ClientHWAddr) != ethernetAddrLen {
+		return
+	}
+	var k dhcpKey
+	k.xid = dhcp.Xid
+	copy(k.mac[:], dhcp.ClientHWAddr)
+	ev = newDHCPEvent(&dhcp)
+	switch dhcpMessageType(&dhcp) {
+	case layers.DHCPMsgTypeDiscover, layers.DHCPMsgTypeRequest:
+		if len(at.pending) >= maxDHCPPending {
+			at.expire(now, true)
+		}
+		if p, ok := at.pending[k]; ok {
+			//keep what the discover told us if the request leaves it out
+			ev.merge(&p.ev)
+		}
+		at.pending[k] = &dhcpPending{ev: ev, seen: now}
+		return ev, false
+	case layers.DHCPMsgTypeAck, layers.DHCPMsgTypeNak:
+		if p, ok := at.pending[k]; ok {
+			delete(at.pending, k)
+			ev.merge(&p.ev)
+		}
+		if dhcpMessageType(&dhcp) == layers.DHCPMsgTypeAck {
+			ev.Event = `ACK`
+			if ev.IP == nil && !dhcp.ClientIP.IsUnspecified() {
+				ev.IP = copyIP(dhcp.ClientIP) //answers to INFORM leave yiaddr empty
+			}
+		} else {
+			ev.Event, ev.IP = `NAK`, nil
+		}
+	case layers.DHCPMsgTypeRelease:
+		ev.Event, ev.IP = `RELEASE`, copyIP(dhcp.ClientIP)
+	case layers.DHCPMsgTypeDecline:
+		ev.Event, ev.IP = `DECLINE`, ev.RequestedIP
+	case layers.DHCPMsgTypeInform:
+		ev.Event, ev.IP = `INFORM`, copyIP(dhcp.ClientIP)
+	default:
+		return
+	}
+	ok = true
+	return
+}
+
+// expire drops DHCP requests that were never answered, all of them when all is set
+func (at *assetTracker) expire(now time.Time, all bool) {
+	for k, p := range at.pending {
+		if all || now.Sub(p.seen) >= dhcpTimeout {
+			delete(at.pending, k)
+		}
+	}
+}
+
+func dhcpMessageType(dhcp *layers.DHCPv4) layers.DHCPMsgType {
+	for _, o := range dhcp.Options {
+		if o.Type == layers.DHCPOptMessageType && len(o.Data) == 1 {
+			return layers.DHCPMsgType(o.Data[0])
+		}
+	}
+	return layers.DHCPMsgTypeUnspecified
+}
+
+func newDHCPEvent(dhcp *layers.DHCPv4) (ev dhcpEvent) {
+	ev = dhcpEvent{
+		Type: assetTypeDHCP,
+		XID:  dhcp.Xid,
+		MAC:  dhcp.ClientHWAddr.String(),
+	}
+	if !dhcp.YourClientIP.IsUnspecified() {
+		ev.IP = copyIP(dhcp.YourClientIP)
+	}
+	for _, o := range dhcp.Options {
+		switch o.Type {
+		case layers.DHCPOptRequestIP:
+			if len(o.Data) == ipv4AddrLen {
+				ev.RequestedIP = copyIP(o.Data)
+			}
+		case layers.DHCPOptHostname:
+			ev.Hostname = strings.TrimRight(string(o.Data), "\x00")
+		case layers.DHCPOptClassID:
+			ev.VendorClass = string(o.Data)
+		case layers.DHCPOptServerID:
+			if len(o.Data) == ipv4AddrLen {
+				ev.Server = copyIP(o.Data)
+			}
+		case layers.DHCPOptLeaseTime:
+			if len(o.Data) == 4 {
+				ev.LeaseTime = binary.BigEndian.Uint32(o.Data)
+			}
+		case layers.DHCPOptSubnetMask:
+			if len(o.Data) == ipv4AddrLen {
+				ev.SubnetMask = copyIP(o.Data)
+			}
+		case layers.DHCPOptRouter:
+			ev.Routers = ipList(o.Data)
+		case layers.DHCPOptDNS:
+			ev.DNSServers = ipList(o.Data)
+		case layers.DHCPOptDomainName:
+			ev.Domain = strings.TrimRight(string(o.Data), "\x00")
+		}
+	}
+	return
+}
+
+// merge fills in the client details the server response does not carry
+func (ev *dhcpEvent) merge(req *dhcpEvent) {
+	if ev.RequestedIP == nil {
+		ev.RequestedIP = req.RequestedIP
+	}
+	if ev.Hostname == `` {
+		ev.Hostname = req.Hostname
+	}
+	if ev.VendorClass == `` {
+		ev.VendorClass = req.VendorClass
+	}
+}
+
+func ipList(b []byte) (ips []net.IP) {
+	for ; len(b) >= ipv4AddrLen; b = b[ipv4AddrLen:] {
+		ips = append(ips, copyIP(b[:ipv4AddrLen]))
+	}
+	return
+}
+
+// copyIP copies an address out of the packet buffer
+func copyIP(b []byte) net.IP {
+	return net.IP(append([]byte(nil), b...))
+}
+
+func encodeAsset(ev interface{}) ([]byte, error) {
+	return json.Marshal(ev)
+}
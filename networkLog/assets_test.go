@@ -0,0 +1,202 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+func testARP(t *testing.T, op uint16, mac net.HardwareAddr, ip, target string) []byte {
+	t.Helper()
+	return testPacket(t, testEth(layers.EthernetTypeARP), &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     ethernetAddrLen,
+		ProtAddressSize:   ipv4AddrLen,
+		Operation:         op,
+		SourceHwAddress:   mac,
+		SourceProtAddress: net.ParseIP(ip).To4(),
+		DstHwAddress:      make([]byte, ethernetAddrLen),
+		DstProtAddress:    net.ParseIP(target).To4(),
+	})
+}
+
+func testDHCP(t *testing.T, mt layers.DHCPMsgType, xid uint32, yiaddr string, opts ...layers.DHCPOption) []byte {
+	t.Helper()
+	op, sport, dport := layers.DHCPOpRequest, uint16(dhcpClientPort), uint16(dhcpServerPort)
+	if mt == layers.DHCPMsgTypeAck || mt == layers.DHCPMsgTypeNak || mt == layers.DHCPMsgTypeOffer {
+		op, sport, dport = layers.DHCPOpReply, dhcpServerPort, dhcpClientPort
+	}
+	dhcp := &layers.DHCPv4{
+		Operation:    op,
+		HardwareType: layers.LinkTypeEthernet,
+		HardwareLen:  ethernetAddrLen,
+		Xid:          xid,
+		ClientIP:     net.IPv4zero.To4(),
+		YourClientIP: net.ParseIP(yiaddr).To4(),
+		NextServerIP: net.IPv4zero.To4(),
+		RelayAgentIP: net.IPv4zero.To4(),
+		ClientHWAddr: testMAC1,
+		Options:      append([]layers.DHCPOption{layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(mt)})}, opts...),
+	}
+	return udpFrame(t, `10.0.0.1`, `255.255.255.255`, sport, dport, testPacket(t, dhcp))
+}
+
+func TestARPEvents(t *testing.T) {
+	at := newAssetTracker()
+	now := time.Now()
+	tests := []struct {
+		pkt  []byte
+		ev   *arpEvent
+		name string
+	}{
+		{
+			name: `first request`,
+			pkt:  testARP(t, arpOpRequest, testMAC1, `10.0.0.5`, `10.0.0.1`),
+			ev:   &arpEvent{Type: assetTypeARP, Event: arpEventNew, IP: net.ParseIP(`10.0.0.5`), MAC: testMAC1.String(), Operation: `request`},
+		},
+		{
+			name: `same binding`,
+			pkt:  testARP(t, arpOpReply, testMAC1, `10.0.0.5`, `10.0.0.1`),
+		},
+		{
+			name: `moved`,
+			pkt:  testARP(t, arpOpReply, testMAC2, `10.0.0.5`, `10.0.0.1`),
+			ev:   &arpEvent{Type: assetTypeARP, Event: arpEventChanged, IP: net.ParseIP(`10.0.0.5`), MAC: testMAC2.String(), PreviousMAC: testMAC1.String(), Operation: `reply`},
+		},
+		{
+			name: `gratuitous`,
+			pkt:  testARP(t, arpOpRequest, testMAC1, `10.0.0.6`, `10.0.0.6`),
+			ev:   &arpEvent{Type: assetTypeARP, Event: arpEventNew, IP: net.ParseIP(`10.0.0.6`), MAC: testMAC1.String(), Operation: `request`, Gratuitous: true},
+		},
+		{
+			name: `probe`,
+			pkt:  testARP(t, arpOpRequest, testMAC1, `0.0.0.0`, `10.0.0.7`),
+		},
+	}
+	for _, tt := range tests {
+		evs := at.add(tt.pkt, layers.LinkTypeEthernet, now)
+		if tt.ev == nil {
+			if len(evs) != 0 {
+				t.Fatalf("%s produced %+v", tt.name, evs)
+			}
+			continue
+		} else if len(evs) != 1 {
+			t.Fatalf("%s produced %d events", tt.name, len(evs))
+		}
+		ev, ok := evs[0].(arpEvent)
+		if !ok {
+			t.Fatalf("%s produced a %T", tt.name, evs[0])
+		} else if !ev.IP.Equal(tt.ev.IP) {
+			t.Fatalf("%s bad IP %v", tt.name, ev.IP)
+		}
+		ev.IP = tt.ev.IP
+		if !reflect.DeepEqual(ev, *tt.ev) {
+			t.Fatalf("%s produced %+v, expected %+v", tt.name, ev, *tt.ev)
+		}
+	}
+}
+
+func TestDHCPEvents(t *testing.T) {
+	at := newAssetTracker()
+	now := time.Now()
+	host := layers.NewDHCPOption(layers.DHCPOptHostname, []byte("laptop\x00"))
+	vendor := layers.NewDHCPOption(layers.DHCPOptClassID, []byte(`MSFT 5.0`))
+	reqIP := layers.NewDHCPOption(layers.DHCPOptRequestIP, []byte{10, 0, 0, 50})
+	for _, pkt := range [][]byte{
+		testDHCP(t, layers.DHCPMsgTypeDiscover, 42, `0.0.0.0`, host, vendor),
+		testDHCP(t, layers.DHCPMsgTypeOffer, 42, `10.0.0.50`),
+		testDHCP(t, layers.DHCPMsgTypeRequest, 42, `0.0.0.0`, reqIP),
+	} {
+		if evs := at.add(pkt, layers.LinkTypeEthernet, now); len(evs) != 0 {
+			t.Fatalf("reported %+v before the server answered", evs)
+		}
+	}
+	ack := testDHCP(t, layers.DHCPMsgTypeAck, 42, `10.0.0.50`,
+		layers.NewDHCPOption(layers.DHCPOptServerID, []byte{10, 0, 0, 1}),
+		layers.NewDHCPOption(layers.DHCPOptLeaseTime, []byte{0, 0, 0x0e, 0x10}),
+		layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 255, 0}),
+		layers.NewDHCPOption(layers.DHCPOptRouter, []byte{10, 0, 0, 1, 10, 0, 0, 2}),
+		layers.NewDHCPOption(layers.DHCPOptDNS, []byte{10, 0, 0, 53, 0xff}), //trailing partial address
+		layers.NewDHCPOption(layers.DHCPOptDomainName, []byte(`corp.example`)),
+	)
+	evs := at.add(ack, layers.LinkTypeEthernet, now)
+	if len(evs) != 1 {
+		t.Fatalf("ACK produced %d events", len(evs))
+	}
+	ev, ok := evs[0].(dhcpEvent)
+	if !ok {
+		t.Fatalf("ACK produced a %T", evs[0])
+	}
+	if ev.Event != `ACK` || ev.XID != 42 || ev.MAC != testMAC1.String() || !ev.IP.Equal(net.ParseIP(`10.0.0.50`)) {
+		t.Fatalf("bad lease %+v", ev)
+	} else if !ev.RequestedIP.Equal(net.ParseIP(`10.0.0.50`)) || ev.Hostname != `laptop` || ev.VendorClass != `MSFT 5.0` {
+		t.Fatalf("client details were not joined %+v", ev)
+	} else if !ev.Server.Equal(net.ParseIP(`10.0.0.1`)) || ev.LeaseTime != 3600 || !ev.SubnetMask.Equal(net.ParseIP(`255.255.255.0`)) || ev.Domain != `corp.example` {
+		t.Fatalf("bad server details %+v", ev)
+	} else if len(ev.Routers) != 2 || len(ev.DNSServers) != 1 || !ev.DNSServers[0].Equal(net.ParseIP(`10.0.0.53`)) {
+		t.Fatalf("bad address lists %v %v", ev.Routers, ev.DNSServers)
+	} else if len(at.pending) != 0 {
+		t.Fatalf("%d requests left pending", len(at.pending))
+	}
+
+	//a NAK carries no address and requests that are never answered are dropped
+	at.add(testDHCP(t, layers.DHCPMsgTypeRequest, 43, `0.0.0.0`, reqIP), layers.LinkTypeEthernet, now)
+	if evs = at.add(testDHCP(t, layers.DHCPMsgTypeNak, 43, `0.0.0.0`), layers.LinkTypeEthernet, now); len(evs) != 1 {
+		t.Fatalf("NAK produced %d events", len(evs))
+	} else if ev = evs[0].(dhcpEvent); ev.Event != `NAK` || ev.IP != nil || !ev.RequestedIP.Equal(net.ParseIP(`10.0.0.50`)) {
+		t.Fatalf("bad NAK %+v", ev)
+	}
+	at.add(testDHCP(t, layers.DHCPMsgTypeDiscover, 44, `0.0.0.0`), layers.LinkTypeEthernet, now)
+	at.expire(now.Add(dhcpTimeout/2), false)
+	if len(at.pending) != 1 {
+		t.Fatal("expired a request early")
+	}
+	at.expire(now.Add(dhcpTimeout), false)
+	if len(at.pending) != 0 {
+		t.Fatal("failed to expire an unanswered request")
+	}
+}
+
+func TestAssetsMalformed(t *testing.T) {
+	at := newAssetTracker()
+	now := time.Now()
+	pkts := [][]byte{
+		testARP(t, arpOpReply, testMAC2, `10.0.0.9`, `10.0.0.1`),
+		testDHCP(t, layers.DHCPMsgTypeAck, 50, `10.0.0.60`, layers.NewDHCPOption(layers.DHCPOptHostname, []byte(`host`))),
+	}
+	for _, pkt := range pkts {
+		prefixes(pkt, func(b []byte) {
+			at.add(b, layers.LinkTypeEthernet, now)
+		})
+		for i := ethHeaderLen; i < len(pkt); i++ {
+			for _, v := range []byte{0, 0xff} {
+				b := append([]byte(nil), pkt...)
+				b[i] = v
+				at.add(b, layers.LinkTypeEthernet, now)
+			}
+		}
+	}
+	//an ARP body that claims larger addresses than it carries
+	arp := testARP(t, arpOpReply, testMAC2, `10.0.0.9`, `10.0.0.1`)
+	arp[ethHeaderLen+4] = 0xff
+	if evs := at.add(arp, layers.LinkTypeEthernet, now); len(evs) != 0 {
+		t.Fatalf("parsed a malformed ARP packet into %+v", evs)
+	}
+	//address sizes whose sum wraps in a byte, which panics gopacket
+	arp = append(arp, make([]byte, 264)...)
+	arp[ethHeaderLen+4], arp[ethHeaderLen+5] = 0x40, 0x40
+	if evs := at.add(arp[:len(arp):len(arp)], layers.LinkTypeEthernet, now); len(evs) != 0 {
+		t.Fatalf("parsed a malformed ARP packet into %+v", evs)
+	}
+}
@@ -10,10 +10,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gravwell/ingest/v3"
@@ -26,30 +28,84 @@ const (
 	maxConfigSize    int64  = (1024 * 1024 * 2) //2MB, even this is crazy large
 	maxSnapLen       int    = 0xffff
 	defaultSnapLen   int    = 96
+	headersSnapLen   int    = 256 //room for stacked VLAN tags, IPv6 extension headers, and TCP options
 	defaultBpfFilter string = `not tcp port 4023 and not tcp port 4024`
 
 	envInterface string = `GRAVWELL_SNIFF_INTERFACE`
 	envBPFFilter string = `GRAVWELL_SNIFF_BPF_FILTER`
 	envSniffTag  string = `GRAVWELL_SNIFF_TAG`
 	envSnapLen   string = `GRAVWELL_SNIFF_SNAPLEN`
+
+	captureModePcap string = `pcap`
+	captureModeRing string = `afpacket`
+
+	defaultRingBlockSize    int           = 1024 * 1024
+	defaultRingBlockCount   int           = 64
+	defaultRingBlockTimeout time.Duration = 64 * time.Millisecond
+
+	defaultFlowIdleTimeout   time.Duration = 15 * time.Second
+	defaultFlowActiveTimeout time.Duration = time.Minute
+	defaultFlowMaxEntries    int           = 256 * 1024
+
+	recordsModeOnly      string = `only`
+	recordsModeAlongside string = `alongside`
+)
+
+var (
+	ErrInvalidCaptureMode      = errors.New("Capture-Mode must be pcap or afpacket")
+	ErrRingOptionsNoRing       = errors.New("Ring-Block-Size, Ring-Block-Count, and Ring-Block-Timeout require Capture-Mode=afpacket")
+	ErrInvalidRingBlockSize    = errors.New("Ring-Block-Size must be a multiple of the page size and larger than the Snap-Len")
+	ErrInvalidRingBlockCount   = errors.New("Ring-Block-Count must be greater than zero")
+	ErrInvalidRingBlockTimeout = errors.New("Ring-Block-Timeout must be at least 1ms")
+	ErrFlowOptionsNoFlows      = errors.New("Flow-Idle-Timeout, Flow-Active-Timeout, and Flow-Max-Entries require Flow-Records")
+	ErrInvalidFlowTimeout      = errors.New("Flow timeouts must be at least 1s")
+	ErrInvalidFlowMaxEntries   = errors.New("Flow-Max-Entries must be greater than zero")
+	ErrRecordsModeMismatch     = errors.New("DNS-Records, TLS-Records, and Asset-Records must all be only or all be alongside")
+	ErrInvalidStatsInterval    = errors.New("Stats-Interval must be a positive duration such as 5m")
+	ErrInvalidStatsListen      = errors.New("Stats-Listen must be a host:port pair or an absolute path to a unix socket")
 )
 
 type cfgReadType struct {
-	Global  config.IngestConfig
+	Global  global
 	Sniffer map[string]*snif
 }
 
+type global struct {
+	config.IngestConfig
+	Stats_Interval string //how often capture stats are logged for each sniffer, stats are not logged if empty
+	Stats_Listen   string //host:port or unix socket path serving capture stats as JSON, disabled if empty
+}
+
 type snif struct {
-	Interface       string //interface name to bind to
-	Promisc         bool   //whether we are binding in promisc mode
-	Tag_Name        string //tag to apply to ingested data
-	Snap_Len        int    //max capture length for packets
-	BPF_Filter      string //BPF-syntax expression to filter packets captured
-	Source_Override string //override normal source IP of the interface
+	Interface           string //interface name to bind to
+	Promisc             bool   //whether we are binding in promisc mode
+	Tag_Name            string //tag to apply to ingested data
+	Snap_Len            int    //max capture length for packets
+	Headers_Only        bool   //keep packets only up to the end of the transport header
+	Decapsulate         string //encapsulations to strip: vlan, gre, vxlan, erspan, or all
+	Sample_Rate         int    //keep 1 in N packets, 0 or 1 keeps every packet
+	Sample_Mode         string //deterministic keeps every Nth packet, random keeps each packet with a 1/N chance
+	BPF_Filter          string //BPF-syntax expression to filter packets captured
+	Source_Override     string //override normal source IP of the interface
+	Capture_Mode        string //pcap or afpacket
+	Ring_Block_Size     int    //size in bytes of each block in the afpacket ring
+	Ring_Block_Count    int    //number of blocks in the afpacket ring
+	Ring_Block_Timeout  string //how long the kernel waits before handing over a partially filled block
+	Flow_Records        bool   //ingest flow records built from the packets instead of the packets
+	Flow_Idle_Timeout   string //flows with no packets for this long are expired
+	Flow_Active_Timeout string //flows open for this long are expired and a new record started
+	Flow_Max_Entries    int    //maximum number of flows tracked at once
+	DNS_Records         string //only or alongside, ingest DNS transactions instead of or alongside the packets
+	DNS_Tag             string //tag for DNS transactions, defaults to the Tag-Name
+	DNS_Timeout         string //queries without a response for this long are reported as timed out
+	TLS_Records         string //only or alongside, ingest TLS hellos instead of or alongside the packets
+	TLS_Tag             string //tag for TLS hellos, defaults to the Tag-Name
+	Asset_Records       string //only or alongside, ingest ARP and DHCP address events instead of or alongside the packets
+	Asset_Tag           string //tag for ARP and DHCP events, defaults to the Tag-Name
 }
 
 type cfgType struct {
-	config.IngestConfig
+	global
 	Sniffer map[string]*snif
 }
 
@@ -81,8 +137,8 @@ func GetConfig(path string) (*cfgType, error) {
 		return nil, err
 	}
 	c := &cfgType{
-		IngestConfig: cr.Global,
-		Sniffer:      cr.Sniffer,
+		global:  cr.Global,
+		Sniffer: cr.Sniffer,
 	}
 	if err := verifyConfig(c); err != nil {
 		return nil, err
@@ -100,6 +156,36 @@ func GetConfig(path string) (*cfgType, error) {
 	return c, nil
 }
 
+func (g *global) Verify() error {
+	if err := g.IngestConfig.Verify(); err != nil {
+		return err
+	}
+	if g.Stats_Interval != `` {
+		if d, err := time.ParseDuration(g.Stats_Interval); err != nil || d <= 0 {
+			return ErrInvalidStatsInterval
+		}
+	}
+	if g.Stats_Listen != `` && !strings.HasPrefix(g.Stats_Listen, `/`) {
+		if _, _, err := net.SplitHostPort(g.Stats_Listen); err != nil {
+			return ErrInvalidStatsListen
+		}
+	}
+	return nil
+}
+
+// StatsInterval returns how often capture stats are logged, zero means never
+func (g *global) StatsInterval() (d time.Duration) {
+	if g.Stats_Interval != `` {
+		d, _ = time.ParseDuration(g.Stats_Interval)
+	}
+	return
+}
+
+// StatsEnabled reports whether the capture stats are logged or served
+func (g *global) StatsEnabled() bool {
+	return g.Stats_Interval != `` || g.Stats_Listen != ``
+}
+
 func verifyConfig(c *cfgType) error {
 	if err := c.Verify(); err != nil {
 		return err
@@ -127,14 +213,21 @@ func verifyConfig(c *cfgType) error {
 		if strings.ContainsAny(v.Tag_Name, ingest.FORBIDDEN_TAG_SET) {
 			return errors.New("Invalid characters in the \"" + v.Tag_Name + "\"Tag-Name for " + k)
 		}
-		if err := getEnvInt(&v.Snap_Len, defaultSnapLen, envSnapLen); err != nil {
+		defSnapLen := defaultSnapLen
+		if v.DNS_Records != `` || v.TLS_Records != `` || v.Asset_Records != `` {
+			//DNS, TLS, and DHCP messages are parsed from the payload, which the snap length would cut off
+			defSnapLen = maxSnapLen
+		} else if v.Headers_Only {
+			defSnapLen = headersSnapLen
+		}
+		if err := getEnvInt(&v.Snap_Len, defSnapLen, envSnapLen); err != nil {
 			return err
 		}
 		if v.Snap_Len > maxSnapLen || v.Snap_Len < 0 {
 			return errors.New("Invalid snaplen. Must be < 65535 and > 0")
 		}
 		if v.Snap_Len == 0 {
-			v.Snap_Len = defaultSnapLen
+			v.Snap_Len = defSnapLen
 		}
 		if v.Source_Override != `` {
 			if net.ParseIP(v.Source_Override) == nil {
@@ -144,6 +237,260 @@ func verifyConfig(c *cfgType) error {
 		if err := config.LoadEnvVar(&v.BPF_Filter, envBPFFilter, defaultBpfFilter); err != nil {
 			return err
 		}
+		if err := v.verifyCaptureMode(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if err := v.verifyFlows(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if _, err := parseDecapsulate(v.Decapsulate); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if err := v.verifySampling(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if err := v.verifyDNS(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if err := v.verifyTLS(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if err := v.verifyAssets(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+		if err := v.verifyRecordModes(); err != nil {
+			return fmt.Errorf("Sniffer %s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// verifyCaptureMode checks the capture mode and fills in the ring defaults for afpacket sniffers
+func (s *snif) verifyCaptureMode() (err error) {
+	s.Capture_Mode = strings.ToLower(strings.TrimSpace(s.Capture_Mode))
+	switch s.Capture_Mode {
+	case ``, captureModePcap:
+		s.Capture_Mode = captureModePcap
+		if s.Ring_Block_Size != 0 || s.Ring_Block_Count != 0 || s.Ring_Block_Timeout != `` {
+			return ErrRingOptionsNoRing
+		}
+		return
+	case captureModeRing:
+	default:
+		return ErrInvalidCaptureMode
+	}
+	if s.Ring_Block_Size == 0 {
+		s.Ring_Block_Size = defaultRingBlockSize
+	}
+	if s.Ring_Block_Size < 0 || s.Ring_Block_Size%os.Getpagesize() != 0 || s.Ring_Block_Size <= s.Snap_Len {
+		return ErrInvalidRingBlockSize
+	}
+	if s.Ring_Block_Count == 0 {
+		s.Ring_Block_Count = defaultRingBlockCount
+	} else if s.Ring_Block_Count < 0 {
+		return ErrInvalidRingBlockCount
+	}
+	if s.Ring_Block_Timeout != `` {
+		var to time.Duration
+		if to, err = time.ParseDuration(s.Ring_Block_Timeout); err != nil {
+			return fmt.Errorf("Invalid Ring-Block-Timeout %q: %v", s.Ring_Block_Timeout, err)
+		} else if to < time.Millisecond {
+			return ErrInvalidRingBlockTimeout
+		}
+	}
+	return
+}
+
+// ringBlockTimeout returns the Ring-Block-Timeout, the value has already been checked by verifyCaptureMode
+func (s *snif) ringBlockTimeout() time.Duration {
+	if to, err := time.ParseDuration(s.Ring_Block_Timeout); err == nil {
+		return to
+	}
+	return defaultRingBlockTimeout
+}
+
+// verifyFlows checks the flow record options and fills in the default table size
+func (s *snif) verifyFlows() error {
+	if !s.Flow_Records {
+		if s.Flow_Idle_Timeout != `` || s.Flow_Active_Timeout != `` || s.Flow_Max_Entries != 0 {
+			return ErrFlowOptionsNoFlows
+		}
+		return nil
+	}
+	for _, v := range []string{s.Flow_Idle_Timeout, s.Flow_Active_Timeout} {
+		if v == `` {
+			continue
+		}
+		if to, err := time.ParseDuration(v); err != nil {
+			return fmt.Errorf("Invalid flow timeout %q: %v", v, err)
+		} else if to < time.Second {
+			return ErrInvalidFlowTimeout
+		}
+	}
+	if s.Flow_Max_Entries == 0 {
+		s.Flow_Max_Entries = defaultFlowMaxEntries
+	} else if s.Flow_Max_Entries < 0 {
+		return ErrInvalidFlowMaxEntries
+	}
+	return nil
+}
+
+// flowTimeouts returns the idle and active flow timeouts, the values have already been checked by verifyFlows
+func (s *snif) flowTimeouts() (idle, active time.Duration) {
+	var err error
+	if idle, err = time.ParseDuration(s.Flow_Idle_Timeout); err != nil {
+		idle = defaultFlowIdleTimeout
+	}
+	if active, err = time.ParseDuration(s.Flow_Active_Timeout); err != nil {
+		active = defaultFlowActiveTimeout
+	}
+	return
+}
+
+// verifyDNS checks the DNS transaction options
+func (s *snif) verifyDNS() error {
+	s.DNS_Records = strings.ToLower(strings.TrimSpace(s.DNS_Records))
+	switch s.DNS_Records {
+	case ``:
+		if s.DNS_Tag != `` || s.DNS_Timeout != `` {
+			return ErrDNSOptionsNoDNS
+		}
+		return nil
+	case recordsModeOnly:
+		if s.Flow_Records {
+			return ErrDNSOnlyWithFlows
+		}
+	case recordsModeAlongside:
+	default:
+		return ErrInvalidDNSRecords
+	}
+	if s.DNS_Tag != `` {
+		if strings.ContainsAny(s.DNS_Tag, ingest.FORBIDDEN_TAG_SET) {
+			return errors.New("Invalid characters in the \"" + s.DNS_Tag + "\" DNS-Tag")
+		}
+	}
+	if s.DNS_Timeout != `` {
+		if to, err := time.ParseDuration(s.DNS_Timeout); err != nil || to <= 0 {
+			return ErrInvalidDNSTimeout
+		}
+	}
+	return nil
+}
+
+// dnsTimeout returns the DNS-Timeout, the value has already been checked by verifyDNS
+func (s *snif) dnsTimeout() time.Duration {
+	if to, err := time.ParseDuration(s.DNS_Timeout); err == nil {
+		return to
+	}
+	return defaultDNSTimeout
+}
+
+// dnsTag returns the tag for DNS transactions
+func (s *snif) dnsTag() string {
+	if s.DNS_Tag != `` {
+		return s.DNS_Tag
+	}
+	return s.Tag_Name
+}
+
+// verifyTLS checks the TLS hello options
+func (s *snif) verifyTLS() error {
+	s.TLS_Records = strings.ToLower(strings.TrimSpace(s.TLS_Records))
+	switch s.TLS_Records {
+	case ``:
+		if s.TLS_Tag != `` {
+			return ErrTLSOptionsNoTLS
+		}
+		return nil
+	case recordsModeOnly:
+		if s.Flow_Records {
+			return ErrTLSOnlyWithFlows
+		}
+	case recordsModeAlongside:
+	default:
+		return ErrInvalidTLSRecords
+	}
+	if s.TLS_Tag != `` {
+		if strings.ContainsAny(s.TLS_Tag, ingest.FORBIDDEN_TAG_SET) {
+			return errors.New("Invalid characters in the \"" + s.TLS_Tag + "\" TLS-Tag")
+		}
+	}
+	return nil
+}
+
+// tlsTag returns the tag for TLS hellos
+func (s *snif) tlsTag() string {
+	if s.TLS_Tag != `` {
+		return s.TLS_Tag
+	}
+	return s.Tag_Name
+}
+
+// verifyAssets checks the ARP and DHCP event options
+func (s *snif) verifyAssets() error {
+	s.Asset_Records = strings.ToLower(strings.TrimSpace(s.Asset_Records))
+	switch s.Asset_Records {
+	case ``:
+		if s.Asset_Tag != `` {
+			return ErrAssetOptionsNoAssets
+		}
+		return nil
+	case recordsModeOnly:
+		if s.Flow_Records {
+			return ErrAssetOnlyWithFlows
+		}
+	case recordsModeAlongside:
+	default:
+		return ErrInvalidAssetRecords
+	}
+	if s.Asset_Tag != `` {
+		if strings.ContainsAny(s.Asset_Tag, ingest.FORBIDDEN_TAG_SET) {
+			return errors.New("Invalid characters in the \"" + s.Asset_Tag + "\" Asset-Tag")
+		}
+	}
+	return nil
+}
+
+// assetTag returns the tag for ARP and DHCP events
+func (s *snif) assetTag() string {
+	if s.Asset_Tag != `` {
+		return s.Asset_Tag
+	}
+	return s.Tag_Name
+}
+
+// verifyRecordModes makes sure the record options agree on whether the packets are kept
+func (s *snif) verifyRecordModes() error {
+	var mode string
+	for _, m := range []string{s.DNS_Records, s.TLS_Records, s.Asset_Records} {
+		if m == `` {
+			continue
+		} else if mode != `` && m != mode {
+			return ErrRecordsModeMismatch
+		}
+		mode = m
+	}
+	return nil
+}
+
+// recordsOnly reports whether the packets themselves are left out in favor of the DNS, TLS, or asset records
+func (s *snif) recordsOnly() bool {
+	return s.DNS_Records == recordsModeOnly || s.TLS_Records == recordsModeOnly || s.Asset_Records == recordsModeOnly
+}
+
+// verifySampling checks the sampling options, an empty Sample-Mode means deterministic
+func (s *snif) verifySampling() error {
+	if s.Sample_Rate < 0 {
+		return ErrInvalidSampleRate
+	}
+	s.Sample_Mode = strings.ToLower(strings.TrimSpace(s.Sample_Mode))
+	switch s.Sample_Mode {
+	case ``, sampleModeDeterministic, sampleModeRandom:
+	default:
+		return ErrInvalidSampleMode
+	}
+	if s.Sample_Mode != `` && s.Sample_Rate <= 1 {
+		return ErrSampleModeNoSampling
 	}
 	return nil
 }
@@ -153,12 +500,14 @@ func (c *cfgType) Tags() ([]string, error) {
 	var tags []string
 	tagMp := make(map[string]bool, 1)
 	for _, v := range c.Sniffer {
-		if len(v.Tag_Name) == 0 {
-			continue
-		}
-		if _, ok := tagMp[v.Tag_Name]; !ok {
-			tags = append(tags, v.Tag_Name)
-			tagMp[v.Tag_Name] = true
+		for _, tag := range []string{v.Tag_Name, v.DNS_Tag, v.TLS_Tag, v.Asset_Tag} {
+			if len(tag) == 0 {
+				continue
+			}
+			if _, ok := tagMp[tag]; !ok {
+				tags = append(tags, tag)
+				tagMp[tag] = true
+			}
 		}
 	}
 	if len(tags) == 0 {
@@ -0,0 +1,178 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	decapVLAN decapFlags = 1 << iota
+	decapGRE
+	decapVXLAN
+	decapERSPAN
+
+	decapAll = decapVLAN | decapGRE | decapVXLAN | decapERSPAN
+
+	maxDecapDepth = 4
+	vxlanPort     = 4789
+	vxlanLen      = 8
+
+	greChecksum = 0x8000
+	greKey      = 0x2000
+	greSequence = 0x1000
+
+	greProtoERSPAN2 = 0x88be
+	greProtoERSPAN3 = 0x22eb
+)
+
+var (
+	ErrInvalidDecapsulate = errors.New("Decapsulate must be a comma separated list of vlan, gre, vxlan, erspan, or all")
+)
+
+// decapFlags selects the encapsulations stripped from captured packets
+type decapFlags uint8
+
+func parseDecapsulate(v string) (d decapFlags, err error) {
+	for _, n := range strings.Split(v, ",") {
+		switch strings.ToLower(strings.TrimSpace(n)) {
+		case ``:
+		case `vlan`:
+			d |= decapVLAN
+		case `gre`:
+			d |= decapGRE
+		case `vxlan`:
+			d |= decapVXLAN
+		case `erspan`:
+			d |= decapERSPAN
+		case `all`:
+			d |= decapAll
+		default:
+			return 0, ErrInvalidDecapsulate
+		}
+	}
+	return
+}
+
+// decapsulate strips the selected encapsulations from an Ethernet frame so the packet is
+// stored with the inner addresses instead of those of the tunnel endpoints.  Tunnels carrying
+// Ethernet (VXLAN, ERSPAN, and GRE bridging) are replaced by the inner frame, tunnels carrying IP
+// keep the outer MAC addresses in front of the inner packet.  The frame is rewritten in place.
+func decapsulate(data []byte, lt layers.LinkType, d decapFlags) []byte {
+	if d == 0 || (lt != layers.LinkTypeEthernet && lt != layers.LinkTypeLinuxSLL) {
+		return data
+	}
+	for i := 0; i < maxDecapDepth; i++ {
+		if d&decapVLAN != 0 {
+			data = stripVLANs(data)
+		}
+		inner := decapTunnel(data, d)
+		if inner == nil {
+			break
+		}
+		data = inner
+	}
+	return data
+}
+
+// stripVLANs removes 802.1Q and QinQ tags by sliding the MAC addresses up over them
+func stripVLANs(data []byte) []byte {
+	off := 12
+	for len(data) >= off+vlanHeaderLen+2 {
+		et := layers.EthernetType(binary.BigEndian.Uint16(data[off:]))
+		if et != layers.EthernetTypeDot1Q && et != layers.EthernetTypeQinQ {
+			break
+		}
+		off += vlanHeaderLen
+	}
+	if off == 12 {
+		return data
+	}
+	copy(data[off-12:off], data[:12])
+	return data[off-12:]
+}
+
+// decapTunnel returns the inner frame of a GRE, ERSPAN, or VXLAN packet, nil if the
+// packet is not a tunnel that should be stripped
+func decapTunnel(data []byte, d decapFlags) []byte {
+	po := decodeOffsets(data, layers.LinkTypeEthernet)
+	if !po.hasTrans {
+		return nil
+	}
+	off := po.transOff
+	switch po.proto {
+	case layers.IPProtocolGRE:
+		if d&(decapGRE|decapERSPAN) == 0 || len(data) < off+4 {
+			return nil
+		}
+		flags := binary.BigEndian.Uint16(data[off:])
+		proto := binary.BigEndian.Uint16(data[off+2:])
+		if flags&0x7 != 0 {
+			return nil //only version 0 GRE carries frames
+		}
+		off += 4
+		for _, f := range []uint16{greChecksum, greKey, greSequence} {
+			if flags&f != 0 {
+				off += 4
+			}
+		}
+		if len(data) < off {
+			return nil
+		}
+		switch proto {
+		case uint16(layers.EthernetTypeTransparentEthernetBridging):
+			if d&decapGRE != 0 {
+				return innerFrame(data, off)
+			}
+		case uint16(layers.EthernetTypeIPv4), uint16(layers.EthernetTypeIPv6):
+			if d&decapGRE != 0 && off >= ethHeaderLen {
+				//reuse the outer MAC addresses in front of the inner packet
+				start := off - ethHeaderLen
+				copy(data[start:start+12], data[:12])
+				binary.BigEndian.PutUint16(data[start+12:], proto)
+				return data[start:]
+			}
+		case greProtoERSPAN2:
+			if d&decapERSPAN != 0 {
+				//type I has no sequence number and no ERSPAN header
+				if flags&greSequence != 0 {
+					off += 8
+				}
+				return innerFrame(data, off)
+			}
+		case greProtoERSPAN3:
+			if d&decapERSPAN != 0 && len(data) >= off+12 {
+				//the optional platform specific subheader follows when the O bit is set
+				if data[off+11]&0x1 != 0 {
+					off += 8
+				}
+				return innerFrame(data, off+12)
+			}
+		}
+	case layers.IPProtocolUDP:
+		if d&decapVXLAN == 0 || len(data) < off+8+vxlanLen {
+			return nil
+		} else if binary.BigEndian.Uint16(data[off+2:]) != vxlanPort || data[off+8]&0x08 == 0 {
+			return nil
+		}
+		return innerFrame(data, off+8+vxlanLen)
+	}
+	return nil
+}
+
+func innerFrame(data []byte, off int) []byte {
+	if len(data) < off+ethHeaderLen {
+		return nil
+	}
+	return data[off:]
+}
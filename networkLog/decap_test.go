@@ -0,0 +1,249 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	testMAC1 = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	testMAC2 = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+// testPacket serializes the layers with the lengths filled in
+func testPacket(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func testEth(et layers.EthernetType) *layers.Ethernet {
+	return &layers.Ethernet{SrcMAC: testMAC1, DstMAC: testMAC2, EthernetType: et}
+}
+
+func testIPv4(src, dst string, proto layers.IPProtocol) *layers.IPv4 {
+	return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: net.ParseIP(src).To4(), DstIP: net.ParseIP(dst).To4()}
+}
+
+func testIPv6(src, dst string, proto layers.IPProtocol) *layers.IPv6 {
+	return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: net.ParseIP(src), DstIP: net.ParseIP(dst)}
+}
+
+// udpFrame builds an Ethernet frame carrying a UDP datagram over IPv4
+func udpFrame(t *testing.T, src, dst string, sport, dport uint16, payload []byte) []byte {
+	t.Helper()
+	return testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(src, dst, layers.IPProtocolUDP),
+		&layers.UDP{SrcPort: layers.UDPPort(sport), DstPort: layers.UDPPort(dport)}, gopacket.Payload(payload))
+}
+
+// tcpFrame builds an Ethernet frame carrying a TCP segment over IPv4
+func tcpFrame(t *testing.T, src, dst string, sport, dport uint16, payload []byte) []byte {
+	t.Helper()
+	return testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(src, dst, layers.IPProtocolTCP),
+		&layers.TCP{SrcPort: layers.TCPPort(sport), DstPort: layers.TCPPort(dport), PSH: true, ACK: true, Window: 1024}, gopacket.Payload(payload))
+}
+
+// sourceIP returns the source address of the network header in an Ethernet frame
+func sourceIP(data []byte) net.IP {
+	po := decodeOffsets(data, layers.LinkTypeEthernet)
+	switch {
+	case !po.hasNet:
+	case po.et == layers.EthernetTypeIPv4:
+		return net.IP(data[po.netOff+12 : po.netOff+16])
+	case po.et == layers.EthernetTypeIPv6:
+		return net.IP(data[po.netOff+8 : po.netOff+24])
+	}
+	return nil
+}
+
+// prefixes runs fn over every truncation of data, the original is never modified
+func prefixes(data []byte, fn func([]byte)) {
+	for i := 0; i < len(data); i++ {
+		fn(append(make([]byte, 0, i), data[:i]...))
+	}
+}
+
+func TestParseDecapsulate(t *testing.T) {
+	tests := []struct {
+		v string
+		d decapFlags
+	}{
+		{v: ``, d: 0},
+		{v: `vlan`, d: decapVLAN},
+		{v: ` GRE , vxlan`, d: decapGRE | decapVXLAN},
+		{v: `erspan,vlan`, d: decapERSPAN | decapVLAN},
+		{v: `all`, d: decapAll},
+	}
+	for _, tt := range tests {
+		if d, err := parseDecapsulate(tt.v); err != nil || d != tt.d {
+			t.Fatalf("%q parsed to %v %v, expected %v", tt.v, d, err, tt.d)
+		}
+	}
+	if _, err := parseDecapsulate(`vlan,ipip`); err != ErrInvalidDecapsulate {
+		t.Fatal("accepted an unknown encapsulation", err)
+	}
+}
+
+func TestDecapsulate(t *testing.T) {
+	inner := udpFrame(t, `10.9.9.9`, `10.8.8.8`, 1234, 80, []byte(`inner`))
+	innerIP := inner[ethHeaderLen:]
+	innerLen := ethHeaderLen + ipv4HeaderLen + 8 + len(`inner`)
+	vxlan := append([]byte{0x08, 0, 0, 0, 0, 0, 0x2a, 0}, inner...)
+	gre := func(flags, proto uint16, extra int, payload []byte) []byte {
+		hdr := []byte{byte(flags >> 8), byte(flags), byte(proto >> 8), byte(proto)}
+		return append(append(hdr, make([]byte, extra)...), payload...)
+	}
+	erspan3 := append(make([]byte, 12), inner...)
+	tests := []struct {
+		name  string
+		pkt   []byte
+		d     decapFlags
+		src   string
+		inner bool //the result should be the whole inner frame
+	}{
+		{
+			name: `vlan`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeDot1Q), &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4},
+				testIPv4(`10.9.9.9`, `10.8.8.8`, layers.IPProtocolUDP), &layers.UDP{SrcPort: 1234, DstPort: 80}, gopacket.Payload(`inner`)),
+			d: decapVLAN, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `qinq`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeQinQ), &layers.Dot1Q{VLANIdentifier: 100, Type: layers.EthernetTypeDot1Q},
+				&layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4},
+				testIPv4(`10.9.9.9`, `10.8.8.8`, layers.IPProtocolUDP), &layers.UDP{SrcPort: 1234, DstPort: 80}, gopacket.Payload(`inner`)),
+			d: decapVLAN, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `vxlan`,
+			pkt:  udpFrame(t, `192.168.0.1`, `192.168.0.2`, 5555, vxlanPort, vxlan),
+			d:    decapVXLAN, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `vxlan not selected`,
+			pkt:  udpFrame(t, `192.168.0.1`, `192.168.0.2`, 5555, vxlanPort, vxlan),
+			d:    decapGRE, src: `192.168.0.1`,
+		},
+		{
+			name: `vxlan without the I flag`,
+			pkt:  udpFrame(t, `192.168.0.1`, `192.168.0.2`, 5555, vxlanPort, append([]byte{0, 0, 0, 0, 0, 0, 0x2a, 0}, inner...)),
+			d:    decapAll, src: `192.168.0.1`,
+		},
+		{
+			name: `gre bridging`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(0, uint16(layers.EthernetTypeTransparentEthernetBridging), 0, inner))),
+			d: decapGRE, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `gre ip with key and sequence`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(greKey|greSequence, uint16(layers.EthernetTypeIPv4), 8, innerIP))),
+			d: decapGRE, src: `10.9.9.9`,
+		},
+		{
+			name: `gre version 1`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(1, uint16(layers.EthernetTypeIPv4), 0, innerIP))),
+			d: decapAll, src: `192.168.0.1`,
+		},
+		{
+			name: `erspan type II`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(greSequence, greProtoERSPAN2, 4+8, inner))),
+			d: decapERSPAN, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `erspan type I`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(0, greProtoERSPAN2, 0, inner))),
+			d: decapERSPAN, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `erspan type III`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(greSequence, greProtoERSPAN3, 4, erspan3))),
+			d: decapERSPAN, src: `10.9.9.9`, inner: true,
+		},
+		{
+			name: `erspan not selected`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv4), testIPv4(`192.168.0.1`, `192.168.0.2`, layers.IPProtocolGRE),
+				gopacket.Payload(gre(0, greProtoERSPAN2, 0, inner))),
+			d: decapGRE, src: `192.168.0.1`,
+		},
+		{
+			name: `vlan inside vxlan`,
+			pkt: udpFrame(t, `192.168.0.1`, `192.168.0.2`, 5555, vxlanPort, append([]byte{0x08, 0, 0, 0, 0, 0, 0x2a, 0},
+				testPacket(t, testEth(layers.EthernetTypeDot1Q), &layers.Dot1Q{VLANIdentifier: 10, Type: layers.EthernetTypeIPv4},
+					testIPv4(`10.9.9.9`, `10.8.8.8`, layers.IPProtocolUDP), &layers.UDP{SrcPort: 1234, DstPort: 80}, gopacket.Payload(`inner`))...)),
+			d: decapVXLAN | decapVLAN, src: `10.9.9.9`, inner: true,
+		},
+	}
+	for _, tt := range tests {
+		out := decapsulate(append([]byte(nil), tt.pkt...), layers.LinkTypeEthernet, tt.d)
+		if ip := sourceIP(out); !ip.Equal(net.ParseIP(tt.src)) {
+			t.Fatalf("%s decapsulated to source %v, expected %s", tt.name, ip, tt.src)
+		} else if tt.inner && (len(out) < innerLen || !bytes.Equal(out[:innerLen], inner[:innerLen])) {
+			//ethernet padding may follow the frame
+			t.Fatalf("%s decapsulated to %x, expected %x", tt.name, out, inner[:innerLen])
+		}
+		//truncated packets are left alone or cut down, never read past
+		prefixes(tt.pkt, func(b []byte) {
+			if out := decapsulate(b, layers.LinkTypeEthernet, decapAll); len(out) > len(b) {
+				t.Fatalf("%s grew a truncated packet from %d to %d bytes", tt.name, len(b), len(out))
+			}
+		})
+	}
+	//other link types and an empty selection are not touched
+	pkt := udpFrame(t, `192.168.0.1`, `192.168.0.2`, 5555, vxlanPort, vxlan)
+	if out := decapsulate(pkt, layers.LinkTypeEthernet, 0); !bytes.Equal(out, pkt) {
+		t.Fatal("decapsulated without any encapsulations selected")
+	} else if out = decapsulate(pkt[ethHeaderLen:], layers.LinkTypeRaw, decapAll); !bytes.Equal(out, pkt[ethHeaderLen:]) {
+		t.Fatal("decapsulated a raw IP packet")
+	}
+}
+
+func TestDecodeOffsetsMalformed(t *testing.T) {
+	pkts := [][]byte{
+		udpFrame(t, `10.0.0.1`, `10.0.0.2`, 1234, 53, []byte(`payload`)),
+		tcpFrame(t, `10.0.0.1`, `10.0.0.2`, 1234, 443, []byte(`payload`)),
+		testPacket(t, testEth(layers.EthernetTypeIPv6), testIPv6(`fd00::1`, `fd00::2`, layers.IPProtocolUDP),
+			&layers.UDP{SrcPort: 1234, DstPort: 53}, gopacket.Payload(`payload`)),
+		//hop by hop header claiming more than the packet holds
+		testPacket(t, testEth(layers.EthernetTypeIPv6), testIPv6(`fd00::1`, `fd00::2`, layers.IPProtocolIPv6HopByHop),
+			gopacket.Payload([]byte{byte(layers.IPProtocolTCP), 0xff, 0, 0, 0, 0, 0, 0})),
+	}
+	//an IPv4 header length of zero and of the maximum
+	for _, ihl := range []byte{0x40, 0x4f} {
+		p := udpFrame(t, `10.0.0.1`, `10.0.0.2`, 1234, 53, []byte(`payload`))
+		p[ethHeaderLen] = ihl
+		pkts = append(pkts, p)
+	}
+	for _, p := range pkts {
+		prefixes(p, func(b []byte) {
+			if l := headerLength(b, layers.LinkTypeEthernet); l > len(b) {
+				t.Fatalf("header length %d is beyond %d bytes", l, len(b))
+			}
+			if l := headerLength(b, layers.LinkTypeRaw); l > len(b) {
+				t.Fatalf("header length %d is beyond %d bytes", l, len(b))
+			}
+		})
+		if l := headerLength(p, layers.LinkTypeEthernet); l > len(p) {
+			t.Fatalf("header length %d is beyond %d bytes", l, len(p))
+		}
+	}
+}
@@ -0,0 +1,325 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	dnsPort  = 53
+	mdnsPort = 5353
+
+	defaultDNSTimeout  = 5 * time.Second
+	maxDNSPending      = 64 * 1024
+	dnsTCPLengthPrefix = 2
+)
+
+var (
+	ErrInvalidDNSRecords = errors.New("DNS-Records must be only or alongside")
+	ErrDNSOptionsNoDNS   = errors.New("DNS-Tag and DNS-Timeout require DNS-Records")
+	ErrDNSOnlyWithFlows  = errors.New("DNS-Records=only cannot be combined with Flow-Records, use DNS-Records=alongside")
+	ErrInvalidDNSTimeout = errors.New("DNS-Timeout must be a positive duration such as 5s")
+
+	errDNSMalformed = errors.New("malformed DNS message")
+
+	dnsRcodes = map[layers.DNSResponseCode]string{
+		layers.DNSResponseCodeNoErr:    `NOERROR`,
+		layers.DNSResponseCodeFormErr:  `FORMERR`,
+		layers.DNSResponseCodeServFail: `SERVFAIL`,
+		layers.DNSResponseCodeNXDomain: `NXDOMAIN`,
+		layers.DNSResponseCodeNotImp:   `NOTIMP`,
+		layers.DNSResponseCodeRefused:  `REFUSED`,
+		layers.DNSResponseCodeYXDomain: `YXDOMAIN`,
+		layers.DNSResponseCodeYXRRSet:  `YXRRSET`,
+		layers.DNSResponseCodeNXRRSet:  `NXRRSET`,
+		layers.DNSResponseCodeNotAuth:  `NOTAUTH`,
+		layers.DNSResponseCodeNotZone:  `NOTZONE`,
+	}
+)
+
+// dnsRecord is the JSON form of a DNS transaction, a query and the response that answered it.
+// Queries that are never answered are reported with TimedOut set once the DNS-Timeout passes,
+// responses whose query was not seen have no Query time or Latency.
+type dnsRecord struct {
+	Client     net.IP
+	ClientPort uint16
+	Server     net.IP
+	ServerPort uint16
+	Transport  string
+	ID         uint16
+	QName      string
+	QType      string
+	RCode      string      `json:",omitempty"`
+	Answers    []dnsAnswer `json:",omitempty"`
+	Query      *time.Time  `json:",omitempty"`
+	Response   *time.Time  `json:",omitempty"`
+	Latency    float64     `json:",omitempty"` //seconds
+	TimedOut   bool        `json:",omitempty"`
+
+	ts time.Time
+}
+
+type dnsAnswer struct {
+	Name string
+	Type string
+	TTL  uint32
+	Data string `json:",omitempty"`
+}
+
+// dnsTxnKey identifies a transaction, the client side is where the query came from
+type dnsTxnKey struct {
+	client, server [16]byte
+	cport, sport   uint16
+	tcp            bool
+	id             uint16
+}
+
+type dnsPending struct {
+	rec  dnsRecord
+	seen time.Time //wall clock time the query was seen, used for the timeout
+}
+
+// dnsTracker matches DNS queries with their responses to build transaction records.
+// Multicast DNS messages are not answered by the host they were sent to so each
+// one is reported on its own.
+type dnsTracker struct {
+	pending map[dnsTxnKey]*dnsPending
+	timeout time.Duration
+}
+
+func newDNSTracker(timeout time.Duration) *dnsTracker {
+	return &dnsTracker{
+		pending: map[dnsTxnKey]*dnsPending{},
+		timeout: timeout,
+	}
+}
+
+// add parses a captured packet and returns the transactions it completes
+func (dt *dnsTracker) add(data []byte, ts time.Time, lt layers.LinkType, now time.Time) (recs []dnsRecord) {
+	k, msg, ok := dnsMessage(data, lt)
+	if !ok {
+		return
+	}
+	var dns layers.DNS
+	if err := decodeDNS(msg, &dns); err != nil {
+		return
+	}
+	k.id = dns.ID
+	if dns.QR {
+		//responses travel from the server back to the client
+		k.client, k.server = k.server, k.client
+		k.cport, k.sport = k.sport, k.cport
+	}
+	if k.cport == mdnsPort || k.sport == mdnsPort {
+		rec := newDNSRecord(k, &dns)
+		rec.ts = ts
+		if dns.QR {
+			rec.setResponse(&dns, ts)
+		} else {
+			rec.Query = timePtr(ts)
+		}
+		return []dnsRecord{rec}
+	}
+	if !dns.QR {
+		if len(dt.pending) >= maxDNSPending {
+			//a flood of unanswered queries, report them rather than growing without bound
+			recs = dt.expire(now, true)
+		}
+		rec := newDNSRecord(k, &dns)
+		rec.ts = ts
+		rec.Query = timePtr(ts)
+		dt.pending[k] = &dnsPending{rec: rec, seen: now}
+		return
+	}
+	if p, ok := dt.pending[k]; ok {
+		delete(dt.pending, k)
+		p.rec.setResponse(&dns, ts)
+		return append(recs, p.rec)
+	}
+	rec := newDNSRecord(k, &dns)
+	rec.ts = ts
+	rec.setResponse(&dns, ts)
+	return append(recs, rec)
+}
+
+// decodeDNS decodes a DNS message, the gopacket decoder does not check that the fixed fields
+// of questions and resource records fit in the message so a malformed message can panic
+func decodeDNS(msg []byte, dns *layers.DNS) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errDNSMalformed
+		}
+	}()
+	return dns.DecodeFromBytes(msg, gopacket.NilDecodeFeedback)
+}
+
+// expire returns the queries that have gone unanswered for the timeout, all pending
+// queries are returned when all is set
+func (dt *dnsTracker) expire(now time.Time, all bool) (recs []dnsRecord) {
+	for k, p := range dt.pending {
+		if all || now.Sub(p.seen) >= dt.timeout {
+			p.rec.TimedOut = true
+			recs = append(recs, p.rec)
+			delete(dt.pending, k)
+		}
+	}
+	return
+}
+
+// dnsMessage locates the DNS message in a UDP or TCP packet to or from a DNS port, the key is
+// filled in from the point of view of the sender.  Only TCP segments holding a whole message
+// are parsed.
+func dnsMessage(data []byte, lt layers.LinkType) (k dnsTxnKey, msg []byte, ok bool) {
+	po := decodeOffsets(data, lt)
+	if !po.hasTrans || po.transEnd > len(data) || len(data) < po.transOff+4 {
+		return
+	}
+	k.cport = binary.BigEndian.Uint16(data[po.transOff:])
+	k.sport = binary.BigEndian.Uint16(data[po.transOff+2:])
+	if !isDNSPort(k.cport) && !isDNSPort(k.sport) {
+		return
+	}
+	msg = data[po.transEnd:]
+	switch po.proto {
+	case layers.IPProtocolUDP:
+	case layers.IPProtocolTCP:
+		if len(msg) < dnsTCPLengthPrefix {
+			return
+		}
+		l := int(binary.BigEndian.Uint16(msg))
+		if msg = msg[dnsTCPLengthPrefix:]; len(msg) < l {
+			return
+		}
+		msg = msg[:l]
+		k.tcp = true
+	default:
+		return
+	}
+	switch po.et {
+	case layers.EthernetTypeIPv4:
+		copy(k.client[:], net.IP(data[po.netOff+12:po.netOff+16]).To16())
+		copy(k.server[:], net.IP(data[po.netOff+16:po.netOff+20]).To16())
+	case layers.EthernetTypeIPv6:
+		copy(k.client[:], data[po.netOff+8:po.netOff+24])
+		copy(k.server[:], data[po.netOff+24:po.netOff+40])
+	}
+	ok = len(msg) > 0
+	return
+}
+
+func isDNSPort(p uint16) bool {
+	return p == dnsPort || p == mdnsPort
+}
+
+func newDNSRecord(k dnsTxnKey, dns *layers.DNS) (rec dnsRecord) {
+	rec = dnsRecord{
+		Client:     shortIP(k.client),
+		ClientPort: k.cport,
+		Server:     shortIP(k.server),
+		ServerPort: k.sport,
+		Transport:  `udp`,
+		ID:         k.id,
+	}
+	if k.tcp {
+		rec.Transport = `tcp`
+	}
+	if len(dns.Questions) > 0 {
+		rec.QName = string(dns.Questions[0].Name)
+		rec.QType = dnsTypeString(dns.Questions[0].Type)
+	}
+	return
+}
+
+func (rec *dnsRecord) setResponse(dns *layers.DNS, ts time.Time) {
+	rec.Response = timePtr(ts)
+	if rec.Query != nil {
+		rec.Latency = ts.Sub(*rec.Query).Seconds()
+	}
+	if rc, ok := dnsRcodes[dns.ResponseCode]; ok {
+		rec.RCode = rc
+	} else {
+		rec.RCode = strconv.Itoa(int(dns.ResponseCode))
+	}
+	if rec.QName == `` && len(dns.Questions) > 0 {
+		rec.QName = string(dns.Questions[0].Name)
+		rec.QType = dnsTypeString(dns.Questions[0].Type)
+	}
+	for _, rr := range dns.Answers {
+		rec.Answers = append(rec.Answers, dnsAnswer{
+			Name: string(rr.Name),
+			Type: dnsTypeString(rr.Type),
+			TTL:  rr.TTL,
+			Data: dnsAnswerData(&rr),
+		})
+	}
+}
+
+func (rec dnsRecord) encode() ([]byte, error) {
+	return json.Marshal(rec)
+}
+
+// dnsTypeString returns the mnemonic of a record type, unknown types use the RFC 3597 form
+func dnsTypeString(t layers.DNSType) string {
+	if s := t.String(); s != `Unknown` {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+func dnsAnswerData(rr *layers.DNSResourceRecord) string {
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		if rr.IP != nil {
+			return rr.IP.String()
+		}
+	case layers.DNSTypeCNAME:
+		return string(rr.CNAME)
+	case layers.DNSTypeNS:
+		return string(rr.NS)
+	case layers.DNSTypePTR:
+		return string(rr.PTR)
+	case layers.DNSTypeMX:
+		return fmt.Sprintf("%d %s", rr.MX.Preference, rr.MX.Name)
+	case layers.DNSTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", rr.SRV.Priority, rr.SRV.Weight, rr.SRV.Port, rr.SRV.Name)
+	case layers.DNSTypeSOA:
+		return fmt.Sprintf("%s %s %d", rr.SOA.MName, rr.SOA.RName, rr.SOA.Serial)
+	case layers.DNSTypeTXT:
+		txts := make([]string, 0, len(rr.TXTs))
+		for _, t := range rr.TXTs {
+			txts = append(txts, string(t))
+		}
+		return strings.Join(txts, ` `)
+	}
+	return ``
+}
+
+// shortIP hands back 4 byte addresses so IPv4 addresses render as dotted quads
+func shortIP(b [16]byte) net.IP {
+	ip := net.IP(append([]byte(nil), b[:]...))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
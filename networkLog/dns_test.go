@@ -0,0 +1,210 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func testDNS(t *testing.T, id uint16, qr bool, name string, answers ...layers.DNSResourceRecord) []byte {
+	t.Helper()
+	dns := &layers.DNS{
+		ID:        id,
+		QR:        qr,
+		RD:        true,
+		Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers:   answers,
+	}
+	if qr {
+		dns.RA = true
+		if len(answers) == 0 {
+			dns.ResponseCode = layers.DNSResponseCodeNXDomain
+		}
+	}
+	return testPacket(t, dns)
+}
+
+func testA(name, ip string, ttl uint32) layers.DNSResourceRecord {
+	return layers.DNSResourceRecord{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: ttl, IP: net.ParseIP(ip).To4()}
+}
+
+// tcpDNS prefixes a DNS message with its TCP length
+func tcpDNS(msg []byte) []byte {
+	b := make([]byte, dnsTCPLengthPrefix, dnsTCPLengthPrefix+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	return append(b, msg...)
+}
+
+func TestDNSTransactions(t *testing.T) {
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	later := start.Add(20 * time.Millisecond)
+	query := udpFrame(t, `10.0.0.5`, `10.0.0.53`, 40000, dnsPort, testDNS(t, 0x1234, false, `example.com`))
+	resp := udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, testDNS(t, 0x1234, true, `example.com`, testA(`example.com`, `93.184.216.34`, 300)))
+
+	dt := newDNSTracker(defaultDNSTimeout)
+	if recs := dt.add(query, start, layers.LinkTypeEthernet, start); len(recs) != 0 {
+		t.Fatalf("query completed %d records", len(recs))
+	}
+	//a response with another ID or from another port does not answer the query
+	other := udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, testDNS(t, 0x4321, true, `example.com`))
+	if recs := dt.add(other, later, layers.LinkTypeEthernet, later); len(recs) != 1 || recs[0].Query != nil || recs[0].RCode != `NXDOMAIN` {
+		t.Fatalf("bad unmatched response %+v", recs)
+	}
+	recs := dt.add(resp, later, layers.LinkTypeEthernet, later)
+	if len(recs) != 1 {
+		t.Fatalf("response completed %d records", len(recs))
+	}
+	rec := recs[0]
+	if !rec.Client.Equal(net.ParseIP(`10.0.0.5`)) || rec.ClientPort != 40000 || !rec.Server.Equal(net.ParseIP(`10.0.0.53`)) || rec.ServerPort != dnsPort {
+		t.Fatalf("bad endpoints %+v", rec)
+	} else if rec.Transport != `udp` || rec.ID != 0x1234 || rec.QName != `example.com` || rec.QType != `A` || rec.RCode != `NOERROR` {
+		t.Fatalf("bad transaction %+v", rec)
+	} else if rec.Query == nil || !rec.Query.Equal(start) || rec.Response == nil || !rec.Response.Equal(later) || rec.Latency != 0.02 {
+		t.Fatalf("bad timing %+v", rec)
+	} else if len(rec.Answers) != 1 || rec.Answers[0] != (dnsAnswer{Name: `example.com`, Type: `A`, TTL: 300, Data: `93.184.216.34`}) {
+		t.Fatalf("bad answers %+v", rec.Answers)
+	}
+	if len(dt.pending) != 0 {
+		t.Fatalf("%d transactions left pending", len(dt.pending))
+	}
+
+	b, err := rec.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	} else if m[`Client`] != `10.0.0.5` || m[`QName`] != `example.com` || m[`TimedOut`] != nil {
+		t.Fatalf("bad JSON %s", b)
+	}
+}
+
+func TestDNSTimeout(t *testing.T) {
+	now := time.Now()
+	dt := newDNSTracker(time.Second)
+	dt.add(udpFrame(t, `10.0.0.5`, `10.0.0.53`, 40000, dnsPort, testDNS(t, 1, false, `a.example`)), now, layers.LinkTypeEthernet, now)
+	dt.add(udpFrame(t, `10.0.0.5`, `10.0.0.53`, 40001, dnsPort, testDNS(t, 2, false, `b.example`)), now, layers.LinkTypeEthernet, now.Add(time.Second))
+	if recs := dt.expire(now.Add(1500*time.Millisecond), false); len(recs) != 1 || !recs[0].TimedOut || recs[0].QName != `a.example` || recs[0].Response != nil {
+		t.Fatalf("bad expired queries %+v", recs)
+	}
+	if recs := dt.expire(now, true); len(recs) != 1 || recs[0].QName != `b.example` {
+		t.Fatalf("bad flushed queries %+v", recs)
+	} else if len(dt.pending) != 0 {
+		t.Fatalf("%d transactions left pending", len(dt.pending))
+	}
+}
+
+func TestDNSTransports(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		pkt       []byte
+		lt        layers.LinkType
+		transport string
+		client    string
+	}{
+		{
+			name:      `tcp`,
+			pkt:       tcpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, tcpDNS(testDNS(t, 7, true, `example.com`))),
+			lt:        layers.LinkTypeEthernet,
+			transport: `tcp`, client: `10.0.0.5`,
+		},
+		{
+			name: `ipv6`,
+			pkt: testPacket(t, testEth(layers.EthernetTypeIPv6), testIPv6(`fd00::53`, `fd00::5`, layers.IPProtocolUDP),
+				&layers.UDP{SrcPort: dnsPort, DstPort: 40000}, gopacket.Payload(testDNS(t, 7, true, `example.com`))),
+			lt:        layers.LinkTypeEthernet,
+			transport: `udp`, client: `fd00::5`,
+		},
+		{
+			name:      `raw`,
+			pkt:       udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, testDNS(t, 7, true, `example.com`))[ethHeaderLen:],
+			lt:        layers.LinkTypeRaw,
+			transport: `udp`, client: `10.0.0.5`,
+		},
+		{
+			//multicast DNS is reported without waiting for an answer
+			name:      `mdns`,
+			pkt:       udpFrame(t, `10.0.0.5`, `224.0.0.251`, mdnsPort, mdnsPort, testDNS(t, 0, false, `printer.local`)),
+			lt:        layers.LinkTypeEthernet,
+			transport: `udp`, client: `10.0.0.5`,
+		},
+	}
+	for _, tt := range tests {
+		dt := newDNSTracker(defaultDNSTimeout)
+		recs := dt.add(tt.pkt, now, tt.lt, now)
+		if len(recs) != 1 {
+			t.Fatalf("%s completed %d records", tt.name, len(recs))
+		} else if recs[0].Transport != tt.transport || !recs[0].Client.Equal(net.ParseIP(tt.client)) {
+			t.Fatalf("%s bad record %+v", tt.name, recs[0])
+		}
+	}
+}
+
+func TestDNSMalformed(t *testing.T) {
+	now := time.Now()
+	msg := testDNS(t, 9, true, `example.com`, testA(`example.com`, `93.184.216.34`, 300))
+	pkts := map[string][]byte{
+		`udp`: udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, msg),
+		`tcp`: tcpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, tcpDNS(msg)),
+	}
+	for name, pkt := range pkts {
+		dt := newDNSTracker(defaultDNSTimeout)
+		prefixes(pkt, func(b []byte) {
+			if recs := dt.add(b, now, layers.LinkTypeEthernet, now); len(recs) > 1 {
+				t.Fatalf("%s truncated to %d bytes completed %d records", name, len(b), len(recs))
+			}
+		})
+		//any byte of the DNS message may be garbage
+		for i := len(pkt) - len(msg); i < len(pkt); i++ {
+			b := append([]byte(nil), pkt...)
+			b[i] = 0xff
+			dt.add(b, now, layers.LinkTypeEthernet, now)
+		}
+	}
+	//TCP segments that do not hold the whole message are skipped
+	short := tcpDNS(msg)
+	binary.BigEndian.PutUint16(short, uint16(len(msg)+1))
+	dt := newDNSTracker(defaultDNSTimeout)
+	if recs := dt.add(tcpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, short), now, layers.LinkTypeEthernet, now); len(recs) != 0 {
+		t.Fatalf("parsed a partial TCP message %+v", recs)
+	}
+	//traffic on other ports and payloads that are not DNS
+	for _, pkt := range [][]byte{
+		udpFrame(t, `10.0.0.53`, `10.0.0.5`, 5300, 40000, msg),
+		udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, []byte(`not a dns message`)),
+		udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, nil),
+		//an answer whose type, class, and TTL fit but whose data length is cut off, which panics gopacket
+		udpFrame(t, `10.0.0.53`, `10.0.0.5`, dnsPort, 40000, []byte{
+			0, 1, 0x81, 0x80, 0, 0, 0, 1, 0, 0, 0, 0,
+			3, 'a', 'b', 'c', 0,
+			0, 1, 0, 1, 0, 0, 0, 60,
+		}),
+	} {
+		//captured frames have no spare capacity to hide reads past the end
+		if recs := dt.add(pkt[:len(pkt):len(pkt)], now, layers.LinkTypeEthernet, now); len(recs) != 0 {
+			t.Fatalf("parsed %x into %+v", pkt, recs)
+		}
+	}
+}
+
+func TestDNSTypeString(t *testing.T) {
+	if s := dnsTypeString(layers.DNSTypeAAAA); s != `AAAA` {
+		t.Fatal("bad type", s)
+	} else if s = dnsTypeString(layers.DNSType(65280)); s != `TYPE65280` {
+		t.Fatal("bad unknown type", s)
+	}
+}
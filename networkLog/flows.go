@@ -0,0 +1,171 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+var tcpFlagNames = []string{`FIN`, `SYN`, `RST`, `PSH`, `ACK`, `URG`, `ECE`, `CWR`}
+
+// flowKey is the 5-tuple of a unidirectional flow, IPv4 addresses are stored in their 16 byte form
+type flowKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+	proto        layers.IPProtocol
+}
+
+type flowState struct {
+	start, end time.Time
+	lastSeen   time.Time //wall clock time of the last packet, used for the idle timeout
+	packets    uint64
+	bytes      uint64
+	flags      uint8
+}
+
+// flowRecord is the JSON form of an expired flow that is ingested in place of its packets
+type flowRecord struct {
+	Src      net.IP
+	Dst      net.IP
+	SrcPort  uint16 `json:",omitempty"`
+	DstPort  uint16 `json:",omitempty"`
+	Protocol uint8
+	Packets  uint64
+	Bytes    uint64
+	Start    time.Time
+	End      time.Time
+	Duration float64 //seconds
+	TCPFlags string  `json:",omitempty"`
+}
+
+// flowTable aggregates captured packets into unidirectional flow records.  A flow is expired
+// when no packets arrive for the idle timeout or when it has been open for the active timeout,
+// long lived connections are reported as a series of records.  When the table is full every
+// flow is expired so memory stays bounded during scans and floods.
+type flowTable struct {
+	flows  map[flowKey]*flowState
+	idle   time.Duration
+	active time.Duration
+	max    int
+}
+
+func newFlowTable(idle, active time.Duration, max int) *flowTable {
+	return &flowTable{
+		flows:  map[flowKey]*flowState{},
+		idle:   idle,
+		active: active,
+		max:    max,
+	}
+}
+
+// add counts a captured packet, wireLen is the length of the packet on the wire so flows are
+// sized correctly even when the capture was truncated.  Packets that are not IP are ignored.
+// The return value is false when the table is full and should be expired.
+func (ft *flowTable) add(data []byte, wireLen int, ts time.Time, lt layers.LinkType, now time.Time) bool {
+	k, flags, ok := packetFlowKey(data, lt)
+	if !ok {
+		return true
+	}
+	fs, ok := ft.flows[k]
+	if !ok {
+		fs = &flowState{start: ts, end: ts}
+		ft.flows[k] = fs
+	}
+	if ts.Before(fs.start) {
+		fs.start = ts
+	} else if ts.After(fs.end) {
+		fs.end = ts
+	}
+	fs.lastSeen = now
+	fs.packets++
+	fs.bytes += uint64(wireLen)
+	fs.flags |= flags
+	return len(ft.flows) < ft.max
+}
+
+// expire removes and returns the flows that have gone idle or been active too long, all
+// flows are returned when all is set
+func (ft *flowTable) expire(now time.Time, all bool) (recs []flowRecord) {
+	for k, fs := range ft.flows {
+		if all || now.Sub(fs.lastSeen) >= ft.idle || fs.end.Sub(fs.start) >= ft.active {
+			recs = append(recs, k.record(fs))
+			delete(ft.flows, k)
+		}
+	}
+	return
+}
+
+// packetFlowKey extracts the flow key and TCP flags of an IP packet, ports are left
+// at zero for protocols without them and for fragments after the first
+func packetFlowKey(data []byte, lt layers.LinkType) (k flowKey, flags uint8, ok bool) {
+	po := decodeOffsets(data, lt)
+	if !po.hasNet {
+		return
+	}
+	k.proto = po.proto
+	switch po.et {
+	case layers.EthernetTypeIPv4:
+		copy(k.src[:], net.IP(data[po.netOff+12:po.netOff+16]).To16())
+		copy(k.dst[:], net.IP(data[po.netOff+16:po.netOff+20]).To16())
+	case layers.EthernetTypeIPv6:
+		copy(k.src[:], data[po.netOff+8:po.netOff+24])
+		copy(k.dst[:], data[po.netOff+24:po.netOff+40])
+	}
+	if po.hasTrans && len(data) >= po.transOff+4 {
+		switch po.proto {
+		case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP:
+			k.sport = binary.BigEndian.Uint16(data[po.transOff:])
+			k.dport = binary.BigEndian.Uint16(data[po.transOff+2:])
+		}
+		if po.proto == layers.IPProtocolTCP && len(data) > po.transOff+13 {
+			flags = data[po.transOff+13]
+		}
+	}
+	ok = true
+	return
+}
+
+func (k flowKey) record(fs *flowState) flowRecord {
+	fr := flowRecord{
+		Src:      shortIP(k.src),
+		Dst:      shortIP(k.dst),
+		SrcPort:  k.sport,
+		DstPort:  k.dport,
+		Protocol: uint8(k.proto),
+		Packets:  fs.packets,
+		Bytes:    fs.bytes,
+		Start:    fs.start,
+		End:      fs.end,
+		Duration: fs.end.Sub(fs.start).Seconds(),
+	}
+	if k.proto == layers.IPProtocolTCP {
+		fr.TCPFlags = tcpFlagString(fs.flags)
+	}
+	return fr
+}
+
+func tcpFlagString(flags uint8) string {
+	var names []string
+	for i, n := range tcpFlagNames {
+		if flags&(1<<uint(i)) != 0 {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, `,`)
+}
+
+func (fr flowRecord) encode() ([]byte, error) {
+	return json.Marshal(fr)
+}
@@ -0,0 +1,156 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	ethHeaderLen  = 14
+	vlanHeaderLen = 4
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+// packetOffsets locates the network and transport headers of a captured packet
+type packetOffsets struct {
+	et        layers.EthernetType
+	proto     layers.IPProtocol
+	netOff    int  //start of the IP header
+	transOff  int  //start of the transport header, valid when hasTrans is set
+	transEnd  int  //end of the transport header, valid when hasTrans is set
+	hasNet    bool //the IP header was fully captured
+	hasTrans  bool //the transport header was located, later fragments do not have one
+	truncated bool //the packet ended before the headers could be located
+}
+
+// decodeOffsets walks the link, network, and transport headers without decoding whole layers.
+// Cooked captures must already be trimmed so the protocol lines up with the EtherType.
+func decodeOffsets(data []byte, lt layers.LinkType) (po packetOffsets) {
+	switch lt {
+	case layers.LinkTypeEthernet, layers.LinkTypeLinuxSLL:
+		if len(data) < ethHeaderLen {
+			po.truncated = true
+			return
+		}
+		po.netOff = ethHeaderLen
+		po.et = layers.EthernetType(binary.BigEndian.Uint16(data[12:]))
+		for po.et == layers.EthernetTypeDot1Q || po.et == layers.EthernetTypeQinQ {
+			if len(data) < po.netOff+vlanHeaderLen {
+				po.truncated = true
+				return
+			}
+			po.et = layers.EthernetType(binary.BigEndian.Uint16(data[po.netOff+2:]))
+			po.netOff += vlanHeaderLen
+		}
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) == 0 {
+			po.truncated = true
+			return
+		}
+		po.et = layers.EthernetTypeIPv4
+		if data[0]>>4 == 6 {
+			po.et = layers.EthernetTypeIPv6
+		}
+	default:
+		return
+	}
+
+	off := po.netOff
+	switch po.et {
+	case layers.EthernetTypeIPv4:
+		if len(data) < off+ipv4HeaderLen {
+			po.truncated = true
+			return
+		}
+		po.proto = layers.IPProtocol(data[off+9])
+		po.hasNet = true
+		//only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(data[off+6:])&0x1fff != 0 {
+			po.transOff = off + int(data[off]&0x0f)*4
+			return
+		}
+		off += int(data[off]&0x0f) * 4
+	case layers.EthernetTypeIPv6:
+		if len(data) < off+ipv6HeaderLen {
+			po.truncated = true
+			return
+		}
+		po.proto = layers.IPProtocol(data[off+6])
+		po.hasNet = true
+		off += ipv6HeaderLen
+		//walk the extension headers that carry a length
+		for po.proto == layers.IPProtocolIPv6HopByHop || po.proto == layers.IPProtocolIPv6Routing || po.proto == layers.IPProtocolIPv6Destination {
+			if len(data) < off+2 {
+				po.truncated = true
+				return
+			}
+			po.proto = layers.IPProtocol(data[off])
+			off += (int(data[off+1]) + 1) * 8
+		}
+		if po.proto == layers.IPProtocolIPv6Fragment {
+			if len(data) < off+8 {
+				po.truncated = true
+				return
+			}
+			po.proto = layers.IPProtocol(data[off])
+			off += 8
+			if binary.BigEndian.Uint16(data[off-6:])&0xfff8 != 0 {
+				po.transOff = off
+				return
+			}
+		}
+	default:
+		return
+	}
+
+	po.transOff = off
+	switch po.proto {
+	case layers.IPProtocolTCP:
+		if len(data) < off+ipv4HeaderLen {
+			po.truncated = true
+			return
+		}
+		po.transEnd = off + int(data[off+12]>>4)*4
+	case layers.IPProtocolUDP, layers.IPProtocolICMPv4, layers.IPProtocolICMPv6:
+		po.transEnd = off + 8
+	default:
+		po.transEnd = off
+	}
+	po.hasTrans = true
+	return
+}
+
+// headerLength returns the number of bytes in the packet up to the end of the transport
+// header, payloads are what fill storage and most analysis only needs the headers.
+// Packets that cannot be parsed far enough are kept whole (up to the snap length).
+func headerLength(data []byte, lt layers.LinkType) int {
+	po := decodeOffsets(data, lt)
+	switch {
+	case po.truncated:
+		return len(data)
+	case po.hasTrans:
+		return clampLen(po.transEnd, data)
+	case po.hasNet:
+		return clampLen(po.transOff, data)
+	case po.et == layers.EthernetTypeARP || po.netOff == 0:
+		return len(data)
+	}
+	return clampLen(po.netOff, data)
+}
+
+func clampLen(l int, data []byte) int {
+	if l > len(data) {
+		return len(data)
+	}
+	return l
+}
@@ -0,0 +1,179 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingesters/v3/utils"
+	"github.com/gravwell/ingesters/v3/version"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	importReadBuffer = 4 * 1024 * 1024
+)
+
+// importPcap ingests the packets of every pcap or pcapng file matching the pattern using the
+// backends from the configuration file, each packet is stamped with the time it was captured
+func importPcap(cfg *cfgType, pattern, tagName string) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	} else if len(files) == 0 {
+		return fmt.Errorf("No files match %s", pattern)
+	}
+	conns, err := cfg.Targets()
+	if err != nil {
+		return fmt.Errorf("Failed to get backend targets from configuration: %v", err)
+	}
+	id, ok := cfg.IngesterUUID()
+	if !ok {
+		return fmt.Errorf("Couldn't read ingester UUID")
+	}
+	igCfg := ingest.UniformMuxerConfig{
+		Destinations:    conns,
+		Tags:            []string{tagName},
+		Auth:            cfg.Secret(),
+		LogLevel:        cfg.LogLevel(),
+		IngesterName:    "networkLog",
+		IngesterVersion: version.GetVersion(),
+		IngesterUUID:    id.String(),
+		VerifyCert:      !cfg.InsecureSkipTLSVerification(),
+		Logger:          lg,
+	}
+	if cfg.EnableCache() {
+		igCfg.EnableCache = true
+		igCfg.CacheConfig.FileBackingLocation = cfg.LocalFileCachePath()
+		igCfg.CacheConfig.MaxCacheSize = cfg.MaxCachedData()
+	}
+	igst, err := ingest.NewUniformMuxer(igCfg)
+	if err != nil {
+		return fmt.Errorf("Failed to create new uniform muxer: %v", err)
+	}
+	defer igst.Close()
+	if err = igst.Start(); err != nil {
+		return fmt.Errorf("Failed start our ingest system: %v", err)
+	} else if err = igst.WaitForHot(cfg.Timeout()); err != nil {
+		return fmt.Errorf("Timedout waiting for backend connections: %v", err)
+	}
+	tag, err := igst.GetTag(tagName)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve tag %s: %v", tagName, err)
+	}
+	var src net.IP
+	if cfg.Source_Override != `` {
+		if src = utils.NormalizeSource(net.ParseIP(cfg.Source_Override)); src == nil {
+			return fmt.Errorf("Global Source-Override is invalid")
+		}
+	} else if src, err = igst.SourceIP(); err != nil {
+		return fmt.Errorf("Failed to get source IP from the ingest muxer: %v", err)
+	}
+
+	var res results
+	start := time.Now()
+	for _, f := range files {
+		r, err := importPcapFile(igst, f, tag, src)
+		addResults(&res, r)
+		if err != nil {
+			return fmt.Errorf("Failed to import %s after %d packets: %v", f, r.Count, err)
+		}
+		lg.Info("Imported %d packets (%s) from %s\n", r.Count, ingest.HumanSize(r.Bytes), f)
+	}
+	if err = igst.Sync(cfg.Timeout()); err != nil {
+		return fmt.Errorf("Failed to sync the ingester: %v", err)
+	}
+	durr := time.Since(start)
+	lg.Info("Imported %s packets (%s) from %d files in %v\n",
+		ingest.HumanCount(res.Count), ingest.HumanSize(res.Bytes), len(files), durr)
+	return nil
+}
+
+func importPcapFile(igst *ingest.IngestMuxer, path string, tag entry.EntryTag, src net.IP) (r results, err error) {
+	var fin *os.File
+	if fin, err = os.Open(path); err != nil {
+		return
+	}
+	defer fin.Close()
+	var pr *pcapFileReader
+	if pr, err = newPcapFileReader(fin); err != nil {
+		return
+	}
+
+	var set []*entry.Entry
+	var setSize int
+	for {
+		var data []byte
+		var ci gopacket.CaptureInfo
+		if data, ci, err = pr.ReadPacketData(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if pr.trimSize > 0 && len(data) > pr.trimSize {
+			data = data[pr.trimSize:]
+		}
+		set = append(set, &entry.Entry{
+			TS:   entry.FromStandard(ci.Timestamp),
+			SRC:  src,
+			Tag:  tag,
+			Data: data,
+		})
+		setSize += len(data)
+		if setSize >= packetsThrowSize {
+			if err = igst.WriteBatch(set); err != nil {
+				return
+			}
+			set, setSize = nil, 0
+		}
+		r.Count++
+		r.Bytes += uint64(len(data))
+	}
+	if err == nil && len(set) > 0 {
+		err = igst.WriteBatch(set)
+	}
+	return
+}
+
+// pcapFileReader reads packets from either a pcap or pcapng file
+type pcapFileReader struct {
+	gopacket.PacketDataSource
+	trimSize int
+}
+
+func newPcapFileReader(fin *os.File) (*pcapFileReader, error) {
+	var pr pcapFileReader
+	var lt layers.LinkType
+	if hnd, err := pcapgo.NewReader(bufio.NewReaderSize(fin, importReadBuffer)); err == nil {
+		pr.PacketDataSource, lt = hnd, hnd.LinkType()
+	} else if _, err = fin.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	} else if nghnd, err := pcapgo.NewNgReader(bufio.NewReaderSize(fin, importReadBuffer), pcapgo.DefaultNgReaderOptions); err != nil {
+		return nil, fmt.Errorf("not a pcap or pcapng file: %v", err)
+	} else {
+		pr.PacketDataSource, lt = nghnd, nghnd.LinkType()
+	}
+	//trim SLL "cooked" captures the same way live captures are trimmed
+	if lt == layers.LinkTypeLinuxSLL {
+		pr.trimSize = 2
+	}
+	return &pr, nil
+}
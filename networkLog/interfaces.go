@@ -0,0 +1,63 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// listInterfaces prints the capture devices with the network interface each belongs to,
+// Npcap device names look like \Device\NPF_{GUID} so the interface name is what goes in the config
+func listInterfaces(w io.Writer) error {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return err
+	}
+	ifaces, _ := net.Interfaces()
+	for _, d := range devs {
+		fmt.Fprintf(w, "%s\n", d.Name)
+		if name := systemInterfaceName(d, ifaces); name != `` && name != d.Name {
+			fmt.Fprintf(w, "\tInterface: %s\n", name)
+		}
+		if d.Description != `` {
+			fmt.Fprintf(w, "\tDescription: %s\n", d.Description)
+		}
+		for _, a := range d.Addresses {
+			fmt.Fprintf(w, "\tAddress: %v\n", a.IP)
+		}
+	}
+	return nil
+}
+
+// systemInterfaceName returns the name of the network interface that holds one of the
+// addresses of a capture device
+func systemInterfaceName(d pcap.Interface, ifaces []net.Interface) string {
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ip, _, err := net.ParseCIDR(addr.String())
+			if err != nil {
+				continue
+			}
+			for _, da := range d.Addresses {
+				if ip.Equal(da.IP) {
+					return iface.Name
+				}
+			}
+		}
+	}
+	return ``
+}
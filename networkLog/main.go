@@ -15,9 +15,7 @@ import (
 	"io"
 	"net"
 	"os"
-	"path"
 	"runtime/pprof"
-	"syscall"
 	"time"
 
 	"github.com/gravwell/ingest/v3"
@@ -26,21 +24,23 @@ import (
 	"github.com/gravwell/ingesters/v3/utils"
 	"github.com/gravwell/ingesters/v3/version"
 
+	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
 
 const (
-	defaultConfigLoc     = `/opt/gravwell/etc/network_capture.conf`
 	packetsThrowSize int = 1024 * 1024 * 2
 )
 
 var (
-	confLoc        = flag.String("config-file", defaultConfigLoc, "Location for configuration file")
-	verbose        = flag.Bool("v", false, "Display verbose status updates to stdout")
-	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
-	profileFile    = flag.String("profile", "", "Start a CPU profiler, disabled if blank")
-	ver            = flag.Bool("version", false, "Print the version information and exit")
+	confLoc     = flag.String("config-file", defaultConfigLoc, "Location for configuration file")
+	verbose     = flag.Bool("v", false, "Display verbose status updates to stdout")
+	profileFile = flag.String("profile", "", "Start a CPU profiler, disabled if blank")
+	ver         = flag.Bool("version", false, "Print the version information and exit")
+	importFiles = flag.String("import-pcap", "", "Import pcap or pcapng files matching the pattern and exit")
+	importTag   = flag.String("import-tag", "pcap", "Tag to apply to packets imported with -import-pcap")
+	listIfaces  = flag.Bool("list-interfaces", false, "List the capture devices and exit")
 
 	pktTimeout time.Duration = 500 * time.Millisecond
 
@@ -57,18 +57,46 @@ type results struct {
 }
 
 type sniffer struct {
-	name      string
-	Promisc   bool
-	Interface string
-	TagName   string
-	tag       entry.EntryTag
-	SnapLen   int
-	BPFFilter string
-	handle    *pcap.Handle
-	src       net.IP
-	die       chan bool
-	res       chan results
-	active    bool
+	name             string
+	Promisc          bool
+	Interface        string
+	TagName          string
+	tag              entry.EntryTag
+	SnapLen          int
+	BPFFilter        string
+	HeadersOnly      bool
+	decap            decapFlags
+	SampleRate       int
+	SampleMode       string
+	CaptureMode      string
+	RingBlockSize    int
+	RingBlockCount   int
+	RingBlockTimeout time.Duration
+	flows            *flowTable
+	dns              *dnsTracker
+	DNSTagName       string
+	dnsTag           entry.EntryTag
+	tls              bool
+	TLSTagName       string
+	tlsTag           entry.EntryTag
+	assets           *assetTracker
+	AssetTagName     string
+	assetTag         entry.EntryTag
+	recordsOnly      bool
+	stats            *captureStats
+	handle           packetSource
+	src              net.IP
+	die              chan bool
+	res              chan results
+	active           bool
+}
+
+// packetSource is a live capture handle, either a pcap handle or an AF_PACKET ring.
+// Read timeouts are reported as pcap.NextErrorTimeoutExpired.
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	Close()
 }
 
 func init() {
@@ -79,31 +107,18 @@ func init() {
 		os.Exit(0)
 	}
 	lg = log.New(os.Stderr) // DO NOT close this, it will prevent backtraces from firing
-	if *stderrOverride != `` {
-		if oldstderr, err := syscall.Dup(int(os.Stderr.Fd())); err != nil {
-			lg.Fatal("Failed to dup stderr: %v\n", err)
-		} else {
-			lg.AddWriter(os.NewFile(uintptr(oldstderr), "oldstderr"))
-		}
-
-		fp := path.Join(`/dev/shm/`, *stderrOverride)
-		fout, err := os.Create(fp)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", fp, err)
-		} else {
-			version.PrintVersion(fout)
-			ingest.PrintVersion(fout)
-			//file created, dup it
-			if err := syscall.Dup2(int(fout.Fd()), int(os.Stderr.Fd())); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to dup2 stderr: %v\n", err)
-				fout.Close()
-			}
-		}
-	}
+	platformInit()
 	v = *verbose
 }
 
 func main() {
+	defer serviceStopped()
+	if *listIfaces {
+		if err := listInterfaces(os.Stdout); err != nil {
+			lg.FatalCode(0, "Failed to list capture devices: %v", err)
+		}
+		return
+	}
 	if *profileFile != `` {
 		f, err := os.Create(*profileFile)
 		if err != nil {
@@ -132,6 +147,13 @@ func main() {
 		}
 	}
 
+	if *importFiles != `` {
+		if err := importPcap(cfg, *importFiles, *importTag); err != nil {
+			lg.FatalCode(0, "Failed to import pcap files: %v", err)
+		}
+		return
+	}
+
 	tags, err := cfg.Tags()
 	if err != nil {
 		lg.FatalCode(0, "Failed to get tags from configuration: %v", err)
@@ -189,14 +211,14 @@ func main() {
 		//If not, derive one.
 		var src net.IP
 		if v.Source_Override != `` {
-			src = net.ParseIP(v.Source_Override)
+			src = utils.NormalizeSource(net.ParseIP(v.Source_Override))
 			if src == nil {
 				closeSniffers(sniffs)
 				lg.FatalCode(0, "Source-Override is invalid")
 			}
 		} else if cfg.Source_Override != `` {
 			// global override
-			src = net.ParseIP(cfg.Source_Override)
+			src = utils.NormalizeSource(net.ParseIP(cfg.Source_Override))
 			if src == nil {
 				closeSniffers(sniffs)
 				lg.FatalCode(0, "Global Source-Override is invalid")
@@ -211,32 +233,52 @@ func main() {
 			}
 		}
 
+		s := sniffer{
+			name:             k,
+			src:              src,
+			Promisc:          v.Promisc,
+			Interface:        v.Interface,
+			TagName:          v.Tag_Name,
+			SnapLen:          v.Snap_Len,
+			BPFFilter:        v.BPF_Filter,
+			HeadersOnly:      v.Headers_Only,
+			SampleRate:       v.Sample_Rate,
+			SampleMode:       v.Sample_Mode,
+			CaptureMode:      v.Capture_Mode,
+			RingBlockSize:    v.Ring_Block_Size,
+			RingBlockCount:   v.Ring_Block_Count,
+			RingBlockTimeout: v.ringBlockTimeout(),
+			die:              make(chan bool, 1),
+			res:              make(chan results, 1),
+		}
+		//already checked when the config was loaded
+		s.decap, _ = parseDecapsulate(v.Decapsulate)
+		if cfg.StatsEnabled() {
+			s.stats = allStats.get(k, v.Interface)
+		}
+		if v.DNS_Records != `` {
+			s.dns = newDNSTracker(v.dnsTimeout())
+			s.DNSTagName = v.dnsTag()
+		}
+		if v.TLS_Records != `` {
+			s.tls = true
+			s.TLSTagName = v.tlsTag()
+		}
+		if v.Asset_Records != `` {
+			s.assets = newAssetTracker()
+			s.AssetTagName = v.assetTag()
+		}
+		s.recordsOnly = v.recordsOnly()
+		if v.Flow_Records {
+			idle, active := v.flowTimeouts()
+			s.flows = newFlowTable(idle, active, v.Flow_Max_Entries)
+		}
 		//get the handle on the device
-		hnd, err := pcap.OpenLive(v.Interface, int32(v.Snap_Len), v.Promisc, pktTimeout)
-		if err != nil {
+		if s.handle, err = openPacketSource(&s); err != nil {
 			closeSniffers(sniffs)
-			lg.FatalCode(0, "Failed to get initialize handler on %s for %s", v.Interface, k)
+			lg.FatalCode(0, "Failed to initialize %s capture on %s for %s: %v", s.CaptureMode, v.Interface, k, err)
 		}
-		//apply a filter if one is specified
-		if v.BPF_Filter != `` {
-			if err := hnd.SetBPFFilter(v.BPF_Filter); err != nil {
-				hnd.Close()
-				closeSniffers(sniffs)
-				lg.FatalCode(0, "Invalid BPF Filter for %s: %v", k, err)
-			}
-		}
-		sniffs = append(sniffs, sniffer{
-			name:      k,
-			src:       src,
-			Promisc:   v.Promisc,
-			Interface: v.Interface,
-			TagName:   v.Tag_Name,
-			SnapLen:   v.Snap_Len,
-			BPFFilter: v.BPF_Filter,
-			handle:    hnd,
-			die:       make(chan bool, 1),
-			res:       make(chan results, 1),
-		})
+		sniffs = append(sniffs, s)
 	}
 
 	//set tags and source for each sniffer
@@ -247,6 +289,24 @@ func main() {
 			lg.Fatal("Failed to resolve tag %s: %v", sniffs[i].TagName, err)
 		}
 		sniffs[i].tag = tag
+		if sniffs[i].dns != nil {
+			if sniffs[i].dnsTag, err = igst.GetTag(sniffs[i].DNSTagName); err != nil {
+				closeSniffers(sniffs)
+				lg.Fatal("Failed to resolve tag %s: %v", sniffs[i].DNSTagName, err)
+			}
+		}
+		if sniffs[i].tls {
+			if sniffs[i].tlsTag, err = igst.GetTag(sniffs[i].TLSTagName); err != nil {
+				closeSniffers(sniffs)
+				lg.Fatal("Failed to resolve tag %s: %v", sniffs[i].TLSTagName, err)
+			}
+		}
+		if sniffs[i].assets != nil {
+			if sniffs[i].assetTag, err = igst.GetTag(sniffs[i].AssetTagName); err != nil {
+				closeSniffers(sniffs)
+				lg.Fatal("Failed to resolve tag %s: %v", sniffs[i].AssetTagName, err)
+			}
+		}
 	}
 
 	start := time.Now()
@@ -255,9 +315,17 @@ func main() {
 		sniffs[i].active = true
 		go pcapIngester(igst, &sniffs[i])
 	}
+	sr, err := newStatsReporter(igst, cfg.StatsInterval(), cfg.Stats_Listen)
+	if err != nil {
+		closeSniffers(sniffs)
+		lg.Fatal("Failed to start the stats listener on %s: %v", cfg.Stats_Listen, err)
+	}
 
-	utils.WaitForQuit()
+	waitForQuit()
 
+	if err := sr.Close(); err != nil {
+		lg.Error("Failed to close the stats listener: %v\n", err)
+	}
 	requestClose(sniffs)
 	res := gatherResponse(sniffs)
 	closeHandles(sniffs)
@@ -278,8 +346,31 @@ func main() {
 	}
 }
 
+// openPacketSource opens the capture handle for a sniffer and applies its filter
+func openPacketSource(s *sniffer) (packetSource, error) {
+	if s.CaptureMode == captureModeRing {
+		return openRing(s)
+	}
+	dev, err := captureDevice(s.Interface)
+	if err != nil {
+		return nil, err
+	}
+	hnd, err := pcap.OpenLive(dev, int32(s.SnapLen), s.Promisc, pktTimeout)
+	if err != nil {
+		return nil, err
+	}
+	//apply a filter if one is specified
+	if s.BPFFilter != `` {
+		if err := hnd.SetBPFFilter(s.BPFFilter); err != nil {
+			hnd.Close()
+			return nil, fmt.Errorf("Invalid BPF Filter: %v", err)
+		}
+	}
+	return hnd, nil
+}
+
 //Called if something bad happens and we need to re-open the packet source
-func rebuildPacketSource(s *sniffer) (*pcap.Handle, bool) {
+func rebuildPacketSource(s *sniffer) (packetSource, bool) {
 	var threwErr bool
 mainLoop:
 	for {
@@ -290,22 +381,15 @@ mainLoop:
 			break mainLoop
 		}
 		//sleep over, try to reopen our pcap device
-		hnd, err := pcap.OpenLive(s.Interface, int32(s.SnapLen), s.Promisc, pktTimeout)
+		//the filter was good when the sniffer started, so any failure here is the device
+		hnd, err := openPacketSource(s)
 		if err != nil {
 			if !threwErr {
 				threwErr = true
-				lg.Error("Failed to get pcap device on reopen (%v)\n", err)
+				lg.Error("Failed to get %s device on reopen (%v)\n", s.CaptureMode, err)
 			}
 			continue
 		}
-		if s.BPFFilter != `` {
-			if err := hnd.SetBPFFilter(s.BPFFilter); err != nil {
-				//this is fatal, this shouldn't be possible, but here we are
-				lg.Error("Invalid BPF Filter on reopen: %v\n", err)
-				hnd.Close()
-				break mainLoop
-			}
-		}
 		//we got a good handle, return it
 		return hnd, true
 	}
@@ -314,11 +398,21 @@ mainLoop:
 
 //A captured packet
 type capPacket struct {
-	ts   entry.Timestamp
-	data []byte
+	ts      entry.Timestamp
+	data    []byte
+	payload []byte //the whole captured packet when data was trimmed to the headers
+	wireLen int
+}
+
+// full returns the whole captured packet, even when the data was trimmed to the headers
+func (p capPacket) full() []byte {
+	if p.payload != nil {
+		return p.payload
+	}
+	return p.data
 }
 
-func packetExtractor(hnd *pcap.Handle, c chan []capPacket) {
+func packetExtractor(hnd packetSource, s *sniffer, c chan []capPacket) {
 	defer close(c)
 	var packets []capPacket
 	var packetsSize int
@@ -329,9 +423,11 @@ func packetExtractor(hnd *pcap.Handle, c chan []capPacket) {
 	var trimSize int
 	//in order for us to deal SLL "cooked" interfaces we have to trim th first 2 bytes
 	//The ethernet layer is going to be foobared, but the IP layers should be fine
-	if hnd.LinkType() == layers.LinkTypeLinuxSLL {
+	lt := hnd.LinkType()
+	if lt == layers.LinkTypeLinuxSLL {
 		trimSize = 2
 	}
+	sampler := newPacketSampler(s.SampleRate, s.SampleMode)
 
 	for {
 		data, ci, err := hnd.ReadPacketData()
@@ -347,11 +443,25 @@ func packetExtractor(hnd *pcap.Handle, c chan []capPacket) {
 			debugout("Failed to get packet from source: %v\n", err)
 			break
 		}
+		if !sampler.keep() {
+			continue
+		}
 		if trimSize > 0 && len(data) > trimSize {
 			data = data[trimSize:]
 		}
+		if s.decap != 0 {
+			data = decapsulate(data, lt, s.decap)
+		}
+		capPkt.payload = nil
+		if s.HeadersOnly {
+			if s.dns != nil || s.tls || s.assets != nil {
+				capPkt.payload = data
+			}
+			data = data[:headerLength(data, lt)]
+		}
 		capPkt.data = data
 		capPkt.ts = entry.FromStandard(ci.Timestamp)
+		capPkt.wireLen = ci.Length
 		packets = append(packets, capPkt)
 		packetsSize += len(capPkt.data)
 
@@ -383,18 +493,52 @@ func pcapIngester(igst *ingest.IngestMuxer, s *sniffer) {
 
 	//get a packet source
 	ch := make(chan []capPacket, 1024)
-	go packetExtractor(s.handle, ch)
-	debugout("Starting sniffer %s on %s with \"%s\"\n", s.name, s.Interface, s.BPFFilter)
-	igst.Info("Starting sniffer %s on %s with \"%s\"\n", s.name, s.Interface, s.BPFFilter)
-	lg.Info("Starting sniffer %s on %s with \"%s\"\n", s.name, s.Interface, s.BPFFilter)
+	go packetExtractor(s.handle, s, ch)
+	debugout("Starting %s sniffer %s on %s with \"%s\"\n", s.CaptureMode, s.name, s.Interface, s.BPFFilter)
+	igst.Info("Starting %s sniffer %s on %s with \"%s\"\n", s.CaptureMode, s.name, s.Interface, s.BPFFilter)
+	lg.Info("Starting %s sniffer %s on %s with \"%s\"\n", s.CaptureMode, s.name, s.Interface, s.BPFFilter)
+
+	//flow records, DNS transactions, and DHCP requests are expired on a timer, the packet path is untouched when they are disabled
+	var expireTick <-chan time.Time
+	if s.flows != nil || s.dns != nil || s.assets != nil {
+		tckr := time.NewTicker(time.Second)
+		defer tckr.Stop()
+		expireTick = tckr.C
+	}
+	//the kernel counters are read here because this routine owns the handle
+	var statsTick <-chan time.Time
+	if s.stats != nil {
+		tckr := time.NewTicker(statsSampleInterval)
+		defer tckr.Stop()
+		statsTick = tckr.C
+	}
+	lt := s.handle.LinkType()
 
 mainLoop:
 	for {
+		var set []*entry.Entry
 		//check if we are supposed to die
 		select {
 		case _ = <-s.die:
 			s.handle.Close()
+			//report the flows and DNS queries still open, the muxer is synced after the sniffers exit
+			if set = s.expireEntries(time.Now(), true); len(set) > 0 {
+				if err := igst.WriteBatch(set); err != nil {
+					lg.Error("Failed to write flow and DNS records: %v\n", err)
+				} else {
+					count += uint64(len(set))
+					totalBytes += entriesSize(set)
+					s.stats.addEntries(len(set))
+				}
+			}
 			break mainLoop
+		case now := <-statsTick:
+			s.stats.sample(s.handle, now)
+			continue
+		case now := <-expireTick:
+			if set = s.expireEntries(now, false); len(set) == 0 {
+				continue
+			}
 		case pkts, ok := <-ch: //get a packet
 			if !ok {
 				//Something bad happened, attempt to restart the pcap
@@ -408,33 +552,45 @@ mainLoop:
 				}
 				//now we need to re-start the extractor
 				ch = make(chan []capPacket, 1024)
-				go packetExtractor(s.handle, ch)
+				go packetExtractor(s.handle, s, ch)
+				lt = s.handle.LinkType()
+				s.stats.reset()
 				debugout("Rebuilding packet source\n")
 				igst.Info("Rebuilt packet source")
 				continue
 			}
-			staticSet := make([]entry.Entry, len(pkts))
-			set := make([]*entry.Entry, len(pkts))
-			for i := range pkts {
-				staticSet[i].TS = pkts[i].ts
-				staticSet[i].Data = pkts[i].data
-				staticSet[i].SRC = s.src
-				staticSet[i].Tag = s.tag
-				set[i] = &staticSet[i]
-				totalBytes += uint64(len(pkts[i].data))
-				count++
+			s.stats.add(pkts, 0)
+			if s.dns != nil {
+				set = s.addDNS(pkts, lt)
 			}
-			if err := igst.WriteBatch(set); err != nil {
-				s.handle.Close()
-				lg.Error("Failed to write entry: %v\n", err)
-				s.res <- results{
-					Bytes: 0,
-					Count: 0,
-					Error: err,
-				}
-				return
+			if s.tls {
+				set = append(set, s.tlsEntries(pkts, lt)...)
+			}
+			if s.assets != nil {
+				set = append(set, s.assetEntries(pkts, lt)...)
+			}
+			if s.flows != nil {
+				set = append(set, s.addFlows(pkts, lt)...)
+			} else if !s.recordsOnly {
+				set = append(set, s.packetEntries(pkts)...)
+			}
+			if len(set) == 0 {
+				continue
 			}
 		}
+		if err := igst.WriteBatch(set); err != nil {
+			s.handle.Close()
+			lg.Error("Failed to write entry: %v\n", err)
+			s.res <- results{
+				Bytes: 0,
+				Count: 0,
+				Error: err,
+			}
+			return
+		}
+		count += uint64(len(set))
+		totalBytes += entriesSize(set)
+		s.stats.addEntries(len(set))
 	}
 
 	s.res <- results{
@@ -444,8 +600,153 @@ mainLoop:
 	}
 }
 
+// packetEntries wraps the captured packets in entries
+func (s *sniffer) packetEntries(pkts []capPacket) []*entry.Entry {
+	staticSet := make([]entry.Entry, len(pkts))
+	set := make([]*entry.Entry, len(pkts))
+	for i := range pkts {
+		staticSet[i].TS = pkts[i].ts
+		staticSet[i].Data = pkts[i].data
+		staticSet[i].SRC = s.src
+		staticSet[i].Tag = s.tag
+		set[i] = &staticSet[i]
+	}
+	return set
+}
+
+// expireEntries returns the entries for the flows and DNS queries that have timed out,
+// everything still open is returned when all is set.  Unanswered DHCP requests are dropped.
+func (s *sniffer) expireEntries(now time.Time, all bool) (set []*entry.Entry) {
+	if s.flows != nil {
+		set = s.flowEntries(s.flows.expire(now, all))
+	}
+	if s.dns != nil {
+		set = append(set, s.dnsEntries(s.dns.expire(now, all))...)
+	}
+	if s.assets != nil {
+		s.assets.expire(now, all)
+	}
+	return
+}
+
+// addDNS parses the DNS messages in the packets, returning the entries for the
+// transactions they complete
+func (s *sniffer) addDNS(pkts []capPacket, lt layers.LinkType) []*entry.Entry {
+	now := time.Now()
+	var recs []dnsRecord
+	for _, p := range pkts {
+		recs = append(recs, s.dns.add(p.full(), p.ts.StandardTime(), lt, now)...)
+	}
+	return s.dnsEntries(recs)
+}
+
+// dnsEntries encodes DNS transactions as entries stamped with the time of the query,
+// or of the response when the query was not seen
+func (s *sniffer) dnsEntries(recs []dnsRecord) (set []*entry.Entry) {
+	for _, rec := range recs {
+		data, err := rec.encode()
+		if err != nil {
+			lg.Error("Failed to encode DNS record: %v\n", err)
+			continue
+		}
+		set = append(set, &entry.Entry{
+			TS:   entry.FromStandard(rec.ts),
+			SRC:  s.src,
+			Tag:  s.dnsTag,
+			Data: data,
+		})
+	}
+	return
+}
+
+// tlsEntries returns entries for the TLS ClientHello and ServerHello messages in the packets
+func (s *sniffer) tlsEntries(pkts []capPacket, lt layers.LinkType) (set []*entry.Entry) {
+	for _, p := range pkts {
+		h, ok := tlsHelloPacket(p.full(), lt)
+		if !ok {
+			continue
+		}
+		data, err := h.encode()
+		if err != nil {
+			lg.Error("Failed to encode TLS hello: %v\n", err)
+			continue
+		}
+		set = append(set, &entry.Entry{
+			TS:   p.ts,
+			SRC:  s.src,
+			Tag:  s.tlsTag,
+			Data: data,
+		})
+	}
+	return
+}
+
+// assetEntries returns entries for the ARP and DHCP events in the packets
+func (s *sniffer) assetEntries(pkts []capPacket, lt layers.LinkType) (set []*entry.Entry) {
+	now := time.Now()
+	for _, p := range pkts {
+		for _, ev := range s.assets.add(p.full(), lt, now) {
+			data, err := encodeAsset(ev)
+			if err != nil {
+				lg.Error("Failed to encode asset event: %v\n", err)
+				continue
+			}
+			set = append(set, &entry.Entry{
+				TS:   p.ts,
+				SRC:  s.src,
+				Tag:  s.assetTag,
+				Data: data,
+			})
+		}
+	}
+	return
+}
+
+// addFlows counts packets into the flow table, returning the entries for every flow
+// when the table fills up
+func (s *sniffer) addFlows(pkts []capPacket, lt layers.LinkType) []*entry.Entry {
+	now := time.Now()
+	var full bool
+	for _, p := range pkts {
+		if !s.flows.add(p.data, p.wireLen, p.ts.StandardTime(), lt, now) {
+			full = true
+		}
+	}
+	if !full {
+		return nil
+	}
+	lg.Warn("Sniffer %s flow table is full, expiring all flows\n", s.name)
+	return s.flowEntries(s.flows.expire(now, true))
+}
+
+// flowEntries encodes flow records as entries stamped with the start of each flow
+func (s *sniffer) flowEntries(recs []flowRecord) (set []*entry.Entry) {
+	for _, fr := range recs {
+		data, err := fr.encode()
+		if err != nil {
+			lg.Error("Failed to encode flow record: %v\n", err)
+			continue
+		}
+		set = append(set, &entry.Entry{
+			TS:   entry.FromStandard(fr.Start),
+			SRC:  s.src,
+			Tag:  s.tag,
+			Data: data,
+		})
+	}
+	return
+}
+
+func entriesSize(set []*entry.Entry) (sz uint64) {
+	for _, e := range set {
+		sz += uint64(len(e.Data))
+	}
+	return
+}
+
 //Attempt to find a reasonable IP for a given interface name
-//Returns the first IP it finds.
+//Returns the first global unicast IP it finds, IPv6 only interfaces
+//always have a link-local address which is only used as a last resort.
 func getSourceIP(dev string) (net.IP, error) {
 	iface, err := net.InterfaceByName(dev)
 	if err != nil {
@@ -455,18 +756,25 @@ func getSourceIP(dev string) (net.IP, error) {
 	if err != nil {
 		return nil, err
 	}
+	var fallback net.IP
 	for _, addr := range addrs {
 		//try for cidr first
 		ip, _, err := net.ParseCIDR(addr.String())
-		if err == nil {
-			return ip, nil
+		if err != nil {
+			//try as an ip
+			if ip = net.ParseIP(addr.String()); ip == nil {
+				continue
+			}
 		}
-		//try as an ip
-		ip = net.ParseIP(addr.String())
-		if ip != nil {
-			return ip, nil
+		if ip.IsGlobalUnicast() {
+			return utils.NormalizeSource(ip), nil
+		} else if fallback == nil {
+			fallback = utils.NormalizeSource(ip)
 		}
 	}
+	if fallback != nil {
+		return fallback, nil
+	}
 	return nil, errors.New("No IP for " + dev)
 }
 
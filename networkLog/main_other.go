@@ -0,0 +1,66 @@
+// +build !windows
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingesters/v3/utils"
+	"github.com/gravwell/ingesters/v3/version"
+)
+
+const (
+	defaultConfigLoc = `/opt/gravwell/etc/network_capture.conf`
+)
+
+var (
+	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
+)
+
+func platformInit() {
+	if *stderrOverride != `` {
+		if oldstderr, err := syscall.Dup(int(os.Stderr.Fd())); err != nil {
+			lg.Fatal("Failed to dup stderr: %v\n", err)
+		} else {
+			lg.AddWriter(os.NewFile(uintptr(oldstderr), "oldstderr"))
+		}
+
+		fp := path.Join(`/dev/shm/`, *stderrOverride)
+		fout, err := os.Create(fp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", fp, err)
+		} else {
+			version.PrintVersion(fout)
+			ingest.PrintVersion(fout)
+			//file created, dup it
+			if err := syscall.Dup2(int(fout.Fd()), int(os.Stderr.Fd())); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to dup2 stderr: %v\n", err)
+				fout.Close()
+			}
+		}
+	}
+}
+
+func waitForQuit() {
+	utils.WaitForQuit()
+}
+
+func serviceStopped() {}
+
+// captureDevice returns the pcap device for a configured interface, interface names are device names
+func captureDevice(iface string) (string, error) {
+	return iface, nil
+}
@@ -0,0 +1,158 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/gravwell/ingesters/v3/utils"
+	"github.com/gravwell/winevent/v3"
+)
+
+const (
+	serviceName       = `GravwellNetworkCapture`
+	defaultConfigName = `network_capture.cfg`
+	npcapDevicePrefix = `\Device\`
+)
+
+var (
+	defaultConfigLoc = serviceConfigLoc()
+
+	service *captureService
+)
+
+// captureService runs the ingester under the Windows service manager, main waits on quit
+// and closes done once the sniffers are shut down and the muxer is synced
+type captureService struct {
+	quit    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+func serviceConfigLoc() string {
+	p, err := winevent.ServiceFilename(defaultConfigName)
+	if err != nil {
+		return defaultConfigName
+	}
+	return p
+}
+
+func platformInit() {
+	inter, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		lg.Fatal("Failed to get interactive session status: %v\n", err)
+	} else if inter {
+		return
+	}
+	//services have no stderr, send the log to the event log as well as any Log-File
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		lg.Fatal("Failed to get event log handle: %v\n", err)
+	}
+	lg.AddWriter(eventLogWriter{elog})
+	service = &captureService{
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go func() {
+		defer close(service.stopped)
+		if err := svc.Run(serviceName, service); err != nil {
+			lg.Error("Failed to run service: %v\n", err)
+		}
+	}()
+}
+
+func (cs *captureService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
+	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown
+	changes <- svc.Status{State: svc.StartPending}
+	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				close(cs.quit)
+				<-cs.done
+				return
+			}
+		case <-cs.done:
+			//main exited on its own
+			return
+		}
+	}
+}
+
+func waitForQuit() {
+	if service == nil {
+		utils.WaitForQuit()
+		return
+	}
+	<-service.quit
+}
+
+// serviceStopped tells the service manager we are done, it is a no-op for interactive runs
+func serviceStopped() {
+	if service == nil {
+		return
+	}
+	close(service.done)
+	<-service.stopped
+}
+
+// captureDevice maps an interface name such as "Ethernet" or an adapter description to its
+// Npcap device name, device names are used as is
+func captureDevice(iface string) (string, error) {
+	if strings.HasPrefix(iface, npcapDevicePrefix) {
+		return iface, nil
+	}
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return ``, fmt.Errorf("Failed to list Npcap devices, is Npcap installed? %v", err)
+	}
+	ifaces, _ := net.Interfaces()
+	for _, d := range devs {
+		if strings.EqualFold(d.Description, iface) || strings.EqualFold(systemInterfaceName(d, ifaces), iface) {
+			return d.Name, nil
+		}
+	}
+	return ``, fmt.Errorf("No Npcap device for interface %q, list them with -list-interfaces", iface)
+}
+
+// eventLogWriter hands log lines to the Windows event log at the matching severity
+type eventLogWriter struct {
+	*eventlog.Log
+}
+
+func (w eventLogWriter) Write(b []byte) (int, error) {
+	ln := strings.TrimSpace(string(b))
+	var err error
+	switch {
+	case strings.Contains(ln, " ERROR "), strings.Contains(ln, " CRITICAL "), strings.Contains(ln, " FATAL "):
+		err = w.Error(1, ln)
+	case strings.Contains(ln, " WARN "):
+		err = w.Warning(1, ln)
+	default:
+		err = w.Info(1, ln)
+	}
+	return len(b), err
+}
+
+func (w eventLogWriter) Close() error {
+	return w.Log.Close()
+}
@@ -0,0 +1,141 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// ringSource captures from an AF_PACKET TPACKET_V3 ring, the kernel fills whole blocks of
+// packets in memory shared with the ingester so reads do not need a syscall per packet
+type ringSource struct {
+	*afpacket.TPacket
+	name    string
+	snapLen int
+	promisc int //socket holding the interface in promiscuous mode, -1 if unused
+}
+
+func openRing(s *sniffer) (packetSource, error) {
+	tp, err := afpacket.NewTPacket(
+		afpacket.OptInterface(s.Interface),
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(s.RingBlockSize),
+		afpacket.OptNumBlocks(s.RingBlockCount),
+		afpacket.OptBlockTimeout(s.RingBlockTimeout),
+		afpacket.OptPollTimeout(pktTimeout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	rs := &ringSource{
+		TPacket: tp,
+		name:    s.name,
+		snapLen: s.SnapLen,
+		promisc: -1,
+	}
+	if s.BPFFilter != `` {
+		if err = rs.setFilter(s.BPFFilter); err != nil {
+			tp.Close()
+			return nil, err
+		}
+	}
+	if s.Promisc {
+		if rs.promisc, err = promiscSocket(s.Interface); err != nil {
+			tp.Close()
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// setFilter compiles the filter with libpcap and attaches it to the ring socket, the compiled
+// program accepts at most snapLen bytes of each packet so the kernel trims packets for us
+func (rs *ringSource) setFilter(filter string) error {
+	insts, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, rs.snapLen, filter)
+	if err != nil {
+		return err
+	}
+	raw := make([]bpf.RawInstruction, len(insts))
+	for i, inst := range insts {
+		raw[i] = bpf.RawInstruction{Op: inst.Code, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}
+	}
+	return rs.SetBPF(raw)
+}
+
+// promiscSocket opens a socket whose membership holds the interface in promiscuous mode until it is closed
+func promiscSocket(iface string) (int, error) {
+	ifc, err := net.InterfaceByName(iface)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return -1, err
+	}
+	mreq := unix.PacketMreq{
+		Ifindex: int32(ifc.Index),
+		Type:    unix.PACKET_MR_PROMISC,
+	}
+	if err = unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// ReadPacketData copies the next packet out of the ring, a poll timeout is reported the same
+// way as a pcap read timeout
+func (rs *ringSource) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if data, ci, err = rs.ZeroCopyReadPacketData(); err != nil {
+		if err == afpacket.ErrTimeout {
+			err = pcap.NextErrorTimeoutExpired
+		}
+		return
+	}
+	if len(data) > rs.snapLen {
+		data = data[:rs.snapLen]
+		ci.CaptureLength = rs.snapLen
+	}
+	data = append([]byte(nil), data...)
+	return
+}
+
+func (rs *ringSource) kernelStats() (ks kernelStats, err error) {
+	var st afpacket.SocketStatsV3
+	if _, st, err = rs.SocketStats(); err == nil {
+		ks = kernelStats{
+			received: uint64(st.Packets()),
+			dropped:  uint64(st.Drops()),
+			freezes:  uint64(st.QueueFreezes()),
+		}
+	}
+	return
+}
+
+func (rs *ringSource) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (rs *ringSource) Close() {
+	if _, st, err := rs.SocketStats(); err == nil && st.Drops() > 0 {
+		lg.Warn("Sniffer %s ring dropped %d packets, consider a larger Ring-Block-Size or Ring-Block-Count\n", rs.name, st.Drops())
+	}
+	rs.TPacket.Close()
+	if rs.promisc != -1 {
+		unix.Close(rs.promisc)
+		rs.promisc = -1
+	}
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+)
+
+func openRing(s *sniffer) (packetSource, error) {
+	return nil, errors.New("Capture-Mode afpacket is only supported on Linux")
+}
@@ -0,0 +1,61 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+const (
+	sampleModeDeterministic = `deterministic`
+	sampleModeRandom        = `random`
+)
+
+var (
+	ErrInvalidSampleRate    = errors.New("Sample-Rate must be zero or greater")
+	ErrInvalidSampleMode    = errors.New("Sample-Mode must be deterministic or random")
+	ErrSampleModeNoSampling = errors.New("Sample-Mode requires a Sample-Rate greater than 1")
+)
+
+// packetSampler keeps 1 in rate packets, either every rate'th packet or each packet with
+// a probability of 1/rate.  A nil sampler keeps every packet.  Samplers are owned by the
+// packet extractor and are not safe for concurrent use.
+type packetSampler struct {
+	rate uint64
+	n    uint64
+	rng  *rand.Rand
+}
+
+// newPacketSampler returns nil when the rate does not call for sampling
+func newPacketSampler(rate int, mode string) *packetSampler {
+	if rate <= 1 {
+		return nil
+	}
+	ps := &packetSampler{rate: uint64(rate)}
+	if mode == sampleModeRandom {
+		ps.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return ps
+}
+
+func (ps *packetSampler) keep() bool {
+	if ps == nil {
+		return true
+	}
+	if ps.rng != nil {
+		return ps.rng.Int63n(int64(ps.rate)) == 0
+	}
+	if ps.n++; ps.n < ps.rate {
+		return false
+	}
+	ps.n = 0
+	return true
+}
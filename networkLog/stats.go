@@ -0,0 +1,326 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	statsSampleInterval             = 5 * time.Second
+	statsSocketPerm     os.FileMode = 0660
+)
+
+var (
+	//stats are registered by sniffer name as sniffers start and are served by the stats endpoint
+	allStats = &statsRegistry{
+		stats: map[string]*captureStats{},
+	}
+)
+
+// kernelStats are the cumulative counters reported by the capture handle since it was opened
+type kernelStats struct {
+	received  uint64
+	dropped   uint64 //dropped by the kernel because the ingester could not keep up
+	ifDropped uint64 //dropped by the interface or driver
+	freezes   uint64 //times an AF_PACKET ring was completely full
+}
+
+type kernelStatser interface {
+	kernelStats() (kernelStats, error)
+}
+
+// sourceStats returns the kernel counters of a capture handle
+func sourceStats(hnd packetSource) (ks kernelStats, err error) {
+	switch h := hnd.(type) {
+	case *pcap.Handle:
+		var st *pcap.Stats
+		if st, err = h.Stats(); err == nil {
+			ks = kernelStats{
+				received:  uint64(st.PacketsReceived),
+				dropped:   uint64(st.PacketsDropped),
+				ifDropped: uint64(st.PacketsIfDropped),
+			}
+		}
+	case kernelStatser:
+		ks, err = h.kernelStats()
+	}
+	return
+}
+
+// captureStats are the counters for a single sniffer, the kernel counters are accumulated
+// across handle rebuilds because a new handle starts counting from zero
+type captureStats struct {
+	sync.Mutex
+	iface   string
+	packets uint64
+	bytes   uint64 //bytes on the wire, not truncated by the snap length
+	entries uint64
+
+	kernel     kernelStats
+	lastKernel kernelStats
+
+	lastPackets  uint64
+	lastBytes    uint64
+	lastSample   time.Time
+	packetRate   float64
+	byteRate     float64
+	lastReported uint64 //kernel and interface drops at the last report
+}
+
+type captureStatsSnapshot struct {
+	Interface        string
+	Packets          uint64
+	Bytes            uint64
+	Entries          uint64
+	PacketsPerSecond float64
+	BytesPerSecond   float64
+	KernelReceived   uint64
+	KernelDropped    uint64
+	InterfaceDropped uint64
+	RingFull         uint64 `json:",omitempty"`
+}
+
+// add counts a batch of packets and the entries written for them, it is safe to call on nil stats
+func (cs *captureStats) add(pkts []capPacket, entries int) {
+	if cs == nil {
+		return
+	}
+	var bytes uint64
+	for i := range pkts {
+		bytes += uint64(pkts[i].wireLen)
+	}
+	cs.Lock()
+	cs.packets += uint64(len(pkts))
+	cs.bytes += bytes
+	cs.entries += uint64(entries)
+	cs.Unlock()
+}
+
+// addEntries counts entries that were not written for a batch of packets, such as expired flows
+func (cs *captureStats) addEntries(entries int) {
+	cs.add(nil, entries)
+}
+
+// sample updates the rates and the kernel counters from the capture handle
+func (cs *captureStats) sample(hnd packetSource, now time.Time) {
+	if cs == nil {
+		return
+	}
+	ks, err := sourceStats(hnd)
+	cs.Lock()
+	defer cs.Unlock()
+	if err == nil {
+		cs.kernel.received += counterDelta(ks.received, cs.lastKernel.received)
+		cs.kernel.dropped += counterDelta(ks.dropped, cs.lastKernel.dropped)
+		cs.kernel.ifDropped += counterDelta(ks.ifDropped, cs.lastKernel.ifDropped)
+		cs.kernel.freezes += counterDelta(ks.freezes, cs.lastKernel.freezes)
+		cs.lastKernel = ks
+	}
+	if secs := now.Sub(cs.lastSample).Seconds(); secs > 0 {
+		cs.packetRate = float64(cs.packets-cs.lastPackets) / secs
+		cs.byteRate = float64(cs.bytes-cs.lastBytes) / secs
+	}
+	cs.lastPackets, cs.lastBytes, cs.lastSample = cs.packets, cs.bytes, now
+}
+
+// reset is called when the capture handle is rebuilt and its counters start over
+func (cs *captureStats) reset() {
+	if cs == nil {
+		return
+	}
+	cs.Lock()
+	cs.lastKernel = kernelStats{}
+	cs.Unlock()
+}
+
+func counterDelta(cur, last uint64) uint64 {
+	if cur < last {
+		return cur //the counters were reset
+	}
+	return cur - last
+}
+
+func (cs *captureStats) snapshot() captureStatsSnapshot {
+	cs.Lock()
+	defer cs.Unlock()
+	return captureStatsSnapshot{
+		Interface:        cs.iface,
+		Packets:          cs.packets,
+		Bytes:            cs.bytes,
+		Entries:          cs.entries,
+		PacketsPerSecond: cs.packetRate,
+		BytesPerSecond:   cs.byteRate,
+		KernelReceived:   cs.kernel.received,
+		KernelDropped:    cs.kernel.dropped,
+		InterfaceDropped: cs.kernel.ifDropped,
+		RingFull:         cs.kernel.freezes,
+	}
+}
+
+// newDrops returns the packets dropped since the last call
+func (cs *captureStats) newDrops() uint64 {
+	cs.Lock()
+	defer cs.Unlock()
+	drops := cs.kernel.dropped + cs.kernel.ifDropped
+	r := drops - cs.lastReported
+	cs.lastReported = drops
+	return r
+}
+
+type statsRegistry struct {
+	sync.Mutex
+	stats map[string]*captureStats
+}
+
+// get returns the stats for a sniffer, creating them if needed
+func (sr *statsRegistry) get(name, iface string) *captureStats {
+	sr.Lock()
+	defer sr.Unlock()
+	cs, ok := sr.stats[name]
+	if !ok {
+		cs = &captureStats{iface: iface, lastSample: time.Now()}
+		sr.stats[name] = cs
+	}
+	return cs
+}
+
+func (sr *statsRegistry) names() (r []string) {
+	sr.Lock()
+	defer sr.Unlock()
+	for name := range sr.stats {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return
+}
+
+func (sr *statsRegistry) snapshot() map[string]captureStatsSnapshot {
+	sr.Lock()
+	defer sr.Unlock()
+	r := make(map[string]captureStatsSnapshot, len(sr.stats))
+	for name, cs := range sr.stats {
+		r[name] = cs.snapshot()
+	}
+	return r
+}
+
+// report logs the stats of every sniffer, new drops are logged as warnings so loss on a sensor is not silent
+func (sr *statsRegistry) report(igst *ingest.IngestMuxer) {
+	for _, name := range sr.names() {
+		sr.Lock()
+		cs := sr.stats[name]
+		sr.Unlock()
+		snap := cs.snapshot()
+		if drops := cs.newDrops(); drops > 0 {
+			lg.Warn("Sniffer %s on %s dropped %d packets, %d kernel and %d interface drops total\n",
+				name, snap.Interface, drops, snap.KernelDropped, snap.InterfaceDropped)
+			igst.Warn("Sniffer %s on %s dropped %d packets, %d kernel and %d interface drops total",
+				name, snap.Interface, drops, snap.KernelDropped, snap.InterfaceDropped)
+		}
+		lg.Info("Sniffer %s on %s: %.0f packets/s %s/s, %d packets %s total, %d entries\n",
+			name, snap.Interface, snap.PacketsPerSecond, ingest.HumanSize(uint64(snap.BytesPerSecond)),
+			snap.Packets, ingest.HumanSize(snap.Bytes), snap.Entries)
+		igst.Info("Sniffer %s on %s: %.0f packets/s %s/s, %d packets %s total, %d entries",
+			name, snap.Interface, snap.PacketsPerSecond, ingest.HumanSize(uint64(snap.BytesPerSecond)),
+			snap.Packets, ingest.HumanSize(snap.Bytes), snap.Entries)
+	}
+}
+
+// statsReporter logs the stats of every sniffer on an interval and optionally serves them
+// as JSON over HTTP on a TCP address or a unix socket
+type statsReporter struct {
+	srv  *http.Server
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newStatsReporter(igst *ingest.IngestMuxer, interval time.Duration, addr string) (sr *statsReporter, err error) {
+	sr = &statsReporter{
+		done: make(chan struct{}),
+	}
+	if addr != `` {
+		var l net.Listener
+		if l, err = statsListener(addr); err != nil {
+			return nil, err
+		}
+		sr.srv = &http.Server{Handler: http.HandlerFunc(serveStats)}
+		go sr.srv.Serve(l)
+	}
+	if interval > 0 {
+		sr.wg.Add(1)
+		go func() {
+			defer sr.wg.Done()
+			tckr := time.NewTicker(interval)
+			defer tckr.Stop()
+			for {
+				select {
+				case <-tckr.C:
+					allStats.report(igst)
+				case <-sr.done:
+					return
+				}
+			}
+		}()
+	}
+	return
+}
+
+func statsListener(addr string) (l net.Listener, err error) {
+	if !strings.HasPrefix(addr, `/`) {
+		return net.Listen(`tcp`, addr)
+	}
+	//remove a stale socket left behind by an ingester that did not shut down cleanly
+	if fi, lerr := os.Lstat(addr); lerr == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err = os.Remove(addr); err != nil {
+			return
+		}
+	}
+	if l, err = net.Listen(`unix`, addr); err != nil {
+		return
+	}
+	if err = os.Chmod(addr, statsSocketPerm); err != nil {
+		l.Close()
+		l = nil
+	}
+	return
+}
+
+func serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `method not allowed`, http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set(`Content-Type`, `application/json`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent(``, "\t")
+	enc.Encode(allStats.snapshot())
+}
+
+func (sr *statsReporter) Close() (err error) {
+	if sr == nil {
+		return
+	}
+	close(sr.done)
+	sr.wg.Wait()
+	if sr.srv != nil {
+		err = sr.srv.Close()
+	}
+	return
+}
@@ -0,0 +1,296 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	tlsRecordHandshake = 0x16
+	tlsClientHello     = 1
+	tlsServerHello     = 2
+	tlsRecordHeaderLen = 5
+	tlsHandshakeLen    = 4
+	tlsRandomLen       = 32
+
+	tlsExtServerName        = 0
+	tlsExtSupportedGroups   = 10
+	tlsExtPointFormats      = 11
+	tlsExtALPN              = 16
+	tlsExtSupportedVersions = 43
+)
+
+var (
+	ErrInvalidTLSRecords = errors.New("TLS-Records must be only or alongside")
+	ErrTLSOptionsNoTLS   = errors.New("TLS-Tag requires TLS-Records")
+	ErrTLSOnlyWithFlows  = errors.New("TLS-Records=only cannot be combined with Flow-Records, use TLS-Records=alongside")
+
+	errTLSShort = errors.New("short TLS hello")
+)
+
+// tlsHello is the JSON form of a TLS ClientHello or ServerHello, the client is the host that
+// sent the ClientHello.  JA3 fingerprints the client and JA3S the server, see
+// https://github.com/salesforce/ja3 for how the strings are built.
+type tlsHello struct {
+	Type              string
+	Client            net.IP
+	ClientPort        uint16
+	Server            net.IP
+	ServerPort        uint16
+	Version           string
+	SNI               string   `json:",omitempty"`
+	ALPN              []string `json:",omitempty"`
+	SupportedVersions []string `json:",omitempty"`
+	CipherSuites      []uint16
+	Extensions        []uint16 `json:",omitempty"`
+	SupportedGroups   []uint16 `json:",omitempty"`
+	PointFormats      []uint16 `json:",omitempty"`
+	JA3               string   `json:",omitempty"`
+	JA3String         string   `json:",omitempty"`
+	JA3S              string   `json:",omitempty"`
+	JA3SString        string   `json:",omitempty"`
+
+	version uint16
+}
+
+// tlsHelloPacket extracts the TLS hello carried by a TCP segment, only hellos that start
+// the segment and are completely held by it are parsed
+func tlsHelloPacket(data []byte, lt layers.LinkType) (h tlsHello, ok bool) {
+	po := decodeOffsets(data, lt)
+	if !po.hasTrans || po.proto != layers.IPProtocolTCP || po.transEnd >= len(data) {
+		return
+	}
+	payload := data[po.transEnd:]
+	if len(payload) < tlsRecordHeaderLen+tlsHandshakeLen || payload[0] != tlsRecordHandshake {
+		return
+	}
+	if payload[5] != tlsClientHello && payload[5] != tlsServerHello {
+		return
+	}
+	var err error
+	if h, err = parseTLSHello(payload); err != nil {
+		return
+	}
+	var src, dst net.IP
+	switch po.et {
+	case layers.EthernetTypeIPv4:
+		src, dst = data[po.netOff+12:po.netOff+16], data[po.netOff+16:po.netOff+20]
+	case layers.EthernetTypeIPv6:
+		src, dst = data[po.netOff+8:po.netOff+24], data[po.netOff+24:po.netOff+40]
+	default:
+		return
+	}
+	sport := binary.BigEndian.Uint16(data[po.transOff:])
+	dport := binary.BigEndian.Uint16(data[po.transOff+2:])
+	src, dst = append(net.IP(nil), src...), append(net.IP(nil), dst...)
+	if h.Type == `ClientHello` {
+		h.Client, h.ClientPort, h.Server, h.ServerPort = src, sport, dst, dport
+	} else {
+		h.Client, h.ClientPort, h.Server, h.ServerPort = dst, dport, src, sport
+	}
+	ok = true
+	return
+}
+
+// parseTLSHello parses a TLS record holding a ClientHello or ServerHello, see RFC 8446 section 4.1
+func parseTLSHello(rec []byte) (h tlsHello, err error) {
+	if l := int(binary.BigEndian.Uint16(rec[3:])); len(rec) > tlsRecordHeaderLen+l {
+		rec = rec[:tlsRecordHeaderLen+l]
+	}
+	if len(rec) < tlsRecordHeaderLen+tlsHandshakeLen {
+		return h, errTLSShort
+	}
+	hs := rec[tlsRecordHeaderLen:]
+	typ := hs[0]
+	l := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < tlsHandshakeLen+l {
+		return h, errTLSShort
+	}
+	b := tlsReader(hs[tlsHandshakeLen : tlsHandshakeLen+l])
+	h.version = b.u16()
+	b.skip(tlsRandomLen)
+	b.skip(int(b.u8())) //session ID
+	if typ == tlsClientHello {
+		h.Type = `ClientHello`
+		for cs := tlsReader(b.bytes(int(b.u16()))); len(cs) >= 2; {
+			h.CipherSuites = append(h.CipherSuites, cs.u16())
+		}
+		b.skip(int(b.u8())) //compression methods
+	} else {
+		h.Type = `ServerHello`
+		h.CipherSuites = []uint16{b.u16()}
+		b.skip(1) //compression method
+	}
+	if b == nil {
+		return h, errTLSShort
+	}
+	if len(b) >= 2 {
+		exts := tlsReader(b.bytes(int(b.u16())))
+		for len(exts) >= 4 {
+			t := exts.u16()
+			ext := tlsReader(exts.bytes(int(exts.u16())))
+			h.Extensions = append(h.Extensions, t)
+			h.parseExtension(t, ext)
+		}
+	}
+	h.Version = tlsVersionString(h.version)
+	if h.Type == `ClientHello` {
+		h.JA3String = h.ja3String()
+		h.JA3 = md5Hex(h.JA3String)
+	} else {
+		h.JA3SString = h.ja3sString()
+		h.JA3S = md5Hex(h.JA3SString)
+	}
+	return
+}
+
+func (h *tlsHello) parseExtension(t uint16, ext tlsReader) {
+	switch t {
+	case tlsExtServerName:
+		for names := tlsReader(ext.bytes(int(ext.u16()))); len(names) >= 3; {
+			nt := names.u8()
+			name := names.bytes(int(names.u16()))
+			if nt == 0 && h.SNI == `` {
+				h.SNI = string(name)
+			}
+		}
+	case tlsExtSupportedGroups:
+		for groups := tlsReader(ext.bytes(int(ext.u16()))); len(groups) >= 2; {
+			h.SupportedGroups = append(h.SupportedGroups, groups.u16())
+		}
+	case tlsExtPointFormats:
+		for _, pf := range ext.bytes(int(ext.u8())) {
+			h.PointFormats = append(h.PointFormats, uint16(pf))
+		}
+	case tlsExtALPN:
+		for protos := tlsReader(ext.bytes(int(ext.u16()))); len(protos) >= 1; {
+			if p := protos.bytes(int(protos.u8())); len(p) > 0 {
+				h.ALPN = append(h.ALPN, string(p))
+			}
+		}
+	case tlsExtSupportedVersions:
+		if h.Type == `ServerHello` {
+			//the server names the version it picked
+			if len(ext) >= 2 {
+				h.SupportedVersions = []string{tlsVersionString(ext.u16())}
+			}
+			return
+		}
+		for vers := tlsReader(ext.bytes(int(ext.u8()))); len(vers) >= 2; {
+			if v := vers.u16(); !isGREASE(v) {
+				h.SupportedVersions = append(h.SupportedVersions, tlsVersionString(v))
+			}
+		}
+	}
+}
+
+// ja3String builds SSLVersion,Ciphers,Extensions,EllipticCurves,EllipticCurvePointFormats
+// with GREASE values left out
+func (h *tlsHello) ja3String() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinValues(h.CipherSuites),
+		joinValues(h.Extensions),
+		joinValues(h.SupportedGroups),
+		joinValues(h.PointFormats),
+	}, `,`)
+}
+
+// ja3sString builds SSLVersion,Cipher,Extensions
+func (h *tlsHello) ja3sString() string {
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinValues(h.CipherSuites),
+		joinValues(h.Extensions),
+	}, `,`)
+}
+
+func joinValues(vals []uint16) string {
+	strs := make([]string, 0, len(vals))
+	for _, v := range vals {
+		if !isGREASE(v) {
+			strs = append(strs, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(strs, `-`)
+}
+
+// isGREASE reports whether the value is one of the reserved values clients send to keep
+// servers tolerant of unknown values, see RFC 8701
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func tlsVersionString(v uint16) string {
+	switch v {
+	case 0x0300:
+		return `SSL 3.0`
+	case 0x0301:
+		return `TLS 1.0`
+	case 0x0302:
+		return `TLS 1.1`
+	case 0x0303:
+		return `TLS 1.2`
+	case 0x0304:
+		return `TLS 1.3`
+	}
+	return fmt.Sprintf("0x%04x", v)
+}
+
+func (h tlsHello) encode() ([]byte, error) {
+	return json.Marshal(h)
+}
+
+// tlsReader consumes big endian values from a buffer, reading past the end empties the buffer
+// and sets it to nil so a short message can be detected once at the end
+type tlsReader []byte
+
+func (r *tlsReader) bytes(n int) []byte {
+	if n > len(*r) {
+		*r = nil
+		return nil
+	}
+	b := (*r)[:n]
+	*r = (*r)[n:]
+	return b
+}
+
+func (r *tlsReader) skip(n int) {
+	r.bytes(n)
+}
+
+func (r *tlsReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tlsReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
@@ -0,0 +1,168 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// tlsVec prefixes b with its length in n bytes
+func tlsVec(n int, b ...byte) []byte {
+	l := len(b)
+	hdr := make([]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		hdr[i] = byte(l)
+		l >>= 8
+	}
+	return append(hdr, b...)
+}
+
+func tlsExt(t uint16, data []byte) []byte {
+	return append([]byte{byte(t >> 8), byte(t)}, tlsVec(2, data...)...)
+}
+
+func tlsU16s(vals ...uint16) (b []byte) {
+	for _, v := range vals {
+		b = append(b, byte(v>>8), byte(v))
+	}
+	return
+}
+
+func cat(bs ...[]byte) (r []byte) {
+	for _, b := range bs {
+		r = append(r, b...)
+	}
+	return
+}
+
+// tlsRecord wraps a hello body in its handshake and record headers
+func tlsRecord(typ byte, body []byte) []byte {
+	hs := append([]byte{typ}, tlsVec(3, body...)...)
+	return append([]byte{tlsRecordHandshake, 3, 1}, tlsVec(2, hs...)...)
+}
+
+// testClientHello is a TLS 1.3 ClientHello with GREASE values sprinkled in the way browsers send them
+func testClientHello() []byte {
+	exts := cat(
+		tlsExt(0x1a1a, nil),
+		tlsExt(tlsExtServerName, tlsVec(2, append([]byte{0}, tlsVec(2, []byte(`example.com`)...)...)...)),
+		tlsExt(tlsExtSupportedGroups, tlsVec(2, tlsU16s(0x2a2a, 29, 23)...)),
+		tlsExt(tlsExtPointFormats, tlsVec(1, 0)),
+		tlsExt(tlsExtALPN, tlsVec(2, cat(tlsVec(1, []byte(`h2`)...), tlsVec(1, []byte(`http/1.1`)...))...)),
+		tlsExt(tlsExtSupportedVersions, tlsVec(1, tlsU16s(0x3a3a, 0x0304, 0x0303)...)),
+	)
+	body := cat(
+		tlsU16s(0x0303),
+		make([]byte, tlsRandomLen),
+		tlsVec(1, make([]byte, 32)...), //session ID
+		tlsVec(2, tlsU16s(0x0a0a, 0x1301, 0xc02f)...),
+		tlsVec(1, 0), //compression methods
+		tlsVec(2, exts...),
+	)
+	return tlsRecord(tlsClientHello, body)
+}
+
+func testServerHello() []byte {
+	body := cat(
+		tlsU16s(0x0303),
+		make([]byte, tlsRandomLen),
+		tlsVec(1, make([]byte, 32)...),
+		tlsU16s(0x1301),
+		[]byte{0},
+		tlsVec(2, tlsExt(tlsExtSupportedVersions, tlsU16s(0x0304))...),
+	)
+	return tlsRecord(tlsServerHello, body)
+}
+
+func TestTLSClientHello(t *testing.T) {
+	pkt := tcpFrame(t, `10.0.0.5`, `10.0.0.9`, 50000, 443, testClientHello())
+	h, ok := tlsHelloPacket(pkt, layers.LinkTypeEthernet)
+	if !ok {
+		t.Fatal("failed to find the ClientHello")
+	}
+	if h.Type != `ClientHello` || h.Version != `TLS 1.2` || h.SNI != `example.com` {
+		t.Fatalf("bad hello %+v", h)
+	} else if !h.Client.Equal(net.ParseIP(`10.0.0.5`)) || h.ClientPort != 50000 || !h.Server.Equal(net.ParseIP(`10.0.0.9`)) || h.ServerPort != 443 {
+		t.Fatalf("bad endpoints %+v", h)
+	} else if len(h.ALPN) != 2 || h.ALPN[0] != `h2` || h.ALPN[1] != `http/1.1` {
+		t.Fatalf("bad ALPN %q", h.ALPN)
+	} else if len(h.SupportedVersions) != 2 || h.SupportedVersions[0] != `TLS 1.3` || h.SupportedVersions[1] != `TLS 1.2` {
+		t.Fatalf("bad supported versions %q", h.SupportedVersions)
+	}
+	//GREASE values are reported but left out of the fingerprint
+	if len(h.CipherSuites) != 3 || len(h.Extensions) != 6 || len(h.SupportedGroups) != 3 {
+		t.Fatalf("bad hello values %+v", h)
+	} else if h.JA3String != `771,4865-49199,0-10-11-16-43,29-23,0` {
+		t.Fatalf("bad JA3 string %q", h.JA3String)
+	} else if h.JA3 != md5Hex(h.JA3String) || len(h.JA3) != 32 || h.JA3S != `` {
+		t.Fatalf("bad JA3 %q %q", h.JA3, h.JA3S)
+	}
+}
+
+func TestTLSServerHello(t *testing.T) {
+	pkt := tcpFrame(t, `10.0.0.9`, `10.0.0.5`, 443, 50000, testServerHello())
+	h, ok := tlsHelloPacket(pkt, layers.LinkTypeEthernet)
+	if !ok {
+		t.Fatal("failed to find the ServerHello")
+	}
+	//the client is still the host that sent the ClientHello
+	if !h.Client.Equal(net.ParseIP(`10.0.0.5`)) || h.ClientPort != 50000 || !h.Server.Equal(net.ParseIP(`10.0.0.9`)) || h.ServerPort != 443 {
+		t.Fatalf("bad endpoints %+v", h)
+	} else if h.Type != `ServerHello` || len(h.SupportedVersions) != 1 || h.SupportedVersions[0] != `TLS 1.3` {
+		t.Fatalf("bad hello %+v", h)
+	} else if h.JA3SString != `771,4865,43` || h.JA3S != md5Hex(h.JA3SString) || h.JA3 != `` {
+		t.Fatalf("bad JA3S %q %q", h.JA3SString, h.JA3S)
+	}
+}
+
+func TestTLSMalformed(t *testing.T) {
+	for _, rec := range [][]byte{testClientHello(), testServerHello()} {
+		pkt := tcpFrame(t, `10.0.0.5`, `10.0.0.9`, 50000, 443, rec)
+		payload := len(pkt) - len(rec)
+		//hellos split across segments are not parsed
+		prefixes(pkt, func(b []byte) {
+			if _, ok := tlsHelloPacket(b, layers.LinkTypeEthernet); ok {
+				t.Fatalf("parsed a hello truncated to %d of %d bytes", len(b)-payload, len(rec))
+			}
+		})
+		//lengths that overrun their vectors must not read past the record
+		for i := payload; i < len(pkt); i++ {
+			for _, v := range []byte{0, 0x7f, 0xff} {
+				b := append([]byte(nil), pkt...)
+				b[i] = v
+				tlsHelloPacket(b, layers.LinkTypeEthernet)
+			}
+		}
+	}
+	bad := [][]byte{
+		tcpFrame(t, `10.0.0.5`, `10.0.0.9`, 50000, 443, []byte("GET / HTTP/1.1\r\n\r\n")),
+		tcpFrame(t, `10.0.0.5`, `10.0.0.9`, 50000, 443, tlsRecord(11, make([]byte, 64))), //certificate
+		udpFrame(t, `10.0.0.5`, `10.0.0.9`, 50000, 443, testClientHello()),
+	}
+	for _, pkt := range bad {
+		if h, ok := tlsHelloPacket(pkt, layers.LinkTypeEthernet); ok {
+			t.Fatalf("parsed %x into %+v", pkt, h)
+		}
+	}
+}
+
+func TestGREASE(t *testing.T) {
+	for _, v := range []uint16{0x0a0a, 0x1a1a, 0xfafa} {
+		if !isGREASE(v) {
+			t.Fatalf("%#x is GREASE", v)
+		}
+	}
+	for _, v := range []uint16{0x0a1a, 0x1301, 0x0a0b, 0} {
+		if isGREASE(v) {
+			t.Fatalf("%#x is not GREASE", v)
+		}
+	}
+}
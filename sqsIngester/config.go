@@ -19,6 +19,7 @@ import (
 	"github.com/gravwell/ingest/v3"
 	"github.com/gravwell/ingest/v3/config"
 	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/timegrinder/v3"
 )
 
 const (
@@ -114,6 +115,11 @@ func verifyConfig(c *cfgType) error {
 				return fmt.Errorf("Invalid timezone override %v in listener %v: %v", v.Timezone_Override, k, err)
 			}
 		}
+		if v.Timestamp_Format_Override != `` {
+			if err := timegrinder.ValidateFormatOverride(v.Timestamp_Format_Override); err != nil {
+				return fmt.Errorf("Invalid Timestamp-Format-Override %v in queue %v: %v", v.Timestamp_Format_Override, k, err)
+			}
+		}
 
 		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
 			return fmt.Errorf("Listener %s preprocessor invalid: %v", k, err)
@@ -26,6 +26,7 @@ import (
 	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/ingesters/v3/utils"
 	"github.com/gravwell/ingesters/v3/version"
+	"github.com/gravwell/timegrinder/v3"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -39,6 +40,10 @@ const (
 	batchSize            = 512
 	maxDataSize      int = 8 * 1024 * 1024
 	initDataSize     int = 512 * 1024
+
+	maxReceiveMessages = 10 //the most SQS hands out at once
+	receiveWaitSeconds = 20 //long poll so empty queues aren't hammered
+	deleteSyncTimeout  = 10 * time.Second
 )
 
 var (
@@ -260,6 +265,29 @@ func debugout(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 }
 
+// newTimeGrinder returns the timegrinder used on the lines of S3 objects, nil when timestamps are ignored
+func (hcfg *handlerConfig) newTimeGrinder() (tg *timegrinder.TimeGrinder, err error) {
+	if hcfg.ignoreTimestamps {
+		return
+	}
+	tcfg := timegrinder.Config{
+		EnableLeftMostSeed: true,
+		FormatOverride:     hcfg.formatOverride,
+	}
+	if tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+		return nil, fmt.Errorf("Failed to get a handle on the timegrinder: %v", err)
+	}
+	if hcfg.setLocalTime {
+		tg.SetLocalTime()
+	}
+	if hcfg.timezoneOverride != `` {
+		if err = tg.SetTimezone(hcfg.timezoneOverride); err != nil {
+			return nil, fmt.Errorf("Failed to set timezone to %v: %v", hcfg.timezoneOverride, err)
+		}
+	}
+	return
+}
+
 func queueRunner(hcfg *handlerConfig) {
 	defer hcfg.wg.Done()
 
@@ -269,6 +297,12 @@ func queueRunner(hcfg *handlerConfig) {
 	}))
 
 	svc := sqs.New(sess)
+	objs := newObjectReader(sess)
+	tg, err := hcfg.newTimeGrinder()
+	if err != nil {
+		lg.Error("%v", err)
+		return
+	}
 
 	c := make(chan *sqs.ReceiveMessageOutput)
 	for {
@@ -280,6 +314,8 @@ func queueRunner(hcfg *handlerConfig) {
 		}
 
 		req = req.SetQueueUrl(hcfg.queue)
+		req = req.SetMaxNumberOfMessages(maxReceiveMessages)
+		req = req.SetWaitTimeSeconds(receiveWaitSeconds)
 		err := req.Validate()
 		if err != nil {
 			lg.Error("sqs request validation: %v", err)
@@ -292,6 +328,7 @@ func queueRunner(hcfg *handlerConfig) {
 			if err != nil {
 				lg.Error("sqs receive message: %v", err)
 				c <- nil
+				return
 			}
 			c <- o
 		}()
@@ -306,38 +343,94 @@ func queueRunner(hcfg *handlerConfig) {
 		}
 
 		// we may have multiple packed messages
-		for _, v := range out.Messages {
-			msg := []byte(*v.Body)
-
-			var ts entry.Timestamp
-			if !hcfg.ignoreTimestamps {
-				// grab the timestamp from SQS
-				t, mok := v.Attributes["SentTimestamp"]
-				if !mok {
-					lg.Error("SQS did not provide timestamp for message: %v", v.Attributes)
-				} else {
-					ut, err := strconv.ParseInt(*t, 10, 64)
-					if err != nil {
-						lg.Error("parseint on unix time: %v", *t)
-					} else {
-						ts = entry.UnixTime(ut/1000, 0)
-					}
-				}
-			} else {
-				ts = entry.Now()
+		var handled []*sqs.DeleteMessageBatchRequestEntry
+		for i, v := range out.Messages {
+			if ok, err := handleMessage(v, hcfg, objs, tg); err != nil {
+				lg.Error("Sending message: %v", err)
+				return
+			} else if ok {
+				handled = append(handled, &sqs.DeleteMessageBatchRequestEntry{
+					Id:            aws.String(strconv.Itoa(i)),
+					ReceiptHandle: v.ReceiptHandle,
+				})
 			}
+		}
+		if err := deleteMessages(svc, hcfg.queue, handled); err != nil {
+			lg.Error("Failed to delete messages from %s: %v", hcfg.queue, err)
+		}
+	}
+}
 
-			ent := &entry.Entry{
-				SRC:  hcfg.src,
-				TS:   ts,
-				Tag:  hcfg.tag,
-				Data: msg,
+// handleMessage ingests the body of a message, or the objects it references when it is an S3
+// event notification.  ok is false when a referenced object could not be read, the message is
+// then left on the queue to be delivered again once its visibility timeout runs out.
+// Malformed S3 event notifications are logged and deleted.
+func handleMessage(v *sqs.Message, hcfg *handlerConfig, objs *objectReader, tg *timegrinder.TimeGrinder) (ok bool, err error) {
+	if refs, isS3, perr := s3Objects(*v.Body); isS3 {
+		if perr != nil {
+			//a malformed notification can never be read, delivering it again does not help
+			lg.Error("Deleting bad S3 event notification in %s: %v", hcfg.queue, perr)
+			return true, nil
+		}
+		for _, obj := range refs {
+			n, err := objs.ingest(obj, hcfg, tg)
+			if err != nil {
+				lg.Error("Failed to ingest s3://%s/%s after %d entries: %v", obj.bucket, obj.key, n, err)
+				return false, nil
 			}
+			debugout("Ingested %d entries from s3://%s/%s\n", n, obj.bucket, obj.key)
+		}
+		return true, nil
+	}
 
-			if err = hcfg.proc.Process(ent); err != nil {
-				lg.Error("Sending message: %v", err)
-				return
+	var ts entry.Timestamp
+	if !hcfg.ignoreTimestamps {
+		// grab the timestamp from SQS
+		t, mok := v.Attributes["SentTimestamp"]
+		if !mok {
+			lg.Error("SQS did not provide timestamp for message: %v", v.Attributes)
+		} else {
+			ut, err := strconv.ParseInt(*t, 10, 64)
+			if err != nil {
+				lg.Error("parseint on unix time: %v", *t)
+			} else {
+				ts = entry.UnixTime(ut/1000, 0)
 			}
 		}
+	} else {
+		ts = entry.Now()
+	}
+
+	ent := &entry.Entry{
+		SRC:  hcfg.src,
+		TS:   ts,
+		Tag:  hcfg.tag,
+		Data: []byte(*v.Body),
+	}
+	if err = hcfg.proc.Process(ent); err != nil {
+		return
+	}
+	return true, nil
+}
+
+// deleteMessages removes handled messages from the queue once the indexers have acknowledged
+// their entries, messages that are not deleted are delivered again
+func deleteMessages(svc *sqs.SQS, queue string, handled []*sqs.DeleteMessageBatchRequestEntry) error {
+	if len(handled) == 0 {
+		return nil
+	}
+	if err := igst.Sync(deleteSyncTimeout); err != nil {
+		return fmt.Errorf("entries not acknowledged: %v", err)
+	}
+	out, err := svc.DeleteMessageBatch(&sqs.DeleteMessageBatchInput{
+		QueueUrl: aws.String(queue),
+		Entries:  handled,
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range out.Failed {
+		lg.Error("Failed to delete message from %s: %s", queue, aws.StringValue(f.Message))
 	}
+	return nil
 }
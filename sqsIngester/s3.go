@@ -0,0 +1,197 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/timegrinder/v3"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	s3EventSource   = `aws:s3`
+	s3ObjectCreated = `ObjectCreated:`
+	s3TestEvent     = `s3:TestEvent`
+	snsNotification = `Notification`
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// s3Event is an S3 event notification, see
+// https://docs.aws.amazon.com/AmazonS3/latest/dev/notification-content-structure.html
+type s3Event struct {
+	Records []struct {
+		EventSource string
+		AwsRegion   string
+		EventTime   time.Time
+		EventName   string
+		S3          struct {
+			Bucket struct {
+				Name string
+			}
+			Object struct {
+				Key  string
+				Size int64
+			}
+		}
+	}
+	Event string //only set on test events
+}
+
+// snsMessage is an SNS notification delivered to an SQS queue, the S3 event is in Message
+type snsMessage struct {
+	Type    string
+	Message string
+}
+
+type s3Object struct {
+	region string
+	bucket string
+	key    string
+	ts     time.Time
+}
+
+// s3Objects returns the objects created according to an S3 event notification, the notification
+// may be wrapped in an SNS notification.  ok is false when the message is not an S3 event
+// notification, test events and events that do not create objects return ok with no objects.
+func s3Objects(body string) (objs []s3Object, ok bool, err error) {
+	body = strings.TrimSpace(body)
+	if !strings.HasPrefix(body, `{`) {
+		return
+	}
+	var sns snsMessage
+	if json.Unmarshal([]byte(body), &sns) == nil && sns.Type == snsNotification && sns.Message != `` {
+		body = sns.Message
+	}
+	var ev s3Event
+	if json.Unmarshal([]byte(body), &ev) != nil {
+		return
+	} else if ev.Event == s3TestEvent {
+		ok = true
+		return
+	}
+	for _, r := range ev.Records {
+		if r.EventSource != s3EventSource {
+			return nil, false, nil
+		}
+		ok = true
+		if !strings.HasPrefix(r.EventName, s3ObjectCreated) {
+			continue
+		}
+		//object keys are URL encoded with spaces as plus signs
+		var key string
+		if key, err = url.QueryUnescape(r.S3.Object.Key); err != nil {
+			return nil, true, fmt.Errorf("invalid object key %q: %v", r.S3.Object.Key, err)
+		}
+		objs = append(objs, s3Object{
+			region: r.AwsRegion,
+			bucket: r.S3.Bucket.Name,
+			key:    key,
+			ts:     r.EventTime,
+		})
+	}
+	return
+}
+
+// objectReader fetches objects with a client for each region, buckets may live in a
+// different region than the queue
+type objectReader struct {
+	sync.Mutex
+	sess    *session.Session
+	clients map[string]*s3.S3
+}
+
+func newObjectReader(sess *session.Session) *objectReader {
+	return &objectReader{
+		sess:    sess,
+		clients: make(map[string]*s3.S3),
+	}
+}
+
+func (or *objectReader) client(region string) *s3.S3 {
+	or.Lock()
+	defer or.Unlock()
+	c, ok := or.clients[region]
+	if !ok {
+		cfg := aws.NewConfig()
+		if region != `` {
+			cfg = cfg.WithRegion(region)
+		}
+		c = s3.New(or.sess, cfg)
+		or.clients[region] = c
+	}
+	return c
+}
+
+// ingest sends every line of an object as an entry, gzip compressed objects are decompressed.
+// Lines are timestamped by the timegrinder, lines without a timestamp get the time of the
+// event that created the object.  Ignore-Timestamps applies the current time instead.
+func (or *objectReader) ingest(obj s3Object, hcfg *handlerConfig, tg *timegrinder.TimeGrinder) (n int, err error) {
+	out, err := or.client(obj.region).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(obj.bucket),
+		Key:    aws.String(obj.key),
+	})
+	if err != nil {
+		return
+	}
+	defer out.Body.Close()
+	brdr := bufio.NewReader(out.Body)
+	var rdr io.Reader = brdr
+	if magic, _ := brdr.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(brdr); err != nil {
+			return
+		}
+		defer gz.Close()
+		rdr = gz
+	}
+	objTS := entry.FromStandard(obj.ts)
+	if hcfg.ignoreTimestamps {
+		objTS = entry.Now()
+	}
+	scn := bufio.NewScanner(rdr)
+	scn.Buffer(make([]byte, initDataSize), maxDataSize)
+	for scn.Scan() {
+		ln := bytes.TrimRight(scn.Bytes(), "\r")
+		if len(ln) == 0 {
+			continue
+		}
+		ent := &entry.Entry{
+			SRC:  hcfg.src,
+			TS:   objTS,
+			Tag:  hcfg.tag,
+			Data: append([]byte(nil), ln...),
+		}
+		if tg != nil && !hcfg.ignoreTimestamps {
+			if ts, ok, lerr := tg.Extract(ent.Data); lerr == nil && ok {
+				ent.TS = entry.FromStandard(ts)
+			}
+		}
+		if err = hcfg.proc.Process(ent); err != nil {
+			return
+		}
+		n++
+	}
+	err = scn.Err()
+	return
+}
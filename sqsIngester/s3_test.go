@@ -0,0 +1,69 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const testS3Event = `{"Records":[
+	{"eventSource":"aws:s3","awsRegion":"us-west-2","eventTime":"2020-01-02T03:04:05.000Z","eventName":"ObjectCreated:Put",
+	 "s3":{"bucket":{"name":"logs"},"object":{"key":"2020/01/app+log%3D1.gz","size":10}}},
+	{"eventSource":"aws:s3","awsRegion":"us-west-2","eventTime":"2020-01-02T03:04:06.000Z","eventName":"ObjectRemoved:Delete",
+	 "s3":{"bucket":{"name":"logs"},"object":{"key":"old.log"}}}
+]}`
+
+func TestS3Objects(t *testing.T) {
+	sns, err := json.Marshal(snsMessage{Type: snsNotification, Message: testS3Event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the plain and SNS wrapped notifications hold the same objects
+	for _, body := range []string{testS3Event, "\n" + string(sns)} {
+		objs, ok, err := s3Objects(body)
+		if err != nil || !ok {
+			t.Fatalf("%s was not an S3 event notification: %v", body, err)
+		} else if len(objs) != 1 {
+			t.Fatalf("%s created %d objects", body, len(objs))
+		}
+		exp := s3Object{region: `us-west-2`, bucket: `logs`, key: `2020/01/app log=1.gz`, ts: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+		if o := objs[0]; o.region != exp.region || o.bucket != exp.bucket || o.key != exp.key || !o.ts.Equal(exp.ts) {
+			t.Fatalf("bad object %+v", o)
+		}
+	}
+
+	//test events are notifications without any objects
+	if objs, ok, err := s3Objects(`{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"logs"}`); err != nil || !ok || len(objs) != 0 {
+		t.Fatalf("bad test event %v %v %v", objs, ok, err)
+	}
+	//keys that cannot be decoded are errors so the notification is deleted
+	bad := `{"Records":[{"eventSource":"aws:s3","eventName":"ObjectCreated:Put","s3":{"bucket":{"name":"logs"},"object":{"key":"bad%zz"}}}]}`
+	if _, ok, err := s3Objects(bad); !ok || err == nil {
+		t.Fatalf("accepted a bad key %v %v", ok, err)
+	}
+	if ok, err := handleMessage(&sqs.Message{Body: aws.String(bad)}, &handlerConfig{queue: `test`}, nil, nil); !ok || err != nil {
+		t.Fatalf("bad notification would be delivered again %v %v", ok, err)
+	}
+	//anything else is an ordinary message
+	for _, body := range []string{
+		`plain text`,
+		`{"user":"bob"}`,
+		`{"Records":[{"eventSource":"aws:sqs"}]}`,
+		`{"Type":"Notification","Message":"hello"}`,
+		`{"Records":`,
+	} {
+		if objs, ok, err := s3Objects(body); ok || err != nil || len(objs) != 0 {
+			t.Fatalf("%s was an S3 event notification %v %v", body, objs, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+)
+
+var (
+	ErrUnknownEncoding = errors.New("Unknown character encoding")
+)
+
+// GetEncoding resolves a character set name such as "utf-16le", "cp1252", "latin1", or "shift_jis"
+// into an encoding that can transcode to UTF-8.  UTF-8 and empty names return a nil encoding
+// which indicates that no conversion is required.
+func GetEncoding(name string) (enc encoding.Encoding, err error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	switch name {
+	case ``, `utf8`, `utf-8`:
+		return
+	}
+	for _, n := range []string{name, strings.Replace(name, `-`, `_`, -1)} {
+		//IANA first so that latin1 is treated as true ISO-8859-1, then the WHATWG names
+		if enc, err = ianaindex.IANA.Encoding(n); err == nil && enc != nil {
+			return
+		}
+		if enc, err = htmlindex.Get(n); err == nil && enc != nil {
+			return
+		}
+	}
+	enc = nil
+	err = fmt.Errorf("%v %q", ErrUnknownEncoding, name)
+	return
+}
+
+// Transcode converts b from the given encoding into UTF-8, a nil encoding is a passthrough.
+// A new decoder is used on each call so Transcode is safe for concurrent use.
+func Transcode(enc encoding.Encoding, b []byte) ([]byte, error) {
+	if enc == nil {
+		return b, nil
+	}
+	return enc.NewDecoder().Bytes(b)
+}
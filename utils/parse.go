@@ -56,6 +56,18 @@ func ParseSource(v string) (ret net.IP, err error) {
 	return
 }
 
+// NormalizeSource returns IPv4 addresses in their 4 byte form and all others in their
+// 16 byte form.  Addresses parsed from strings and IPv4 peers of dual stack sockets are
+// 16 byte IPv4-mapped addresses, which would otherwise be stored as IPv6 entry sources.
+func NormalizeSource(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	} else if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
 func ParseInt(v string) (r uint64, err error) {
 	if strings.HasPrefix(v, `0x`) {
 		r, err = strconv.ParseUint(strings.TrimPrefix(v, `0x`), 16, 64)
@@ -52,3 +52,24 @@ func TestParseBadSource(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizeSource(t *testing.T) {
+	tests := []struct {
+		v   net.IP
+		len int
+	}{
+		{net.ParseIP(`192.168.0.1`), 4},
+		{net.ParseIP(`::ffff:10.0.0.1`), 4},
+		{net.IP{10, 0, 0, 1}, 4},
+		{net.ParseIP(`2001:db8::1`), 16},
+		{net.ParseIP(`::1`), 16},
+	}
+	for _, v := range tests {
+		if r := NormalizeSource(v.v); len(r) != v.len || !r.Equal(v.v) {
+			t.Fatalf("Bad normalized source for %v: %v (%d bytes)", v.v, r, len(r))
+		}
+	}
+	if r := NormalizeSource(nil); r != nil {
+		t.Fatalf("nil source normalized to %v", r)
+	}
+}
@@ -11,6 +11,7 @@ package utils
 import (
 	"encoding/gob"
 	"errors"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
@@ -25,8 +26,9 @@ var (
 
 type State struct {
 	sync.Mutex
-	fpath string
-	perm  os.FileMode
+	fpath  string
+	perm   os.FileMode
+	nosync bool
 }
 
 func NewState(pth string, perm os.FileMode) (s *State, err error) {
@@ -55,8 +57,22 @@ func NewState(pth string, perm os.FileMode) (s *State, err error) {
 	return
 }
 
+// SetSync controls whether writes are synced to disk before the state file is replaced,
+// writes are synced by default.  Without syncing a crash may lose the latest writes, the
+// state file is still always replaced whole.
+func (s *State) SetSync(sync bool) {
+	s.Lock()
+	s.nosync = !sync
+	s.Unlock()
+}
+
 func (s *State) Write(f interface{}) (err error) {
 	s.Lock()
+	if s.nosync {
+		err = s.writeNoSync(f)
+		s.Unlock()
+		return
+	}
 	var fout *safefile.File
 	if fout, err = safefile.Create(s.fpath, s.perm); err == nil {
 		n := fout.Name() //incase we have to destroy it
@@ -72,6 +88,29 @@ func (s *State) Write(f interface{}) (err error) {
 	return
 }
 
+// writeNoSync writes the state to a temporary file and renames it over the state file,
+// caller must hold the lock
+func (s *State) writeNoSync(f interface{}) (err error) {
+	var fout *os.File
+	if fout, err = ioutil.TempFile(filepath.Dir(s.fpath), filepath.Base(s.fpath)+`.tmp`); err != nil {
+		return
+	}
+	n := fout.Name()
+	if err = fout.Chmod(s.perm); err == nil {
+		err = gob.NewEncoder(fout).Encode(f)
+	}
+	if lerr := fout.Close(); err == nil {
+		err = lerr
+	}
+	if err == nil {
+		err = os.Rename(n, s.fpath)
+	}
+	if err != nil {
+		os.Remove(n)
+	}
+	return
+}
+
 func (s *State) Read(f interface{}) (err error) {
 	s.Lock()
 	var fin *os.File
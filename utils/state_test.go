@@ -64,6 +64,38 @@ func TestNewState(t *testing.T) {
 	}
 }
 
+func TestNoSyncState(t *testing.T) {
+	p := filepath.Join(tdir, "state-nosync")
+	s, err := NewState(p, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetSync(false)
+	for i := 0; i < 4; i++ {
+		tv := testS{
+			Foo: `test`,
+			Bar: i,
+			Baz: 1.1,
+		}
+		var tv2 testS
+		if err = s.Write(tv); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Read(&tv2); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tv, tv2) {
+			t.Fatal("Readout is wrong")
+		}
+	}
+	//temporary files must not be left behind
+	if m, err := filepath.Glob(p + `.tmp*`); err != nil {
+		t.Fatal(err)
+	} else if len(m) != 0 {
+		t.Fatal("temporary state files left behind", m)
+	}
+}
+
 func TestEmptyState(t *testing.T) {
 	s, err := NewState(filepath.Join(tdir, "state2"), 0660)
 	if err != nil {
@@ -0,0 +1,68 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+)
+
+var (
+	binaryOpen  = []byte(`<Binary`)
+	binaryClose = []byte(`</Binary>`)
+)
+
+// trimBinary shortens the text of the Binary elements in the event XML to at most limit
+// bytes, a limit of zero drops the binary data entirely.  Some providers attach multi
+// megabyte dumps as Binary data.
+func trimBinary(buff []byte, limit int) (r []byte, trimmed bool) {
+	//binary data is rendered as hex, keep whole bytes
+	limit -= limit % 2
+	for off := 0; off < len(buff); {
+		idx := bytes.Index(buff[off:], binaryOpen)
+		if idx == -1 {
+			break
+		}
+		start := off + idx
+		//make sure this is the Binary element and not something like BinaryData
+		tagEnd := start + len(binaryOpen)
+		if tagEnd >= len(buff) || (buff[tagEnd] != '>' && buff[tagEnd] != ' ') {
+			off = tagEnd
+			continue
+		}
+		gt := bytes.IndexByte(buff[tagEnd:], '>')
+		if gt == -1 {
+			break
+		}
+		gt += tagEnd
+		if buff[gt-1] == '/' {
+			off = gt + 1 //empty element
+			continue
+		}
+		end := bytes.Index(buff[gt+1:], binaryClose)
+		if end == -1 {
+			break
+		}
+		end += gt + 1
+		if end-(gt+1) > limit {
+			if r == nil {
+				r = make([]byte, 0, len(buff))
+			}
+			r = append(r, buff[:gt+1+limit]...)
+			trimmed = true
+			buff = buff[end:]
+			off = 0
+			continue
+		}
+		off = end + len(binaryClose)
+	}
+	if !trimmed {
+		return buff, false
+	}
+	return append(r, buff...), true
+}
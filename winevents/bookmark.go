@@ -0,0 +1,227 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/gravwell/winevent/v3/wineventlog"
+)
+
+const (
+	bookmarkPerm       os.FileMode = 0660
+	bookmarkTmpExt                 = `.tmp`
+	bookmarkCorruptExt             = `.corrupt`
+)
+
+var (
+	ErrBookmarkClosed = errors.New("Bookmark is not open")
+)
+
+// bookmarkStore holds the last record ID of each channel.  It reads and writes the same gob
+// encoded map as the winevent BookmarkHandler, but every sync writes a new file and renames
+// it over the old one so a crash mid write cannot leave a truncated bookmark behind.
+type bookmarkStore struct {
+	mtx       sync.Mutex
+	path      string
+	bookmarks map[string]uint64
+	corrupted bool
+	open      bool
+}
+
+// newBookmarkStore loads the bookmarks at path, a corrupted bookmark file is moved aside to
+// path.corrupt and the store reports it through Corrupted so the recovery policy can be applied
+func newBookmarkStore(path string) (*bookmarkStore, error) {
+	bs := &bookmarkStore{
+		path:      path,
+		bookmarks: map[string]uint64{},
+		open:      true,
+	}
+	fin, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			//nothing stored yet, make sure we can create the bookmark
+			return bs, bs.Sync()
+		}
+		return nil, err
+	}
+	st, err := fin.Stat()
+	if err != nil {
+		fin.Close()
+		return nil, err
+	} else if st.Size() > 0 {
+		if err = gob.NewDecoder(fin).Decode(&bs.bookmarks); err != nil {
+			bs.corrupted = true
+			bs.bookmarks = map[string]uint64{}
+		}
+	}
+	fin.Close()
+	if bs.corrupted {
+		if err = os.Rename(path, path+bookmarkCorruptExt); err != nil {
+			return nil, err
+		}
+	}
+	return bs, nil
+}
+
+// Corrupted reports whether the bookmark file could not be decoded when it was loaded
+func (bs *bookmarkStore) Corrupted() bool {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	return bs.corrupted
+}
+
+func (bs *bookmarkStore) Update(name string, val uint64) error {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if !bs.open {
+		return ErrBookmarkClosed
+	}
+	bs.bookmarks[name] = val
+	return nil
+}
+
+// Get returns the bookmark for a channel and whether one was stored
+func (bs *bookmarkStore) Get(name string) (uint64, bool, error) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if !bs.open {
+		return 0, false, ErrBookmarkClosed
+	}
+	v, ok := bs.bookmarks[name]
+	return v, ok, nil
+}
+
+func (bs *bookmarkStore) Sync() error {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if !bs.open {
+		return ErrBookmarkClosed
+	}
+	return bs.store()
+}
+
+func (bs *bookmarkStore) Close() error {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if !bs.open {
+		return nil
+	}
+	bs.open = false
+	return bs.store()
+}
+
+// store writes the bookmarks, the caller holds the lock
+func (bs *bookmarkStore) store() error {
+	return writeGobFile(bs.path, bs.bookmarks)
+}
+
+// writeGobFile encodes v to a temporary file and swaps it into place so a crash mid
+// write cannot leave a truncated file behind
+func writeGobFile(path string, v interface{}) error {
+	tmp := path + bookmarkTmpExt
+	fout, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, bookmarkPerm)
+	if err != nil {
+		return err
+	}
+	if err = gob.NewEncoder(fout).Encode(v); err != nil {
+		fout.Close()
+		return err
+	} else if err = fout.Sync(); err != nil {
+		fout.Close()
+		return err
+	} else if err = fout.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// channelRecords returns the oldest and newest record IDs currently held by a channel,
+// newest is zero when the channel is empty
+func channelRecords(session wineventlog.EvtHandle, channel string) (oldest, newest uint64, err error) {
+	var hnd wineventlog.EvtHandle
+	if hnd, err = wineventlog.EvtOpenLog(session, channel, wineventlog.EvtOpenChannelPath); err != nil {
+		return
+	}
+	defer wineventlog.Close(hnd)
+	var lfi wineventlog.LogFileInfo
+	if lfi, err = wineventlog.QueryLogFile(hnd); err != nil {
+		return
+	}
+	oldest = lfi.OldestRecord
+	if lfi.NumberOfRecords > 0 {
+		newest = lfi.OldestRecord + lfi.NumberOfRecords - 1
+	}
+	return
+}
+
+// bookmarkExpired reports whether a bookmark no longer points into the channel, either
+// because the records after it were overwritten or because the channel was cleared
+func bookmarkExpired(last, oldest, newest uint64) bool {
+	if last == 0 {
+		return false
+	} else if newest == 0 {
+		//the channel is empty, so it was cleared after the bookmark was taken
+		return true
+	}
+	return last+1 < oldest || last > newest
+}
+
+// bookmarkStart returns the record ID a stream starts after.  When the bookmark file was corrupted
+// or the bookmark no longer points into the channel the Bookmark-Recovery policy picks the start
+// and the recovery is logged, rather than silently starting over.
+func (m *mainService) bookmarkStart(c *streamParams, session wineventlog.EvtHandle) (last uint64, err error) {
+	var ok bool
+	if last, ok, err = m.bmk.Get(c.Name); err != nil {
+		return
+	}
+	var reason string
+	if !ok && m.bmk.Corrupted() {
+		reason = "the bookmark file was corrupted"
+	} else if ok {
+		oldest, newest, lerr := channelRecords(session, c.Channel)
+		if lerr != nil {
+			warnout("Failed to check the bookmark for %s against channel %s: %v\n", c.Name, c.Channel, lerr)
+			return
+		} else if !bookmarkExpired(last, oldest, newest) {
+			return
+		}
+		reason = fmt.Sprintf("record %d is no longer in the channel, which holds records %d - %d", last, oldest, newest)
+	} else {
+		return //new channel
+	}
+
+	var start string
+	last = 0
+	switch c.Recovery {
+	case recoverOldest:
+		c.ReachBack = 0
+		start = "the oldest record"
+	case recoverNow:
+		if _, last, err = channelRecords(session, c.Channel); err != nil {
+			return
+		}
+		c.ReachBack = 0
+		start = "the newest record"
+	case recoverBackfill:
+		c.ReachBack = c.Backfill
+		start = fmt.Sprintf("records from the last %v", c.Backfill)
+	default:
+		start = fmt.Sprintf("records within the reachback of %v", c.ReachBack)
+	}
+	warnout("Recovering bookmark for %s because %s, starting from %s\n", c.Name, reason, start)
+	if m.igst != nil {
+		m.igst.Warn("recovering bookmark for %s because %s, starting from %s", c.Name, reason, start)
+	}
+	return
+}
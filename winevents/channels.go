@@ -0,0 +1,106 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gravwell/winevent/v3/wineventlog"
+)
+
+const (
+	channelRescanInterval = 5 * time.Minute
+	channelWildcards      = `*?`
+)
+
+func isChannelPattern(ch string) bool {
+	return strings.ContainsAny(ch, channelWildcards)
+}
+
+// channelPattern converts a wildcard channel name into a regular expression, channel names
+// are case insensitive and a * also matches the / between a provider and its channel
+func channelPattern(pattern string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString(`(?i)\A`)
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(`.*`)
+		case '?':
+			sb.WriteString(`.`)
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString(`\z`)
+	return regexp.MustCompile(sb.String())
+}
+
+// matchChannels returns the channels matched by the Channel pattern and none of the Exclude-Channel patterns
+func (p streamParams) matchChannels(channels []string) (r []string) {
+	inc := channelPattern(p.Channel)
+	var exc []*regexp.Regexp
+	for _, v := range p.ExcludeChannels {
+		exc = append(exc, channelPattern(v))
+	}
+chanLoop:
+	for _, ch := range channels {
+		if !inc.MatchString(ch) {
+			continue
+		}
+		for _, re := range exc {
+			if re.MatchString(ch) {
+				continue chanLoop
+			}
+		}
+		r = append(r, ch)
+	}
+	return
+}
+
+// forChannel returns the parameters for a channel discovered by a wildcard, the stream
+// name includes the channel so each channel keeps its own bookmark
+func (p streamParams) forChannel(ch string) streamParams {
+	p.Channel = ch
+	p.Name = p.Name + `:` + ch
+	return p
+}
+
+// discoverStreams opens streams on the channels matching the wildcard channels that are not
+// already being read.  Channels that cannot be subscribed to, such as analytic and debug
+// channels, are logged and skipped so they do not stop the ingester.
+func (m *mainService) discoverStreams() (srcs []eventSrc) {
+	if len(m.patterns) == 0 {
+		return
+	}
+	channels, err := wineventlog.Channels()
+	if err != nil {
+		warnout("Failed to list event channels: %v\n", err)
+		return
+	}
+	for _, p := range m.patterns {
+		for _, ch := range p.matchChannels(channels) {
+			c := p.forChannel(ch)
+			if m.known[c.Name] {
+				continue
+			}
+			m.known[c.Name] = true
+			es, err := m.newEventSrc(c)
+			if err != nil {
+				warnout("Skipping channel %s matched by %s: %v\n", ch, p.Name, err)
+				m.igst.Warn("skipping channel %s matched by %s: %v", ch, p.Name, err)
+				continue
+			}
+			srcs = append(srcs, es)
+		}
+	}
+	return
+}
@@ -0,0 +1,513 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gravwell/ingest/v3/config"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/winevent/v3"
+)
+
+const (
+	defaultBookmarkName = `bookmark`
+	defaultTag          = entry.DefaultTagName
+	defaultReachback    = 168 * time.Hour //1 week
+
+	mb              = 1024 * 1024
+	defaultBuffSize = 2 * mb  //2MB  Sure... why not
+	minBuffSize     = 1 * mb  //1MB is kindo of a lower bound
+	maxBuffSize     = 32 * mb //a 32MB message is stupid
+
+	defaultHandleRequest = 128
+	//this CANNOT be less than 2
+	//or you will fall into an infinite loop HAMMERING the kernel
+	minHandleRequest = 2
+	maxHandleRequest = 1024
+
+	defaultReaderThreads = 1
+	maxReaderThreads     = 64
+)
+
+var (
+	ErrXPathWithFilters = errors.New("XPath cannot be combined with Provider, Level, or EventID filters")
+	ErrInvalidXPath     = errors.New("XPath must be a query such as *[System[EventID=4624]] or a full <QueryList>")
+	ErrInvalidRender    = errors.New("Render-Message must be xml or text")
+	ErrInvalidFormat    = errors.New("Output-Format must be xml or json")
+	ErrJSONText         = errors.New("Output-Format json cannot be used with Render-Message text, use Render-Message xml to include the message")
+	ErrInvalidThreads   = fmt.Errorf("Reader-Threads must be between 1 and %d", maxReaderThreads)
+	ErrInvalidBacklog   = errors.New("Max-Backlog must be a positive duration such as 2h")
+	ErrExcludeChannel   = errors.New("Exclude-Channel requires a Channel with a * or ? wildcard")
+	ErrQueryListPattern = errors.New("A <QueryList> XPath names its own channels and cannot be used with a wildcard Channel")
+	ErrInvalidRecovery  = errors.New("Bookmark-Recovery must be oldest, now, or a positive backfill duration such as 24h")
+	ErrInvalidEPS       = errors.New("Max-EPS and EPS-Burst cannot be negative")
+	ErrEPSBurstNoMax    = errors.New("EPS-Burst requires a Max-EPS")
+	ErrDropOverNoMax    = errors.New("Drop-Over-Limit requires a Max-EPS")
+	ErrInvalidBinary    = errors.New("Max-Binary-Size cannot be negative")
+	ErrBinaryOptions    = errors.New("Drop-Binary cannot be combined with Max-Binary-Size")
+)
+
+type renderMode int
+
+const (
+	renderRaw  renderMode = iota //event XML without the message strings
+	renderXML                    //event XML with the RenderingInfo message strings
+	renderText                   //only the event message
+)
+
+type outputFormat int
+
+const (
+	formatXML  outputFormat = iota
+	formatJSON              //event XML converted to JSON
+)
+
+type recoveryMode int
+
+const (
+	recoverReachback recoveryMode = iota //start over like a new channel using Max-Reachback
+	recoverOldest                        //start from the oldest record in the channel
+	recoverNow                           //start from the newest record in the channel
+	recoverBackfill                      //start from the records within the backfill window
+)
+
+// eventChannel extends the channel configuration from the winevent package
+// with the options handled by the ingester itself
+type eventChannel struct {
+	winevent.EventStreamConfig
+	XPath             string   //full XPath query, replaces the Provider, Level, and EventID filters
+	Render_Message    string   //xml or text, renders the localized event message using the publisher metadata
+	Reader_Threads    int      //number of routines rendering each batch of events
+	Max_Backlog       string   //skip ahead when the stream falls further behind than this
+	Bookmark_Recovery string   //oldest, now, or a backfill duration used when the bookmark is corrupted or expired
+	Exclude_Channel   []string //channel patterns to skip when Channel has wildcards
+	Output_Format     string   //xml or json
+	Max_EPS           int      //events per second sent from each channel, 0 is unlimited
+	EPS_Burst         int      //events allowed over Max-EPS in a burst, defaults to Max-EPS
+	Drop_Over_Limit   bool     //drop events over Max-EPS instead of delaying them
+	Remote            string   //name of the Remote section for a channel on another host
+	Provider_Tag      []string //provider:tag overrides of the channel tag
+	EventID_Tag       []string //id:tag or low-high:tag overrides of the channel tag
+	Max_Binary_Size   int      //truncate Binary event data longer than this many bytes of hex
+	Drop_Binary       bool     //remove Binary event data entirely
+}
+
+type cfgType struct {
+	Global struct {
+		config.IngestConfig
+		Bookmark_Location string
+		Ignore_Timestamps bool
+		Duplicate_Window  int //number of recent events per channel remembered to suppress duplicates after a restart
+	}
+	EventChannel map[string]*eventChannel
+	Remote       map[string]*remoteHost
+	Preprocessor processors.ProcessorConfig
+}
+
+// streamParams are the parameters used to open an event stream
+type streamParams struct {
+	winevent.EventStreamParams
+	XPath      string
+	Render     renderMode
+	Format     outputFormat
+	Threads    int
+	MaxBacklog time.Duration
+	Recovery   recoveryMode
+	Backfill   time.Duration
+
+	ExcludeChannels []string
+
+	MaxEPS        int
+	EPSBurst      int
+	DropOverLimit bool
+
+	Remote *remoteHost //nil for channels on this host
+
+	TagRoutes tagRoutes
+
+	TrimBinary  bool
+	BinaryLimit int //longest Binary data kept when TrimBinary is set, zero drops it
+}
+
+func GetConfig(path string) (*cfgType, error) {
+	var c cfgType
+	if err := config.LoadConfigFile(&c, path); err != nil {
+		return nil, err
+	}
+	if err := c.verify(); err != nil {
+		return nil, err
+	}
+	// Verify and set UUID
+	if _, ok := c.Global.IngesterUUID(); !ok {
+		id := uuid.New()
+		if err := c.Global.SetIngesterUUID(id, path); err != nil {
+			return nil, err
+		}
+		if id2, ok := c.Global.IngesterUUID(); !ok || id != id2 {
+			return nil, errors.New("Failed to set a new ingester UUID")
+		}
+	}
+	return &c, nil
+}
+
+func (c *cfgType) verify() error {
+	//verify the global parameters
+	if err := c.Global.Verify(); err != nil {
+		return err
+	} else if err := c.Preprocessor.Validate(); err != nil {
+		return err
+	}
+
+	if c.Global.Bookmark_Location == "" {
+		b, err := winevent.ProgramDataFilename(filepath.Join(`gravwell\eventlog\`, defaultBookmarkName))
+		if err != nil {
+			return err
+		}
+		c.Global.Bookmark_Location = b
+	}
+	if c.Global.Duplicate_Window < 0 {
+		return ErrInvalidDuplicateWindow
+	}
+	for k, v := range c.Remote {
+		v.normalize()
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("Remote %s configuration error: %v", k, err)
+		}
+	}
+	for k, v := range c.EventChannel {
+		v.normalize()
+		if err := v.validate(); err != nil {
+			return fmt.Errorf("Event Stream %s configuration error: %v", k, err)
+		}
+		if v.Remote != `` {
+			if _, ok := c.Remote[v.Remote]; !ok {
+				return fmt.Errorf("Event Stream %s configuration error: Remote %s is not defined", k, v.Remote)
+			}
+		}
+		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
+			return fmt.Errorf("Event Stream %s preprocessor invalid: %v", k, err)
+		}
+	}
+	return nil
+}
+
+func (c *cfgType) Targets() ([]string, error) {
+	return c.Global.Targets()
+}
+
+func (c *cfgType) Tags() ([]string, error) {
+	var tags []string
+	var tag string
+	tagMp := make(map[string]bool, 1)
+	for _, v := range c.EventChannel {
+		tag = v.Tag_Name
+		if len(tag) == 0 {
+			tag = defaultTag
+		}
+		if _, ok := tagMp[tag]; !ok {
+			tags = append(tags, tag)
+			tagMp[tag] = true
+		}
+		routes, err := parseTagRoutes(v.Provider_Tag, v.EventID_Tag)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag = range routes.Tags() {
+			if _, ok := tagMp[tag]; !ok {
+				tags = append(tags, tag)
+				tagMp[tag] = true
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil, errors.New("No tags specified")
+	}
+	return tags, nil
+}
+
+func (c *cfgType) Timeout() time.Duration {
+	if tos, _ := c.parseTimeout(); tos > 0 {
+		return tos
+	}
+	return 0
+}
+
+func (c *cfgType) Secret() string {
+	return c.Global.Ingest_Secret
+}
+
+func (c *cfgType) BookmarkPath() string {
+	return c.Global.Bookmark_Location
+}
+
+func (c *cfgType) DuplicateWindow() int {
+	return c.Global.Duplicate_Window
+}
+
+func (c *cfgType) IgnoreTimestamps() bool {
+	return c.Global.Ignore_Timestamps
+}
+
+func (c *cfgType) EnableCache() bool {
+	return len(c.Global.Ingest_Cache_Path) != 0
+}
+
+func (c *cfgType) LocalFileCachePath() string {
+	return c.Global.Ingest_Cache_Path
+}
+
+func (c *cfgType) LogLevel() string {
+	return c.Global.Log_Level
+}
+
+func (c *cfgType) parseTimeout() (time.Duration, error) {
+	tos := strings.TrimSpace(c.Global.Connection_Timeout)
+	if len(tos) == 0 {
+		return 0, nil
+	}
+	return time.ParseDuration(tos)
+}
+
+func (c *cfgType) Streams() ([]streamParams, error) {
+	var params []streamParams
+	for k, v := range c.EventChannel {
+		esp, err := v.params(k)
+		if err != nil {
+			return nil, err
+		}
+		if v.Remote != `` {
+			esp.Remote = c.Remote[v.Remote]
+		}
+		params = append(params, esp)
+	}
+	return params, nil
+}
+
+func (ec *eventChannel) normalize() {
+	ec.Channel = strings.TrimSpace(ec.Channel)
+	ec.Max_Reachback = strings.TrimSpace(ec.Max_Reachback)
+	ec.Tag_Name = strings.TrimSpace(ec.Tag_Name)
+	ec.XPath = strings.TrimSpace(ec.XPath)
+	ec.Render_Message = strings.ToLower(strings.TrimSpace(ec.Render_Message))
+	ec.Output_Format = strings.ToLower(strings.TrimSpace(ec.Output_Format))
+	ec.Max_Backlog = strings.TrimSpace(ec.Max_Backlog)
+	ec.Bookmark_Recovery = strings.ToLower(strings.TrimSpace(ec.Bookmark_Recovery))
+	ec.Remote = strings.TrimSpace(ec.Remote)
+	if ec.Reader_Threads == 0 {
+		ec.Reader_Threads = defaultReaderThreads
+	}
+	for i := range ec.Level {
+		ec.Level[i] = strings.ToLower(strings.TrimSpace(ec.Level[i]))
+	}
+	for i := range ec.Provider {
+		ec.Provider[i] = strings.TrimSpace(ec.Provider[i])
+	}
+	for i := range ec.EventID {
+		ec.EventID[i] = strings.TrimSpace(ec.EventID[i])
+	}
+	for i := range ec.Exclude_Channel {
+		ec.Exclude_Channel[i] = strings.TrimSpace(ec.Exclude_Channel[i])
+	}
+	if ec.Request_Size == 0 {
+		ec.Request_Size = defaultHandleRequest
+	} else if ec.Request_Size > maxHandleRequest {
+		ec.Request_Size = maxHandleRequest
+	} else if ec.Request_Size < minHandleRequest {
+		ec.Request_Size = minHandleRequest
+	}
+
+	ec.Request_Buffer *= mb
+	if ec.Request_Buffer == 0 {
+		ec.Request_Buffer = defaultBuffSize
+	} else if ec.Request_Buffer > maxBuffSize {
+		ec.Request_Buffer = maxBuffSize
+	} else if ec.Request_Buffer < minBuffSize {
+		ec.Request_Buffer = minBuffSize
+	}
+}
+
+func (ec *eventChannel) validate() error {
+	if isChannelPattern(ec.Channel) {
+		if strings.HasPrefix(ec.XPath, `<`) {
+			return ErrQueryListPattern
+		} else if ec.Remote != `` {
+			return ErrRemotePattern
+		}
+	} else if len(ec.Exclude_Channel) != 0 {
+		return ErrExcludeChannel
+	}
+	if ec.XPath != `` {
+		if len(ec.Provider) != 0 || len(ec.Level) != 0 || len(ec.EventID) != 0 {
+			return ErrXPathWithFilters
+		} else if _, err := genXPathQuery(ec.Channel, ec.XPath); err != nil {
+			return err
+		}
+	}
+	if rm, err := ec.renderMode(); err != nil {
+		return err
+	} else if of, err := ec.outputFormat(); err != nil {
+		return err
+	} else if rm == renderText && of == formatJSON {
+		return ErrJSONText
+	} else if ec.Reader_Threads < 1 || ec.Reader_Threads > maxReaderThreads {
+		return ErrInvalidThreads
+	} else if _, err := ec.maxBacklog(); err != nil {
+		return err
+	} else if _, _, err := ec.recovery(); err != nil {
+		return err
+	} else if err := ec.validateRate(); err != nil {
+		return err
+	} else if _, err := parseTagRoutes(ec.Provider_Tag, ec.EventID_Tag); err != nil {
+		return err
+	} else if ec.Max_Binary_Size < 0 {
+		return ErrInvalidBinary
+	} else if ec.Drop_Binary && ec.Max_Binary_Size > 0 {
+		return ErrBinaryOptions
+	}
+	return ec.EventStreamConfig.Validate()
+}
+
+func (ec *eventChannel) outputFormat() (outputFormat, error) {
+	switch ec.Output_Format {
+	case ``, `xml`:
+		return formatXML, nil
+	case `json`:
+		return formatJSON, nil
+	}
+	return formatXML, ErrInvalidFormat
+}
+
+func (ec *eventChannel) recovery() (rm recoveryMode, d time.Duration, err error) {
+	switch ec.Bookmark_Recovery {
+	case ``:
+		rm = recoverReachback
+	case `oldest`:
+		rm = recoverOldest
+	case `now`:
+		rm = recoverNow
+	default:
+		rm = recoverBackfill
+		if d, err = time.ParseDuration(ec.Bookmark_Recovery); err != nil || d <= 0 {
+			err = ErrInvalidRecovery
+		}
+	}
+	return
+}
+
+func (ec *eventChannel) validateRate() error {
+	if ec.Max_EPS < 0 || ec.EPS_Burst < 0 {
+		return ErrInvalidEPS
+	} else if ec.Max_EPS == 0 {
+		if ec.EPS_Burst > 0 {
+			return ErrEPSBurstNoMax
+		} else if ec.Drop_Over_Limit {
+			return ErrDropOverNoMax
+		}
+	}
+	return nil
+}
+
+func (ec *eventChannel) maxBacklog() (d time.Duration, err error) {
+	if ec.Max_Backlog == `` {
+		return
+	}
+	if d, err = time.ParseDuration(ec.Max_Backlog); err != nil || d <= 0 {
+		err = ErrInvalidBacklog
+	}
+	return
+}
+
+func (ec *eventChannel) renderMode() (renderMode, error) {
+	switch ec.Render_Message {
+	case ``:
+		return renderRaw, nil
+	case `xml`:
+		return renderXML, nil
+	case `text`:
+		return renderText, nil
+	}
+	return renderRaw, ErrInvalidRender
+}
+
+// validate SHOULD have already been called, we aren't going to check anything here
+func (ec *eventChannel) params(name string) (streamParams, error) {
+	var dur time.Duration
+	if len(ec.Max_Reachback) == 0 {
+		dur = defaultReachback
+	} else {
+		var err error
+		dur, err = time.ParseDuration(ec.Max_Reachback)
+		if err != nil {
+			return streamParams{}, err
+		}
+	}
+	tag := ec.Tag_Name
+	if len(tag) == 0 {
+		tag = defaultTag
+	}
+	esp := winevent.EventStreamParams{
+		Name:         name,
+		TagName:      tag,
+		Channel:      ec.Channel,
+		EventIDs:     strings.Join(ec.EventID, ","),
+		Providers:    append([]string{}, ec.Provider...),
+		ReachBack:    dur,
+		Preprocessor: ec.Preprocessor,
+		ReqSize:      ec.Request_Size,
+		BuffSize:     ec.Request_Buffer,
+	}
+	//an XPath query does its own level filtering
+	if ec.XPath == `` {
+		esp.Levels = strings.Join(ec.Level, ",")
+	}
+	render, err := ec.renderMode()
+	if err != nil {
+		return streamParams{}, err
+	}
+	format, err := ec.outputFormat()
+	if err != nil {
+		return streamParams{}, err
+	}
+	backlog, err := ec.maxBacklog()
+	if err != nil {
+		return streamParams{}, err
+	}
+	recovery, backfill, err := ec.recovery()
+	if err != nil {
+		return streamParams{}, err
+	}
+	routes, err := parseTagRoutes(ec.Provider_Tag, ec.EventID_Tag)
+	if err != nil {
+		return streamParams{}, err
+	}
+	return streamParams{
+		EventStreamParams: esp,
+		XPath:             ec.XPath,
+		Render:            render,
+		Format:            format,
+		Threads:           ec.Reader_Threads,
+		MaxBacklog:        backlog,
+		Recovery:          recovery,
+		Backfill:          backfill,
+		ExcludeChannels:   ec.Exclude_Channel,
+		MaxEPS:            ec.Max_EPS,
+		EPSBurst:          ec.EPS_Burst,
+		DropOverLimit:     ec.Drop_Over_Limit,
+		TagRoutes:         routes,
+		TrimBinary:        ec.Drop_Binary || ec.Max_Binary_Size > 0,
+		BinaryLimit:       ec.Max_Binary_Size,
+	}, nil
+}
@@ -0,0 +1,190 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+const (
+	seenExt = `.seen`
+)
+
+var (
+	ErrInvalidDuplicateWindow = errors.New("Duplicate-Window cannot be negative")
+)
+
+// seenStore remembers the most recently ingested events of each channel so that events
+// re-read after a restart with a stale bookmark are not ingested again.  Events are keyed
+// on the record ID and creation time, record IDs start over when a channel is cleared so
+// the ID alone could suppress new events.  The keys are saved next to the bookmark file
+// whenever the bookmark is synced.
+type seenStore struct {
+	mtx    sync.Mutex
+	path   string
+	window int
+	chans  map[string]*seenRing
+	open   bool
+}
+
+// seenRing holds the keys of the last window events of a channel in the order they were ingested
+type seenRing struct {
+	sync.Mutex
+	keys   []uint64
+	next   int
+	set    map[uint64]struct{}
+	window int
+}
+
+// newSeenStore loads the keys saved at path, a nil store is returned when window is zero.
+// A saved file that cannot be decoded is ignored, the bookmark still protects against
+// most duplicates.
+func newSeenStore(path string, window int) (*seenStore, error) {
+	if window <= 0 {
+		return nil, nil
+	}
+	ss := &seenStore{
+		path:   path,
+		window: window,
+		chans:  map[string]*seenRing{},
+		open:   true,
+	}
+	var saved map[string][]uint64
+	fin, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ss, ss.Sync()
+		}
+		return nil, err
+	}
+	if err = gob.NewDecoder(fin).Decode(&saved); err != nil {
+		saved = nil
+	}
+	fin.Close()
+	for name, keys := range saved {
+		sr := ss.channel(name)
+		for _, k := range keys {
+			sr.add(k)
+		}
+	}
+	return ss, nil
+}
+
+// channel returns the ring for a channel, creating it if needed, it is safe to call on a nil store
+func (ss *seenStore) channel(name string) *seenRing {
+	if ss == nil {
+		return nil
+	}
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	sr, ok := ss.chans[name]
+	if !ok {
+		sr = &seenRing{
+			set:    make(map[uint64]struct{}, ss.window),
+			window: ss.window,
+		}
+		ss.chans[name] = sr
+	}
+	return sr
+}
+
+func (ss *seenStore) Sync() error {
+	if ss == nil {
+		return nil
+	}
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if !ss.open {
+		return ErrBookmarkClosed
+	}
+	return ss.store()
+}
+
+func (ss *seenStore) Close() error {
+	if ss == nil {
+		return nil
+	}
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	if !ss.open {
+		return nil
+	}
+	ss.open = false
+	return ss.store()
+}
+
+// store writes the keys of every channel, the caller holds the lock
+func (ss *seenStore) store() error {
+	saved := make(map[string][]uint64, len(ss.chans))
+	for name, sr := range ss.chans {
+		saved[name] = sr.ordered()
+	}
+	return writeGobFile(ss.path, saved)
+}
+
+// eventKey hashes the record ID and creation time of the rendered event XML
+func eventKey(id uint64, buff []byte) uint64 {
+	var b [8]byte
+	h := fnv.New64a()
+	binary.LittleEndian.PutUint64(b[:], id)
+	h.Write(b[:])
+	if idx := bytes.Index(buff, []byte(`</System>`)); idx > 0 {
+		buff = buff[:idx]
+	}
+	if m := timeCreatedRegex.FindSubmatch(buff); len(m) == 2 {
+		h.Write(m[1])
+	}
+	return h.Sum64()
+}
+
+// seen reports whether the event was already ingested and remembers it if not, it is safe to call on a nil ring
+func (sr *seenRing) seen(id uint64, buff []byte) bool {
+	if sr == nil {
+		return false
+	}
+	k := eventKey(id, buff)
+	sr.Lock()
+	defer sr.Unlock()
+	if _, ok := sr.set[k]; ok {
+		return true
+	}
+	sr.add(k)
+	return false
+}
+
+// add remembers a key, pushing out the oldest key once the ring is full.  The caller holds the lock
+// or owns the ring.
+func (sr *seenRing) add(k uint64) {
+	if _, ok := sr.set[k]; ok {
+		return
+	}
+	if len(sr.keys) < sr.window {
+		sr.keys = append(sr.keys, k)
+	} else {
+		delete(sr.set, sr.keys[sr.next])
+		sr.keys[sr.next] = k
+		sr.next = (sr.next + 1) % sr.window
+	}
+	sr.set[k] = struct{}{}
+}
+
+// ordered returns the keys from oldest to newest
+func (sr *seenRing) ordered() []uint64 {
+	sr.Lock()
+	defer sr.Unlock()
+	r := make([]uint64, 0, len(sr.keys))
+	r = append(r, sr.keys[sr.next:]...)
+	return append(r, sr.keys[:sr.next]...)
+}
@@ -0,0 +1,150 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingesters/v3/version"
+	"github.com/gravwell/winevent/v3/wineventlog"
+)
+
+const (
+	evtxBatchSize = 128
+)
+
+// importEVTX ingests every saved event log file matching the pattern using the backends from
+// the configuration file, each event is stamped with the time it was originally created
+func importEVTX(cfg *cfgType, pattern, tagName string) error {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return err
+	} else if len(files) == 0 {
+		return fmt.Errorf("No files match %s", pattern)
+	}
+	conns, err := cfg.Targets()
+	if err != nil {
+		return fmt.Errorf("Failed to get backend targets from configuration: %v", err)
+	}
+	id, _ := cfg.Global.IngesterUUID()
+	igst, err := ingest.NewUniformMuxer(ingest.UniformMuxerConfig{
+		Destinations:    conns,
+		Tags:            []string{tagName},
+		Auth:            cfg.Secret(),
+		LogLevel:        cfg.LogLevel(),
+		IngesterName:    "winevent",
+		IngesterVersion: version.GetVersion(),
+		IngesterUUID:    id.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed build our ingest system: %v", err)
+	}
+	defer igst.Close()
+	if err = igst.Start(); err != nil {
+		return fmt.Errorf("Failed start our ingest system: %v", err)
+	} else if err = igst.WaitForHotContext(context.Background(), cfg.Timeout()); err != nil {
+		return fmt.Errorf("Failed to wait for hot ingester connections: %v", err)
+	}
+	tag, err := igst.GetTag(tagName)
+	if err != nil {
+		return fmt.Errorf("Failed to translate tag %s: %v", tagName, err)
+	}
+	src, err := igst.SourceIP()
+	if err != nil {
+		return fmt.Errorf("Failed to get Source IP from ingest muxer: %v", err)
+	}
+
+	var total uint64
+	start := time.Now()
+	for _, f := range files {
+		cnt, err := importEVTXFile(igst, f, tag, src)
+		total += cnt
+		if err != nil {
+			return fmt.Errorf("Failed to import %s after %d events: %v", f, cnt, err)
+		}
+		infoout("Imported %d events from %s\n", cnt, f)
+	}
+	if err = igst.Sync(cfg.Timeout()); err != nil {
+		return fmt.Errorf("Failed to sync the ingest muxer: %v", err)
+	}
+	infoout("Imported %d events from %d files in %v\n", total, len(files), time.Since(start))
+	return nil
+}
+
+func importEVTXFile(igst *ingest.IngestMuxer, path string, tag entry.EntryTag, src net.IP) (cnt uint64, err error) {
+	var q wineventlog.EvtHandle
+	if q, err = wineventlog.EvtQuery(0, path, ``, wineventlog.EvtQueryFilePath|wineventlog.EvtQueryForwardDirection); err != nil {
+		return
+	}
+	defer wineventlog.Close(q)
+	buff := make([]byte, defaultBuffSize)
+	bb := bytes.NewBuffer(nil)
+	for {
+		var hnds []wineventlog.EvtHandle
+		if hnds, err = evtxHandles(q); err != nil {
+			if err == wineventlog.ERROR_NO_MORE_ITEMS {
+				err = nil
+			}
+			return
+		} else if len(hnds) == 0 {
+			return
+		}
+		for i, h := range hnds {
+			bb.Reset()
+			if err = wineventlog.RenderEventSimple(h, buff, bb); err != nil {
+				for _, h := range hnds[i:] {
+					wineventlog.Close(h)
+				}
+				return
+			}
+			wineventlog.Close(h)
+			ent := &entry.Entry{
+				SRC:  src,
+				TS:   evtxTimestamp(bb.Bytes()),
+				Tag:  tag,
+				Data: append([]byte(nil), bb.Bytes()...),
+			}
+			if err = igst.WriteEntry(ent); err != nil {
+				for _, h := range hnds[i+1:] {
+					wineventlog.Close(h)
+				}
+				return
+			}
+			cnt++
+		}
+	}
+}
+
+// evtxHandles pulls the next batch of events, backing off the batch size when the events are too
+// large to hand back at once
+func evtxHandles(q wineventlog.EvtHandle) (hnds []wineventlog.EvtHandle, err error) {
+	for cnt := evtxBatchSize; cnt >= 1; cnt = cnt / 2 {
+		if hnds, err = wineventlog.EventHandles(q, cnt); err != wineventlog.RPC_S_INVALID_BOUND {
+			return
+		}
+	}
+	return
+}
+
+// evtxTimestamp returns the original creation time of the event, falling back to now
+func evtxTimestamp(buff []byte) entry.Timestamp {
+	if m := timeCreatedRegex.FindSubmatch(buff); len(m) == 2 {
+		if ts, err := time.Parse(time.RFC3339Nano, string(m[1])); err == nil {
+			return entry.FromStandard(ts)
+		}
+	}
+	return entry.Now()
+}
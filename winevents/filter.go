@@ -0,0 +1,70 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+var (
+	providerRegex    = regexp.MustCompile(`<Provider\s+Name=['"]([^'"]+)['"]`)
+	timeCreatedRegex = regexp.MustCompile(`<TimeCreated\s+SystemTime=['"]([^'"]+)['"]`)
+)
+
+// splitProviders separates the Provider values into providers to include and providers to
+// exclude, exclusions are written like EventID exclusions with a leading dash: -Service Control Manager
+func splitProviders(provs []string) (inc, exc []string) {
+	for _, p := range provs {
+		if strings.HasPrefix(p, `-`) {
+			if p = strings.TrimSpace(strings.TrimPrefix(p, `-`)); p != `` {
+				exc = append(exc, p)
+			}
+		} else {
+			inc = append(inc, p)
+		}
+	}
+	return
+}
+
+// providerFilter drops events from excluded providers.  The subscription query can only
+// select providers, so excluded providers are filtered out of the rendered events.
+type providerFilter struct {
+	exclude []string
+}
+
+func newProviderFilter(exc []string) *providerFilter {
+	if len(exc) == 0 {
+		return nil
+	}
+	return &providerFilter{exclude: exc}
+}
+
+// drop reports whether the rendered event came from an excluded provider, it is safe to call on a nil filter
+func (pf *providerFilter) drop(buff []byte) bool {
+	if pf == nil {
+		return false
+	}
+	//the provider is in the System element at the top of the event
+	if idx := bytes.Index(buff, []byte(`</System>`)); idx > 0 {
+		buff = buff[:idx]
+	}
+	m := providerRegex.FindSubmatch(buff)
+	if len(m) != 2 {
+		return false
+	}
+	//provider names are case insensitive
+	for _, p := range pf.exclude {
+		if strings.EqualFold(p, string(m[1])) {
+			return true
+		}
+	}
+	return false
+}
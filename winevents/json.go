@@ -0,0 +1,125 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+const (
+	jsonTextKey = `Value` //text of an element that also has attributes or children
+)
+
+var (
+	ErrEmptyEventXML = errors.New("Event XML has no root element")
+)
+
+type xmlNode struct {
+	name     string
+	attrs    []xml.Attr
+	children []*xmlNode
+	text     strings.Builder
+}
+
+// eventJSON converts rendered event XML into JSON.  Attributes and child elements become object
+// members, elements holding only text become strings, and repeated elements become arrays.
+// The named Data elements under EventData become members named by their Name attribute so
+// fields can be pulled out directly, such as EventData.TargetUserName.
+func eventJSON(buff []byte) ([]byte, error) {
+	root, err := parseXMLNode(buff)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{root.name: root.value()})
+}
+
+func parseXMLNode(buff []byte) (root *xmlNode, err error) {
+	var stack []*xmlNode
+	dec := xml.NewDecoder(bytes.NewReader(buff))
+	for {
+		var tok xml.Token
+		if tok, err = dec.Token(); err != nil {
+			if err == io.EOF {
+				err = nil
+				if root == nil {
+					err = ErrEmptyEventXML
+				}
+			}
+			return
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{name: t.Name.Local}
+			for _, a := range t.Attr {
+				if a.Name.Space != `xmlns` && a.Name.Local != `xmlns` {
+					n.attrs = append(n.attrs, a)
+				}
+			}
+			if len(stack) > 0 {
+				p := stack[len(stack)-1]
+				p.children = append(p.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		}
+	}
+}
+
+func (n *xmlNode) attr(name string) (string, bool) {
+	for _, a := range n.attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return ``, false
+}
+
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+	if len(n.attrs) == 0 && len(n.children) == 0 {
+		return text
+	}
+	obj := make(map[string]interface{}, len(n.attrs)+len(n.children))
+	for _, a := range n.attrs {
+		obj[a.Name.Local] = a.Value
+	}
+	for _, c := range n.children {
+		name, v := c.name, c.value()
+		//named Data elements are keyed by their name
+		if dn, ok := c.attr(`Name`); ok && c.name == `Data` && len(c.children) == 0 {
+			name, v = dn, strings.TrimSpace(c.text.String())
+		}
+		switch ev := obj[name].(type) {
+		case nil:
+			obj[name] = v
+		case []interface{}:
+			obj[name] = append(ev, v)
+		default:
+			obj[name] = []interface{}{ev, v}
+		}
+	}
+	if text != `` {
+		obj[jsonTextKey] = text
+	}
+	return obj
+}
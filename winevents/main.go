@@ -35,6 +35,8 @@ var (
 	configOverride = flag.String("config-file-override", "", "Override location for configuration file")
 	verboseF       = flag.Bool("v", false, "Verbose mode, do not run as a service and output status to stdout")
 	ver            = flag.Bool("version", false, "Print the version information and exit")
+	importFiles    = flag.String("import-evtx", "", "Import saved .evtx files matching the pattern and exit, does not run as a service")
+	importTag      = flag.String("import-tag", "windows", "Tag to apply to events imported with -import-evtx")
 
 	confLoc string
 	verbose bool
@@ -82,11 +84,17 @@ func main() {
 		infW = serviceInfoWriter
 		infoout("%s started\n", serviceName)
 	}
-	cfg, err := winevent.GetConfig(confLoc)
+	cfg, err := GetConfig(confLoc)
 	if err != nil {
 		errorout("Failed to get configuration: %v\n", err)
 		return
 	}
+	if *importFiles != `` {
+		if err := importEVTX(cfg, *importFiles, *importTag); err != nil {
+			errorout("Failed to import event log files: %v\n", err)
+		}
+		return
+	}
 
 	s, err := NewService(cfg)
 	if err != nil {
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sys/windows/svc"
@@ -23,7 +24,6 @@ import (
 	"github.com/gravwell/ingest/v3/processors"
 	"github.com/gravwell/ingesters/v3/version"
 	"github.com/gravwell/timegrinder/v3"
-	"github.com/gravwell/winevent/v3"
 )
 
 const (
@@ -35,9 +35,14 @@ var (
 )
 
 type eventSrc struct {
-	h    *winevent.EventStreamHandle
-	proc *processors.ProcessorSet
-	tag  entry.EntryTag
+	h      *eventStream
+	proc   *processors.ProcessorSet
+	tag    entry.EntryTag
+	filter *providerFilter
+	limit  *eventLimiter
+	remote *remoteHost
+	router *tagRouter
+	seen   *seenRing
 }
 
 type mainService struct {
@@ -47,7 +52,11 @@ type mainService struct {
 	tags         []string
 	conns        []string
 	bookmarkPath string
-	streams      []winevent.EventStreamParams
+	dupWindow    int
+	streams      []streamParams
+	patterns     []streamParams //wildcard channels that are expanded by discoverStreams
+	known        map[string]bool
+	pending      []streamParams //remote streams that could not be opened yet
 	enableCache  bool
 	cachePath    string
 	igstLogLevel string
@@ -55,14 +64,15 @@ type mainService struct {
 	src          net.IP
 	ctx          context.Context
 
-	bmk     *winevent.BookmarkHandler
+	bmk     *bookmarkStore
+	seen    *seenStore
 	evtSrcs []eventSrc
 	igst    *ingest.IngestMuxer
 	tg      *timegrinder.TimeGrinder
 	pp      processors.ProcessorConfig
 }
 
-func NewService(cfg *winevent.CfgType) (*mainService, error) {
+func NewService(cfg *cfgType) (*mainService, error) {
 	//populate items from our config
 	tags, err := cfg.Tags()
 	if err != nil {
@@ -83,6 +93,14 @@ func NewService(cfg *winevent.CfgType) (*mainService, error) {
 		return nil, errors.New("Couldn't read ingester UUID")
 	}
 	debugout("Parsed %d streams\n", len(chanConf))
+	var streams, patterns []streamParams
+	for _, c := range chanConf {
+		if isChannelPattern(c.Channel) {
+			patterns = append(patterns, c)
+		} else {
+			streams = append(streams, c)
+		}
+	}
 	return &mainService{
 		timeout:      cfg.Timeout(),
 		secret:       cfg.Secret(),
@@ -90,7 +108,10 @@ func NewService(cfg *winevent.CfgType) (*mainService, error) {
 		conns:        conns,
 		ignoreTS:     cfg.IgnoreTimestamps(),
 		bookmarkPath: cfg.BookmarkPath(),
-		streams:      chanConf,
+		dupWindow:    cfg.DuplicateWindow(),
+		streams:      streams,
+		patterns:     patterns,
+		known:        map[string]bool{},
 		enableCache:  cfg.EnableCache(),
 		cachePath:    cfg.LocalFileCachePath(),
 		igstLogLevel: cfg.LogLevel(),
@@ -109,6 +130,7 @@ func (m *mainService) shutdown() error {
 	var rerr error
 	//close any service handles that happen to be open
 	for _, e := range m.evtSrcs {
+		e.limit.Close()
 		last := e.h.Last()
 		name := e.h.Name()
 		if err := e.h.Close(); err != nil {
@@ -133,6 +155,10 @@ func (m *mainService) shutdown() error {
 			errorout("%s", rerr)
 		}
 	}
+	if err := m.seen.Close(); err != nil {
+		rerr = fmt.Errorf("Failed to close the duplicate event window: %v", err)
+		errorout("%s", rerr)
+	}
 	if m.igst != nil {
 		if err := m.igst.Sync(time.Second); err != nil {
 			rerr = fmt.Errorf("Failed to sync the ingest muxer: %v", err)
@@ -210,36 +236,148 @@ func (m *mainService) consumerRoutine(errC chan error, closeC chan bool, wg *syn
 		errC <- err
 		return
 	}
-	tkr := time.Tick(eventSampleInterval)
+	//each stream is read by its own routine so a busy channel does not hold up the others
+	ctx, cancel := context.WithCancel(m.ctx)
+	defer cancel()
+	var dirty int32
+	var swg sync.WaitGroup
+	streamErr := make(chan error, 1)
+	for _, eh := range m.evtSrcs {
+		swg.Add(1)
+		go m.streamRoutine(ctx, eh, &dirty, streamErr, &swg)
+	}
+	tkr := time.NewTicker(eventSampleInterval)
+	defer tkr.Stop()
+	//wildcard channels are rescanned to pick up channels from newly installed software
+	var rescan <-chan time.Time
+	if len(m.patterns) > 0 {
+		rtkr := time.NewTicker(channelRescanInterval)
+		defer rtkr.Stop()
+		rescan = rtkr.C
+	}
+	var retry <-chan time.Time
+	if len(m.pending) > 0 {
+		rtkr := time.NewTicker(remoteRetryInterval)
+		defer rtkr.Stop()
+		retry = rtkr.C
+	}
 
 consumerLoop:
 	for {
 		select {
-		case <-tkr:
-			if nev, err := m.consumeEvents(); err != nil {
-				errorout("Failed to consume events: %v", err)
-				errC <- err
-				return
-			} else if nev {
+		case <-tkr.C:
+			if atomic.SwapInt32(&dirty, 0) != 0 {
 				if err := m.bmk.Sync(); err != nil {
 					errorout("Failed to sync bookmark: %v", err)
+					cancel()
+					swg.Wait()
 					errC <- err
 					return
+				} else if err := m.seen.Sync(); err != nil {
+					warnout("Failed to sync the duplicate event window: %v\n", err)
 				}
-				break
 			}
+		case <-rescan:
+			for _, eh := range m.discoverStreams() {
+				m.evtSrcs = append(m.evtSrcs, eh)
+				swg.Add(1)
+				go m.streamRoutine(ctx, eh, &dirty, streamErr, &swg)
+			}
+		case <-retry:
+			for _, eh := range m.openPending() {
+				m.evtSrcs = append(m.evtSrcs, eh)
+				swg.Add(1)
+				go m.streamRoutine(ctx, eh, &dirty, streamErr, &swg)
+			}
+			if len(m.pending) == 0 {
+				retry = nil
+			}
+		case err := <-streamErr:
+			cancel()
+			swg.Wait()
+			errC <- err
+			return
 		case <-closeC:
 			infoout("Consumer exiting\n")
 			break consumerLoop
 		}
 	}
+	cancel()
+	swg.Wait()
 	if err := m.bmk.Sync(); err != nil {
 		errorout("Failed to sync bookmark: %v", err)
 		errC <- err
+	} else if err := m.seen.Sync(); err != nil {
+		warnout("Failed to sync the duplicate event window: %v\n", err)
 	}
 	infoout("Consumer exiting\n")
 }
 
+// streamRoutine services a single event stream until the context is cancelled.  Streams on
+// remote hosts ride out network and host outages by waiting and resetting the stream, local
+// stream failures stop the service.
+func (m *mainService) streamRoutine(ctx context.Context, eh eventSrc, dirty *int32, errC chan error, wg *sync.WaitGroup) {
+	defer wg.Done()
+	tkr := time.NewTicker(eventSampleInterval)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-tkr.C:
+			if err := m.serviceEventStream(ctx, eh, m.src, dirty); err != nil {
+				if eh.remote != nil {
+					m.retryRemote(ctx, eh, err)
+					continue
+				}
+				errorout("Failed to consume events: %v", err)
+				select {
+				case errC <- err:
+				case <-ctx.Done():
+				}
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryRemote waits out a remote stream failure and resets the stream until it recovers or the context is cancelled
+func (m *mainService) retryRemote(ctx context.Context, eh eventSrc, err error) {
+	warnout("Stream %s on %s failed, retrying every %v: %v\n", eh.h.Name(), eh.remote.Host, remoteRetryInterval, err)
+	m.igst.Warn("stream %s on %s failed, retrying every %v: %v", eh.h.Name(), eh.remote.Host, remoteRetryInterval, err)
+	tkr := time.NewTicker(remoteRetryInterval)
+	defer tkr.Stop()
+	for {
+		select {
+		case <-tkr.C:
+			if err = eh.h.Reset(); err == nil {
+				infoout("Stream %s on %s recovered\n", eh.h.Name(), eh.remote.Host)
+				m.igst.Info("stream %s on %s recovered", eh.h.Name(), eh.remote.Host)
+				return
+			}
+			debugout("Stream %s on %s is still failing: %v\n", eh.h.Name(), eh.remote.Host, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// openPending retries the remote streams that could not be opened at startup
+func (m *mainService) openPending() (srcs []eventSrc) {
+	var still []streamParams
+	for _, c := range m.pending {
+		es, err := m.newEventSrc(c)
+		if err != nil {
+			debugout("Stream %s on %s still cannot be opened: %v\n", c.Name, c.Remote.Host, err)
+			still = append(still, c)
+			continue
+		}
+		srcs = append(srcs, es)
+	}
+	m.pending = still
+	return
+}
+
 func (m *mainService) init() error {
 	if !m.ignoreTS {
 		tg, err := timegrinder.NewTimeGrinder(timegrinder.Config{})
@@ -248,12 +386,15 @@ func (m *mainService) init() error {
 		}
 		m.tg = tg
 	}
-	bmk, err := winevent.NewBookmark(m.bookmarkPath)
+	bmk, err := newBookmarkStore(m.bookmarkPath)
 	if err != nil {
 		return fmt.Errorf("Failed to create a bookmark at %s: %v", m.bookmarkPath, err)
 	}
 	m.bmk = bmk
 	debugout("Opened bookmark\n")
+	if m.seen, err = newSeenStore(m.bookmarkPath+seenExt, m.dupWindow); err != nil {
+		return fmt.Errorf("Failed to open the duplicate event window at %s: %v", m.bookmarkPath+seenExt, err)
+	}
 
 	//fire up the ingesters
 	igCfg := ingest.UniformMuxerConfig{
@@ -294,41 +435,22 @@ func (m *mainService) init() error {
 
 	var evtSrcs []eventSrc
 	for _, c := range m.streams {
-		tag, err := igst.GetTag(c.TagName)
-		if err != nil {
-			return fmt.Errorf("Failed to translate tag %s: %v", c.TagName, err)
-		}
-		last, err := bmk.Get(c.Name)
+		es, err := m.newEventSrc(c)
 		if err != nil {
-			return fmt.Errorf("Failed to get bookmark for %s: %v", c.Name, err)
-		}
-		pproc, err := m.pp.ProcessorSet(igst, c.Preprocessor)
-		if err != nil {
-			return fmt.Errorf("Preprocessor construction error: %v", err)
-		}
-		evt, err := winevent.NewStream(c, last)
-		if err != nil {
-			return fmt.Errorf("Failed to create new eventStream(%s) on Channel %s: %v", c.Name, c.Channel, err)
-		}
-		infoout("Started stream %s at recordID %d\n", c.Name, last)
-		msg := fmt.Sprintf("starting stream %s on channel %s at recordID %d, ingesting to tag %s.", c.Name, c.Channel, last, c.TagName)
-		if c.ReachBack != 0 {
-			msg += fmt.Sprintf(" Reachback is %v.", c.ReachBack)
-		}
-		if len(c.Providers) != 0 {
-			msg += fmt.Sprintf(" Providers: %v.", c.Providers)
-		}
-		if c.Levels != `` {
-			msg += fmt.Sprintf(" Allowed levels: %v.", c.Levels)
-		}
-		if c.EventIDs != `` {
-			msg += fmt.Sprintf(" Recording only the following EventIDs: %v.", c.EventIDs)
+			if c.Remote == nil {
+				return err
+			}
+			//an unreachable remote host should not keep us from collecting the others
+			warnout("Failed to open stream %s on %s, retrying every %v: %v\n", c.Name, c.Remote.Host, remoteRetryInterval, err)
+			m.igst.Warn("failed to open stream %s on %s, retrying every %v: %v", c.Name, c.Remote.Host, remoteRetryInterval, err)
+			m.pending = append(m.pending, c)
+			continue
 		}
-		igst.Info(msg)
-		evtSrcs = append(evtSrcs, eventSrc{h: evt, proc: pproc, tag: tag})
+		evtSrcs = append(evtSrcs, es)
 	}
-	if len(evtSrcs) == 0 {
-		return fmt.Errorf("Failed to load event handles: %v", err)
+	evtSrcs = append(evtSrcs, m.discoverStreams()...)
+	if len(evtSrcs) == 0 && len(m.patterns) == 0 && len(m.pending) == 0 {
+		return errors.New("Failed to load event handles, no event channels are configured")
 	}
 	m.evtSrcs = evtSrcs
 	if m.src, err = m.igst.SourceIP(); err != nil {
@@ -339,26 +461,107 @@ func (m *mainService) init() error {
 	return nil
 }
 
-func (m *mainService) consumeEvents() (bool, error) {
-	//we have an IP and some hot connections, do stuff
-	//service events
-	var consumed bool
-	for _, eh := range m.evtSrcs {
-		if nev, err := m.serviceEventStream(eh, m.src); err != nil {
-			return consumed, err
-		} else if nev {
-			consumed = true
+// newEventSrc opens the stream for a single event channel
+func (m *mainService) newEventSrc(c streamParams) (es eventSrc, err error) {
+	tag, err := m.igst.GetTag(c.TagName)
+	if err != nil {
+		return es, fmt.Errorf("Failed to translate tag %s: %v", c.TagName, err)
+	}
+	router, err := c.TagRoutes.router(m.igst.GetTag)
+	if err != nil {
+		return es, err
+	}
+	session, err := c.Remote.openSession()
+	if err != nil {
+		return es, fmt.Errorf("Failed to open a session on %s: %v", c.Remote.Host, err)
+	}
+	last, err := m.bookmarkStart(&c, session)
+	if err != nil {
+		closeSession(session)
+		return es, fmt.Errorf("Failed to get bookmark for %s: %v", c.Name, err)
+	}
+	pproc, err := m.pp.ProcessorSet(m.igst, c.Preprocessor)
+	if err != nil {
+		closeSession(session)
+		return es, fmt.Errorf("Preprocessor construction error: %v", err)
+	}
+	var excProviders []string
+	c.Providers, excProviders = splitProviders(c.Providers)
+	evt, err := newEventStream(c, last, session)
+	if err != nil {
+		closeSession(session)
+		pproc.Close()
+		return es, fmt.Errorf("Failed to create new eventStream(%s) on Channel %s: %v", c.Name, c.Channel, err)
+	}
+	infoout("Started stream %s at recordID %d\n", c.Name, last)
+	msg := fmt.Sprintf("starting stream %s on channel %s at recordID %d, ingesting to tag %s.", c.Name, c.Channel, last, c.TagName)
+	if c.Remote != nil {
+		msg += fmt.Sprintf(" Remote host: %s.", c.Remote.Host)
+	}
+	if c.TrimBinary {
+		if c.BinaryLimit == 0 {
+			msg += " Dropping Binary event data."
+		} else {
+			msg += fmt.Sprintf(" Truncating Binary event data to %d bytes.", c.BinaryLimit)
 		}
 	}
-	return consumed, nil
+	if !c.TagRoutes.empty() {
+		msg += fmt.Sprintf(" Tag overrides: %s.", c.TagRoutes)
+	}
+	if c.ReachBack != 0 {
+		msg += fmt.Sprintf(" Reachback is %v.", c.ReachBack)
+	}
+	if len(c.Providers) != 0 {
+		msg += fmt.Sprintf(" Providers: %v.", c.Providers)
+	}
+	if len(excProviders) != 0 {
+		msg += fmt.Sprintf(" Excluded providers: %v.", excProviders)
+	}
+	if c.Levels != `` {
+		msg += fmt.Sprintf(" Allowed levels: %v.", c.Levels)
+	}
+	if c.EventIDs != `` {
+		msg += fmt.Sprintf(" Recording only the following EventIDs: %v.", c.EventIDs)
+	}
+	if c.XPath != `` {
+		msg += fmt.Sprintf(" XPath query: %v.", c.XPath)
+	}
+	switch c.Render {
+	case renderXML:
+		msg += " Rendering event messages into the XML."
+	case renderText:
+		msg += " Rendering event messages as text."
+	}
+	if c.Format == formatJSON {
+		msg += " Sending events as JSON."
+	}
+	if c.Threads > 1 {
+		msg += fmt.Sprintf(" Reader threads: %d.", c.Threads)
+	}
+	if c.MaxBacklog > 0 {
+		msg += fmt.Sprintf(" Max backlog: %v.", c.MaxBacklog)
+	}
+	limit := newEventLimiter(c)
+	if limit != nil {
+		if c.DropOverLimit {
+			msg += fmt.Sprintf(" Dropping events over %d EPS with a burst of %d.", c.MaxEPS, int(limit.burst))
+		} else {
+			msg += fmt.Sprintf(" Delaying events over %d EPS with a burst of %d.", c.MaxEPS, int(limit.burst))
+		}
+	}
+	m.igst.Info(msg)
+	limit.start(m.igst)
+	es = eventSrc{h: evt, proc: pproc, tag: tag, filter: newProviderFilter(excProviders), limit: limit, remote: c.Remote, router: router, seen: m.seen.channel(c.Name)}
+	return
 }
 
-func (m *mainService) serviceEventStream(eh eventSrc, ip net.IP) (nev bool, err error) {
+// serviceEventStream reads until the stream is drained, flagging the bookmark as dirty as events are consumed
+func (m *mainService) serviceEventStream(ctx context.Context, eh eventSrc, ip net.IP, dirty *int32) (err error) {
 	var hit bool
 	full := true
 	//feed from the stream until we don't get any entries out
 	for full {
-		if hit, full, err = m.serviceEventStreamChunk(eh, ip); err != nil {
+		if hit, full, err = m.serviceEventStreamChunk(ctx, eh, ip); err != nil {
 			errorout("Failed to service event stream %s: %v\n", eh.h.Name(), err)
 			if err = eh.h.Reset(); err != nil {
 				errorout("Failed to reset event stream %s: %v\n", eh.h.Name(), err)
@@ -368,10 +571,10 @@ func (m *mainService) serviceEventStream(eh eventSrc, ip net.IP) (nev bool, err
 			}
 			return
 		} else if hit {
-			nev = true
+			atomic.StoreInt32(dirty, 1)
 		}
 		select {
-		case <-m.ctx.Done():
+		case <-ctx.Done():
 			full = false
 		default:
 			//do nothing
@@ -381,41 +584,29 @@ func (m *mainService) serviceEventStream(eh eventSrc, ip net.IP) (nev bool, err
 	return
 }
 
-func (m *mainService) serviceEventStreamChunk(eh eventSrc, ip net.IP) (hit, fullRead bool, err error) {
-	var ents []winevent.RenderedEvent
+func (m *mainService) serviceEventStreamChunk(ctx context.Context, eh eventSrc, ip net.IP) (hit, fullRead bool, err error) {
+	var ents []renderedEvent
 	var warn error
 	if ents, fullRead, warn, err = eh.h.Read(); err != nil {
 		return
 	} else if warn != nil {
 		warnout("Event stream %s warning %q\n", eh.h.Name(), warn)
+		if _, ok := warn.(stallWarning); ok {
+			m.igst.Warn("event stream %s watchdog: %v", eh.h.Name(), warn)
+		}
 	}
 	var first, last uint64
+	var dups int
 
 	for i, e := range ents {
-		var ts entry.Timestamp
-		var ok bool
-		var lts time.Time
-		if !m.ignoreTS {
-			lts, ok, err = m.tg.Extract(e.Buff)
-			if err != nil {
-				errorout("Failed to extract TS: %v\n", err)
+		if eh.seen.seen(e.ID, e.Buff) {
+			dups++
+		} else if !eh.filter.drop(e.Buff) && eh.limit.wait(ctx) {
+			if err = m.sendEvent(eh, e, ip); err != nil {
 				return
 			}
-			ts = entry.FromStandard(lts)
-		}
-		if !ok {
-			ts = entry.Now()
-		}
-		ent := &entry.Entry{
-			SRC:  ip,
-			TS:   ts,
-			Tag:  eh.tag,
-			Data: e.Buff,
-		}
-		if err = eh.proc.Process(ent); err != nil {
-			warnout("Failed to Process event: %v\n", err)
-			return
 		}
+		//the bookmark advances past filtered and dropped events too
 		if err = m.bmk.Update(eh.h.Name(), e.ID); err != nil {
 			errorout("Failed to update bookmark for %s: %v\n", eh.h.Name(), err)
 			return
@@ -425,9 +616,40 @@ func (m *mainService) serviceEventStreamChunk(eh eventSrc, ip net.IP) (hit, full
 		}
 		last = e.ID
 	}
+	if dups > 0 {
+		infoout("Skipped %d events from %s that were already ingested\n", dups, eh.h.Name())
+		m.igst.Info("skipped %d events from %s that were already ingested", dups, eh.h.Name())
+	}
 	if len(ents) > 0 {
 		hit = true
 		debugout("Pulled %d events from %s [%d - %d]\n", len(ents), eh.h.Name(), first, last)
 	}
 	return
 }
+
+func (m *mainService) sendEvent(eh eventSrc, e renderedEvent, ip net.IP) (err error) {
+	var ts entry.Timestamp
+	var ok bool
+	var lts time.Time
+	if !m.ignoreTS {
+		lts, ok, err = m.tg.Extract(e.Buff)
+		if err != nil {
+			errorout("Failed to extract TS: %v\n", err)
+			return
+		}
+		ts = entry.FromStandard(lts)
+	}
+	if !ok {
+		ts = entry.Now()
+	}
+	ent := &entry.Entry{
+		SRC:  ip,
+		TS:   ts,
+		Tag:  eh.router.tag(e.Buff, eh.tag),
+		Data: e.Data(),
+	}
+	if err = eh.proc.Process(ent); err != nil {
+		warnout("Failed to Process event: %v\n", err)
+	}
+	return
+}
@@ -0,0 +1,152 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+)
+
+const (
+	rateSummaryInterval = time.Minute
+)
+
+// eventLimiter is a token bucket that caps the events per second sent from a single stream.
+// Events over the limit are delayed by default, the event log buffers them for us and the
+// stream catches up once the storm passes.  With Drop-Over-Limit they are dropped instead.
+type eventLimiter struct {
+	sync.Mutex
+	name    string
+	rate    float64 //events per second
+	burst   float64
+	tokens  float64
+	last    time.Time
+	drop    bool
+	delayed uint64
+	waited  time.Duration
+	dropped uint64
+	igst    *ingest.IngestMuxer
+	done    chan struct{}
+}
+
+// newEventLimiter returns nil if the stream does not set a Max-EPS, the burst defaults to
+// one second worth of events
+func newEventLimiter(c streamParams) *eventLimiter {
+	if c.MaxEPS <= 0 {
+		return nil
+	}
+	burst := c.EPSBurst
+	if burst == 0 {
+		burst = c.MaxEPS
+	}
+	return &eventLimiter{
+		name:   c.Name,
+		rate:   float64(c.MaxEPS),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		drop:   c.DropOverLimit,
+	}
+}
+
+// wait takes a token for a single event, blocking until one is available unless the limiter
+// drops events over the limit.  It returns false when the event should be dropped.  Once the
+// context is cancelled events are no longer delayed so the batch in hand can be flushed.
+// A nil limiter allows everything.
+func (el *eventLimiter) wait(ctx context.Context) bool {
+	if el == nil {
+		return true
+	}
+	el.Lock()
+	now := time.Now()
+	if elapsed := now.Sub(el.last); elapsed > 0 {
+		el.tokens = math.Min(el.burst, el.tokens+elapsed.Seconds()*el.rate)
+		el.last = now
+	}
+	if el.tokens >= 1 {
+		el.tokens--
+		el.Unlock()
+		return true
+	} else if el.drop {
+		el.dropped++
+		el.Unlock()
+		return false
+	}
+	//take the token now and wait for it to refill
+	delay := time.Duration((1 - el.tokens) / el.rate * float64(time.Second))
+	el.tokens--
+	el.delayed++
+	el.waited += delay
+	el.Unlock()
+
+	tmr := time.NewTimer(delay)
+	defer tmr.Stop()
+	select {
+	case <-tmr.C:
+	case <-ctx.Done():
+	}
+	return true
+}
+
+// summarize returns and resets the delay and drop counters
+func (el *eventLimiter) summarize() (delayed uint64, waited time.Duration, dropped uint64) {
+	el.Lock()
+	delayed, waited, dropped = el.delayed, el.waited, el.dropped
+	el.delayed, el.waited, el.dropped = 0, 0, 0
+	el.Unlock()
+	return
+}
+
+// start logs the delayed and dropped events every rateSummaryInterval until the limiter is closed
+func (el *eventLimiter) start(igst *ingest.IngestMuxer) {
+	if el == nil {
+		return
+	}
+	el.igst = igst
+	done := make(chan struct{})
+	el.done = done
+	go func() {
+		tkr := time.NewTicker(rateSummaryInterval)
+		defer tkr.Stop()
+		for {
+			select {
+			case <-tkr.C:
+				el.report()
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func (el *eventLimiter) report() {
+	delayed, waited, dropped := el.summarize()
+	if delayed > 0 {
+		infoout("Stream %s delayed %d events by %v exceeding the Max-EPS\n", el.name, delayed, waited)
+		el.igst.Info("stream %s delayed %d events by %v exceeding the Max-EPS", el.name, delayed, waited)
+	}
+	if dropped > 0 {
+		warnout("Stream %s dropped %d events exceeding the Max-EPS\n", el.name, dropped)
+		el.igst.Warn("stream %s dropped %d events exceeding the Max-EPS", el.name, dropped)
+	}
+}
+
+// Close stops the summary routine and reports any delays or drops since the last summary
+func (el *eventLimiter) Close() error {
+	if el != nil && el.done != nil {
+		close(el.done)
+		el.done = nil
+		el.report()
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/gravwell/winevent/v3/wineventlog"
+)
+
+const (
+	//streams on remote hosts that cannot be opened or fail while reading are retried on this interval
+	remoteRetryInterval = time.Minute
+
+	evtRpcLogin = 1 //EVT_LOGIN_CLASS EvtRpcLogin
+)
+
+var (
+	ErrRemoteNoHost      = errors.New("Remote requires a Host")
+	ErrInvalidRemoteAuth = errors.New("Auth must be default, negotiate, kerberos, or ntlm")
+	ErrRemotePassword    = errors.New("Remote Password requires a User")
+	ErrRemotePattern     = errors.New("A wildcard Channel cannot be used with Remote, list each remote channel")
+
+	modwevtapi         = windows.NewLazySystemDLL("wevtapi.dll")
+	procEvtOpenSession = modwevtapi.NewProc("EvtOpenSession")
+)
+
+// remoteHost is a host whose event logs are read over the EventLog remoting protocol,
+// the same protocol Event Viewer uses to connect to another computer.  Without a User
+// the ingester service account is used to log in.
+type remoteHost struct {
+	Host     string
+	Domain   string
+	User     string
+	Password string
+	Auth     string //default, negotiate, kerberos, or ntlm
+}
+
+// evtRPCLogin mirrors EVT_RPC_LOGIN
+type evtRPCLogin struct {
+	server   *uint16
+	user     *uint16
+	domain   *uint16
+	password *uint16
+	flags    uint32
+}
+
+func (rh *remoteHost) normalize() {
+	rh.Host = strings.TrimSpace(rh.Host)
+	rh.Domain = strings.TrimSpace(rh.Domain)
+	rh.User = strings.TrimSpace(rh.User)
+	rh.Auth = strings.ToLower(strings.TrimSpace(rh.Auth))
+}
+
+func (rh *remoteHost) validate() error {
+	if rh.Host == `` {
+		return ErrRemoteNoHost
+	} else if rh.Password != `` && rh.User == `` {
+		return ErrRemotePassword
+	} else if _, err := rh.authFlags(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// authFlags returns the EVT_RPC_LOGIN_FLAGS for the Auth option
+func (rh *remoteHost) authFlags() (uint32, error) {
+	switch rh.Auth {
+	case ``, `default`:
+		return 0, nil
+	case `negotiate`:
+		return 1, nil
+	case `kerberos`:
+		return 2, nil
+	case `ntlm`:
+		return 3, nil
+	}
+	return 0, ErrInvalidRemoteAuth
+}
+
+// openSession logs in to the remote host, a nil remoteHost returns the local session
+func (rh *remoteHost) openSession() (wineventlog.EvtHandle, error) {
+	if rh == nil {
+		return 0, nil
+	}
+	flags, err := rh.authFlags()
+	if err != nil {
+		return 0, err
+	}
+	login := evtRPCLogin{flags: flags}
+	if login.server, err = utf16Ptr(rh.Host); err != nil {
+		return 0, err
+	} else if login.user, err = utf16Ptr(rh.User); err != nil {
+		return 0, err
+	} else if login.domain, err = utf16Ptr(rh.Domain); err != nil {
+		return 0, err
+	} else if login.password, err = utf16Ptr(rh.Password); err != nil {
+		return 0, err
+	}
+	r0, _, e1 := syscall.Syscall6(procEvtOpenSession.Addr(), 4, uintptr(evtRpcLogin), uintptr(unsafe.Pointer(&login)), 0, 0, 0, 0)
+	if r0 == 0 {
+		if e1 != 0 {
+			return 0, e1
+		}
+		return 0, syscall.EINVAL
+	}
+	return wineventlog.EvtHandle(r0), nil
+}
+
+func utf16Ptr(s string) (*uint16, error) {
+	if s == `` {
+		return nil, nil
+	}
+	return syscall.UTF16PtrFromString(s)
+}
+
+func closeSession(session wineventlog.EvtHandle) {
+	if session != 0 {
+		wineventlog.Close(session)
+	}
+}
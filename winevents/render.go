@@ -0,0 +1,164 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/gravwell/winevent/v3"
+	"github.com/gravwell/winevent/v3/wineventlog"
+)
+
+// renderedEvent is an event as read from a stream, Buff always holds event XML
+// so that filtering and timestamp extraction work in every output format
+type renderedEvent struct {
+	winevent.RenderedEvent
+	Out []byte //the entry data when it is not the event XML, such as the message text or JSON
+}
+
+// Data returns the entry data for the event
+func (re renderedEvent) Data() []byte {
+	if len(re.Out) > 0 {
+		return re.Out
+	}
+	return re.Buff
+}
+
+// publisherCache holds publisher metadata handles by provider name.  Opening the
+// metadata is very expensive, so handles are kept for the life of the stream and
+// providers whose metadata cannot be opened are remembered and not retried.
+type publisherCache struct {
+	sync.Mutex
+	session wineventlog.EvtHandle
+	hnds    map[string]wineventlog.EvtHandle
+}
+
+func newPublisherCache(session wineventlog.EvtHandle) *publisherCache {
+	return &publisherCache{session: session, hnds: map[string]wineventlog.EvtHandle{}}
+}
+
+func (pc *publisherCache) get(provider string) (h wineventlog.EvtHandle, ok bool) {
+	pc.Lock()
+	defer pc.Unlock()
+	if h, ok = pc.hnds[provider]; ok {
+		return h, h != 0
+	}
+	h, err := wineventlog.OpenPublisherMetadata(pc.session, provider, 0)
+	if err != nil {
+		h = 0
+	}
+	pc.hnds[provider] = h
+	return h, h != 0
+}
+
+func (pc *publisherCache) close() {
+	if pc == nil {
+		return
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	for k, h := range pc.hnds {
+		if h != 0 {
+			wineventlog.Close(h)
+		}
+		delete(pc.hnds, k)
+	}
+}
+
+// render renders a single event using the provided buffers, it is called concurrently
+// when the stream has multiple reader threads
+func (e *eventStream) render(h wineventlog.EvtHandle, buff []byte, bb *bytes.Buffer) (re renderedEvent, err error) {
+	bb.Reset()
+	if err = wineventlog.RenderEventSimple(h, buff, bb); err != nil {
+		return
+	}
+	re.Buff = append(re.Buff, bb.Bytes()...)
+	if e.publishers != nil {
+		e.renderMessage(h, &re, buff, bb)
+	}
+	if e.params.TrimBinary {
+		re.Buff, _ = trimBinary(re.Buff, e.params.BinaryLimit)
+	}
+	if e.params.Format == formatJSON {
+		//events that do not convert are sent as XML
+		if out, jerr := eventJSON(re.Buff); jerr == nil {
+			re.Out = out
+		}
+	}
+	return
+}
+
+// renderAll renders a batch of events into ents, spreading the batch across the reader threads
+func (e *eventStream) renderAll(hnds []wineventlog.EvtHandle, ents []renderedEvent) error {
+	workers := len(e.buffs)
+	if workers > len(hnds) {
+		workers = len(hnds)
+	}
+	if workers <= 1 {
+		bb := bytes.NewBuffer(nil)
+		for i, h := range hnds {
+			var err error
+			if ents[i], err = e.render(h, e.buff, bb); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			bb := bytes.NewBuffer(nil)
+			for i := w; i < len(hnds); i += workers {
+				var err error
+				if ents[i], err = e.render(hnds[i], e.buffs[w], bb); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderMessage formats the event using the publisher metadata in the system locale.
+// Events whose publisher is not installed on this host are left as plain XML, the
+// forwarded events that carry their own RenderingInfo still include the message.
+func (e *eventStream) renderMessage(h wineventlog.EvtHandle, re *renderedEvent, buff []byte, bb *bytes.Buffer) {
+	m := providerRegex.FindSubmatch(re.Buff)
+	if len(m) != 2 {
+		return
+	}
+	ph, ok := e.publishers.get(string(m[1]))
+	if !ok {
+		return
+	}
+	flag := wineventlog.EvtFormatMessageXml
+	if e.params.Render == renderText {
+		flag = wineventlog.EvtFormatMessageEvent
+	}
+	bb.Reset()
+	if err := wineventlog.FormatEventString(flag, h, string(m[1]), ph, 0, buff, bb); err != nil || bb.Len() == 0 {
+		return
+	}
+	if e.params.Render == renderText {
+		re.Out = append([]byte(nil), bb.Bytes()...)
+	} else {
+		re.Buff = append(re.Buff[:0], bb.Bytes()...)
+	}
+}
@@ -0,0 +1,471 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/gravwell/winevent/v3/wineventlog"
+)
+
+const (
+	//if we don't get any events for this long of time, we will poll the
+	//event handle to see if something has gone wrong
+	eventHandleCheckupInterval time.Duration = 10 * time.Second
+	//if we don't get any events for this long while the channel holds unread records
+	//the subscription is considered stalled and is recreated
+	streamStallTimeout time.Duration = 2 * time.Minute
+)
+
+// stallWarning is returned by Read when the watchdog recreated a stalled subscription
+type stallWarning struct {
+	idle   time.Duration
+	unread uint64
+}
+
+func (sw stallWarning) Error() string {
+	return fmt.Sprintf("Subscription stalled for %v with %d unread records, recreated the subscription", sw.idle, sw.unread)
+}
+
+// eventStream is a subscription to a single event channel.  It follows the
+// EventStreamHandle in the winevent package, but builds its own query so that
+// channels can supply a raw XPath query.
+type eventStream struct {
+	params       streamParams
+	subHandle    wineventlog.EvtHandle
+	bmk          wineventlog.EvtHandle
+	filePath     string
+	fileCreation time.Time
+	buff         []byte
+	buffs        [][]byte //render buffers for each reader thread, the first is buff
+	last         uint64
+	prev         uint64
+	checkGaps    bool
+	mtx          *sync.Mutex
+	lastRead     time.Time
+	publishers   *publisherCache
+	session      wineventlog.EvtHandle //remote session, zero for the local host
+	stallCheck   time.Time
+}
+
+// newEventStream subscribes to the channel, the stream takes ownership of the session and closes it with the stream
+func newEventStream(param streamParams, last uint64, session wineventlog.EvtHandle) (e *eventStream, err error) {
+	if last > 0 {
+		//if we have a last value, we don't want to do reachback
+		param.ReachBack = 0
+	}
+	e = &eventStream{
+		params:    param,
+		mtx:       &sync.Mutex{},
+		last:      last,
+		prev:      last,
+		checkGaps: param.XPath == `` && !param.IsFiltering(),
+		lastRead:  time.Now(),
+		session:   session,
+	}
+	for i := 0; i < param.Threads || i == 0; i++ {
+		e.buffs = append(e.buffs, make([]byte, param.BuffSize))
+	}
+	e.buff = e.buffs[0]
+	if param.Render != renderRaw {
+		e.publishers = newPublisherCache(session)
+	}
+	if err = e.open(); err != nil {
+		e = nil
+		return
+	}
+	return
+}
+
+func (e *eventStream) open() (err error) {
+	e.mtx.Lock()
+	err = e.openNoLock()
+	e.mtx.Unlock()
+	return
+}
+
+func (e *eventStream) openNoLock() error {
+	var err error
+	if e.last == 0 {
+		//get a record id
+		if e.last, err = e.getRecordID(); err != nil {
+			return err
+		}
+	}
+	params := e.params
+	//disable the reachback parameter after we get our recordID
+	params.ReachBack = 0
+	if e.fileCreation, e.filePath, err = e.channelFile(); err != nil {
+		return err
+	}
+	sigEvent, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(sigEvent)
+	query, err := genQuery(params)
+	if err != nil {
+		return err
+	}
+	//we build our bookmark
+	flags := wineventlog.EvtSubscribeStartAfterBookmark
+	if e.bmk, err = wineventlog.CreateBookmarkFromRecordID(e.params.Channel, e.last); err != nil {
+		return err
+	}
+
+	//subscribe to the channel using our session, zero is the local host
+	subHandle, err := wineventlog.Subscribe(e.session, sigEvent, ``, query, e.bmk, flags)
+	if err != nil {
+		wineventlog.Close(e.bmk)
+		return err
+	}
+
+	e.subHandle = subHandle
+	return nil
+}
+
+func (e *eventStream) closeNoLock() (err error) {
+	if err = wineventlog.Close(e.subHandle); err != nil {
+		wineventlog.Close(e.bmk)
+	} else {
+		err = wineventlog.Close(e.bmk)
+	}
+	return
+}
+
+func (e *eventStream) Reset() (err error) {
+	e.mtx.Lock()
+	err = e.resetNoLock()
+	e.mtx.Unlock()
+	return
+}
+
+func (e *eventStream) resetNoLock() (err error) {
+	e.closeNoLock()
+	err = e.openNoLock()
+	return
+}
+
+// getHandles will iterate on the call to EventHandles, on big event log entries the kernel throws
+// RPC_S_INVALID_BOUND which means it can't hand back all the handles due to size
+func (e *eventStream) getHandles(start int) (evtHnds []wineventlog.EvtHandle, fullRead bool, err error) {
+	for cnt := start; cnt >= minHandleRequest; cnt = cnt / 2 {
+		evtHnds, err = wineventlog.EventHandles(e.subHandle, cnt)
+		switch err {
+		case nil:
+			fullRead = len(evtHnds) == cnt
+			e.lastRead = time.Now()
+			return //got a good read
+		case wineventlog.ERROR_NO_MORE_ITEMS:
+			err = nil
+			return //empty
+		case wineventlog.RPC_S_INVALID_BOUND:
+			//our buffer isn't big enough, reset the handle and try again
+			if err = e.resetNoLock(); err != nil {
+				return
+			}
+			//we will retry
+		default:
+			return
+		}
+	}
+	//if we hit here, then our buffer is not big enough to handle two entries
+	if evtHnds, err = wineventlog.EventHandles(e.subHandle, 1); err == nil && len(evtHnds) == 1 {
+		fullRead = true
+	}
+	return
+}
+
+func (e *eventStream) checkEventHandles() (warn, err error) {
+	var ts time.Time
+	var pth string
+	if ts, pth, err = e.channelFile(); err != nil {
+		return
+	} else if ts != e.fileCreation {
+		if err = e.resetNoLock(); err != nil {
+			err = fmt.Errorf("Failed to reset event stream after time change: %v", err)
+		} else {
+			warn = fmt.Errorf("Backing event file reset, reinitializing the event stream")
+		}
+	} else if pth != e.filePath {
+		if err = e.resetNoLock(); err != nil {
+			err = fmt.Errorf("Failed to reset event stream after path change: %v", err)
+		} else {
+			warn = fmt.Errorf("Backing event file moved, reinitializing the event stream")
+		}
+	}
+	return
+}
+
+// channelFile returns the creation time and path of the file backing the channel.  The channel
+// configuration cannot be read from a remote host, so remote channels only check the creation time.
+func (e *eventStream) channelFile() (ts time.Time, pth string, err error) {
+	if e.session == 0 {
+		if ts, err = wineventlog.GetChannelFileCreationTime(e.params.Channel); err == nil {
+			pth, err = wineventlog.GetChannelFilePath(e.params.Channel)
+		}
+		return
+	}
+	var hnd wineventlog.EvtHandle
+	if hnd, err = wineventlog.EvtOpenLog(e.session, e.params.Channel, wineventlog.EvtOpenChannelPath); err != nil {
+		return
+	}
+	defer wineventlog.Close(hnd)
+	var lfi wineventlog.LogFileInfo
+	if lfi, err = wineventlog.QueryLogFile(hnd); err == nil {
+		ts = lfi.Creation
+	}
+	return
+}
+
+// getRecordID grabs the oldest record within the reachback window
+func (e *eventStream) getRecordID() (uint64, error) {
+	bb := bytes.NewBuffer(nil)
+	sigEvent, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer windows.CloseHandle(sigEvent)
+	query, err := genReachbackQuery(e.params)
+	if err != nil {
+		return 0, err
+	}
+	//we build our bookmark
+	flags := wineventlog.EvtSubscribeStartAfterBookmark
+	bmk, err := wineventlog.CreateBookmarkFromRecordID(e.params.Channel, e.last)
+	if err != nil {
+		return 0, err
+	}
+	defer wineventlog.Close(bmk)
+
+	subHandle, err := wineventlog.Subscribe(
+		e.session,
+		sigEvent,
+		``,    // channel is in the query
+		query, //query has the reachback parameter
+		bmk,
+		flags)
+	if err != nil {
+		return 0, err
+	}
+	defer wineventlog.Close(subHandle)
+
+	evtHnds, err := wineventlog.EventHandles(subHandle, 1)
+	switch err {
+	case nil:
+		if len(evtHnds) != 1 {
+			return 0, fmt.Errorf("invalid return count %d != 1 on seek", len(evtHnds))
+		}
+		defer wineventlog.Close(evtHnds[0])
+		if err = wineventlog.UpdateBookmarkFromEvent(bmk, evtHnds[0]); err != nil {
+			return 0, err
+		}
+		id, err := wineventlog.GetRecordIDFromBookmark(bmk, e.buff, bb)
+		if err != nil {
+			return 0, err
+		}
+		if id > 0 {
+			//always decrement or we will throw away the entry from this sample
+			id--
+		}
+		return id, nil
+	case wineventlog.ERROR_NO_MORE_ITEMS:
+		return 0, nil
+	}
+	return 0, err
+}
+
+func (e *eventStream) Read() (ents []renderedEvent, fullRead bool, warn, err error) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	var evtHandles []wineventlog.EvtHandle
+	if evtHandles, fullRead, err = e.getHandles(e.params.ReqSize); err != nil {
+		return
+	} else if len(evtHandles) == 0 {
+		//check if we need to poll the log event values
+		if time.Since(e.lastRead) > eventHandleCheckupInterval {
+			if warn, err = e.checkEventHandles(); warn == nil && err == nil {
+				warn, err = e.checkStalled()
+			}
+		}
+		return
+	}
+	defer func() {
+		for _, h := range evtHandles {
+			wineventlog.Close(h)
+		}
+	}()
+	ents = make([]renderedEvent, len(evtHandles))
+	if err = e.renderAll(evtHandles, ents); err != nil {
+		ents = nil
+		return
+	}
+	//the bookmark walks the batch in order to pick up each record ID
+	bb := bytes.NewBuffer(nil)
+	for i, h := range evtHandles {
+		bb.Reset()
+		if err = wineventlog.UpdateBookmarkFromEvent(e.bmk, h); err != nil {
+			ents = nil
+			return
+		} else if ents[i].ID, err = wineventlog.GetRecordIDFromBookmark(e.bmk, e.buff, bb); err != nil {
+			ents = nil
+			return
+		}
+		if e.checkGaps && (e.prev+1) != ents[i].ID {
+			jump := ents[i].ID - e.prev
+			warn = fmt.Errorf("RecordID Jumped %d from %d to %d at request batch offset %d / %d", jump, e.prev, ents[i].ID, i, len(evtHandles))
+		}
+		e.prev = ents[i].ID
+		e.last = ents[i].ID
+	}
+	if e.params.MaxBacklog > 0 {
+		if bwarn, berr := e.checkBacklog(ents[len(ents)-1].Buff); berr != nil {
+			err = berr
+		} else if bwarn != nil {
+			warn = bwarn
+		}
+	}
+	return
+}
+
+// checkStalled is the subscription watchdog, when no events have been delivered for the
+// streamStallTimeout but the channel holds records past the last one read the subscription
+// is recreated.  Filtered streams cannot tell unread records from filtered ones, so only
+// unfiltered streams are watched.
+func (e *eventStream) checkStalled() (warn, err error) {
+	if !e.checkGaps || time.Since(e.lastRead) < streamStallTimeout || time.Since(e.stallCheck) < streamStallTimeout {
+		return
+	}
+	e.stallCheck = time.Now()
+	_, newest, lerr := channelRecords(e.session, e.params.Channel)
+	if lerr != nil || newest <= e.last {
+		return
+	}
+	sw := stallWarning{idle: time.Since(e.lastRead).Round(time.Second), unread: newest - e.last}
+	if err = e.resetNoLock(); err != nil {
+		err = fmt.Errorf("Failed to recreate stalled subscription: %v", err)
+		return
+	}
+	e.lastRead = time.Now()
+	warn = sw
+	return
+}
+
+// checkBacklog skips ahead to the events within the Max-Backlog window when the newest event
+// read is older than the window, so a collector that has fallen behind catches up instead of
+// staying permanently behind.  The events that are skipped are never sent.
+func (e *eventStream) checkBacklog(newest []byte) (warn, err error) {
+	m := timeCreatedRegex.FindSubmatch(newest)
+	if len(m) != 2 {
+		return
+	}
+	created, perr := time.Parse(time.RFC3339Nano, string(m[1]))
+	if perr != nil || time.Since(created) <= e.params.MaxBacklog {
+		return
+	}
+	reachback := e.params.ReachBack
+	e.params.ReachBack = e.params.MaxBacklog
+	id, err := e.getRecordID()
+	e.params.ReachBack = reachback
+	if err != nil || id <= e.last {
+		return
+	}
+	skipped := id - e.last
+	e.last, e.prev = id, id
+	if err = e.resetNoLock(); err != nil {
+		err = fmt.Errorf("Failed to reset event stream after skipping the backlog: %v", err)
+		return
+	}
+	warn = fmt.Errorf("Event stream is more than %v behind, skipped %d records to record ID %d", e.params.MaxBacklog, skipped, id)
+	return
+}
+
+func (e *eventStream) Name() (s string) {
+	e.mtx.Lock()
+	s = e.params.Name
+	e.mtx.Unlock()
+	return
+}
+
+func (e *eventStream) Last() (l uint64) {
+	e.mtx.Lock()
+	l = e.last
+	e.mtx.Unlock()
+	return
+}
+
+func (e *eventStream) Close() (err error) {
+	e.mtx.Lock()
+	e.publishers.close()
+	err = e.closeNoLock()
+	if e.session != 0 {
+		wineventlog.Close(e.session)
+		e.session = 0
+	}
+	e.mtx.Unlock()
+	return
+}
+
+func genQuery(p streamParams) (string, error) {
+	if p.XPath != `` {
+		return genXPathQuery(p.Channel, p.XPath)
+	}
+	return wineventlog.Query{
+		Log:         p.Channel,
+		IgnoreOlder: p.ReachBack,
+		Level:       p.Levels,
+		Provider:    p.Providers,
+		EventID:     p.EventIDs, //black list and white list of event IDs (add - in front to remove one) blank is all
+	}.Build()
+}
+
+// genReachbackQuery builds the query used to find the starting record, a raw XPath
+// query cannot be combined with the reachback so it starts from the oldest record
+// in the reachback window and lets the subscription do the filtering
+func genReachbackQuery(p streamParams) (string, error) {
+	if p.XPath == `` {
+		return genQuery(p)
+	}
+	return wineventlog.Query{
+		Log:         p.Channel,
+		IgnoreOlder: p.ReachBack,
+	}.Build()
+}
+
+// genXPathQuery accepts either a full <QueryList> as exported from an Event Viewer
+// custom view or a bare XPath query which is selected from the channel
+func genXPathQuery(channel, xpath string) (string, error) {
+	if strings.HasPrefix(xpath, `<`) {
+		var ql struct {
+			XMLName xml.Name `xml:"QueryList"`
+		}
+		if err := xml.Unmarshal([]byte(xpath), &ql); err != nil {
+			return ``, ErrInvalidXPath
+		}
+		return xpath, nil
+	}
+	bb := bytes.NewBuffer(nil)
+	bb.WriteString(`<QueryList><Query Id="0"><Select Path="`)
+	if err := xml.EscapeText(bb, []byte(channel)); err != nil {
+		return ``, err
+	}
+	bb.WriteString(`">`)
+	if err := xml.EscapeText(bb, []byte(xpath)); err != nil {
+		return ``, err
+	}
+	bb.WriteString(`</Select></Query></QueryList>`)
+	return bb.String(), nil
+}
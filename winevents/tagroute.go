@@ -0,0 +1,200 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+)
+
+var (
+	ErrInvalidProviderTag = errors.New("Provider-Tag must be of the form provider:tag")
+	ErrInvalidEventIDTag  = errors.New("EventID-Tag must be of the form id:tag or low-high:tag, such as 4624-4634:winlogon")
+
+	eventIDRegex = regexp.MustCompile(`<EventID(?:\s[^>]*)?>(\d+)</EventID>`)
+)
+
+// idTag maps an inclusive range of event IDs to a tag
+type idTag struct {
+	low, high uint16
+	tag       string
+}
+
+// tagRoutes hold the Provider-Tag and EventID-Tag overrides of a channel by tag name,
+// provider names are stored lower case because they are case insensitive
+type tagRoutes struct {
+	providers map[string]string
+	ids       []idTag
+}
+
+// tagRouter picks the tag for each event from the overrides of a channel, provider
+// overrides are checked first and then the EventID overrides in the order they were given.
+// Events matching no override keep the channel tag.
+type tagRouter struct {
+	providers map[string]entry.EntryTag
+	ids       []idRoute
+}
+
+type idRoute struct {
+	low, high uint16
+	tag       entry.EntryTag
+}
+
+// splitTagOverride splits a value:tag override, tags cannot contain a colon so the last one separates the value
+func splitTagOverride(v string) (val, tag string, ok bool) {
+	idx := strings.LastIndex(v, ":")
+	if idx <= 0 {
+		return
+	}
+	val, tag = strings.TrimSpace(v[:idx]), strings.TrimSpace(v[idx+1:])
+	ok = val != `` && tag != ``
+	return
+}
+
+func parseTagRoutes(provTags, idTags []string) (tr tagRoutes, err error) {
+	for _, v := range provTags {
+		prov, tag, ok := splitTagOverride(v)
+		if !ok {
+			err = ErrInvalidProviderTag
+			return
+		} else if err = ingest.CheckTag(tag); err != nil {
+			err = fmt.Errorf("Invalid Provider-Tag tag %q: %v", tag, err)
+			return
+		}
+		if tr.providers == nil {
+			tr.providers = map[string]string{}
+		}
+		tr.providers[strings.ToLower(prov)] = tag
+	}
+	for _, v := range idTags {
+		ids, tag, ok := splitTagOverride(v)
+		if !ok {
+			err = ErrInvalidEventIDTag
+			return
+		} else if err = ingest.CheckTag(tag); err != nil {
+			err = fmt.Errorf("Invalid EventID-Tag tag %q: %v", tag, err)
+			return
+		}
+		it := idTag{tag: tag}
+		if it.low, it.high, err = parseIDRange(ids); err != nil {
+			return
+		}
+		tr.ids = append(tr.ids, it)
+	}
+	return
+}
+
+func parseIDRange(v string) (low, high uint16, err error) {
+	lows, highs := v, v
+	if idx := strings.Index(v, "-"); idx != -1 {
+		lows, highs = strings.TrimSpace(v[:idx]), strings.TrimSpace(v[idx+1:])
+	}
+	var l, h uint64
+	if l, err = strconv.ParseUint(lows, 10, 16); err != nil {
+		err = ErrInvalidEventIDTag
+	} else if h, err = strconv.ParseUint(highs, 10, 16); err != nil || h < l {
+		err = ErrInvalidEventIDTag
+	} else {
+		low, high = uint16(l), uint16(h)
+	}
+	return
+}
+
+// Tags returns the tag names used by the overrides
+func (tr tagRoutes) Tags() (tags []string) {
+	for _, v := range tr.providers {
+		tags = append(tags, v)
+	}
+	for _, v := range tr.ids {
+		tags = append(tags, v.tag)
+	}
+	return
+}
+
+func (tr tagRoutes) empty() bool {
+	return len(tr.providers) == 0 && len(tr.ids) == 0
+}
+
+func (tr tagRoutes) String() string {
+	var parts []string
+	for k, v := range tr.providers {
+		parts = append(parts, k+":"+v)
+	}
+	for _, v := range tr.ids {
+		if v.low == v.high {
+			parts = append(parts, fmt.Sprintf("%d:%s", v.low, v.tag))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d:%s", v.low, v.high, v.tag))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// router resolves the override tags, it returns nil when the channel has no overrides
+func (tr tagRoutes) router(getTag func(string) (entry.EntryTag, error)) (*tagRouter, error) {
+	if tr.empty() {
+		return nil, nil
+	}
+	r := &tagRouter{}
+	for prov, name := range tr.providers {
+		tag, err := getTag(name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to translate tag %s: %v", name, err)
+		}
+		if r.providers == nil {
+			r.providers = map[string]entry.EntryTag{}
+		}
+		r.providers[prov] = tag
+	}
+	for _, v := range tr.ids {
+		tag, err := getTag(v.tag)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to translate tag %s: %v", v.tag, err)
+		}
+		r.ids = append(r.ids, idRoute{low: v.low, high: v.high, tag: tag})
+	}
+	return r, nil
+}
+
+// tag returns the tag for the rendered event XML, it is safe to call on a nil router
+func (r *tagRouter) tag(buff []byte, def entry.EntryTag) entry.EntryTag {
+	if r == nil {
+		return def
+	}
+	//the provider and event ID are in the System element at the top of the event
+	if idx := bytes.Index(buff, []byte(`</System>`)); idx > 0 {
+		buff = buff[:idx]
+	}
+	if len(r.providers) > 0 {
+		if m := providerRegex.FindSubmatch(buff); len(m) == 2 {
+			if tag, ok := r.providers[strings.ToLower(string(m[1]))]; ok {
+				return tag
+			}
+		}
+	}
+	if len(r.ids) > 0 {
+		if m := eventIDRegex.FindSubmatch(buff); len(m) == 2 {
+			if id, err := strconv.ParseUint(string(m[1]), 10, 16); err == nil {
+				for _, v := range r.ids {
+					if uint16(id) >= v.low && uint16(id) <= v.high {
+						return v.tag
+					}
+				}
+			}
+		}
+	}
+	return def
+}
@@ -0,0 +1,283 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/config"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/timegrinder/v3"
+)
+
+const (
+	MAX_CONFIG_SIZE int64 = (1024 * 1024 * 2) //2MB, even this is crazy large
+)
+
+var (
+	ErrMissingEndpoint      = errors.New("Endpoint is required")
+	ErrInvalidEndpoint      = errors.New("Endpoint must be tcp://host:port or ipc:///path")
+	ErrInvalidSocketType    = errors.New("Socket-Type must be sub or pull")
+	ErrSubscribeWithoutSUB  = errors.New("Subscribe only applies to sub sockets")
+	ErrInvalidTopicTag      = errors.New("Topic-Tag must be of the form prefix:tag")
+	ErrTopicFrameWithoutSUB = errors.New("Topic-Frame only applies to sub sockets")
+)
+
+type ConfigSocket struct {
+	Tag_Name        string
+	Endpoint        string   //tcp://host:port or ipc:///path/to/socket
+	Bind            bool     //listen on the Endpoint for peers instead of connecting to it
+	Socket_Type     string   //sub or pull
+	Subscribe       []string //topic prefix for sub sockets, may be given multiple times, everything is received if empty
+	Topic_Tag       []string //prefix:tag, messages whose topic starts with prefix go to the tag instead of Tag-Name
+	Topic_Frame     bool     //the first part of each multipart message is the topic and is not ingested
+	Source_Override string
+
+	Extract_Timestamps        bool //ZeroMQ messages carry no timestamp, use timegrinder instead of the receive time
+	Assume_Local_Timezone     bool
+	Timezone_Override         string
+	Timestamp_Format_Override string //override the timestamp format
+	Preprocessor              []string
+}
+
+type topicTag struct {
+	prefix string
+	tag    string
+}
+
+type socketCfg struct {
+	tag          string
+	network      string //tcp or unix
+	addr         string
+	bind         bool
+	socketType   string
+	subscribe    []string
+	topicTags    []topicTag //in configuration order, the first matching prefix wins
+	topicFrame   bool
+	srcOverride  net.IP
+	tg           *timegrinder.TimeGrinder
+	preprocessor []string
+}
+
+type cfgReadType struct {
+	Global       config.IngestConfig
+	Socket       map[string]*ConfigSocket
+	Preprocessor processors.ProcessorConfig
+}
+
+type cfgType struct {
+	config.IngestConfig
+	Sockets      map[string]*socketCfg
+	Preprocessor processors.ProcessorConfig
+}
+
+func GetConfig(path string) (*cfgType, error) {
+	var cr cfgReadType
+	if err := config.LoadConfigFile(&cr, path); err != nil {
+		return nil, err
+	}
+	//validate the global params
+	if err := cr.Global.Verify(); err != nil {
+		return nil, err
+	} else if len(cr.Socket) == 0 {
+		return nil, errors.New("no sockets defined")
+	} else if err := cr.Preprocessor.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := &cfgType{
+		IngestConfig: cr.Global,
+		Sockets:      make(map[string]*socketCfg, len(cr.Socket)),
+		Preprocessor: cr.Preprocessor,
+	}
+	bound := map[string]string{}
+	for k, v := range cr.Socket {
+		if err := c.Preprocessor.CheckProcessors(v.Preprocessor); err != nil {
+			return nil, fmt.Errorf("Socket %s preprocessor invalid: %v", k, err)
+		}
+		sc, err := v.validateAndProcess()
+		if err != nil {
+			return nil, fmt.Errorf("Socket %s: %v", k, err)
+		}
+		if sc.bind {
+			if other, ok := bound[sc.addr]; ok {
+				return nil, fmt.Errorf("Socket %s binds the same Endpoint as %s", k, other)
+			}
+			bound[sc.addr] = k
+		}
+		c.Sockets[k] = &sc
+	}
+	return c, nil
+}
+
+func (c *cfgType) Tags() (tags []string, err error) {
+	tagMp := make(map[string]bool, len(c.Sockets))
+	add := func(tag string) {
+		if _, ok := tagMp[tag]; !ok {
+			tags = append(tags, tag)
+			tagMp[tag] = true
+		}
+	}
+	for _, v := range c.Sockets {
+		add(v.tag)
+		for _, tt := range v.topicTags {
+			add(tt.tag)
+		}
+	}
+	if len(tags) == 0 {
+		err = errors.New("No tags specified")
+	} else {
+		sort.Strings(tags)
+	}
+	return
+}
+
+func (cs ConfigSocket) validateAndProcess() (c socketCfg, err error) {
+	if len(cs.Tag_Name) == 0 {
+		err = errors.New("missing tag name")
+		return
+	} else if err = ingest.CheckTag(cs.Tag_Name); err != nil {
+		return
+	}
+	c.tag = cs.Tag_Name
+
+	if c.network, c.addr, err = parseEndpoint(cs.Endpoint); err != nil {
+		return
+	}
+	c.bind = cs.Bind
+
+	switch strings.ToLower(strings.TrimSpace(cs.Socket_Type)) {
+	case `sub`:
+		c.socketType = socketSUB
+		c.topicFrame = cs.Topic_Frame
+		c.subscribe = cs.Subscribe
+		if len(c.subscribe) == 0 {
+			c.subscribe = []string{``}
+		}
+	case `pull`:
+		c.socketType = socketPULL
+		if len(cs.Subscribe) > 0 {
+			err = ErrSubscribeWithoutSUB
+			return
+		} else if cs.Topic_Frame {
+			err = ErrTopicFrameWithoutSUB
+			return
+		}
+	default:
+		err = ErrInvalidSocketType
+		return
+	}
+	if c.topicTags, err = cs.parseTopicTags(); err != nil {
+		return
+	}
+
+	if len(cs.Source_Override) > 0 {
+		if c.srcOverride = net.ParseIP(cs.Source_Override); c.srcOverride == nil {
+			err = fmt.Errorf("Invalid source override %s", cs.Source_Override)
+			return
+		}
+	}
+
+	if cs.Timezone_Override != "" {
+		if cs.Assume_Local_Timezone {
+			err = fmt.Errorf("Cannot specify Assume-Local-Timezone and Timezone-Override in the same socket")
+			return
+		}
+		if _, err = time.LoadLocation(cs.Timezone_Override); err != nil {
+			err = fmt.Errorf("Invalid timezone override %v: %v", cs.Timezone_Override, err)
+			return
+		}
+	}
+	if cs.Extract_Timestamps {
+		tcfg := timegrinder.Config{
+			EnableLeftMostSeed: true,
+			FormatOverride:     cs.Timestamp_Format_Override,
+		}
+		if c.tg, err = timegrinder.NewTimeGrinder(tcfg); err != nil {
+			err = fmt.Errorf("Failed to generate new timegrinder: %v", err)
+			return
+		}
+		if cs.Assume_Local_Timezone {
+			c.tg.SetLocalTime()
+		}
+		if cs.Timezone_Override != `` {
+			if err = c.tg.SetTimezone(cs.Timezone_Override); err != nil {
+				err = fmt.Errorf("Failed to override timezone: %v", err)
+				return
+			}
+		}
+	}
+	c.preprocessor = cs.Preprocessor
+	return
+}
+
+// parseEndpoint translates a ZeroMQ endpoint into a network and address for the net package
+func parseEndpoint(ep string) (network, addr string, err error) {
+	if ep = strings.TrimSpace(ep); ep == `` {
+		err = ErrMissingEndpoint
+		return
+	}
+	switch {
+	case strings.HasPrefix(ep, `tcp://`):
+		network, addr = `tcp`, strings.TrimPrefix(ep, `tcp://`)
+		//ZeroMQ binds to all interfaces with *
+		if strings.HasPrefix(addr, `*:`) {
+			addr = strings.TrimPrefix(addr, `*`)
+		}
+		var port string
+		if _, port, err = net.SplitHostPort(addr); err != nil || port == `` {
+			err = ErrInvalidEndpoint
+		}
+	case strings.HasPrefix(ep, `ipc://`):
+		if network, addr = `unix`, strings.TrimPrefix(ep, `ipc://`); addr == `` {
+			err = ErrInvalidEndpoint
+		}
+	default:
+		err = ErrInvalidEndpoint
+	}
+	return
+}
+
+// parseTopicTags checks the prefix:tag overrides, tags cannot contain a colon so the last one
+// separates the prefix
+func (cs ConfigSocket) parseTopicTags() (tts []topicTag, err error) {
+	for _, v := range cs.Topic_Tag {
+		idx := strings.LastIndex(v, ":")
+		if idx <= 0 {
+			return nil, ErrInvalidTopicTag
+		}
+		tt := topicTag{
+			prefix: v[:idx],
+			tag:    strings.TrimSpace(v[idx+1:]),
+		}
+		if tt.tag == `` {
+			return nil, ErrInvalidTopicTag
+		} else if err = ingest.CheckTag(tt.tag); err != nil {
+			return nil, fmt.Errorf("Invalid Topic-Tag tag %q: %v", tt.tag, err)
+		}
+		tts = append(tts, tt)
+	}
+	return
+}
+
+// tagFor returns the tag for a message with the given topic
+func (c *socketCfg) tagFor(topic []byte) string {
+	for _, tt := range c.topicTags {
+		if strings.HasPrefix(string(topic), tt.prefix) {
+			return tt.tag
+		}
+	}
+	return c.tag
+}
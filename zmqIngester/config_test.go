@@ -0,0 +1,164 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gravwell/ingest/v3/log"
+)
+
+var (
+	tmpDir string
+)
+
+func TestMain(m *testing.M) {
+	var err error
+	if tmpDir, err = ioutil.TempDir(os.TempDir(), `zmq`); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create tempdir %v\n", err)
+		os.Exit(-1)
+	}
+	lg = log.NewDiscardLogger()
+	r := m.Run()
+	os.RemoveAll(tmpDir)
+	os.Exit(r)
+}
+
+func writeConfig(t *testing.T, s string) string {
+	fout, err := ioutil.TempFile(tmpDir, `cfg`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fout.Close()
+	if _, err = fout.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+	return fout.Name()
+}
+
+func TestConfig(t *testing.T) {
+	cfg, err := GetConfig(writeConfig(t, baseConfig))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(cfg.Sockets) != 2 {
+		t.Fatalf("invalid socket count %d", len(cfg.Sockets))
+	}
+	if tags, err := cfg.Tags(); err != nil {
+		t.Fatal(err)
+	} else if len(tags) != 3 {
+		t.Fatalf("invalid tags %v", tags)
+	}
+
+	sc := cfg.Sockets[`telemetry`]
+	if sc.network != `tcp` || sc.addr != `collector.example.com:5556` || sc.bind || sc.socketType != socketSUB {
+		t.Fatalf("bad socket config %+v", sc)
+	} else if len(sc.subscribe) != 2 || !sc.topicFrame || sc.tg == nil {
+		t.Fatalf("bad socket config %+v", sc)
+	}
+	for topic, tag := range map[string]string{
+		`cluster.node1.gpu`: `gpu`,
+		`cluster.node1.cpu`: `hpc`,
+		`jobs.start`:        `jobs`,
+	} {
+		if r := sc.tagFor([]byte(topic)); r != tag {
+			t.Errorf("topic %s went to %s instead of %s", topic, r, tag)
+		}
+	}
+
+	sc = cfg.Sockets[`pipeline`]
+	if sc.network != `unix` || sc.addr != `/tmp/pipeline.ipc` || !sc.bind || sc.socketType != socketPULL {
+		t.Fatalf("bad socket config %+v", sc)
+	} else if len(sc.subscribe) != 0 || sc.tg != nil {
+		t.Fatalf("bad socket config %+v", sc)
+	}
+}
+
+func TestParseEndpoint(t *testing.T) {
+	for ep, exp := range map[string][2]string{
+		`tcp://127.0.0.1:5555`: {`tcp`, `127.0.0.1:5555`},
+		`tcp://*:5555`:         {`tcp`, `:5555`},
+		`tcp://[::1]:5555`:     {`tcp`, `[::1]:5555`},
+		`ipc:///tmp/feed`:      {`unix`, `/tmp/feed`},
+	} {
+		if n, a, err := parseEndpoint(ep); err != nil {
+			t.Fatal(err)
+		} else if n != exp[0] || a != exp[1] {
+			t.Fatalf("bad endpoint %s: %s %s", ep, n, a)
+		}
+	}
+	for _, ep := range []string{``, `127.0.0.1:5555`, `tcp://127.0.0.1`, `ipc://`, `inproc://feed`, `pgm://eth0;239.192.1.1:5555`} {
+		if _, _, err := parseEndpoint(ep); err == nil {
+			t.Errorf("bad endpoint %q accepted", ep)
+		}
+	}
+}
+
+func TestBadConfigs(t *testing.T) {
+	for _, b := range []string{
+		`Socket-Type=sub`,
+		`Endpoint=tcp://127.0.0.1:5555`,
+		`Endpoint=tcp://127.0.0.1:5555
+		Socket-Type=pub`,
+		`Endpoint=tcp://127.0.0.1:5555
+		Socket-Type=pull
+		Subscribe=logs`,
+		`Endpoint=tcp://127.0.0.1:5555
+		Socket-Type=pull
+		Topic-Frame=true`,
+		`Endpoint=tcp://127.0.0.1:5555
+		Socket-Type=sub
+		Topic-Tag=logs`,
+		`Endpoint=tcp://127.0.0.1:5555
+		Socket-Type=sub
+		Topic-Tag=logs:bad tag`,
+	} {
+		if _, err := GetConfig(writeConfig(t, badBase+b)); err == nil {
+			t.Errorf("bad config accepted: %s", b)
+		}
+	}
+	dup := badBase + "Endpoint=tcp://*:5555\nSocket-Type=pull\nBind=true\n[Socket \"dup\"]\nTag-Name=zmq\nEndpoint=tcp://*:5555\nSocket-Type=pull\nBind=true\n"
+	if _, err := GetConfig(writeConfig(t, dup)); err == nil {
+		t.Error("duplicate bind accepted")
+	}
+}
+
+const baseConfig = `
+[Global]
+Ingest-Secret = IngestSecrets
+Connection-Timeout = 0
+Cleartext-Backend-Target=127.0.0.1:4023
+
+[Socket "telemetry"]
+	Endpoint=tcp://collector.example.com:5556
+	Socket-Type=sub
+	Tag-Name=hpc
+	Subscribe=cluster.
+	Subscribe=jobs.
+	Topic-Frame=true
+	Topic-Tag=cluster.node1.gpu:gpu
+	Topic-Tag=jobs.:jobs
+	Extract-Timestamps=true
+
+[Socket "pipeline"]
+	Endpoint=ipc:///tmp/pipeline.ipc
+	Bind=true
+	Socket-Type=pull
+	Tag-Name=hpc
+`
+
+const badBase = `
+[Global]
+Ingest-Secret = IngestSecrets
+Cleartext-Backend-Target=127.0.0.1:4023
+
+[Socket "bad"]
+	Tag-Name=zmq
+	`
@@ -0,0 +1,253 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/gravwell/ingest/v3"
+	"github.com/gravwell/ingest/v3/entry"
+	"github.com/gravwell/ingest/v3/log"
+	"github.com/gravwell/ingest/v3/processors"
+	"github.com/gravwell/ingesters/v3/utils"
+	"github.com/gravwell/ingesters/v3/version"
+)
+
+const (
+	defaultConfigLoc = `/opt/gravwell/etc/zmq.conf`
+	ingesterName     = `zmq`
+)
+
+var (
+	confLoc        = flag.String("config-file", defaultConfigLoc, "Location for configuration file")
+	verbose        = flag.Bool("v", false, "Display verbose status updates to stdout")
+	stderrOverride = flag.String("stderr", "", "Redirect stderr to a shared memory file")
+	ver            = flag.Bool("version", false, "Print the version information and exit")
+
+	v  bool
+	lg *log.Logger
+)
+
+func handleFlags() {
+	flag.Parse()
+	if *ver {
+		version.PrintVersion(os.Stdout)
+		ingest.PrintVersion(os.Stdout)
+		os.Exit(0)
+	}
+	lg = log.New(os.Stderr) // DO NOT close this, it will prevent backtraces from firing
+	if *stderrOverride != `` {
+		if oldstderr, err := syscall.Dup(int(os.Stderr.Fd())); err != nil {
+			lg.Fatal("Failed to dup stderr: %v\n", err)
+		} else {
+			lg.AddWriter(os.NewFile(uintptr(oldstderr), "oldstderr"))
+		}
+
+		fp := path.Join(`/dev/shm/`, *stderrOverride)
+		fout, err := os.Create(fp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", fp, err)
+		} else {
+			version.PrintVersion(fout)
+			ingest.PrintVersion(fout)
+			//file created, dup it
+			if err := syscall.Dup2(int(fout.Fd()), int(os.Stderr.Fd())); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to dup2 stderr: %v\n", err)
+				fout.Close()
+			}
+		}
+	}
+
+	v = *verbose
+}
+
+func main() {
+	handleFlags()
+	cfg, err := GetConfig(*confLoc)
+	if err != nil {
+		lg.FatalCode(0, "Failed to get configuration: %v\n", err)
+		return
+	}
+
+	if len(cfg.Log_File) > 0 {
+		fout, err := os.OpenFile(cfg.Log_File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			lg.FatalCode(0, "Failed to open log file %s: %v", cfg.Log_File, err)
+		}
+		if err = lg.AddWriter(fout); err != nil {
+			lg.Fatal("Failed to add a writer: %v", err)
+		}
+		if len(cfg.Log_Level) > 0 {
+			if err = lg.SetLevelString(cfg.Log_Level); err != nil {
+				lg.FatalCode(0, "Invalid Log Level \"%s\": %v", cfg.Log_Level, err)
+			}
+		}
+	}
+
+	tags, err := cfg.Tags()
+	if err != nil {
+		lg.FatalCode(0, "Failed to get tags from configuration: %v\n", err)
+		return
+	}
+	conns, err := cfg.Targets()
+	if err != nil {
+		lg.FatalCode(0, "Failed to get backend targets from configuration: %v\n", err)
+		return
+	}
+	debugout("Handling %d tags over %d targets\n", len(tags), len(conns))
+
+	lmt, err := cfg.RateLimit()
+	if err != nil {
+		lg.FatalCode(0, "Failed to get rate limit from configuration: %v\n", err)
+		return
+	}
+	debugout("Rate limiting connection to %d bps\n", lmt)
+
+	//fire up the ingesters
+	debugout("INSECURE skip TLS certificate verification: %v\n", cfg.InsecureSkipTLSVerification())
+	igCfg := ingest.UniformMuxerConfig{
+		Destinations: conns,
+		Tags:         tags,
+		Auth:         cfg.Secret(),
+		LogLevel:     cfg.LogLevel(),
+		VerifyCert:   !cfg.InsecureSkipTLSVerification(),
+		IngesterName: ingesterName,
+		RateLimitBps: lmt,
+		Logger:       lg,
+	}
+	if cfg.EnableCache() {
+		igCfg.EnableCache = true
+		igCfg.CacheConfig.FileBackingLocation = cfg.LocalFileCachePath()
+		igCfg.CacheConfig.MaxCacheSize = cfg.MaxCachedData()
+	}
+	igst, err := ingest.NewUniformMuxer(igCfg)
+	if err != nil {
+		lg.Fatal("Failed build our ingest system: %v\n", err)
+		return
+	}
+
+	defer igst.Close()
+	debugout("Started ingester muxer\n")
+	if err := igst.Start(); err != nil {
+		lg.Fatal("Failed start our ingest system: %v\n", err)
+		return
+	}
+	debugout("Waiting for connections to indexers ... ")
+	if err := igst.WaitForHot(cfg.Timeout()); err != nil {
+		lg.FatalCode(0, "Timedout waiting for backend connections: %v\n", err)
+		return
+	}
+	debugout("Successfully connected to ingesters\n")
+
+	var sockets []*zmqSocket
+	var procs []*processors.ProcessorSet
+	for k, sc := range cfg.Sockets {
+		h := &handler{
+			cfg:  sc,
+			tags: map[string]entry.EntryTag{},
+		}
+		for _, name := range append([]string{sc.tag}, topicTagNames(sc.topicTags)...) {
+			if h.tags[name], err = igst.GetTag(name); err != nil {
+				lg.Fatal("Failed to resolve tag %s for socket %s: %v\n", name, k, err)
+			}
+		}
+		if h.proc, err = cfg.Preprocessor.ProcessorSet(igst, sc.preprocessor); err != nil {
+			lg.Fatal("Preprocessor construction error: %v", err)
+		}
+		procs = append(procs, h.proc)
+		s := newZMQSocket(k, sc, h.handle)
+		if err = s.Start(); err != nil {
+			lg.Fatal("Failed to bind socket %s to %s: %v\n", k, sc.addr, err)
+		}
+		sockets = append(sockets, s)
+		debugout("Started ZeroMQ %s socket %s (%s)\n", sc.socketType, k, sc.addr)
+	}
+
+	//listen for signals so we can close gracefully
+	utils.WaitForQuit()
+
+	for _, s := range sockets {
+		if err := s.Close(); err != nil {
+			lg.Error("Failed to close ZeroMQ socket: %v\n", err)
+		}
+	}
+	for _, v := range procs {
+		if err := v.Close(); err != nil {
+			lg.Error("Failed to close processors: %v\n", err)
+		}
+	}
+
+	//sync our data and close the ingester
+	if err := igst.Sync(time.Second); err != nil {
+		lg.Error("Failed to sync: %v\n", err)
+	}
+	if err := igst.Close(); err != nil {
+		lg.Error("Failed to close: %v\n", err)
+	}
+}
+
+// handler turns the messages from a socket into entries, the socket calls it from a single
+// goroutine at a time so the timegrinder is not shared
+type handler struct {
+	cfg  *socketCfg
+	proc *processors.ProcessorSet
+	tags map[string]entry.EntryTag
+}
+
+// handle sends a message as one entry, the parts are joined unless the first is a topic
+// frame.  Topic-Tag prefixes are matched against the topic frame or the start of the data.
+func (h *handler) handle(parts [][]byte) error {
+	var topic []byte
+	if h.cfg.topicFrame {
+		topic, parts = parts[0], parts[1:]
+	}
+	var data []byte
+	if len(parts) == 1 {
+		data = parts[0]
+	} else {
+		data = bytes.Join(parts, nil)
+	}
+	if len(data) == 0 {
+		return nil
+	} else if !h.cfg.topicFrame {
+		topic = data
+	}
+	ent := &entry.Entry{
+		TS:   entry.Now(),
+		SRC:  h.cfg.srcOverride,
+		Tag:  h.tags[h.cfg.tagFor(topic)],
+		Data: data,
+	}
+	if h.cfg.tg != nil {
+		if ts, ok, err := h.cfg.tg.Extract(ent.Data); err == nil && ok {
+			ent.TS = entry.FromStandard(ts)
+		}
+	}
+	return h.proc.Process(ent)
+}
+
+func topicTagNames(tts []topicTag) (names []string) {
+	for _, tt := range tts {
+		names = append(names, tt.tag)
+	}
+	return
+}
+
+func debugout(format string, args ...interface{}) {
+	if !v {
+		return
+	}
+	fmt.Printf(format, args...)
+}
@@ -0,0 +1,320 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	dialTimeout       = 10 * time.Second
+	handshakeTimeout  = 30 * time.Second
+	writeTimeout      = 10 * time.Second
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+)
+
+var (
+	ErrSocketClosed = errors.New("socket closed")
+)
+
+// zmqSocket is a SUB or PULL socket that either connects to a single peer, reconnecting with
+// a backoff, or binds and accepts any number of peers.  Messages from every peer are passed
+// to handle one at a time.  ZeroMQ has no acknowledgements, messages in flight when a
+// connection drops are lost just as they are with libzmq.
+type zmqSocket struct {
+	name   string
+	cfg    *socketCfg
+	handle func(parts [][]byte) error
+	hmtx   sync.Mutex //serializes handle between peers
+
+	mtx   sync.Mutex
+	lst   net.Listener
+	conns map[net.Conn]bool
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newZMQSocket(name string, cfg *socketCfg, handle func([][]byte) error) *zmqSocket {
+	return &zmqSocket{
+		name:   name,
+		cfg:    cfg,
+		handle: handle,
+		conns:  map[net.Conn]bool{},
+		done:   make(chan struct{}),
+	}
+}
+
+// Start binds the listening socket or starts connecting, only binding can fail
+func (s *zmqSocket) Start() error {
+	if !s.cfg.bind {
+		s.wg.Add(1)
+		go s.connectLoop()
+		return nil
+	}
+	if s.cfg.network == `unix` {
+		//like libzmq, a socket file left behind by a previous run is replaced
+		if fi, err := os.Lstat(s.cfg.addr); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(s.cfg.addr)
+		}
+	}
+	lst, err := net.Listen(s.cfg.network, s.cfg.addr)
+	if err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	s.lst = lst
+	s.mtx.Unlock()
+	s.wg.Add(1)
+	go s.acceptLoop(lst)
+	return nil
+}
+
+// Close stops accepting or connecting, closes every peer connection, and waits for them to exit
+func (s *zmqSocket) Close() error {
+	s.mtx.Lock()
+	select {
+	case <-s.done:
+		s.mtx.Unlock()
+		return ErrSocketClosed
+	default:
+	}
+	close(s.done)
+	if s.lst != nil {
+		s.lst.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *zmqSocket) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+	}
+	return false
+}
+
+// addConn tracks the connection so Close can interrupt it, false means the socket was closed
+func (s *zmqSocket) addConn(c net.Conn) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed() {
+		return false
+	}
+	s.conns[c] = true
+	return true
+}
+
+func (s *zmqSocket) delConn(c net.Conn) {
+	s.mtx.Lock()
+	delete(s.conns, c)
+	s.mtx.Unlock()
+	c.Close()
+}
+
+func (s *zmqSocket) connectLoop() {
+	defer s.wg.Done()
+	delay := minReconnectDelay
+	for {
+		connected, err := s.connect()
+		if s.closed() {
+			return
+		}
+		if connected {
+			delay = minReconnectDelay
+		}
+		lg.Error("ZeroMQ socket %s connection to %s failed, reconnecting in %v: %v", s.name, s.cfg.addr, delay, err)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+func (s *zmqSocket) connect() (connected bool, err error) {
+	conn, err := net.DialTimeout(s.cfg.network, s.cfg.addr, dialTimeout)
+	if err != nil {
+		return
+	} else if !s.addConn(conn) {
+		conn.Close()
+		return false, ErrSocketClosed
+	}
+	defer s.delConn(conn)
+	return s.session(conn)
+}
+
+func (s *zmqSocket) acceptLoop(lst net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := lst.Accept()
+		if err != nil {
+			if s.closed() {
+				return
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				time.Sleep(minReconnectDelay)
+				continue
+			}
+			lg.Error("ZeroMQ socket %s stopped accepting on %s: %v", s.name, s.cfg.addr, err)
+			return
+		}
+		if !s.addConn(conn) {
+			conn.Close()
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.delConn(conn)
+			if _, err := s.session(conn); err != nil && !s.closed() {
+				lg.Info("ZeroMQ socket %s peer %v disconnected: %v", s.name, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+func (s *zmqSocket) write(conn net.Conn, f frame) error {
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := conn.Write(f.encode())
+	return err
+}
+
+// session runs the handshake and reads messages until the connection fails, connected is
+// true once the peer completed the handshake
+func (s *zmqSocket) session(conn net.Conn) (connected bool, err error) {
+	rdr := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if _, err = conn.Write(greeting(s.cfg.bind)); err != nil {
+		return
+	} else if err = readGreeting(rdr); err != nil {
+		return
+	}
+	ready := commandFrame(cmdReady, metadata(map[string]string{propSocketType: s.cfg.socketType}))
+	if err = s.write(conn, ready); err != nil {
+		return
+	}
+	if err = s.peerReady(rdr); err != nil {
+		return
+	}
+	connected = true
+	//publishers and pushers may be quiet for any length of time
+	conn.SetDeadline(time.Time{})
+	debugout("ZeroMQ socket %s connected to %v\n", s.name, conn.RemoteAddr())
+	if s.cfg.socketType == socketSUB {
+		for _, prefix := range s.cfg.subscribe {
+			if err = s.write(conn, subscribeFrame(prefix)); err != nil {
+				return
+			}
+		}
+	}
+
+	var parts [][]byte
+	var size int
+	for {
+		var f frame
+		if f, err = readFrame(rdr, maxMessageSize-size); err != nil {
+			return
+		}
+		if f.command() {
+			if err = s.handleCommand(conn, f); err != nil {
+				return
+			}
+			continue
+		}
+		parts = append(parts, f.body)
+		size += len(f.body)
+		if f.more() {
+			if len(parts) >= maxMessageParts {
+				err = ErrMessageTooLarge
+				return
+			}
+			continue
+		}
+		s.hmtx.Lock()
+		err = s.handle(parts)
+		s.hmtx.Unlock()
+		if err != nil {
+			return
+		}
+		parts, size = nil, 0
+	}
+}
+
+// peerReady reads the peer's READY command and checks that its socket type can talk to ours
+func (s *zmqSocket) peerReady(rdr *bufio.Reader) error {
+	f, err := readFrame(rdr, maxMessageSize)
+	if err != nil {
+		return err
+	} else if !f.command() {
+		return ErrMalformedFrame
+	}
+	cmd, err := parseCommand(f)
+	if err != nil {
+		return err
+	}
+	switch cmd.name {
+	case cmdReady:
+	case cmdError:
+		return fmt.Errorf("peer refused the handshake: %q", commandReason(cmd))
+	default:
+		return fmt.Errorf("expected READY, got %q", cmd.name)
+	}
+	props, err := parseMetadata(cmd.data)
+	if err != nil {
+		return err
+	}
+	if peer := props[`socket-type`]; !compatiblePeer(s.cfg.socketType, peer) {
+		return fmt.Errorf("%v, %s sockets cannot talk to %q", ErrIncompatiblePeer, s.cfg.socketType, peer)
+	}
+	return nil
+}
+
+// handleCommand answers ZMTP 3.1 heartbeats and fails on ERROR, other commands are ignored
+func (s *zmqSocket) handleCommand(conn net.Conn, f frame) error {
+	cmd, err := parseCommand(f)
+	if err != nil {
+		return err
+	}
+	switch cmd.name {
+	case cmdPing:
+		//the ping holds a 2 byte TTL followed by a context echoed in the pong
+		if len(cmd.data) < 2 {
+			return ErrMalformedFrame
+		}
+		return s.write(conn, commandFrame(cmdPong, cmd.data[2:]))
+	case cmdError:
+		return fmt.Errorf("peer sent ERROR: %q", commandReason(cmd))
+	}
+	return nil
+}
+
+// commandReason extracts the reason from an ERROR command
+func commandReason(cmd command) string {
+	if len(cmd.data) == 0 || int(cmd.data[0]) >= len(cmd.data) {
+		return ``
+	}
+	return string(cmd.data[1 : 1+cmd.data[0]])
+}
@@ -0,0 +1,222 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The subset of ZMTP 3.0 (https://rfc.zeromq.org/spec/23/) needed by SUB and PULL sockets using
+// the NULL security mechanism.  The greeting advertises version 3.0 so peers speaking 3.1 fall
+// back to message based subscriptions and do not expect heartbeats.
+const (
+	greetingSize  = 64
+	signatureSize = 10
+	versionMajor  = 3
+	versionMinor  = 0
+
+	flagMore    byte = 0x01
+	flagLong    byte = 0x02
+	flagCommand byte = 0x04
+
+	maxMessageSize  = 8 * 1024 * 1024 //largest message, summed over its parts
+	maxMessageParts = 1024
+
+	cmdReady = `READY`
+	cmdError = `ERROR`
+	cmdPing  = `PING`
+	cmdPong  = `PONG`
+
+	socketSUB  = `SUB`
+	socketPULL = `PULL`
+	socketPUB  = `PUB`
+	socketXPUB = `XPUB`
+	socketPUSH = `PUSH`
+
+	mechanismNull  = `NULL`
+	propSocketType = `Socket-Type`
+)
+
+var (
+	ErrBadGreeting      = errors.New("peer did not send a ZMTP greeting")
+	ErrBadVersion       = errors.New("peer does not speak ZMTP 3")
+	ErrBadMechanism     = errors.New("peer does not use the NULL security mechanism")
+	ErrMalformedFrame   = errors.New("malformed ZMTP frame")
+	ErrMessageTooLarge  = fmt.Errorf("message larger than %d bytes", maxMessageSize)
+	ErrIncompatiblePeer = errors.New("peer socket type is not compatible")
+)
+
+// greeting builds the 64 byte greeting for the NULL mechanism
+func greeting(asServer bool) []byte {
+	g := make([]byte, greetingSize)
+	g[0] = 0xff
+	g[9] = 0x7f
+	g[10] = versionMajor
+	g[11] = versionMinor
+	copy(g[12:32], mechanismNull)
+	if asServer {
+		g[32] = 1
+	}
+	return g
+}
+
+// readGreeting checks the peer greeting, any 3.x minor version is accepted
+func readGreeting(r io.Reader) error {
+	g := make([]byte, greetingSize)
+	if _, err := io.ReadFull(r, g[:signatureSize]); err != nil {
+		return err
+	} else if g[0] != 0xff || g[9]&0x01 != 0x01 {
+		return ErrBadGreeting
+	}
+	if _, err := io.ReadFull(r, g[signatureSize:]); err != nil {
+		return err
+	} else if g[10] < versionMajor {
+		return ErrBadVersion
+	} else if mech := string(bytes.TrimRight(g[12:32], "\x00")); mech != mechanismNull {
+		return fmt.Errorf("%v, it asked for %q", ErrBadMechanism, mech)
+	}
+	return nil
+}
+
+type frame struct {
+	flags byte
+	body  []byte
+}
+
+func (f frame) more() bool {
+	return f.flags&flagMore != 0
+}
+
+func (f frame) command() bool {
+	return f.flags&flagCommand != 0
+}
+
+func (f frame) encode() []byte {
+	var b []byte
+	flags := f.flags &^ flagLong
+	if len(f.body) > 255 {
+		b = make([]byte, 9, 9+len(f.body))
+		b[0] = flags | flagLong
+		binary.BigEndian.PutUint64(b[1:], uint64(len(f.body)))
+	} else {
+		b = []byte{flags, byte(len(f.body))}
+	}
+	return append(b, f.body...)
+}
+
+// readFrame reads a frame, limit bounds its size
+func readFrame(r *bufio.Reader, limit int) (f frame, err error) {
+	if f.flags, err = r.ReadByte(); err != nil {
+		return
+	} else if f.flags&^(flagMore|flagLong|flagCommand) != 0 {
+		err = ErrMalformedFrame
+		return
+	}
+	var sz uint64
+	if f.flags&flagLong != 0 {
+		var b [8]byte
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return
+		}
+		sz = binary.BigEndian.Uint64(b[:])
+	} else {
+		var c byte
+		if c, err = r.ReadByte(); err != nil {
+			return
+		}
+		sz = uint64(c)
+	}
+	if sz > uint64(limit) {
+		err = ErrMessageTooLarge
+		return
+	}
+	f.body = make([]byte, sz)
+	_, err = io.ReadFull(r, f.body)
+	return
+}
+
+type command struct {
+	name string
+	data []byte
+}
+
+func commandFrame(name string, data []byte) frame {
+	body := append([]byte{byte(len(name))}, name...)
+	return frame{flags: flagCommand, body: append(body, data...)}
+}
+
+func parseCommand(f frame) (c command, err error) {
+	if len(f.body) == 0 {
+		err = ErrMalformedFrame
+		return
+	}
+	n := int(f.body[0])
+	if n >= len(f.body) {
+		err = ErrMalformedFrame
+		return
+	}
+	c.name = string(f.body[1 : 1+n])
+	c.data = f.body[1+n:]
+	return
+}
+
+// metadata encodes the READY properties
+func metadata(props map[string]string) (b []byte) {
+	for k, v := range props {
+		b = append(b, byte(len(k)))
+		b = append(b, k...)
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(v)))
+		b = append(b, l[:]...)
+		b = append(b, v...)
+	}
+	return
+}
+
+// parseMetadata decodes READY properties, names are case insensitive
+func parseMetadata(b []byte) (map[string]string, error) {
+	props := map[string]string{}
+	for len(b) > 0 {
+		nl := int(b[0])
+		if len(b) < 1+nl+4 {
+			return nil, ErrMalformedFrame
+		}
+		name := string(b[1 : 1+nl])
+		b = b[1+nl:]
+		vl := binary.BigEndian.Uint32(b)
+		if uint64(len(b)-4) < uint64(vl) {
+			return nil, ErrMalformedFrame
+		}
+		props[strings.ToLower(name)] = string(b[4 : 4+vl])
+		b = b[4+vl:]
+	}
+	return props, nil
+}
+
+// compatiblePeer reports whether a peer socket type may talk to our socket type
+func compatiblePeer(ours, peer string) bool {
+	switch ours {
+	case socketSUB:
+		return peer == socketPUB || peer == socketXPUB
+	case socketPULL:
+		return peer == socketPUSH
+	}
+	return false
+}
+
+// subscribeFrame is a ZMTP 3.0 subscription message for a topic prefix
+func subscribeFrame(prefix string) frame {
+	return frame{body: append([]byte{1}, prefix...)}
+}
@@ -0,0 +1,249 @@
+/*************************************************************************
+ * Copyright 2020 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrames(t *testing.T) {
+	for _, f := range []frame{
+		{flags: flagMore, body: []byte(`topic`)},
+		{body: bytes.Repeat([]byte(`x`), 300)},
+		commandFrame(cmdReady, metadata(map[string]string{propSocketType: socketPUB})),
+	} {
+		r, err := readFrame(bufio.NewReader(bytes.NewReader(f.encode())), maxMessageSize)
+		if err != nil {
+			t.Fatal(err)
+		} else if r.flags&^flagLong != f.flags || !bytes.Equal(r.body, f.body) {
+			t.Fatalf("bad frame %+v", r)
+		}
+	}
+	big := frame{body: make([]byte, 1024)}
+	if _, err := readFrame(bufio.NewReader(bytes.NewReader(big.encode())), 512); err != ErrMessageTooLarge {
+		t.Fatalf("oversized frame not rejected: %v", err)
+	}
+	cmd, err := parseCommand(commandFrame(cmdReady, metadata(map[string]string{propSocketType: socketPUSH, `Identity`: ``})))
+	if err != nil {
+		t.Fatal(err)
+	} else if props, err := parseMetadata(cmd.data); err != nil {
+		t.Fatal(err)
+	} else if cmd.name != cmdReady || props[`socket-type`] != socketPUSH || len(props) != 2 {
+		t.Fatalf("bad READY %+v %v", cmd, props)
+	}
+	if _, err = parseMetadata([]byte{4, 'a'}); err == nil {
+		t.Fatal("truncated metadata accepted")
+	}
+	//a name length of 255 must not wrap when the body is long enough to hold it
+	long := frame{flags: flagCommand, body: append([]byte{255}, bytes.Repeat([]byte(`x`), 300)...)}
+	if cmd, err = parseCommand(long); err != nil || len(cmd.name) != 255 || len(cmd.data) != 45 {
+		t.Fatalf("bad long command %v %d %d", err, len(cmd.name), len(cmd.data))
+	}
+	for _, b := range [][]byte{nil, {5, 'R', 'E', 'A', 'D'}, append([]byte{255}, bytes.Repeat([]byte(`x`), 254)...)} {
+		if _, err = parseCommand(frame{flags: flagCommand, body: b}); err != ErrMalformedFrame {
+			t.Fatalf("malformed command %x returned %v", b, err)
+		}
+	}
+}
+
+// fakePeer plays the remote end of a connection
+type fakePeer struct {
+	t    *testing.T
+	conn net.Conn
+	rdr  *bufio.Reader
+}
+
+func newFakePeer(t *testing.T, conn net.Conn) *fakePeer {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return &fakePeer{t: t, conn: conn, rdr: bufio.NewReader(conn)}
+}
+
+func (fp *fakePeer) send(f frame) {
+	if _, err := fp.conn.Write(f.encode()); err != nil {
+		fp.t.Fatal(err)
+	}
+}
+
+func (fp *fakePeer) read() frame {
+	f, err := readFrame(fp.rdr, maxMessageSize)
+	if err != nil {
+		fp.t.Fatal(err)
+	}
+	return f
+}
+
+// handshake exchanges greetings and READY commands, returning the socket type the other side sent
+func (fp *fakePeer) handshake(socketType string) string {
+	if _, err := fp.conn.Write(greeting(false)); err != nil {
+		fp.t.Fatal(err)
+	} else if err = readGreeting(fp.rdr); err != nil {
+		fp.t.Fatal(err)
+	}
+	fp.send(commandFrame(cmdReady, metadata(map[string]string{propSocketType: socketType})))
+	cmd, err := parseCommand(fp.read())
+	if err != nil {
+		fp.t.Fatal(err)
+	}
+	props, err := parseMetadata(cmd.data)
+	if err != nil || cmd.name != cmdReady {
+		fp.t.Fatalf("bad READY %+v %v", cmd, err)
+	}
+	return props[`socket-type`]
+}
+
+type capture struct {
+	msgs chan [][]byte
+}
+
+func newCapture() *capture {
+	return &capture{msgs: make(chan [][]byte, 16)}
+}
+
+func (c *capture) handle(parts [][]byte) error {
+	c.msgs <- parts
+	return nil
+}
+
+func (c *capture) next(t *testing.T) [][]byte {
+	select {
+	case m := <-c.msgs:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+func TestConnectSUB(t *testing.T) {
+	lst, err := net.Listen(`tcp`, `127.0.0.1:0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lst.Close()
+	cp := newCapture()
+	s := newZMQSocket(`test`, &socketCfg{
+		network:    `tcp`,
+		addr:       lst.Addr().String(),
+		socketType: socketSUB,
+		subscribe:  []string{`logs.`, `metrics.`},
+	}, cp.handle)
+	if err = s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	conn, err := lst.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := newFakePeer(t, conn)
+	if st := fp.handshake(socketPUB); st != socketSUB {
+		t.Fatalf("bad socket type %q", st)
+	}
+	for _, exp := range []string{"\x01logs.", "\x01metrics."} {
+		if f := fp.read(); string(f.body) != exp {
+			t.Fatalf("bad subscription %q", f.body)
+		}
+	}
+	//heartbeats from 3.1 peers are answered
+	fp.send(commandFrame(cmdPing, []byte{0, 10, 'c', 't', 'x'}))
+	if cmd, err := parseCommand(fp.read()); err != nil || cmd.name != cmdPong || string(cmd.data) != `ctx` {
+		t.Fatalf("bad PONG %+v %v", cmd, err)
+	}
+	fp.send(frame{flags: flagMore, body: []byte(`logs.app`)})
+	fp.send(frame{body: []byte(`hello`)})
+	fp.send(frame{body: []byte(`logs.single`)})
+	if m := cp.next(t); len(m) != 2 || string(m[0]) != `logs.app` || string(m[1]) != `hello` {
+		t.Fatalf("bad message %q", m)
+	} else if m = cp.next(t); len(m) != 1 || string(m[0]) != `logs.single` {
+		t.Fatalf("bad message %q", m)
+	}
+
+	//the socket reconnects after the peer goes away
+	conn.Close()
+	lst.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+	if conn, err = lst.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	newFakePeer(t, conn).handshake(socketPUB)
+}
+
+func TestBindPULL(t *testing.T) {
+	path := filepath.Join(tmpDir, `zmq.sock`)
+	cp := newCapture()
+	s := newZMQSocket(`test`, &socketCfg{
+		network:    `unix`,
+		addr:       path,
+		bind:       true,
+		socketType: socketPULL,
+	}, cp.handle)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	//any number of pushers may connect
+	for _, msg := range []string{`first`, `second`} {
+		conn, err := net.Dial(`unix`, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp := newFakePeer(t, conn)
+		if st := fp.handshake(socketPUSH); st != socketPULL {
+			t.Fatalf("bad socket type %q", st)
+		}
+		fp.send(frame{body: []byte(msg)})
+		if m := cp.next(t); len(m) != 1 || string(m[0]) != msg {
+			t.Fatalf("bad message %q", m)
+		}
+		defer conn.Close()
+	}
+
+	//an incompatible peer is disconnected before it can send
+	conn, err := net.Dial(`unix`, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fp := newFakePeer(t, conn)
+	fp.handshake(socketPUB)
+	fp.conn.Write(frame{body: []byte(`ignored`)}.encode())
+	if _, err = readFrame(fp.rdr, maxMessageSize); err == nil {
+		t.Fatal("incompatible peer was not disconnected")
+	}
+	select {
+	case m := <-cp.msgs:
+		t.Fatalf("message from incompatible peer %q", m)
+	default:
+	}
+}
+
+func TestBadGreeting(t *testing.T) {
+	srv, cli := net.Pipe()
+	s := newZMQSocket(`test`, &socketCfg{socketType: socketPULL, bind: true}, nil)
+	//pipes are unbuffered, so the peer drains the greeting while it sends its own
+	go io.Copy(ioutil.Discard, cli)
+	go func() {
+		g := greeting(false)
+		copy(g[12:32], "CURVE\x00")
+		cli.Write(g)
+	}()
+	if _, err := s.session(srv); err == nil || !strings.Contains(err.Error(), `CURVE`) {
+		t.Fatalf("CURVE peer not refused: %v", err)
+	}
+	cli.Close()
+}